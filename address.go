@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// AddressConsensusPeers is how many distinct peers must report the same
+	// source IP before we believe our public address has changed
+	AddressConsensusPeers = 3
+
+	// AddressObservationMaxAge drops reports from peers we haven't heard from recently
+	AddressObservationMaxAge = 1 * time.Hour
+
+	// AddressChangeCooldown is the minimum time between advertised address changes
+	// Keeps a node with a misbehaving NAT from flapping its announced address
+	AddressChangeCooldown = 15 * time.Minute
+
+	// AddressProbePeers is how many peers we ask to reach us at a new address before moving
+	AddressProbePeers = 3
+)
+
+// addressObservation is one peer's view of our source IP
+type addressObservation struct {
+	ip   string
+	seen time.Time
+}
+
+// AddressDetector learns our public IP from what responding peers saw as our source address
+// Only the host part is learned - the advertised port always comes from -public-address
+type AddressDetector struct {
+	mu           sync.Mutex
+	observations map[uuid.UUID]addressObservation
+	lastChange   time.Time
+}
+
+// NewAddressDetector creates an empty detector
+func NewAddressDetector() *AddressDetector {
+	return &AddressDetector{
+		observations: make(map[uuid.UUID]addressObservation),
+	}
+}
+
+// EnableAddressDetection turns on public address auto-detection for this node
+func (dht *DHT) EnableAddressDetection() {
+	dht.addressDetector = NewAddressDetector()
+	log.Printf("Public address auto-detection enabled (advertising %s until peers agree otherwise)", dht.advertisedAddress())
+}
+
+// observedRemoteIP returns the caller's IP as seen by this server
+func observedRemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// observeAddress records the source IP a peer reported for us and switches
+// our advertised address once enough peers agree on a new one
+func (dht *DHT) observeAddress(peerID uuid.UUID, observed string) {
+	if dht.addressDetector == nil || observed == "" {
+		return
+	}
+
+	ip := net.ParseIP(observed)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		// LAN peers see our LAN address, which says nothing about our public one
+		return
+	}
+
+	newIP, ok := dht.addressDetector.record(peerID, ip.String())
+	if !ok {
+		return
+	}
+
+	current := dht.advertisedAddress()
+	host, port, err := net.SplitHostPort(current)
+	if err != nil || host == newIP {
+		return
+	}
+	if net.ParseIP(host) == nil {
+		// Advertising a DNS name - that's already how dynamic IPs are followed
+		return
+	}
+	dht.addressDetector.markChanged()
+
+	// Peers can agree on an address nobody can reach us at (another NAT in front, or
+	// peers lying), so one has to reach us there first. A failed probe also waits out
+	// the cooldown, so it isn't retried on every response
+	newAddr := net.JoinHostPort(newIP, port)
+	go func() {
+		if !dht.probeAddress(newAddr) {
+			log.Printf("Peers report our public address as %s, but none could reach us there; keeping %s", newAddr, current)
+			return
+		}
+		log.Printf("Public address changed: %s -> %s (reported by %d peers, reachable)",
+			current, newAddr, AddressConsensusPeers)
+		dht.moveAdvertisedAddress(newAddr)
+	}()
+}
+
+// probeAddress asks peers to ping us back at addr, and reports whether one reached us
+// there as ourselves
+func (dht *DHT) probeAddress(addr string) bool {
+	asked := 0
+	for _, peer := range dht.routingTable.GetAllRoutingTableNodes() {
+		if asked == AddressProbePeers {
+			break
+		}
+		if peer.PeerAddress == "" || !dht.peerSupports(peer.ID, CapPingBack) {
+			continue
+		}
+		asked++
+		msg, err := NewRelayedPingRequest(dht.localSystem, peer.ID, dht.localSystem.ID, "")
+		if err != nil {
+			return false
+		}
+		msg.PingBack = addr
+		resp, err := dht.sendRequest(peer.PeerAddress, msg)
+		if err != nil {
+			continue
+		}
+		if resp.Relayed != nil && resp.Relayed.ID == dht.localSystem.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// pingBack pings requester at the address it's about to advertise, for probeAddress
+// Only at the IP the request came from, so nobody can point us at a third party
+func (dht *DHT) pingBack(requester *System, addr, sourceIP string) (*System, string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil || !net.ParseIP(host).Equal(net.ParseIP(sourceIP)) {
+		return nil, "ping_back must be at the IP the request came from"
+	}
+	if !dht.relayedPings.allow(requester.ID) {
+		return nil, "too many relayed pings, try again later"
+	}
+
+	msg, err := NewPingRequest(dht.localSystem, requester.ID, "")
+	if err != nil {
+		return nil, err.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RelayedPingTimeout)
+	defer cancel()
+	resp, err := dht.sendRequestContext(ctx, addr, msg)
+	if err != nil {
+		return nil, "unreachable: " + err.Error()
+	}
+	if resp.FromSystem == nil || resp.FromSystem.ID != requester.ID {
+		return nil, "another system answers there"
+	}
+	return resp.FromSystem, ""
+}
+
+// record stores an observation and returns the IP that has reached consensus, if any
+// Returns ok=false while in cooldown or when no IP has enough agreeing peers
+func (ad *AddressDetector) record(peerID uuid.UUID, ip string) (string, bool) {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+
+	now := time.Now()
+	ad.observations[peerID] = addressObservation{ip: ip, seen: now}
+
+	if !ad.lastChange.IsZero() && now.Sub(ad.lastChange) < AddressChangeCooldown {
+		return "", false
+	}
+
+	counts := make(map[string]int)
+	for id, obs := range ad.observations {
+		if now.Sub(obs.seen) > AddressObservationMaxAge {
+			delete(ad.observations, id)
+			continue
+		}
+		counts[obs.ip]++
+	}
+
+	if counts[ip] < AddressConsensusPeers {
+		return "", false
+	}
+	return ip, true
+}
+
+// markChanged starts the cooldown after the advertised address was switched
+func (ad *AddressDetector) markChanged() {
+	ad.mu.Lock()
+	ad.lastChange = time.Now()
+	ad.mu.Unlock()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// AddressConflictLogAge is how long resolved conflicts stay in the address_conflicts log
+	AddressConflictLogAge = 7 * 24 * time.Hour
+
+	// addressConflictCheckInterval is how often conflicts nobody settled are pinged again
+	addressConflictCheckInterval = 5 * time.Minute
+)
+
+// addressConflicts queues cached systems that claim the same peer address
+// Addresses legitimately move between systems (DHCP churn, a reinstall under a new UUID),
+// so a conflict isn't an error: whoever answers at the address keeps it
+type addressConflicts struct {
+	mu      sync.Mutex
+	pending map[uuid.UUID]bool // Systems to ping to settle who owns their address
+	wake    chan struct{}
+}
+
+func newAddressConflicts() *addressConflicts {
+	return &addressConflicts{
+		pending: make(map[uuid.UUID]bool),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// queue schedules verification pings for ids, right away
+func (ac *addressConflicts) queue(ids ...uuid.UUID) {
+	ac.retry(ids...)
+	select {
+	case ac.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retry schedules verification pings for ids at the next check
+func (ac *addressConflicts) retry(ids ...uuid.UUID) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for _, id := range ids {
+		ac.pending[id] = true
+	}
+}
+
+// take empties the queue
+func (ac *addressConflicts) take() []uuid.UUID {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ids := make([]uuid.UUID, 0, len(ac.pending))
+	for id := range ac.pending {
+		ids = append(ids, id)
+	}
+	ac.pending = make(map[uuid.UUID]bool)
+	return ids
+}
+
+// addressKey is a peer address as the address index keys it ("" for none)
+func addressKey(address string) string {
+	if address == "" {
+		return ""
+	}
+	if n, err := NormalizePeerAddress(address); err == nil {
+		return n
+	}
+	return address
+}
+
+// indexAddress adds a cached system to the address index (caller holds cacheMu)
+// Returns the other systems already claiming its address; all of them are marked conflicted
+func (rt *RoutingTable) indexAddress(cached *CachedSystem) []uuid.UUID {
+	key := addressKey(cached.System.PeerAddress)
+	if key == "" {
+		return nil
+	}
+	ids := rt.byAddress[key]
+	if ids == nil {
+		ids = make(map[uuid.UUID]bool)
+		rt.byAddress[key] = ids
+	}
+	ids[cached.System.ID] = true
+	if len(ids) == 1 {
+		return nil
+	}
+
+	var others []uuid.UUID
+	for id := range ids {
+		if id == cached.System.ID {
+			continue
+		}
+		others = append(others, id)
+		if other, ok := rt.systemCache[id]; ok {
+			other.AddressConflict = true
+		}
+	}
+	cached.AddressConflict = true
+	return others
+}
+
+// unindexAddress removes a cached system from the address index (caller holds cacheMu)
+// A system left alone at the address is no longer conflicted
+func (rt *RoutingTable) unindexAddress(cached *CachedSystem) {
+	key := addressKey(cached.System.PeerAddress)
+	ids := rt.byAddress[key]
+	if ids == nil {
+		return
+	}
+	delete(ids, cached.System.ID)
+	cached.AddressConflict = false
+
+	switch len(ids) {
+	case 0:
+		delete(rt.byAddress, key)
+	case 1:
+		for id := range ids {
+			if other, ok := rt.systemCache[id]; ok {
+				other.AddressConflict = false
+			}
+		}
+	}
+}
+
+// systemsAtAddress returns the cached systems claiming address, most recently verified first
+// (caller holds cacheMu)
+func (rt *RoutingTable) systemsAtAddress(address string) []*CachedSystem {
+	var systems []*CachedSystem
+	for id := range rt.byAddress[addressKey(address)] {
+		if cached, ok := rt.systemCache[id]; ok {
+			systems = append(systems, cached)
+		}
+	}
+	sort.Slice(systems, func(i, j int) bool {
+		if !systems[i].LastVerified.Equal(systems[j].LastVerified) {
+			return systems[i].LastVerified.After(systems[j].LastVerified)
+		}
+		return systems[i].System.ID.String() < systems[j].System.ID.String()
+	})
+	return systems
+}
+
+// reportAddressConflict logs a newly detected conflict and queues everyone involved for a ping
+func (rt *RoutingTable) reportAddressConflict(sys *System, others []uuid.UUID) {
+	for _, other := range others {
+		log.Printf("Address conflict: %s (%s) and %s both claim %s - checking who answers there",
+			sys.Name, sys.ID.String()[:8], other.String()[:8], sys.PeerAddress)
+		if rt.storage != nil {
+			if err := rt.storage.LogAddressConflict(addressKey(sys.PeerAddress), sys.ID, other); err != nil {
+				log.Printf("Failed to log address conflict: %v", err)
+			}
+		}
+	}
+	rt.conflicts.queue(append(others, sys.ID)...)
+}
+
+// addressConflictLoop pings systems that share an address until one owner is left
+func (dht *DHT) addressConflictLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskAddressConflicts, every(addressConflictCheckInterval))
+
+	ticker := time.NewTicker(addressConflictCheckInterval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(addressConflictCheckInterval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(addressConflictCheckInterval))
+		case <-dht.routingTable.conflicts.wake:
+		case <-t.trigger:
+		}
+		t.run(func() (int, error) { return dht.resolveAddressConflicts(), nil })
+	}
+}
+
+// resolveAddressConflicts pings every queued system at its address. PingNode drops an
+// entry when a different UUID answers there, which leaves the address to the one that did
+// Conflicts still open afterwards (nobody answered) are retried next interval
+// Returns how many systems were pinged
+func (dht *DHT) resolveAddressConflicts() int {
+	ids := dht.routingTable.conflicts.take()
+
+	addresses := make(map[string]bool)
+	pinged := 0
+	for _, id := range ids {
+		sys := dht.routingTable.GetCachedSystem(id)
+		if sys == nil || sys.PeerAddress == "" {
+			continue
+		}
+		addresses[sys.PeerAddress] = true
+		pinged++
+		if err := dht.PingNode(sys); err != nil {
+			log.Printf("Address conflict: %s (%s) unreachable at %s: %v", sys.Name, sys.ID.String()[:8], sys.PeerAddress, err)
+		}
+	}
+
+	for address := range addresses {
+		owners := dht.routingTable.GetSystemsAtAddress(address)
+		switch {
+		case len(owners) == 1:
+			log.Printf("Address conflict at %s resolved: %s (%s) answers there", address, owners[0].Name, owners[0].ID.String()[:8])
+			if err := dht.storage.ResolveAddressConflicts(addressKey(address), owners[0].ID); err != nil {
+				log.Printf("Failed to log address conflict resolution: %v", err)
+			}
+		case len(owners) > 1:
+			for _, sys := range owners {
+				dht.routingTable.conflicts.retry(sys.ID)
+			}
+		}
+	}
+	return pinged
+}
+
+// GetSystemsAtAddress returns the cached systems claiming address, most recently verified first
+func (rt *RoutingTable) GetSystemsAtAddress(address string) []*System {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+
+	cached := rt.systemsAtAddress(address)
+	systems := make([]*System, len(cached))
+	for i, c := range cached {
+		systems[i] = c.System
+	}
+	return systems
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// When our advertised address changes, peers that cached the old one keep trying it and
+// show us as degraded until our next announce reaches them. So a move is announced to
+// every routing table peer right away, and a few of them are asked to pass our signed
+// info on to their own peers once (info_relay). Those copies are applied like any other
+// gossip, through the InfoVersion and signature checks, and are never relayed further.
+
+const (
+	// AddressRelayHelpers is how many peers we ask to pass our moved info on
+	AddressRelayHelpers = 3
+
+	// InfoRelayCooldown is how often we pass on one system's info, however often it asks
+	InfoRelayCooldown = AddressChangeCooldown
+)
+
+// infoRelays remembers whose info we passed on recently
+type infoRelays struct {
+	mu   sync.Mutex
+	last map[uuid.UUID]time.Time
+}
+
+func newInfoRelays() *infoRelays {
+	return &infoRelays{last: make(map[uuid.UUID]time.Time)}
+}
+
+// allow reports whether id's info may be relayed now, and if so starts its cooldown
+func (r *infoRelays) allow(id uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for other, at := range r.last {
+		if now.Sub(at) >= InfoRelayCooldown {
+			delete(r.last, other)
+		}
+	}
+	if _, ok := r.last[id]; ok {
+		return false
+	}
+	r.last[id] = now
+	return true
+}
+
+// moveAdvertisedAddress switches the address we advertise at runtime and announces the move
+// The move is signed on a copy and swapped in under localMu, so no message or handler
+// ever sees the new address with the old signature
+func (dht *DHT) moveAdvertisedAddress(newAddr string) {
+	dht.localMu.Lock()
+	previous := dht.localSystem.PeerAddress
+	updated := *dht.localSystem
+	updated.PeerAddress = newAddr
+	updated.BumpInfoVersion()
+	if err := dht.storage.SaveSystem(&updated); err != nil {
+		log.Printf("Warning: failed to save new public address: %v", err)
+	}
+	dht.localSystem.PeerAddress = updated.PeerAddress
+	dht.localSystem.InfoVersion = updated.InfoVersion
+	dht.localSystem.InfoSignature = updated.InfoSignature
+	dht.localMu.Unlock()
+
+	// Let the network know right away rather than waiting for the next announce cycle
+	dht.announceAddressChange(previous)
+}
+
+// advertisedAddress returns the peer address we currently advertise
+func (dht *DHT) advertisedAddress() string {
+	dht.localMu.RLock()
+	defer dht.localMu.RUnlock()
+	return dht.localSystem.PeerAddress
+}
+
+// announceAddressChange tells the network we now advertise a different address than previous
+// Helpers get a relaying announce straight away; every other routing table peer missing
+// our current info gets one on the next announce tick
+func (dht *DHT) announceAddressChange(previous string) {
+	peers := dht.routingTable.GetAllRoutingTableNodesWithMeta()
+	helpers := dht.relayHelpers(peers)
+	log.Printf("Advertised address moved from %s to %s: announcing to %d peers, %d passing it on",
+		previous, dht.advertisedAddress(), len(peers), len(helpers))
+
+	isHelper := make(map[uuid.UUID]bool)
+	for _, sys := range helpers {
+		isHelper[sys.ID] = true
+	}
+	var rest []*System
+	for _, cached := range peers {
+		if !isHelper[cached.System.ID] {
+			rest = append(rest, cached.System)
+		}
+	}
+	dht.scheduleAnnounces(rest, 0)
+
+	for _, sys := range helpers {
+		go func(sys *System) {
+			if err := dht.announceTo(sys, true); err != nil {
+				log.Printf("  Failed to announce our move to %s: %v", sys.Name, err)
+			}
+		}(sys)
+	}
+}
+
+// relayHelpers picks the most recently verified peers that can relay our info
+func (dht *DHT) relayHelpers(peers []*CachedSystem) []*System {
+	var candidates []*CachedSystem
+	for _, cached := range peers {
+		if cached.System.PeerAddress != "" && dht.peerSupports(cached.System.ID, CapInfoRelay) {
+			candidates = append(candidates, cached)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastVerified.After(candidates[j].LastVerified)
+	})
+
+	var helpers []*System
+	for _, cached := range candidates {
+		if len(helpers) == AddressRelayHelpers {
+			break
+		}
+		helpers = append(helpers, cached.System)
+	}
+	return helpers
+}
+
+// relayMovedInfo passes a peer's info, as it just announced it to us, on to our other peers
+// Only once per InfoRelayCooldown per system, so a relay flag can't make us a megaphone
+func (dht *DHT) relayMovedInfo(sys *System) {
+	if sys.InfoSignature == "" || !dht.infoRelays.allow(sys.ID) {
+		return
+	}
+
+	sent := 0
+	for _, peer := range dht.routingTable.GetAllRoutingTableNodes() {
+		if peer.ID == sys.ID || peer.PeerAddress == "" || !dht.peerSupports(peer.ID, CapInfoRelay) {
+			continue
+		}
+		msg, err := NewInfoRelayRequest(dht.localSystem, peer.ID, sys, "")
+		if err != nil {
+			return
+		}
+		if _, err := dht.sendRequest(peer.PeerAddress, msg); err == nil {
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Printf("Passed %s's new address %s on to %d peers", sys.Name, sys.PeerAddress, sent)
+	}
+}
+
+// handleInfoRelay applies a system's info passed on by one of its peers
+func (dht *DHT) handleInfoRelay(msg *DHTMessage) (*DHTMessage, error) {
+	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	dht.routingTable.CacheSystem(msg.FromSystem, msg.FromSystem.ID, true)
+
+	before := dht.cachedInfoVersion(msg.Relayed.ID)
+	dht.routingTable.CacheSystem(msg.Relayed, msg.FromSystem.ID, false)
+	if dht.cachedInfoVersion(msg.Relayed.ID) > before {
+		log.Printf("%s passed on %s's info (now at %s)", msg.FromSystem.Name, msg.Relayed.Name, msg.Relayed.PeerAddress)
+	}
+
+	return NewInfoRelayResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+}
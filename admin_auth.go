@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// AuthError is the JSON body of a 401 from a mutating or admin-only endpoint
+type AuthError struct {
+	Error   string `json:"error"`   // Always "unauthorized"
+	Message string `json:"message"` // Human-readable, safe to show in the UI
+}
+
+// loadAdminToken returns the token mutating web API calls must present
+// override (-admin-token) wins; otherwise one is generated on first run and logged once
+func loadAdminToken(storage *Storage, systemID uuid.UUID, override string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+
+	token, err := storage.GetAdminToken(systemID)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		return token, nil
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(b)
+	if err := storage.SaveAdminToken(systemID, token); err != nil {
+		return "", err
+	}
+	log.Printf("Generated web API admin token (shown only this once, keep it): %s", token)
+	log.Printf("  Send it as \"Authorization: Bearer <token>\" to change anything via the API or web UI")
+	return token, nil
+}
+
+// SetAdminToken sets the token required by mutating endpoints
+// Must be called before Start; without one, mutating requests are always refused
+func (w *WebInterface) SetAdminToken(token string) {
+	w.adminToken = token
+}
+
+// mutating wraps handlers that change state: anything but GET and HEAD needs the admin token
+// Handlers that also serve reads (e.g. GET /api/blocklist) stay open for those
+func (w *WebInterface) mutating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(rw, r)
+			return
+		}
+
+		w.adminOnly(handler)(rw, r)
+	}
+}
+
+// adminOnly wraps handlers that need the admin token even to read, such as ones that
+// send network traffic
+func (w *WebInterface) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeAuthError(rw, "Admin token required (Authorization: Bearer <token>)")
+			return
+		}
+		if w.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(w.adminToken)) != 1 {
+			writeAuthError(rw, "Invalid admin token")
+			return
+		}
+		handler(rw, r)
+	}
+}
+
+// writeAuthError sends a 401 with an AuthError body
+func writeAuthError(rw http.ResponseWriter, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("WWW-Authenticate", `Bearer realm="stellar-lab"`)
+	rw.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(rw).Encode(AuthError{Error: "unauthorized", Message: message})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The capacity advisor reads the topology peers gossip (peer_connections) to estimate how
+// many connections each known system has, then points out systems near us that hardly
+// anyone peers with, and, when our own slots run short, peers of ours that are full anyway.
+// It only ever suggests: connecting is left to the operator (the Connect button posts to
+// /api/peers/connect like the map's). Estimates are only as fresh as the reports behind
+// them, so the report says how old those are.
+const (
+	// AdvisorInterval is how often the suggestions are worked out again
+	AdvisorInterval = 10 * time.Minute
+
+	// AdvisorTopologyMaxAge is how old a reported peer list may be and still count
+	AdvisorTopologyMaxAge = 6 * time.Hour
+
+	// AdvisorStarvedConnections is the most connections a system may have to count as
+	// under-connected
+	AdvisorStarvedConnections = 2
+
+	// AdvisorPressure is the share of our peer capacity in use from which full peers are
+	// pointed out as well
+	AdvisorPressure = 0.8
+
+	// AdvisorMaxSuggestions caps each kind of suggestion
+	AdvisorMaxSuggestions = 5
+)
+
+// Kinds of advisor suggestion
+const (
+	AdviceConnect       = "connect"        // An under-connected system near us that we don't peer with
+	AdviceOverConnected = "over-connected" // One of our peers that is at or over its capacity
+)
+
+// AdvisorReport is GET /api/advisor
+type AdvisorReport struct {
+	GeneratedAt      int64               `json:"generated_at"`
+	WindowHours      float64             `json:"window_hours"`            // Only peer lists reported within this many hours count
+	OldestReport     int64               `json:"oldest_report,omitempty"` // The oldest of those reports (0 when there are none)
+	NewestReport     int64               `json:"newest_report,omitempty"`
+	SystemsEstimated int                 `json:"systems_estimated"` // Systems whose connection count could be estimated
+	Peers            int                 `json:"peers"`             // Our routing table peers
+	MaxPeers         int                 `json:"max_peers"`
+	Suggestions      []AdvisorSuggestion `json:"suggestions"`
+}
+
+// AdvisorSuggestion is one hint, never acted on by the node itself
+type AdvisorSuggestion struct {
+	ID          string  `json:"id"`   // Kind and system ID: what the UI remembers a dismissal by
+	Kind        string  `json:"kind"` // AdviceConnect or AdviceOverConnected
+	SystemID    string  `json:"system_id"`
+	Name        string  `json:"name"`
+	Connections int     `json:"connections"` // Estimated, from reports within the window
+	MaxPeers    int     `json:"max_peers"`   // Its capacity, from its star class
+	Distance    float64 `json:"distance"`
+	Message     string  `json:"message"`
+}
+
+// advisor holds the latest report
+type advisor struct {
+	mu     sync.Mutex
+	report *AdvisorReport
+}
+
+// advisorLoop works out the suggestions again every AdvisorInterval
+func (dht *DHT) advisorLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskAdvisor, every(AdvisorInterval))
+
+	ticker := time.NewTicker(AdvisorInterval)
+	defer ticker.Stop()
+
+	// First run once bootstrap has brought in some gossip, or on request
+	t.scheduleNext(time.Now().Add(2 * time.Minute))
+	first := time.After(2 * time.Minute)
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-first:
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(AdvisorInterval))
+		case <-t.trigger:
+		}
+		t.run(dht.refreshAdvice)
+	}
+}
+
+// refreshAdvice replaces the advisor's report. Returns how many suggestions it made
+func (dht *DHT) refreshAdvice() (int, error) {
+	report, err := dht.computeAdvice(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	dht.advisor.mu.Lock()
+	dht.advisor.report = report
+	dht.advisor.mu.Unlock()
+	return len(report.Suggestions), nil
+}
+
+// GetAdvice returns the latest advisor report, working one out if the loop hasn't yet
+func (dht *DHT) GetAdvice() (*AdvisorReport, error) {
+	dht.advisor.mu.Lock()
+	report := dht.advisor.report
+	dht.advisor.mu.Unlock()
+	if report != nil {
+		return report, nil
+	}
+	if _, err := dht.refreshAdvice(); err != nil {
+		return nil, err
+	}
+	dht.advisor.mu.Lock()
+	defer dht.advisor.mu.Unlock()
+	return dht.advisor.report, nil
+}
+
+// computeAdvice estimates every system's connections from the reports within
+// AdvisorTopologyMaxAge and our own routing table, and picks out what's worth suggesting
+func (dht *DHT) computeAdvice(now time.Time) (*AdvisorReport, error) {
+	links, err := dht.storage.GetPeerLinks(AdvisorTopologyMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("load peer connections: %w", err)
+	}
+	oldest, newest, err := dht.storage.GetPeerLinksSpan(AdvisorTopologyMaxAge)
+	if err != nil {
+		return nil, fmt.Errorf("load peer connection ages: %w", err)
+	}
+
+	local := dht.localSystem
+	peers := dht.routingTable.GetAllRoutingTableNodes()
+	peerIDs := make([]uuid.UUID, len(peers))
+	isPeer := make(map[uuid.UUID]bool, len(peers))
+	for i, p := range peers {
+		peerIDs[i] = p.ID
+		isPeer[p.ID] = true
+	}
+	degree := linkDegrees(local.ID, peerIDs, links)
+
+	report := &AdvisorReport{
+		GeneratedAt:  now.Unix(),
+		WindowHours:  AdvisorTopologyMaxAge.Hours(),
+		OldestReport: oldest,
+		NewestReport: newest,
+		Peers:        len(peers),
+		MaxPeers:     local.GetMaxPeers(),
+		Suggestions:  []AdvisorSuggestion{},
+	}
+
+	// A system nobody reported within the window has no estimate, unless we reached it
+	// ourselves in that time and so know it's up with nobody listing it
+	cutoff := now.Add(-AdvisorTopologyMaxAge)
+	var starved []AdvisorSuggestion
+	for _, cached := range dht.routingTable.GetAllCachedSystemsWithMeta() {
+		sys := cached.System
+		if sys.ID == local.ID {
+			continue
+		}
+		_, reported := links[sys.ID]
+		if !reported && !(isPeer[sys.ID] || cached.LastVerified.After(cutoff)) {
+			continue
+		}
+		report.SystemsEstimated++
+
+		if isPeer[sys.ID] || sys.PeerAddress == "" || degree[sys.ID] > AdvisorStarvedConnections {
+			continue
+		}
+		if cached.Quarantined || cached.Retracted || cached.CoordsUnverified || cached.AddressConflict {
+			continue
+		}
+		distance := local.DistanceTo(sys)
+		starved = append(starved, AdvisorSuggestion{
+			ID:          AdviceConnect + ":" + sys.ID.String(),
+			Kind:        AdviceConnect,
+			SystemID:    sys.ID.String(),
+			Name:        sys.Name,
+			Connections: degree[sys.ID],
+			MaxPeers:    sys.GetMaxPeers(),
+			Distance:    distance,
+			Message: fmt.Sprintf("You are at %d/%d peers; %s (%d connections, %.0f units away) would benefit from a connection",
+				len(peers), report.MaxPeers, sys.Name, degree[sys.ID], distance),
+		})
+	}
+	sort.Slice(starved, func(i, j int) bool {
+		if starved[i].Distance != starved[j].Distance {
+			return starved[i].Distance < starved[j].Distance
+		}
+		return starved[i].SystemID < starved[j].SystemID
+	})
+	if len(starved) > AdvisorMaxSuggestions {
+		starved = starved[:AdvisorMaxSuggestions]
+	}
+	report.Suggestions = append(report.Suggestions, starved...)
+
+	// A full peer turns newcomers away whether or not we stay, so with our own slots running
+	// short and someone under-connected nearby, its slot may do more good elsewhere
+	if len(starved) == 0 || float64(len(peers)) < AdvisorPressure*float64(report.MaxPeers) {
+		return report, nil
+	}
+	var full []AdvisorSuggestion
+	for _, sys := range peers {
+		connections, capacity := degree[sys.ID], sys.GetMaxPeers()
+		if connections < capacity {
+			continue
+		}
+		distance := local.DistanceTo(sys)
+		full = append(full, AdvisorSuggestion{
+			ID:          AdviceOverConnected + ":" + sys.ID.String(),
+			Kind:        AdviceOverConnected,
+			SystemID:    sys.ID.String(),
+			Name:        sys.Name,
+			Connections: connections,
+			MaxPeers:    capacity,
+			Distance:    distance,
+			Message: fmt.Sprintf("Your peer %s has %d connections for %d slots; the slot it takes here would do more for an under-connected system nearby",
+				sys.Name, connections, capacity),
+		})
+	}
+	sort.Slice(full, func(i, j int) bool {
+		if full[i].Connections-full[i].MaxPeers != full[j].Connections-full[j].MaxPeers {
+			return full[i].Connections-full[i].MaxPeers > full[j].Connections-full[j].MaxPeers
+		}
+		return full[i].SystemID < full[j].SystemID
+	})
+	if len(full) > AdvisorMaxSuggestions {
+		full = full[:AdvisorMaxSuggestions]
+	}
+	report.Suggestions = append(report.Suggestions, full...)
+	return report, nil
+}
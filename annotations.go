@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Annotations are the operator's own notes on other systems. They live in
+// peer_annotations, keyed by system ID rather than tied to the cached row, so one survives
+// the system being pruned, trimmed or blocked and shows up again if it comes back. They
+// are never sent to peers: no DHT message or full-sync response carries them, and the web
+// API only serves them outside public mode.
+
+const (
+	// MaxAnnotationNoteLength is the longest note accepted, in bytes
+	MaxAnnotationNoteLength = 1000
+
+	// MaxAnnotationTags is how many tags one system can have
+	MaxAnnotationTags = 10
+
+	// MaxAnnotationTagLength is the longest tag accepted, in bytes
+	MaxAnnotationTagLength = 24
+)
+
+// annotationColor is the only color override accepted: it ends up in inline styles
+var annotationColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// PeerAnnotation is a private note, tags and label color attached to a system
+type PeerAnnotation struct {
+	SystemID  uuid.UUID `json:"system_id"`
+	Note      string    `json:"note"`
+	Tags      []string  `json:"tags"`
+	Color     string    `json:"color,omitempty"` // "#rrggbb" tint for the system's label; empty = its star color
+	UpdatedAt int64     `json:"updated_at"`
+}
+
+// Empty reports whether the annotation has nothing left in it
+func (a *PeerAnnotation) Empty() bool {
+	return a.Note == "" && len(a.Tags) == 0 && a.Color == ""
+}
+
+// AnnotationRequest is the PUT /api/peers/{id}/annotation body
+type AnnotationRequest struct {
+	Note  string   `json:"note"`
+	Tags  []string `json:"tags"`
+	Color string   `json:"color"`
+}
+
+// normalizeAnnotation checks a request and returns the annotation it describes
+// Tags are trimmed, lowercased and deduplicated; empty ones are dropped
+func normalizeAnnotation(id uuid.UUID, req AnnotationRequest) (*PeerAnnotation, error) {
+	a := &PeerAnnotation{SystemID: id, Tags: []string{}}
+
+	a.Note = strings.TrimSpace(req.Note)
+	if !utf8.ValidString(a.Note) {
+		return nil, errors.New("note is not valid UTF-8")
+	}
+	if len(a.Note) > MaxAnnotationNoteLength {
+		return nil, fmt.Errorf("note is longer than %d bytes", MaxAnnotationNoteLength)
+	}
+	for _, r := range a.Note {
+		if r != '\n' && (unicode.IsControl(r) || unicode.Is(unicode.Cf, r)) {
+			return nil, errors.New("note contains control characters")
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, tag := range req.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxAnnotationTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d bytes", tag, MaxAnnotationTagLength)
+		}
+		for _, r := range tag {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" -_.", r) {
+				return nil, fmt.Errorf("tag %q may only contain letters, digits, spaces, '-', '_' and '.'", tag)
+			}
+		}
+		seen[tag] = true
+		a.Tags = append(a.Tags, tag)
+	}
+	if len(a.Tags) > MaxAnnotationTags {
+		return nil, fmt.Errorf("at most %d tags", MaxAnnotationTags)
+	}
+
+	a.Color = strings.ToLower(strings.TrimSpace(req.Color))
+	if a.Color != "" && !annotationColor.MatchString(a.Color) {
+		return nil, errors.New("color must look like #4ade80")
+	}
+	return a, nil
+}
+
+// SetPeerAnnotation saves the operator's annotation on a system, or removes it when the
+// request is empty. The system doesn't have to be cached (yet)
+// Returns the saved annotation, or nil if it was removed
+func (dht *DHT) SetPeerAnnotation(id uuid.UUID, req AnnotationRequest) (*PeerAnnotation, error) {
+	if id == dht.localSystem.ID {
+		return nil, fmt.Errorf("cannot annotate the local system")
+	}
+	a, err := normalizeAnnotation(id, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Empty() {
+		if _, err := dht.storage.DeletePeerAnnotation(id); err != nil {
+			return nil, err
+		}
+		log.Printf("Removed annotation on %s", id)
+		return nil, nil
+	}
+
+	a.UpdatedAt = time.Now().Unix()
+	if err := dht.storage.SavePeerAnnotation(a); err != nil {
+		return nil, err
+	}
+	log.Printf("Annotated %s (%d tags)", id, len(a.Tags))
+	return a, nil
+}
+
+// GetPeerAnnotation returns the annotation on a system, or nil if it has none
+func (dht *DHT) GetPeerAnnotation(id uuid.UUID) (*PeerAnnotation, error) {
+	return dht.storage.GetPeerAnnotation(id)
+}
+
+// GetPeerAnnotations returns every annotation, including ones on systems no longer cached
+func (dht *DHT) GetPeerAnnotations() ([]*PeerAnnotation, error) {
+	return dht.storage.GetPeerAnnotations()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// AnnounceRefreshInterval re-announces to a peer that already has our current info
+	// after this long, in case it has since lost it
+	AnnounceRefreshInterval = 6 * time.Hour
+
+	// InfoChangeSpread is the window announces of changed info are spread over
+	InfoChangeSpread = 30 * time.Second
+
+	// AnnounceRetryDelay is how long to wait before re-announcing to a rate-limited peer
+	AnnounceRetryDelay = 1 * time.Minute
+
+	// announceTickInterval is how often scheduled announces are checked for being due
+	announceTickInterval = 5 * time.Second
+)
+
+// deliveredInfo is the newest InfoVersion of ours a peer is known to hold
+type deliveredInfo struct {
+	version int64
+	at      time.Time
+}
+
+// scheduledAnnounce is an announce waiting for its slot in the window
+type scheduledAnnounce struct {
+	system *System
+	due    time.Time
+}
+
+// announcer tracks which peers already have our info and spreads announces over time
+type announcer struct {
+	mu        sync.Mutex
+	delivered map[uuid.UUID]deliveredInfo
+	scheduled map[uuid.UUID]*scheduledAnnounce
+	changed   chan struct{}
+}
+
+func newAnnouncer() *announcer {
+	return &announcer{
+		delivered: make(map[uuid.UUID]deliveredInfo),
+		scheduled: make(map[uuid.UUID]*scheduledAnnounce),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+// recordDelivered notes that a peer holds our info at version
+// Any exchange counts: every message and response carries our signed info
+func (a *announcer) recordDelivered(peerID uuid.UUID, version int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if version >= a.delivered[peerID].version {
+		a.delivered[peerID] = deliveredInfo{version: version, at: time.Now()}
+	}
+}
+
+// needsAnnounce reports whether a peer is missing our current info or is due a refresh
+func (dht *DHT) needsAnnounce(peerID uuid.UUID) bool {
+	dht.announcer.mu.Lock()
+	d, ok := dht.announcer.delivered[peerID]
+	dht.announcer.mu.Unlock()
+	return !ok || d.version < dht.GetLocalSystem().InfoVersion || time.Since(d.at) > AnnounceRefreshInterval
+}
+
+// announceInfoChange announces changed info to our routing table peers right away
+// instead of waiting for the next announce round
+func (dht *DHT) announceInfoChange() {
+	select {
+	case dht.announcer.changed <- struct{}{}:
+	default:
+	}
+}
+
+// scheduleAnnounces spreads announces to the targets that need one evenly over window
+// Returns how many were scheduled; already scheduled peers keep their earlier slot
+func (dht *DHT) scheduleAnnounces(targets []*System, window time.Duration) int {
+	var due []*System
+	for _, sys := range targets {
+		if sys.ID != dht.localSystem.ID && sys.PeerAddress != "" && dht.needsAnnounce(sys.ID) {
+			due = append(due, sys)
+		}
+	}
+	if len(due) == 0 {
+		return 0
+	}
+
+	a := dht.announcer
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for i, sys := range due {
+		at := now.Add(window * time.Duration(i) / time.Duration(len(due)))
+		if s, ok := a.scheduled[sys.ID]; ok && s.due.Before(at) {
+			s.system = sys
+			continue
+		}
+		a.scheduled[sys.ID] = &scheduledAnnounce{system: sys, due: at}
+	}
+	return len(due)
+}
+
+// retryAnnounce schedules one more announce to sys after delay
+func (dht *DHT) retryAnnounce(sys *System, delay time.Duration) {
+	dht.announcer.mu.Lock()
+	defer dht.announcer.mu.Unlock()
+	dht.announcer.scheduled[sys.ID] = &scheduledAnnounce{system: sys, due: time.Now().Add(delay)}
+}
+
+// sendDueAnnounces announces to every scheduled peer whose slot has come
+// Peers that got our current info some other way in the meantime are skipped
+func (dht *DHT) sendDueAnnounces() {
+	now := time.Now()
+
+	var due []*System
+	dht.announcer.mu.Lock()
+	for id, s := range dht.announcer.scheduled {
+		if !s.due.After(now) {
+			due = append(due, s.system)
+			delete(dht.announcer.scheduled, id)
+		}
+	}
+	dht.announcer.mu.Unlock()
+
+	var targets []*System
+	for _, sys := range due {
+		if dht.needsAnnounce(sys.ID) {
+			targets = append(targets, sys)
+		}
+	}
+	if len(targets) > 0 {
+		dht.announceWithRedirects(targets)
+	}
+}
+
+// pruneDelivered forgets peers whose delivery record is past the refresh interval
+func (a *announcer) pruneDelivered() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, d := range a.delivered {
+		if time.Since(d.at) > AnnounceRefreshInterval {
+			delete(a.delivered, id)
+		}
+	}
+}
+
+// announceToNetwork looks up the K closest nodes to ourselves and spreads announces
+// to the ones missing our current info over window, returning how many were scheduled
+func (dht *DHT) announceToNetwork(window time.Duration) int {
+	dht.announcer.pruneDelivered()
+
+	result := dht.FindNode(dht.localSystem.ID)
+	scheduled := dht.scheduleAnnounces(result.ClosestNodes, window)
+
+	log.Printf("Announcing to %d of %d closest nodes over %s (the rest have our current info)",
+		scheduled, len(result.ClosestNodes), window)
+	return scheduled
+}
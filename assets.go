@@ -0,0 +1,120 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The web UI's templates, styles and scripts live under web/ and are compiled into the
+// binary. With -dev-assets they're read from a checkout on disk instead, and templates are
+// parsed again on every request, so edits show up on reload without rebuilding.
+
+//go:generate curl -fsSL -o web/static/vendor/three.min.js https://cdnjs.cloudflare.com/ajax/libs/three.js/r128/three.min.js
+
+//go:embed web
+var embeddedWeb embed.FS
+
+const (
+	// threeJSVendorPath is where go generate puts the Three.js build, relative to web/
+	threeJSVendorPath = "static/vendor/three.min.js"
+
+	// threeJSCDNURL is used when the build wasn't vendored
+	threeJSCDNURL = "https://cdnjs.cloudflare.com/ajax/libs/three.js/r128/three.min.js"
+)
+
+// webAssets serves the web UI's files and holds its parsed templates
+type webAssets struct {
+	files fs.FS // Rooted at web/
+	dev   bool  // Reading from disk: parse templates per request
+
+	mu    sync.Mutex
+	index *template.Template
+	peer  *template.Template
+}
+
+// loadWebAssets parses the templates from the embedded files, or from devDir when set
+// devDir is the web/ directory of a checkout
+func loadWebAssets(devDir string) (*webAssets, error) {
+	a := &webAssets{}
+	if devDir != "" {
+		if _, err := os.Stat(devDir); err != nil {
+			return nil, fmt.Errorf("dev assets: %w", err)
+		}
+		a.files = os.DirFS(devDir)
+		a.dev = true
+		log.Printf("Serving web assets from %s (templates reloaded on every request)", devDir)
+	} else {
+		sub, err := fs.Sub(embeddedWeb, "web")
+		if err != nil {
+			return nil, err
+		}
+		a.files = sub
+	}
+
+	if err := a.parse(); err != nil {
+		return nil, err
+	}
+	if a.threeJSURL() == threeJSCDNURL {
+		log.Printf("Warning: Three.js isn't vendored (run go generate), the galaxy map will load it from cdnjs")
+	}
+	return a, nil
+}
+
+// parse (re)reads both page templates
+func (a *webAssets) parse() error {
+	index, err := template.ParseFS(a.files, "templates/index.html")
+	if err != nil {
+		return fmt.Errorf("index template: %w", err)
+	}
+	peer, err := template.ParseFS(a.files, "templates/peer.html")
+	if err != nil {
+		return fmt.Errorf("peer template: %w", err)
+	}
+
+	a.mu.Lock()
+	a.index, a.peer = index, peer
+	a.mu.Unlock()
+	return nil
+}
+
+// templates returns the index and peer page templates, reparsed first in dev mode
+func (a *webAssets) templates() (index, peer *template.Template, err error) {
+	if a.dev {
+		if err := a.parse(); err != nil {
+			return nil, nil, err
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.index, a.peer, nil
+}
+
+// threeJSURL is the vendored Three.js build if there is one, otherwise the CDN copy
+func (a *webAssets) threeJSURL() string {
+	if _, err := fs.Stat(a.files, threeJSVendorPath); err == nil {
+		return "/" + threeJSVendorPath
+	}
+	return threeJSCDNURL
+}
+
+// handler serves web/static/ under /static/
+func (a *webAssets) handler() http.Handler {
+	files := http.FileServer(http.FS(a.files))
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(rw, r) // No directory listings
+			return
+		}
+		if a.dev {
+			rw.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(rw, r)
+	})
+}
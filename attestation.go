@@ -4,6 +4,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"time"
 
@@ -36,6 +37,23 @@ type Attestation struct {
 	MessageType  string    `json:"message_type"`
 	Signature    string    `json:"signature"`      // Ed25519 signature (base64)
 	PublicKey    string    `json:"public_key"`     // Sender's public key (base64)
+	Nonce        string    `json:"nonce,omitempty"` // Random hex, signed; a stored one can't be saved again (see addNonce)
+
+	// Seconds the sender's clock was ahead of ours when we received it (not signed, never sent)
+	ClockSkew int64 `json:"-"`
+
+	// For an untargeted (uuid.Nil) attestation in a credit proof, the system that stored it
+	// as received. Not signed: only the prover's word (see LegacyAttestationWeight)
+	ReceivedBy *uuid.UUID `json:"received_by,omitempty"`
+}
+
+// addressedTo reports whether the attestation is evidence for systemID: signed to it, or
+// untargeted and recorded as received by it
+func (a *Attestation) addressedTo(systemID uuid.UUID) bool {
+	if a.ToSystemID == systemID {
+		return true
+	}
+	return a.ToSystemID == uuid.Nil && a.ReceivedBy != nil && *a.ReceivedBy == systemID
 }
 
 // SignAttestation creates a signed attestation
@@ -65,16 +83,43 @@ func (a *Attestation) GetSignableMessage() []byte {
 		To        string `json:"to"`
 		Timestamp int64  `json:"timestamp"`
 		Type      string `json:"type"`
+		Nonce     string `json:"nonce,omitempty"` // Omitted, legacy attestations sign what they always did
 	}{
 		From:      a.FromSystemID.String(),
 		To:        a.ToSystemID.String(),
 		Timestamp: a.Timestamp,
 		Type:      a.MessageType,
+		Nonce:     a.Nonce,
 	}
 	data, _ := json.Marshal(msg)
 	return data
 }
 
+// AttestationNonceLength is the hex length of an attestation nonce (16 random bytes)
+const AttestationNonceLength = 32
+
+// addNonce gives the attestation a fresh random nonce and signs it again
+// Only peers listing attestation-nonce get one: older nodes verify the nonce-less message.
+// Storage refuses a nonce it already holds from the same sender, so a captured attestation
+// can't be replayed within the clock skew window to pad uptime or credits
+func (a *Attestation) addNonce(privKey ed25519.PrivateKey) {
+	b := make([]byte, AttestationNonceLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return
+	}
+	a.Nonce = hex.EncodeToString(b)
+	a.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privKey, a.GetSignableMessage()))
+}
+
+// replayKey identifies an attestation for deduplication: its sender and nonce, or for
+// legacy attestations its signature (the same from, to, type and timestamp)
+func (a *Attestation) replayKey() string {
+	if a.Nonce != "" {
+		return a.FromSystemID.String() + "/" + a.Nonce
+	}
+	return a.Signature
+}
+
 // Verify checks if an attestation has a valid signature
 func (a *Attestation) Verify() bool {
 	// Decode public key
@@ -94,6 +139,12 @@ func (a *Attestation) Verify() bool {
 	return ed25519.Verify(pubKeyBytes, msg, sigBytes)
 }
 
+// LocalTime is the timestamp corrected for the sender's clock skew: when it was
+// signed by our clock. Uptime and credits count this; signatures cover Timestamp
+func (a *Attestation) LocalTime() int64 {
+	return a.Timestamp - a.ClockSkew
+}
+
 // Checks if timestamp is within acceptable ranges
 func (a *Attestation) IsTimestampValid(maxDrift time.Duration) bool {
     now := time.Now().Unix()
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAttestationFlushInterval is how long received attestations may wait in memory
+	DefaultAttestationFlushInterval = 30 * time.Second
+
+	// AttestationBatchSize flushes early once this many attestations are waiting
+	AttestationBatchSize = 200
+
+	// MaxBufferedAttestations bounds the buffer while writes keep failing; the oldest are dropped
+	MaxBufferedAttestations = 5000
+)
+
+// attestationBuffer collects received attestations so they're written in one
+// transaction per flush instead of one per inbound message
+type attestationBuffer struct {
+	mu       sync.Mutex
+	pending  []PendingAttestation
+	interval time.Duration // 0 writes every attestation immediately
+
+	flushMu sync.Mutex // One flush at a time, so batches are written in arrival order
+	full    chan struct{}
+}
+
+func newAttestationBuffer() *attestationBuffer {
+	return &attestationBuffer{
+		interval: DefaultAttestationFlushInterval,
+		full:     make(chan struct{}, 1),
+	}
+}
+
+// SetAttestationFlushInterval sets how often buffered attestations are written (0 disables buffering)
+// Must be called before Start
+func (dht *DHT) SetAttestationFlushInterval(d time.Duration) {
+	dht.attestations.interval = d
+}
+
+// saveAttestation queues an attestation we received for the next flush
+// It's stored with the sender's current clock skew, so uptime can use our clock's time
+// (truncated: signed timestamps drop the fraction, so an in-sync peer looks ~0.5s behind)
+func (dht *DHT) saveAttestation(attestation *Attestation) {
+	if skew, ok := dht.ClockSkew(attestation.FromSystemID); ok {
+		attestation.ClockSkew = int64(skew / time.Second)
+	}
+
+	b := dht.attestations
+	if b.interval <= 0 {
+		err := dht.storage.SaveAttestation(attestation, dht.localSystem.ID)
+		if errors.Is(err, ErrReplayedAttestation) {
+			log.Printf("Dropped replayed attestation from %s", attestation.FromSystemID.String()[:8])
+		} else if err != nil {
+			log.Printf("Failed to save attestation: %v", err)
+		}
+		return
+	}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, PendingAttestation{
+		Attestation: attestation,
+		ReceivedBy:  dht.localSystem.ID,
+		ReceivedAt:  time.Now().Unix(),
+	})
+	n := len(b.pending)
+	b.mu.Unlock()
+
+	if n >= AttestationBatchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// FlushAttestations writes every buffered attestation in a single transaction
+// Anything reading attestations for this node calls it first so nothing buffered is missed
+func (dht *DHT) FlushAttestations() error {
+	_, err := dht.flushAttestations()
+	return err
+}
+
+// flushAttestations is FlushAttestations, also returning how many were written
+func (dht *DHT) flushAttestations() (int, error) {
+	b := dht.attestations
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	replayed, err := dht.storage.SaveAttestationsBatch(batch)
+	if err != nil {
+		// Put them back in front of anything that arrived meanwhile and retry next flush
+		b.mu.Lock()
+		b.pending = append(batch, b.pending...)
+		if over := len(b.pending) - MaxBufferedAttestations; over > 0 {
+			log.Printf("Attestation buffer full, dropping %d oldest", over)
+			b.pending = b.pending[over:]
+		}
+		b.mu.Unlock()
+		return 0, err
+	}
+	if replayed > 0 {
+		log.Printf("Dropped %d replayed attestation(s)", replayed)
+	}
+	return len(batch) - replayed, nil
+}
+
+// attestationFlushLoop flushes the buffer every interval, or sooner once a batch fills up
+// The final flush happens in Stop, after the DHT server has stopped taking messages
+func (dht *DHT) attestationFlushLoop() {
+	defer dht.wg.Done()
+
+	interval := dht.attestations.interval
+	t := dht.tasks.register(TaskAttestationFlush, every(interval))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(interval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(interval))
+		case <-dht.attestations.full:
+		case <-t.trigger:
+		}
+		t.run(func() (int, error) {
+			n, err := dht.flushAttestations()
+			if err != nil {
+				log.Printf("Failed to save attestations: %v", err)
+			}
+			return n, err
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The bandwidth budget (-bandwidth-budget) is for nodes on metered connections. Every
+// byte on the DHT port and on our own connections to peers is counted, headers and TLS
+// included, against the local day; the day's count is saved every minute so a restart
+// carries on where it left off. As the day's usage climbs towards the budget the node
+// gives up what it can do without, one stage at a time, and starts over at midnight.
+
+// Bandwidth budget stages; each keeps the restrictions of the ones before it
+const (
+	BudgetNormal       = iota
+	BudgetConserve     // Announce rounds and liveness pings BudgetSlowdown times further apart
+	BudgetNoFullSync   // Full-sync refused with a 503, and not asked of others
+	BudgetSmallReplies // find_node answered with BudgetFindNodeResults systems instead of K
+	BudgetInboundOnly  // Peers are still answered, but pings are all that go out
+)
+
+// budgetStages names each stage and the share of the budget used that starts it
+var budgetStages = []struct {
+	name      string
+	threshold float64
+}{
+	{"normal", 0},
+	{"conserve", 0.5},
+	{"no-full-sync", 0.7},
+	{"small-replies", 0.85},
+	{"inbound-only", 0.95},
+}
+
+const (
+	// BudgetSlowdown stretches the announce and liveness intervals from BudgetConserve on
+	BudgetSlowdown = 3
+
+	// BudgetFindNodeResults is how many systems a find_node reply carries from BudgetSmallReplies on
+	BudgetFindNodeResults = 5
+
+	// BandwidthSaveInterval is how often the day's usage is written to the database
+	BandwidthSaveInterval = time.Minute
+
+	// BandwidthHistoryDays is how many days of usage are kept
+	BandwidthHistoryDays = 30
+)
+
+// ErrBandwidthBudget is returned for requests held back by the bandwidth budget.
+// It says nothing about the peer, so it never counts against one
+var ErrBandwidthBudget = errors.New("daily bandwidth budget nearly used up, not sending")
+
+// BandwidthUsage is the "bandwidth" section of /api/stats
+type BandwidthUsage struct {
+	Day           string `json:"day"` // Local date, YYYY-MM-DD
+	BytesSent     int64  `json:"bytes_sent"`
+	BytesReceived int64  `json:"bytes_received"`
+	BudgetBytes   int64  `json:"budget_bytes,omitempty"` // 0 = no budget
+	Stage         string `json:"stage"`
+	Projected     int64  `json:"projected_bytes"` // End of day usage at today's rate so far
+	ResetsAt      int64  `json:"resets_at"`       // Next local midnight
+}
+
+// bandwidthBudget counts the day's DHT bytes and works out the stage they put us in
+type bandwidthBudget struct {
+	mu       sync.Mutex
+	limit    int64 // Bytes per day; 0 = count only
+	day      string
+	sent     int64
+	received int64
+	stage    int
+	dirty    bool
+
+	// The previous day's final count, until it is saved
+	finished *bandwidthDay
+}
+
+// bandwidthDay is one day's count as stored in bandwidth_usage
+type bandwidthDay struct {
+	day            string
+	sent, received int64
+}
+
+func newBandwidthBudget() *bandwidthBudget {
+	return &bandwidthBudget{day: time.Now().Format(time.DateOnly)}
+}
+
+// budgetStage returns the stage a day's usage puts a budget in
+func budgetStage(used, limit int64) int {
+	if limit <= 0 {
+		return BudgetNormal
+	}
+	stage := BudgetNormal
+	for i, s := range budgetStages {
+		if float64(used) >= s.threshold*float64(limit) {
+			stage = i
+		}
+	}
+	return stage
+}
+
+// add counts bytes against the current day, logging stage changes
+func (b *bandwidthBudget) add(sent, received int64) {
+	b.mu.Lock()
+	b.rollover(time.Now())
+	b.sent += sent
+	b.received += received
+	b.dirty = true
+	from, to := b.restage()
+	b.mu.Unlock()
+
+	if from != to {
+		logBudgetStage(from, to)
+	}
+}
+
+// rollover starts a new day when the date has changed, keeping the old one to be saved
+// Callers hold b.mu
+func (b *bandwidthBudget) rollover(now time.Time) {
+	day := now.Format(time.DateOnly)
+	if day == b.day {
+		return
+	}
+	if b.sent > 0 || b.received > 0 {
+		b.finished = &bandwidthDay{day: b.day, sent: b.sent, received: b.received}
+	}
+	from := b.stage
+	b.day, b.sent, b.received, b.stage, b.dirty = day, 0, 0, BudgetNormal, true
+	if from != BudgetNormal {
+		log.Printf("Bandwidth budget reset for %s", day)
+	}
+}
+
+// restage recomputes the stage, returning the old and new one. Callers hold b.mu
+func (b *bandwidthBudget) restage() (int, int) {
+	from := b.stage
+	b.stage = budgetStage(b.sent+b.received, b.limit)
+	return from, b.stage
+}
+
+// logBudgetStage says what a stage change means for the node
+func logBudgetStage(from, to int) {
+	if to < from {
+		log.Printf("Bandwidth budget back to stage %s", budgetStages[to].name)
+		return
+	}
+	effects := map[int]string{
+		BudgetConserve:     "announcing and pinging peers less often",
+		BudgetNoFullSync:   "refusing full-sync requests",
+		BudgetSmallReplies: "answering find_node with fewer systems",
+		BudgetInboundOnly:  "only answering peers and pinging them",
+	}
+	log.Printf("Bandwidth budget %.0f%% used, stage %s: %s", budgetStages[to].threshold*100, budgetStages[to].name, effects[to])
+}
+
+// Stage returns the current stage, starting a new day first if midnight has passed
+func (b *bandwidthBudget) Stage() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(time.Now())
+	return b.stage
+}
+
+// usage returns the day's count and where it is heading
+func (b *bandwidthBudget) usage(now time.Time) BandwidthUsage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(now)
+
+	midnight := nextMidnight(now)
+	dayStart := midnight.AddDate(0, 0, -1)
+	used := b.sent + b.received
+	projected := used
+	if elapsed := now.Sub(dayStart); elapsed > time.Minute {
+		projected = int64(float64(used) * float64(midnight.Sub(dayStart)) / float64(elapsed))
+	}
+	return BandwidthUsage{
+		Day:           b.day,
+		BytesSent:     b.sent,
+		BytesReceived: b.received,
+		BudgetBytes:   b.limit,
+		Stage:         budgetStages[b.stage].name,
+		Projected:     projected,
+		ResetsAt:      midnight.Unix(),
+	}
+}
+
+// nextMidnight returns the start of the next local day
+func nextMidnight(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+}
+
+// dial is a DialContext counting every byte of the connections it makes
+func (b *bandwidthBudget) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, budget: b}, nil
+}
+
+// transport returns an HTTP transport whose connections are counted
+func (b *bandwidthBudget) transport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = b.dial
+	return t
+}
+
+// listener counts every byte of the connections accepted on l
+func (b *bandwidthBudget) listener(l net.Listener) net.Listener {
+	return &countingListener{Listener: l, budget: b}
+}
+
+// countingConn counts what is read and written through a connection
+type countingConn struct {
+	net.Conn
+	budget *bandwidthBudget
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.budget.add(0, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.budget.add(int64(n), 0)
+	}
+	return n, err
+}
+
+// countingListener hands out countingConns
+type countingListener struct {
+	net.Listener
+	budget *bandwidthBudget
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, budget: l.budget}, nil
+}
+
+// SetBandwidthBudget sets how many megabytes a day the DHT may use (0 = no budget)
+// Must be called before Start
+func (dht *DHT) SetBandwidthBudget(mb int) {
+	dht.bandwidth.mu.Lock()
+	dht.bandwidth.limit = int64(mb) * 1024 * 1024
+	dht.bandwidth.mu.Unlock()
+	if mb > 0 {
+		log.Printf("Bandwidth budget: %d MB a day", mb)
+	}
+}
+
+// budgetStage returns the stage the bandwidth budget is in
+func (dht *DHT) budgetStage() int {
+	return dht.bandwidth.Stage()
+}
+
+// checkBandwidthBudget holds back a request the budget has no room for
+// Once inbound-only, pings are the only requests that go out: they are small and keep
+// the routing table from evicting peers we can no longer afford to talk to otherwise
+func (dht *DHT) checkBandwidthBudget(msg *DHTMessage) error {
+	if msg.Type != MessageTypePing && dht.budgetStage() >= BudgetInboundOnly {
+		return ErrBandwidthBudget
+	}
+	return nil
+}
+
+// livenessStretch is how much later than usual liveness pings are due
+func (dht *DHT) livenessStretch() time.Duration {
+	if dht.budgetStage() < BudgetConserve {
+		return 0
+	}
+	return (BudgetSlowdown - 1) * dht.localSystem.LivenessInterval()
+}
+
+// BandwidthStats returns the day's DHT bandwidth usage (/api/stats)
+func (dht *DHT) BandwidthStats() BandwidthUsage {
+	return dht.bandwidth.usage(time.Now())
+}
+
+// restoreBandwidthUsage picks up today's count from before a restart
+func (dht *DHT) restoreBandwidthUsage() {
+	b := dht.bandwidth
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover(time.Now())
+	sent, received, err := dht.storage.GetBandwidthUsage(b.day)
+	if err != nil {
+		log.Printf("Failed to load today's bandwidth usage: %v", err)
+		return
+	}
+	b.sent += sent
+	b.received += received
+	b.restage()
+	if sent+received > 0 {
+		log.Printf("Bandwidth used today so far: %s (stage %s)", formatBytes(b.sent+b.received), budgetStages[b.stage].name)
+	}
+}
+
+// saveBandwidthUsage writes the day's count (and a finished day's) to the database
+func (dht *DHT) saveBandwidthUsage() error {
+	b := dht.bandwidth
+	b.mu.Lock()
+	b.rollover(time.Now())
+	var days []bandwidthDay
+	if b.finished != nil {
+		days = append(days, *b.finished)
+	}
+	if b.dirty {
+		days = append(days, bandwidthDay{day: b.day, sent: b.sent, received: b.received})
+	}
+	b.finished, b.dirty = nil, false
+	b.mu.Unlock()
+
+	for _, d := range days {
+		if err := dht.storage.SaveBandwidthUsage(d.day, d.sent, d.received); err != nil {
+			b.mu.Lock()
+			b.dirty = true
+			b.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// bandwidthLoop saves the day's usage every BandwidthSaveInterval
+func (dht *DHT) bandwidthLoop() {
+	defer dht.wg.Done()
+
+	ticker := time.NewTicker(BandwidthSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			if err := dht.saveBandwidthUsage(); err != nil {
+				log.Printf("Failed to save bandwidth usage: %v", err)
+			}
+		}
+	}
+}
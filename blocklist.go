@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// BlockedSystem is a system we refuse to talk to or cache
+type BlockedSystem struct {
+	SystemID  uuid.UUID `json:"system_id"`
+	Reason    string    `json:"reason"`
+	BlockedAt int64     `json:"blocked_at"`
+	ExpiresAt int64     `json:"expires_at,omitempty"` // Unix timestamp; 0 = permanent
+}
+
+// Expired reports whether a temporary block has run out
+func (b *BlockedSystem) Expired(now time.Time) bool {
+	return b.ExpiresAt > 0 && now.Unix() >= b.ExpiresAt
+}
+
+// BlockRequest is the POST /api/blocklist body
+type BlockRequest struct {
+	SystemID string `json:"system_id"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // Go duration ("24h"); empty = permanent
+}
+
+// Blocklist is the in-memory view of blocked_systems, checked on every cache write
+type Blocklist struct {
+	mu      sync.RWMutex
+	blocked map[uuid.UUID]*BlockedSystem
+}
+
+// NewBlocklist creates an empty blocklist
+func NewBlocklist() *Blocklist {
+	return &Blocklist{blocked: make(map[uuid.UUID]*BlockedSystem)}
+}
+
+// IsBlocked reports whether a system is currently blocked (expired blocks don't count)
+func (bl *Blocklist) IsBlocked(id uuid.UUID) bool {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	b, ok := bl.blocked[id]
+	return ok && !b.Expired(time.Now())
+}
+
+// add records a block in memory
+func (bl *Blocklist) add(b *BlockedSystem) {
+	bl.mu.Lock()
+	bl.blocked[b.SystemID] = b
+	bl.mu.Unlock()
+}
+
+// remove drops a block from memory, returning whether it existed
+func (bl *Blocklist) remove(id uuid.UUID) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	_, ok := bl.blocked[id]
+	delete(bl.blocked, id)
+	return ok
+}
+
+// list returns active blocks
+func (bl *Blocklist) list() []*BlockedSystem {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	now := time.Now()
+	result := make([]*BlockedSystem, 0, len(bl.blocked))
+	for _, b := range bl.blocked {
+		if !b.Expired(now) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+// pruneExpired drops expired blocks from memory
+func (bl *Blocklist) pruneExpired() int {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	now := time.Now()
+	pruned := 0
+	for id, b := range bl.blocked {
+		if b.Expired(now) {
+			delete(bl.blocked, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// BlockSystem blocks a system (duration 0 = permanent) and purges everything we know about it
+func (dht *DHT) BlockSystem(id uuid.UUID, reason string, duration time.Duration) (*BlockedSystem, error) {
+	if id == dht.localSystem.ID {
+		return nil, fmt.Errorf("cannot block the local system")
+	}
+
+	now := time.Now()
+	b := &BlockedSystem{SystemID: id, Reason: reason, BlockedAt: now.Unix()}
+	if duration > 0 {
+		b.ExpiresAt = now.Add(duration).Unix()
+	}
+
+	if err := dht.storage.SaveBlockedSystem(b); err != nil {
+		return nil, err
+	}
+	dht.routingTable.blocklist.add(b)
+
+	// Purge so the node disappears from the routing table, cache and map
+	dht.routingTable.RemoveFromCache(id)
+	if err := dht.storage.DeletePeerSystem(id); err != nil {
+		log.Printf("Warning: failed to delete blocked peer system: %v", err)
+	}
+	if err := dht.storage.DeletePeerConnections(id); err != nil {
+		log.Printf("Warning: failed to delete blocked peer connections: %v", err)
+	}
+
+	if b.ExpiresAt > 0 {
+		log.Printf("Blocked %s until %s: %s", id, time.Unix(b.ExpiresAt, 0).Format(time.RFC3339), reason)
+	} else {
+		log.Printf("Blocked %s permanently: %s", id, reason)
+	}
+	return b, nil
+}
+
+// UnblockSystem lifts a block, returning whether one existed
+// The system can come back through gossip or its own announces afterwards
+func (dht *DHT) UnblockSystem(id uuid.UUID) (bool, error) {
+	removed, err := dht.storage.DeleteBlockedSystem(id)
+	if err != nil {
+		return false, err
+	}
+	if dht.routingTable.blocklist.remove(id) {
+		removed = true
+	}
+	if removed {
+		log.Printf("Unblocked %s", id)
+	}
+	return removed, nil
+}
+
+// GetBlockedSystems returns all active blocks
+func (dht *DHT) GetBlockedSystems() []*BlockedSystem {
+	return dht.routingTable.blocklist.list()
+}
+
+// pruneExpiredBlocks forgets blocks that have run out
+func (dht *DHT) pruneExpiredBlocks() {
+	dht.routingTable.blocklist.pruneExpired()
+	if pruned, err := dht.storage.PruneExpiredBlocks(); err != nil {
+		log.Printf("Failed to prune expired blocks: %v", err)
+	} else if pruned > 0 {
+		log.Printf("Lifted %d expired blocks", pruned)
+	}
+}
+
+// parseBlockSpec parses a -block entry: "uuid", "uuid:duration" or "uuid:duration:reason"
+func parseBlockSpec(spec string) (uuid.UUID, time.Duration, string, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
+
+	id, err := uuid.Parse(parts[0])
+	if err != nil {
+		return uuid.Nil, 0, "", fmt.Errorf("invalid system ID %q: %w", parts[0], err)
+	}
+
+	var duration time.Duration
+	if len(parts) > 1 && parts[1] != "" {
+		duration, err = time.ParseDuration(parts[1])
+		if err != nil {
+			return uuid.Nil, 0, "", fmt.Errorf("invalid block duration %q: %w", parts[1], err)
+		}
+	}
+
+	reason := "blocked at startup"
+	if len(parts) > 2 && parts[2] != "" {
+		reason = parts[2]
+	}
+	return id, duration, reason, nil
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strings"
@@ -17,39 +19,32 @@ import (
 // SeedNodeListURL is the URL to fetch the seed node list from
 const SeedNodeListURL = "https://raw.githubusercontent.com/sargonas/stellar-lab/main/SEED-NODES.txt"
 
-// FallbackSeedNodes are used if GitHub is unreachable
+// FallbackSeedNodes are tried last, after the GitHub (or cached) list and our personal seeds
 var FallbackSeedNodes = []string{
 	// Add stable fallback seeds here if needed
 }
 
 // FetchSeedNodes retrieves the current seed node list from GitHub
-func FetchSeedNodes() []string {
-	log.Printf("Fetching seed node list from GitHub...")
-
+// Callers fall back to the cached copy on error (see seeds.go)
+func FetchSeedNodes() ([]string, error) {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
 	req, err := http.NewRequest("GET", SeedNodeListURL, nil)
 	if err != nil {
-		log.Printf("Warning: Could not create request: %v", err)
-		log.Printf("Using fallback seed nodes")
-		return FallbackSeedNodes
+		return nil, fmt.Errorf("could not create seed list request: %w", err)
 	}
 	req.Header.Set("Cache-Control", "no-cache")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Warning: Could not fetch seed list from GitHub: %v", err)
-		log.Printf("Using fallback seed nodes")
-		return FallbackSeedNodes
+		return nil, fmt.Errorf("could not fetch seed list from GitHub: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		log.Printf("Warning: GitHub seed list returned status %d", resp.StatusCode)
-		log.Printf("Using fallback seed nodes")
-		return FallbackSeedNodes
+		return nil, fmt.Errorf("GitHub seed list returned status %d", resp.StatusCode)
 	}
 
 	var seeds []string
@@ -67,19 +62,14 @@ func FetchSeedNodes() []string {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Printf("Warning: Error reading seed list: %v", err)
-		log.Printf("Using fallback seed nodes")
-		return FallbackSeedNodes
+		return nil, fmt.Errorf("error reading seed list: %w", err)
 	}
 
 	if len(seeds) == 0 {
-		log.Printf("Warning: No seeds found in GitHub list")
-		log.Printf("Using fallback seed nodes")
-		return FallbackSeedNodes
+		return nil, fmt.Errorf("no seeds found in GitHub list")
 	}
 
-	log.Printf("Loaded %d seed nodes from GitHub", len(seeds))
-	return seeds
+	return seeds, nil
 }
 
 // === Full Sync ===
@@ -88,9 +78,13 @@ func FetchSeedNodes() []string {
 // This is the preferred method for new nodes to learn about the entire network quickly.
 // Returns the number of new systems learned, or error if full-sync is not available.
 func (dht *DHT) tryFullSync(address string) (int, error) {
-	fullSyncURL := fmt.Sprintf("http://%s/api/full-sync", address)
+	fullSyncURL := peerURL(address, "/api/full-sync")
+
+	if dht.budgetStage() >= BudgetNoFullSync {
+		return 0, fmt.Errorf("skipping full-sync: %w", ErrBandwidthBudget)
+	}
 
-	client := &http.Client{Timeout: 30 * time.Second} // Longer timeout for full sync
+	client := &http.Client{Timeout: 30 * time.Second, Transport: dht.httpClient.Transport} // Longer timeout for full sync
 	resp, err := client.Get(fullSyncURL)
 	if err != nil {
 		return 0, fmt.Errorf("full-sync request failed: %w", err)
@@ -100,41 +94,52 @@ func (dht *DHT) tryFullSync(address string) (int, error) {
 	if resp.StatusCode == http.StatusNotFound {
 		return 0, fmt.Errorf("full-sync not supported (v1.8.x or older)")
 	}
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return 0, fmt.Errorf("full-sync unavailable (retry after %ss)", resp.Header.Get("Retry-After"))
+	}
 	if resp.StatusCode != http.StatusOK {
 		return 0, fmt.Errorf("full-sync returned status %d", resp.StatusCode)
 	}
 
-	var syncResp FullSyncResponse
-	if err := json.NewDecoder(resp.Body).Decode(&syncResp); err != nil {
+	syncResp, truncated, err := decodeFullSync(io.LimitReader(resp.Body, MaxFullSyncBytes), dht.maxFullSyncSystems)
+	if err != nil {
 		return 0, fmt.Errorf("failed to parse full-sync response: %w", err)
 	}
 
 	log.Printf("  Full-sync received %d systems from %s (protocol v%s)",
 		syncResp.TotalCount, address, syncResp.ProtocolVersion)
+	if truncated {
+		log.Printf("  Full-sync from %s exceeded the %d system cap, ignoring the rest", address, dht.maxFullSyncSystems)
+	}
 
-	// Cache all systems from the response
-	newSystems := 0
+	// Collect everything first so the cache is written to storage in one transaction
+	entries := make([]CacheEntry, 0, len(syncResp.Systems)+1)
+	sourceID, _ := uuid.Parse(syncResp.LocalSystem.ID)
 
 	// Cache the local system from the sync response
 	if syncResp.LocalSystem.ID != "" {
 		localID, err := uuid.Parse(syncResp.LocalSystem.ID)
 		if err == nil && localID != dht.localSystem.ID {
 			sys := &System{
-				ID:          localID,
-				Name:        syncResp.LocalSystem.Name,
-				X:           syncResp.LocalSystem.X,
-				Y:           syncResp.LocalSystem.Y,
-				Z:           syncResp.LocalSystem.Z,
-				PeerAddress: syncResp.LocalSystem.PeerAddress,
-				InfoVersion: syncResp.LocalSystem.InfoVersion,
+				ID:              localID,
+				Name:            syncResp.LocalSystem.Name,
+				X:               syncResp.LocalSystem.X,
+				Y:               syncResp.LocalSystem.Y,
+				Z:               syncResp.LocalSystem.Z,
+				PeerAddress:     syncResp.LocalSystem.PeerAddress,
+				InfoVersion:     syncResp.LocalSystem.InfoVersion,
+				InfoSignature:   syncResp.LocalSystem.InfoSignature,
+				PeerTLS:         syncResp.LocalSystem.PeerTLS,
+				CoordsVersion:   syncResp.LocalSystem.CoordsVersion,
+				StarsVersion:    syncResp.LocalSystem.StarsVersion,
+				GenesisDemotion: syncResp.LocalSystem.GenesisDemotion,
+				Profile:         syncResp.LocalSystem.Profile,
 			}
 			// Assign star type from class (simplified)
-			sys.Stars = assignStarFromClass(syncResp.LocalSystem.StarClass)
+			sys.Stars = assignStarFromClass(syncResp.LocalSystem.classes())
 
-			if existing := dht.routingTable.GetCachedSystem(localID); existing == nil {
-				newSystems++
-			}
-			dht.routingTable.CacheSystem(sys, localID, true) // Mark as verified since we got it directly
+			// Mark as verified since we got it directly
+			entries = append(entries, CacheEntry{System: sys, LearnedFrom: localID, Verified: true})
 		}
 	}
 
@@ -149,30 +154,118 @@ func (dht *DHT) tryFullSync(address string) (int, error) {
 		}
 
 		sys := &System{
-			ID:          sysID,
-			Name:        syncSys.Name,
-			X:           syncSys.X,
-			Y:           syncSys.Y,
-			Z:           syncSys.Z,
-			PeerAddress: syncSys.PeerAddress,
-			InfoVersion: syncSys.InfoVersion,
-		}
-		sys.Stars = assignStarFromClass(syncSys.StarClass)
-
-		if existing := dht.routingTable.GetCachedSystem(sysID); existing == nil {
-			newSystems++
+			ID:              sysID,
+			Name:            syncSys.Name,
+			X:               syncSys.X,
+			Y:               syncSys.Y,
+			Z:               syncSys.Z,
+			PeerAddress:     syncSys.PeerAddress,
+			InfoVersion:     syncSys.InfoVersion,
+			InfoSignature:   syncSys.InfoSignature,
+			PeerTLS:         syncSys.PeerTLS,
+			CoordsVersion:   syncSys.CoordsVersion,
+			StarsVersion:    syncSys.StarsVersion,
+			GenesisDemotion: syncSys.GenesisDemotion,
+			Profile:         syncSys.Profile,
 		}
+		sys.Stars = assignStarFromClass(syncSys.classes())
 
 		// Mark as verified only if the source says they verified it recently
 		verified := syncSys.LastSeen > 0 && time.Since(time.Unix(syncSys.LastSeen, 0)) < VerificationCutoff
-		dht.routingTable.CacheSystem(sys, uuid.Nil, verified)
+		entries = append(entries, CacheEntry{System: sys, LearnedFrom: sourceID, Verified: verified})
+	}
+
+	newSystems := dht.routingTable.CacheSystemsBatch(entries)
+	for _, e := range entries {
+		if e.Verified && sourceID != uuid.Nil {
+			dht.routingTable.partitions.reported(e.System, sourceID)
+		}
 	}
 
+	dht.sendServiceReceipt(sourceID, address, AttestationFullSyncServed)
 	return newSystems, nil
 }
 
-// assignStarFromClass creates a MultiStarSystem from a star class string
-func assignStarFromClass(class string) MultiStarSystem {
+// decodeFullSync reads a full-sync response, keeping at most maxSystems systems
+// Systems are decoded one at a time and reading stops at the cap, so an oversized
+// response costs neither memory nor cache space. Returns whether systems were dropped.
+func decodeFullSync(r io.Reader, maxSystems int) (*FullSyncResponse, bool, error) {
+	var syncResp FullSyncResponse
+	dec := json.NewDecoder(r)
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, false, fmt.Errorf("expected JSON object")
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, false, err
+		}
+		key, _ := tok.(string)
+
+		var target interface{}
+		switch key {
+		case "protocol_version":
+			target = &syncResp.ProtocolVersion
+		case "timestamp":
+			target = &syncResp.Timestamp
+		case "local_system":
+			target = &syncResp.LocalSystem
+		case "total_count":
+			target = &syncResp.TotalCount
+		case "systems":
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+				return nil, false, fmt.Errorf("expected systems array")
+			}
+			for dec.More() {
+				if len(syncResp.Systems) >= maxSystems {
+					return &syncResp, true, nil
+				}
+				var sys FullSyncSystem
+				if err := dec.Decode(&sys); err != nil {
+					return nil, false, err
+				}
+				syncResp.Systems = append(syncResp.Systems, sys)
+			}
+			if _, err := dec.Token(); err != nil { // Closing ]
+				return nil, false, err
+			}
+			continue
+		default:
+			target = &json.RawMessage{} // Unknown field from a newer version
+		}
+		if err := dec.Decode(target); err != nil {
+			return nil, false, err
+		}
+	}
+	return &syncResp, false, nil
+}
+
+// starClasses joins a multi-star system's classes for full-sync, primary first ("G+M", "K+M+M")
+// Single stars give "": StarClass already says all there is
+func starClasses(stars MultiStarSystem) string {
+	if stars.Secondary == nil {
+		return ""
+	}
+	classes := stars.Primary.Class + "+" + stars.Secondary.Class
+	if stars.Tertiary != nil {
+		classes += "+" + stars.Tertiary.Class
+	}
+	return classes
+}
+
+// classes returns every star class a full-sync entry lists
+// Older nodes only send the primary's
+func (f *FullSyncSystem) classes() string {
+	if f.StarClasses != "" {
+		return f.StarClasses
+	}
+	return f.StarClass
+}
+
+// assignStarFromClass creates a MultiStarSystem from a star class string: one class,
+// or the primary's and its companions' joined with "+" (see starClasses)
+func assignStarFromClass(classes string) MultiStarSystem {
 	// Map class to star type - simplified version
 	starTypes := map[string]StarType{
 		"O": {Class: "O", Description: "Blue Giant", Color: "#9bb0ff", Temperature: 40000, Luminosity: 30000},
@@ -185,23 +278,46 @@ func assignStarFromClass(class string) MultiStarSystem {
 		"X": {Class: "X", Description: "Supermassive Black Hole", Color: "#000000", Temperature: 0, Luminosity: 0},
 	}
 
-	star, ok := starTypes[class]
-	if !ok {
-		star = starTypes["G"] // Default to G-class
+	lookup := func(class string) StarType {
+		star, ok := starTypes[class]
+		if !ok {
+			star = starTypes["G"] // Default to G-class
+		}
+		return star
 	}
 
-	return MultiStarSystem{
-		Primary:   star,
-		IsBinary:  false,
-		IsTrinary: false,
-		Count:     1,
+	parts := strings.SplitN(classes, "+", 4)
+	stars := MultiStarSystem{
+		Primary: lookup(parts[0]),
+		Count:   1,
+	}
+	if len(parts) > 3 || stars.Primary.Class == "X" {
+		return stars // More than a trinary (or a black hole with company) isn't anything we generate
+	}
+	if len(parts) >= 2 {
+		secondary := lookup(parts[1])
+		stars.Secondary = &secondary
+		stars.IsBinary = true
+		stars.Count = 2
 	}
+	if len(parts) == 3 {
+		tertiary := lookup(parts[2])
+		stars.Tertiary = &tertiary
+		stars.IsBinary = false
+		stars.IsTrinary = true
+		stars.Count = 3
+	}
+	return stars
 }
 
+// BootstrapParallelism is how many bootstrap peers are contacted at once
+const BootstrapParallelism = 4
+
 // BootstrapConfig holds configuration for the bootstrap process
 type BootstrapConfig struct {
-	SeedNodes       []string      // Seed node addresses to try
-	BootstrapPeer   string        // Direct peer to bootstrap from
+	SeedNodes       []SeedNode    // Seeds to try, in order (loaded by Bootstrap when empty; see seeds.go)
+	BootstrapPeers  []string      // Direct peers to bootstrap from, raced against each other
+	FallbackToSeeds bool          // Try the seeds if every bootstrap peer fails (set for remembered peers, not -bootstrap)
 	Timeout         time.Duration // Timeout for bootstrap operations
 	MinInitialPeers int           // Minimum peers before considering bootstrap complete
 }
@@ -237,60 +353,65 @@ func (dht *DHT) Bootstrap(config BootstrapConfig) error {
 		}
 		if connected > 0 {
 			log.Printf("Rejoined network via %d cached peers", connected)
+			dht.diagnose(DiagCachedPeers, true, "Rejoined through %d of %d peers from the last session", connected, len(cachedPeers))
+			if len(config.BootstrapPeers) > 0 {
+				// Still contact every bootstrap peer, not just the ones we were last connected to
+				dht.wg.Add(1)
+				go func() {
+					defer dht.wg.Done()
+					dht.bootstrapFromPeers(config.BootstrapPeers)
+				}()
+			}
 			return dht.completeBootstrap()
 		}
 		log.Printf("Could not reach any cached peers, falling back to bootstrap...")
+		dht.diagnose(DiagCachedPeers, false, "None of the %d peers from the last session answered", len(cachedPeers))
 	}
 
-	// If we have a direct bootstrap peer by cli parameter, try that
-	if config.BootstrapPeer != "" {
-		err := dht.bootstrapFromPeer(config.BootstrapPeer)
-		if err != nil {
-			// In isolated mode, failing to bootstrap means we're the genesis node
-			if isolatedMode != nil && *isolatedMode {
-				log.Printf("Isolated mode: becoming genesis node")
-				dht.becomeGenesisNode()
-				return nil
-			}
-			return fmt.Errorf("direct bootstrap peer failed: %w", err)
+	// If we have direct bootstrap peers (cli parameter or remembered from it), race them
+	if len(config.BootstrapPeers) > 0 {
+		err := dht.bootstrapFromPeers(config.BootstrapPeers)
+		if err == nil {
+			log.Printf("Successfully bootstrapped from direct peer")
+			return dht.completeBootstrap()
 		}
-		log.Printf("Successfully bootstrapped from direct peer")
-		return dht.completeBootstrap()
+		// In isolated mode, failing to bootstrap means we're the genesis node
+		if isolatedMode != nil && *isolatedMode {
+			log.Printf("Isolated mode: becoming genesis node")
+			dht.diagnose(DiagBootstrap, true, "Isolated mode: no bootstrap peer answered, so this node became the genesis black hole")
+			dht.becomeGenesisNode()
+			return nil
+		}
+		if !config.FallbackToSeeds {
+			dht.diagnose(DiagBootstrap, false, "No -bootstrap peer answered, and seeds aren't tried for them")
+			return fmt.Errorf("direct bootstrap peers failed: %w", err)
+		}
+		log.Printf("Remembered bootstrap peers failed (%v), falling back to seed nodes", err)
 	}
 
 	// In isolated mode with no bootstrap peer, become genesis immediately
 	if isolatedMode != nil && *isolatedMode {
 		log.Printf("Isolated mode: no bootstrap peer specified, starting as genesis")
+		dht.diagnose(DiagBootstrap, true, "Isolated mode: started as the genesis black hole")
 		dht.becomeGenesisNode()
 		return nil
 	}
 
-	// Try the seed nodes
-	if len(config.SeedNodes) > 0 {
-		for _, seedAddr := range config.SeedNodes {
-			log.Printf("Trying seed node: %s", seedAddr)
-			if err := dht.bootstrapFromSeed(seedAddr); err != nil {
-				log.Printf("  Failed: %v", err)
-				continue
-			}
-			log.Printf("Successfully bootstrapped from seed node")
-			return dht.completeBootstrap()
-		}
+	// Try the seed nodes: GitHub (or cached), personal, then hardcoded
+	if len(config.SeedNodes) == 0 {
+		config.SeedNodes = dht.LoadSeedNodes()
 	}
-
-	// Try fetching seed nodes from GitHub (only if not in isolated mode)
-	if isolatedMode == nil || !*isolatedMode {
-		log.Printf("Fetching seed nodes from GitHub...")
-		seedNodes := FetchSeedNodes()
-		for _, seedAddr := range seedNodes {
-			log.Printf("Trying seed node: %s", seedAddr)
-			if err := dht.bootstrapFromSeed(seedAddr); err != nil {
-				log.Printf("  Failed: %v", err)
-				continue
-			}
-			log.Printf("Successfully bootstrapped from seed node")
-			return dht.completeBootstrap()
+	for _, seed := range config.SeedNodes {
+		log.Printf("Trying seed node: %s (%s)", seed.Address, seed.Source)
+		if err := dht.bootstrapFromSeed(seed.Address); err != nil {
+			log.Printf("  Failed: %v", err)
+			dht.diagnose(DiagSeedContact, false, "%s seed %s: %v", seed.Source, seed.Address, err)
+			continue
 		}
+		dht.diagnose(DiagSeedContact, true, "Joined through %s seed %s", seed.Source, seed.Address)
+		log.Printf("Successfully bootstrapped from %s seed node", seed.Source)
+		dht.setJoinedVia(seed)
+		return dht.completeBootstrap()
 	}
 
 	// When no bootstrap sources available
@@ -299,6 +420,11 @@ func (dht *DHT) Bootstrap(config BootstrapConfig) error {
 		log.Printf("Warning: Could not contact any seed nodes, but have %d cached peers", rtSize)
 		return dht.completeBootstrap()
 	}
+	if len(config.SeedNodes) == 0 {
+		dht.diagnose(DiagBootstrap, false, "No seeds or bootstrap peers to join through")
+	} else {
+		dht.diagnose(DiagBootstrap, false, "None of the %d seeds could be joined through", len(config.SeedNodes))
+	}
 
 	log.Printf("Warning: Could not find any bootstrap peers")
 	log.Printf("  Your node is running but isolated")
@@ -327,6 +453,7 @@ func (dht *DHT) becomeGenesisNode() {
 		IsTrinary: false,
 		Count:     1,
 	}
+	dht.localSystem.BumpInfoVersion()
 
 	// Save to database
 	if err := dht.storage.SaveSystem(dht.localSystem); err != nil {
@@ -336,23 +463,112 @@ func (dht *DHT) becomeGenesisNode() {
 	log.Printf("✦ Now operating as genesis black hole at origin (0,0,0) ✦")
 }
 
+// bootstrapFromPeers races the bootstrap peers, returning once one of them has let us in
+// The rest keep being contacted in the background; any that answer join the routing table
+func (dht *DHT) bootstrapFromPeers(addresses []string) error {
+	workers := BootstrapParallelism
+	if len(addresses) < workers {
+		workers = len(addresses)
+	}
+
+	jobs := make(chan string)
+	results := make(chan error, len(addresses))
+	dht.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer dht.wg.Done()
+			for address := range jobs {
+				err := dht.bootstrapFromPeer(address)
+				if err != nil {
+					log.Printf("  Bootstrap peer %s failed: %v", address, err)
+					dht.diagnose(DiagSeedContact, false, "Bootstrap peer %s: %v", address, err)
+					err = fmt.Errorf("%s: %w", address, err)
+				} else {
+					dht.diagnose(DiagSeedContact, true, "Joined through bootstrap peer %s", address)
+				}
+				results <- err
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for _, address := range addresses {
+			select {
+			case jobs <- address:
+			case <-dht.shutdown:
+				return
+			}
+		}
+	}()
+
+	var errs []error
+	for range addresses {
+		select {
+		case err := <-results:
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err)
+		case <-dht.shutdown:
+			return fmt.Errorf("shutting down")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// needsSponsor reports whether we still have to pick a sponsor (and so our coordinates)
+func (dht *DHT) needsSponsor() bool {
+	dht.sponsorMu.Lock()
+	defer dht.sponsorMu.Unlock()
+	return dht.localSystem.SponsorID == nil && dht.localSystem.Stars.Primary.Class != "X"
+}
+
+// assignSponsor places us near sponsor, unless a sponsor has been assigned meanwhile
+// (racing bootstrap peers: only the first to answer becomes the sponsor)
+func (dht *DHT) assignSponsor(sponsor *System) bool {
+	dht.sponsorMu.Lock()
+	defer dht.sponsorMu.Unlock()
+	if dht.localSystem.SponsorID != nil || dht.localSystem.Stars.Primary.Class == "X" {
+		return false
+	}
+
+	// Generate our deterministic coordinates based on this sponsor
+	dht.localSystem.GenerateClusteredCoordinates(sponsor)
+	dht.localSystem.BumpInfoVersion()
+
+	log.Printf("  Assigned sponsor: %s (%s)", sponsor.Name, sponsor.ID.String()[:8])
+	dht.diagnose(DiagSponsor, true, "Placed near %s (%s)", sponsor.Name, sponsor.ID.String()[:8])
+	log.Printf("  New coordinates: (%.2f, %.2f, %.2f)",
+		dht.localSystem.X, dht.localSystem.Y, dht.localSystem.Z)
+
+	// Save updated coordinates to database
+	if err := dht.storage.SaveSystem(dht.localSystem); err != nil {
+		log.Printf("  Warning: failed to save coordinates: %v", err)
+	}
+	return true
+}
+
 // bootstrapFromPeer bootstraps from a known peer address
 func (dht *DHT) bootstrapFromPeer(address string) error {
 	// If we don't have a sponsor yet, we need to get peer info BEFORE pinging
 	// because the ping will fail coordinate validation without valid coordinates
-	if dht.localSystem.SponsorID == nil && dht.localSystem.Stars.Primary.Class != "X" {
+	if dht.needsSponsor() {
 		// Get peer's system info via HTTP api call (not DHT ping)
-		systemURL := fmt.Sprintf("http://%s/system", address)
-		resp, err := http.Get(systemURL)
+		systemURL := peerURL(address, "/system")
+		resp, err := (&http.Client{Transport: dht.httpClient.Transport}).Get(systemURL)
 		if err != nil {
 			return fmt.Errorf("failed to get peer system info: %w", err)
 		}
 		defer resp.Body.Close()
 
-		var peerSys System
-		if err := json.NewDecoder(resp.Body).Decode(&peerSys); err != nil {
+		var info SystemInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
 			return fmt.Errorf("failed to parse peer system info: %w", err)
 		}
+		peerSys, err := info.System()
+		if err != nil {
+			return fmt.Errorf("invalid peer system info: %w", err)
+		}
 
 		// Don't bootstrap from ourselves - this happens when a node points to itself
 		// for isolation (e.g., dev cluster node 1). Fail cleanly without state mutation.
@@ -360,17 +576,7 @@ func (dht *DHT) bootstrapFromPeer(address string) error {
 			return fmt.Errorf("cannot bootstrap from self (isolated mode)")
 		}
 
-		// Generate our deterministic coordinates based on this sponsor
-		dht.localSystem.GenerateClusteredCoordinates(&peerSys)
-
-		log.Printf("  Assigned sponsor: %s (%s)", peerSys.Name, peerSys.ID.String()[:8])
-		log.Printf("  New coordinates: (%.2f, %.2f, %.2f)",
-			dht.localSystem.X, dht.localSystem.Y, dht.localSystem.Z)
-
-		// Save updated coordinates to database
-		if err := dht.storage.SaveSystem(dht.localSystem); err != nil {
-			log.Printf("  Warning: failed to save coordinates: %v", err)
-		}
+		dht.assignSponsor(peerSys)
 	}
 
 	// Now we can ping with valid coordinates
@@ -402,8 +608,8 @@ func (dht *DHT) bootstrapFromPeer(address string) error {
 // bootstrapFromSeed bootstraps using a seed node's discovery endpoint
 func (dht *DHT) bootstrapFromSeed(seedAddr string) error {
 	// First try the discovery endpoint
-	discoveryURL := fmt.Sprintf("http://%s/api/discovery", seedAddr)
-	resp, err := http.Get(discoveryURL)
+	discoveryURL := peerURL(seedAddr, "/api/discovery")
+	resp, err := (&http.Client{Transport: dht.httpClient.Transport}).Get(discoveryURL)
 	if err != nil {
 		return fmt.Errorf("failed to contact seed: %w", err)
 	}
@@ -422,37 +628,25 @@ func (dht *DHT) bootstrapFromSeed(seedAddr string) error {
 
 	// If we don't have a sponsor yet (new node), set one before pinging
 	// This is required for coordinate validation
-	if dht.localSystem.SponsorID == nil && dht.localSystem.Stars.Primary.Class != "X" {
-		// Find a suitable sponsor from the discovery list
-		var sponsor *DiscoverySystem
-		for i := range systems {
-			if systems[i].ID != dht.localSystem.ID.String() {
-				sponsor = &systems[i]
-				break
-			}
-		}
+	if dht.needsSponsor() {
+		// Find a suitable sponsor from the discovery list, preferring ones with room
+		sponsor := pickSponsor(systems, dht.localSystem.ID.String())
 
-		if sponsor != nil {
+		if sponsor == nil {
+			dht.diagnose(DiagSponsor, false, "Seed %s listed %d systems but none with an address to reach", seedAddr, len(systems))
+		} else {
 			sponsorID, err := uuid.Parse(sponsor.ID)
 			if err == nil {
 				// Create a temporary System struct for coordinate generation
-				sponsorSys := &System{
-					ID: sponsorID,
-					X:  sponsor.X,
-					Y:  sponsor.Y,
-					Z:  sponsor.Z,
-				}
-
-				// Generate our deterministic coordinates based on sponsor
-				dht.localSystem.GenerateClusteredCoordinates(sponsorSys)
-
-				log.Printf("  Assigned sponsor: %s (%s)", sponsor.Name, sponsor.ID[:8])
-				log.Printf("  New coordinates: (%.2f, %.2f, %.2f)",
-					dht.localSystem.X, dht.localSystem.Y, dht.localSystem.Z)
-
-				// Save updated coordinates to database
-				if err := dht.storage.SaveSystem(dht.localSystem); err != nil {
-					log.Printf("  Warning: failed to save coordinates: %v", err)
+				assigned := dht.assignSponsor(&System{
+					ID:   sponsorID,
+					Name: sponsor.Name,
+					X:    sponsor.X,
+					Y:    sponsor.Y,
+					Z:    sponsor.Z,
+				})
+				if assigned && !sponsor.HasCapacity {
+					dht.diagnose(DiagSponsor, false, "Every system seed %s listed is full; placed near %s anyway", seedAddr, sponsor.Name)
 				}
 			}
 		}
@@ -499,6 +693,10 @@ func (dht *DHT) bootstrapFromSeed(seedAddr string) error {
 		return fmt.Errorf("could not connect to any systems from seed")
 	}
 
+	// The seed lists itself first
+	if seedID, err := uuid.Parse(systems[0].ID); err == nil {
+		dht.sendServiceReceipt(seedID, seedAddr, AttestationDiscoveryServed)
+	}
 	return nil
 }
 
@@ -511,7 +709,7 @@ func (dht *DHT) completeBootstrap() error {
 	peers := dht.routingTable.GetAllRoutingTableNodes()
 	fullSyncSuccess := false
 	for _, peer := range peers {
-		if peer.PeerAddress == "" {
+		if peer.PeerAddress == "" || !dht.peerSupports(peer.ID, CapFullSync) {
 			continue
 		}
 		newSystems, err := dht.tryFullSync(peer.PeerAddress)
@@ -537,16 +735,9 @@ func (dht *DHT) completeBootstrap() error {
 	// Step 3: Announce ourselves to closest nodes (always do this)
 	log.Printf("  Announcing to closest nodes...")
 	result := dht.FindNode(dht.localSystem.ID)
-	announced := 0
-	for _, sys := range result.ClosestNodes {
-		if sys.ID == dht.localSystem.ID || sys.PeerAddress == "" {
-			continue
-		}
-		if err := dht.AnnounceToSystem(sys); err == nil {
-			announced++
-		}
-	}
+	announced := dht.announceWithRedirects(result.ClosestNodes)
 	log.Printf("  Announced to %d nodes", announced)
+	dht.diagnose(DiagAnnounce, announced > 0, "Announced to %d of %d closest nodes", announced, len(result.ClosestNodes))
 
 	// Report final state
 	rtSize := dht.routingTable.GetRoutingTableSize()
@@ -559,12 +750,12 @@ func (dht *DHT) completeBootstrap() error {
 // BootstrapFromAddress is a convenience function to bootstrap from a single address
 func (dht *DHT) BootstrapFromAddress(address string) error {
 	config := DefaultBootstrapConfig()
-	config.BootstrapPeer = address
+	config.BootstrapPeers = []string{address}
 	return dht.Bootstrap(config)
 }
 
 // BootstrapFromSeedNodes is a convenience function to bootstrap from seed nodes
-func (dht *DHT) BootstrapFromSeedNodes(seeds []string) error {
+func (dht *DHT) BootstrapFromSeedNodes(seeds []SeedNode) error {
 	config := DefaultBootstrapConfig()
 	config.SeedNodes = seeds
 	return dht.Bootstrap(config)
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The routing table keeps every system in one map rather than k-buckets, but the ID space
+// is still split the Kademlia way for upkeep: bucket i holds the IDs sharing exactly i
+// leading bits with ours, so bucket 0 is the far half of the space and each one after it
+// half the size of the last. Lookups and direct contact touch a bucket; one left alone
+// for BucketRefreshAge that should hold someone is refreshed with a lookup for a random
+// ID in its range, so far corners of the galaxy keep being visited even when nearby peers
+// answer everything we ask.
+const (
+	// IDBits is the length of a system ID, and so the number of buckets
+	IDBits = 128
+
+	// BucketRefreshInterval is how often stale buckets are looked for
+	BucketRefreshInterval = 10 * time.Minute
+
+	// BucketRefreshAge is how long a bucket goes untouched before it's refreshed
+	BucketRefreshAge = time.Hour
+
+	// MaxBucketRefreshes caps the lookups of one run, stalest first, so a node waking
+	// from a long sleep with every bucket stale catches up over several runs
+	MaxBucketRefreshes = 8
+
+	// BucketRefreshConcurrency is how many refresh lookups run at once
+	BucketRefreshConcurrency = 2
+
+	// RoutingHealthLogInterval is how often the routing table health summary is logged
+	RoutingHealthLogInterval = 7 * 24 * time.Hour
+)
+
+// bucketIndex is the bucket id falls in: how many leading bits it shares with local
+// (IDBits-1 for local itself, which has no bucket)
+func bucketIndex(local, id uuid.UUID) int {
+	for i := 0; i < len(local); i++ {
+		if x := local[i] ^ id[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IDBits - 1
+}
+
+// RandomIDInBucket returns a random ID in bucket idx: our first idx bits, the next one
+// flipped, and random bits after it
+func (rt *RoutingTable) RandomIDInBucket(idx int) uuid.UUID {
+	var id uuid.UUID
+	rand.Read(id[:])
+	for i := 0; i < idx; i++ {
+		mask := byte(0x80) >> (i % 8)
+		id[i/8] = id[i/8]&^mask | rt.localID[i/8]&mask
+	}
+	mask := byte(0x80) >> (idx % 8)
+	id[idx/8] = id[idx/8]&^mask | ^rt.localID[idx/8]&mask
+	return id
+}
+
+// bucketExpected is how many of size systems spread evenly over the ID space would fall
+// in bucket idx
+func bucketExpected(idx, size int) float64 {
+	if idx >= 62 {
+		return 0
+	}
+	return float64(size) / float64(uint64(2)<<idx)
+}
+
+// bucketTracker remembers when each bucket was last touched and refreshed
+// Locked on its own, never while holding cacheMu
+type bucketTracker struct {
+	mu          sync.Mutex
+	started     time.Time
+	lastAccess  [IDBits]time.Time
+	lastRefresh [IDBits]time.Time
+	lastFound   [IDBits]int // Systems in the bucket the last refresh turned up
+	refreshes   int64
+	failures    int64 // Refresh lookups nobody answered
+	loggedAt    time.Time
+}
+
+func newBucketTracker() *bucketTracker {
+	return &bucketTracker{started: time.Now()}
+}
+
+// touch records a lookup for, or direct contact with, an ID in bucket idx
+func (b *bucketTracker) touch(idx int, at time.Time) {
+	b.mu.Lock()
+	b.lastAccess[idx] = at
+	b.mu.Unlock()
+}
+
+// accessed is when bucket idx was last touched (our start if never)
+func (b *bucketTracker) accessed(idx int) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.lastAccess[idx].IsZero() {
+		return b.started
+	}
+	return b.lastAccess[idx]
+}
+
+// refreshed records a refresh lookup's outcome
+func (b *bucketTracker) refreshed(idx int, at time.Time, found int, answered bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastRefresh[idx] = at
+	b.lastFound[idx] = found
+	b.refreshes++
+	if !answered {
+		b.failures++
+	}
+}
+
+// touchBucket records a lookup for, or direct contact with, id
+func (rt *RoutingTable) touchBucket(id uuid.UUID) {
+	if id != rt.localID {
+		rt.buckets.touch(bucketIndex(rt.localID, id), time.Now())
+	}
+}
+
+// bucketCounts returns how many cached systems, and of them routing table peers, each bucket holds
+func (rt *RoutingTable) bucketCounts() (systems, peers [IDBits]int) {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+
+	cutoff := time.Now().Add(-VerificationCutoff)
+	for id, cached := range rt.systemCache {
+		idx := bucketIndex(rt.localID, id)
+		systems[idx]++
+		if cachedPeerStatus(cached, cutoff).inTable {
+			peers[idx]++
+		}
+	}
+	return systems, peers
+}
+
+// StaleBuckets returns the buckets due for a refresh at now, stalest first: untouched for
+// BucketRefreshAge, and holding cached systems or expected to given the galaxy's size
+func (rt *RoutingTable) StaleBuckets(now time.Time) []int {
+	systems, _ := rt.bucketCounts()
+	size := rt.GetCacheSize() + 1
+
+	var stale []int
+	for idx := 0; idx < IDBits; idx++ {
+		if systems[idx] == 0 && bucketExpected(idx, size) < 1 {
+			continue
+		}
+		if now.Sub(rt.buckets.accessed(idx)) >= BucketRefreshAge {
+			stale = append(stale, idx)
+		}
+	}
+	sort.SliceStable(stale, func(i, j int) bool {
+		return rt.buckets.accessed(stale[i]).Before(rt.buckets.accessed(stale[j]))
+	})
+	return stale
+}
+
+// BucketHealth is one bucket of the routing table health summary
+type BucketHealth struct {
+	Index       int   `json:"index"`
+	Systems     int   `json:"systems"`      // Cached systems in its range
+	Peers       int   `json:"peers"`        // Of them, routing table peers
+	LastAccess  int64 `json:"last_access"`  // Last lookup or contact in its range (0 = none since start)
+	LastRefresh int64 `json:"last_refresh"` // 0 = never refreshed
+	LastFound   int   `json:"last_found"`   // Systems in its range the last refresh turned up
+}
+
+// RoutingHealth summarizes how well the routing table covers the ID space (/api/stats)
+type RoutingHealth struct {
+	Populated       int            `json:"buckets_populated"` // Buckets holding at least one cached system
+	Expected        int            `json:"buckets_expected"`  // Buckets the galaxy's size says should
+	FillRatio       float64        `json:"fill_ratio"`        // Populated expected buckets / expected buckets
+	Stale           int            `json:"buckets_stale"`     // Due for a refresh
+	Refreshes       int64          `json:"refreshes"`
+	RefreshFailures int64          `json:"refresh_failures"` // Refresh lookups nobody answered
+	Buckets         []BucketHealth `json:"buckets"`          // Populated or refreshed ones, nearest first
+}
+
+// RoutingHealth returns the routing table health summary
+func (rt *RoutingTable) RoutingHealth() RoutingHealth {
+	systems, peers := rt.bucketCounts()
+	size := rt.GetCacheSize() + 1
+	h := RoutingHealth{Stale: len(rt.StaleBuckets(time.Now())), Buckets: []BucketHealth{}}
+
+	expectedFilled := 0
+	for idx := 0; idx < IDBits; idx++ {
+		expected := bucketExpected(idx, size) >= 1
+		if expected {
+			h.Expected++
+		}
+		if systems[idx] > 0 {
+			h.Populated++
+			if expected {
+				expectedFilled++
+			}
+		}
+	}
+	if h.Expected > 0 {
+		h.FillRatio = float64(expectedFilled) / float64(h.Expected)
+	}
+
+	b := rt.buckets
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h.Refreshes, h.RefreshFailures = b.refreshes, b.failures
+	for idx := IDBits - 1; idx >= 0; idx-- {
+		if systems[idx] == 0 && b.lastRefresh[idx].IsZero() {
+			continue
+		}
+		bh := BucketHealth{Index: idx, Systems: systems[idx], Peers: peers[idx], LastFound: b.lastFound[idx]}
+		if !b.lastAccess[idx].IsZero() {
+			bh.LastAccess = b.lastAccess[idx].Unix()
+		}
+		if !b.lastRefresh[idx].IsZero() {
+			bh.LastRefresh = b.lastRefresh[idx].Unix()
+		}
+		h.Buckets = append(h.Buckets, bh)
+	}
+	return h
+}
+
+// bucketRefreshLoop refreshes stale buckets and logs the health summary weekly
+func (dht *DHT) bucketRefreshLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskBucketRefresh, every(BucketRefreshInterval))
+
+	ticker := time.NewTicker(BucketRefreshInterval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(BucketRefreshInterval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(BucketRefreshInterval))
+		case <-t.trigger:
+		}
+		t.run(dht.refreshBuckets)
+	}
+}
+
+// refreshBuckets looks up a random ID in each of the stalest buckets, a few at a time
+// Returns how many buckets were refreshed
+func (dht *DHT) refreshBuckets() (int, error) {
+	rt := dht.routingTable
+	stale := rt.StaleBuckets(time.Now())
+	if len(stale) > MaxBucketRefreshes {
+		stale = stale[:MaxBucketRefreshes]
+	}
+
+	sem := make(chan struct{}, BucketRefreshConcurrency)
+	var wg sync.WaitGroup
+	for _, idx := range stale {
+		select {
+		case <-dht.shutdown:
+			wg.Wait()
+			return 0, nil
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(idx int) {
+			defer func() { <-sem; wg.Done() }()
+			result := dht.findNode(rt.RandomIDInBucket(idx), false)
+			found, answered := 0, false
+			for _, sys := range result.ClosestNodes {
+				if bucketIndex(rt.localID, sys.ID) == idx {
+					found++
+				}
+			}
+			for _, q := range result.Queries {
+				answered = answered || q.Outcome == QueryAnswered
+			}
+			rt.buckets.refreshed(idx, time.Now(), found, answered)
+		}(idx)
+	}
+	wg.Wait()
+
+	dht.logRoutingHealth()
+	return len(stale), nil
+}
+
+// logRoutingHealth logs the health summary once every RoutingHealthLogInterval
+func (dht *DHT) logRoutingHealth() {
+	b := dht.routingTable.buckets
+	b.mu.Lock()
+	due := time.Since(b.loggedAt) >= RoutingHealthLogInterval
+	if due {
+		b.loggedAt = time.Now()
+	}
+	b.mu.Unlock()
+	if !due {
+		return
+	}
+
+	h := dht.routingTable.RoutingHealth()
+	log.Printf("Routing table health: %d buckets populated (%d of %d expected, %.0f%%), %d stale, %d refreshes (%d unanswered)",
+		h.Populated, int(h.FillRatio*float64(h.Expected)+0.5), h.Expected, h.FillRatio*100, h.Stale, h.Refreshes, h.RefreshFailures)
+}
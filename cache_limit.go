@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The system cache is capped so a peer gossiping made-up systems can't grow it without
+// bound. When a new system would take it past the cap, entries are evicted to make room:
+// never-verified ones first, then ones whose last contact aged out, farthest from us by
+// XOR within each. Routing table members and systems verified within VerificationCutoff
+// are never evicted, so the cap only binds on gossip. On top of that, each sender may
+// introduce at most half the cap in systems we'd never heard of per hour, which keeps
+// one flooding peer from churning out everyone else's gossip.
+const (
+	// DefaultMaxCachedSystems is the default cap on the system cache
+	DefaultMaxCachedSystems = 5000
+
+	// IntroductionWindow is the window the per-sender introduction limit counts over
+	IntroductionWindow = time.Hour
+
+	// CacheEvictionHeadroom is the share of the cap freed beyond the one slot needed,
+	// so a burst of inserts at the cap doesn't scan the cache once each
+	CacheEvictionHeadroom = 20
+)
+
+// introductionCount is how many new systems one sender introduced in its current window
+type introductionCount struct {
+	windowStart time.Time
+	count       int
+	refused     bool // Refusals already logged this window
+}
+
+// cacheLimit enforces the system cache cap (guarded by cacheMu)
+type cacheLimit struct {
+	max           int
+	evicted       int
+	refused       int
+	introductions map[uuid.UUID]*introductionCount
+}
+
+func newCacheLimit() *cacheLimit {
+	return &cacheLimit{max: DefaultMaxCachedSystems, introductions: make(map[uuid.UUID]*introductionCount)}
+}
+
+// perSender is how many new systems one sender may introduce per IntroductionWindow
+func (l *cacheLimit) perSender() int {
+	if n := l.max / 2; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// CacheLimitStats reports the cache cap and what it has turned away (stats endpoint)
+type CacheLimitStats struct {
+	Size                 int `json:"size"`
+	Max                  int `json:"max"`
+	MaxPerSenderHour     int `json:"max_per_sender_hour"`
+	Evicted              int `json:"evicted"`
+	RefusedIntroductions int `json:"refused_introductions"`
+}
+
+// SetMaxCachedSystems changes the cache cap, evicting right away if it's now over
+func (rt *RoutingTable) SetMaxCachedSystems(n int) {
+	rt.cacheMu.Lock()
+	rt.cacheLimit.max = n
+	events := rt.evictForRoom(0, time.Now())
+	rt.cacheMu.Unlock()
+
+	rt.emit(events...)
+}
+
+// GetCacheLimitStats returns the cache cap counters
+func (rt *RoutingTable) GetCacheLimitStats() CacheLimitStats {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	return CacheLimitStats{
+		Size:                 len(rt.systemCache),
+		Max:                  rt.cacheLimit.max,
+		MaxPerSenderHour:     rt.cacheLimit.perSender(),
+		Evicted:              rt.cacheLimit.evicted,
+		RefusedIntroductions: rt.cacheLimit.refused,
+	}
+}
+
+// allowIntroduction counts sys as a new system introduced by learnedFrom, reporting
+// false once that sender is over its limit. Systems speaking for themselves and ones we
+// added locally (uuid.Nil) aren't counted. Caller holds cacheMu.
+func (rt *RoutingTable) allowIntroduction(sys *System, learnedFrom uuid.UUID, now time.Time) bool {
+	if learnedFrom == uuid.Nil || learnedFrom == sys.ID {
+		return true
+	}
+	l := rt.cacheLimit
+	c, ok := l.introductions[learnedFrom]
+	if !ok || now.Sub(c.windowStart) >= IntroductionWindow {
+		// A window opening is a good time to forget the senders whose windows closed
+		for id, other := range l.introductions {
+			if now.Sub(other.windowStart) >= IntroductionWindow {
+				delete(l.introductions, id)
+			}
+		}
+		c = &introductionCount{windowStart: now}
+		l.introductions[learnedFrom] = c
+	}
+	if c.count >= l.perSender() {
+		l.refused++
+		if !c.refused {
+			c.refused = true
+			log.Printf("Refusing further new systems from %s: it introduced %d within the hour", learnedFrom.String()[:8], c.count)
+		}
+		return false
+	}
+	c.count++
+	return true
+}
+
+// evictable reports whether cached may be evicted to make room
+func evictable(cached *CachedSystem, cutoff time.Time) bool {
+	if cachedPeerStatus(cached, cutoff).inTable {
+		return false
+	}
+	return !cached.Verified || cached.LastVerified.Before(cutoff)
+}
+
+// xorFarther reports whether a is farther from local than b by XOR distance
+func xorFarther(local, a, b uuid.UUID) bool {
+	var da, db [16]byte
+	for i := range local {
+		da[i], db[i] = local[i]^a[i], local[i]^b[i]
+	}
+	return bytes.Compare(da[:], db[:]) > 0
+}
+
+// evictForRoom evicts until incoming more systems fit under the cap, plus headroom when
+// it has to evict at all (caller holds cacheMu and emits the returned events after
+// releasing it). It may leave the cache over the cap when everything left is protected.
+func (rt *RoutingTable) evictForRoom(incoming int, now time.Time) []Event {
+	l := rt.cacheLimit
+	over := len(rt.systemCache) + incoming - l.max
+	if over <= 0 {
+		return nil
+	}
+	over += l.max / CacheEvictionHeadroom
+
+	cutoff := now.Add(-VerificationCutoff)
+	var candidates []*CachedSystem
+	for _, cached := range rt.systemCache {
+		if evictable(cached, cutoff) {
+			candidates = append(candidates, cached)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Verified != b.Verified {
+			return !a.Verified
+		}
+		return xorFarther(rt.localID, a.System.ID, b.System.ID)
+	})
+	if len(candidates) > over {
+		candidates = candidates[:over]
+	}
+
+	events := make([]Event, 0, len(candidates))
+	for _, cached := range candidates {
+		rt.unindexAddress(cached)
+		delete(rt.systemCache, cached.System.ID)
+		events = append(events, Event{Type: EventPeerRemoved, SystemID: cached.System.ID.String(), Forgotten: true})
+	}
+	l.evicted += len(candidates)
+	return events
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/google/uuid"
+)
+
+// Capability is an optional protocol feature. Nodes list theirs by name in every DHT
+// message, so features are negotiated instead of guessed from version strings.
+type Capability uint32
+
+// Capabilities is a set of capabilities
+type Capabilities uint32
+
+const (
+	CapTargetedAttestation Capability = 1 << iota // Attestations name their recipient (ToSystemID)
+	CapFullSync                                   // Serves /api/full-sync
+	CapSignedInfo                                 // Signs its own system info (see signed_info.go)
+	CapInfoVersion                                // Versions its info and acks the version it holds in announce responses
+	CapAnnounceRedirect                           // Turns announces away at capacity with alternatives (see capacity.go)
+	CapSupersede                                  // Handles supersede requests
+	CapTransferAnnounce                           // Handles transfer_announce gossip
+	CapPeerUnreachable                            // Handles peer_unreachable gossip (see retraction.go)
+	CapGzip                                       // Takes gzipped DHT request bodies (see wire.go)
+	CapRankClaims                                 // Shares its credit rank in announces and answers rank_proof (see leaderboard.go)
+	CapAttestationNonce                           // Checks attestation nonces, so attestations sent to it carry one (see attestation.go)
+	CapKeyRotation                                // Follows key rotation chains and handles key_rotation (see key_rotation.go)
+	CapInfoRelay                                  // Passes a moved peer's info on and handles info_relay (see address_move.go)
+	CapRelayedPing                                // Pings a system for a peer that can't reach it (see partition.go)
+	CapServiceReceipt                             // Takes receipts for full-sync and discovery it served (see service_receipts.go)
+	CapMessages                                   // Takes direct messages between operators (see messages.go)
+	CapStarsVersion                               // Records its star derivation and checks stars against the recorded one, any version it knows (see system.go)
+	CapPingBack                                   // Pings a peer back at a new address before it advertises it (see address.go)
+)
+
+// capabilityInfo names a capability on the wire and, when known, the first version that had it
+type capabilityInfo struct {
+	c     Capability
+	name  string
+	since *ProtocolVersion // Peers too old to list capabilities have it from this version on (nil: only if listed)
+}
+
+var capabilityTable = []capabilityInfo{
+	{CapTargetedAttestation, "targeted-attestation", &ProtocolVersion{Major: 1, Minor: 6}},
+	{CapFullSync, "full-sync", &ProtocolVersion{Major: 1, Minor: 9}},
+	{CapSignedInfo, "signed-info", &SignedInfoMinVersion},
+	{CapInfoVersion, "info-version", nil},
+	{CapAnnounceRedirect, "announce-redirect", nil},
+	{CapSupersede, "supersede", nil},
+	{CapTransferAnnounce, "transfer-announce", nil},
+	{CapPeerUnreachable, "peer-unreachable", nil},
+	{CapGzip, "gzip", nil},
+	{CapRankClaims, "rank-claims", nil},
+	{CapAttestationNonce, "attestation-nonce", nil},
+	{CapKeyRotation, "key-rotation", nil},
+	{CapInfoRelay, "info-relay", nil},
+	{CapRelayedPing, "relayed-ping", nil},
+	{CapServiceReceipt, "service-receipt", nil},
+	{CapMessages, "messages", nil},
+	{CapStarsVersion, "stars-version", nil},
+	{CapPingBack, "ping-back", nil},
+}
+
+// LocalCapabilities is everything this build supports
+var LocalCapabilities = func() Capabilities {
+	var all Capabilities
+	for _, c := range capabilityTable {
+		all |= Capabilities(c.c)
+	}
+	return all
+}()
+
+// Has reports whether the set includes want
+func (c Capabilities) Has(want Capability) bool {
+	return c&Capabilities(want) != 0
+}
+
+// Names lists the set's capabilities by wire name
+func (c Capabilities) Names() []string {
+	names := []string{}
+	for _, info := range capabilityTable {
+		if c.Has(info.c) {
+			names = append(names, info.name)
+		}
+	}
+	return names
+}
+
+// ParseCapabilities reads a capability list, ignoring names this build doesn't know
+func ParseCapabilities(names []string) Capabilities {
+	var c Capabilities
+	for _, name := range names {
+		for _, info := range capabilityTable {
+			if info.name == name {
+				c |= Capabilities(info.c)
+			}
+		}
+	}
+	return c
+}
+
+// legacyCapabilities infers what a node too old to list its capabilities supports from its version
+func legacyCapabilities(version string) Capabilities {
+	v, err := ParseProtocolVersion(version)
+	if err != nil {
+		return 0
+	}
+	var c Capabilities
+	for _, info := range capabilityTable {
+		if info.since != nil && v.Compare(*info.since) >= 0 {
+			c |= Capabilities(info.c)
+		}
+	}
+	return c
+}
+
+// PeerCapabilities returns what the sender of a message supports: its list, or failing
+// that whatever its version implies
+func (msg *DHTMessage) PeerCapabilities() Capabilities {
+	if msg.Capabilities != nil {
+		return ParseCapabilities(msg.Capabilities)
+	}
+	return legacyCapabilities(msg.Version)
+}
+
+// recordCapabilities stores what the sender of a message we just validated supports,
+// and the largest message it takes
+func (dht *DHT) recordCapabilities(msg *DHTMessage) {
+	if msg.FromSystem != nil {
+		dht.routingTable.SetCapabilities(msg.FromSystem.ID, msg.PeerCapabilities(), msg.MaxMessageBytes)
+	}
+}
+
+// peerSupports reports whether a peer supports want
+// Peers we haven't exchanged messages with yet get the benefit of the doubt
+func (dht *DHT) peerSupports(id uuid.UUID, want Capability) bool {
+	caps, known := dht.routingTable.GetCapabilities(id)
+	return !known || caps.Has(want)
+}
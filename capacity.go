@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxCapacityAlternatives is how many other systems an at-capacity announce response suggests
+const MaxCapacityAlternatives = 5
+
+// AtCapacityError is returned by AnnounceToSystem when the peer's routing table is full
+// Alternatives are the peer's least-loaded neighbours, worth announcing to instead
+type AtCapacityError struct {
+	System       *System
+	Alternatives []*System
+}
+
+func (e *AtCapacityError) Error() string {
+	return fmt.Sprintf("%s is at capacity (%d alternatives suggested)", e.System.Name, len(e.Alternatives))
+}
+
+// hasCapacityFor reports whether we can take sys as a new routing table peer
+// Current peers are always kept, so a shrinking capacity never evicts anyone. Newcomers
+// fill the routing slots first; once those are full, one near enough takes a local slot
+// (see local_peers.go)
+func (dht *DHT) hasCapacityFor(sys *System) bool {
+	rt := dht.routingTable
+	if rt.IsRoutingTablePeer(sys.ID) {
+		return true
+	}
+	quota := dht.localPeerQuota()
+	if _, routing := rt.SlotCounts(); routing < dht.localSystem.GetMaxPeers()-quota {
+		return true
+	}
+	return rt.claimLocalSlot(sys.ID, dht.localSystem, quota)
+}
+
+// peerLoads estimates each system's connection count from the known topology
+func (dht *DHT) peerLoads() map[string]int {
+	neighbours := make(map[string]map[string]bool)
+	add := func(a, b string) {
+		if neighbours[a] == nil {
+			neighbours[a] = make(map[string]bool)
+		}
+		neighbours[a][b] = true
+	}
+	for _, e := range dht.GetConnections() {
+		add(e.FromID, e.ToID)
+		add(e.ToID, e.FromID)
+	}
+
+	loads := make(map[string]int, len(neighbours))
+	for id, n := range neighbours {
+		loads[id] = len(n)
+	}
+	return loads
+}
+
+// capacityAlternatives picks our least-loaded routing table peers to redirect a newcomer to
+func (dht *DHT) capacityAlternatives(exclude uuid.UUID) []*System {
+	loads := dht.peerLoads()
+	ratio := func(sys *System) float64 {
+		return float64(loads[sys.ID.String()]) / float64(sys.GetMaxPeers())
+	}
+
+	var candidates []*System
+	for _, sys := range dht.routingTable.GetAllRoutingTableNodes() {
+		if sys.ID != exclude && sys.PeerAddress != "" && dht.shareable(sys) {
+			candidates = append(candidates, sys)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return ratio(candidates[i]) < ratio(candidates[j]) })
+
+	if len(candidates) > MaxCapacityAlternatives {
+		candidates = candidates[:MaxCapacityAlternatives]
+	}
+	return candidates
+}
+
+// announceWithRedirects announces to each target, then to the alternatives suggested by
+// any that were at capacity. Redirects are followed one level deep so two full nodes
+// can't bounce us between each other. Returns how many systems accepted.
+func (dht *DHT) announceWithRedirects(targets []*System) int {
+	tried := map[uuid.UUID]bool{dht.localSystem.ID: true}
+	var redirects []*System
+	announced := 0
+
+	announce := func(sys *System, follow bool) {
+		if tried[sys.ID] || sys.PeerAddress == "" {
+			return
+		}
+		tried[sys.ID] = true
+
+		err := dht.AnnounceToSystem(sys)
+		var full *AtCapacityError
+		var dhtErr *DHTError
+		switch {
+		case err == nil:
+			announced++
+		case errors.As(err, &full):
+			log.Printf("  %s is at capacity, suggested %d alternatives", sys.Name, len(full.Alternatives))
+			if follow {
+				redirects = append(redirects, full.Alternatives...)
+			}
+		case errors.As(err, &dhtErr) && dhtErr.Code == ErrCodeRateLimited:
+			// Not before its rejection backoff runs out
+			delay := AnnounceRetryDelay
+			if r := dht.routingTable.GetRejection(sys.ID); r != nil && time.Until(time.Unix(r.RetryAt, 0)) > delay {
+				delay = time.Until(time.Unix(r.RetryAt, 0)).Round(time.Second)
+			}
+			log.Printf("  %s is rate limiting announces, retrying in %s", sys.Name, delay)
+			dht.retryAnnounce(sys, delay)
+		default:
+			log.Printf("  Failed to announce to %s: %v", sys.Name, err)
+			if !isPeerRejection(err) && !errors.Is(err, ErrBandwidthBudget) {
+				dht.routingTable.MarkFailed(sys.ID)
+			}
+		}
+	}
+
+	for _, sys := range targets {
+		announce(sys, true)
+	}
+	for _, sys := range redirects {
+		announce(sys, false)
+	}
+	return announced
+}
+
+// pickSponsor chooses the least-loaded discovered system that still has room
+// Falls back to the least-loaded one overall when everyone is full
+func pickSponsor(systems []DiscoverySystem, selfID string) *DiscoverySystem {
+	var best *DiscoverySystem
+	bestHasRoom := false
+	bestRatio := 0.0
+	for i := range systems {
+		sys := &systems[i]
+		if sys.ID == selfID || sys.PeerAddress == "" {
+			continue
+		}
+		ratio := 1.0
+		if sys.MaxPeers > 0 {
+			ratio = float64(sys.CurrentPeers) / float64(sys.MaxPeers)
+		}
+		if best == nil || (sys.HasCapacity && !bestHasRoom) ||
+			(sys.HasCapacity == bestHasRoom && ratio < bestRatio) {
+			best, bestHasRoom, bestRatio = sys, sys.HasCapacity, ratio
+		}
+	}
+	return best
+}
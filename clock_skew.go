@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxClockSkew is the hard cap on how far an attestation timestamp may be from our
+	// clock, whatever the sender's skew. It matches the credit grace period, so a
+	// skewed clock can shift a peer's attestations but can't stretch uptime past a gap
+	MaxClockSkew = 15 * time.Minute
+
+	// TimestampTolerance is how far an attestation timestamp may be from our clock
+	// once corrected for the sender's estimated skew
+	TimestampTolerance = 5 * time.Minute
+
+	// ClockSkewSamples is how many recent observations a peer's skew is the median of
+	ClockSkewSamples = 7
+
+	// ClockSkewWarning is the skew at which the peer detail view warns about a peer's clock
+	ClockSkewWarning = 2 * time.Minute
+)
+
+// clockSkews estimates how far each peer's clock is from ours, from the signed
+// timestamps on its messages
+type clockSkews struct {
+	mu    sync.Mutex
+	peers map[uuid.UUID][]time.Duration // Most recent last, at most ClockSkewSamples
+}
+
+func newClockSkews() *clockSkews {
+	return &clockSkews{peers: make(map[uuid.UUID][]time.Duration)}
+}
+
+// observe records one observation and returns the peer's new estimate
+func (c *clockSkews) observe(id uuid.UUID, skew time.Duration) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples := append(c.peers[id], skew)
+	if len(samples) > ClockSkewSamples {
+		samples = samples[len(samples)-ClockSkewSamples:]
+	}
+	c.peers[id] = samples
+	return medianDuration(samples)
+}
+
+// estimate returns a peer's skew (positive when its clock is ahead of ours)
+func (c *clockSkews) estimate(id uuid.UUID) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples, ok := c.peers[id]
+	if !ok {
+		return 0, false
+	}
+	return medianDuration(samples), true
+}
+
+// network returns the median of every peer's estimate and how many peers that is
+// When most peers agree, it's our own clock that's off (by minus the result)
+func (c *clockSkews) network() (time.Duration, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	estimates := make([]time.Duration, 0, len(c.peers))
+	for _, samples := range c.peers {
+		estimates = append(estimates, medianDuration(samples))
+	}
+	if len(estimates) == 0 {
+		return 0, 0
+	}
+	return medianDuration(estimates), len(estimates)
+}
+
+// forget drops the peers keep doesn't want
+func (c *clockSkews) forget(keep func(uuid.UUID) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.peers {
+		if !keep(id) {
+			delete(c.peers, id)
+		}
+	}
+}
+
+func medianDuration(samples []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// checkClockSkew records how far a validated message's sender is from our clock, then
+// checks its attestation timestamp against the sender's usual skew. sentAt is when we
+// sent the request a response answers (zero for requests): its timestamp is compared
+// with the middle of the round trip. The observation counts even when the message is
+// refused, so a clock that really jumped is trusted again once most samples agree
+func (dht *DHT) checkClockSkew(msg *DHTMessage, sentAt time.Time) error {
+	now := time.Now()
+	reference := now
+	if !sentAt.IsZero() {
+		reference = sentAt.Add(now.Sub(sentAt) / 2)
+	}
+	signed := time.Unix(msg.Attestation.Timestamp, 0)
+	skew := dht.clockSkews.observe(msg.FromSystem.ID, signed.Sub(reference))
+
+	if off := signed.Sub(reference.Add(skew)); off > TimestampTolerance || off < -TimestampTolerance {
+		return &DHTError{Code: ErrCodeInvalidAttestation, Message: fmt.Sprintf(
+			"attestation timestamp is %v off your clock's usual %v skew", off.Round(time.Second), skew.Round(time.Second))}
+	}
+	return nil
+}
+
+// ClockSkew returns a peer's estimated clock skew (positive when it's ahead of ours)
+func (dht *DHT) ClockSkew(id uuid.UUID) (time.Duration, bool) {
+	return dht.clockSkews.estimate(id)
+}
+
+// clockSkewWarning describes a skew worth warning about, or returns ""
+func clockSkewWarning(skew time.Duration) string {
+	if skew < ClockSkewWarning && skew > -ClockSkewWarning {
+		return ""
+	}
+	direction := "ahead"
+	if skew < 0 {
+		direction = "behind"
+	}
+	return fmt.Sprintf("peer clock is ~%d minutes %s", int(math.Round(math.Abs(skew.Minutes()))), direction)
+}
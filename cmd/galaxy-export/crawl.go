@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoSystemID = errors.New("/system returned no system ID")
+
+// listedSystem is one entry of a node's /api/full-sync or (older nodes) /api/discovery list
+type listedSystem struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	X           float64 `json:"x"`
+	Y           float64 `json:"y"`
+	Z           float64 `json:"z"`
+	PeerAddress string  `json:"peer_address"`
+	StarClass   string  `json:"star_class"`   // full-sync only
+	StarClasses string  `json:"star_classes"` // full-sync only, multi-star systems on newer nodes ("G+M")
+	InfoVersion int64   `json:"info_version"`
+}
+
+// system converts a listing into an exported system we couldn't confirm first-hand
+func (l *listedSystem) system() *System {
+	sys := &System{ID: l.ID, Name: l.Name, X: l.X, Y: l.Y, Z: l.Z, InfoVersion: l.InfoVersion, CachedOnly: true}
+	sys.Stars.Primary.Class = l.StarClass
+	if parts := strings.Split(l.StarClasses, "+"); len(parts) > 1 && len(parts) <= 3 {
+		sys.Stars.Primary.Class = parts[0]
+		sys.Stars.Secondary = &Star{Class: parts[1]}
+		if len(parts) == 3 {
+			sys.Stars.Tertiary = &Star{Class: parts[2]}
+		}
+		sys.Stars.Count = len(parts)
+	}
+	return sys
+}
+
+// nodeInfo is a node's /system response (DHT port), with the addresses we crawl by
+type nodeInfo struct {
+	System
+	Address     string `json:"address"` // Web UI listen address
+	PeerAddress string `json:"peer_address"`
+}
+
+// CrawlSummary reports how a crawl went
+type CrawlSummary struct {
+	Entry       string `json:"entry"`
+	Reached     int    `json:"reached"`
+	Unreachable int    `json:"unreachable"`
+	Skipped     int    `json:"skipped"` // Listed but never contacted: no address, or over -max-nodes
+}
+
+// crawlTarget is a node to contact, by its DHT address
+type crawlTarget struct {
+	Address string
+}
+
+// crawlResult is what one node told us (Self is nil if it couldn't be reached)
+type crawlResult struct {
+	Target crawlTarget
+	Self   *System
+	Listed []*listedSystem
+	Conns  []Connection
+	Err    error
+}
+
+// crawler walks the galaxy from an entry node, following the peer addresses each node lists
+type crawler struct {
+	client   *http.Client
+	timeout  time.Duration // Per node, covering every request made to it
+	workers  int
+	maxNodes int
+}
+
+// crawl contacts the entry node, then every node it lists, and so on, one round per hop
+// Nodes are visited once per UUID; systems only known from listings come back as CachedOnly
+func (c *crawler) crawl(entry string) (map[string]*System, map[Edge]bool, []string, *CrawlSummary) {
+	systems := make(map[string]*System)
+	listed := make(map[string]*listedSystem)
+	edges := make(map[Edge]bool)
+	visited := make(map[string]bool)
+	var sources []string
+
+	summary := &CrawlSummary{Entry: entry}
+	contacted := 1
+	frontier := []crawlTarget{{Address: entry}}
+
+	for len(frontier) > 0 {
+		var next []crawlTarget
+		for _, res := range c.visitAll(frontier) {
+			if res.Self == nil {
+				summary.Unreachable++
+				log.Printf("Unreachable: %s: %v", res.Target.Address, res.Err)
+				continue
+			}
+			summary.Reached++
+			sources = append(sources, res.Target.Address)
+			visited[res.Self.ID] = true
+			systems[res.Self.ID] = res.Self
+
+			addConnections(edges, res.Conns)
+
+			for _, l := range res.Listed {
+				if l.ID == "" {
+					continue
+				}
+				if prev, ok := listed[l.ID]; !ok || l.InfoVersion > prev.InfoVersion {
+					listed[l.ID] = l
+				}
+				if visited[l.ID] {
+					continue
+				}
+				visited[l.ID] = true
+				if l.PeerAddress == "" || contacted >= c.maxNodes {
+					summary.Skipped++
+					continue
+				}
+				contacted++
+				next = append(next, crawlTarget{Address: l.PeerAddress})
+			}
+		}
+		frontier = next
+	}
+
+	// Whatever we only heard about keeps its last-known listing
+	for id, l := range listed {
+		if systems[id] == nil {
+			systems[id] = l.system()
+		}
+	}
+	return systems, edges, sources, summary
+}
+
+// visitAll contacts targets with at most c.workers requests in flight, returning results in target order
+func (c *crawler) visitAll(targets []crawlTarget) []*crawlResult {
+	results := make([]*crawlResult, len(targets))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < c.workers && w < len(targets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = c.visit(targets[i])
+			}
+		}()
+	}
+	for i := range targets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// visit fetches one node's own info, the systems it lists and the connections its web UI reports
+func (c *crawler) visit(target crawlTarget) *crawlResult {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	res := &crawlResult{Target: target}
+	base := "http://" + target.Address
+
+	var info nodeInfo
+	if err := getJSON(ctx, c.client, base+"/system", &info); err != nil {
+		res.Err = err
+		return res
+	}
+	if info.ID == "" {
+		res.Err = errNoSystemID
+		return res
+	}
+	res.Self = &info.System
+
+	var fullSync struct {
+		Systems []*listedSystem `json:"systems"`
+	}
+	if err := getJSON(ctx, c.client, base+"/api/full-sync", &fullSync); err == nil {
+		res.Listed = fullSync.Systems
+	} else if err := getJSON(ctx, c.client, base+"/api/discovery", &res.Listed); err != nil {
+		log.Printf("No system list from %s: %v", target.Address, err)
+	}
+
+	// Connections are only served by the web UI, which may well not be reachable
+	if web := webURL(info.Address, target.Address); web != "" {
+		if err := getJSON(ctx, c.client, web+"/api/connections", &res.Conns); err != nil {
+			log.Printf("No connections from %s: %v", web, err)
+		}
+	}
+	return res
+}
+
+// webURL guesses a node's web UI URL from its advertised listen address
+// Nodes usually listen on 0.0.0.0 or localhost, so the host we reached the DHT port on
+// is used with the web port unless the listen address names a routable host
+func webURL(address, peerAddress string) string {
+	webHost, port, err := net.SplitHostPort(address)
+	if err != nil || port == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(peerAddress)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(webHost); webHost != "" && (ip == nil || !(ip.IsUnspecified() || ip.IsLoopback())) {
+		host = webHost
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// entryAddress accepts an entry node as host:port or as a URL of its DHT port
+func entryAddress(entry string) string {
+	entry = strings.TrimSpace(entry)
+	entry = strings.TrimPrefix(entry, "http://")
+	return strings.TrimRight(entry, "/")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// runDiff prints the systems and connections added and removed between two snapshot
+// files, or between the last two snapshots of one file written by -watch
+// Returns the process exit code
+func runDiff(w io.Writer, args []string) int {
+	var before, after *Snapshot
+	switch len(args) {
+	case 1:
+		snaps, err := readSnapshots(args[0], 2)
+		if err != nil {
+			log.Printf("Failed to read snapshots: %v", err)
+			return 1
+		}
+		if len(snaps) < 2 {
+			log.Printf("%s holds %d snapshot(s); -diff needs two", args[0], len(snaps))
+			return 1
+		}
+		before, after = snaps[0], snaps[1]
+	case 2:
+		for i, path := range args {
+			snaps, err := readSnapshots(path, 1)
+			if err != nil {
+				log.Printf("Failed to read snapshots: %v", err)
+				return 1
+			}
+			if len(snaps) == 0 {
+				log.Printf("%s holds no snapshot", path)
+				return 1
+			}
+			if i == 0 {
+				before = snaps[0]
+			} else {
+				after = snaps[0]
+			}
+		}
+	default:
+		log.Printf("Usage: galaxy-export -diff before.json after.json (or -diff watch.jsonl for its last two)")
+		return 2
+	}
+
+	writeDiff(w, before, after)
+	return 0
+}
+
+// writeDiff writes what changed from before to after: systems by name and ID, then
+// directed connections, each + added or - removed
+func writeDiff(w io.Writer, before, after *Snapshot) {
+	names := make(map[string]string)
+	for _, snap := range []*Snapshot{before, after} {
+		for _, sys := range snap.Systems {
+			names[sys.ID] = sys.Name
+		}
+	}
+	label := func(id string) string {
+		short := id
+		if len(short) > 8 {
+			short = short[:8]
+		}
+		if name := names[id]; name != "" {
+			return fmt.Sprintf("%s (%s)", name, short)
+		}
+		return short
+	}
+
+	old, cur := setsOf(before), setsOf(after)
+	fmt.Fprintf(w, "From %s to %s\n", before.ExportedAt.Format("2006-01-02 15:04:05Z"), after.ExportedAt.Format("2006-01-02 15:04:05Z"))
+
+	var addedSystems, removedSystems []string
+	for id := range cur.systems {
+		if !old.systems[id] {
+			addedSystems = append(addedSystems, id)
+		}
+	}
+	for id := range old.systems {
+		if !cur.systems[id] {
+			removedSystems = append(removedSystems, id)
+		}
+	}
+	byLabel := func(ids []string) {
+		sort.Slice(ids, func(i, j int) bool { return label(ids[i]) < label(ids[j]) })
+	}
+	byLabel(addedSystems)
+	byLabel(removedSystems)
+
+	fmt.Fprintf(w, "Systems: %d added, %d removed (%d -> %d)\n",
+		len(addedSystems), len(removedSystems), len(old.systems), len(cur.systems))
+	for _, id := range addedSystems {
+		fmt.Fprintf(w, "  + %s\n", label(id))
+	}
+	for _, id := range removedSystems {
+		fmt.Fprintf(w, "  - %s\n", label(id))
+	}
+
+	var addedEdges, removedEdges []Edge
+	for e := range cur.edges {
+		if !old.edges[e] {
+			addedEdges = append(addedEdges, e)
+		}
+	}
+	for e := range old.edges {
+		if !cur.edges[e] {
+			removedEdges = append(removedEdges, e)
+		}
+	}
+	byEnds := func(edges []Edge) {
+		sort.Slice(edges, func(i, j int) bool {
+			if a, b := label(edges[i].FromID), label(edges[j].FromID); a != b {
+				return a < b
+			}
+			return label(edges[i].ToID) < label(edges[j].ToID)
+		})
+	}
+	byEnds(addedEdges)
+	byEnds(removedEdges)
+
+	fmt.Fprintf(w, "Connections: %d added, %d removed (%d -> %d)\n",
+		len(addedEdges), len(removedEdges), len(old.edges), len(cur.edges))
+	for _, e := range addedEdges {
+		fmt.Fprintf(w, "  + %s -> %s\n", label(e.FromID), label(e.ToID))
+	}
+	for _, e := range removedEdges {
+		fmt.Fprintf(w, "  - %s -> %s\n", label(e.FromID), label(e.ToID))
+	}
+}
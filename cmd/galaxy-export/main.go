@@ -0,0 +1,510 @@
+// galaxy-export collects systems and peer connections from one or more running
+// nodes' web APIs, or by crawling the network from a single entry node, and writes
+// a merged galaxy snapshot as JSON, Graphviz DOT or GEXF.
+//
+//	go run ./cmd/galaxy-export -nodes http://localhost:8080,http://localhost:8081 -format dot > galaxy.dot
+//	go run ./cmd/galaxy-export -entry localhost:7867 -format gexf > galaxy.gexf
+//	go run ./cmd/galaxy-export -entry localhost:7867 -watch -interval 1h -dedupe -o galaxy.jsonl
+//	go run ./cmd/galaxy-export -diff before.json after.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Star is the subset of a star's JSON we export
+type Star struct {
+	Class       string `json:"class"`
+	Description string `json:"description"`
+	Color       string `json:"color"`
+}
+
+// System is the subset of a node's system JSON we export
+type System struct {
+	ID    string  `json:"id"`
+	Name  string  `json:"name"`
+	X     float64 `json:"x"`
+	Y     float64 `json:"y"`
+	Z     float64 `json:"z"`
+	Stars struct {
+		Primary   Star  `json:"primary"`
+		Secondary *Star `json:"secondary,omitempty"`
+		Tertiary  *Star `json:"tertiary,omitempty"`
+		Count     int   `json:"count"`
+	} `json:"stars"`
+	InfoVersion int64 `json:"info_version"`
+	CachedOnly  bool  `json:"cached_only,omitempty"` // Crawl couldn't reach it; last-known info from another node's list
+}
+
+// Edge is one directed connection as reported by /api/connections
+type Edge struct {
+	FromID string `json:"from_id"`
+	ToID   string `json:"to_id"`
+}
+
+// Connection is an edge as served by /api/connections
+// Reciprocal (newer nodes) means the other direction exists even if it isn't listed
+type Connection struct {
+	FromID     string `json:"from_id"`
+	ToID       string `json:"to_id"`
+	Reciprocal bool   `json:"reciprocal"`
+}
+
+// Snapshot is the merged export
+type Snapshot struct {
+	ExportedAt time.Time     `json:"exported_at"`
+	Sources    []string      `json:"sources"`
+	Systems    []*System     `json:"systems"`
+	Edges      []Edge        `json:"edges"`
+	Crawl      *CrawlSummary `json:"crawl,omitempty"`
+}
+
+func main() {
+	nodes := flag.String("nodes", "http://localhost:8080", "Comma-separated web UI base URLs to collect from")
+	entry := flag.String("entry", "", "Crawl the network from this node's DHT address (host:port) instead of using -nodes")
+	maxNodes := flag.Int("max-nodes", 500, "Most nodes contacted while crawling")
+	workers := flag.Int("workers", 8, "Nodes contacted at once while crawling")
+	format := flag.String("format", "json", "Output format: json, dot or gexf")
+	includeCached := flag.Bool("include-cached", false, "Export every known system, not just routing table peers (-nodes only)")
+	output := flag.String("o", "", "Output file, or a directory for timestamped files (default stdout)")
+	timeout := flag.Duration("timeout", 10*time.Second, "Per-node timeout, covering every request made to it")
+	watchMode := flag.Bool("watch", false, "Keep running, collecting again every -interval and appending JSON lines to -o")
+	interval := flag.Duration("interval", 15*time.Minute, "Time between collections with -watch")
+	dedupe := flag.Bool("dedupe", false, "Only write a snapshot when its systems or connections changed since the last one")
+	diff := flag.Bool("diff", false, "Compare two snapshot files (or the last two in one -watch file) and exit")
+	flag.Parse()
+
+	if *diff {
+		os.Exit(runDiff(os.Stdout, flag.Args()))
+	}
+	switch *format {
+	case "json", "dot", "gexf":
+	default:
+		log.Fatalf("Unknown format %q (expected json, dot or gexf)", *format)
+	}
+
+	src := &source{client: &http.Client{}, timeout: *timeout, includeCached: *includeCached}
+	if *entry != "" {
+		src.entry = entryAddress(*entry)
+		src.crawler = &crawler{client: src.client, timeout: *timeout, workers: max(*workers, 1), maxNodes: max(*maxNodes, 1)}
+	} else {
+		for _, base := range strings.Split(*nodes, ",") {
+			if base = strings.TrimRight(strings.TrimSpace(base), "/"); base != "" {
+				src.nodes = append(src.nodes, base)
+			}
+		}
+	}
+
+	out, err := newOutput(*output, *format, *watchMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := &recorder{src: src, out: out, dedupe: *dedupe}
+	if *dedupe {
+		last, err := out.lastSnapshot()
+		if err != nil {
+			log.Fatalf("Failed to read the last snapshot from %s: %v", *output, err)
+		}
+		if last != nil {
+			sets := setsOf(last)
+			r.prev = &sets
+		}
+	}
+
+	if !*watchMode {
+		if err := r.record(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if *interval < 10*time.Second {
+		log.Fatalf("-interval %v is too short (at least 10s)", *interval)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	r.watch(ctx, *interval)
+}
+
+// source collects snapshots from -nodes' web APIs, or by crawling from -entry
+type source struct {
+	client        *http.Client
+	timeout       time.Duration
+	includeCached bool
+	nodes         []string // Web UI base URLs (when not crawling)
+	entry         string   // DHT address to crawl from
+	crawler       *crawler
+}
+
+// snapshot collects the galaxy once. Everything it gathers is built afresh, so nodes that
+// come and go between calls leave nothing behind
+func (src *source) snapshot() (*Snapshot, error) {
+	systems := make(map[string]*System)
+	edges := make(map[Edge]bool)
+	var sources []string
+	var summary *CrawlSummary
+
+	if src.crawler != nil {
+		systems, edges, sources, summary = src.crawler.crawl(src.entry)
+		log.Printf("Crawl from %s: %d reached, %d unreachable, %d skipped",
+			summary.Entry, summary.Reached, summary.Unreachable, summary.Skipped)
+	} else {
+		for _, base := range src.nodes {
+			if err := collect(src.client, base, src.timeout, src.includeCached, systems, edges); err != nil {
+				log.Printf("Skipping %s: %v", base, err)
+				continue
+			}
+			sources = append(sources, base)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no nodes could be reached")
+	}
+
+	snap := buildSnapshot(systems, edges)
+	snap.Sources = sources
+	snap.Crawl = summary
+	return snap, nil
+}
+
+// writeSnapshot writes a snapshot in a format; indented JSON unless compact (one line)
+func writeSnapshot(w io.Writer, snap *Snapshot, format string, compact bool) error {
+	switch format {
+	case "dot":
+		return writeDOT(w, snap)
+	case "gexf":
+		return writeGEXF(w, snap)
+	}
+	enc := json.NewEncoder(w)
+	if !compact {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(snap)
+}
+
+// collect merges one node's view into systems (deduped by ID, highest InfoVersion wins) and edges
+func collect(client *http.Client, base string, timeout time.Duration, includeCached bool, systems map[string]*System, edges map[Edge]bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var self System
+	if err := getJSON(ctx, client, base+"/api/system", &self); err != nil {
+		return err
+	}
+
+	listPath := "/api/peers"
+	if includeCached {
+		listPath = "/api/known-systems"
+	}
+	var peers []*System
+	if err := getJSON(ctx, client, base+listPath, &peers); err != nil {
+		return err
+	}
+
+	var conns []Connection
+	if err := getJSON(ctx, client, base+"/api/connections", &conns); err != nil {
+		return err
+	}
+
+	// Nodes in -public-ui mode hide their own ID; their peers are still useful
+	if self.ID != "" {
+		merge(systems, &self)
+	}
+	for _, sys := range peers {
+		merge(systems, sys)
+	}
+	addConnections(edges, conns)
+	return nil
+}
+
+// addConnections adds reported connections as directed edges, both ways when reciprocal
+func addConnections(edges map[Edge]bool, conns []Connection) {
+	for _, c := range conns {
+		if c.FromID == "" || c.ToID == "" || c.FromID == c.ToID {
+			continue
+		}
+		edges[Edge{FromID: c.FromID, ToID: c.ToID}] = true
+		if c.Reciprocal {
+			edges[Edge{FromID: c.ToID, ToID: c.FromID}] = true
+		}
+	}
+}
+
+// merge keeps the copy of a system with the highest InfoVersion
+func merge(systems map[string]*System, sys *System) {
+	if sys.ID == "" {
+		return
+	}
+	if existing, ok := systems[sys.ID]; !ok || sys.InfoVersion > existing.InfoVersion {
+		systems[sys.ID] = sys
+	}
+}
+
+// buildSnapshot sorts systems and drops edges to systems we aren't exporting
+func buildSnapshot(systems map[string]*System, edges map[Edge]bool) *Snapshot {
+	snap := &Snapshot{ExportedAt: time.Now().UTC()}
+
+	for _, sys := range systems {
+		snap.Systems = append(snap.Systems, sys)
+	}
+	sort.Slice(snap.Systems, func(i, j int) bool { return snap.Systems[i].Name < snap.Systems[j].Name })
+
+	for e := range edges {
+		if systems[e.FromID] != nil && systems[e.ToID] != nil {
+			snap.Edges = append(snap.Edges, e)
+		}
+	}
+	sort.Slice(snap.Edges, func(i, j int) bool {
+		if snap.Edges[i].FromID != snap.Edges[j].FromID {
+			return snap.Edges[i].FromID < snap.Edges[j].FromID
+		}
+		return snap.Edges[i].ToID < snap.Edges[j].ToID
+	})
+	return snap
+}
+
+// undirected collapses directed edges into pairs, marking pairs seen in both directions
+// Same semantics as the web map: reciprocal links are solid, one-way links dashed
+func undirected(edges []Edge) ([]Edge, map[Edge]bool) {
+	directed := make(map[Edge]bool, len(edges))
+	for _, e := range edges {
+		directed[e] = true
+	}
+
+	var pairs []Edge
+	reciprocal := make(map[Edge]bool)
+	seen := make(map[Edge]bool)
+	for _, e := range edges {
+		key := e
+		if key.ToID < key.FromID {
+			key = Edge{FromID: e.ToID, ToID: e.FromID}
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		pairs = append(pairs, e)
+		reciprocal[e] = directed[Edge{FromID: e.ToID, ToID: e.FromID}]
+	}
+	return pairs, reciprocal
+}
+
+// writeDOT writes a Graphviz graph, nodes colored by primary star class
+func writeDOT(w io.Writer, snap *Snapshot) error {
+	var b strings.Builder
+	b.WriteString("graph galaxy {\n")
+	b.WriteString("\tgraph [bgcolor=\"#0a0a1a\", overlap=false];\n")
+	b.WriteString("\tnode [style=filled, shape=circle, fontcolor=white, fontsize=10, color=\"#333344\"];\n")
+	b.WriteString("\tedge [color=\"#4a6fa5\"];\n")
+
+	for _, sys := range snap.Systems {
+		// Systems a crawl only heard about are drawn dashed
+		style := ""
+		if sys.CachedOnly {
+			style = `, style="filled,dashed"`
+		}
+		fmt.Fprintf(&b, "\t%q [label=%q, fillcolor=%q, tooltip=%q%s];\n",
+			sys.ID, sys.Name, starColor(sys), strings.TrimSpace(starClasses(sys)+" "+sys.Stars.Primary.Description), style)
+	}
+
+	pairs, reciprocal := undirected(snap.Edges)
+	for _, e := range pairs {
+		style := "dashed"
+		if reciprocal[e] {
+			style = "solid"
+		}
+		fmt.Fprintf(&b, "\t%q -- %q [style=%s];\n", e.FromID, e.ToID, style)
+	}
+
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// GEXF document types (https://gexf.net/schema.html), with viz for color and position
+type gexfDoc struct {
+	XMLName xml.Name  `xml:"gexf"`
+	XMLNS   string    `xml:"xmlns,attr"`
+	VizNS   string    `xml:"xmlns:viz,attr"`
+	Version string    `xml:"version,attr"`
+	Meta    gexfMeta  `xml:"meta"`
+	Graph   gexfGraph `xml:"graph"`
+}
+
+type gexfMeta struct {
+	LastModified string `xml:"lastmodifieddate,attr"`
+	Creator      string `xml:"creator"`
+	Description  string `xml:"description"`
+}
+
+type gexfGraph struct {
+	DefaultEdgeType string           `xml:"defaultedgetype,attr"`
+	Attributes      []gexfAttributes `xml:"attributes"`
+	Nodes           []gexfNode       `xml:"nodes>node"`
+	Edges           []gexfEdge       `xml:"edges>edge"`
+}
+
+type gexfAttributes struct {
+	Class string          `xml:"class,attr"`
+	Attrs []gexfAttribute `xml:"attribute"`
+}
+
+type gexfAttribute struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+type gexfNode struct {
+	ID       string          `xml:"id,attr"`
+	Label    string          `xml:"label,attr"`
+	Values   []gexfAttrValue `xml:"attvalues>attvalue"`
+	Color    gexfColor       `xml:"viz:color"`
+	Position gexfPosition    `xml:"viz:position"`
+}
+
+type gexfAttrValue struct {
+	For   string `xml:"for,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type gexfColor struct {
+	R int `xml:"r,attr"`
+	G int `xml:"g,attr"`
+	B int `xml:"b,attr"`
+}
+
+type gexfPosition struct {
+	X float64 `xml:"x,attr"`
+	Y float64 `xml:"y,attr"`
+	Z float64 `xml:"z,attr"`
+}
+
+type gexfEdge struct {
+	ID     string          `xml:"id,attr"`
+	Source string          `xml:"source,attr"`
+	Target string          `xml:"target,attr"`
+	Values []gexfAttrValue `xml:"attvalues>attvalue"`
+}
+
+// writeGEXF writes a Gephi graph with galaxy coordinates as node positions
+func writeGEXF(w io.Writer, snap *Snapshot) error {
+	doc := gexfDoc{
+		XMLNS:   "http://gexf.net/1.3",
+		VizNS:   "http://gexf.net/1.3/viz",
+		Version: "1.3",
+		Meta: gexfMeta{
+			LastModified: snap.ExportedAt.Format("2006-01-02"),
+			Creator:      "stellar-lab galaxy-export",
+			Description:  "Stellar Lab galaxy snapshot from " + strings.Join(snap.Sources, ", "),
+		},
+		Graph: gexfGraph{
+			DefaultEdgeType: "undirected",
+			Attributes: []gexfAttributes{
+				{Class: "node", Attrs: []gexfAttribute{
+					{ID: "class", Title: "star_class", Type: "string"},
+					{ID: "classes", Title: "star_classes", Type: "string"},
+					{ID: "stars", Title: "star_count", Type: "integer"},
+					{ID: "cached_only", Title: "cached_only", Type: "boolean"},
+				}},
+				{Class: "edge", Attrs: []gexfAttribute{
+					{ID: "reciprocal", Title: "reciprocal", Type: "boolean"},
+				}},
+			},
+		},
+	}
+
+	for _, sys := range snap.Systems {
+		r, g, b := hexToRGB(starColor(sys))
+		doc.Graph.Nodes = append(doc.Graph.Nodes, gexfNode{
+			ID:    sys.ID,
+			Label: sys.Name,
+			Values: []gexfAttrValue{
+				{For: "class", Value: sys.Stars.Primary.Class},
+				{For: "classes", Value: starClasses(sys)},
+				{For: "stars", Value: fmt.Sprint(sys.Stars.Count)},
+				{For: "cached_only", Value: fmt.Sprint(sys.CachedOnly)},
+			},
+			Color:    gexfColor{R: r, G: g, B: b},
+			Position: gexfPosition{X: sys.X, Y: sys.Y, Z: sys.Z},
+		})
+	}
+
+	pairs, reciprocal := undirected(snap.Edges)
+	for i, e := range pairs {
+		doc.Graph.Edges = append(doc.Graph.Edges, gexfEdge{
+			ID:     fmt.Sprint(i),
+			Source: e.FromID,
+			Target: e.ToID,
+			Values: []gexfAttrValue{{For: "reciprocal", Value: fmt.Sprint(reciprocal[e])}},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// starClasses joins every star's class, primary first ("G+M")
+func starClasses(sys *System) string {
+	classes := sys.Stars.Primary.Class
+	for _, star := range []*Star{sys.Stars.Secondary, sys.Stars.Tertiary} {
+		if star != nil {
+			classes += "+" + star.Class
+		}
+	}
+	return classes
+}
+
+// starColor returns the system's star color, falling back to gray
+func starColor(sys *System) string {
+	if c := sys.Stars.Primary.Color; len(c) == 7 && c[0] == '#' {
+		return c
+	}
+	return "#888888"
+}
+
+// hexToRGB parses "#rrggbb"
+func hexToRGB(hex string) (int, int, int) {
+	var r, g, b int
+	fmt.Sscanf(hex, "#%02x%02x%02x", &r, &g, &b)
+	return r, g, b
+}
+
+// getJSON fetches and decodes a JSON endpoint
+func getJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// output is where snapshots go: stdout, a file, or timestamped files in a directory
+type output struct {
+	path   string // "" for stdout
+	dir    bool
+	format string
+	lines  bool // Append one compact JSON snapshot per line (-watch to a file or stdout)
+}
+
+// newOutput works out where snapshots go. A path that is a directory (or ends in a
+// separator, creating it) gets a timestamped file per snapshot; otherwise -watch appends
+// JSON lines, which needs -format json
+func newOutput(path, format string, watch bool) (*output, error) {
+	out := &output{path: path, format: format}
+	if path != "" {
+		if strings.HasSuffix(path, string(os.PathSeparator)) || strings.HasSuffix(path, "/") {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return nil, err
+			}
+		}
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			out.dir = true
+			return out, nil
+		}
+	}
+	if watch {
+		if format != "json" {
+			return nil, fmt.Errorf("-watch writes JSON lines; use -o with a directory for %s files", format)
+		}
+		out.lines = true
+	}
+	return out, nil
+}
+
+// write writes a snapshot and returns where it went
+func (o *output) write(snap *Snapshot) (string, error) {
+	if o.dir {
+		name := filepath.Join(o.path, "galaxy-"+snap.ExportedAt.Format("20060102T150405Z")+"."+o.format)
+		f, err := os.Create(name)
+		if err != nil {
+			return "", err
+		}
+		if err := writeSnapshot(f, snap, o.format, false); err != nil {
+			f.Close()
+			return "", err
+		}
+		return name, f.Close()
+	}
+	if o.path == "" {
+		return "stdout", writeSnapshot(os.Stdout, snap, o.format, o.lines)
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if o.lines {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(o.path, flags, 0644)
+	if err != nil {
+		return "", err
+	}
+	if err := writeSnapshot(f, snap, o.format, o.lines); err != nil {
+		f.Close()
+		return "", err
+	}
+	return o.path, f.Close()
+}
+
+// lastSnapshot reads back the newest JSON snapshot written to the output, so -dedupe
+// carries on across runs. nil when there's none to read (stdout, or not JSON)
+func (o *output) lastSnapshot() (*Snapshot, error) {
+	if o.path == "" || o.format != "json" {
+		return nil, nil
+	}
+	path := o.path
+	if o.dir {
+		names, err := filepath.Glob(filepath.Join(o.path, "galaxy-*.json"))
+		if err != nil || len(names) == 0 {
+			return nil, err
+		}
+		sort.Strings(names)
+		path = names[len(names)-1]
+	}
+	snaps, err := readSnapshots(path, 1)
+	if errors.Is(err, os.ErrNotExist) || len(snaps) == 0 {
+		return nil, nil
+	}
+	return snaps[0], err
+}
+
+// readSnapshots reads the last n snapshots from a file holding one (indented) or several
+// (JSON lines), oldest first. Only n are held at a time, however long the file
+func readSnapshots(path string, n int) ([]*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var snaps []*Snapshot
+	dec := json.NewDecoder(f)
+	for {
+		var snap Snapshot
+		if err := dec.Decode(&snap); err == io.EOF {
+			return snaps, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		snaps = append(snaps, &snap)
+		if len(snaps) > n {
+			snaps = snaps[1:]
+		}
+	}
+}
+
+// snapshotSets is a snapshot's systems and connections, as compared between snapshots
+type snapshotSets struct {
+	systems map[string]bool
+	edges   map[Edge]bool
+}
+
+// setsOf collects a snapshot's system IDs and edges
+func setsOf(snap *Snapshot) snapshotSets {
+	s := snapshotSets{systems: make(map[string]bool, len(snap.Systems)), edges: make(map[Edge]bool, len(snap.Edges))}
+	for _, sys := range snap.Systems {
+		s.systems[sys.ID] = true
+	}
+	for _, e := range snap.Edges {
+		s.edges[e] = true
+	}
+	return s
+}
+
+// changes counts the systems in s but not prev, and in prev but not s
+func (s snapshotSets) changes(prev snapshotSets) (added, lost int) {
+	for id := range s.systems {
+		if !prev.systems[id] {
+			added++
+		}
+	}
+	for id := range prev.systems {
+		if !s.systems[id] {
+			lost++
+		}
+	}
+	return added, lost
+}
+
+// same reports whether both hold the same systems and connections
+func (s snapshotSets) same(other snapshotSets) bool {
+	if len(s.systems) != len(other.systems) || len(s.edges) != len(other.edges) {
+		return false
+	}
+	for id := range s.systems {
+		if !other.systems[id] {
+			return false
+		}
+	}
+	for e := range s.edges {
+		if !other.edges[e] {
+			return false
+		}
+	}
+	return true
+}
+
+// recorder collects snapshots and writes them, remembering only the last one's sets
+type recorder struct {
+	src    *source
+	out    *output
+	dedupe bool
+	prev   *snapshotSets // The last snapshot's, for new/lost and -dedupe (nil before the first)
+}
+
+// record collects one snapshot and writes it (unless -dedupe finds nothing changed),
+// logging a one-line summary: systems, edges, new, lost, duration and where it went
+func (r *recorder) record() error {
+	start := time.Now()
+	snap, err := r.src.snapshot()
+	if err != nil {
+		return err
+	}
+	took := time.Since(start).Round(time.Millisecond)
+
+	sets := setsOf(snap)
+	added, lost := len(sets.systems), 0
+	if r.prev != nil {
+		added, lost = sets.changes(*r.prev)
+	}
+
+	written := "unchanged, not written"
+	if !r.dedupe || r.prev == nil || !sets.same(*r.prev) {
+		if written, err = r.out.write(snap); err != nil {
+			return fmt.Errorf("failed to write %s: %w", r.out.format, err)
+		}
+	}
+	r.prev = &sets
+
+	log.Printf("Snapshot: %d systems, %d edges, %d new, %d lost, took %v (%s)",
+		len(snap.Systems), len(snap.Edges), added, lost, took, written)
+	return nil
+}
+
+// watch records a snapshot now and every interval until ctx is done. A collection that
+// fails is logged and skipped, leaving the last snapshot to compare the next one with
+func (r *recorder) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.record(); err != nil {
+			log.Printf("Snapshot failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped watching")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCompactionSchedule runs compaction once a day in the small hours (local time)
+	DefaultCompactionSchedule = "03:00"
+
+	// DefaultCompactionKeepDays is how many days of attestations are kept in full
+	DefaultCompactionKeepDays = 7
+
+	// CompactionSizeCheckInterval is how often the database size is checked
+	// against -compact-max-db-mb between scheduled runs
+	CompactionSizeCheckInterval = 10 * time.Minute
+)
+
+// CompactionSchedule is either a fixed local time of day or a fixed interval
+type CompactionSchedule struct {
+	every        time.Duration // Interval schedule ("every 6h"); zero for daily
+	hour, minute int           // Daily schedule ("03:00")
+}
+
+// ParseCompactionSchedule accepts:
+//   - "HH:MM" or "daily HH:MM" - every day at that local time
+//   - "@daily" / "@hourly"     - midnight daily / every hour
+//   - "every <duration>"       - fixed interval, e.g. "every 6h", "every 90m"
+func ParseCompactionSchedule(spec string) (*CompactionSchedule, error) {
+	s := strings.ToLower(strings.TrimSpace(spec))
+
+	switch s {
+	case "@daily", "@midnight":
+		return &CompactionSchedule{}, nil
+	case "@hourly":
+		return &CompactionSchedule{every: time.Hour}, nil
+	}
+
+	if rest, ok := strings.CutPrefix(s, "every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("invalid compaction interval %q: %w", spec, err)
+		}
+		if d < time.Minute {
+			return nil, fmt.Errorf("compaction interval %q is too short (minimum 1m)", spec)
+		}
+		return &CompactionSchedule{every: d}, nil
+	}
+
+	s = strings.TrimSpace(strings.TrimPrefix(s, "daily"))
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compaction schedule %q (expected \"HH:MM\", \"daily HH:MM\", \"@daily\", \"@hourly\" or \"every 6h\")", spec)
+	}
+	return &CompactionSchedule{hour: t.Hour(), minute: t.Minute()}, nil
+}
+
+// Next returns the first scheduled run strictly after the given time
+func (cs *CompactionSchedule) Next(after time.Time) time.Time {
+	if cs.every > 0 {
+		return after.Add(cs.every)
+	}
+
+	next := time.Date(after.Year(), after.Month(), after.Day(), cs.hour, cs.minute, 0, 0, after.Location())
+	if !next.After(after) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// String describes the schedule for logs
+func (cs *CompactionSchedule) String() string {
+	if cs.every > 0 {
+		return "every " + cs.every.String()
+	}
+	return fmt.Sprintf("daily at %02d:%02d", cs.hour, cs.minute)
+}
+
+// CompactionConfig controls background attestation compaction
+type CompactionConfig struct {
+	Schedule   *CompactionSchedule
+	KeepDays   int
+	MaxDBBytes int64 // Compact immediately when the database grows past this (0 = no size trigger)
+}
+
+// compactor holds the compaction settings (its schedule state lives in the task registry)
+type compactor struct {
+	config CompactionConfig
+}
+
+// EnableCompaction turns on scheduled attestation compaction
+// Must be called before Start
+func (dht *DHT) EnableCompaction(config CompactionConfig) {
+	dht.compactor = &compactor{config: config}
+
+	msg := fmt.Sprintf("Attestation compaction %s, keeping %d days", config.Schedule, config.KeepDays)
+	if config.MaxDBBytes > 0 {
+		msg += fmt.Sprintf(" (or when database exceeds %s)", formatBytes(config.MaxDBBytes))
+	}
+	log.Print(msg)
+}
+
+// NextCompaction returns when the next scheduled compaction will run (zero if disabled)
+func (dht *DHT) NextCompaction() time.Time {
+	if t := dht.tasks.get(TaskCompaction); t != nil {
+		return t.next()
+	}
+	return time.Time{}
+}
+
+// compactionLoop runs compaction on schedule, and early whenever the database is too large
+// Each run starts with a retention trim (see retention.go), so the vacuum reclaims what it
+// frees; the trim can also be run alone
+func (dht *DHT) compactionLoop() {
+	defer dht.wg.Done()
+
+	c := dht.compactor
+	t := dht.tasks.register(TaskCompaction, c.config.Schedule.String())
+	r := dht.tasks.register(TaskRetention, "with compaction")
+	sizeCheck := time.NewTicker(CompactionSizeCheckInterval)
+	defer sizeCheck.Stop()
+
+	trim := func() {
+		r.run(func() (int, error) { return dht.trimTables() })
+	}
+	compact := func(reason string) {
+		trim()
+		t.run(func() (int, error) { return dht.runCompaction(reason) })
+	}
+
+	next := c.config.Schedule.Next(time.Now())
+	for {
+		t.scheduleNext(next)
+		r.scheduleNext(next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-dht.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+			compact("scheduled")
+			next = c.config.Schedule.Next(time.Now())
+		case <-t.trigger:
+			timer.Stop()
+			compact("manual")
+		case <-r.trigger:
+			timer.Stop()
+			trim()
+		case <-sizeCheck.C:
+			timer.Stop()
+			if c.config.MaxDBBytes <= 0 {
+				continue
+			}
+			size, err := dht.storage.GetDatabaseSize()
+			if err == nil && size > c.config.MaxDBBytes {
+				log.Printf("Database is %s (limit %s), compacting now", formatBytes(size), formatBytes(c.config.MaxDBBytes))
+				compact("size limit")
+			}
+		}
+	}
+}
+
+// runCompaction compacts attestations, thins galaxy history, rolls up credit history
+// and reclaims the freed space
+// Returns how many rows were removed or rolled up, and any step that failed
+func (dht *DHT) runCompaction(reason string) (int, error) {
+	c := dht.compactor
+	var errs []error
+
+	if err := dht.FlushAttestations(); err != nil {
+		log.Printf("Compaction (%s): saving buffered attestations failed: %v", reason, err)
+		errs = append(errs, fmt.Errorf("saving buffered attestations: %w", err))
+	}
+	removed, err := dht.storage.CompactAttestations(c.config.KeepDays)
+	if err != nil {
+		log.Printf("Compaction (%s) failed: %v", reason, err)
+		return 0, errors.Join(append(errs, err)...)
+	}
+	thinned, err := dht.storage.ThinGalaxySnapshots(c.config.KeepDays)
+	if err != nil {
+		log.Printf("Compaction (%s): thinning galaxy history failed: %v", reason, err)
+		errs = append(errs, fmt.Errorf("thinning galaxy history: %w", err))
+	}
+	rolled, err := dht.storage.CompactCreditEarnings(c.config.KeepDays)
+	if err != nil {
+		log.Printf("Compaction (%s): rolling up credit history failed: %v", reason, err)
+		errs = append(errs, fmt.Errorf("rolling up credit history: %w", err))
+	}
+	if err := dht.storage.Vacuum(); err != nil {
+		log.Printf("Compaction (%s): vacuum failed: %v", reason, err)
+		errs = append(errs, fmt.Errorf("vacuum: %w", err))
+	}
+
+	if removed > 0 {
+		log.Printf("Compaction (%s): summarized and removed %d attestations older than %d days", reason, removed, c.config.KeepDays)
+	}
+	if thinned > 0 {
+		log.Printf("Compaction (%s): thinned %d galaxy snapshots older than %d days to daily", reason, thinned, c.config.KeepDays)
+	}
+	if rolled > 0 {
+		log.Printf("Compaction (%s): rolled %d credit calculations older than %d days into daily totals", reason, rolled, c.config.KeepDays)
+	}
+	return int(removed + thinned + rolled), errors.Join(errs...)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigFileName is the config file in a data directory
+const ConfigFileName = "stellar-lab.toml"
+
+// configCommandLineOnly are flags a config file can't set: one-off actions, and the
+// flags that decide which config file to read
+var configCommandLineOnly = map[string]bool{
+	"config":          true,
+	"data-dir":        true,
+	"profile":         true,
+	"init":            true,
+	"status":          true,
+	"doctor":          true,
+	"doctor-fix":      true,
+	"migrate-dry-run": true,
+	"install-service": true,
+	"compact":         true,
+	"send-credits":    true,
+	"supersede":       true,
+	"supersede-key":   true,
+}
+
+// ConfigEntry is one "key = value" line of a config file. Value is what the flag's
+// Set takes: strings unquoted and arrays joined with commas
+type ConfigEntry struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// flagEnvKey is the environment variable a flag falls back to (-public-address is
+// STELLAR_PUBLIC_ADDRESS)
+func flagEnvKey(name string) string {
+	return "STELLAR_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// ParseConfig reads the TOML subset config files use: one "key = value" per line,
+// where a value is a "string", 'literal string', integer, true/false or an array of
+// strings, plus # comments. Tables aren't supported, since every key is a flag name
+func ParseConfig(r io.Reader) ([]ConfigEntry, error) {
+	var entries []ConfigEntry
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: tables aren't supported, put every setting at the top level", n)
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", n)
+		}
+		if prev, dup := seen[key]; dup {
+			return nil, fmt.Errorf("line %d: %s is already set on line %d", n, key, prev)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n, key, err)
+		}
+		seen[key] = n
+		entries = append(entries, ConfigEntry{Key: key, Value: value, Line: n})
+	}
+	return entries, scanner.Err()
+}
+
+// stripConfigComment drops a # comment that isn't inside a string
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++ // An escaped quote doesn't end the string
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", errors.New("missing value")
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return "", errors.New("arrays must close on the same line")
+		}
+		var items []string
+		for _, item := range splitConfigArray(strings.TrimSpace(raw[1 : len(raw)-1])) {
+			v, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	case strings.HasPrefix(raw, `"`):
+		v, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return v, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	if _, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 10, 64); err == nil {
+		return strings.ReplaceAll(raw, "_", ""), nil
+	}
+	return "", fmt.Errorf("%s isn't a string, number or true/false (quote strings)", raw)
+}
+
+// splitConfigArray splits array items on commas outside strings (a trailing comma is fine)
+func splitConfigArray(s string) []string {
+	var items []string
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// ApplyConfig sets flags from config entries, except those given reports as set
+// already, so a flag (or its environment variable) beats the file and the file beats
+// the default. Unknown keys are an error naming the closest flag, not ignored
+func ApplyConfig(fs *flag.FlagSet, entries []ConfigEntry, path string, given func(name string) bool) error {
+	for _, e := range entries {
+		f := fs.Lookup(e.Key)
+		if f == nil {
+			msg := fmt.Sprintf("%s:%d: unknown setting %q", path, e.Line, e.Key)
+			if s := closestFlag(fs, e.Key); s != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", s)
+			}
+			return errors.New(msg)
+		}
+		if configCommandLineOnly[e.Key] {
+			return fmt.Errorf("%s:%d: %s can only be given on the command line", path, e.Line, e.Key)
+		}
+		if given(e.Key) {
+			continue
+		}
+		if err := fs.Set(e.Key, e.Value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, e.Line, e.Value, e.Key, err)
+		}
+	}
+	return nil
+}
+
+// LoadConfig applies a config file to the command line flags not set on the command
+// line or through the environment
+func LoadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := ParseConfig(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	onCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	return ApplyConfig(flag.CommandLine, entries, path, func(name string) bool {
+		return onCommandLine[name] || os.Getenv(flagEnvKey(name)) != ""
+	})
+}
+
+// closestFlag suggests the settable flag nearest a misspelt key, if any is close
+func closestFlag(fs *flag.FlagSet, key string) string {
+	best, bestDist := "", len(key)/2+1
+	fs.VisitAll(func(f *flag.Flag) {
+		if configCommandLineOnly[f.Name] {
+			return
+		}
+		if d := editDistance(strings.ToLower(key), f.Name); d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	})
+	return best
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// formatConfigValue renders a flag value as a config value: true/false and integers
+// bare, everything else quoted, and list flags (bootstrap) as arrays
+func formatConfigValue(key, value string) string {
+	if key == "bootstrap" {
+		var items []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				items = append(items, strconv.Quote(v))
+			}
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	if value == "true" || value == "false" {
+		return value
+	}
+	if _, err := strconv.Atoi(value); err == nil {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// UpdateConfigFile sets keys in a config file, replacing their existing lines in place
+// (comments and other settings stay as they are) and appending new ones in sorted
+// order. Keys with an empty value are removed
+func UpdateConfigFile(path string, values map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	}
+
+	entries, err := ParseConfig(strings.NewReader(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	done := make(map[string]bool)
+	removed := make(map[int]bool)
+	for _, e := range entries {
+		value, ok := values[e.Key]
+		if !ok {
+			continue
+		}
+		done[e.Key] = true
+		if value == "" {
+			removed[e.Line-1] = true
+		} else {
+			lines[e.Line-1] = e.Key + " = " + formatConfigValue(e.Key, value)
+		}
+	}
+
+	var out []string
+	for i, line := range lines {
+		if !removed[i] {
+			out = append(out, line)
+		}
+	}
+	var keys []string
+	for key, value := range values {
+		if !done[key] && value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		out = append(out, key+" = "+formatConfigValue(key, values[key]))
+	}
+	return os.WriteFile(path, []byte(strings.Join(out, "\n")+"\n"), 0600)
+}
+
+// configFilePath is -config, or else the config file in the data directory (the
+// default one when neither -data-dir nor -profile is given). Empty if there's no
+// default data directory
+func configFilePath(explicit, base, profile string) string {
+	if explicit != "" {
+		return explicit
+	}
+	if base == "" {
+		dir, err := defaultDataDir()
+		if err != nil {
+			return ""
+		}
+		base = dir
+	}
+	if profile != "" {
+		if !profileNamePattern.MatchString(profile) {
+			return "" // OpenDataDir reports it
+		}
+		base = filepath.Join(base, profile)
+	}
+	return filepath.Join(base, ConfigFileName)
+}
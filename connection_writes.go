@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Every lookup round reports each responder's peers, and a busy node sees the same
+// (system, peer) pairs hundreds of times an hour. Writing each sighting would rewrite the
+// same peer_connections rows over and over, so a row is only written again once
+// PeerConnectionRewriteInterval has passed. Sightings in between are counted in memory
+// and added to the row's observations when it's next written, or by a later sweep once
+// the edge goes quiet.
+
+// PeerConnectionRewriteInterval is how long a written peer_connections row is left alone
+// A tenth of the hour the map shows edges for, so an edge's age is off by minutes at most
+const PeerConnectionRewriteInterval = 6 * time.Minute
+
+// connectionKey is one directed edge
+type connectionKey struct {
+	system, peer uuid.UUID
+}
+
+// connectionWrite is what we remember about an edge we wrote
+type connectionWrite struct {
+	writtenAt time.Time
+	unwritten int64 // Sightings since then, not yet in the row's observations
+}
+
+// connectionWriteCache remembers recently written peer_connections rows
+type connectionWriteCache struct {
+	mu        sync.Mutex
+	interval  time.Duration // 0 writes every sighting
+	edges     map[connectionKey]*connectionWrite
+	lastSweep time.Time
+
+	// Totals since startup, for comparing with and without the cache
+	sightings int64 // Edges reported
+	written   int64 // Rows written, sweeps included
+}
+
+func newConnectionWriteCache(interval time.Duration) *connectionWriteCache {
+	return &connectionWriteCache{
+		interval: interval,
+		edges:    make(map[connectionKey]*connectionWrite),
+	}
+}
+
+// connectionUpdate is a row to write: a new or due edge, or a quiet edge's leftover sightings
+type connectionUpdate struct {
+	peer         uuid.UUID
+	observations int64
+	touch        bool // Also refresh updated_at and reciprocity (false: only add observations)
+}
+
+// plan records a responder's reported peers and returns the rows that need writing
+// Quiet edges with sightings left over are swept at most once an interval
+func (c *connectionWriteCache) plan(systemID uuid.UUID, peerIDs []uuid.UUID, now time.Time) map[uuid.UUID][]connectionUpdate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	updates := make(map[uuid.UUID][]connectionUpdate)
+	for _, peerID := range peerIDs {
+		c.sightings++
+		key := connectionKey{systemID, peerID}
+		if w, ok := c.edges[key]; ok && now.Sub(w.writtenAt) < c.interval {
+			w.unwritten++
+			continue
+		}
+
+		observations := int64(1)
+		if w, ok := c.edges[key]; ok {
+			observations += w.unwritten
+		}
+		updates[systemID] = append(updates[systemID], connectionUpdate{peer: peerID, observations: observations, touch: true})
+		c.written++
+		if c.interval > 0 {
+			c.edges[key] = &connectionWrite{writtenAt: now}
+		}
+	}
+
+	if now.Sub(c.lastSweep) >= c.interval {
+		c.lastSweep = now
+		for key, w := range c.edges {
+			if now.Sub(w.writtenAt) < c.interval {
+				continue
+			}
+			if w.unwritten > 0 {
+				updates[key.system] = append(updates[key.system], connectionUpdate{peer: key.peer, observations: w.unwritten})
+				c.written++
+			}
+			delete(c.edges, key)
+		}
+	}
+	return updates
+}
+
+// reset forgets every edge, after rows were deleted or moved underneath it
+// Sightings not yet written are dropped; observation counts are approximate anyway
+func (c *connectionWriteCache) reset() {
+	c.mu.Lock()
+	c.edges = make(map[connectionKey]*connectionWrite)
+	c.mu.Unlock()
+}
+
+// stats returns the sightings recorded and rows written since startup
+func (c *connectionWriteCache) stats() (sightings, written int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sightings, c.written
+}
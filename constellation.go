@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultConstellationDepth is how many sponsor links /api/constellation follows by default
+	DefaultConstellationDepth = 3
+
+	// MaxConstellationDepth bounds the depth a request can ask for
+	MaxConstellationDepth = 10
+
+	// MaxConstellationSize caps the systems in one constellation; an early sponsor's
+	// descendants can be most of the galaxy
+	MaxConstellationSize = 500
+)
+
+// ConstellationNode is one system in a sponsor lineage, with the systems it sponsored
+type ConstellationNode struct {
+	ID         string               `json:"id"`
+	Name       string               `json:"name"`
+	Generation int                  `json:"generation"` // Relative to the system asked about: -1 is its sponsor, 1 a system it sponsored
+	Children   []*ConstellationNode `json:"children"`
+}
+
+// Constellation is a system's sponsor lineage (/api/constellation/{id})
+type Constellation struct {
+	SystemID  string             `json:"system_id"`
+	Depth     int                `json:"depth"`
+	Size      int                `json:"size"`
+	Truncated bool               `json:"truncated,omitempty"` // Stopped at MaxConstellationSize
+	Root      *ConstellationNode `json:"root"`                // The furthest ancestor found
+}
+
+// GetConstellation walks sponsor links out from a system: up to whoever sponsored it and
+// down to the cached systems naming it as their sponsor, up to depth links away (so with
+// depth 2, its siblings too). Sponsor data comes from gossip and may loop, so every
+// system is visited once. Returns ErrUnknownSystem if the system isn't known
+func (dht *DHT) GetConstellation(id uuid.UUID, depth int) (*Constellation, error) {
+	start := dht.lookupSponsor(id)
+	if start == nil {
+		return nil, ErrUnknownSystem
+	}
+
+	// Who each system sponsored, per our cache
+	systems := []*System{dht.localSystem}
+	systems = append(systems, dht.routingTable.GetAllCachedSystems()...)
+	sponsored := make(map[uuid.UUID][]*System)
+	for _, sys := range systems {
+		if sys.SponsorID != nil && *sys.SponsorID != sys.ID {
+			sponsored[*sys.SponsorID] = append(sponsored[*sys.SponsorID], sys)
+		}
+	}
+
+	// Breadth first, so hitting the size cap drops the most distant relatives
+	c := &Constellation{SystemID: id.String(), Depth: depth}
+	visited := map[uuid.UUID]*System{id: start}
+	frontier := []*System{start}
+	for hop := 0; hop < depth && len(frontier) > 0 && !c.Truncated; hop++ {
+		var next []*System
+		visit := func(sys *System) {
+			if sys == nil || visited[sys.ID] != nil {
+				return
+			}
+			if len(visited) >= MaxConstellationSize {
+				c.Truncated = true
+				return
+			}
+			visited[sys.ID] = sys
+			next = append(next, sys)
+		}
+		for _, sys := range frontier {
+			if sys.SponsorID != nil {
+				visit(dht.lookupSponsor(*sys.SponsorID))
+			}
+			for _, child := range sponsored[sys.ID] {
+				visit(child)
+			}
+		}
+		frontier = next
+	}
+
+	// The root is the furthest ancestor visited (stopping where a sponsor loop closes)
+	root, generation := start, 0
+	for seen := map[uuid.UUID]bool{id: true}; root.SponsorID != nil; generation-- {
+		parent := visited[*root.SponsorID]
+		if parent == nil || seen[parent.ID] {
+			break
+		}
+		seen[parent.ID] = true
+		root = parent
+	}
+
+	placed := make(map[uuid.UUID]bool)
+	var build func(sys *System, generation int) *ConstellationNode
+	build = func(sys *System, generation int) *ConstellationNode {
+		placed[sys.ID] = true
+		node := &ConstellationNode{ID: sys.ID.String(), Name: sys.Name, Generation: generation, Children: []*ConstellationNode{}}
+		for _, child := range sponsored[sys.ID] {
+			if visited[child.ID] != nil && !placed[child.ID] {
+				node.Children = append(node.Children, build(child, generation+1))
+			}
+		}
+		sort.Slice(node.Children, func(i, j int) bool {
+			a, b := node.Children[i], node.Children[j]
+			return a.Name < b.Name || (a.Name == b.Name && a.ID < b.ID)
+		})
+		return node
+	}
+	c.Root = build(root, generation)
+	c.Size = len(placed)
+	return c, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// CoordsRetryInterval is how long to wait before looking up a missing sponsor again
+	CoordsRetryInterval = 5 * time.Minute
+
+	// CoordsBlockDuration is how long a system stays blocked after failing deferred validation
+	CoordsBlockDuration = 24 * time.Hour
+
+	// MaxPendingCoords bounds how many systems may wait on their sponsor at once
+	MaxPendingCoords = 1024
+
+	// coordsCheckInterval is how often the pending queue is checked for due lookups
+	coordsCheckInterval = 1 * time.Minute
+)
+
+// pendingCoords is a system accepted before its sponsor was known
+type pendingCoords struct {
+	system     *System // As the system presented itself to us
+	nextLookup time.Time
+}
+
+// coordsVerifier queues systems whose coordinates can't be checked yet
+type coordsVerifier struct {
+	mu      sync.Mutex
+	pending map[uuid.UUID]*pendingCoords
+	wake    chan struct{}
+}
+
+func newCoordsVerifier() *coordsVerifier {
+	return &coordsVerifier{
+		pending: make(map[uuid.UUID]*pendingCoords),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// lookupSponsor finds a sponsor in the routing table cache or storage, or nil if unknown
+func (dht *DHT) lookupSponsor(sponsorID uuid.UUID) *System {
+	if sponsorID == dht.localSystem.ID {
+		return dht.localSystem
+	}
+	if cached := dht.routingTable.GetCachedSystem(sponsorID); cached != nil {
+		return cached
+	}
+	if stored, err := dht.storage.GetPeerSystem(sponsorID); err == nil {
+		return stored
+	}
+	return nil
+}
+
+// deferCoordsValidation marks a cached system unverified and queues a lookup of its sponsor
+// When the queue is full the system still isn't shared; its next message retries the check
+func (dht *DHT) deferCoordsValidation(sys *System) {
+	dht.routingTable.SetCoordsUnverified(sys.ID, true)
+
+	cv := dht.coords
+	cv.mu.Lock()
+	if p, ok := cv.pending[sys.ID]; ok {
+		p.system = sys
+		cv.mu.Unlock()
+		return
+	}
+	if len(cv.pending) >= MaxPendingCoords {
+		cv.mu.Unlock()
+		return
+	}
+	cv.pending[sys.ID] = &pendingCoords{system: sys, nextLookup: time.Now()}
+	cv.mu.Unlock()
+
+	log.Printf("Sponsor %s of %s (%s) is unknown, validating coordinates in the background",
+		sys.SponsorID.String()[:8], sys.Name, sys.ID.String()[:8])
+
+	select {
+	case cv.wake <- struct{}{}:
+	default:
+	}
+}
+
+// resolveCoords settles a deferred validation: valid systems become shareable,
+// invalid ones are evicted and blocked so they're dropped from gossip too
+// reason is what CheckCoordinates found wrong with invalid ones
+func (dht *DHT) resolveCoords(sys *System, status CoordsStatus, reason string) {
+	dht.coords.mu.Lock()
+	_, wasPending := dht.coords.pending[sys.ID]
+	delete(dht.coords.pending, sys.ID)
+	dht.coords.mu.Unlock()
+
+	switch status {
+	case CoordsValid:
+		dht.routingTable.SetCoordsUnverified(sys.ID, false)
+		if wasPending {
+			log.Printf("Coordinates verified for %s (%s)", sys.Name, sys.ID.String()[:8])
+		}
+	case CoordsInvalid:
+		if !wasPending && !dht.routingTable.CoordsUnverified(sys.ID) {
+			return // Never accepted; the caller just rejects the message
+		}
+		log.Printf("Coordinates of %s (%s) don't match sponsor %s (%s), blocking",
+			sys.Name, sys.ID.String()[:8], sys.SponsorID.String()[:8], reason)
+		if _, err := dht.BlockSystem(sys.ID, "coordinates invalid for UUID and sponsor", CoordsBlockDuration); err != nil {
+			log.Printf("Failed to block %s: %v", sys.ID.String()[:8], err)
+		}
+	}
+}
+
+// coordsVerificationLoop looks up missing sponsors and re-validates queued systems
+func (dht *DHT) coordsVerificationLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskCoordsVerification, every(coordsCheckInterval))
+
+	ticker := time.NewTicker(coordsCheckInterval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(coordsCheckInterval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(coordsCheckInterval))
+		case <-dht.coords.wake:
+		case <-t.trigger:
+		}
+		t.run(func() (int, error) { return dht.verifyPendingCoords(), nil })
+	}
+}
+
+// verifyPendingCoords handles every queued system whose next lookup is due
+// Returns how many were due
+func (dht *DHT) verifyPendingCoords() int {
+	now := time.Now()
+
+	var due []*System
+	dht.coords.mu.Lock()
+	for id, p := range dht.coords.pending {
+		// Pruned or blocked in the meantime - nothing left to validate
+		if dht.routingTable.GetCachedSystemMeta(id) == nil {
+			delete(dht.coords.pending, id)
+			continue
+		}
+		if !p.nextLookup.After(now) {
+			due = append(due, p.system)
+		}
+	}
+	dht.coords.mu.Unlock()
+
+	for _, sys := range due {
+		sponsor := dht.lookupSponsor(*sys.SponsorID)
+		if sponsor == nil {
+			// FindNode caches what it learns, so a found sponsor is known from here on
+			if found, err := dht.Lookup(*sys.SponsorID); err == nil {
+				sponsor = found
+			}
+		}
+
+		if sponsor == nil {
+			dht.coords.mu.Lock()
+			if p, ok := dht.coords.pending[sys.ID]; ok {
+				p.nextLookup = time.Now().Add(CoordsRetryInterval)
+			}
+			dht.coords.mu.Unlock()
+			continue
+		}
+
+		status, reason := CheckCoordinates(sys, func(uuid.UUID) *System { return sponsor })
+		dht.resolveCoords(sys, status, reason)
+	}
+	return len(due)
+}
+
+// shareable reports whether a system may be passed on in find_node, full-sync and discovery responses
+func (dht *DHT) shareable(sys *System) bool {
+	return !dht.routingTable.CoordsUnverified(sys.ID) && !dht.routingTable.IsQuarantined(sys.ID) &&
+		!dht.routingTable.IsRetracted(sys.ID)
+}
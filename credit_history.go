@@ -0,0 +1,123 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// DefaultCreditHistoryDays is how far back /api/credits/history looks by default
+	DefaultCreditHistoryDays = 30
+
+	// MaxCreditHistoryDays bounds the /api/credits/history range
+	MaxCreditHistoryDays = 90
+)
+
+// CreditEarning is the breakdown of one credit calculation cycle, or of a whole
+// day of them once compacted (Cycles > 1: credits summed, the rest averaged)
+type CreditEarning struct {
+	CalculatedAt int64         `json:"calculated_at"`
+	Cycles       int           `json:"cycles"`
+	Base         float64       `json:"base_credits"`
+	Bonuses      CreditBonuses `json:"bonuses"`
+	Service      float64       `json:"service_credits"` // Included in Earned
+	Earned       float64       `json:"credits_earned"`
+	PeerCount    int           `json:"peer_count"`
+	GalaxySize   int           `json:"galaxy_size"`
+	WindowStart  int64         `json:"window_start"` // Evidence counted from here (the last calculation)
+	WindowEnd    int64         `json:"window_end"`   // up to here; a compacted day spans its cycles' windows
+
+	// Inputs behind the bridge and reciprocity bonuses
+	BridgeScore      float64 `json:"bridge_score"`
+	ReciprocityRatio float64 `json:"reciprocity_ratio"`
+	AvgConnectivity  float64 `json:"avg_connectivity"`
+}
+
+// NewCreditEarning records a calculation result together with the inputs worth charting or auditing
+func NewCreditEarning(input CalculationInput, result CalculationResult, at time.Time) *CreditEarning {
+	return &CreditEarning{
+		CalculatedAt: at.Unix(),
+		Cycles:       1,
+		Base:         result.BaseCredits,
+		Bonuses:      result.Bonuses,
+		Service:      result.ServiceCredits,
+		Earned:       result.CreditsEarned,
+		PeerCount:    input.PeerCount,
+		GalaxySize:   input.GalaxySize,
+		WindowStart:  input.LastCalculation,
+		WindowEnd:    input.WindowEnd,
+
+		BridgeScore:      input.BridgeScore,
+		ReciprocityRatio: input.ReciprocityRatio,
+		AvgConnectivity:  input.AvgConnectivity,
+	}
+}
+
+// CreditDay is one UTC day of credit earnings
+type CreditDay struct {
+	Date    string        `json:"date"` // YYYY-MM-DD (UTC)
+	Start   int64         `json:"start"`
+	Cycles  int           `json:"cycles"`
+	Base    float64       `json:"base_credits"`
+	Bonuses CreditBonuses `json:"bonuses"` // Averaged over the day's cycles
+	Service float64       `json:"service_credits"`
+	Earned  float64       `json:"credits_earned"`
+}
+
+// CreditHistory is the /api/credits/history response
+type CreditHistory struct {
+	Since   int64            `json:"since"`
+	Entries []*CreditEarning `json:"entries"`
+	Days    []CreditDay      `json:"days"`
+}
+
+// dailyCreditEarnings totals earnings per UTC day from since to now, including empty days
+func dailyCreditEarnings(entries []*CreditEarning, since, now time.Time) []CreditDay {
+	var days []CreditDay
+	for day := since.UTC().Truncate(24 * time.Hour); day.Before(now); day = day.Add(24 * time.Hour) {
+		d := CreditDay{Date: day.Format("2006-01-02"), Start: day.Unix()}
+		for _, e := range entries {
+			if e.CalculatedAt < d.Start || e.CalculatedAt >= d.Start+86400 {
+				continue
+			}
+			n := float64(e.Cycles)
+			d.Cycles += e.Cycles
+			d.Base += e.Base
+			d.Service += e.Service
+			d.Earned += e.Earned
+			d.Bonuses.Bridge += e.Bonuses.Bridge * n
+			d.Bonuses.Longevity += e.Bonuses.Longevity * n
+			d.Bonuses.Pioneer += e.Bonuses.Pioneer * n
+			d.Bonuses.Reciprocity += e.Bonuses.Reciprocity * n
+		}
+		if d.Cycles > 0 {
+			n := float64(d.Cycles)
+			d.Bonuses.Bridge /= n
+			d.Bonuses.Longevity /= n
+			d.Bonuses.Pioneer /= n
+			d.Bonuses.Reciprocity /= n
+			d.Bonuses.Total = d.Bonuses.Bridge + d.Bonuses.Longevity + d.Bonuses.Pioneer + d.Bonuses.Reciprocity
+		}
+		days = append(days, d)
+	}
+	return days
+}
+
+// GetCreditHistory returns the credit calculations of the last days (including today, UTC)
+func (dht *DHT) GetCreditHistory(days int) (*CreditHistory, error) {
+	now := time.Now()
+	since := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+
+	entries, err := dht.storage.GetCreditEarnings(since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []*CreditEarning{}
+	}
+
+	return &CreditHistory{
+		Since:   since.Unix(),
+		Entries: entries,
+		Days:    dailyCreditEarnings(entries, since, now),
+	}, nil
+}
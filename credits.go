@@ -5,7 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/google/uuid"
@@ -32,6 +34,10 @@ import (
 // - Pioneer bonus: Up to +30% when network is small (<20 nodes)
 // - Reciprocity bonus: Up to +5% for healthy bidirectional peer relationships
 //
+// Service credits (added after bonuses, see service_receipts.go):
+// - 0.25 per full-sync and 0.1 per discovery request served, from signed receipts
+// - At most 0.25 per requester per day; identities bound under a week count for less
+//
 // Grace period: 15 minutes - short gaps don't count as downtime
 // Longevity reset: 30 minutes - longer gaps reset your streak
 //
@@ -133,51 +139,98 @@ type CreditBonuses struct {
 	Total      float64 `json:"total"`      // Sum of all bonuses
 }
 
+// AttestationSpan is aggregated uptime evidence from one peer for one day,
+// left behind when compaction removes the individual attestations
+// Spans count toward uptime and reciprocity but can't be put in transfer proofs
+type AttestationSpan struct {
+	FromSystemID uuid.UUID
+	Count        int
+	First        int64 // Earliest compacted attestation
+	Last         int64 // Latest compacted attestation
+}
+
 // CalculationInput holds all inputs for credit calculation
 type CalculationInput struct {
 	Attestations     []*Attestation
+	Spans            []*AttestationSpan // Compacted evidence (see Storage.CompactAttestations)
 	PeerCount        int
 	LastCalculation  int64
+	WindowEnd        int64   // Evidence after this is left for the next calculation (0 = count it all)
 	LongevityStart   int64   // When current uptime streak began
 	BridgeScore      float64 // 0.0 to 1.0
 	GalaxySize       int     // Total nodes in network
 	ReciprocityRatio float64 // 0.0 to 1.0, fraction of peers that attest back
+	AvgConnectivity  float64 // Network average BridgeScore was measured against (recorded only)
+
+	// Service receipts from the start of LastCalculation's UTC day on, oldest first, and
+	// when each signer's identity was bound (see service_receipts.go)
+	ServiceReceipts   []*Attestation
+	ReceiptIdentities map[uuid.UUID]int64
 }
 
 // CalculationResult holds the result with breakdown
 type CalculationResult struct {
 	CreditsEarned     float64       `json:"credits_earned"`     // Now float64 for fractional credits
 	BaseCredits       float64       `json:"base_credits"`
+	ServiceCredits    float64       `json:"service_credits"`    // From service receipts, included in CreditsEarned
 	Bonuses           CreditBonuses `json:"bonuses"`
 	LongevityBroken   bool          `json:"longevity_broken"`   // True if streak was reset
 	NewLongevityStart int64         `json:"new_longevity_start"`
 }
 
-// CalculateEarnedCredits computes credits with all bonuses
+// CalculateEarnedCredits computes credits with all bonuses, plus service credits
 func (cc *CreditCalculator) CalculateEarnedCredits(input CalculationInput) CalculationResult {
+	result := cc.uptimeCredits(input)
+	result.ServiceCredits = cc.serviceCredits(input)
+	result.CreditsEarned += result.ServiceCredits
+	return result
+}
+
+// inWindow reports whether evidence from t falls before the window's end
+func (input CalculationInput) inWindow(t int64) bool {
+	return input.WindowEnd == 0 || t <= input.WindowEnd
+}
+
+// uptimeCredits computes the credits attested uptime earns, with all bonuses
+func (cc *CreditCalculator) uptimeCredits(input CalculationInput) CalculationResult {
 	result := CalculationResult{
 		NewLongevityStart: input.LongevityStart,
 	}
 
-	if len(input.Attestations) == 0 || input.PeerCount == 0 {
+	if (len(input.Attestations) == 0 && len(input.Spans) == 0) || input.PeerCount == 0 {
 		return result
 	}
 
 	// Find time bounds
-	var oldest, newest int64 = input.Attestations[0].Timestamp, input.Attestations[0].Timestamp
+	var oldest, newest int64
+	// Attestations count at our clock's time, whatever the signer's clock said
 	for _, att := range input.Attestations {
-		if att.Timestamp < oldest {
-			oldest = att.Timestamp
+		if !input.inWindow(att.LocalTime()) {
+			continue
+		}
+		if oldest == 0 || att.LocalTime() < oldest {
+			oldest = att.LocalTime()
+		}
+		if att.LocalTime() > newest {
+			newest = att.LocalTime()
+		}
+	}
+	for _, span := range input.Spans {
+		if oldest == 0 || span.First < oldest {
+			oldest = span.First
 		}
-		if att.Timestamp > newest {
-			newest = att.Timestamp
+		if span.Last > newest {
+			newest = span.Last
 		}
 	}
 
-	// Only count time since last calculation
+	// Only count time since last calculation, and up to the window's end
 	if oldest < input.LastCalculation {
 		oldest = input.LastCalculation
 	}
+	if input.WindowEnd > 0 && newest > input.WindowEnd {
+		newest = input.WindowEnd
+	}
 
 	// Time span
 	spanSeconds := newest - oldest
@@ -192,37 +245,56 @@ func (cc *CreditCalculator) CalculateEarnedCredits(input CalculationInput) Calcu
 	// Realistically expect ~4-6 attestations per peer per hour
 	expectedPerHour := float64(input.PeerCount) * 4.0
 
-	// Count attestations and collect timestamps for gap analysis
+	// Count attestations and collect covered intervals for gap analysis
+	// Their signatures were checked when they were saved (see GetAttestationsSince)
 	actualCount := 0
-	var timestamps []int64
+	var covered []interval
 	for _, att := range input.Attestations {
-		if att.Timestamp >= oldest && att.Verify() {
+		if att.LocalTime() >= oldest && input.inWindow(att.LocalTime()) {
 			actualCount++
-			timestamps = append(timestamps, att.Timestamp)
+			covered = append(covered, interval{att.LocalTime(), att.LocalTime()})
 		}
 	}
 
-	// Sort timestamps to find gaps
-	sortInt64s(timestamps)
+	gracePeriodSec := int64(cc.GracePeriod.Seconds())
+	for _, span := range input.Spans {
+		if span.Last < oldest {
+			continue
+		}
+		if span.First < oldest {
+			// Only the part of the span after the last calculation counts
+			actualCount += int(float64(span.Count) * float64(span.Last-oldest) / float64(span.Last-span.First))
+		} else {
+			actualCount += span.Count
+		}
+
+		for _, iv := range cc.coverage(span.Count, span.First, span.Last) {
+			if iv.end < oldest {
+				continue
+			}
+			if iv.start < oldest {
+				iv.start = oldest
+			}
+			covered = append(covered, iv)
+		}
+	}
 
 	// Check for longevity-breaking gaps (>30 min)
-	gracePeriodSec := int64(cc.GracePeriod.Seconds())
 	longevityResetSec := int64(cc.LongevityResetThreshold.Seconds())
 	totalGapTime := int64(0)
-	
-	for i := 1; i < len(timestamps); i++ {
-		gap := timestamps[i] - timestamps[i-1]
-		
+
+	for _, gap := range cc.downtimeGaps(covered) {
+		length := gap.end - gap.start
+
 		// Check if this gap breaks longevity streak
-		if gap > longevityResetSec {
+		// (the reset threshold exceeds the grace period, so no breaking gap is missed)
+		if length > longevityResetSec {
 			result.LongevityBroken = true
-			result.NewLongevityStart = timestamps[i] // Streak restarts from here
+			result.NewLongevityStart = gap.end // Streak restarts from here
 		}
-		
+
 		// Count excess gap time beyond grace period
-		if gap > gracePeriodSec {
-			totalGapTime += gap - gracePeriodSec
-		}
+		totalGapTime += length - gracePeriodSec
 	}
 
 	// If no longevity start set, start now
@@ -266,7 +338,8 @@ func (cc *CreditCalculator) CalculateEarnedCredits(input CalculationInput) Calcu
 	// 2. LONGEVITY BONUS - +1% per week, max +52% at 1 year
 	longevityWeeks := float64(0)
 	if !result.LongevityBroken && result.NewLongevityStart > 0 {
-		longevitySeconds := newest - result.NewLongevityStart
+		// A streak start ahead of newest (the clock was set back) counts as none
+		longevitySeconds := max(newest-result.NewLongevityStart, 0)
 		longevityWeeks = float64(longevitySeconds) / (7 * 24 * 3600)
 	}
 	result.Bonuses.Longevity = min(longevityWeeks * 0.01, 0.52)
@@ -289,6 +362,44 @@ func (cc *CreditCalculator) CalculateEarnedCredits(input CalculationInput) Calcu
 	return result
 }
 
+// coverage returns what a group of attestations proves about uptime
+// A group dense enough that its average spacing is within the grace period is treated
+// as continuous; otherwise only its endpoints are known
+func (cc *CreditCalculator) coverage(count int, first, last int64) []interval {
+	gracePeriodSec := int64(cc.GracePeriod.Seconds())
+	if count > 1 && (last-first)/int64(count-1) <= gracePeriodSec {
+		return []interval{{first, last}}
+	}
+	if first == last {
+		return []interval{{last, last}}
+	}
+	return []interval{{first, first}, {last, last}}
+}
+
+// downtimeGaps returns the gaps between covered intervals that are longer than the
+// grace period; each one counts as (length - grace period) of downtime
+// Shared by credit calculation and the uptime history so the two can't disagree.
+// Sorts covered in place.
+func (cc *CreditCalculator) downtimeGaps(covered []interval) []interval {
+	if len(covered) == 0 {
+		return nil
+	}
+	sortIntervals(covered)
+
+	gracePeriodSec := int64(cc.GracePeriod.Seconds())
+	var gaps []interval
+	end := covered[0].end
+	for _, iv := range covered[1:] {
+		if iv.start-end > gracePeriodSec {
+			gaps = append(gaps, interval{end, iv.start})
+		}
+		if iv.end > end {
+			end = iv.end // Carry forward past contained intervals
+		}
+	}
+	return gaps
+}
+
 // calculatePioneerBonus returns bonus for small network participation
 // +30% at <20 nodes, +15% at <50 nodes, +5% at <100 nodes, 0% at 100+
 func calculatePioneerBonus(galaxySize int) float64 {
@@ -312,10 +423,15 @@ func min(a, b float64) float64 {
 	return b
 }
 
-// sortInt64s sorts a slice of int64 in ascending order
-func sortInt64s(a []int64) {
+// interval is a stretch of time covered by uptime evidence (start == end for a single attestation)
+type interval struct {
+	start, end int64
+}
+
+// sortIntervals sorts intervals by start time in ascending order
+func sortIntervals(a []interval) {
 	for i := 1; i < len(a); i++ {
-		for j := i; j > 0 && a[j] < a[j-1]; j-- {
+		for j := i; j > 0 && a[j].start < a[j-1].start; j-- {
 			a[j], a[j-1] = a[j-1], a[j]
 		}
 	}
@@ -464,9 +580,9 @@ type CreditProof struct {
 	AsOfTime     int64          `json:"as_of_time"`      // Timestamp this proof was generated
 	
 	// Attestations proving uptime - these are signed by OTHER nodes
-	// NOTE: Only attestations from v1.6.0+ nodes will have valid ToSystemID.
-	// Older attestations (pre-v1.6.0) have ToSystemID = uuid.Nil and won't count.
-	// Only attestations where ToSystemID == SystemID count (others attesting TO us)
+	// Only attestations from others count: ones to SystemID, and untargeted (pre-v1.6.0
+	// or first contact, ToSystemID = uuid.Nil) ones claimed as received by it, at
+	// LegacyAttestationWeight
 	Attestations []*Attestation `json:"attestations"`
 	
 	// Previous transfers that affect available balance
@@ -523,56 +639,108 @@ func GenerateCreditProof(
 // TRANSFER VALIDATION
 // =============================================================================
 
+// LegacyAttestationWeight is what an hour proven only by untargeted attestations is worth
+// in a credit proof. Nodes before v1.6.0, and any node on first contact, sign attestations
+// to uuid.Nil, so the signature doesn't say who received one: in a proof, received_by is
+// the prover's word, and one attestation could be shown by every system it was passed to.
+// Half weight lets a long-running node's older history count without making an
+// attestation it can't prove was its own worth as much as one addressed to it. The local
+// credit cycle counts them fully, since there received_by is our own record of receiving
+// them (see GetAttestationsSince)
+const LegacyAttestationWeight = 0.5
+
+// LegacyAttestationCap bounds what untargeted attestations add to a proof, as a multiple
+// of what its targeted ones prove. A system with no addressed attestations proves nothing
+// with untargeted ones, and history passed off as its own can at most double its proof
+const LegacyAttestationCap = 1.0
+
 // CalculateCreditsFromAttestations deterministically calculates earned credits
 // This is a simplified calculation that any node can verify:
 // - 1 credit per hour of attested uptime
 // - Only counts attestations FROM others TO the system (not self-attestations)
+// - Hours only untargeted attestations cover count at LegacyAttestationWeight, up to
+//   LegacyAttestationCap times the targeted ones
 // - No bonuses (they depend on network state at calculation time)
-//
-// NOTE: Only attestations from v1.6.0+ nodes will have valid ToSystemID.
-// Pre-v1.6.0 attestations have ToSystemID = uuid.Nil and won't be counted.
-// Credit transfers will only work with attestations created after v1.6.0 upgrade.
 func CalculateCreditsFromAttestations(attestations []*Attestation, systemID uuid.UUID) int64 {
 	if len(attestations) == 0 {
 		return 0
 	}
 
-	// Filter to only attestations TO this system (from others)
-	var validAttestations []*Attestation
+	// Filter to only attestations TO this system (from others), each counted once
+	var span proofSpan
+	seen := make(map[string]bool, len(attestations))
 	for _, att := range attestations {
-		// Only v1.6.0+ attestations have valid ToSystemID
-		// Pre-v1.6.0 attestations have uuid.Nil and won't match
-		if att.ToSystemID != systemID {
+		if !att.addressedTo(systemID) {
 			continue
 		}
 		// Must be FROM someone else
 		if att.FromSystemID == systemID {
 			continue
 		}
-		// Must have valid signature
-		if !att.Verify() {
+		// Must have valid signature (a proof is checked before it's recalculated)
+		if !att.VerifyCached() {
+			continue
+		}
+		// A replayed copy proves nothing the original doesn't
+		if seen[att.replayKey()] {
 			continue
 		}
-		validAttestations = append(validAttestations, att)
+		seen[att.replayKey()] = true
+		span.add(att)
 	}
 
-	if len(validAttestations) == 0 {
-		return 0
+	return span.credits()
+}
+
+// proofSpan is the time a proof's attestations cover, all of them and the targeted ones
+type proofSpan struct {
+	all, targeted timeBounds
+}
+
+// timeBounds is the oldest and newest of some timestamps
+type timeBounds struct {
+	set            bool
+	oldest, newest int64
+}
+
+// add widens the bounds to take in ts
+func (b *timeBounds) add(ts int64) {
+	if !b.set || ts < b.oldest {
+		b.oldest = ts
+	}
+	if !b.set || ts > b.newest {
+		b.newest = ts
 	}
+	b.set = true
+}
 
-	// Find time bounds
-	var oldest, newest int64 = validAttestations[0].Timestamp, validAttestations[0].Timestamp
-	for _, att := range validAttestations {
-		if att.Timestamp < oldest {
-			oldest = att.Timestamp
-		}
-		if att.Timestamp > newest {
-			newest = att.Timestamp
-		}
+// add counts an attestation already found to be evidence for the system
+func (p *proofSpan) add(att *Attestation) {
+	p.all.add(att.Timestamp)
+	if att.ToSystemID != uuid.Nil {
+		p.targeted.add(att.Timestamp)
+	}
+}
+
+// credits is what the span proves: the targeted attestations' hours in full, and the
+// hours untargeted ones add beyond them at LegacyAttestationWeight, capped at
+// LegacyAttestationCap times the targeted hours
+func (p *proofSpan) credits() int64 {
+	if !p.targeted.set {
+		return 0
+	}
+	all := creditsForSpan(p.all.newest, p.all.oldest)
+	targeted := creditsForSpan(p.targeted.newest, p.targeted.oldest)
+	legacy := int64(float64(all-targeted) * LegacyAttestationWeight)
+	if limit := int64(float64(targeted) * LegacyAttestationCap); legacy > limit {
+		legacy = limit
 	}
+	return targeted + legacy
+}
 
-	// Calculate hours of uptime
-	// Simple model: if you have attestations spanning N hours, you were online N hours
+// creditsForSpan is the credit attestations from newest back to oldest prove
+// Simple model: if you have attestations spanning N hours, you were online N hours
+func creditsForSpan(newest, oldest int64) int64 {
 	spanSeconds := newest - oldest
 	if spanSeconds <= 0 {
 		// Single attestation = 1 hour minimum
@@ -590,9 +758,8 @@ func CalculateCreditsFromAttestations(attestations []*Attestation, systemID uuid
 
 // ValidateTransferProof validates that a transfer has sufficient proven balance
 // Returns nil if valid, error describing the problem if invalid
-//
-// NOTE: Only works with attestations from v1.6.0+ nodes that have valid ToSystemID.
-// Pre-v1.6.0 attestations have ToSystemID = uuid.Nil and won't be counted.
+// Untargeted attestations count when they're claimed as received by the sender, at
+// LegacyAttestationWeight and up to LegacyAttestationCap (see CalculateCreditsFromAttestations)
 func ValidateTransferProof(transfer *CreditTransfer, knownTransfers []*CreditTransfer) error {
 	// 1. Verify transfer signature
 	if !transfer.Verify() {
@@ -611,9 +778,8 @@ func ValidateTransferProof(transfer *CreditTransfer, knownTransfers []*CreditTra
 
 	// 4. Verify all attestations in proof are from OTHER nodes (not self-signed)
 	for _, att := range transfer.Proof.Attestations {
-		// Only v1.6.0+ attestations have valid ToSystemID
 		// Must be TO the sender (proving they received attestation)
-		if att.ToSystemID != transfer.FromSystemID {
+		if !att.addressedTo(transfer.FromSystemID) {
 			continue // Skip, doesn't help their case
 		}
 		// Must be FROM someone else
@@ -621,12 +787,12 @@ func ValidateTransferProof(transfer *CreditTransfer, knownTransfers []*CreditTra
 			return fmt.Errorf("proof contains self-attestation")
 		}
 		// Must have valid signature from the other node
-		if !att.Verify() {
+		if !att.VerifyCached() {
 			return fmt.Errorf("proof contains invalid attestation signature")
 		}
 	}
 
-	// 5. Recalculate earned credits from attestations
+	// 5. Recalculate earned credits from attestations (repeats counted once)
 	calculatedEarned := CalculateCreditsFromAttestations(
 		transfer.Proof.Attestations,
 		transfer.FromSystemID,
@@ -669,52 +835,154 @@ func ValidateTransferProof(transfer *CreditTransfer, knownTransfers []*CreditTra
 	return nil
 }
 
+// ProofPageSize is how many attestations BuildMinimalProof reads at a time
+const ProofPageSize = 1000
+
+// ErrProofTooLarge is a proof that can't be made to fit its byte budget
+var ErrProofTooLarge = errors.New("amount too large to prove in one message")
+
+// AttestationPage returns up to limit attestations other systems sent a system before
+// the given time, newest first, each with a signature already checked on arrival
+// (see Storage.GetRecentAttestationsForSystem)
+type AttestationPage func(limit int, before int64) ([]*Attestation, error)
+
 // BuildMinimalProof creates a proof with just enough attestations to cover the transfer amount
 // This keeps proof sizes manageable for large histories
 //
-// NOTE: Only works with attestations from v1.6.0+ nodes that have valid ToSystemID.
-// Pre-v1.6.0 attestations have ToSystemID = uuid.Nil and won't be counted.
+// Attestations are read a page at a time, newest first, until the span they cover is
+// enough; older history is never loaded. Attestations sharing a page boundary's second
+// may be skipped, which leaves the span (all a proof measures) unchanged. A proof over
+// budget bytes of JSON is thinned to fit (see fitProof)
 func BuildMinimalProof(
 	system *System,
 	amount int64,
 	priorSent int64,
-	allAttestations []*Attestation,
-) *CreditProof {
-	// Sort attestations by timestamp (newest first for freshest proof)
-	sorted := make([]*Attestation, len(allAttestations))
-	copy(sorted, allAttestations)
-	
-	// Simple sort - newest first
-	for i := 0; i < len(sorted)-1; i++ {
-		for j := i + 1; j < len(sorted); j++ {
-			if sorted[j].Timestamp > sorted[i].Timestamp {
-				sorted[i], sorted[j] = sorted[j], sorted[i]
-			}
-		}
-	}
-
+	page AttestationPage,
+	budget int,
+) (*CreditProof, error) {
 	// Include attestations until we have enough to prove the needed balance
 	needed := amount + priorSent
 	var included []*Attestation
+	var span proofSpan
 	var running int64
 
-	for _, att := range sorted {
-		// Only v1.6.0+ attestations have valid ToSystemID
-		// Only count attestations TO us from others
-		if att.ToSystemID != system.ID || att.FromSystemID == system.ID {
-			continue
-		}
-		if !att.Verify() {
-			continue
+	before := int64(math.MaxInt64)
+	for running < needed {
+		batch, err := page(ProofPageSize, before)
+		if err != nil {
+			return nil, err
 		}
+		for _, att := range batch {
+			// Only count attestations TO us from others
+			if !att.addressedTo(system.ID) || att.FromSystemID == system.ID {
+				continue
+			}
 
-		included = append(included, att)
-		running = CalculateCreditsFromAttestations(included, system.ID)
+			included = append(included, att)
+			span.add(att)
+			running = span.credits()
 
-		if running >= needed {
+			if running >= needed {
+				break
+			}
+		}
+		if len(batch) < ProofPageSize {
 			break
 		}
+		before = batch[len(batch)-1].Timestamp
 	}
 
-	return GenerateCreditProof(system, running, priorSent, included)
+	return fitProof(system, running, priorSent, included, budget)
+}
+
+// fitProof signs a proof of included (newest first), thinned to budget bytes of JSON
+// Credits are proven by the span between the newest and oldest attestation (and the
+// targeted ones among them), so those always stay and the ones between are dropped
+// evenly; the claim doesn't change
+func fitProof(system *System, claimed, priorSent int64, included []*Attestation, budget int) (*CreditProof, error) {
+	keep := len(included)
+	for {
+		proof := GenerateCreditProof(system, claimed, priorSent, thinAttestations(included, keep))
+		if proofSizeBound(proof) <= budget {
+			return proof, nil
+		}
+		data, err := json.Marshal(proof)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) <= budget {
+			return proof, nil
+		}
+		if keep <= 2 {
+			return nil, fmt.Errorf("%w: a proof of %d credits needs %d bytes, over the %d a message takes",
+				ErrProofTooLarge, claimed, len(data), budget)
+		}
+
+		// Scale down by how far over it is, with a little to spare for the envelope
+		next := int(float64(keep) * float64(budget) / float64(len(data)) * 0.95)
+		if next >= keep {
+			next = keep - 1
+		}
+		if next < 2 {
+			next = 2
+		}
+		keep = next
+	}
+}
+
+// proofSizeBound is at least a proof's JSON size, worked out without encoding it
+func proofSizeBound(p *CreditProof) int {
+	const fields = 256 // Names, UUIDs, numbers and punctuation, per proof and per attestation
+	n := fields + jsonStringBound(p.Signature) + jsonStringBound(p.PublicKey)
+	for _, att := range p.Attestations {
+		n += fields + jsonStringBound(att.MessageType) + jsonStringBound(att.Signature) +
+			jsonStringBound(att.PublicKey) + jsonStringBound(att.Nonce)
+		if att.ReceivedBy != nil {
+			n += 64
+		}
+	}
+	return n
+}
+
+// jsonStringBound is at least a string's encoded size, quotes aside: its length when
+// nothing in it needs escaping (base64 and hex never do), else as if everything did
+func jsonStringBound(s string) int {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return 6 * len(s)
+		}
+	}
+	return len(s)
+}
+
+// thinAttestations picks keep of atts, evenly spaced, always including the first and last
+// and the first and last targeted ones (up to two more than keep)
+func thinAttestations(atts []*Attestation, keep int) []*Attestation {
+	if keep >= len(atts) || keep < 2 {
+		return atts
+	}
+	picked := make(map[int]bool, keep+2)
+	for i := 0; i < keep; i++ {
+		picked[i*(len(atts)-1)/(keep-1)] = true
+	}
+	first, last := -1, -1
+	for i, att := range atts {
+		if att.ToSystemID != uuid.Nil {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first >= 0 {
+		picked[first], picked[last] = true, true
+	}
+
+	thinned := make([]*Attestation, 0, len(picked))
+	for i, att := range atts {
+		if picked[i] {
+			thinned = append(thinned, att)
+		}
+	}
+	return thinned
 }
\ No newline at end of file
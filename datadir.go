@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// DatabaseFileName is the database inside a data directory (and the usual flat -db name)
+	DatabaseFileName = "stellar-lab.db"
+
+	// LogFileName is where a node running from a data directory also writes its log
+	LogFileName = "stellar-lab.log"
+
+	// MaxLogFileBytes is the log size at which startup moves it aside to LogFileName.1
+	MaxLogFileBytes = 10 * 1024 * 1024
+
+	// lockFileName holds the PID of the node running from a data directory
+	lockFileName = "stellar-lab.lock"
+
+	// profileFileName records a profile's ports and public address
+	profileFileName = "profile.json"
+
+	// DefaultWebPort and DefaultPeerPort are where profile port assignment starts
+	DefaultWebPort  = 8080
+	DefaultPeerPort = 7867
+
+	// maxProfilePortOffset bounds the search for free profile ports
+	maxProfilePortOffset = 100
+)
+
+// profileNamePattern is what -profile accepts (it becomes a directory name)
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// ErrDataDirLocked is returned when another process runs from the same data directory
+var ErrDataDirLocked = errors.New("data directory is in use")
+
+// DataDir is a directory holding everything one node keeps on disk: its database
+// (which includes the identity keys), its log and, for a profile, profile.json
+type DataDir struct {
+	Path    string
+	Profile *Profile // nil unless opened with -profile
+
+	lockPath string
+}
+
+// Profile is a named data directory under -data-dir, with ports of its own so several
+// nodes can run side by side on one machine
+type Profile struct {
+	Name          string `json:"name"`
+	WebPort       int    `json:"web_port"`
+	PeerPort      int    `json:"peer_port"`
+	PublicAddress string `json:"public_address,omitempty"` // Remembered from -public-address
+	CreatedAt     int64  `json:"created_at"`
+}
+
+// defaultDataDir returns the per-user data directory: $XDG_DATA_HOME/stellar-lab
+// (~/.local/share/stellar-lab) on Linux, ~/Library/Application Support/stellar-lab on
+// macOS and %AppData%\stellar-lab on Windows
+func defaultDataDir() (string, error) {
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "stellar-lab"), nil
+	default:
+		if xdg := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(xdg) {
+			return filepath.Join(xdg, "stellar-lab"), nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".local", "share", "stellar-lab"), nil
+	}
+}
+
+// OpenDataDir resolves -data-dir and -profile (either may be empty, not both)
+// A profile lives in a subdirectory of the data directory named after it; its ports
+// are assigned the first time it's opened with create set. Without create, a missing
+// directory is an error
+func OpenDataDir(base, profile string, create bool) (*DataDir, error) {
+	if base == "" {
+		dir, err := defaultDataDir()
+		if err != nil {
+			return nil, fmt.Errorf("no default data directory: %w (use -data-dir)", err)
+		}
+		base = dir
+	}
+
+	d := &DataDir{Path: base}
+	if profile != "" {
+		if !profileNamePattern.MatchString(profile) {
+			return nil, fmt.Errorf("invalid profile name %q (letters, digits, '-' and '_', at most 32)", profile)
+		}
+		d.Path = filepath.Join(base, profile)
+	}
+	d.lockPath = d.File(lockFileName)
+
+	if _, err := os.Stat(d.Path); err != nil {
+		if !create || !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := os.MkdirAll(d.Path, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	if profile != "" {
+		p, err := loadProfile(d.File(profileFileName))
+		switch {
+		case err == nil:
+			d.Profile = p
+		case os.IsNotExist(err) && create:
+			if d.Profile, err = newProfile(base, profile); err != nil {
+				return nil, err
+			}
+			if err := d.SaveProfile(); err != nil {
+				return nil, err
+			}
+			log.Printf("Created profile %s (web port %d, peer port %d)", profile, d.Profile.WebPort, d.Profile.PeerPort)
+		default:
+			return nil, fmt.Errorf("profile %s: %w", profile, err)
+		}
+	}
+	return d, nil
+}
+
+// File returns the path of a file in the data directory
+func (d *DataDir) File(name string) string {
+	return filepath.Join(d.Path, name)
+}
+
+// DatabasePath is the node's database
+func (d *DataDir) DatabasePath() string {
+	return d.File(DatabaseFileName)
+}
+
+// SaveProfile writes profile.json
+func (d *DataDir) SaveProfile() error {
+	data, err := json.MarshalIndent(d.Profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(d.File(profileFileName), append(data, '\n'), 0600)
+}
+
+func loadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	if p.WebPort <= 0 || p.PeerPort <= 0 {
+		return nil, fmt.Errorf("%s has no ports", path)
+	}
+	return &p, nil
+}
+
+// newProfile assigns a new profile the first ports no other profile under base has
+// and nothing is listening on right now
+func newProfile(base, name string) (*Profile, error) {
+	taken := make(map[int]bool)
+	entries, _ := os.ReadDir(base)
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == name {
+			continue
+		}
+		if p, err := loadProfile(filepath.Join(base, e.Name(), profileFileName)); err == nil {
+			taken[p.WebPort] = true
+			taken[p.PeerPort] = true
+		}
+	}
+
+	web, err := freeProfilePort(DefaultWebPort, taken)
+	if err != nil {
+		return nil, err
+	}
+	taken[web] = true
+	peer, err := freeProfilePort(DefaultPeerPort, taken)
+	if err != nil {
+		return nil, err
+	}
+	return &Profile{Name: name, WebPort: web, PeerPort: peer, CreatedAt: time.Now().Unix()}, nil
+}
+
+// freeProfilePort returns the first port from start up that isn't taken and can be bound
+func freeProfilePort(start int, taken map[int]bool) (int, error) {
+	for port := start; port < start+maxProfilePortOffset; port++ {
+		if taken[port] {
+			continue
+		}
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port in %d-%d", start, start+maxProfilePortOffset-1)
+}
+
+// WebAddress is the profile's default web UI bind address
+func (p *Profile) WebAddress() string {
+	return net.JoinHostPort("0.0.0.0", strconv.Itoa(p.WebPort))
+}
+
+// ResolvePublicAddress completes -public-address from the profile: a bare host gets the
+// profile's peer port, and an empty one is the address remembered from an earlier run.
+// A new address is remembered for next time
+func (p *Profile) ResolvePublicAddress(d *DataDir, flagValue string) (string, error) {
+	addr := strings.TrimSpace(flagValue)
+	if addr == "" {
+		return p.PublicAddress, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(p.PeerPort))
+	}
+	if addr != p.PublicAddress {
+		p.PublicAddress = addr
+		if err := d.SaveProfile(); err != nil {
+			return "", err
+		}
+	}
+	return addr, nil
+}
+
+// Lock claims the data directory for this process. A lock left by a process that's no
+// longer running is taken over; one held by a running process is ErrDataDirLocked
+func (d *DataDir) Lock() error {
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(d.lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		data, _ := os.ReadFile(d.lockPath)
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		if pid > 0 && processAlive(pid) {
+			return fmt.Errorf("%w: %s is locked by process %d (remove %s if that's not a stellar-lab node)",
+				ErrDataDirLocked, d.Path, pid, d.lockPath)
+		}
+		log.Printf("Removing stale lock left by process %d in %s", pid, d.Path)
+		os.Remove(d.lockPath)
+	}
+	return fmt.Errorf("%w: couldn't take over the lock in %s", ErrDataDirLocked, d.Path)
+}
+
+// Unlock releases the data directory
+func (d *DataDir) Unlock() {
+	if err := os.Remove(d.lockPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove %s: %v", d.lockPath, err)
+	}
+}
+
+// processAlive reports whether a process with this PID is running
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true // FindProcess already failed for a PID that isn't running
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+// MigrateDatabase moves the first existing flat database among candidates (with its
+// WAL and shared-memory files) into the data directory, if it has no database yet
+// Returns the path it moved, or "" if there was nothing to do
+func (d *DataDir) MigrateDatabase(candidates []string) (string, error) {
+	target := d.DatabasePath()
+	if _, err := os.Stat(target); err == nil {
+		return "", nil
+	}
+
+	for _, src := range candidates {
+		if src == "" {
+			continue
+		}
+		abs, err := filepath.Abs(src)
+		if err != nil || abs == target {
+			continue
+		}
+		if info, err := os.Stat(abs); err != nil || info.IsDir() {
+			continue
+		}
+
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if _, err := os.Stat(abs + suffix); err != nil {
+				continue
+			}
+			if err := moveFile(abs+suffix, target+suffix); err != nil {
+				return "", fmt.Errorf("moving %s into %s: %w", abs+suffix, d.Path, err)
+			}
+		}
+		return abs, nil
+	}
+	return "", nil
+}
+
+// moveFile renames a file, copying it when the rename crosses filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// OpenLog opens the data directory's log for appending, first moving a log past
+// MaxLogFileBytes aside to LogFileName.1
+func (d *DataDir) OpenLog() (*os.File, error) {
+	path := d.File(LogFileName)
+	if info, err := os.Stat(path); err == nil && info.Size() > MaxLogFileBytes {
+		os.Rename(path, path+".1")
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
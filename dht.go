@@ -1,14 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/base64"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,6 +35,18 @@ const (
 	// RequestTimeout is how long to wait for a DHT response
 	RequestTimeout = 5 * time.Second
 
+	// LookupQueryTimeout is how long a lookup waits on one peer before moving on without it
+	LookupQueryTimeout = 2 * time.Second
+
+	// DefaultLookupTimeout bounds a whole lookup; past it the best nodes so far are returned
+	DefaultLookupTimeout = 10 * time.Second
+
+	// MaxLookupVerifications is how many new, unverified candidates a lookup pings afterwards
+	MaxLookupVerifications = 3
+
+	// ShutdownTimeout bounds how long in-flight requests get to finish on shutdown
+	ShutdownTimeout = 10 * time.Second
+
 	// AnnounceInterval is how often to re-announce ourselves
 	AnnounceInterval = 30 * time.Minute
 
@@ -37,13 +59,29 @@ const (
 	// VerificationCutoff is how long before a system is considered "stale" for full-sync
 	// Extended from 24h to 36h to avoid missing alive-but-quiet nodes
 	VerificationCutoff = 36 * time.Hour
+
+	// DefaultMaxFullSyncSystems caps how many systems we accept from (and serve in)
+	// one full-sync response, so a malicious seed can't flood our cache
+	DefaultMaxFullSyncSystems = 5000
+
+	// MaxFullSyncBytes bounds how much of a full-sync response body we'll read
+	MaxFullSyncBytes = 32 << 20
 )
 
 // DHT Message Types
 const (
-	MessageTypePing     = "ping"
-	MessageTypeFindNode = "find_node"
-	MessageTypeAnnounce = "announce"
+	MessageTypePing      = "ping"
+	MessageTypeFindNode  = "find_node"
+	MessageTypeAnnounce  = "announce"
+	MessageTypeSupersede = "supersede"
+	MessageTypeTransferAnnounce = "transfer_announce"
+	MessageTypePeerUnreachable  = "peer_unreachable"
+	MessageTypeRankProof        = "rank_proof"
+	MessageTypeKeyRotation      = "key_rotation"
+	MessageTypeInfoRelay        = "info_relay"
+	MessageTypeRelayedPing      = "relayed_ping"
+	MessageTypeServiceReceipt   = "service_receipt"
+	MessageTypeMessage          = "message"
 )
 
 // Error codes
@@ -52,20 +90,45 @@ const (
 	ErrCodeMissingAttestation = 401
 	ErrCodeInvalidAttestation = 402
 	ErrCodeIncompatibleVersion = 403
+	ErrCodeDuplicateTransfer  = 409
+	ErrCodeBlocked            = 423
+	ErrCodeRateLimited        = 429
+	ErrCodeInvalidTransfer    = 422
+	ErrCodeMessageRefused     = 424 // The recipient won't take this message (daily limit); not retried
 	ErrCodeInternalError      = 500
 )
 
 // DHTMessage is the unified message format for all DHT operations
 type DHTMessage struct {
-	Type         string       `json:"type"`                    // "ping", "find_node", "announce"
+	Type         string       `json:"type"`                    // "ping", "find_node", "announce", "supersede", "transfer_announce", "peer_unreachable", "info_relay", "relayed_ping", "service_receipt", "message"
 	Version      string       `json:"version"`                 // Protocol version (e.g., "1.0.0")
-	FromSystem   *System      `json:"from_system"`             // Sender's full system info (always included)
-	TargetID     *uuid.UUID   `json:"target_id,omitempty"`     // For find_node: the ID we're looking for
+	Capabilities []string     `json:"capabilities,omitempty"`  // Optional features the sender supports (see capabilities.go)
+	MaxMessageBytes int       `json:"max_message_bytes,omitempty"` // The largest DHT message body the sender takes (absent: DefaultMaxMessageBytes)
+	FromSystem   *System      `json:"from_system"`             // Sender's full system info (always included; Keys never serialize, the attestation carries the public key)
+	TargetID     *uuid.UUID   `json:"target_id,omitempty"`     // For find_node: the ID we're looking for; for relayed_ping: the system to ping
 	ClosestNodes []*System    `json:"closest_nodes,omitempty"` // For find_node response: K closest nodes
+	Supersede    *SupersedeClaim `json:"supersede,omitempty"`   // For supersede request: the identity being replaced
+	Transfer     *CreditTransfer `json:"transfer,omitempty"`    // For transfer_announce request: a transfer someone accepted (no proof)
+	Unreachable  *UnreachableClaim `json:"unreachable,omitempty"` // For peer_unreachable request: a signed claim that a system stopped answering
+	Hops         int          `json:"hops,omitempty"`          // For transfer_announce and peer_unreachable requests: how many times it has been relayed
+	AtCapacity   bool         `json:"at_capacity,omitempty"`   // For announce response: we're full, try Alternatives instead
+	Alternatives []*System    `json:"alternatives,omitempty"`  // For at-capacity announce response: least-loaded peers to announce to
+	AckedVersion int64        `json:"acked_version,omitempty"` // For announce response: the requester's InfoVersion we now hold (ours is in FromSystem)
+	RankClaim    *RankClaim   `json:"rank_claim,omitempty"`    // For announce request and response: the sender's credit rank, unless it keeps it private
+	RankProof    *CreditProof `json:"rank_proof,omitempty"`    // For rank_proof response: attestations covering the sender's rank
+	KeyRotations []*KeyRotation `json:"key_rotations,omitempty"` // For key_rotation request, and announces for a while after: the sender's key rotations, oldest first
+	RelayInfo    bool         `json:"relay_info,omitempty"`    // For announce request: the sender's address changed, pass its info on to your peers
+	Relayed      *System      `json:"relayed,omitempty"`       // For info_relay request: another system's signed info after it moved; for relayed_ping response: the target's, as it answered
+	RelayError   string       `json:"relay_error,omitempty"`   // For relayed_ping response: why the target wasn't reached
+	PingBack     string       `json:"ping_back,omitempty"`     // For relayed_ping request targeting the sender: a new address to reach it at (see address.go)
+	Message      *SealedMessage `json:"message,omitempty"`     // For message request: text sealed to the recipient (see messages.go)
 	Attestation  *Attestation `json:"attestation"`             // Cryptographic proof (required)
 	Timestamp    time.Time    `json:"timestamp"`
 	IsResponse   bool         `json:"is_response"`          // True if this is a response to a request
 	RequestID    string       `json:"request_id,omitempty"` // Correlates requests with responses
+	ObservedAddr string       `json:"observed_addr,omitempty"` // In responses: requester's source IP as seen by responder
+
+	sourceIP string // For received requests: the IP the request came from (never sent)
 }
 
 // DHTError represents an error response
@@ -102,6 +165,7 @@ func NewPingRequest(fromSystem *System, toSystemID uuid.UUID, requestID string)
 	return &DHTMessage{
 		Type:        MessageTypePing,
 		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
 		FromSystem:  fromSystem,
 		Attestation: attestation,
 		Timestamp:   time.Now(),
@@ -128,6 +192,7 @@ func NewPingResponse(fromSystem *System, toSystemID uuid.UUID, requestID string)
 	return &DHTMessage{
 		Type:        MessageTypePing,
 		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
 		FromSystem:  fromSystem,
 		Attestation: attestation,
 		Timestamp:   time.Now(),
@@ -154,6 +219,7 @@ func NewFindNodeRequest(fromSystem *System, toSystemID uuid.UUID, targetID uuid.
 	return &DHTMessage{
 		Type:        MessageTypeFindNode,
 		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
 		FromSystem:  fromSystem,
 		TargetID:    &targetID,
 		Attestation: attestation,
@@ -181,6 +247,7 @@ func NewFindNodeResponse(fromSystem *System, toSystemID uuid.UUID, closestNodes
 	return &DHTMessage{
 		Type:         MessageTypeFindNode,
 		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
 		FromSystem:   fromSystem,
 		ClosestNodes: closestNodes,
 		Attestation:  attestation,
@@ -208,6 +275,7 @@ func NewAnnounceRequest(fromSystem *System, toSystemID uuid.UUID, requestID stri
 	return &DHTMessage{
 		Type:        MessageTypeAnnounce,
 		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
 		FromSystem:  fromSystem,
 		Attestation: attestation,
 		Timestamp:   time.Now(),
@@ -234,6 +302,188 @@ func NewAnnounceResponse(fromSystem *System, toSystemID uuid.UUID, requestID str
 	return &DHTMessage{
 		Type:        MessageTypeAnnounce,
 		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:  fromSystem,
+		Attestation: attestation,
+		Timestamp:   time.Now(),
+		IsResponse:  true,
+		RequestID:   requestID,
+	}, nil
+}
+
+// NewAnnounceAtCapacityResponse turns an announce away because our routing table is full
+// Older nodes ignore the extra fields and read it as an ordinary acceptance
+func NewAnnounceAtCapacityResponse(fromSystem *System, toSystemID uuid.UUID, alternatives []*System, requestID string) (*DHTMessage, error) {
+	msg, err := NewAnnounceResponse(fromSystem, toSystemID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	msg.AtCapacity = true
+	msg.Alternatives = alternatives
+	return msg, nil
+}
+
+// NewSupersedeRequest creates a supersede request (sender replaces an older identity)
+// toSystemID should be the recipient's UUID if known, or uuid.Nil for first contact
+func NewSupersedeRequest(fromSystem *System, toSystemID uuid.UUID, claim *SupersedeClaim, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_supersede",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:        MessageTypeSupersede,
+		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:  fromSystem,
+		Supersede:   claim,
+		Attestation: attestation,
+		Timestamp:   time.Now(),
+		IsResponse:  false,
+		RequestID:   requestID,
+	}, nil
+}
+
+// NewSupersedeResponse creates a supersede response
+// toSystemID should be the original requester's UUID
+func NewSupersedeResponse(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_supersede_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:        MessageTypeSupersede,
+		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:  fromSystem,
+		Attestation: attestation,
+		Timestamp:   time.Now(),
+		IsResponse:  true,
+		RequestID:   requestID,
+	}, nil
+}
+
+// NewKeyRotationRequest creates a key_rotation request carrying the sender's rotation chain
+// toSystemID should be the recipient's UUID if known, or uuid.Nil for first contact
+func NewKeyRotationRequest(fromSystem *System, toSystemID uuid.UUID, chain []*KeyRotation, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_key_rotation",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeKeyRotation,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		KeyRotations: chain,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   false,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewKeyRotationResponse creates a key_rotation response
+// toSystemID should be the original requester's UUID
+func NewKeyRotationResponse(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_key_rotation_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeKeyRotation,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   true,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewTransferAnnounceRequest creates a transfer_announce request
+// The transfer is sent without its proof; only the signed transfer matters for double-spend checks
+func NewTransferAnnounceRequest(fromSystem *System, toSystemID uuid.UUID, transfer *CreditTransfer, hops int, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_transfer_announce",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	announced := *transfer
+	announced.Proof = nil
+
+	return &DHTMessage{
+		Type:        MessageTypeTransferAnnounce,
+		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:  fromSystem,
+		Transfer:    &announced,
+		Hops:        hops,
+		Attestation: attestation,
+		Timestamp:   time.Now(),
+		IsResponse:  false,
+		RequestID:   requestID,
+	}, nil
+}
+
+// NewTransferAnnounceResponse creates a transfer_announce response
+// toSystemID should be the original requester's UUID
+func NewTransferAnnounceResponse(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_transfer_announce_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:        MessageTypeTransferAnnounce,
+		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
 		FromSystem:  fromSystem,
 		Attestation: attestation,
 		Timestamp:   time.Now(),
@@ -242,6 +492,334 @@ func NewAnnounceResponse(fromSystem *System, toSystemID uuid.UUID, requestID str
 	}, nil
 }
 
+// NewPeerUnreachableRequest creates a peer_unreachable request
+func NewPeerUnreachableRequest(fromSystem *System, toSystemID uuid.UUID, claim *UnreachableClaim, hops int, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_peer_unreachable",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:        MessageTypePeerUnreachable,
+		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:  fromSystem,
+		Unreachable: claim,
+		Hops:        hops,
+		Attestation: attestation,
+		Timestamp:   time.Now(),
+		IsResponse:  false,
+		RequestID:   requestID,
+	}, nil
+}
+
+// NewPeerUnreachableResponse creates a peer_unreachable response
+// toSystemID should be the original requester's UUID
+func NewPeerUnreachableResponse(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_peer_unreachable_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:        MessageTypePeerUnreachable,
+		Version:     CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:  fromSystem,
+		Attestation: attestation,
+		Timestamp:   time.Now(),
+		IsResponse:  true,
+		RequestID:   requestID,
+	}, nil
+}
+
+// NewInfoRelayRequest creates an info_relay request passing on another system's info
+func NewInfoRelayRequest(fromSystem *System, toSystemID uuid.UUID, relayed *System, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_info_relay",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeInfoRelay,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Relayed:      relayed,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   false,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewInfoRelayResponse creates an info_relay response
+// toSystemID should be the original requester's UUID
+func NewInfoRelayResponse(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_info_relay_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeInfoRelay,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   true,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewRelayedPingRequest asks a peer to ping a system we can't reach (see partition.go)
+func NewRelayedPingRequest(fromSystem *System, toSystemID uuid.UUID, targetID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_relayed_ping",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeRelayedPing,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		TargetID:     &targetID,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   false,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewRelayedPingResponse creates a relayed_ping response: the target's info if it answered,
+// otherwise why not
+// toSystemID should be the original requester's UUID
+func NewRelayedPingResponse(fromSystem *System, toSystemID uuid.UUID, reached *System, relayErr string, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_relayed_ping_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeRelayedPing,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Relayed:      reached,
+		RelayError:   relayErr,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   true,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewServiceReceiptRequest creates a service_receipt request: the attestation itself is
+// the receipt, of type served (see service_receipts.go), for the server toSystemID
+func NewServiceReceiptRequest(fromSystem *System, toSystemID uuid.UUID, served string, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		served,
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeServiceReceipt,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   false,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewServiceReceiptResponse creates a service_receipt response
+// toSystemID should be the original requester's UUID
+func NewServiceReceiptResponse(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_service_receipt_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeServiceReceipt,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   true,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewMessageRequest creates a message request carrying sealed text for toSystemID
+func NewMessageRequest(fromSystem *System, toSystemID uuid.UUID, sealed *SealedMessage, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		AttestationMessage,
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeMessage,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Message:      sealed,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   false,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewMessageResponse acknowledges a message
+// toSystemID should be the original requester's UUID
+func NewMessageResponse(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_message_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeMessage,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   true,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewRankProofRequest asks a system to prove the credit rank it claims
+func NewRankProofRequest(fromSystem *System, toSystemID uuid.UUID, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_rank_proof",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeRankProof,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   false,
+		RequestID:    requestID,
+	}, nil
+}
+
+// NewRankProofResponse answers a rank_proof request with the proof behind our claim
+// toSystemID should be the original requester's UUID
+func NewRankProofResponse(fromSystem *System, toSystemID uuid.UUID, proof *CreditProof, requestID string) (*DHTMessage, error) {
+	if fromSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	attestation := SignAttestation(
+		fromSystem.ID,
+		toSystemID,
+		"dht_rank_proof_response",
+		fromSystem.Keys.PrivateKey,
+		fromSystem.Keys.PublicKey,
+	)
+
+	return &DHTMessage{
+		Type:         MessageTypeRankProof,
+		Version:      CurrentProtocolVersion.String(),
+		Capabilities: LocalCapabilities.Names(),
+		FromSystem:   fromSystem,
+		RankProof:    proof,
+		Attestation:  attestation,
+		Timestamp:    time.Now(),
+		IsResponse:   true,
+		RequestID:    requestID,
+	}, nil
+}
+
 // Validate checks if a DHT message is valid
 func (msg *DHTMessage) Validate() error {
 	if msg.FromSystem == nil {
@@ -252,7 +830,7 @@ func (msg *DHTMessage) Validate() error {
 		return &DHTError{Code: ErrCodeMissingAttestation, Message: "missing attestation"}
 	}
 
-	if !msg.Attestation.Verify() {
+	if !msg.Attestation.VerifyCached() {
 		return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid attestation signature"}
 	}
 
@@ -260,17 +838,56 @@ func (msg *DHTMessage) Validate() error {
 		return &DHTError{Code: ErrCodeInvalidAttestation, Message: "attestation sender mismatch"}
 	}
 
-	if !msg.Attestation.IsTimestampValid(5 * time.Minute) {
+	if n := msg.Attestation.Nonce; n != "" {
+		if _, err := hex.DecodeString(n); err != nil || len(n) != AttestationNonceLength {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid attestation nonce"}
+		}
+	}
+
+	// Receipts only travel as service_receipt requests, which say what they're for
+	if isServiceReceipt(msg.Attestation.MessageType) && (msg.Type != MessageTypeServiceReceipt || msg.IsResponse) {
+		return &DHTError{Code: ErrCodeInvalidAttestation, Message: "service receipt outside a service_receipt request"}
+	}
+
+	// The hard cap; the receiving DHT then checks it against the sender's usual skew
+	if !msg.Attestation.IsTimestampValid(MaxClockSkew) {
 		return &DHTError{Code: ErrCodeInvalidAttestation, Message: "attestation timestamp out of range"}
 	}
 
-	if len(msg.FromSystem.Name) > 64 {
-		return &DHTError{Code: ErrCodeInvalidMessage, Message: "system name too long"}
+	// Senders must fix their own name; systems only relayed to us get quarantined instead (see cacheSystem)
+	if err := checkSystemFields(msg.FromSystem); err != nil {
+		return &DHTError{Code: ErrCodeInvalidMessage, Message: "invalid system info: " + strings.ReplaceAll(err.Error(), "\n", "; ")}
 	}
 
 	// Verify star configuration matches what the UUID should produce
 	if !ValidateStarSystem(msg.FromSystem) {
-		return &DHTError{Code: ErrCodeInvalidMessage, Message: "star system configuration invalid for UUID"}
+		return &DHTError{Code: ErrCodeInvalidMessage, Message: describeStarsMismatch(msg.FromSystem)}
+	}
+
+	// Sender's own info must be signed by the attested key (legacy senders may omit it)
+	if msg.FromSystem.InfoSignature != "" {
+		if !msg.FromSystem.VerifyInfo(msg.Attestation.PublicKey) {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid system info signature"}
+		}
+	} else if requiresSignedInfo(msg) {
+		return &DHTError{Code: ErrCodeInvalidAttestation, Message: "missing system info signature"}
+	}
+
+	// Key rotations must be the sender's own, in order, each signed by the key before it,
+	// and end at the key it signs with now (or, revoked, the key it signs with last)
+	if n := len(msg.KeyRotations); n > 0 {
+		if n > MaxKeyRotations {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "too many key rotations"}
+		}
+		first := msg.KeyRotations[0]
+		key, _, err := followKeyChain(msg.FromSystem.ID, first.OldPublicKey, first.Sequence-1, msg.KeyRotations)
+		if err != nil {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid key rotation chain: " + err.Error()}
+		}
+		last := msg.KeyRotations[n-1]
+		if key != msg.Attestation.PublicKey && !(last.Revoked && last.OldPublicKey == msg.Attestation.PublicKey) {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "key rotation chain doesn't end at the sender's key"}
+		}
 	}
 
 	switch msg.Type {
@@ -281,7 +898,125 @@ func (msg *DHTMessage) Validate() error {
 			return &DHTError{Code: ErrCodeInvalidMessage, Message: "find_node request requires target_id"}
 		}
 	case MessageTypeAnnounce:
-		// No additional validation needed
+		if len(msg.Alternatives) > MaxCapacityAlternatives {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "too many alternatives"}
+		}
+		if msg.RankClaim != nil {
+			if err := msg.RankClaim.Verify(msg.FromSystem.ID, msg.Attestation.PublicKey); err != nil {
+				return err
+			}
+		}
+	case MessageTypeRankProof:
+		if msg.IsResponse && msg.RankProof == nil {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "rank_proof response requires rank_proof"}
+		}
+	case MessageTypeSupersede:
+		if msg.IsResponse {
+			break
+		}
+		claim := msg.Supersede
+		if claim == nil {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "supersede request requires supersede claim"}
+		}
+		// The claim must come from the new identity itself, signed with its attested key
+		if claim.NewID != msg.FromSystem.ID || claim.NewPublicKey != msg.Attestation.PublicKey {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "supersede claim sender mismatch"}
+		}
+		if claim.OldID == claim.NewID {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "supersede claim replaces itself"}
+		}
+		if !claim.VerifyNew() {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid supersede claim signature"}
+		}
+	case MessageTypeKeyRotation:
+		if !msg.IsResponse && len(msg.KeyRotations) == 0 {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "key_rotation request requires key_rotations"}
+		}
+	case MessageTypeTransferAnnounce:
+		if msg.IsResponse {
+			break
+		}
+		if msg.Transfer == nil {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "transfer_announce request requires transfer"}
+		}
+		if msg.Hops < 1 || msg.Hops > MaxTransferGossipHops {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "transfer_announce hop count out of range"}
+		}
+		if msg.Transfer.Amount <= 0 || !msg.Transfer.Verify() {
+			return &DHTError{Code: ErrCodeInvalidTransfer, Message: "invalid transfer signature"}
+		}
+	case MessageTypePeerUnreachable:
+		if msg.IsResponse {
+			break
+		}
+		claim := msg.Unreachable
+		if claim == nil {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "peer_unreachable request requires unreachable claim"}
+		}
+		if msg.Hops < 1 || msg.Hops > MaxRetractionHops {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "peer_unreachable hop count out of range"}
+		}
+		// A first-hand claim must come from the claimer itself, signed with its attested key
+		if msg.Hops == 1 && (claim.ClaimerID != msg.FromSystem.ID || claim.PublicKey != msg.Attestation.PublicKey) {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "peer_unreachable claim sender mismatch"}
+		}
+		if claim.TargetID == claim.ClaimerID || len(claim.Attempts) == 0 || len(claim.Attempts) > MaxFailCount {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "malformed peer_unreachable claim"}
+		}
+		if !claim.Verify() {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid peer_unreachable claim signature"}
+		}
+	case MessageTypeInfoRelay:
+		if msg.IsResponse {
+			break
+		}
+		if msg.Relayed == nil || msg.Relayed.ID == uuid.Nil {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "info_relay request requires relayed system"}
+		}
+		if msg.Relayed.ID == msg.FromSystem.ID {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "info_relay relays the sender's own info"}
+		}
+		// Only signed info is passed on; the signature is checked against the owner's key on caching
+		if msg.Relayed.InfoSignature == "" {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "info_relay requires signed info"}
+		}
+	case MessageTypeServiceReceipt:
+		if msg.IsResponse {
+			break
+		}
+		if !isServiceReceipt(msg.Attestation.MessageType) {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "service_receipt request requires a receipt attestation"}
+		}
+		if msg.Attestation.ToSystemID == uuid.Nil {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "service receipt names no server"}
+		}
+	case MessageTypeRelayedPing:
+		if msg.IsResponse {
+			// A reached target's info is cached like any gossip, so it must be signed too
+			if msg.Relayed != nil && msg.Relayed.InfoSignature == "" {
+				return &DHTError{Code: ErrCodeInvalidAttestation, Message: "relayed_ping requires signed info"}
+			}
+			break
+		}
+		if msg.TargetID == nil || *msg.TargetID == uuid.Nil {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "relayed_ping request requires target_id"}
+		}
+		if (*msg.TargetID == msg.FromSystem.ID) != (msg.PingBack != "") {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "relayed_ping targets the sender without ping_back, or another system with it"}
+		}
+	case MessageTypeMessage:
+		if msg.IsResponse {
+			break
+		}
+		if msg.Message == nil || msg.Message.ID == uuid.Nil || msg.Message.Sealed == "" {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "message request requires message"}
+		}
+		if len(msg.Message.Sealed) > MaxSealedMessageLength {
+			return &DHTError{Code: ErrCodeInvalidMessage, Message: "message too long"}
+		}
+		if msg.Attestation.ToSystemID == uuid.Nil {
+			return &DHTError{Code: ErrCodeInvalidAttestation, Message: "message names no recipient"}
+		}
 	default:
 		return &DHTError{Code: ErrCodeInvalidMessage, Message: "unknown message type: " + msg.Type}
 	}
@@ -302,6 +1037,31 @@ type LookupResult struct {
 	Found        *System // Non-nil if exact target was found
 	Hops         int
 	Duration     time.Duration
+	TimedOut     int  // Queries given up on after LookupQueryTimeout
+	DeadlineHit  bool // Stopped at the lookup deadline; ClosestNodes is the best found by then
+	Queries      []*LookupQuery // Every peer asked, in the order asked
+}
+
+// Outcomes of one lookup query
+const (
+	QueryAnswered  = "answered"
+	QueryTimedOut  = "timed_out"  // No answer within LookupQueryTimeout
+	QueryFailed    = "failed"     // Unreachable or a bad answer; counts towards its failures
+	QueryRejected  = "rejected"   // The peer answered with a protocol error
+	QueryHeldBack  = "held_back"  // Not sent: the bandwidth budget ran low
+	QueryAbandoned = "abandoned"  // Still in flight when the lookup ended
+)
+
+// LookupQuery is one peer a lookup asked and how that went
+type LookupQuery struct {
+	System   *System
+	Hop      int
+	Outcome  string
+	Returned int // Systems in its answer
+	Duration time.Duration
+	Err      error
+
+	started time.Time
 }
 
 // DHT is the main coordinator for distributed hash table operations
@@ -313,16 +1073,128 @@ type DHT struct {
 	listenAddr   string
 
 	// Pending requests awaiting responses
-	pendingRequests map[string]chan *DHTMessage
-	pendingMu       sync.RWMutex
+	pendingRequests  map[string]*pendingRequest
+	pendingMu        sync.RWMutex
+	lastPendingSweep time.Time
+
+	// DHT bytes exchanged per peer since startup
+	traffic *trafficStats
+
+	// Messages exchanged per peer by kind, flushed hourly (see peer_traffic.go)
+	messageTraffic *messageTraffic
+
+	// Each peer's clock skew, from its signed timestamps (see clock_skew.go)
+	clockSkews *clockSkews
+
+	// Our own credit rank claim and proof (see leaderboard.go)
+	ranks *rankSharing
+
+	// Table limits and trim results (see retention.go)
+	retention *retention
+
+	// The day's DHT bytes and the budget for them (see bandwidth.go)
+	bandwidth *bandwidthBudget
+
+	// Times this system was started before this run (see process_uptime.go)
+	restartCount int64
+
+	// The seed list Bootstrap was given and the seed it joined through (see seeds.go)
+	seeds *seedSources
 
 	// Inbound connection tracking (for outbound-only detection)
 	startTime           time.Time
 	hasReceivedInbound  bool
+	lastInbound         time.Time
 	inboundMu           sync.RWMutex
 	lastInboundWarning  time.Time
 
+	// Serializes credit balance read-modify-write (hourly calculation vs transfers)
+	creditMu sync.Mutex
+
+	// Public address auto-detection (nil when disabled)
+	addressDetector *AddressDetector
+
+	// UPnP/NAT-PMP forwarding of the DHT port (nil with -no-upnp, see port_mapping.go)
+	portMapping *portMapping
+
+	// Live event listener (see events.go)
+	onEvent EventHandler
+
+	// Scheduled attestation compaction (nil when disabled)
+	compactor *compactor
+
+	// Senders waiting on their sponsor before their coordinates can be checked (see coords.go)
+	coords *coordsVerifier
+
+	// Who has our current info, and announces waiting for their slot (see announce.go)
+	announcer *announcer
+
+	// Systems whose moved info we passed on recently (see address_move.go)
+	infoRelays *infoRelays
+
+	// Relayed pings done for peers that can't reach a system (see partition.go)
+	relayedPings *relayedPings
+
+	// Held while a debug lookup runs, one at a time (see lookup_debug.go)
+	debugLookupMu sync.Mutex
+
+	// When the operator last tried connecting to each system from the map (see peer_connect.go)
+	connectAttempts *connectAttempts
+
+	// Inbound announce rate limit, higher for relays (see star_roles.go)
+	announceLimit rateLimiter
+
+	// Local network peer discovery (nil when -lan-discovery is off)
+	lan *lanDiscovery
+
+	// Received attestations waiting to be written (see attestation_buffer.go)
+	attestations *attestationBuffer
+
+	// Background loop state for /api/tasks (see tasks.go)
+	tasks *taskRegistry
+
+	// What /healthz and /readyz report (see service.go)
+	listening atomic.Bool  // The DHT port is being served
+	readyAt   atomic.Int64 // When bootstrap finished (0 while starting)
+
+	// Most systems accepted from or served in one full-sync
+	maxFullSyncSystems int
+
+	// Largest DHT message body we take, and advertise in every message (see wire.go)
+	maxMessageBytes int
+
+	// How long one FindNode may take in all
+	lookupTimeout time.Duration
+
+	// Share of GetMaxPeers kept for the spatially nearest systems (see local_peers.go)
+	localPeerPercent int
+
+	// The capacity advisor's latest suggestions (see advisor.go)
+	advisor *advisor
+
+	// TLS on the DHT port (nil when -peer-tls is off)
+	peerTLSConfig *tls.Config
+
+	// One pinned client per TLS peer so connections are reused (see peer_tls.go)
+	peerTLSClients sync.Map // uuid.UUID -> *pinnedClient
+
+	// Serializes sponsor assignment while bootstrap peers race (see bootstrap.go)
+	sponsorMu sync.Mutex
+
+	// Local rename rate limiting (see rename.go)
+	renameMu   sync.Mutex
+	lastRename time.Time
+
+	// Guards the local system's signed info while a move or rename changes it at runtime;
+	// held for reading wherever it is sent or copied (see address_move.go)
+	localMu sync.RWMutex
+
+	// Last galaxy snapshot, owned by galaxySnapshotLoop (see galaxy_history.go)
+	lastGalaxy          *galaxyState
+	galaxySinceKeyframe int
+
 	// Shutdown coordination
+	server   *http.Server
 	shutdown chan struct{}
 	wg       sync.WaitGroup
 }
@@ -333,12 +1205,32 @@ func NewDHT(localSystem *System, storage *Storage, listenAddr string) *DHT {
 		localSystem:     localSystem,
 		storage:         storage,
 		listenAddr:      listenAddr,
-		pendingRequests: make(map[string]chan *DHTMessage),
+		pendingRequests: make(map[string]*pendingRequest),
 		shutdown:        make(chan struct{}),
 		startTime:       time.Now(),
-		httpClient: &http.Client{
-			Timeout: RequestTimeout,
-		},
+		maxFullSyncSystems: DefaultMaxFullSyncSystems,
+		maxMessageBytes: DefaultMaxMessageBytes,
+		lookupTimeout:   DefaultLookupTimeout,
+		localPeerPercent: DefaultLocalPeerPercent,
+		coords:          newCoordsVerifier(),
+		attestations:    newAttestationBuffer(),
+		announcer:       newAnnouncer(),
+		infoRelays:      newInfoRelays(),
+		relayedPings:    newRelayedPings(),
+		connectAttempts: newConnectAttempts(),
+		tasks:           newTaskRegistry(),
+		traffic:         newTrafficStats(),
+		messageTraffic:  newMessageTraffic(),
+		clockSkews:      newClockSkews(),
+		ranks:           &rankSharing{},
+		retention:       newRetention(),
+		bandwidth:       newBandwidthBudget(),
+		seeds:           &seedSources{},
+		advisor:         &advisor{},
+	}
+	dht.httpClient = &http.Client{
+		Timeout:   RequestTimeout,
+		Transport: dht.bandwidth.transport(),
 	}
 
 	// Create routing table
@@ -356,36 +1248,109 @@ func (dht *DHT) Start() error {
 		return fmt.Errorf("DHT failed to bind to %s: %w", dht.listenAddr, err)
 	}
 
+	// Count every byte on the port, TLS included
+	dht.restoreBandwidthUsage()
+	listener = dht.bandwidth.listener(listener)
+
+	// A send interrupted by a restart can't be told apart from a delivered one, so it stays
+	// debited until transferRetryLoop hears back from the recipient
+	if n, err := dht.storage.CountPendingCreditTransfers(); err == nil && n > 0 {
+		log.Printf("%d credit transfers were interrupted mid-delivery; they stay debited and are resent", n)
+	}
+
+	if dht.peerTLSConfig != nil {
+		listener = newPeerListener(listener, dht.peerTLSConfig)
+	}
+
 	// Start HTTP server for DHT messages
+	dht.server = &http.Server{Handler: dht.newServeMux()}
 	go dht.serveHTTP(listener)
 
+	// Forward the port before anything is announced, so peers get the mapped address
+	if dht.portMapping != nil {
+		dht.setupPortMapping()
+		dht.wg.Add(1)
+		go dht.portMappingLoop()
+	}
+
 	// Start maintenance loops
-	dht.wg.Add(5)
+	dht.wg.Add(19)
 	go dht.announceLoop()
 	go dht.cacheMaintenanceLoop()
 	go dht.peerLivenessLoop()
 	go dht.gossipValidationLoop()
 	go dht.creditCalculationLoop()
+	go dht.galaxySnapshotLoop()
+	go dht.coordsVerificationLoop()
+	go dht.addressConflictLoop()
+	go dht.rankVerificationLoop()
+	go dht.bandwidthLoop()
+	go dht.genesisLoop()
+	go dht.personalSeedLoop()
+	go dht.partitionLoop()
+	go dht.bucketRefreshLoop()
+	go dht.messageDeliveryLoop()
+	go dht.transferRetryLoop()
+	go dht.localPeerLoop()
+	go dht.advisorLoop()
+	go dht.trafficFlushLoop()
+	if dht.compactor != nil {
+		dht.wg.Add(1)
+		go dht.compactionLoop()
+	}
+	if dht.attestations.interval > 0 {
+		dht.wg.Add(1)
+		go dht.attestationFlushLoop()
+	}
+	if dht.lan != nil {
+		dht.wg.Add(2)
+		go dht.lanListenLoop()
+		go dht.lanPresenceLoop()
+	}
 
 	log.Printf("DHT started for %s (%s)", dht.localSystem.Name, dht.localSystem.ID)
 	return nil
 }
 
 // Stop gracefully shuts down the DHT
-func (dht *DHT) Stop() {
+// In-flight requests get until ctx expires to finish, then maintenance loops
+// are stopped and buffered attestations, peer traffic and the routing table are flushed to storage
+func (dht *DHT) Stop(ctx context.Context) {
+	if dht.server != nil {
+		if err := dht.server.Shutdown(ctx); err != nil {
+			log.Printf("DHT server shutdown: %v", err)
+		}
+	}
+
 	close(dht.shutdown)
 	dht.wg.Wait()
-	log.Printf("DHT stopped")
+	dht.closePortMapping()
+
+	if err := dht.FlushAttestations(); err != nil {
+		log.Printf("Failed to save buffered attestations: %v", err)
+	}
+	if err := dht.saveBandwidthUsage(); err != nil {
+		log.Printf("Failed to save bandwidth usage: %v", err)
+	}
+	dht.flushPeerTraffic()
+	saved := dht.routingTable.SaveSnapshot()
+	log.Printf("DHT stopped (persisted %d peers)", saved)
 }
 
 // markInboundReceived records that we've received an inbound connection
 func (dht *DHT) markInboundReceived() {
 	dht.inboundMu.Lock()
+	first := !dht.hasReceivedInbound
 	dht.hasReceivedInbound = true
+	dht.lastInbound = time.Now()
 	dht.inboundMu.Unlock()
+
+	if first {
+		dht.diagnose(DiagInbound, true, "First inbound request after %v", time.Since(dht.startTime).Round(time.Second))
+	}
 }
 
-// checkInboundStatus logs a warning if no inbound connections after startup period
+// checkInboundStatus warns (in the log and diagnostics) if no inbound connections after startup period
 func (dht *DHT) checkInboundStatus() {
 	dht.inboundMu.RLock()
 	hasInbound := dht.hasReceivedInbound
@@ -397,7 +1362,7 @@ func (dht *DHT) checkInboundStatus() {
 	}
 
 	// Only warn after 10 minutes of uptime
-	if time.Since(dht.startTime) < 10*time.Minute {
+	if time.Since(dht.startTime) < InboundWarningDelay {
 		return
 	}
 
@@ -412,7 +1377,8 @@ func (dht *DHT) checkInboundStatus() {
 
 	log.Printf("WARNING: No inbound connections received after 10 minutes.")
 	log.Printf("  Your node may be in outbound-only mode (can see network but others can't reach you).")
-	log.Printf("  Check that port %s is open and forwarded correctly, as UPnP may have failed.", dht.listenAddr)
+	log.Printf("  Check that port %s is open and forwarded correctly (%s).", dht.listenAddr, dht.portMappingStatus())
+	dht.diagnose(DiagInbound, false, "No inbound requests after %v: %s", time.Since(dht.startTime).Round(time.Minute), dht.portMappingStatus())
 }
 
 // updateRoutingTable adds a node to the peer cache
@@ -424,16 +1390,23 @@ func (dht *DHT) updateRoutingTable(sys *System) {
 	dht.routingTable.Update(sys)
 }
 
-// serveHTTP runs the HTTP server on an existing listener
-func (dht *DHT) serveHTTP(listener net.Listener) {
+// newServeMux registers the DHT protocol handlers
+func (dht *DHT) newServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/dht", dht.handleDHTMessage)
 	mux.HandleFunc("/system", dht.handleSystemInfo)
 	mux.HandleFunc("/api/discovery", dht.handleDiscoveryInfo)
 	mux.HandleFunc("/api/full-sync", dht.handleFullSync)
+	mux.HandleFunc("/api/transfer", dht.handleCreditTransfer)
+	return mux
+}
 
+// serveHTTP runs the HTTP server on an existing listener
+func (dht *DHT) serveHTTP(listener net.Listener) {
 	log.Printf("DHT listening on %s", dht.listenAddr)
-	if err := http.Serve(listener, mux); err != nil {
+	dht.listening.Store(true)
+	defer dht.listening.Store(false)
+	if err := dht.server.Serve(listener); err != nil && err != http.ErrServerClosed {
 		log.Printf("DHT server error: %v", err)
 	}
 }
@@ -445,23 +1418,57 @@ func (dht *DHT) handleDHTMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Limit request body size to 1MB for security
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
-
+	// Count what crosses the wire (compressed sizes) once we know who sent it
+	// rejected marks a message refused for failing validation, identified one whose sender's
+	// identity checked out; until then its counts go under the remote IP (see peer_traffic.go)
 	var msg DHTMessage
-	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+	rejected, identified := false, false
+	received := &countingReader{r: http.MaxBytesReader(w, r.Body, int64(dht.maxMessageBytes))}
+	sent := &countingResponseWriter{ResponseWriter: w}
+	w = sent
+	defer func() {
+		if msg.FromSystem != nil {
+			dht.traffic.record(msg.FromSystem.ID, sent.n, received.n)
+		}
+		peer := observedRemoteIP(r)
+		if identified {
+			peer = msg.FromSystem.ID.String()
+		}
+		if peer != "" {
+			dht.messageTraffic.inbound(peer, &msg, received.n, sent.n, sent.status >= http.StatusBadRequest, rejected)
+		}
+	}()
+
+	// Limit request body size (1MB by default) for security, after decompression
+	body, err := readDHTBody(received, r.Header.Get("Content-Encoding"), dht.maxMessageBytes)
+	if err != nil {
+		rejected = true
+		dht.sendError(w, ErrCodeInvalidMessage, "invalid body: "+err.Error())
+		return
+	}
+	if err := json.Unmarshal(body, &msg); err != nil {
+		rejected = true
 		dht.sendError(w, ErrCodeInvalidMessage, "invalid JSON: "+err.Error())
 		return
 	}
+	msg.sourceIP = observedRemoteIP(r)
 
 	// Reject messages claiming our own UUID (impersonation attempt)
 	if msg.FromSystem != nil && msg.FromSystem.ID == dht.localSystem.ID {
+		rejected = true
 		dht.sendError(w, ErrCodeInvalidMessage, "cannot impersonate local system")
 		return
 	}
 
+	// Refuse blocked systems outright so they know to stop retrying
+	if msg.FromSystem != nil && dht.routingTable.IsBlocked(msg.FromSystem.ID) {
+		dht.sendError(w, ErrCodeBlocked, "system is blocked by this node")
+		return
+	}
+
 	// Validate message
 	if err := msg.Validate(); err != nil {
+		rejected = true
 		if dhtErr, ok := err.(*DHTError); ok {
 			dht.sendError(w, dhtErr.Code, dhtErr.Message)
 		} else {
@@ -471,15 +1478,16 @@ func (dht *DHT) handleDHTMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate identity binding (UUID must always map to same public key)
-	if msg.FromSystem != nil && msg.FromSystem.Keys != nil {
-		pubKeyStr := base64.StdEncoding.EncodeToString(msg.FromSystem.Keys.PublicKey)
-		valid, isNew, err := dht.storage.ValidateIdentityBinding(msg.FromSystem.ID, pubKeyStr)
+	// Keys are never serialized, so the attested key is what identifies the sender
+	if msg.FromSystem != nil {
+		valid, isNew, err := dht.storage.ValidateIdentityBinding(msg.FromSystem.ID, msg.Attestation.PublicKey, msg.KeyRotations)
 		if err != nil {
 			log.Printf("Identity binding check failed: %v", err)
 			dht.sendError(w, ErrCodeInternalError, "identity validation error")
 			return
 		}
 		if !valid {
+			rejected = true
 			log.Printf("UUID spoofing attempt detected: %s", msg.FromSystem.ID)
 			dht.sendError(w, ErrCodeInvalidMessage, "identity mismatch: UUID bound to different key")
 			return
@@ -487,42 +1495,64 @@ func (dht *DHT) handleDHTMessage(w http.ResponseWriter, r *http.Request) {
 		if isNew {
 			log.Printf("New identity bound: %s", msg.FromSystem.ID)
 		}
+		identified = true
 	}
 
-	// Validate coordinates match expected position based on UUID + Sponsor
-	lookupSponsor := func(sponsorID uuid.UUID) *System {
-		// Check routing table cache first
-		if cached := dht.routingTable.GetCachedSystem(sponsorID); cached != nil {
-			return cached
-		}
-		// Try storage
-		if stored, err := dht.storage.GetPeerSystem(sponsorID); err == nil {
-			return stored
+	// A response is only taken from the peer its request went to, before it can
+	// touch the routing table or attestations
+	var pending *pendingRequest
+	if msg.IsResponse {
+		var matchErr error
+		if pending, matchErr = dht.matchResponse(&msg, observedRemoteIP(r)); matchErr != nil {
+			rejected = true
+			dht.sendError(w, ErrCodeInvalidMessage, "unexpected response: "+matchErr.Error())
+			return
 		}
-		return nil
 	}
-	if !ValidateCoordinates(msg.FromSystem, lookupSponsor) {
-		dht.sendError(w, ErrCodeInvalidMessage, "coordinates invalid for UUID and sponsor")
+
+	// The sender's timestamp must agree with its clock's usual skew
+	var sentAt time.Time
+	if pending != nil {
+		sentAt = pending.sentAt
+	}
+	if err := dht.checkClockSkew(&msg, sentAt); err != nil {
+		rejected = true
+		dht.sendError(w, ErrCodeInvalidAttestation, err.Error())
+		return
+	}
+
+	// Validate coordinates match expected position based on UUID + Sponsor
+	// An unknown sponsor doesn't reject the sender - the check is deferred until we find it
+	coordsStatus, coordsReason := CheckCoordinates(msg.FromSystem, dht.lookupSponsor)
+	if coordsStatus == CoordsInvalid {
+		rejected = true
+		dht.resolveCoords(msg.FromSystem, CoordsInvalid, coordsReason)
+		dht.sendError(w, ErrCodeInvalidMessage, "coordinates invalid for UUID and sponsor: "+coordsReason)
 		return
 	}
 
 	// Store attestation with our local ID as the receiver
 	// Note: We pass our ID separately to preserve the original signed attestation
 	// The attestation's ToSystemID (uuid.Nil) stays unchanged so signature remains valid
-	if err := dht.storage.SaveAttestation(msg.Attestation, dht.localSystem.ID); err != nil {
-		log.Printf("Failed to save attestation: %v", err)
-	}
+	// Buffered and written in batches to spare the disk one transaction per message
+	dht.saveAttestation(msg.Attestation)
 
 	// Update routing table with sender's info (proper Kademlia LRS-ping if bucket full)
 	dht.updateRoutingTable(msg.FromSystem)
+	dht.routingTable.RecordTransport(msg.FromSystem.ID, requestTransport(r))
+	dht.recordCapabilities(&msg)
+	if coordsStatus == CoordsUnverified {
+		dht.deferCoordsValidation(msg.FromSystem)
+	} else {
+		dht.resolveCoords(msg.FromSystem, coordsStatus, coordsReason)
+	}
 
 	// Handle based on message type
 	var response *DHTMessage
-	var err error
 
 	if msg.IsResponse {
 		// This is a response to one of our requests
-		dht.handleResponse(&msg)
+		dht.handleResponse(pending, &msg)
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -537,19 +1567,67 @@ func (dht *DHT) handleDHTMessage(w http.ResponseWriter, r *http.Request) {
 		response, err = dht.handleFindNode(&msg)
 	case MessageTypeAnnounce:
 		response, err = dht.handleAnnounce(&msg)
+	case MessageTypeSupersede:
+		response, err = dht.handleSupersede(&msg)
+	case MessageTypeTransferAnnounce:
+		response, err = dht.handleTransferAnnounce(&msg)
+	case MessageTypePeerUnreachable:
+		response, err = dht.handlePeerUnreachable(&msg)
+	case MessageTypeRankProof:
+		response, err = dht.handleRankProof(&msg)
+	case MessageTypeKeyRotation:
+		response, err = dht.handleKeyRotation(&msg)
+	case MessageTypeInfoRelay:
+		response, err = dht.handleInfoRelay(&msg)
+	case MessageTypeRelayedPing:
+		response, err = dht.handleRelayedPing(&msg)
+	case MessageTypeServiceReceipt:
+		response, err = dht.handleServiceReceipt(&msg)
+	case MessageTypeMessage:
+		response, err = dht.handleMessage(&msg)
 	default:
 		dht.sendError(w, ErrCodeInvalidMessage, "unknown message type")
 		return
 	}
 
 	if err != nil {
-		dht.sendError(w, ErrCodeInternalError, err.Error())
+		code := ErrCodeInternalError
+		var dhtErr *DHTError
+		if errors.As(err, &dhtErr) {
+			code = dhtErr.Code
+		}
+		dht.sendError(w, code, err.Error())
 		return
 	}
 
-	// Send response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	// Tell the requester which IP we saw them connect from
+	response.ObservedAddr = observedRemoteIP(r)
+
+	// A requester that checks nonces gets one in our attestation
+	if response.Attestation != nil && msg.PeerCapabilities().Has(CapAttestationNonce) {
+		response.Attestation = dht.withNonce(response.Attestation)
+	}
+
+	// Send response, if it's within what the requester takes
+	response.MaxMessageBytes = dht.maxMessageBytes
+	limit := msg.MaxMessageBytes
+	if limit == 0 {
+		limit = DefaultMaxMessageBytes
+	}
+	dht.localMu.RLock()
+	sentVersion := response.FromSystem.InfoVersion
+	data, gzipped, err := encodeDHTBody(response, acceptsGzip(r), limit)
+	dht.localMu.RUnlock()
+	if err == nil {
+		err = writeDHTBody(w, data, gzipped)
+	}
+	if err == nil {
+		// The response carries our info, so the requester now has it
+		dht.announcer.recordDelivered(msg.FromSystem.ID, sentVersion)
+	} else if errors.Is(err, ErrMessageTooLarge) {
+		log.Printf("Not answering %s from %s: %v", msg.Type, msg.FromSystem.Name, err)
+		dht.sendError(w, ErrCodeInternalError, err.Error())
+	}
 }
 
 // handlePing processes a ping request
@@ -557,7 +1635,10 @@ func (dht *DHT) handlePing(msg *DHTMessage) (*DHTMessage, error) {
 	log.Printf("PING from %s (%s) [v%s]", msg.FromSystem.Name, msg.FromSystem.ID, msg.Version)
 
 	// Mark the sender as verified since they successfully contacted us
-	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	// (unless we're full - newcomers only join through an accepted announce)
+	if dht.hasCapacityFor(msg.FromSystem) {
+		dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	}
 
 	// Check if sender is using old protocol (no targeted attestation)
 	dht.warnIfOldProtocol(msg)
@@ -572,13 +1653,26 @@ func (dht *DHT) handleFindNode(msg *DHTMessage) (*DHTMessage, error) {
 	}
 
 	// Mark the sender as verified since they successfully contacted us
-	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	// (unless we're full - newcomers only join through an accepted announce)
+	if dht.hasCapacityFor(msg.FromSystem) {
+		dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	}
 
 	// Only log FIND_NODE at debug level (commented out to reduce noise)
 	// log.Printf("FIND_NODE for %s from %s", msg.TargetID.String()[:8], msg.FromSystem.Name)
 
-	// Get K closest nodes to the target
-	closest := dht.routingTable.GetClosest(*msg.TargetID, K)
+	// Get K closest nodes to the target, leaving out degraded peers and systems whose coordinates
+	// are still unchecked (fewer when the bandwidth budget is running low)
+	k := K
+	if dht.budgetStage() >= BudgetSmallReplies {
+		k = BudgetFindNodeResults
+	}
+	var closest []*System
+	for _, sys := range dht.routingTable.GetClosestActive(*msg.TargetID, k) {
+		if dht.shareable(sys) {
+			closest = append(closest, sys)
+		}
+	}
 
 	// Include ourselves if we're close enough
 	selfIncluded := false
@@ -590,7 +1684,7 @@ func (dht *DHT) handleFindNode(msg *DHTMessage) (*DHTMessage, error) {
 	}
 
 	// Add self if we're one of the K closest and not already included
-	if !selfIncluded && len(closest) < K {
+	if !selfIncluded && len(closest) < k {
 		closest = append(closest, dht.localSystem)
 	}
 
@@ -601,31 +1695,64 @@ func (dht *DHT) handleFindNode(msg *DHTMessage) (*DHTMessage, error) {
 func (dht *DHT) handleAnnounce(msg *DHTMessage) (*DHTMessage, error) {
 	log.Printf("ANNOUNCE from %s (%s) [v%s]", msg.FromSystem.Name, msg.FromSystem.ID, msg.Version)
 
+	if !dht.announceLimit.allow(dht.localSystem.AnnounceRateLimit()) {
+		log.Printf("  Announce rate limit (%d/min) reached, turning %s away", dht.localSystem.AnnounceRateLimit(), msg.FromSystem.Name)
+		return nil, &DHTError{Code: ErrCodeRateLimited, Message: "announce rate limit reached, try again later"}
+	}
+
+	// Full: point newcomers at our least-loaded peers instead of taking them on
+	if !dht.hasCapacityFor(msg.FromSystem) {
+		alternatives := dht.capacityAlternatives(msg.FromSystem.ID)
+		log.Printf("  At capacity (%d/%d peers), redirecting %s to %d alternatives",
+			dht.routingTable.GetRoutingTableSize(), dht.localSystem.GetMaxPeers(), msg.FromSystem.Name, len(alternatives))
+		resp, err := NewAnnounceAtCapacityResponse(dht.localSystem, msg.FromSystem.ID, alternatives, msg.RequestID)
+		if err != nil {
+			return nil, err
+		}
+		resp.AckedVersion = dht.cachedInfoVersion(msg.FromSystem.ID)
+		dht.attachRankClaim(resp)
+		return resp, nil
+	}
+
 	// Mark the sender as verified since they successfully contacted us
 	dht.routingTable.MarkVerified(msg.FromSystem.ID)
 
 	// Cache the announcing system (already done in handleDHTMessage via Update)
 	// Mark as verified since they're actively announcing
 	dht.routingTable.CacheSystem(msg.FromSystem, msg.FromSystem.ID, true)
+	dht.recordRankClaim(msg)
+
+	// It moved and asked us to tell our peers (see address_move.go)
+	if msg.RelayInfo {
+		go dht.relayMovedInfo(msg.FromSystem)
+	}
 
 	// Check if sender is using old protocol (no targeted attestation)
 	dht.warnIfOldProtocol(msg)
 
-	return NewAnnounceResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+	resp, err := NewAnnounceResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	resp.AckedVersion = dht.cachedInfoVersion(msg.FromSystem.ID)
+	dht.attachRankClaim(resp)
+	return resp, nil
 }
 
-// handleResponse processes a response to a pending request
-func (dht *DHT) handleResponse(msg *DHTMessage) {
-	dht.pendingMu.RLock()
-	ch, exists := dht.pendingRequests[msg.RequestID]
-	dht.pendingMu.RUnlock()
+// cachedInfoVersion returns the InfoVersion we hold for a system (0 if not cached)
+func (dht *DHT) cachedInfoVersion(id uuid.UUID) int64 {
+	if cached := dht.routingTable.GetCachedSystem(id); cached != nil {
+		return cached.InfoVersion
+	}
+	return 0
+}
 
-	if exists {
-		select {
-		case ch <- msg:
-		default:
-			// Channel full or closed, ignore
-		}
+// handleResponse delivers a response to the pending request matchResponse found for it
+func (dht *DHT) handleResponse(p *pendingRequest, msg *DHTMessage) {
+	select {
+	case p.ch <- msg:
+	default:
+		// Channel full or closed, ignore
 	}
 }
 
@@ -638,10 +1765,10 @@ func (dht *DHT) sendError(w http.ResponseWriter, code int, message string) {
 	})
 }
 
-// handleSystemInfo returns this node's system info
+// handleSystemInfo returns this node's system info, versioned (see system_info.go)
 func (dht *DHT) handleSystemInfo(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(dht.localSystem)
+	json.NewEncoder(w).Encode(NewSystemInfo(dht.GetLocalSystem()))
 }
 
 // handleDiscoveryInfo returns discovery info for bootstrapping
@@ -650,49 +1777,58 @@ func (dht *DHT) handleDiscoveryInfo(w http.ResponseWriter, r *http.Request) {
 	seenIDs := make(map[uuid.UUID]bool)
 
 	// Add self
+	self := dht.GetLocalSystem()
 	rtSize := dht.routingTable.GetRoutingTableSize()
-	selfHasCapacity := rtSize < dht.localSystem.GetMaxPeers()
+	selfHasCapacity := rtSize < self.GetMaxPeers()
 
 	systems = append(systems, DiscoverySystem{
-		ID:           dht.localSystem.ID.String(),
-		Name:         dht.localSystem.Name,
-		X:            dht.localSystem.X,
-		Y:            dht.localSystem.Y,
-		Z:            dht.localSystem.Z,
-		PeerAddress:  dht.localSystem.PeerAddress,
+		ID:           self.ID.String(),
+		Name:         self.Name,
+		X:            self.X,
+		Y:            self.Y,
+		Z:            self.Z,
+		PeerAddress:  self.PeerAddress,
 		CurrentPeers: rtSize,
-		MaxPeers:     dht.localSystem.GetMaxPeers(),
+		MaxPeers:     self.GetMaxPeers(),
 		HasCapacity:  selfHasCapacity,
 	})
-	seenIDs[dht.localSystem.ID] = true
+	seenIDs[self.ID] = true
 
-	// Add nodes from routing table
+	// Add nodes from routing table, with their load estimated from the connection map
+	loads := dht.peerLoads()
 	for _, sys := range dht.routingTable.GetAllRoutingTableNodes() {
+		if !dht.shareable(sys) {
+			continue
+		}
+		current := loads[sys.ID.String()]
 		systems = append(systems, DiscoverySystem{
-			ID:          sys.ID.String(),
-			Name:        sys.Name,
-			X:           sys.X,
-			Y:           sys.Y,
-			Z:           sys.Z,
-			PeerAddress: sys.PeerAddress,
-			MaxPeers:    sys.GetMaxPeers(),
-			HasCapacity: true, // Assume yes, they'll reject if not
+			ID:           sys.ID.String(),
+			Name:         sys.Name,
+			X:            sys.X,
+			Y:            sys.Y,
+			Z:            sys.Z,
+			PeerAddress:  sys.PeerAddress,
+			CurrentPeers: current,
+			MaxPeers:     sys.GetMaxPeers(),
+			HasCapacity:  current < sys.GetMaxPeers(),
 		})
 		seenIDs[sys.ID] = true
 	}
 
 	// Also add verified cached systems not already included (only recently verified)
 	for _, sys := range dht.routingTable.GetVerifiedCachedSystems(24 * time.Hour) {
-		if !seenIDs[sys.ID] {
+		if !seenIDs[sys.ID] && dht.shareable(sys) {
+			current := loads[sys.ID.String()]
 			systems = append(systems, DiscoverySystem{
-				ID:          sys.ID.String(),
-				Name:        sys.Name,
-				X:           sys.X,
-				Y:           sys.Y,
-				Z:           sys.Z,
-				PeerAddress: sys.PeerAddress,
-				MaxPeers:    sys.GetMaxPeers(),
-				HasCapacity: true,
+				ID:           sys.ID.String(),
+				Name:         sys.Name,
+				X:            sys.X,
+				Y:            sys.Y,
+				Z:            sys.Z,
+				PeerAddress:  sys.PeerAddress,
+				CurrentPeers: current,
+				MaxPeers:     sys.GetMaxPeers(),
+				HasCapacity:  current < sys.GetMaxPeers(),
 			})
 		}
 	}
@@ -710,8 +1846,15 @@ type FullSyncSystem struct {
 	Z           float64 `json:"z"`
 	PeerAddress string  `json:"peer_address"`
 	StarClass   string  `json:"star_class"`
+	StarClasses string  `json:"star_classes,omitempty"` // All stars for binaries and trinaries, e.g. "G+M" (see starClasses)
 	InfoVersion int64   `json:"info_version"`
+	InfoSignature string `json:"info_signature,omitempty"`
+	PeerTLS     bool    `json:"peer_tls,omitempty"` // Signed, so carried for the signature to verify
+	CoordsVersion int   `json:"coords_version,omitempty"`
+	StarsVersion int    `json:"stars_version,omitempty"` // Derivation behind its stars, for planets (see ExpectedStars)
 	LastSeen    int64   `json:"last_seen"` // Unix timestamp, 0 if never directly seen
+	GenesisDemotion *GenesisDemotion `json:"genesis_demotion,omitempty"`
+	Profile     *OperatorProfile `json:"profile,omitempty"`
 }
 
 // FullSyncResponse is the response from /api/full-sync
@@ -727,6 +1870,13 @@ type FullSyncResponse struct {
 // This endpoint enables new nodes to learn about the entire network in one request
 // rather than iteratively discovering nodes through Kademlia lookups.
 func (dht *DHT) handleFullSync(w http.ResponseWriter, r *http.Request) {
+	// The biggest thing we serve is the first to go when the bandwidth budget runs low
+	if dht.budgetStage() >= BudgetNoFullSync {
+		w.Header().Set("Retry-After", strconv.FormatInt(dht.BandwidthStats().ResetsAt-time.Now().Unix(), 10))
+		http.Error(w, "full-sync unavailable: daily bandwidth budget nearly used up", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Build list of all known systems
 	systems := []FullSyncSystem{}
 	seenIDs := make(map[uuid.UUID]bool)
@@ -740,7 +1890,10 @@ func (dht *DHT) handleFullSync(w http.ResponseWriter, r *http.Request) {
 
 	// Add routing table nodes first (these are actively maintained)
 	for _, sys := range dht.routingTable.GetAllRoutingTableNodes() {
-		if seenIDs[sys.ID] {
+		if len(systems) >= dht.maxFullSyncSystems {
+			break
+		}
+		if seenIDs[sys.ID] || !dht.shareable(sys) {
 			continue
 		}
 		seenIDs[sys.ID] = true
@@ -753,15 +1906,25 @@ func (dht *DHT) handleFullSync(w http.ResponseWriter, r *http.Request) {
 			Z:           sys.Z,
 			PeerAddress: sys.PeerAddress,
 			StarClass:   sys.Stars.Primary.Class,
+			StarClasses: starClasses(sys.Stars),
 			InfoVersion: sys.InfoVersion,
+			InfoSignature: sys.InfoSignature,
+			PeerTLS:     sys.PeerTLS,
+			CoordsVersion: sys.CoordsVersion,
+			StarsVersion: sys.StarsVersion,
 			LastSeen:    time.Now().Unix(), // Routing table nodes are actively maintained
+			GenesisDemotion: sys.GenesisDemotion,
+			Profile:     sys.Profile,
 		})
 	}
 
 	// Add cached systems ONLY if they've been verified recently
 	// This prevents spreading stale gossip about dead nodes
 	for _, sys := range dht.routingTable.GetAllCachedSystems() {
-		if seenIDs[sys.ID] {
+		if len(systems) >= dht.maxFullSyncSystems {
+			break // Size guard on the response
+		}
+		if seenIDs[sys.ID] || !dht.shareable(sys) {
 			continue
 		}
 
@@ -786,24 +1949,39 @@ func (dht *DHT) handleFullSync(w http.ResponseWriter, r *http.Request) {
 			Z:           sys.Z,
 			PeerAddress: sys.PeerAddress,
 			StarClass:   sys.Stars.Primary.Class,
+			StarClasses: starClasses(sys.Stars),
 			InfoVersion: sys.InfoVersion,
+			InfoSignature: sys.InfoSignature,
+			PeerTLS:     sys.PeerTLS,
+			CoordsVersion: sys.CoordsVersion,
+			StarsVersion: sys.StarsVersion,
 			LastSeen:    cached.LastVerified.Unix(),
+			GenesisDemotion: sys.GenesisDemotion,
+			Profile:     sys.Profile,
 		})
 	}
 
+	self := dht.GetLocalSystem()
 	response := FullSyncResponse{
 		ProtocolVersion: CurrentProtocolVersion.String(),
 		Timestamp:       time.Now().Unix(),
 		LocalSystem: FullSyncSystem{
-			ID:          dht.localSystem.ID.String(),
-			Name:        dht.localSystem.Name,
-			X:           dht.localSystem.X,
-			Y:           dht.localSystem.Y,
-			Z:           dht.localSystem.Z,
-			PeerAddress: dht.localSystem.PeerAddress,
-			StarClass:   dht.localSystem.Stars.Primary.Class,
-			InfoVersion: dht.localSystem.InfoVersion,
+			ID:          self.ID.String(),
+			Name:        self.Name,
+			X:           self.X,
+			Y:           self.Y,
+			Z:           self.Z,
+			PeerAddress: self.PeerAddress,
+			StarClass:   self.Stars.Primary.Class,
+			StarClasses: starClasses(self.Stars),
+			InfoVersion: self.InfoVersion,
+			InfoSignature: self.InfoSignature,
+			PeerTLS:     self.PeerTLS,
+			CoordsVersion: self.CoordsVersion,
+			StarsVersion: self.StarsVersion,
 			LastSeen:    time.Now().Unix(),
+			GenesisDemotion: self.GenesisDemotion,
+			Profile:     self.Profile,
 		},
 		Systems:    systems,
 		TotalCount: len(systems) + 1, // +1 for local system
@@ -812,77 +1990,282 @@ func (dht *DHT) handleFullSync(w http.ResponseWriter, r *http.Request) {
 	log.Printf("FULL-SYNC: returning %d verified systems to %s", response.TotalCount, r.RemoteAddr)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	if err := writeFullSyncResponse(w, &response); err != nil {
+		log.Printf("FULL-SYNC: failed to send to %s: %v", r.RemoteAddr, err)
+	}
+}
+
+// writeFullSyncResponse streams a full-sync response one system at a time,
+// so a large galaxy is never held in memory as a single encoded buffer
+// The output is the same JSON object json.Marshal would produce, with total_count
+// written before the systems array so readers can stop early
+func writeFullSyncResponse(w io.Writer, response *FullSyncResponse) error {
+	head, err := json.Marshal(struct {
+		ProtocolVersion string         `json:"protocol_version"`
+		Timestamp       int64          `json:"timestamp"`
+		LocalSystem     FullSyncSystem `json:"local_system"`
+		TotalCount      int            `json:"total_count"`
+	}{response.ProtocolVersion, response.Timestamp, response.LocalSystem, response.TotalCount})
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(head[:len(head)-1]) // Reopen the object to append systems
+	bw.WriteString(`,"systems":[`)
+	for i := range response.Systems {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		data, err := json.Marshal(&response.Systems[i])
+		if err != nil {
+			return err
+		}
+		if _, err := bw.Write(data); err != nil {
+			return err // Client went away
+		}
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
+}
+
+// SetMaxFullSyncSystems changes how many systems one full-sync may carry (both directions)
+func (dht *DHT) SetMaxFullSyncSystems(n int) {
+	dht.maxFullSyncSystems = n
+}
+
+// SetMaxMessageBytes changes the largest DHT message body we take
+func (dht *DHT) SetMaxMessageBytes(n int) {
+	dht.maxMessageBytes = n
+}
+
+// SetMaxCachedSystems changes the cap on the system cache (see cache_limit.go)
+func (dht *DHT) SetMaxCachedSystems(n int) {
+	dht.routingTable.SetMaxCachedSystems(n)
+}
+
+// SetLookupTimeout changes how long one FindNode may take before returning what it has
+func (dht *DHT) SetLookupTimeout(d time.Duration) {
+	dht.lookupTimeout = d
 }
 
 // === Outbound Operations ===
 
 // sendRequest sends a DHT request and waits for response
 func (dht *DHT) sendRequest(address string, msg *DHTMessage) (*DHTMessage, error) {
+	return dht.sendRequestContext(context.Background(), address, msg)
+}
+
+// sendRequestContext is sendRequest, given up when ctx is done
+func (dht *DHT) sendRequestContext(ctx context.Context, address string, msg *DHTMessage) (*DHTMessage, error) {
 	// Generate request ID if not set
 	if msg.RequestID == "" {
 		msg.RequestID = uuid.New().String()
 	}
 
-	// Register pending request
-	respCh := make(chan *DHTMessage, 1)
-	dht.pendingMu.Lock()
-	dht.pendingRequests[msg.RequestID] = respCh
-	dht.pendingMu.Unlock()
+	if err := dht.checkBandwidthBudget(msg); err != nil {
+		return nil, err
+	}
 
-	defer func() {
-		dht.pendingMu.Lock()
-		delete(dht.pendingRequests, msg.RequestID)
-		dht.pendingMu.Unlock()
-	}()
+	// Peers that refused us are left alone for a while (see rejections.go)
+	if msg.Attestation != nil {
+		if err := dht.checkRejectionHold(msg.Attestation.ToSystemID); err != nil {
+			return nil, err
+		}
+	}
 
-	// Send request
-	data, err := json.Marshal(msg)
+	// Register pending request
+	pending := dht.registerPending(msg, address)
+	defer dht.unregisterPending(msg.RequestID)
+
+	// Nonces only go to peers known to check them; a first contact gets the legacy form
+	if msg.Attestation != nil && dht.peerChecksNonces(pending.expectedID) {
+		msg.Attestation = dht.withNonce(msg.Attestation)
+	}
+
+	// Send request, gzipped for peers known to take it, if it's within what the peer takes
+	// FromSystem is our live local system, so it's encoded under localMu
+	msg.MaxMessageBytes = dht.maxMessageBytes
+	allowGzip, limit := dht.peerTakesGzip(pending.expectedID), dht.routingTable.GetMaxMessageBytes(pending.expectedID)
+	dht.localMu.RLock()
+	sentVersion := msg.FromSystem.InfoVersion
+	data, gzipped, err := encodeDHTBody(msg, allowGzip, limit)
+	dht.localMu.RUnlock()
 	if err != nil {
+		if errors.Is(err, ErrMessageTooLarge) {
+			log.Printf("Not sending to %s: %v", address, err)
+		}
 		return nil, err
 	}
 
-	url := fmt.Sprintf("http://%s/dht", address)
-	resp, err := dht.httpClient.Post(url, "application/json", bytes.NewReader(data))
+	// Peers that advertise TLS are only reached over TLS, pinned to their bound key
+	// A failure is not retried in plain HTTP: that would let anyone who can break the
+	// TLS connection downgrade it. A peer that drops -peer-tls advertises so in newer
+	// signed info, and we go back to plain HTTP once we have it
+	// The round trip is timed from here to the whole response being read
+	sentAt := time.Now()
+	transport := TransportHTTP
+	var resp *http.Response
+	if client, peerID := dht.tlsClientFor(address, msg); client != nil {
+		resp, err = postDHT(ctx, client, peerTLSURL(address, "/dht"), data, gzipped)
+		if errors.Is(err, ErrPeerCertMismatch) {
+			log.Printf("TLS certificate from %s (%s) doesn't match its identity key", address, peerID.String()[:8])
+		}
+		if err != nil {
+			return nil, err
+		}
+		transport = TransportHTTPS
+	} else {
+		resp, err = postDHT(ctx, dht.httpClient, peerURL(address, "/dht"), data, gzipped)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	// Bytes go to whoever answered, or else to who we asked
+	// rejected marks a response refused for failing validation (see peer_traffic.go)
+	peerID := pending.expectedID
+	rejected := false
+	errCode := 0 // The error code it answered with
+	received := &countingReader{r: resp.Body}
+	defer func() {
+		dht.traffic.record(peerID, int64(len(data)), received.n)
+		if peerID != uuid.Nil {
+			dht.messageTraffic.outbound(peerID, msg.Type, int64(len(data)), received.n, resp.StatusCode != http.StatusOK, errCode, rejected)
+		}
+	}()
+
+	body, err := readDHTBody(received, resp.Header.Get("Content-Encoding"), dht.maxMessageBytes)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	rtt := time.Since(sentAt)
 
 	if resp.StatusCode != http.StatusOK {
 		var errResp struct {
 			Error DHTError `json:"error"`
 		}
-		json.NewDecoder(resp.Body).Decode(&errResp)
-		return nil, &errResp.Error
+		json.Unmarshal(body, &errResp)
+		errCode = errResp.Error.Code
+		if errResp.Error.Code == 0 {
+			return nil, &errResp.Error
+		}
+		return nil, dht.recordRejection(pending.expectedID, &errResp.Error)
 	}
 
 	// Parse response
 	var response DHTMessage
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	if err := json.Unmarshal(body, &response); err != nil {
+		rejected = true
 		return nil, err
 	}
+	if response.FromSystem != nil {
+		peerID = response.FromSystem.ID
+	}
 
 	// Validate response
 	if err := response.Validate(); err != nil {
+		rejected = true
+		return nil, err
+	}
+
+	// Whoever answered must be the peer we asked, and must be answering us
+	if response.RequestID != "" && response.RequestID != msg.RequestID {
+		rejected = true
+		return nil, fmt.Errorf("response from %s answers request %s, not %s", address, response.RequestID, msg.RequestID)
+	}
+	if err := dht.checkResponder(pending, &response, ""); err != nil {
+		rejected = true
+		log.Printf("Discarding response: %v", err)
+		return nil, err
+	}
+	if err := dht.checkClockSkew(&response, sentAt); err != nil {
+		rejected = true
+		log.Printf("Discarding response from %s: %v", address, err)
 		return nil, err
 	}
 
 	// Update routing table with responder's info (proper Kademlia LRS-ping if bucket full)
+	// A peer that turned us away at capacity is alive but isn't our peer
 	if response.FromSystem != nil {
 		dht.updateRoutingTable(response.FromSystem)
-		dht.routingTable.MarkVerified(response.FromSystem.ID)
+		if !response.AtCapacity {
+			dht.routingTable.MarkVerified(response.FromSystem.ID)
+		}
+		dht.routingTable.RecordTransport(response.FromSystem.ID, transport)
+		dht.routingTable.RecordLatency(response.FromSystem.ID, rtt)
+		dht.recordCapabilities(&response)
+		dht.observeAddress(response.FromSystem.ID, response.ObservedAddr)
+
+		// Our request carried our info; announce responses from peers that version info say exactly which version they kept
+		delivered := sentVersion
+		if response.AckedVersion > 0 && response.PeerCapabilities().Has(CapInfoVersion) {
+			delivered = response.AckedVersion
+		}
+		dht.announcer.recordDelivered(response.FromSystem.ID, delivered)
 	}
 
-	// Cache any systems in the response and try to add to routing table
+	// Cache any systems in the response, unverified: they join the routing table only
+	// once they answer us directly, however many peers vouch for them
+	// The responder lists only its live peers, which is what gives a partition away
 	for _, sys := range response.ClosestNodes {
 		dht.routingTable.CacheSystem(sys, response.FromSystem.ID, false)
-		dht.updateRoutingTable(sys)
+		dht.routingTable.partitions.reported(sys, response.FromSystem.ID)
+	}
+	for _, sys := range response.Alternatives {
+		dht.routingTable.CacheSystem(sys, response.FromSystem.ID, false)
+		dht.routingTable.partitions.reported(sys, response.FromSystem.ID)
 	}
 
 	return &response, nil
 }
 
+// postDHT posts a DHT message body, saying we take gzipped responses
+// Setting Accept-Encoding ourselves means the transport leaves decompressing (and its size limit) to us
+func postDHT(ctx context.Context, client *http.Client, url string, data []byte, gzipped bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	return client.Do(req)
+}
+
+// peerTakesGzip reports whether a peer has said it accepts gzipped requests
+// Unlike peerSupports, an unknown peer doesn't: a request it can't read is a lost request
+func (dht *DHT) peerTakesGzip(id uuid.UUID) bool {
+	if id == uuid.Nil {
+		return false
+	}
+	caps, known := dht.routingTable.GetCapabilities(id)
+	return known && caps.Has(CapGzip)
+}
+
+// peerChecksNonces reports whether a peer has said it checks attestation nonces
+// Like peerTakesGzip, an unknown peer doesn't: it couldn't verify a nonce it doesn't sign over
+func (dht *DHT) peerChecksNonces(id uuid.UUID) bool {
+	if id == uuid.Nil {
+		return false
+	}
+	caps, known := dht.routingTable.GetCapabilities(id)
+	return known && caps.Has(CapAttestationNonce)
+}
+
+// withNonce returns a copy of one of our attestations with a fresh nonce
+func (dht *DHT) withNonce(a *Attestation) *Attestation {
+	if dht.localSystem.Keys == nil {
+		return a
+	}
+	nonced := *a
+	nonced.addNonce(dht.localSystem.Keys.PrivateKey)
+	return &nonced
+}
+
 // Ping sends a ping to a node and returns their system info
 // If the recipient's UUID is unknown (first contact), uses uuid.Nil
 func (dht *DHT) Ping(address string) (*System, error) {
@@ -916,11 +2299,15 @@ func (dht *DHT) PingNode(sys *System) error {
 
 	resp, err := dht.sendRequest(sys.PeerAddress, msg)
 	if err != nil {
-		dht.routingTable.MarkFailed(sys.ID)
+		// A peer that refused us is alive, just not talking to us
+		if !isPeerRejection(err) {
+			dht.routingTable.MarkFailed(sys.ID)
+		}
 		return err
 	}
 
 	// Check if the responding system matches who we expected
+	// (sendRequest only lets a different one through if it claims the address itself)
 	if resp.FromSystem != nil && resp.FromSystem.ID != sys.ID {
 		// Different node responded - the address now belongs to someone else
 		log.Printf("UUID mismatch at %s: expected %s (%s), got %s (%s) - removing stale entry",
@@ -945,6 +2332,11 @@ func (dht *DHT) PingNode(sys *System) error {
 
 // FindNodeDirectToSystem performs a find_node query to a known system
 func (dht *DHT) FindNodeDirectToSystem(sys *System, targetID uuid.UUID) ([]*System, error) {
+	return dht.findNodeDirect(context.Background(), sys, targetID)
+}
+
+// findNodeDirect is FindNodeDirectToSystem, given up when ctx is done
+func (dht *DHT) findNodeDirect(ctx context.Context, sys *System, targetID uuid.UUID) ([]*System, error) {
 	if sys.PeerAddress == "" {
 		return nil, fmt.Errorf("no peer address for %s", sys.Name)
 	}
@@ -954,7 +2346,7 @@ func (dht *DHT) FindNodeDirectToSystem(sys *System, targetID uuid.UUID) ([]*Syst
 		return nil, err
 	}
 
-	resp, err := dht.sendRequest(sys.PeerAddress, msg)
+	resp, err := dht.sendRequestContext(ctx, sys.PeerAddress, msg)
 	if err != nil {
 		return nil, err
 	}
@@ -964,6 +2356,11 @@ func (dht *DHT) FindNodeDirectToSystem(sys *System, targetID uuid.UUID) ([]*Syst
 
 // AnnounceToSystem sends an announce message to a known system
 func (dht *DHT) AnnounceToSystem(sys *System) error {
+	return dht.announceTo(sys, false)
+}
+
+// announceTo announces to sys, asking it to pass our info on when relay is set
+func (dht *DHT) announceTo(sys *System, relay bool) error {
 	if sys.PeerAddress == "" {
 		return fmt.Errorf("no peer address for %s", sys.Name)
 	}
@@ -972,9 +2369,19 @@ func (dht *DHT) AnnounceToSystem(sys *System) error {
 	if err != nil {
 		return err
 	}
+	msg.RelayInfo = relay
+	dht.attachRankClaim(msg)
+	dht.attachKeyRotations(msg)
 
-	_, err = dht.sendRequest(sys.PeerAddress, msg)
-	return err
+	resp, err := dht.sendRequest(sys.PeerAddress, msg)
+	if err != nil {
+		return err
+	}
+	dht.recordRankClaim(resp)
+	if resp.AtCapacity {
+		return &AtCapacityError{System: sys, Alternatives: resp.Alternatives}
+	}
+	return nil
 }
 
 // === Protocol Compatibility ===
@@ -988,8 +2395,8 @@ var (
 // warnIfOldProtocol logs a warning if the sender is using an old protocol version
 // that doesn't include ToSystemID in attestations. Only warns once per hour per system.
 func (dht *DHT) warnIfOldProtocol(msg *DHTMessage) {
-	// Check if attestation has targeted recipient (v1.6.0+) and not a v0.0.0 dev version
-	if msg.HasTargetedAttestation() {
+	// First contact attestations have no recipient even from current nodes, so ask the capabilities
+	if msg.PeerCapabilities().Has(CapTargetedAttestation) || msg.HasTargetedAttestation() {
 		return // New protocol, all good
 	}
 
@@ -1024,9 +2431,12 @@ func (dht *DHT) GetRoutingTable() *RoutingTable {
 	return dht.routingTable
 }
 
-// GetLocalSystem returns the local system
+// GetLocalSystem returns a copy of the local system, safe to read while its info changes
 func (dht *DHT) GetLocalSystem() *System {
-	return dht.localSystem
+	dht.localMu.RLock()
+	defer dht.localMu.RUnlock()
+	sys := *dht.localSystem
+	return &sys
 }
 
 // GetStorage returns the storage
@@ -1034,6 +2444,84 @@ func (dht *DHT) GetStorage() *Storage {
 	return dht.storage
 }
 
+// GetConnections returns the network topology as directed edges
+// Peer-reported connections from the last hour, plus our routing table peers, each with
+// its newest evidence and a strength that fades with age and for degraded or stale peers
+// Sorted by system IDs, so the map bundles them the same way on every refresh
+func (dht *DHT) GetConnections() []TopologyEdge {
+	const maxAge = time.Hour
+	now := time.Now()
+
+	connections, err := dht.storage.GetAllConnections(maxAge)
+	if err != nil {
+		connections = []TopologyEdge{} // Continue with empty if error
+	}
+	attested, err := dht.storage.GetLatestAttestations(dht.localSystem.ID, now.Add(-maxAge).Unix())
+	if err != nil {
+		attested = nil
+	}
+
+	// Peers in our routing table have had bidirectional communication with us,
+	// so both directions are present and reciprocal whatever the peer reported
+	selfID := dht.localSystem.ID.String()
+	selfName := dht.localSystem.Name
+
+	existingEdges := make(map[string]int)
+	for i, c := range connections {
+		existingEdges[c.FromID+":"+c.ToID] = i
+	}
+
+	for _, cached := range dht.routingTable.GetAllRoutingTableNodesWithMeta() {
+		peer := cached.System
+		peerID := peer.ID.String()
+		for _, e := range []TopologyEdge{
+			{FromID: selfID, FromName: selfName, ToID: peerID, ToName: peer.Name, Reciprocal: true},
+			{FromID: peerID, FromName: peer.Name, ToID: selfID, ToName: selfName, Reciprocal: true},
+		} {
+			i, ok := existingEdges[e.FromID+":"+e.ToID]
+			if ok {
+				connections[i].Reciprocal = true
+			} else {
+				i = len(connections)
+				existingEdges[e.FromID+":"+e.ToID] = i
+				connections = append(connections, e)
+			}
+			// The peer's signed attestations back its side; our own contact backs ours
+			if at, ok := attested[peer.ID]; ok && e.ToID == selfID {
+				connections[i].addEvidence(at, EdgeEvidenceAttestation)
+			} else {
+				connections[i].addEvidence(cached.LastVerified.Unix(), EdgeEvidenceDirect)
+			}
+		}
+	}
+	scoreEdges(connections, maxAge, now)
+
+	// Fade edges to peers we're losing touch with
+	fade := make(map[string]float64)
+	for _, cached := range dht.routingTable.GetAllCachedSystemsWithMeta() {
+		switch cachedPeerStatus(cached, now.Add(-VerificationCutoff)).state {
+		case PeerDegraded:
+			fade[cached.System.ID.String()] = 0.6
+		case PeerStale:
+			fade[cached.System.ID.String()] = 0.3
+		}
+	}
+	for i := range connections {
+		for _, id := range []string{connections[i].FromID, connections[i].ToID} {
+			if f, ok := fade[id]; ok {
+				connections[i].Strength = math.Round(connections[i].Strength*f*100) / 100
+			}
+		}
+	}
+	sort.Slice(connections, func(i, j int) bool {
+		if connections[i].FromID != connections[j].FromID {
+			return connections[i].FromID < connections[j].FromID
+		}
+		return connections[i].ToID < connections[j].ToID
+	})
+	return connections
+}
+
 // === DHT Lookup Operations ===
 
 // queryResponse holds the result of querying a single node
@@ -1045,14 +2533,23 @@ type queryResponse struct {
 
 // FindNode performs an iterative lookup to discover peers and find a target ID
 // Simplified from Kademlia - we query peers to learn about more peers
+// Up to Alpha queries are in flight at once, and each answer is handled as it arrives,
+// so one slow peer holds up only its own query. A peer silent for LookupQueryTimeout
+// is given up on, and the whole lookup stops at the lookup timeout with what it has
 func (dht *DHT) FindNode(targetID uuid.UUID) *LookupResult {
+	return dht.findNode(targetID, true)
+}
+
+// findNode is FindNode; without useCache it asks the network even for a cached target
+func (dht *DHT) findNode(targetID uuid.UUID, useCache bool) *LookupResult {
 	startTime := time.Now()
 	result := &LookupResult{
 		Target: targetID,
 	}
+	dht.routingTable.touchBucket(targetID)
 
 	// Check if we have the target cached
-	if cached := dht.routingTable.GetCachedSystem(targetID); cached != nil {
+	if cached := dht.routingTable.GetCachedSystem(targetID); cached != nil && useCache {
 		result.Found = cached
 		result.ClosestNodes = []*System{cached}
 		result.Duration = time.Since(startTime)
@@ -1060,112 +2557,199 @@ func (dht *DHT) FindNode(targetID uuid.UUID) *LookupResult {
 	}
 
 	// Get initial closest nodes from our routing table
-	shortlist := dht.routingTable.GetClosest(targetID, Alpha)
+	// Relays first, then the fastest peers, which answer each hop sooner
+	shortlist := preferRelays(dht.routingTable.sortByLatency(dht.routingTable.GetClosest(targetID, Alpha)))
 	if len(shortlist) == 0 {
 		log.Printf("FindNode: no nodes in routing table, cannot lookup %s", targetID.String()[:8])
 		result.Duration = time.Since(startTime)
 		return result
 	}
 
-	// Track which nodes we've queried
+	// Cancelling ctx abandons every query still in flight
+	ctx, cancel := context.WithTimeout(context.Background(), dht.lookupTimeout)
+	defer cancel()
+	responses := make(chan queryResponse)
+
+	// Track which nodes we've queried (or are querying), and how each query went
 	queried := make(map[uuid.UUID]bool)
+	queries := make(map[uuid.UUID]*LookupQuery)
+	inFlight := 0
 
-	// Track all nodes we've learned about, sorted by distance
+	// Track all nodes we've learned about, sorted by distance, and the hop each was found at
 	allNodes := make(map[uuid.UUID]*System)
+	hop := make(map[uuid.UUID]int)
 	for _, sys := range shortlist {
 		allNodes[sys.ID] = sys
+		hop[sys.ID] = 1
 	}
 
-	hops := 0
-	maxHops := 20 // Safety limit
-
-	for hops < maxHops {
-		hops++
+	maxQueries := 20 * Alpha // Safety limit (formerly 20 rounds of Alpha)
+	exhausted := false
 
-		// Select Alpha closest unqueried nodes
-		toQuery := selectUnqueried(shortlist, queried, Alpha)
-		if len(toQuery) == 0 {
-			// No more unqueried nodes in shortlist
+	for ctx.Err() == nil {
+		// Keep Alpha queries going to the closest unqueried nodes
+		if !exhausted && inFlight < Alpha {
+			for _, sys := range selectUnqueried(shortlist, queried, Alpha-inFlight) {
+				if len(result.Queries) >= maxQueries {
+					break
+				}
+				queried[sys.ID] = true
+				inFlight++
+				q := &LookupQuery{System: sys, Hop: hop[sys.ID], started: time.Now()}
+				queries[sys.ID] = q
+				result.Queries = append(result.Queries, q)
+				if hop[sys.ID] > result.Hops {
+					result.Hops = hop[sys.ID]
+				}
+				go dht.queryNode(ctx, sys, targetID, responses)
+			}
+		}
+		if inFlight == 0 {
 			break
 		}
 
-		// Query nodes in parallel
-		responses := dht.queryNodesParallel(toQuery, targetID)
+		var resp queryResponse
+		select {
+		case resp = <-responses:
+			inFlight--
+		case <-ctx.Done():
+			continue
+		}
 
-		// Process responses
-		newNodesFound := false
-		for _, resp := range responses {
-			if resp.err != nil {
+		q := queries[resp.nodeID]
+		q.Duration = time.Since(q.started)
+		q.Returned = len(resp.nodes)
+		q.Err = resp.err
+
+		if resp.err != nil {
+			switch {
+			case errors.Is(resp.err, context.DeadlineExceeded):
+				// Slow, not necessarily dead: the liveness loop decides that
+				result.TimedOut++
+				q.Outcome = QueryTimedOut
+			case isPeerRejection(resp.err):
+				q.Outcome = QueryRejected
+			case errors.Is(resp.err, ErrBandwidthBudget):
+				q.Outcome = QueryHeldBack
+			default:
+				q.Outcome = QueryFailed
 				dht.routingTable.MarkFailed(resp.nodeID)
-				continue
 			}
+			continue
+		}
+		q.Outcome = QueryAnswered
 
-			// Mark responding node as verified (successful communication)
-			dht.routingTable.MarkVerified(resp.nodeID)
-
-			// Mark as queried
-			queried[resp.nodeID] = true
+		// Mark responding node as verified (successful communication)
+		dht.routingTable.MarkVerified(resp.nodeID)
 
-			// Save learned peer connections (responder knows these nodes)
-			if len(resp.nodes) > 0 {
-				peerIDs := make([]uuid.UUID, 0, len(resp.nodes))
-				for _, sys := range resp.nodes {
-					if sys.ID != dht.localSystem.ID && sys.ID != resp.nodeID {
-						peerIDs = append(peerIDs, sys.ID)
-					}
-				}
-				if len(peerIDs) > 0 {
-					dht.storage.SavePeerConnections(resp.nodeID, peerIDs)
+		// Save learned peer connections (responder knows these nodes)
+		if len(resp.nodes) > 0 {
+			peerIDs := make([]uuid.UUID, 0, len(resp.nodes))
+			for _, sys := range resp.nodes {
+				if sys.ID != dht.localSystem.ID && sys.ID != resp.nodeID && !dht.routingTable.IsBlocked(sys.ID) {
+					peerIDs = append(peerIDs, sys.ID)
 				}
 			}
-
-			// Process returned nodes
-			for _, sys := range resp.nodes {
-				if sys.ID == dht.localSystem.ID {
-					continue // Skip ourselves
+			if len(peerIDs) > 0 {
+				if err := dht.storage.SavePeerConnections(resp.nodeID, peerIDs); err == nil {
+					dht.emitConnectionChanged(resp.nodeID, peerIDs)
 				}
+			}
+		}
 
-				// Check if this is the exact target
-				if sys.ID == targetID {
-					result.Found = sys
-				}
+		// Process returned nodes
+		newNodesFound := false
+		for _, sys := range resp.nodes {
+			if sys.ID == dht.localSystem.ID {
+				continue // Skip ourselves
+			}
 
-				// Add to allNodes if not seen before
-				if _, exists := allNodes[sys.ID]; !exists {
-					allNodes[sys.ID] = sys
-					newNodesFound = true
+			// Check if this is the exact target
+			if sys.ID == targetID {
+				result.Found = sys
+			}
 
-					// Cache this peer
-					dht.updateRoutingTable(sys)
-				}
+			// Add to allNodes if not seen before (sendRequest already cached it)
+			if _, exists := allNodes[sys.ID]; !exists {
+				allNodes[sys.ID] = sys
+				hop[sys.ID] = hop[resp.nodeID] + 1
+				newNodesFound = true
 			}
 		}
 
-		// If we found the exact target, we can stop
+		// If we found the exact target, we can stop (and drop the stragglers)
 		if result.Found != nil {
 			break
 		}
 
-		// Update shortlist with all known nodes, sorted by distance
-		shortlist = sortByDistance(allNodes, targetID)
+		// Update shortlist with all known nodes, relays and then fast peers first so they're queried as the next hops
+		shortlist = preferRelays(dht.routingTable.sortByLatency(sortByDistance(allNodes, targetID)))
 
-		// Check termination condition: K closest nodes have all been queried
-		if allClosestQueried(shortlist, queried, K) && !newNodesFound {
-			break
+		// Termination condition: K closest nodes have all been queried and this answer
+		// taught us nothing new. What's still in flight is waited for, not added to
+		exhausted = allClosestQueried(shortlist, queried, K) && !newNodesFound
+	}
+
+	for _, q := range result.Queries {
+		if q.Outcome == "" {
+			q.Outcome = QueryAbandoned
+			q.Duration = time.Since(q.started)
 		}
 	}
 
 	// Final result is K closest nodes
+	result.DeadlineHit = result.Found == nil && ctx.Err() == context.DeadlineExceeded
 	result.ClosestNodes = truncateToK(shortlist, K)
-	result.Hops = hops
 	result.Duration = time.Since(startTime)
 
-	log.Printf("FindNode(%s): found %d nodes in %d hops (%v)",
-		targetID.String()[:8], len(result.ClosestNodes), hops, result.Duration)
+	note := ""
+	if result.TimedOut > 0 {
+		note += fmt.Sprintf(", %d timed out", result.TimedOut)
+	}
+	if result.DeadlineHit {
+		note += ", lookup deadline hit"
+	}
+	log.Printf("FindNode(%s): found %d nodes in %d hops (%v%s)",
+		targetID.String()[:8], len(result.ClosestNodes), result.Hops, result.Duration, note)
 
+	if candidates := dht.unverifiedCandidates(result, queried); len(candidates) > 0 {
+		go dht.verifyCandidates(candidates)
+	}
 	return result
 }
 
+// unverifiedCandidates picks the target and closest systems a lookup only heard of: never
+// asked during it and not in our routing table. At most MaxLookupVerifications are returned
+func (dht *DHT) unverifiedCandidates(result *LookupResult, queried map[uuid.UUID]bool) []*System {
+	closest := result.ClosestNodes
+	if result.Found != nil {
+		closest = append([]*System{result.Found}, closest...)
+	}
+	var candidates []*System
+	for _, sys := range closest {
+		if len(candidates) >= MaxLookupVerifications {
+			break
+		}
+		if queried[sys.ID] || sys.ID == dht.localSystem.ID || sys.PeerAddress == "" {
+			continue
+		}
+		if status := dht.routingTable.GetCachedSystemStatus(sys.ID); status != nil && !status.InRoutingTable {
+			candidates = append(candidates, sys)
+		}
+	}
+	return candidates
+}
+
+// verifyCandidates pings systems we only know from FIND_NODE answers; the ones that
+// answer join the routing table, the silent ones count a failure
+func (dht *DHT) verifyCandidates(candidates []*System) {
+	for _, sys := range candidates {
+		if err := dht.PingNode(sys); err != nil {
+			log.Printf("Lookup candidate %s (%s) didn't answer: %v", sys.ID.String()[:8], sys.Name, err)
+		}
+	}
+}
+
 // Lookup finds a specific system by ID
 func (dht *DHT) Lookup(targetID uuid.UUID) (*System, error) {
 	result := dht.FindNode(targetID)
@@ -1183,35 +2767,22 @@ func (dht *DHT) Lookup(targetID uuid.UUID) (*System, error) {
 	return nil, &DHTError{Code: 404, Message: "system not found"}
 }
 
-// queryNodesParallel queries multiple nodes in parallel
-func (dht *DHT) queryNodesParallel(nodes []*System, targetID uuid.UUID) []queryResponse {
-	var wg sync.WaitGroup
-	responses := make([]queryResponse, len(nodes))
-
-	for i, node := range nodes {
-		wg.Add(1)
-		go func(idx int, sys *System) {
-			defer wg.Done()
-
-			responses[idx].nodeID = sys.ID
-
-			if sys.PeerAddress == "" {
-				responses[idx].err = &DHTError{Code: 400, Message: "no peer address"}
-				return
-			}
-
-			closestNodes, err := dht.FindNodeDirectToSystem(sys, targetID)
-			if err != nil {
-				responses[idx].err = err
-				return
-			}
-
-			responses[idx].nodes = closestNodes
-		}(i, node)
+// queryNode sends one lookup query, bounded by LookupQueryTimeout, and delivers the
+// answer to responses unless the lookup is over by then
+func (dht *DHT) queryNode(ctx context.Context, sys *System, targetID uuid.UUID, responses chan<- queryResponse) {
+	resp := queryResponse{nodeID: sys.ID}
+	if sys.PeerAddress == "" {
+		resp.err = &DHTError{Code: 400, Message: "no peer address"}
+	} else {
+		queryCtx, cancel := context.WithTimeout(ctx, LookupQueryTimeout)
+		resp.nodes, resp.err = dht.findNodeDirect(queryCtx, sys, targetID)
+		cancel()
 	}
 
-	wg.Wait()
-	return responses
+	select {
+	case responses <- resp:
+	case <-ctx.Done():
+	}
 }
 
 // selectUnqueried returns up to count nodes from the list that haven't been queried
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"strings"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 const (
@@ -14,25 +17,91 @@ const (
 	// With 50 peers/cycle, a 20K node network takes ~33 hours to fully cycle
 	// But organic contact (announces, FIND_NODE) provides additional verification
 	LivenessSampleSize = 50
+
+	// LivenessInterval is the base time between liveness pings to a healthy peer
+	// M-class systems stretch it (see System.LivenessInterval)
+	LivenessInterval = 5 * time.Minute
+
+	// LivenessMaxBackoff caps the per-peer delay after repeated failures (5m, 10m, 20m, 30m...)
+	LivenessMaxBackoff = 30 * time.Minute
+
+	// LivenessFreshness skips pinging peers we verified this recently through other traffic
+	LivenessFreshness = 5 * time.Minute
+
+	// LivenessJitter spreads each delay by ±20% so restarted fleets don't ping in lockstep
+	LivenessJitter = 0.2
+
+	// LivenessTickInterval is how often the loop looks for peers that are due
+	LivenessTickInterval = 1 * time.Minute
+
+	// InboundCheckInterval is how often reachability (inbound connections) is checked
+	InboundCheckInterval = 5 * time.Minute
+
+	// BridgeTopologyMaxAge is how recent reported peer connections must be to count
+	// toward the bridge score (the same window the galaxy map draws)
+	BridgeTopologyMaxAge = 1 * time.Hour
 )
 
-// announceLoop periodically announces our presence to the network
+// livenessDelay returns the jittered wait before the next ping, doubling per consecutive failure
+// interval is the pinging system's base interval (see System.LivenessInterval)
+func livenessDelay(interval time.Duration, failCount int) time.Duration {
+	d := interval
+	for i := 0; i < failCount && d < LivenessMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > LivenessMaxBackoff {
+		d = LivenessMaxBackoff
+	}
+	return time.Duration(float64(d) * (1 - LivenessJitter + 2*LivenessJitter*rand.Float64()))
+}
+
+// announceLoop announces our presence to the network
+// Each round's announces are spread over the interval rather than sent in a burst,
+// and info changes go out to routing table peers within InfoChangeSpread
 func (dht *DHT) announceLoop() {
 	defer dht.wg.Done()
 
-	// Initial announce after short delay
-	time.Sleep(10 * time.Second)
-	dht.announceToNetwork()
+	t := dht.tasks.register(TaskAnnounce, every(AnnounceInterval))
+
+	// Initial announce after short delay; our info was just bumped, so everyone needs it
+	initial := time.After(10 * time.Second)
+	t.scheduleNext(time.Now().Add(10 * time.Second))
 
 	ticker := time.NewTicker(AnnounceInterval)
 	defer ticker.Stop()
+	nextTick := time.Now().Add(AnnounceInterval)
+	sinceRound := 0 // Ticks skipped to save bandwidth
+	sendTicker := time.NewTicker(announceTickInterval)
+	defer sendTicker.Stop()
+
+	announce := func(window time.Duration) {
+		t.run(func() (int, error) { return dht.announceToNetwork(window), nil })
+	}
 
 	for {
 		select {
 		case <-dht.shutdown:
 			return
+		case <-initial:
+			t.scheduleNext(nextTick)
+			announce(InfoChangeSpread)
 		case <-ticker.C:
-			dht.announceToNetwork()
+			nextTick = time.Now().Add(AnnounceInterval)
+			t.scheduleNext(nextTick)
+			// A bandwidth budget running low makes rounds BudgetSlowdown ticks apart, then stops them
+			sinceRound++
+			if stage := dht.budgetStage(); stage >= BudgetInboundOnly || (stage >= BudgetConserve && sinceRound < BudgetSlowdown) {
+				continue
+			}
+			sinceRound = 0
+			announce(AnnounceInterval)
+		case <-t.trigger:
+			announce(InfoChangeSpread)
+		case <-dht.announcer.changed:
+			n := dht.scheduleAnnounces(dht.routingTable.GetAllRoutingTableNodes(), InfoChangeSpread)
+			log.Printf("Info changed, announcing to %d peers over %s", n, InfoChangeSpread)
+		case <-sendTicker.C:
+			dht.sendDueAnnounces()
 		}
 	}
 }
@@ -42,46 +111,63 @@ func (dht *DHT) announceLoop() {
 func (dht *DHT) peerLivenessLoop() {
 	defer dht.wg.Done()
 
-	// Wait for initial bootstrap
-	time.Sleep(30 * time.Second)
+	t := dht.tasks.register(TaskLiveness, every(LivenessTickInterval))
+	t.scheduleNext(time.Now().Add(30*time.Second + LivenessTickInterval))
 
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+	// Wait for initial bootstrap (a manual run waits for it too)
+	select {
+	case <-dht.shutdown:
+		return
+	case <-time.After(30 * time.Second):
+	}
+
+	livenessTicker := time.NewTicker(LivenessTickInterval)
+	defer livenessTicker.Stop()
+	inboundTicker := time.NewTicker(InboundCheckInterval)
+	defer inboundTicker.Stop()
 
 	for {
 		select {
 		case <-dht.shutdown:
 			return
-		case <-ticker.C:
-			dht.checkPeerLiveness()
+		case <-livenessTicker.C:
+			t.scheduleNext(time.Now().Add(LivenessTickInterval))
+		case <-t.trigger:
+		case <-inboundTicker.C:
 			dht.checkInboundStatus()
+			continue
 		}
+		t.run(func() (int, error) { return dht.checkPeerLiveness(), nil })
 	}
 }
 
-// checkPeerLiveness pings a sample of peers to verify they're alive
-// Uses sampling to scale to large networks (20K+ nodes)
-// Organic contact (announces, FIND_NODE responses) provides additional verification
-func (dht *DHT) checkPeerLiveness() {
-	allNodes := dht.routingTable.GetAllRoutingTableNodes()
-	if len(allNodes) == 0 {
-		return
+// checkPeerLiveness pings the peers whose per-peer liveness check is due
+// Healthy peers are checked every ~LivenessInterval, failing ones back off exponentially,
+// and peers verified recently by organic contact (announces, FIND_NODE) are skipped
+// Sampling still caps each round to scale to large networks (20K+ nodes)
+// Returns how many peers were pinged
+func (dht *DHT) checkPeerLiveness() int {
+	dueNodes := dht.routingTable.DueForLiveness(time.Now(), dht.livenessStretch())
+	if len(dueNodes) == 0 {
+		// Still evict nodes that other traffic marked as failed
+		dht.evictDeadNodes()
+		return 0
 	}
 
-	// Sample peers if we have more than LivenessSampleSize
+	// Sample peers if more than LivenessSampleSize are due; the rest stay due for next tick
 	var nodes []*System
-	if len(allNodes) <= LivenessSampleSize {
-		nodes = allNodes
+	if len(dueNodes) <= LivenessSampleSize {
+		nodes = dueNodes
 	} else {
 		// Random sample without replacement
 		nodes = make([]*System, LivenessSampleSize)
-		perm := rand.Perm(len(allNodes))
+		perm := rand.Perm(len(dueNodes))
 		for i := 0; i < LivenessSampleSize; i++ {
-			nodes[i] = allNodes[perm[i]]
+			nodes[i] = dueNodes[perm[i]]
 		}
 	}
 
-	log.Printf("Checking liveness of %d peers (of %d total)...", len(nodes), len(allNodes))
+	log.Printf("Checking liveness of %d due peers (of %d routing table peers)...", len(nodes), dht.routingTable.GetRoutingTableSize())
 
 	alive := 0
 	dead := 0
@@ -97,8 +183,10 @@ func (dht *DHT) checkPeerLiveness() {
 		} else {
 			// Also announce ourselves so they know we're alive
 			dht.AnnounceToSystem(sys)
+			dht.checkLatency(sys)
 			alive++
 		}
+		dht.routingTable.ScheduleLivenessCheck(sys.ID)
 	}
 
 	if dead > 0 {
@@ -106,54 +194,39 @@ func (dht *DHT) checkPeerLiveness() {
 	}
 
 	// Evict nodes that have failed too many times
-	evicted := dht.routingTable.EvictDeadNodes()
-	if evicted > 0 {
-		log.Printf("Evicted %d dead nodes from routing table", evicted)
-	}
+	dht.evictDeadNodes()
+	return alive + dead
 }
 
-// announceToNetwork announces ourselves to the K closest nodes
-func (dht *DHT) announceToNetwork() {
-	log.Printf("Announcing presence to network...")
-
-	// Find K closest nodes to ourselves
-	result := dht.FindNode(dht.localSystem.ID)
-
-	announced := 0
-	for _, sys := range result.ClosestNodes {
-		if sys.ID == dht.localSystem.ID {
-			continue // Don't announce to ourselves
-		}
-		if sys.PeerAddress == "" {
-			continue
-		}
-
-		if err := dht.AnnounceToSystem(sys); err != nil {
-			log.Printf("  Failed to announce to %s: %v", sys.Name, err)
-			dht.routingTable.MarkFailed(sys.ID)
-		} else {
-			announced++
-			dht.routingTable.MarkVerified(sys.ID)
-		}
+// evictDeadNodes drops nodes that failed too many pings and tells our peers they're unreachable
+func (dht *DHT) evictDeadNodes() {
+	evicted := dht.routingTable.EvictDeadNodes()
+	if len(evicted) == 0 {
+		return
 	}
-
-	log.Printf("Announced to %d nodes", announced)
+	log.Printf("Evicted %d dead nodes from routing table", len(evicted))
+	go dht.retractDeadNodes(evicted)
 }
 
 // cacheMaintenanceLoop periodically prunes the system cache
 func (dht *DHT) cacheMaintenanceLoop() {
 	defer dht.wg.Done()
 
+	t := dht.tasks.register(TaskCachePrune, every(CachePruneInterval))
+
 	ticker := time.NewTicker(CachePruneInterval)
 	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(CachePruneInterval))
 
 	for {
 		select {
 		case <-dht.shutdown:
 			return
 		case <-ticker.C:
-			dht.pruneCache()
+			t.scheduleNext(time.Now().Add(CachePruneInterval))
+		case <-t.trigger:
 		}
+		t.run(dht.pruneCache)
 	}
 }
 
@@ -163,8 +236,15 @@ func (dht *DHT) cacheMaintenanceLoop() {
 func (dht *DHT) gossipValidationLoop() {
 	defer dht.wg.Done()
 
-	// Wait for initial bootstrap before validating
-	time.Sleep(2 * time.Minute)
+	t := dht.tasks.register(TaskGossipValidation, every(10*time.Minute))
+	t.scheduleNext(time.Now().Add(12 * time.Minute))
+
+	// Wait for initial bootstrap before validating (a manual run waits for it too)
+	select {
+	case <-dht.shutdown:
+		return
+	case <-time.After(2 * time.Minute):
+	}
 
 	// Run every 10 minutes - validate a batch of unverified systems
 	ticker := time.NewTicker(10 * time.Minute)
@@ -175,17 +255,20 @@ func (dht *DHT) gossipValidationLoop() {
 		case <-dht.shutdown:
 			return
 		case <-ticker.C:
-			dht.validateGossipSystems()
+			t.scheduleNext(time.Now().Add(10 * time.Minute))
+		case <-t.trigger:
 		}
+		t.run(func() (int, error) { return dht.validateGossipSystems(), nil })
 	}
 }
 
 // validateGossipSystems attempts to verify systems that were learned via gossip
 // but never directly contacted. This closes the loop on gossip propagation.
-func (dht *DHT) validateGossipSystems() {
+// Returns how many systems were checked.
+func (dht *DHT) validateGossipSystems() int {
 	unverified := dht.routingTable.GetUnverifiedCachedSystems()
 	if len(unverified) == 0 {
-		return
+		return 0
 	}
 
 	// Validate up to 10 systems per cycle to avoid flooding
@@ -200,91 +283,111 @@ func (dht *DHT) validateGossipSystems() {
 	removed := 0
 
 	for i := 0; i < maxValidate; i++ {
-		sys := unverified[i]
-		if sys.PeerAddress == "" {
-			// Can't verify without address - remove from cache
-			dht.routingTable.RemoveFromCache(sys.ID)
-			removed++
-			continue
-		}
-
-		// Try to ping the system directly
-		respSystem, err := dht.Ping(sys.PeerAddress)
-		if err != nil {
-			// Failed to contact - check if this is the expected system
-			// The Ping function already handles UUID mismatches
-			// For now, just mark that we tried (fail count is tracked elsewhere)
-			log.Printf("  %s (%s): unreachable - %v", sys.Name, sys.ID.String()[:8], err)
-
-			// If we've never verified this system and it's unreachable,
-			// remove it from cache to prevent ghost propagation
-			cached := dht.routingTable.GetCachedSystemMeta(sys.ID)
-			if cached != nil && cached.LastVerified.IsZero() {
-				// Never verified at all - likely a ghost, remove it
-				dht.routingTable.RemoveFromCache(sys.ID)
-				removed++
-			}
-		} else if respSystem != nil && respSystem.ID != sys.ID {
-			// UUID mismatch - a different system now lives at this address
-			// The gossip entry is stale, remove it
-			log.Printf("  %s (%s): UUID mismatch - address now belongs to %s (%s), removing stale entry",
-				sys.Name, sys.ID.String()[:8], respSystem.Name, respSystem.ID.String()[:8])
-			dht.routingTable.RemoveFromCache(sys.ID)
-			if err := dht.storage.DeletePeerSystem(sys.ID); err != nil {
-				log.Printf("Warning: failed to delete stale peer system %s: %v", sys.ID.String()[:8], err)
-			}
-			removed++
-		} else {
+		switch dht.validateGossipSystem(unverified[i]) {
+		case gossipVerified:
 			verified++
-			log.Printf("  %s: verified", sys.Name)
+		case gossipRemoved:
+			removed++
 		}
 	}
 
 	if verified > 0 || removed > 0 {
 		log.Printf("Gossip validation: %d verified, %d removed as ghosts", verified, removed)
 	}
+	return maxValidate
+}
+
+// Outcomes of validateGossipSystem
+const (
+	gossipUnreachable = iota // No answer, but it was verified once; left for the liveness loop
+	gossipVerified
+	gossipRemoved
+)
+
+// validateGossipSystem pings one system we only know from gossip (or an import) at its
+// address, dropping it if nothing answers or another system lives there now
+func (dht *DHT) validateGossipSystem(sys *System) int {
+	if sys.PeerAddress == "" {
+		// Can't verify without address - remove from cache
+		dht.routingTable.RemoveFromCache(sys.ID)
+		return gossipRemoved
+	}
+
+	// Try to ping the system directly
+	respSystem, err := dht.Ping(sys.PeerAddress)
+	if err != nil {
+		// Failed to contact - check if this is the expected system
+		// The Ping function already handles UUID mismatches
+		// For now, just mark that we tried (fail count is tracked elsewhere)
+		log.Printf("  %s (%s): unreachable - %v", sys.Name, sys.ID.String()[:8], err)
+
+		// If we've never verified this system and it's unreachable,
+		// remove it from cache to prevent ghost propagation
+		cached := dht.routingTable.GetCachedSystemMeta(sys.ID)
+		if cached != nil && cached.LastVerified.IsZero() {
+			// Never verified at all - likely a ghost, remove it
+			dht.routingTable.RemoveFromCache(sys.ID)
+			return gossipRemoved
+		}
+		return gossipUnreachable
+	}
+	if respSystem != nil && respSystem.ID != sys.ID {
+		// UUID mismatch - a different system now lives at this address
+		// The gossip entry is stale, remove it
+		log.Printf("  %s (%s): UUID mismatch - address now belongs to %s (%s), removing stale entry",
+			sys.Name, sys.ID.String()[:8], respSystem.Name, respSystem.ID.String()[:8])
+		dht.routingTable.RemoveFromCache(sys.ID)
+		if err := dht.storage.DeletePeerSystem(sys.ID); err != nil {
+			log.Printf("Warning: failed to delete stale peer system %s: %v", sys.ID.String()[:8], err)
+		}
+		return gossipRemoved
+	}
+	log.Printf("  %s: verified", sys.Name)
+	return gossipVerified
 }
 
 // pruneCache removes stale entries from the system cache and storage
-func (dht *DHT) pruneCache() {
+// Returns how many entries were removed, and the storage errors hit along the way
+func (dht *DHT) pruneCache() (int, error) {
+	var errs []error
+
 	// Prune in-memory cache
 	pruned := dht.routingTable.PruneCache(CacheMaxAge)
 	if pruned > 0 {
 		log.Printf("Pruned %d stale entries from system cache", pruned)
 	}
 
-	// Prune peer_systems table
-	prunedSystems, err := dht.storage.PrunePeerSystems(CacheMaxAge)
+	// The peer tables age as fast as the cache, so their limits are enforced here too
+	trimmed, err := dht.trimTables(RetainPeerSystems, RetainPeerConnections)
 	if err != nil {
-		log.Printf("Error pruning peer systems: %v", err)
-	} else if prunedSystems > 0 {
-		log.Printf("Pruned %d stale entries from peer_systems table", prunedSystems)
+		errs = append(errs, err)
 	}
 
-	// Prune peer_connections table
-	prunedConns, err := dht.storage.PrunePeerConnections(CacheMaxAge)
-	if err != nil {
-		log.Printf("Error pruning peer connections: %v", err)
-	} else if prunedConns > 0 {
-		log.Printf("Pruned %d stale entries from peer_connections table", prunedConns)
+	// Per-peer traffic and clock skew are only kept for systems still cached
+	cached := func(id uuid.UUID) bool { return dht.routingTable.GetCachedSystemMeta(id) != nil }
+	dht.traffic.forget(cached)
+	dht.messageTraffic.forget(cached)
+	dht.clockSkews.forget(cached)
+
+	// Forget unreachable claims that no longer count
+	dht.routingTable.PruneSuspicions()
+	if _, err := dht.storage.PruneSuspicions(time.Now().Add(-RetractionWindow).Unix()); err != nil {
+		log.Printf("Error pruning suspicions: %v", err)
+		errs = append(errs, fmt.Errorf("pruning suspicions: %w", err))
 	}
-}
 
-// GetNetworkStats returns statistics about the DHT network
-func (dht *DHT) GetNetworkStats() map[string]interface{} {
-	rtSize := dht.routingTable.GetRoutingTableSize()
-	cacheSize := dht.routingTable.GetCacheSize()
-	unverifiedCount := dht.routingTable.GetUnverifiedCount()
-
-	return map[string]interface{}{
-		"local_id":           dht.localSystem.ID.String(),
-		"local_name":         dht.localSystem.Name,
-		"routing_table_size": rtSize,
-		"cache_size":         cacheSize,
-		"verified_peers":     rtSize,
-		"unverified_peers":   unverifiedCount,
-		"max_peers":          MaxPeers,
+	// Forget conflicts settled long ago
+	if n, err := dht.storage.PruneAddressConflicts(AddressConflictLogAge); err != nil {
+		log.Printf("Error pruning address conflicts: %v", err)
+		errs = append(errs, fmt.Errorf("pruning address conflicts: %w", err))
+	} else if n > 0 {
+		log.Printf("Pruned %d resolved address conflicts", n)
 	}
+
+	// Lift temporary blocks that have expired
+	dht.pruneExpiredBlocks()
+
+	return pruned + trimmed, errors.Join(errs...)
 }
 
 // =============================================================================
@@ -295,54 +398,178 @@ func (dht *DHT) GetNetworkStats() map[string]interface{} {
 func (dht *DHT) creditCalculationLoop() {
 	defer dht.wg.Done()
 
+	t := dht.tasks.register(TaskCredits, every(time.Hour))
+
 	// Calculate every hour
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
+	firstTick := time.Now().Add(time.Hour)
 
-	// Initial calculation after 5 minutes
+	// Initial calculation after 5 minutes, or on request
+	t.scheduleNext(time.Now().Add(5 * time.Minute))
 	select {
 	case <-dht.shutdown:
 		return
 	case <-time.After(5 * time.Minute):
-		dht.calculateCredits()
+	case <-t.trigger:
 	}
+	t.scheduleNext(firstTick)
+	t.run(dht.calculateCredits)
 
 	for {
 		select {
 		case <-dht.shutdown:
 			return
 		case <-ticker.C:
-			dht.calculateCredits()
+			t.scheduleNext(time.Now().Add(time.Hour))
+		case <-t.trigger:
 		}
+		t.run(dht.calculateCredits)
 	}
 }
 
 // calculateCredits computes and stores earned credits based on attestations
-func (dht *DHT) calculateCredits() {
+// Returns how many attestations, compacted summaries and service receipts were counted
+func (dht *DHT) calculateCredits() (int, error) {
 	log.Printf("Calculating stellar credits...")
 
+	// Hold the credit lock so an in-flight transfer can't be overwritten
+	dht.creditMu.Lock()
+	defer dht.creditMu.Unlock()
+
+	cycle, err := dht.computeCreditCycle(time.Now())
+	if err != nil || cycle == nil {
+		return 0, err
+	}
+
+	// Nothing is saved until the whole cycle is: a restart before this recalculates the
+	// same window, and committing a window twice is a no-op
+	committed, err := dht.storage.CommitCreditCalculation(cycle.input.LastCalculation, cycle.balance, cycle.earning)
+	if err != nil {
+		log.Printf("  ERROR: Failed to save credit calculation: %v", err)
+		return 0, err
+	}
+	if !committed {
+		log.Printf("  Window from %d was already calculated - skipping", cycle.input.LastCalculation)
+		return 0, nil
+	}
+
+	result, balance := cycle.result, cycle.balance
+	if cycle.advanced {
+		rank := GetRank(balance.Balance)
+
+		// Build bonus summary for logging
+		bonusParts := []string{}
+		if result.Bonuses.Bridge > 0.001 {
+			bonusParts = append(bonusParts, fmt.Sprintf("bridge:+%.0f%%", result.Bonuses.Bridge*100))
+		}
+		if result.Bonuses.Longevity > 0.001 {
+			bonusParts = append(bonusParts, fmt.Sprintf("longevity:+%.0f%%", result.Bonuses.Longevity*100))
+		}
+		if result.Bonuses.Pioneer > 0.001 {
+			bonusParts = append(bonusParts, fmt.Sprintf("pioneer:+%.0f%%", result.Bonuses.Pioneer*100))
+		}
+		if result.Bonuses.Reciprocity > 0.001 {
+			bonusParts = append(bonusParts, fmt.Sprintf("reciprocity:+%.1f%%", result.Bonuses.Reciprocity*100))
+		}
+		if result.ServiceCredits > 0.001 {
+			bonusParts = append(bonusParts, fmt.Sprintf("service:+%.2f", result.ServiceCredits))
+		}
+
+		if cycle.wholeCredits > 0 {
+			if len(bonusParts) > 0 {
+				log.Printf("  ✦ Earned %d stellar credits [%s] (total: %d, rank: %s, pending: %.3f)",
+					cycle.wholeCredits, strings.Join(bonusParts, ", "), balance.Balance, rank.Name, balance.PendingCredits)
+			} else {
+				log.Printf("  ✦ Earned %d stellar credits (total: %d, rank: %s, pending: %.3f)",
+					cycle.wholeCredits, balance.Balance, rank.Name, balance.PendingCredits)
+			}
+		} else {
+			// No whole credits this cycle, but fractional credits accumulated
+			log.Printf("  Accumulated %.3f credits (pending: %.3f, need %.3f more for next credit)",
+				result.CreditsEarned, balance.PendingCredits, 1.0-balance.PendingCredits)
+		}
+
+		if result.LongevityBroken {
+			log.Printf("  Longevity streak reset due to >30min gap")
+		}
+	} else {
+		log.Printf("  No credits earned this cycle (base=%.2f)",
+			result.BaseCredits)
+	}
+	return cycle.evidence, nil
+}
+
+// creditCycle is one credit calculation worked out and ready to commit
+type creditCycle struct {
+	input        CalculationInput // Its window runs from LastCalculation to WindowEnd
+	result       CalculationResult
+	balance      *CreditBalance // As it stands after the cycle
+	earning      *CreditEarning
+	advanced     bool  // Something was earned, so last_calculated moves to the window's end
+	wholeCredits int64 // Moved from pending into the balance
+	evidence     int   // Attestations, compacted summaries and service receipts in the window
+}
+
+// computeCreditCycle works out the credits earned from the last calculation up to now,
+// without saving anything (nil if there's no new evidence; caller holds creditMu)
+func (dht *DHT) computeCreditCycle(now time.Time) (*creditCycle, error) {
 	// Get current balance
 	balance, err := dht.storage.GetCreditBalance(dht.localSystem.ID)
 	if err != nil {
 		log.Printf("  ERROR: Failed to get credit balance: %v", err)
-		return
+		return nil, err
 	}
 
 	log.Printf("  Current state: balance=%d, pending=%.3f, last_calculated=%d, longevity_start=%d",
 		balance.Balance, balance.PendingCredits, balance.LastUpdated, balance.LongevityStart)
 
-	// Get attestations since last calculation
+	// A clock set back behind the last calculation gives an empty window rather than a negative one
+	windowEnd := now.Unix()
+	if windowEnd < balance.LastUpdated {
+		log.Printf("  Clock is %ds behind the last calculation - nothing to count until it catches up",
+			balance.LastUpdated-windowEnd)
+		windowEnd = balance.LastUpdated
+	}
+
+	// Get attestations since last calculation, including any still buffered
+	if err := dht.FlushAttestations(); err != nil {
+		log.Printf("  ERROR: Failed to save buffered attestations: %v", err)
+		return nil, err
+	}
 	attestations, err := dht.storage.GetAttestationsSince(dht.localSystem.ID, balance.LastUpdated)
 	if err != nil {
 		log.Printf("  ERROR: Failed to get attestations: %v", err)
-		return
+		return nil, err
+	}
+
+	// Compacted summaries cover any part of the window whose detail is gone
+	spans, err := dht.storage.GetAttestationSpansSince(dht.localSystem.ID, balance.LastUpdated)
+	if err != nil {
+		log.Printf("  ERROR: Failed to get attestation summaries: %v", err)
+		return nil, err
+	}
+
+	// Service receipts earn credits of their own rather than counting as uptime
+	attestations = withoutServiceReceipts(attestations)
+	receipts, receiptIdentities, err := dht.serviceReceiptsSince(balance.LastUpdated)
+	if err != nil {
+		log.Printf("  ERROR: Failed to get service receipts: %v", err)
+		return nil, err
+	}
+	newReceipts := 0
+	for _, r := range receipts {
+		if r.LocalTime() > balance.LastUpdated && r.LocalTime() <= windowEnd {
+			newReceipts++
+		}
 	}
 
-	log.Printf("  Found %d attestations since last calculation", len(attestations))
+	log.Printf("  Found %d attestations, %d compacted summaries and %d service receipts since last calculation",
+		len(attestations), len(spans), newReceipts)
 
-	if len(attestations) == 0 {
+	if len(attestations) == 0 && len(spans) == 0 && newReceipts == 0 {
 		log.Printf("  No new attestations - skipping calculation")
-		return
+		return nil, nil
 	}
 
 	// Get current peer count for normalization
@@ -354,123 +581,132 @@ func (dht *DHT) calculateCredits() {
 	log.Printf("  Current peer count: %d", peerCount)
 
 	// Calculate inputs for credit calculation
-	bridgeScore := dht.calculateBridgeScore()
+	bridgeScore, avgConnectivity := dht.calculateBridgeScore()
 	galaxySize := dht.routingTable.GetCacheSize() + 1 // +1 for self
-	reciprocityRatio := dht.calculateReciprocityRatio(attestations)
+	reciprocityRatio := dht.calculateReciprocityRatio(attestations, spans)
 
-	log.Printf("  Inputs: bridge_score=%.3f, galaxy_size=%d, reciprocity=%.3f",
-		bridgeScore, galaxySize, reciprocityRatio)
+	log.Printf("  Inputs: bridge_score=%.3f (network avg %.2f peers), galaxy_size=%d, reciprocity=%.3f",
+		bridgeScore, avgConnectivity, galaxySize, reciprocityRatio)
 
 	// Build calculation input
 	input := CalculationInput{
 		Attestations:     attestations,
+		Spans:            spans,
 		PeerCount:        peerCount,
 		LastCalculation:  balance.LastUpdated,
+		WindowEnd:        windowEnd,
 		LongevityStart:   balance.LongevityStart,
 		BridgeScore:      bridgeScore,
 		GalaxySize:       galaxySize,
 		ReciprocityRatio: reciprocityRatio,
+		AvgConnectivity:  avgConnectivity,
+
+		ServiceReceipts:   receipts,
+		ReceiptIdentities: receiptIdentities,
 	}
 
 	// Calculate earned credits with all bonuses
 	calculator := NewCreditCalculator()
 	result := calculator.CalculateEarnedCredits(input)
 
-	log.Printf("  Calculation result: earned=%.3f, base=%.3f",
-		result.CreditsEarned, result.BaseCredits)
+	log.Printf("  Calculation result: earned=%.3f, base=%.3f, service=%.3f",
+		result.CreditsEarned, result.BaseCredits, result.ServiceCredits)
+
+	cycle := &creditCycle{
+		input:    input,
+		result:   result,
+		balance:  balance,
+		// Keep the breakdown for /api/credits/history, including cycles that earned nothing
+		earning:  NewCreditEarning(input, result, now),
+		evidence: len(attestations) + len(spans) + newReceipts,
+	}
 
 	if result.CreditsEarned > 0 || result.BaseCredits > 0 {
 		// Add earned credits to pending balance
 		pending := balance.PendingCredits + result.CreditsEarned
 		
 		// Extract whole credits
-		wholeCredits := int64(pending)
+		cycle.wholeCredits = int64(pending)
 		
 		// Keep fractional part for next time
-		balance.PendingCredits = pending - float64(wholeCredits)
+		balance.PendingCredits = pending - float64(cycle.wholeCredits)
 		
 		// Update balance with whole credits
-		balance.Balance += wholeCredits
-		balance.TotalEarned += wholeCredits
-		balance.LastUpdated = time.Now().Unix()
+		balance.Balance += cycle.wholeCredits
+		balance.TotalEarned += cycle.wholeCredits
+		balance.LastUpdated = windowEnd
 		balance.LongevityStart = result.NewLongevityStart
+		cycle.advanced = true
+	}
+	return cycle, nil
+}
 
-		if err := dht.storage.SaveCreditBalance(balance); err != nil {
-			log.Printf("  ERROR: Failed to save credit balance: %v", err)
-			return
-		}
+// calculateBridgeScore determines how critical this node is for network connectivity,
+// from the topology peers reported within BridgeTopologyMaxAge
+// Returns the score and the network average connectivity it was measured against
+func (dht *DHT) calculateBridgeScore() (float64, float64) {
+	peers := dht.routingTable.GetAllRoutingTableNodes()
+	if len(peers) == 0 {
+		return 0.0, 0.0
+	}
 
-		rank := GetRank(balance.Balance)
+	links, err := dht.storage.GetPeerLinks(BridgeTopologyMaxAge)
+	if err != nil {
+		log.Printf("  Failed to load peer connections for bridge score: %v", err)
+		return 0.0, 0.0
+	}
 
-		// Build bonus summary for logging
-		bonusParts := []string{}
-		if result.Bonuses.Bridge > 0.001 {
-			bonusParts = append(bonusParts, fmt.Sprintf("bridge:+%.0f%%", result.Bonuses.Bridge*100))
-		}
-		if result.Bonuses.Longevity > 0.001 {
-			bonusParts = append(bonusParts, fmt.Sprintf("longevity:+%.0f%%", result.Bonuses.Longevity*100))
-		}
-		if result.Bonuses.Pioneer > 0.001 {
-			bonusParts = append(bonusParts, fmt.Sprintf("pioneer:+%.0f%%", result.Bonuses.Pioneer*100))
-		}
-		if result.Bonuses.Reciprocity > 0.001 {
-			bonusParts = append(bonusParts, fmt.Sprintf("reciprocity:+%.1f%%", result.Bonuses.Reciprocity*100))
-		}
+	peerIDs := make([]uuid.UUID, len(peers))
+	for i, peer := range peers {
+		peerIDs[i] = peer.ID
+	}
+	peerConnectivity, avgConnectivity := bridgeConnectivity(dht.localSystem.ID, peerIDs, links)
+	return CalculateBridgeScore(len(peers), peerConnectivity, avgConnectivity), avgConnectivity
+}
 
-		if wholeCredits > 0 {
-			if len(bonusParts) > 0 {
-				log.Printf("  ✦ Earned %d stellar credits [%s] (total: %d, rank: %s, pending: %.3f)",
-					wholeCredits, strings.Join(bonusParts, ", "), balance.Balance, rank.Name, balance.PendingCredits)
-			} else {
-				log.Printf("  ✦ Earned %d stellar credits (total: %d, rank: %s, pending: %.3f)",
-					wholeCredits, balance.Balance, rank.Name, balance.PendingCredits)
-			}
-		} else {
-			// No whole credits this cycle, but fractional credits accumulated
-			log.Printf("  Accumulated %.3f credits (pending: %.3f, need %.3f more for next credit)",
-				result.CreditsEarned, balance.PendingCredits, 1.0-balance.PendingCredits)
-		}
+// bridgeConnectivity works out CalculateBridgeScore's inputs from the galaxy's links
+// (as Storage.GetPeerLinks returns them) plus our own routing table peers
+// A system's connectivity is how many distinct systems it is linked to; the average
+// is over every system with at least one link, including us
+func bridgeConnectivity(self uuid.UUID, peers []uuid.UUID, links map[uuid.UUID]map[uuid.UUID]bool) ([]int, float64) {
+	degree := linkDegrees(self, peers, links)
 
-		if result.LongevityBroken {
-			log.Printf("  Longevity streak reset due to >30min gap")
-		}
-	} else {
-		log.Printf("  No credits earned this cycle (base=%.2f)",
-			result.BaseCredits)
+	peerConnectivity := make([]int, len(peers))
+	for i, peer := range peers {
+		peerConnectivity[i] = degree[peer]
 	}
-}
 
-// calculateBridgeScore determines how critical this node is for network connectivity
-func (dht *DHT) calculateBridgeScore() float64 {
-	peers := dht.routingTable.GetAllRoutingTableNodes()
-	if len(peers) == 0 {
-		return 0.0
+	total := 0
+	for _, d := range degree {
+		total += d
+	}
+	if len(degree) == 0 {
+		return peerConnectivity, 0
 	}
+	return peerConnectivity, float64(total) / float64(len(degree))
+}
 
-	// For each peer, estimate their connectivity
-	peerConnectivity := make([]int, 0, len(peers))
-	totalConnectivity := 0
+// linkDegrees counts the distinct systems each system is linked to, from the galaxy's links
+// plus our own routing table peers
+func linkDegrees(self uuid.UUID, peers []uuid.UUID, links map[uuid.UUID]map[uuid.UUID]bool) map[uuid.UUID]int {
+	degree := make(map[uuid.UUID]int, len(links)+1)
+	for id, linked := range links {
+		degree[id] = len(linked)
+	}
 
+	// Peers leave us out of the lists they report to us, so our own links are added here
 	for _, peer := range peers {
-		// Estimate peer's connectivity based on their max peers (star class)
-		estimatedConns := peer.GetMaxPeers() / 2
-		if estimatedConns < 1 {
-			estimatedConns = 1
+		if !links[self][peer] {
+			degree[self]++
+			degree[peer]++
 		}
-		peerConnectivity = append(peerConnectivity, estimatedConns)
-		totalConnectivity += estimatedConns
-	}
-
-	avgConnectivity := float64(totalConnectivity) / float64(len(peers))
-	if avgConnectivity < 1 {
-		avgConnectivity = 1
 	}
-
-	return CalculateBridgeScore(len(peers), peerConnectivity, avgConnectivity)
+	return degree
 }
 
 // calculateReciprocityRatio determines what fraction of our peers attest back to us
-func (dht *DHT) calculateReciprocityRatio(attestations []*Attestation) float64 {
+// Local and routing slot peers count alike: both are routing table peers
+func (dht *DHT) calculateReciprocityRatio(attestations []*Attestation, spans []*AttestationSpan) float64 {
 	peers := dht.routingTable.GetAllRoutingTableNodes()
 	if len(peers) == 0 {
 		return 0.0
@@ -484,6 +720,9 @@ func (dht *DHT) calculateReciprocityRatio(attestations []*Attestation) float64 {
 	for _, att := range attestations {
 		heardFrom[att.FromSystemID.String()] = true
 	}
+	for _, span := range spans {
+		heardFrom[span.FromSystemID.String()] = true
+	}
 
 	// Count how many of our routing table peers have attested to us
 	reciprocal := 0
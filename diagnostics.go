@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Diagnostic stages: the steps of joining the network /api/diagnostics reports on
+const (
+	DiagSeedFetch     = "seed_fetch"     // Downloading the seed list
+	DiagCachedPeers   = "cached_peers"   // Rejoining through the last session's peers
+	DiagSeedContact   = "seed_contact"   // Contacting one seed or bootstrap peer
+	DiagSponsor       = "sponsor"        // Picking the system our coordinates are placed near
+	DiagBootstrap     = "bootstrap"      // Bootstrap's overall result
+	DiagAnnounce      = "announce"       // The announce that ends bootstrap
+	DiagInbound       = "inbound"        // Whether any peer has reached us
+	DiagRejection     = "rejection"      // A peer refuses to talk to us for a day
+	DiagSelfRejection = "self_rejection" // A peer refused our own info
+)
+
+// Finding severities, worst last
+const (
+	FindingOK      = "ok"
+	FindingInfo    = "info"
+	FindingWarning = "warning"
+	FindingProblem = "problem"
+)
+
+const (
+	// MaxDiagnosticEvents is how many diagnostic events are kept, across restarts
+	MaxDiagnosticEvents = 100
+
+	// InboundWarningDelay is how long a node may run before having had no inbound
+	// request at all counts as a problem
+	InboundWarningDelay = 10 * time.Minute
+)
+
+// DiagnosticEvent is one recorded outcome
+type DiagnosticEvent struct {
+	At      int64  `json:"at"` // Unix
+	Stage   string `json:"stage"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// DiagnosticFinding is one conclusion about this node, in plain language
+type DiagnosticFinding struct {
+	Severity string `json:"severity"`
+	Title    string `json:"title"`
+	Detail   string `json:"detail"`
+	Advice   string `json:"advice,omitempty"` // What to try next
+}
+
+// DiagnosticsReport is /api/diagnostics
+type DiagnosticsReport struct {
+	Health           string              `json:"health"`
+	RoutingTableSize int                 `json:"routing_table_size"`
+	Findings         []DiagnosticFinding `json:"findings"` // From this run only
+	Events           []DiagnosticEvent   `json:"events"`   // Oldest first, earlier runs included
+}
+
+// diagnose records the outcome of a stage of joining the network
+func (dht *DHT) diagnose(stage string, ok bool, format string, args ...interface{}) {
+	e := DiagnosticEvent{At: time.Now().Unix(), Stage: stage, OK: ok, Message: fmt.Sprintf(format, args...)}
+	if err := dht.storage.SaveDiagnosticEvent(e, MaxDiagnosticEvents); err != nil {
+		log.Printf("Failed to save diagnostic event: %v", err)
+	}
+}
+
+// Diagnostics explains the node's health from what happened since it started
+func (dht *DHT) Diagnostics() (*DiagnosticsReport, error) {
+	events, err := dht.storage.GetDiagnosticEvents()
+	if err != nil {
+		return nil, err
+	}
+	rtSize := dht.routingTable.GetRoutingTableSize()
+
+	var run []DiagnosticEvent
+	for _, e := range events {
+		if e.At >= dht.startTime.Unix() {
+			run = append(run, e)
+		}
+	}
+	return &DiagnosticsReport{
+		Health:           NodeHealth(rtSize).String(),
+		RoutingTableSize: rtSize,
+		Findings:         dht.diagnosticFindings(run, rtSize),
+		Events:           events,
+	}, nil
+}
+
+// diagnosticFindings works through joining in order: seeds, contact, sponsor, announce,
+// then what peers made of us and whether they can reach us
+func (dht *DHT) diagnosticFindings(run []DiagnosticEvent, rtSize int) []DiagnosticFinding {
+	var findings []DiagnosticFinding
+	add := func(severity, title, detail, advice string) {
+		findings = append(findings, DiagnosticFinding{Severity: severity, Title: title, Detail: detail, Advice: advice})
+	}
+	latest := func(stages ...string) (DiagnosticEvent, bool) {
+		return latestEvent(run, false, stages...)
+	}
+
+	if e, ok := latest(DiagSeedFetch); ok && !e.OK {
+		add(FindingWarning, "Couldn't download the seed list", e.Message,
+			"Check that this machine can reach GitHub (DNS, firewall or proxy). Cached, personal and built-in seeds are tried instead.")
+	}
+
+	// Reaching anyone at all, through last session's peers, bootstrap peers or seeds
+	tried, reached := 0, 0
+	for _, e := range run {
+		if e.Stage == DiagCachedPeers || e.Stage == DiagSeedContact {
+			tried++
+			if e.OK {
+				reached++
+			}
+		}
+	}
+	if e, ok := latest(DiagCachedPeers, DiagSeedContact); ok {
+		if reached > 0 {
+			last, _ := latestEvent(run, true, DiagCachedPeers, DiagSeedContact)
+			add(FindingOK, "Reached the network", last.Message, "")
+		} else {
+			add(FindingProblem, "Couldn't reach any seed or bootstrap peer",
+				fmt.Sprintf("Tried %d, none answered. Last: %s", tried, e.Message),
+				"Check that outgoing connections aren't blocked by a firewall, or start with -bootstrap host:port pointing at a node you know is online.")
+		}
+	}
+	if e, ok := latest(DiagBootstrap); ok {
+		if e.OK {
+			add(FindingInfo, "Bootstrap", e.Message, "")
+		} else if tried == 0 {
+			add(FindingProblem, "Nothing to bootstrap from", e.Message,
+				"Start with -bootstrap host:port pointing at a node you know is online, so this node has somewhere to join through.")
+		}
+	}
+
+	if e, ok := latest(DiagSponsor); ok {
+		if e.OK {
+			add(FindingOK, "Sponsor chosen", e.Message, "")
+		} else {
+			severity := FindingProblem
+			if rtSize > 0 {
+				severity = FindingWarning // Joined anyway
+			}
+			add(severity, "No system had room to sponsor this node", e.Message,
+				"The seeds answered, but the systems they listed have no room for another neighbour. Wait a while and restart, or bootstrap from a specific node with -bootstrap.")
+		}
+	}
+
+	if e, ok := latest(DiagAnnounce); ok && !e.OK {
+		add(FindingWarning, "No peer accepted this node's announce", e.Message,
+			"Peers learn about this node from its announce. This usually follows from a problem above or a rejection below.")
+	}
+
+	// What peers made of us
+	if w := dht.routingTable.GetSelfRejectionWarning(); w != nil {
+		add(FindingProblem, "Peers are rejecting this node's own info",
+			fmt.Sprintf("%d peers refused it in the last hour. Latest reason: %s", w.Peers, w.Reason),
+			selfRejectionAdvice(w.Reason))
+	} else if e, ok := latest(DiagSelfRejection); ok {
+		add(FindingWarning, "A peer rejected this node's own info", e.Message, selfRejectionAdvice(e.Message))
+	}
+	refusals := 0
+	for _, e := range run {
+		if e.Stage == DiagRejection {
+			refusals++
+		}
+	}
+	if e, ok := latest(DiagRejection); ok {
+		add(FindingWarning, "Some peers refuse to talk to this node",
+			fmt.Sprintf("%d refusals since starting. Latest: %s", refusals, e.Message),
+			"An incompatible version means this node or the peer needs upgrading; a block is the other operator's choice. They're tried again after a day.")
+	}
+	if skew, peers := dht.clockSkews.network(); peers >= SelfRejectionQuorum && (skew >= ClockSkewWarning || skew <= -ClockSkewWarning) {
+		// Peers ahead of us means our clock is behind
+		direction := "behind"
+		if skew < 0 {
+			direction, skew = "ahead of", -skew
+		}
+		add(FindingProblem, fmt.Sprintf("This machine's clock is about %d minutes %s the network", int(skew.Round(time.Minute).Minutes()), direction),
+			fmt.Sprintf("Measured against %d peers.", peers),
+			fmt.Sprintf("Turn on automatic time sync (NTP). Peers refuse messages signed more than %v off.", TimestampTolerance))
+	}
+
+	// Whether peers can reach us
+	dht.inboundMu.RLock()
+	hasInbound, lastInbound := dht.hasReceivedInbound, dht.lastInbound
+	dht.inboundMu.RUnlock()
+	uptime := time.Since(dht.startTime)
+	switch {
+	case hasInbound:
+		add(FindingOK, "Other nodes can reach this one",
+			fmt.Sprintf("Last inbound request %v ago.", time.Since(lastInbound).Round(time.Second)), "")
+	case uptime >= InboundWarningDelay:
+		add(FindingProblem, fmt.Sprintf("No other node has connected in %v", uptime.Round(time.Minute)),
+			fmt.Sprintf("This node can probably see the network but nobody can reach it. Peers are told to use %s; listening on %s; %s.",
+				dht.advertisedAddress(), dht.listenAddr, dht.portMappingStatus()),
+			"Forward the DHT port on your router to this machine, allow it through the firewall, and check that -public-address is this machine's public host and port.")
+	default:
+		add(FindingInfo, "Waiting for a first inbound connection",
+			fmt.Sprintf("Peers can take a few minutes to contact a new node; this is checked again after %v.", InboundWarningDelay), "")
+	}
+
+	if rtSize == 0 && len(run) == 0 {
+		add(FindingInfo, "Still joining", "Nothing has been recorded about joining the network yet in this run.", "")
+	}
+	return findings
+}
+
+// latestEvent returns the last event of the stages (the last successful one with okOnly)
+func latestEvent(run []DiagnosticEvent, okOnly bool, stages ...string) (DiagnosticEvent, bool) {
+	for i := len(run) - 1; i >= 0; i-- {
+		for _, stage := range stages {
+			if run[i].Stage == stage && (run[i].OK || !okOnly) {
+				return run[i], true
+			}
+		}
+	}
+	return DiagnosticEvent{}, false
+}
+
+// selfRejectionAdvice suggests a fix for a peer refusing our own info
+func selfRejectionAdvice(reason string) string {
+	switch {
+	case strings.Contains(reason, "timestamp"):
+		return "This machine's clock is probably wrong: turn on automatic time sync (NTP)."
+	case strings.Contains(reason, "coordinates"), strings.Contains(reason, "star system"):
+		return "This node's coordinates or stars don't match its identity, usually because the database was edited or copied from another node. Restore the original database or start fresh with a new one."
+	case strings.Contains(reason, "identity"), strings.Contains(reason, "signature"):
+		return "This node's keys don't match its ID, usually because the database was copied from another node or -seed changed. Restore the original database or start fresh with a new one."
+	}
+	return "Check this node's clock, database and identity."
+}
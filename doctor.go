@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DoctorCheck is the outcome of one database health check
+type DoctorCheck struct {
+	Name      string
+	Found     int // Problems found
+	Fixed     int // Problems repaired (only with -doctor-fix)
+	Unfixable int // Problems no safe repair exists for
+	Detail    string
+}
+
+// Remaining returns how many problems are still there after this run
+func (c DoctorCheck) Remaining() int {
+	return c.Found - c.Fixed
+}
+
+// dbQuerier is satisfied by both *sql.DB and *sql.Tx, so checks can run read-only or inside the repair transaction
+type dbQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// doctorCheck finds problems and, when fix is set, repairs the safe ones
+type doctorCheck func(q dbQuerier, localID string, fix bool) (DoctorCheck, error)
+
+// doctorChecks run in order after the integrity check
+var doctorChecks = []doctorCheck{
+	checkOrphanedAttestations,
+	checkPeerSystemIDs,
+	checkCreditBalances,
+	checkPeerConnections,
+}
+
+// RunDoctor checks the database and, with fix, repairs what it safely can
+// Repairs happen in one transaction, after a backup copy is written to backupPath
+func (s *Storage) RunDoctor(fix bool, backupPath string) ([]DoctorCheck, error) {
+	integrity, err := s.checkIntegrity()
+	if err != nil {
+		return nil, err
+	}
+	results := []DoctorCheck{integrity}
+
+	// The local system ID is read directly - LoadSystem may be what's broken
+	var localID string
+	s.read.QueryRow("SELECT id FROM system LIMIT 1").Scan(&localID)
+
+	fixable := 0
+	for _, check := range doctorChecks {
+		result, err := check(s.read, localID, false)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+		fixable += result.Found - result.Unfixable
+	}
+
+	if !fix || fixable == 0 {
+		return results, nil
+	}
+
+	if err := s.BackupTo(backupPath); err != nil {
+		return nil, fmt.Errorf("backup failed, nothing was changed: %w", err)
+	}
+	log.Printf("Backup written to %s", backupPath)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results = results[:1]
+	for _, check := range doctorChecks {
+		result, err := check(tx, localID, true)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// BackupTo writes a consistent copy of the database to path
+func (s *Storage) BackupTo(path string) error {
+	_, err := s.db.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// checkIntegrity runs SQLite's own consistency check
+// Page-level corruption can't be repaired from here; restore a backup instead
+func (s *Storage) checkIntegrity() (DoctorCheck, error) {
+	result := DoctorCheck{Name: "integrity_check"}
+
+	rows, err := s.read.Query("PRAGMA integrity_check")
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return result, err
+		}
+		if line == "ok" {
+			continue
+		}
+		if result.Found == 0 {
+			result.Detail = line
+		}
+		result.Found++
+	}
+	result.Unfixable = result.Found
+	return result, rows.Err()
+}
+
+// checkOrphanedAttestations finds attestations from systems with no identity binding
+// Every attestation is signature-checked against the key it carries, so when all of a
+// system's orphans agree on one key the binding is restored from it. Conflicting keys
+// can't be told apart and are left alone.
+func checkOrphanedAttestations(q dbQuerier, localID string, fix bool) (DoctorCheck, error) {
+	result := DoctorCheck{Name: "orphaned attestations"}
+
+	rows, err := q.Query(`
+		SELECT from_system_id, public_key, COUNT(*), MIN(timestamp)
+		FROM attestations
+		WHERE from_system_id != ? AND from_system_id NOT IN (SELECT system_id FROM identity_bindings)
+		GROUP BY from_system_id, public_key
+	`, localID)
+	if err != nil {
+		return result, err
+	}
+
+	type orphan struct {
+		publicKey string
+		count     int
+		firstSeen int64
+	}
+	bySystem := make(map[string][]orphan)
+	for rows.Next() {
+		var systemID string
+		var o orphan
+		if err := rows.Scan(&systemID, &o.publicKey, &o.count, &o.firstSeen); err != nil {
+			rows.Close()
+			return result, err
+		}
+		bySystem[systemID] = append(bySystem[systemID], o)
+		result.Found += o.count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	conflicting := 0
+	for systemID, orphans := range bySystem {
+		if len(orphans) > 1 {
+			conflicting++
+			for _, o := range orphans {
+				result.Unfixable += o.count
+			}
+			continue
+		}
+		if !fix {
+			continue
+		}
+		if _, err := q.Exec(`INSERT INTO identity_bindings (system_id, public_key, first_seen) VALUES (?, ?, ?)`,
+			systemID, orphans[0].publicKey, orphans[0].firstSeen); err != nil {
+			return result, err
+		}
+		result.Fixed += orphans[0].count
+	}
+
+	if len(bySystem) > 0 {
+		result.Detail = fmt.Sprintf("%d unbound systems, %d signing with conflicting keys", len(bySystem), conflicting)
+	}
+	return result, nil
+}
+
+// checkPeerSystemIDs finds peer_systems rows whose UUIDs don't parse or aren't in canonical form
+// Non-canonical IDs ("ABC..." vs "abc...") are how a crash left duplicate rows for one system
+func checkPeerSystemIDs(q dbQuerier, localID string, fix bool) (DoctorCheck, error) {
+	result := DoctorCheck{Name: "peer_systems IDs"}
+
+	rows, err := q.Query(`SELECT id, COALESCE(sponsor_id, '') FROM peer_systems`)
+	if err != nil {
+		return result, err
+	}
+
+	var badIDs, badSponsors []string
+	renames := make(map[string]string) // non-canonical id -> canonical
+	for rows.Next() {
+		var id, sponsor string
+		if err := rows.Scan(&id, &sponsor); err != nil {
+			rows.Close()
+			return result, err
+		}
+		parsed, err := uuid.Parse(id)
+		switch {
+		case err != nil:
+			badIDs = append(badIDs, id)
+		case parsed.String() != id:
+			renames[id] = parsed.String()
+		}
+		if sponsor != "" {
+			if _, err := uuid.Parse(sponsor); err != nil {
+				badSponsors = append(badSponsors, id)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	result.Found = len(badIDs) + len(renames) + len(badSponsors)
+	if result.Found > 0 {
+		result.Detail = fmt.Sprintf("%d unparsable, %d non-canonical, %d bad sponsor IDs",
+			len(badIDs), len(renames), len(badSponsors))
+	}
+	if !fix {
+		return result, nil
+	}
+
+	// The peer is re-learned on next contact, so dropping a bad row loses nothing
+	for _, id := range badIDs {
+		if _, err := q.Exec(`DELETE FROM peer_systems WHERE id = ?`, id); err != nil {
+			return result, err
+		}
+		result.Fixed++
+	}
+	for _, id := range badSponsors {
+		if _, err := q.Exec(`UPDATE peer_systems SET sponsor_id = NULL WHERE id = ?`, id); err != nil {
+			return result, err
+		}
+		result.Fixed++
+	}
+	// Keep the canonical row when both exist, otherwise rename in place
+	for id, canonical := range renames {
+		if _, err := q.Exec(`UPDATE OR IGNORE peer_systems SET id = ? WHERE id = ?`, canonical, id); err != nil {
+			return result, err
+		}
+		if _, err := q.Exec(`DELETE FROM peer_systems WHERE id = ?`, id); err != nil {
+			return result, err
+		}
+		result.Fixed++
+	}
+	return result, nil
+}
+
+// checkCreditBalances verifies balance = total_earned + total_received - total_sent
+// Every code path moves a balance and its total together, so the totals are the ledger
+// and a drifted balance is recomputed from them. Negative totals are left for a human.
+func checkCreditBalances(q dbQuerier, localID string, fix bool) (DoctorCheck, error) {
+	result := DoctorCheck{Name: "credit_balance"}
+
+	rows, err := q.Query(`SELECT system_id, balance, total_earned, total_sent, total_received FROM credit_balance`)
+	if err != nil {
+		return result, err
+	}
+
+	drifted := make(map[string]int64) // system_id -> correct balance
+	for rows.Next() {
+		var systemID string
+		var balance, earned, sent, received int64
+		if err := rows.Scan(&systemID, &balance, &earned, &sent, &received); err != nil {
+			rows.Close()
+			return result, err
+		}
+		expected := earned + received - sent
+		switch {
+		case earned < 0 || sent < 0 || received < 0 || expected < 0:
+			result.Found++
+			result.Unfixable++
+			result.Detail = fmt.Sprintf("%s has negative totals", systemID)
+		case balance != expected:
+			result.Found++
+			drifted[systemID] = expected
+			if result.Detail == "" {
+				result.Detail = fmt.Sprintf("%s balance %d, totals say %d", systemID, balance, expected)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	if !fix {
+		return result, nil
+	}
+	for systemID, expected := range drifted {
+		if _, err := q.Exec(`UPDATE credit_balance SET balance = ?, updated_at = ? WHERE system_id = ?`,
+			expected, time.Now().Unix(), systemID); err != nil {
+			return result, err
+		}
+		result.Fixed++
+	}
+	return result, nil
+}
+
+// checkPeerConnections finds topology rows that mention systems we know nothing about
+// They're re-reported by peers on the next exchange, so deleting them is safe
+func checkPeerConnections(q dbQuerier, localID string, fix bool) (DoctorCheck, error) {
+	result := DoctorCheck{Name: "peer_connections"}
+
+	const unknown = `
+		FROM peer_connections
+		WHERE (system_id != ?1 AND system_id NOT IN (SELECT id FROM peer_systems))
+		   OR (peer_id != ?1 AND peer_id NOT IN (SELECT id FROM peer_systems))`
+
+	if err := q.QueryRow(`SELECT COUNT(*) `+unknown, localID).Scan(&result.Found); err != nil {
+		return result, err
+	}
+	if result.Found > 0 {
+		result.Detail = "rows referencing systems not in peer_systems"
+	}
+	if !fix || result.Found == 0 {
+		return result, nil
+	}
+
+	res, err := q.Exec(`DELETE `+unknown, localID)
+	if err != nil {
+		return result, err
+	}
+	fixed, _ := res.RowsAffected()
+	result.Fixed = int(fixed)
+	return result, nil
+}
+
+// runDoctor is the -doctor CLI mode: prints a report and returns the process exit code
+func runDoctor(dbPath string, fix bool) int {
+	storage, err := NewStorage(dbPath)
+	if err != nil {
+		log.Printf("Failed to open database: %v", err)
+		return 1
+	}
+	defer storage.Close()
+
+	backupPath := fmt.Sprintf("%s.doctor-%s.bak", dbPath, time.Now().Format("20060102-150405"))
+	results, err := storage.RunDoctor(fix, backupPath)
+	if err != nil {
+		log.Printf("Doctor failed: %v", err)
+		return 1
+	}
+
+	remaining, unfixable := 0, 0
+	for _, r := range results {
+		status := "ok"
+		if r.Found > 0 {
+			status = fmt.Sprintf("%d found, %d fixed, %d unfixable", r.Found, r.Fixed, r.Unfixable)
+		}
+		log.Printf("  %-22s %s", r.Name, status)
+		if r.Detail != "" {
+			log.Printf("  %-22s   %s", "", r.Detail)
+		}
+		remaining += r.Remaining()
+		unfixable += r.Unfixable
+	}
+
+	switch {
+	case remaining == 0:
+		log.Printf("Database is healthy")
+		return 0
+	case !fix && remaining > unfixable:
+		log.Printf("%d problems found (%d fixable with -doctor-fix)", remaining, remaining-unfixable)
+	default:
+		log.Printf("%d problems remain that can't be fixed automatically", remaining)
+	}
+	return 1
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types pushed to live listeners (the web UI's /ws socket)
+const (
+	EventPeerAdded          = "peer_added"           // System entered the routing table (verified, recent, responding)
+	EventPeerRemoved        = "peer_removed"         // System left the routing table, or was dropped from the cache entirely
+	EventPeerStateChanged   = "peer_state_changed"   // active/degraded/pending/stale transition
+	EventSystemLearned      = "system_learned"       // New system cached, or newer info for a known one
+	EventConnectionChanged  = "connection_changed"   // A peer's reported peer list was saved
+	EventLocalSystemChanged = "local_system_changed" // Our own system info changed (e.g. renamed)
+	EventStats              = "stats"                // Periodic stats delta (only changed fields)
+)
+
+// Event describes a state change at the point it happened
+type Event struct {
+	Type        string      `json:"type"`
+	SystemID    string      `json:"system_id,omitempty"`
+	System      *System     `json:"system,omitempty"`
+	LearnedAt   int64       `json:"learned_at,omitempty"`
+	State       string      `json:"state,omitempty"`
+	Forgotten   bool        `json:"forgotten,omitempty"`   // peer_removed: also gone from the known systems cache
+	LAN         bool        `json:"lan,omitempty"`         // peer_added: found through LAN discovery
+	Quarantined bool        `json:"quarantined,omitempty"` // peer_added: name or addresses failed sanitization
+	Data        interface{} `json:"data,omitempty"`        // Event-specific payload (connections, stats)
+	Timestamp   int64       `json:"timestamp"`
+}
+
+// EventHandler receives events; it must not block since it is called from DHT code paths
+type EventHandler func(Event)
+
+// SetEventHandler registers a listener for routing table and DHT events
+// Must be called before Start
+func (dht *DHT) SetEventHandler(handler EventHandler) {
+	dht.onEvent = handler
+	dht.routingTable.onEvent = handler
+}
+
+// emit delivers an event to the registered handler, if any
+func (dht *DHT) emit(e Event) {
+	if dht.onEvent == nil {
+		return
+	}
+	e.Timestamp = time.Now().Unix()
+	dht.onEvent(e)
+}
+
+// emitConnectionChanged reports a peer's freshly saved peer list
+func (dht *DHT) emitConnectionChanged(systemID uuid.UUID, peerIDs []uuid.UUID) {
+	ids := make([]string, len(peerIDs))
+	for i, id := range peerIDs {
+		ids[i] = id.String()
+	}
+	dht.emit(Event{
+		Type:     EventConnectionChanged,
+		SystemID: systemID.String(),
+		Data:     map[string]interface{}{"peer_ids": ids},
+	})
+}
+
+// === Routing table transitions ===
+
+// peerStatus is a cached system's state as shown in the peer state breakdown,
+// plus whether it counts as a routing table member
+type peerStatus struct {
+	state   PeerState
+	inTable bool
+}
+
+// cachedPeerStatus reads a cache entry's state (caller holds cacheMu; see peer_state.go)
+func cachedPeerStatus(cached *CachedSystem, cutoff time.Time) peerStatus {
+	return statusOf(cached, cached.stateAt(cutoff))
+}
+
+// statusOf pairs a state with whether it puts the cache entry in the routing table
+func statusOf(cached *CachedSystem, state PeerState) peerStatus {
+	return peerStatus{state: state, inTable: state.inRoutingTable() && cached.FailCount < MaxFailCount}
+}
+
+// transitionEvents returns the events implied by a status change (nil if nothing changed)
+func transitionEvents(cached *CachedSystem, before, after peerStatus) []Event {
+	id := cached.System.ID.String()
+	var events []Event
+
+	if before.inTable != after.inTable {
+		if after.inTable {
+			events = append(events, Event{Type: EventPeerAdded, SystemID: id, System: cached.System,
+				LearnedAt: cached.LearnedAt.Unix(), State: string(after.state), LAN: cached.LANDiscovered,
+				Quarantined: cached.Quarantined})
+		} else {
+			events = append(events, Event{Type: EventPeerRemoved, SystemID: id, State: string(after.state)})
+		}
+	} else if before.state != after.state {
+		events = append(events, Event{Type: EventPeerStateChanged, SystemID: id, State: string(after.state)})
+	}
+	return events
+}
+
+// emit delivers events to the registered handler; call without cacheMu held
+func (rt *RoutingTable) emit(events ...Event) {
+	if rt.onEvent == nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, e := range events {
+		e.Timestamp = now
+		rt.onEvent(e)
+	}
+}
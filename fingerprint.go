@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/google/uuid"
+)
+
+// InstallSaltBytes is the size of the random per-install salt for seeded UUIDs
+const InstallSaltBytes = 16
+
+// fingerprintDigest is what the log shows of the hardware fingerprint: a truncated hash,
+// enough to tell two machines apart in a pasted log but not to recognise one elsewhere
+func fingerprintDigest(fingerprint string) string {
+	sum := sha256.Sum256([]byte("stellar-lab fingerprint|" + fingerprint))
+	return hex.EncodeToString(sum[:4])
+}
+
+// newSystemID picks a fresh system's UUID: random, or with a seed derived from the seed
+// and the hardware fingerprint. Salted, the derivation also mixes in this install's salt
+// (made on first use and kept in the database), so other software deriving IDs from the
+// same fingerprint can't be matched up with it. Existing systems never come through here
+func newSystemID(storage *Storage, seed string, salted bool) (uuid.UUID, error) {
+	if seed == "" {
+		return uuid.New(), nil
+	}
+	salt := ""
+	if salted {
+		var err error
+		if salt, err = storage.EnsureInstallSalt(); err != nil {
+			return uuid.Nil, err
+		}
+	}
+	return generateDeterministicUUID(seed, salt), nil
+}
+
+// newInstallSalt returns a random salt, hex-encoded
+func newInstallSalt() (string, error) {
+	b := make([]byte, InstallSaltBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// GalaxySnapshotInterval is how often the known galaxy is recorded
+	GalaxySnapshotInterval = 1 * time.Hour
+
+	// GalaxyKeyframeInterval stores every Nth snapshot as full state, so replaying
+	// any point in history never has to start further back than this
+	GalaxyKeyframeInterval = 24
+
+	// DefaultHistoryRange is how far back /api/history looks when no range is given
+	DefaultHistoryRange = 7 * 24 * time.Hour
+
+	// MaxHistoryFrames bounds one /api/history response; the step widens to fit
+	MaxHistoryFrames = 500
+
+	// galaxySnapshotDelay lets the routing table fill before the first snapshot
+	galaxySnapshotDelay = 2 * time.Minute
+)
+
+// SnapshotSystem is what history keeps about a system - enough to place it on the map
+type SnapshotSystem struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	X         float64 `json:"x"`
+	Y         float64 `json:"y"`
+	Z         float64 `json:"z"`
+	Class     string  `json:"class"`
+	Color     string  `json:"color"`
+	SponsorID string  `json:"sponsor_id,omitempty"`
+}
+
+// SnapshotDelta is the change from one snapshot to the next
+// Edges are directed [from, to] pairs as served by /api/connections
+type SnapshotDelta struct {
+	AddedSystems   []SnapshotSystem `json:"added_systems,omitempty"` // New or changed (renamed, moved)
+	RemovedSystems []string         `json:"removed_systems,omitempty"`
+	AddedEdges     [][2]string      `json:"added_edges,omitempty"`
+	RemovedEdges   [][2]string      `json:"removed_edges,omitempty"`
+	RoutingAdded   []string         `json:"routing_added,omitempty"`
+	RoutingRemoved []string         `json:"routing_removed,omitempty"`
+}
+
+// GalaxySnapshot is one stored row of galaxy_snapshots
+type GalaxySnapshot struct {
+	ID               int64 `json:"-"`
+	TakenAt          int64 `json:"taken_at"`
+	Keyframe         bool  `json:"keyframe"` // Delta is against an empty galaxy
+	SystemCount      int   `json:"system_count"`
+	RoutingTableSize int   `json:"routing_table_size"`
+	SnapshotDelta
+}
+
+// HistoryFrame is the galaxy as of Time, as a delta from the previous frame
+type HistoryFrame struct {
+	Time int64 `json:"time"`
+	GalaxySnapshot
+}
+
+// GalaxyHistory is the /api/history response
+// The first frame is a keyframe; replaying the rest in order rebuilds each point in time
+type GalaxyHistory struct {
+	From   int64          `json:"from"`
+	To     int64          `json:"to"`
+	Step   int64          `json:"step"`
+	Frames []HistoryFrame `json:"frames"`
+}
+
+// galaxyState is the full galaxy at one point in time, rebuilt by replaying snapshots
+type galaxyState struct {
+	systems map[string]SnapshotSystem
+	edges   map[[2]string]bool
+	routing map[string]bool
+}
+
+func newGalaxyState() *galaxyState {
+	return &galaxyState{
+		systems: make(map[string]SnapshotSystem),
+		edges:   make(map[[2]string]bool),
+		routing: make(map[string]bool),
+	}
+}
+
+func (g *galaxyState) clone() *galaxyState {
+	c := newGalaxyState()
+	for id, sys := range g.systems {
+		c.systems[id] = sys
+	}
+	for e := range g.edges {
+		c.edges[e] = true
+	}
+	for id := range g.routing {
+		c.routing[id] = true
+	}
+	return c
+}
+
+// apply moves the state forward by one snapshot
+func (g *galaxyState) apply(snap *GalaxySnapshot) {
+	if snap.Keyframe {
+		*g = *newGalaxyState()
+	}
+	for _, sys := range snap.AddedSystems {
+		g.systems[sys.ID] = sys
+	}
+	for _, id := range snap.RemovedSystems {
+		delete(g.systems, id)
+	}
+	for _, e := range snap.AddedEdges {
+		g.edges[e] = true
+	}
+	for _, e := range snap.RemovedEdges {
+		delete(g.edges, e)
+	}
+	for _, id := range snap.RoutingAdded {
+		g.routing[id] = true
+	}
+	for _, id := range snap.RoutingRemoved {
+		delete(g.routing, id)
+	}
+}
+
+// diffGalaxy returns what changed from prev to next (a nil prev is an empty galaxy)
+// Output is sorted so identical states always encode identically
+func diffGalaxy(prev, next *galaxyState) SnapshotDelta {
+	if prev == nil {
+		prev = newGalaxyState()
+	}
+	var d SnapshotDelta
+
+	for id, sys := range next.systems {
+		if old, ok := prev.systems[id]; !ok || old != sys {
+			d.AddedSystems = append(d.AddedSystems, sys)
+		}
+	}
+	for id := range prev.systems {
+		if _, ok := next.systems[id]; !ok {
+			d.RemovedSystems = append(d.RemovedSystems, id)
+		}
+	}
+	for e := range next.edges {
+		if !prev.edges[e] {
+			d.AddedEdges = append(d.AddedEdges, e)
+		}
+	}
+	for e := range prev.edges {
+		if !next.edges[e] {
+			d.RemovedEdges = append(d.RemovedEdges, e)
+		}
+	}
+	for id := range next.routing {
+		if !prev.routing[id] {
+			d.RoutingAdded = append(d.RoutingAdded, id)
+		}
+	}
+	for id := range prev.routing {
+		if !next.routing[id] {
+			d.RoutingRemoved = append(d.RoutingRemoved, id)
+		}
+	}
+
+	sort.Slice(d.AddedSystems, func(i, j int) bool { return d.AddedSystems[i].ID < d.AddedSystems[j].ID })
+	sort.Strings(d.RemovedSystems)
+	sortEdges(d.AddedEdges)
+	sortEdges(d.RemovedEdges)
+	sort.Strings(d.RoutingAdded)
+	sort.Strings(d.RoutingRemoved)
+	return d
+}
+
+func sortEdges(edges [][2]string) {
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+}
+
+// encodeSnapshot builds a snapshot of next, as a keyframe or as a delta from prev
+func encodeSnapshot(takenAt int64, prev, next *galaxyState, keyframe bool) *GalaxySnapshot {
+	if keyframe {
+		prev = nil
+	}
+	return &GalaxySnapshot{
+		TakenAt:          takenAt,
+		Keyframe:         keyframe,
+		SystemCount:      len(next.systems),
+		RoutingTableSize: len(next.routing),
+		SnapshotDelta:    diffGalaxy(prev, next),
+	}
+}
+
+// === Recording ===
+
+// captureGalaxy reads the galaxy as this node currently knows it
+func (dht *DHT) captureGalaxy() *galaxyState {
+	g := newGalaxyState()
+
+	add := func(sys *System) {
+		snap := SnapshotSystem{
+			ID:    sys.ID.String(),
+			Name:  sys.Name,
+			X:     sys.X,
+			Y:     sys.Y,
+			Z:     sys.Z,
+			Class: sys.Stars.Primary.Class,
+			Color: sys.Stars.Primary.Color,
+		}
+		if sys.SponsorID != nil {
+			snap.SponsorID = sys.SponsorID.String()
+		}
+		g.systems[snap.ID] = snap
+	}
+	add(dht.localSystem)
+	for _, sys := range dht.routingTable.GetAllCachedSystems() {
+		add(sys)
+	}
+
+	for _, sys := range dht.routingTable.GetAllRoutingTableNodes() {
+		g.routing[sys.ID.String()] = true
+	}
+	for _, e := range dht.GetConnections() {
+		g.edges[[2]string{e.FromID, e.ToID}] = true
+	}
+	return g
+}
+
+// galaxySnapshotLoop records the galaxy every GalaxySnapshotInterval
+func (dht *DHT) galaxySnapshotLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskGalaxySnapshot, every(GalaxySnapshotInterval))
+	t.scheduleNext(time.Now().Add(galaxySnapshotDelay))
+
+	select {
+	case <-dht.shutdown:
+		return
+	case <-time.After(galaxySnapshotDelay):
+	case <-t.trigger:
+	}
+	t.scheduleNext(time.Now().Add(GalaxySnapshotInterval))
+	t.run(dht.takeGalaxySnapshot)
+
+	ticker := time.NewTicker(GalaxySnapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(GalaxySnapshotInterval))
+		case <-t.trigger:
+		}
+		t.run(dht.takeGalaxySnapshot)
+	}
+}
+
+// takeGalaxySnapshot stores the change since the last snapshot
+// The first snapshot after a start is always a keyframe, so nothing has to be read back
+// Returns how many systems the snapshot recorded
+func (dht *DHT) takeGalaxySnapshot() (int, error) {
+	current := dht.captureGalaxy()
+	keyframe := dht.lastGalaxy == nil || dht.galaxySinceKeyframe >= GalaxyKeyframeInterval-1
+
+	snap := encodeSnapshot(time.Now().Unix(), dht.lastGalaxy, current, keyframe)
+	if err := dht.storage.SaveGalaxySnapshot(snap); err != nil {
+		log.Printf("Failed to save galaxy snapshot: %v", err)
+		return 0, err
+	}
+
+	dht.lastGalaxy = current
+	if keyframe {
+		dht.galaxySinceKeyframe = 0
+	} else {
+		dht.galaxySinceKeyframe++
+	}
+	return snap.SystemCount, nil
+}
+
+// === Playback ===
+
+// GetGalaxyHistory samples recorded history every step seconds from from to to
+// Times before the first snapshot are skipped; each frame shows the latest snapshot at or before it
+func (dht *DHT) GetGalaxyHistory(from, to, step int64) (*GalaxyHistory, error) {
+	if frames := (to-from)/step + 1; frames > MaxHistoryFrames {
+		step = (to - from + MaxHistoryFrames - 2) / (MaxHistoryFrames - 1)
+	}
+
+	snaps, err := dht.storage.GetGalaxySnapshots(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &GalaxyHistory{From: from, To: to, Step: step, Frames: []HistoryFrame{}}
+	state := newGalaxyState()
+	var prev *galaxyState
+	var latest *GalaxySnapshot
+
+	next := 0
+	for t := from; ; t += step {
+		if t > to {
+			t = to
+		}
+		for next < len(snaps) && snaps[next].TakenAt <= t {
+			state.apply(snaps[next])
+			latest = snaps[next]
+			next++
+		}
+		if latest != nil {
+			snap := encodeSnapshot(latest.TakenAt, prev, state, prev == nil)
+			history.Frames = append(history.Frames, HistoryFrame{Time: t, GalaxySnapshot: *snap})
+			prev = state.clone()
+		}
+		if t == to {
+			break
+		}
+	}
+	return history, nil
+}
+
+// thinGalaxySnapshots keeps only the first snapshot of each UTC day before cutoff
+// Returns the IDs to delete and the kept rows that must be re-encoded because a
+// snapshot they were a delta against is going away
+func thinGalaxySnapshots(snaps []*GalaxySnapshot, cutoff int64) (doomed []int64, rewritten []*GalaxySnapshot) {
+	state := newGalaxyState()
+	var kept *galaxyState // State at the last kept snapshot
+	lastDay := int64(-1)
+	dropped := false
+	sinceKeyframe := 0
+
+	for _, snap := range snaps {
+		state.apply(snap)
+
+		day := snap.TakenAt / 86400
+		if snap.TakenAt < cutoff && day == lastDay {
+			doomed = append(doomed, snap.ID)
+			dropped = true
+			continue
+		}
+		lastDay = day
+
+		if dropped {
+			keyframe := kept == nil || snap.Keyframe || sinceKeyframe >= GalaxyKeyframeInterval-1
+			updated := encodeSnapshot(snap.TakenAt, kept, state, keyframe)
+			updated.ID = snap.ID
+			rewritten = append(rewritten, updated)
+			snap = updated
+			dropped = false
+		}
+
+		if snap.Keyframe {
+			sinceKeyframe = 0
+		} else {
+			sinceKeyframe++
+		}
+		kept = state.clone()
+	}
+	return doomed, rewritten
+}
+
+// trimGalaxySnapshots drops snapshots taken before cutoff and the oldest beyond maxRows,
+// always keeping the newest: the next snapshot recorded is a delta against it. Returns
+// the IDs to delete and, unless it already is one, the first kept snapshot re-encoded
+// as a keyframe, since the snapshots it was a delta against are going away
+func trimGalaxySnapshots(snaps []*GalaxySnapshot, maxRows int, cutoff int64) (doomed []int64, rewritten *GalaxySnapshot) {
+	drop := 0
+	for drop < len(snaps)-1 && (snaps[drop].TakenAt < cutoff || (maxRows > 0 && len(snaps)-drop > maxRows)) {
+		drop++
+	}
+	if drop == 0 {
+		return nil, nil
+	}
+
+	state := newGalaxyState()
+	for _, snap := range snaps[:drop+1] {
+		state.apply(snap)
+	}
+	for _, snap := range snaps[:drop] {
+		doomed = append(doomed, snap.ID)
+	}
+	if first := snaps[drop]; !first.Keyframe {
+		rewritten = encodeSnapshot(first.TakenAt, nil, state, true)
+		rewritten.ID = first.ID
+	}
+	return doomed, rewritten
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// MapClusterThreshold is the galaxy size above which /api/map clusters systems
+	// Smaller galaxies are always sent in full, exactly as /api/known-systems has them
+	MapClusterThreshold = 300
+
+	// MaxMapLOD is the finest clustering level /api/map serves
+	MaxMapLOD = 5
+
+	// mapBaseCellSize is the grid cell edge at LOD 0, in map units; each LOD halves it
+	mapBaseCellSize = 4000.0
+)
+
+// MapCluster is a group of systems binned into one grid cell, drawn as a single sprite
+type MapCluster struct {
+	ID        string  `json:"id"`
+	Count     int     `json:"count"`
+	X         float64 `json:"x"` // Centroid
+	Y         float64 `json:"y"`
+	Z         float64 `json:"z"`
+	Radius    float64 `json:"radius"`     // Furthest member from the centroid
+	StarClass string  `json:"star_class"` // Most common primary class
+	Color     string  `json:"color"`
+}
+
+// GalaxyMap is the /api/map response: every system, or clusters plus the systems kept apart
+type GalaxyMap struct {
+	Clustered bool                  `json:"clustered"`
+	LOD       int                   `json:"lod"`
+	CellSize  float64               `json:"cell_size,omitempty"`
+	Total     int                   `json:"total"`    // Known systems, not counting ourselves
+	Matching  int                   `json:"matching"` // Of those, the ones passing the filter (Total without one)
+	Systems   []KnownSystemResponse `json:"systems"`
+	Clusters  []MapCluster          `json:"clusters"`
+}
+
+// mapCell is a cluster being built
+type mapCell struct {
+	key     [3]int64
+	members []*CachedSystem
+}
+
+// GetGalaxyMap returns the known galaxy for the map at level of detail lod (0 to MaxMapLOD),
+// only the systems passing filter if there is one (nil = all). Clustering goes by how many
+// systems pass. Routing table peers and systems alone in their cell are always sent
+// individually, so live peers and our connections look the same at every LOD
+func (dht *DHT) GetGalaxyMap(lod int, filter *MapFilter) *GalaxyMap {
+	if lod < 0 {
+		lod = 0
+	}
+	if lod > MaxMapLOD {
+		lod = MaxMapLOD
+	}
+	rt := dht.GetRoutingTable()
+	all := rt.GetAllCachedSystemsWithMeta()
+	cached := filter.filterCached(all)
+
+	m := &GalaxyMap{LOD: lod, Total: len(all), Matching: len(cached), Systems: []KnownSystemResponse{}, Clusters: []MapCluster{}}
+	if len(cached) <= MapClusterThreshold {
+		for _, c := range cached {
+			m.Systems = append(m.Systems, KnownSystemResponse{System: c.System, LearnedAt: c.LearnedAt.Unix()})
+		}
+		return m
+	}
+
+	live := make(map[string]bool)
+	for _, sys := range rt.GetAllRoutingTableNodes() {
+		live[sys.ID.String()] = true
+	}
+
+	m.Clustered = true
+	m.CellSize = mapBaseCellSize / float64(int64(1)<<lod)
+
+	cells := make(map[[3]int64]*mapCell)
+	for _, c := range cached {
+		if live[c.System.ID.String()] {
+			m.Systems = append(m.Systems, KnownSystemResponse{System: c.System, LearnedAt: c.LearnedAt.Unix()})
+			continue
+		}
+		key := [3]int64{
+			int64(math.Floor(c.System.X / m.CellSize)),
+			int64(math.Floor(c.System.Y / m.CellSize)),
+			int64(math.Floor(c.System.Z / m.CellSize)),
+		}
+		cell := cells[key]
+		if cell == nil {
+			cell = &mapCell{key: key}
+			cells[key] = cell
+		}
+		cell.members = append(cell.members, c)
+	}
+
+	for _, cell := range cells {
+		if len(cell.members) == 1 {
+			c := cell.members[0]
+			m.Systems = append(m.Systems, KnownSystemResponse{System: c.System, LearnedAt: c.LearnedAt.Unix()})
+			continue
+		}
+		m.Clusters = append(m.Clusters, cell.cluster(lod))
+	}
+
+	// Map iteration order is random; keep responses stable between refreshes
+	sort.Slice(m.Clusters, func(i, j int) bool { return m.Clusters[i].ID < m.Clusters[j].ID })
+	return m
+}
+
+// cluster summarizes a cell's members
+func (cell *mapCell) cluster(lod int) MapCluster {
+	cl := MapCluster{
+		ID:    fmt.Sprintf("cluster:%d:%d:%d:%d", lod, cell.key[0], cell.key[1], cell.key[2]),
+		Count: len(cell.members),
+	}
+
+	classes := make(map[string]int)
+	colors := make(map[string]string)
+	for _, c := range cell.members {
+		cl.X += c.System.X
+		cl.Y += c.System.Y
+		cl.Z += c.System.Z
+		class := c.System.Stars.Primary.Class
+		classes[class]++
+		if colors[class] == "" {
+			colors[class] = c.System.Stars.Primary.Color
+		}
+	}
+	n := float64(len(cell.members))
+	cl.X, cl.Y, cl.Z = cl.X/n, cl.Y/n, cl.Z/n
+
+	for _, c := range cell.members {
+		dx, dy, dz := c.System.X-cl.X, c.System.Y-cl.Y, c.System.Z-cl.Z
+		cl.Radius = math.Max(cl.Radius, math.Sqrt(dx*dx+dy*dy+dz*dz))
+	}
+
+	// Ties go to the alphabetically first class, so the same cell always looks the same
+	for class, count := range classes {
+		if count > classes[cl.StarClass] || (count == classes[cl.StarClass] && class < cl.StarClass) {
+			cl.StarClass = class
+		}
+	}
+	cl.Color = colors[cl.StarClass]
+	return cl
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Two partitions that each start without a bootstrap peer each mint a genesis black hole at
+// the origin. When they meet, the older genesis (earlier CreatedAt, then lower UUID) keeps
+// the origin; the other demotes itself to the ordinary system its UUID gives, sponsored by
+// the winner, and keeps its peers. Its signed GenesisDemotion record travels with its info:
+// peers only accept a Class X system turning into anything else with one, and the systems
+// it sponsored while at the origin keep validating against the origin.
+
+// GenesisDemotion is a former genesis' signed statement that it left the origin to winner
+type GenesisDemotion struct {
+	SystemID  uuid.UUID `json:"system_id"`
+	WinnerID  uuid.UUID `json:"winner_id"`
+	DemotedAt int64     `json:"demoted_at"`
+	Signature string    `json:"signature"`
+}
+
+// signableMessage is what the demoted system signs
+func (d *GenesisDemotion) signableMessage() []byte {
+	data, _ := json.Marshal(struct {
+		Type      string `json:"type"`
+		SystemID  string `json:"system_id"`
+		WinnerID  string `json:"winner_id"`
+		DemotedAt int64  `json:"demoted_at"`
+	}{"genesis_demotion", d.SystemID.String(), d.WinnerID.String(), d.DemotedAt})
+	return data
+}
+
+// Verify checks the record was signed with publicKey (base64)
+func (d *GenesisDemotion) Verify(publicKey string) bool {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pubKeyBytes) != ed25519.PublicKeySize {
+		return false
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(d.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pubKeyBytes, d.signableMessage(), sigBytes)
+}
+
+// isGenesis reports whether a system presents itself as a genesis black hole
+func isGenesis(sys *System) bool {
+	return sys.Stars.Primary.Class == "X" && sys.SponsorID == nil && sys.X == 0 && sys.Y == 0 && sys.Z == 0
+}
+
+// genesisOutranks reports whether genesis a keeps the origin over b: the older one does,
+// and between systems created in the same second the lower UUID
+// Seconds, because that's what a restarted node has of its own CreatedAt
+func genesisOutranks(a, b *System) bool {
+	if a.CreatedAt.Unix() != b.CreatedAt.Unix() {
+		return a.CreatedAt.Unix() < b.CreatedAt.Unix()
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// genesisRivals queues other genesis systems the routing table has come across
+type genesisRivals struct {
+	mu      sync.Mutex
+	pending map[uuid.UUID]bool
+	wake    chan struct{}
+}
+
+func newGenesisRivals() *genesisRivals {
+	return &genesisRivals{pending: make(map[uuid.UUID]bool), wake: make(chan struct{}, 1)}
+}
+
+// report queues a rival genesis for the genesis loop
+func (g *genesisRivals) report(id uuid.UUID) {
+	g.mu.Lock()
+	if g.pending[id] {
+		g.mu.Unlock()
+		return
+	}
+	g.pending[id] = true
+	g.mu.Unlock()
+
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns and clears the queued rivals
+func (g *genesisRivals) take() []uuid.UUID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ids := make([]uuid.UUID, 0, len(g.pending))
+	for id := range g.pending {
+		ids = append(ids, id)
+	}
+	g.pending = make(map[uuid.UUID]bool)
+	return ids
+}
+
+// checkGenesisTransition vets a cached system's new info for a genesis' demotion
+// A record that doesn't verify against the bound key is dropped; a cached genesis
+// changing class without a valid record is refused. A record already cached carries over
+// to info relayed without it. Returns the info to cache, or nil to refuse it
+// Callers hold cacheMu
+func (rt *RoutingTable) checkGenesisTransition(sys *System, existing *CachedSystem) *System {
+	if d := sys.GenesisDemotion; d != nil {
+		valid := d.SystemID == sys.ID && d.WinnerID != sys.ID
+		if valid && rt.storage != nil {
+			if publicKey, err := rt.storage.GetIdentityBinding(sys.ID); err == nil && publicKey != "" {
+				valid = d.Verify(publicKey)
+			}
+		}
+		if !valid {
+			log.Printf("Dropped invalid genesis demotion record of %s", sys.ID.String()[:8])
+			stripped := *sys
+			stripped.GenesisDemotion = nil
+			sys = &stripped
+		}
+	}
+	if existing == nil {
+		return sys
+	}
+
+	if sys.GenesisDemotion == nil && existing.System.GenesisDemotion != nil {
+		withRecord := *sys
+		withRecord.GenesisDemotion = existing.System.GenesisDemotion
+		sys = &withRecord
+	}
+	if existing.System.Stars.Primary.Class == "X" && sys.Stars.Primary.Class != "X" && sys.GenesisDemotion == nil {
+		log.Printf("Rejected class change of genesis %q (%s) without a demotion record", existing.System.Name, sys.ID.String()[:8])
+		return nil
+	}
+	return sys
+}
+
+// genesisLoop settles conflicts with the other genesis systems the routing table reports
+func (dht *DHT) genesisLoop() {
+	defer dht.wg.Done()
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-dht.routingTable.genesis.wake:
+		}
+		for _, id := range dht.routingTable.genesis.take() {
+			dht.resolveGenesisConflict(id)
+		}
+	}
+}
+
+// resolveGenesisConflict asks a rival genesis for its own info and, if it outranks us,
+// hands it the origin. A rival we can't reach is left for the next time we hear of it
+func (dht *DHT) resolveGenesisConflict(id uuid.UUID) {
+	if !isGenesis(dht.localSystem) {
+		return
+	}
+	cached := dht.routingTable.GetCachedSystem(id)
+	if cached == nil || !isGenesis(cached) || cached.PeerAddress == "" {
+		return
+	}
+
+	// Relayed info doesn't carry CreatedAt; the rival's own does
+	rival, err := dht.Ping(cached.PeerAddress)
+	if err != nil || rival == nil || rival.ID != id {
+		log.Printf("Genesis conflict with %s (%s): couldn't reach it to compare (%v)", cached.Name, id.String()[:8], err)
+		return
+	}
+	if !isGenesis(rival) {
+		return // It has stepped down already
+	}
+
+	if genesisOutranks(dht.localSystem, rival) {
+		log.Printf("Genesis conflict with %s (%s): this system is older and keeps the origin", rival.Name, id.String()[:8])
+		return
+	}
+	dht.demoteGenesis(rival)
+}
+
+// demoteGenesis turns us from a genesis into the system our UUID gives, sponsored by winner,
+// and tells our peers. Our routing table is kept
+func (dht *DHT) demoteGenesis(winner *System) {
+	dht.sponsorMu.Lock()
+	local := dht.localSystem
+	record := &GenesisDemotion{SystemID: local.ID, WinnerID: winner.ID, DemotedAt: time.Now().Unix()}
+	if local.Keys != nil {
+		record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(local.Keys.PrivateKey, record.signableMessage()))
+	}
+	local.GenerateMultiStarSystem()
+	local.GenerateClusteredCoordinates(winner)
+	local.GenesisDemotion = record
+	local.BumpInfoVersion()
+	dht.sponsorMu.Unlock()
+
+	if err := dht.storage.SaveSystem(local); err != nil {
+		log.Printf("Warning: failed to save demoted genesis state: %v", err)
+	}
+	log.Printf("Genesis conflict with %s (%s): it is older, so this system leaves the origin", winner.Name, winner.ID.String()[:8])
+	log.Printf("  Now a class %s system at (%.2f, %.2f, %.2f), sponsored by %s",
+		local.Stars.Primary.Class, local.X, local.Y, local.Z, winner.Name)
+
+	dht.updateRoutingTable(winner)
+	dht.announceInfoChange()
+}
@@ -6,6 +6,8 @@ require (
         github.com/google/uuid v1.6.0
         github.com/libp2p/go-nat v0.2.0
         github.com/mattn/go-sqlite3 v1.14.22
+        golang.org/x/net v0.10.0
+        golang.org/x/sys v0.8.0
 )
 
 require (
@@ -14,7 +16,5 @@ require (
         github.com/jackpal/go-nat-pmp v1.0.2 // indirect
         github.com/koron/go-ssdp v0.0.4 // indirect
         github.com/libp2p/go-netroute v0.2.1 // indirect
-        golang.org/x/net v0.10.0 // indirect
         golang.org/x/sync v0.2.0 // indirect
-        golang.org/x/sys v0.8.0 // indirect
 )
\ No newline at end of file
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configFileHeader starts a config file written by -init
+const configFileHeader = `# stellar-lab settings. Any command line flag can be set here by its name without
+# the dash (public-address = "myhost.com:7867"); flags on the command line and
+# STELLAR_* environment variables take precedence over this file
+`
+
+// errSetupCancelled is returned when input ends before the wizard is done
+var errSetupCancelled = errors.New("setup cancelled")
+
+// setupWizard asks its questions on in and writes prompts to out
+type setupWizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prompts for a line, returning def for an empty answer
+func (w *setupWizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		fmt.Fprintln(w.out)
+		return "", errSetupCancelled
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// askYesNo prompts for y/n
+func (w *setupWizard) askYesNo(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		answer, err := w.ask(question+" ("+hint+")", "")
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(answer) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Fprintln(w.out, "  Please answer y or n")
+	}
+}
+
+// askPort prompts for a TCP port
+func (w *setupWizard) askPort(question string, def int) (int, error) {
+	for {
+		answer, err := w.ask(question, strconv.Itoa(def))
+		if err != nil {
+			return 0, err
+		}
+		port, err := strconv.Atoi(answer)
+		if err == nil && port > 0 && port < 65536 {
+			return port, nil
+		}
+		fmt.Fprintln(w.out, "  Please enter a port between 1 and 65535")
+	}
+}
+
+// splitPort returns an address's host and port, or the whole address and def when it has no port
+func splitPort(address string, def int) (string, int) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return strings.Trim(address, "[]"), def
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, def
+	}
+	return host, port
+}
+
+// runInit is -init: it asks for the essentials and writes them to the config file at
+// path, then says how to start the node (start). An existing config is edited in
+// place, its answers offered as the defaults. Returns the process exit code
+func runInit(in io.Reader, out io.Writer, path string, dir *DataDir, start string) int {
+	if err := initConfig(&setupWizard{in: bufio.NewReader(in), out: out}, path, dir, start); err != nil {
+		fmt.Fprintf(out, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func initConfig(w *setupWizard, path string, dir *DataDir, start string) error {
+	current := make(map[string]string)
+	data, err := os.ReadFile(path)
+	exists := err == nil
+	switch {
+	case exists:
+		entries, err := ParseConfig(strings.NewReader(string(data)))
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, e := range entries {
+			current[e.Key] = e.Value
+		}
+		fmt.Fprintf(w.out, "%s already exists.\n", path)
+		edit, err := w.askYesNo("Edit it? Settings you don't change are kept", true)
+		if err != nil {
+			return err
+		}
+		if !edit {
+			fmt.Fprintln(w.out, "Left it unchanged.")
+			return nil
+		}
+	case os.IsNotExist(err):
+		fmt.Fprintf(w.out, "Setting up a new star system. Settings go in %s\n", path)
+		fmt.Fprintln(w.out, "Press Enter to accept the [default].")
+	default:
+		return err
+	}
+	fmt.Fprintln(w.out)
+
+	webPort, peerPort := DefaultWebPort, DefaultPeerPort
+	if dir != nil && dir.Profile != nil {
+		webPort, peerPort = dir.Profile.WebPort, dir.Profile.PeerPort
+	}
+	_, webPort = splitPort(current["address"], webPort)
+	host, peerPort := splitPort(current["public-address"], peerPort)
+
+	var name string
+	for {
+		if name, err = w.ask("Star system name", current["name"]); err != nil {
+			return err
+		}
+		name = sanitizeStarName(name)
+		if err := validateStarName(name); err != nil {
+			fmt.Fprintf(w.out, "  %v\n", err)
+			continue
+		}
+		break
+	}
+
+	if webPort, err = w.askPort("Web UI port", webPort); err != nil {
+		return err
+	}
+	for {
+		if host, err = w.ask("Public host name or IP other systems reach you at", host); err != nil {
+			return err
+		}
+		if host != "" {
+			break
+		}
+		fmt.Fprintln(w.out, "  Peers need an address to connect to")
+	}
+	if peerPort, err = w.askPort("Peer port", peerPort); err != nil {
+		return err
+	}
+	publicAddr, err := NormalizePeerAddress(net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(peerPort)))
+	if err != nil {
+		return fmt.Errorf("invalid public address: %w", err)
+	}
+
+	// Seeds find the public galaxy; without them the node joins its bootstrap peers or
+	// starts a galaxy of its own
+	seeds, err := w.askYesNo("Find peers automatically through the seed nodes?", current["isolated"] != "true")
+	if err != nil {
+		return err
+	}
+	values := map[string]string{
+		"name":           name,
+		"address":        net.JoinHostPort("0.0.0.0", strconv.Itoa(webPort)),
+		"public-address": publicAddr,
+		"isolated":       "",
+	}
+	if !seeds {
+		values["isolated"] = "true"
+		bootstrap, err := w.ask("Bootstrap peers (host:port, comma-separated; empty to start a new galaxy)", current["bootstrap"])
+		if err != nil {
+			return err
+		}
+		values["bootstrap"] = bootstrap
+	}
+
+	if !exists {
+		if err := os.WriteFile(path, []byte(configFileHeader), 0600); err != nil {
+			return err
+		}
+	}
+	if err := UpdateConfigFile(path, values); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w.out, "\nWrote %s\n\n", path)
+	fmt.Fprintf(w.out, "Start your node with:\n  %s\n\n", start)
+	fmt.Fprintf(w.out, "Then open the web UI at http://localhost:%d\n\n", webPort)
+	fmt.Fprintf(w.out, "Other systems connect to you on TCP port %d. If you're behind a router, forward\n", peerPort)
+	fmt.Fprintf(w.out, "port %d to this machine (the node tries UPnP/NAT-PMP itself unless no-upnp is set).\n", peerPort)
+	if !seeds && values["bootstrap"] == "" {
+		fmt.Fprintln(w.out, "With no seeds or bootstrap peers, this node starts a new galaxy; others join it with")
+		fmt.Fprintf(w.out, "bootstrap = [\"%s\"]\n", publicAddr)
+	}
+	return nil
+}
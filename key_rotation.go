@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A node whose private key leaked can move its UUID (and credits) to a new keypair: the
+// old key signs a rotation binding the new public key to the UUID. Peers follow the chain
+// of rotations from the key they bound on first contact, so only the holder of the bound
+// key can move it on. Old keys stay on file to check attestations signed before the
+// rotation. A revocation is the same record without a new key: the UUID is dead.
+
+const (
+	// KeyRotationAnnounceWindow is how long after the latest rotation our announces carry the chain
+	KeyRotationAnnounceWindow = 7 * 24 * time.Hour
+
+	// MaxKeyRotations bounds the chain one message may carry
+	MaxKeyRotations = 16
+)
+
+// KeyRotation hands a system's identity from one key to the next, signed by the old key
+type KeyRotation struct {
+	SystemID     uuid.UUID `json:"system_id"`
+	Sequence     int       `json:"sequence"` // 1 for the first rotation, one more for each after
+	OldPublicKey string    `json:"old_public_key"`
+	NewPublicKey string    `json:"new_public_key,omitempty"` // base64; empty for a revocation
+	Revoked      bool      `json:"revoked,omitempty"`        // The UUID is dead: no key follows OldPublicKey
+	Timestamp    int64     `json:"timestamp"`
+	Signature    string    `json:"signature"` // By OldPublicKey
+}
+
+// signableMessage returns the canonical statement the old key signs
+func (r *KeyRotation) signableMessage() []byte {
+	msg := struct {
+		SystemID     string `json:"system_id"`
+		Sequence     int    `json:"sequence"`
+		OldPublicKey string `json:"old_public_key"`
+		NewPublicKey string `json:"new_public_key"`
+		Revoked      bool   `json:"revoked"`
+		Timestamp    int64  `json:"timestamp"`
+	}{
+		SystemID:     r.SystemID.String(),
+		Sequence:     r.Sequence,
+		OldPublicKey: r.OldPublicKey,
+		NewPublicKey: r.NewPublicKey,
+		Revoked:      r.Revoked,
+		Timestamp:    r.Timestamp,
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// NewKeyRotation signs a rotation to newKeys with the system's current key, or a
+// revocation when newKeys is nil
+func NewKeyRotation(sys *System, sequence int, newKeys *KeyPair) (*KeyRotation, error) {
+	if sys.Keys == nil {
+		return nil, ErrNoKeys
+	}
+	r := &KeyRotation{
+		SystemID:     sys.ID,
+		Sequence:     sequence,
+		OldPublicKey: base64.StdEncoding.EncodeToString(sys.Keys.PublicKey),
+		Revoked:      newKeys == nil,
+		Timestamp:    time.Now().Unix(),
+	}
+	if newKeys != nil {
+		r.NewPublicKey = base64.StdEncoding.EncodeToString(newKeys.PublicKey)
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(sys.Keys.PrivateKey, r.signableMessage()))
+	return r, nil
+}
+
+// Verify checks the record is well formed and signed by its old key
+func (r *KeyRotation) Verify() bool {
+	if r.Sequence < 1 || r.Revoked != (r.NewPublicKey == "") || r.NewPublicKey == r.OldPublicKey {
+		return false
+	}
+	if r.NewPublicKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(r.NewPublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			return false
+		}
+	}
+	pub, err := base64.StdEncoding.DecodeString(r.OldPublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, r.signableMessage(), sig)
+}
+
+// followKeyChain walks rotations after sequence from, starting at key, and returns the
+// key the chain ends at ("" if it ends in a revocation) and the records it went through.
+// Every step must carry on from the one before it; entries at or before from are skipped
+func followKeyChain(id uuid.UUID, key string, from int, chain []*KeyRotation) (string, []*KeyRotation, error) {
+	sorted := append([]*KeyRotation(nil), chain...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Sequence < sorted[j].Sequence })
+
+	var steps []*KeyRotation
+	seq := from
+	for _, r := range sorted {
+		if r.Sequence <= from {
+			continue
+		}
+		if key == "" {
+			return "", nil, fmt.Errorf("key rotation %d follows a revocation", r.Sequence)
+		}
+		if r.SystemID != id || r.Sequence != seq+1 {
+			return "", nil, fmt.Errorf("key rotation %d doesn't follow %d", r.Sequence, seq)
+		}
+		if r.OldPublicKey != key || !r.Verify() {
+			return "", nil, fmt.Errorf("key rotation %d isn't signed by the key before it", r.Sequence)
+		}
+		key, seq = r.NewPublicKey, r.Sequence
+		steps = append(steps, r)
+	}
+	return key, steps, nil
+}
+
+// rotateLocalKey moves this system to a new keypair, signing the handover with the old one
+// Called at startup before the info is signed, so everything sent afterwards uses the new key
+func rotateLocalKey(system *System, storage *Storage) (*KeyRotation, error) {
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate keys: %w", err)
+	}
+	r, err := newLocalRotation(system, storage, keys)
+	if err != nil {
+		return nil, err
+	}
+	system.Keys = keys
+	log.Printf("Rotated identity key (rotation %d)", r.Sequence)
+	return r, nil
+}
+
+// revokeLocalIdentity signs this system's revocation; it can't be started again afterwards
+func revokeLocalIdentity(system *System, storage *Storage) (*KeyRotation, error) {
+	r, err := newLocalRotation(system, storage, nil)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Revoked identity %s", system.ID)
+	return r, nil
+}
+
+// newLocalRotation signs and stores the next rotation (or the revocation) of our key,
+// along with the new keys
+func newLocalRotation(system *System, storage *Storage, keys *KeyPair) (*KeyRotation, error) {
+	history, err := storage.GetKeyRotations(system.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key history: %w", err)
+	}
+	seq := 1
+	if n := len(history); n > 0 {
+		if history[n-1].Revoked {
+			return nil, fmt.Errorf("identity %s was revoked", system.ID)
+		}
+		seq = history[n-1].Sequence + 1
+	}
+	r, err := NewKeyRotation(system, seq, keys)
+	if err != nil {
+		return nil, err
+	}
+	if err := storage.SaveLocalKeyRotation(r, keys); err != nil {
+		return nil, fmt.Errorf("failed to save key rotation: %w", err)
+	}
+	return r, nil
+}
+
+// localKeyRotations returns our rotation chain if the latest rotation is recent enough to
+// still be handed out (nil otherwise). The chain's oldest entries go first past MaxKeyRotations
+func (dht *DHT) localKeyRotations(window time.Duration) []*KeyRotation {
+	history, err := dht.storage.GetKeyRotations(dht.localSystem.ID)
+	if err != nil || len(history) == 0 {
+		return nil
+	}
+	if time.Since(time.Unix(history[len(history)-1].Timestamp, 0)) > window {
+		return nil
+	}
+	if len(history) > MaxKeyRotations {
+		history = history[len(history)-MaxKeyRotations:]
+	}
+	return history
+}
+
+// attachKeyRotations adds our recent rotations to an outgoing announce
+func (dht *DHT) attachKeyRotations(msg *DHTMessage) {
+	msg.KeyRotations = dht.localKeyRotations(KeyRotationAnnounceWindow)
+}
+
+// handleKeyRotation processes a key_rotation request. The chain was followed and the
+// binding moved on before the sender's key was checked (see ValidateIdentityBinding);
+// what's left is retiring a revoked identity
+func (dht *DHT) handleKeyRotation(msg *DHTMessage) (*DHTMessage, error) {
+	last := msg.KeyRotations[len(msg.KeyRotations)-1]
+	log.Printf("KEY_ROTATION from %s (%s): rotation %d", msg.FromSystem.Name, msg.FromSystem.ID, last.Sequence)
+
+	resp, err := NewKeyRotationResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+	if err != nil {
+		return nil, err
+	}
+	// Only a revocation that followed on from the key we hold counts
+	if revoked, err := dht.storage.IdentityRevoked(msg.FromSystem.ID); err == nil && revoked {
+		// Blocking purges the cache, peer_systems and connections; the key history stays
+		if _, err := dht.BlockSystem(msg.FromSystem.ID, "identity revoked", 0); err != nil {
+			log.Printf("Key rotation: failed to retire %s: %v", msg.FromSystem.ID, err)
+		} else {
+			log.Printf("%s (%s) revoked its identity", msg.FromSystem.Name, msg.FromSystem.ID.String()[:8])
+		}
+		return resp, nil
+	}
+	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	dht.routingTable.CacheSystem(msg.FromSystem, msg.FromSystem.ID, true)
+	return resp, nil
+}
+
+// KeyRotationToSystem sends our rotation chain to a known system
+func (dht *DHT) KeyRotationToSystem(sys *System, chain []*KeyRotation) error {
+	if sys.PeerAddress == "" {
+		return fmt.Errorf("no peer address for %s", sys.Name)
+	}
+	msg, err := NewKeyRotationRequest(dht.localSystem, sys.ID, chain, "")
+	if err != nil {
+		return err
+	}
+	_, err = dht.sendRequest(sys.PeerAddress, msg)
+	return err
+}
+
+// broadcastKeyRotations sends a rotation chain of ours to every known peer
+// Called before bootstrap, so peers know the new key before it pings them
+func (dht *DHT) broadcastKeyRotations(chain []*KeyRotation) int {
+	if len(chain) == 0 {
+		return 0
+	}
+	sent := 0
+	for _, sys := range dht.routingTable.GetAllCachedSystems() {
+		if sys.PeerAddress == "" || !dht.peerSupports(sys.ID, CapKeyRotation) {
+			continue
+		}
+		if err := dht.KeyRotationToSystem(sys, chain); err != nil {
+			log.Printf("  Failed to send key rotation to %s: %v", sys.Name, err)
+			continue
+		}
+		sent++
+	}
+	log.Printf("Sent key rotation %d to %d peers", chain[len(chain)-1].Sequence, sent)
+	return sent
+}
+
+// revokeIdentityFromCLI revokes this system's identity and tells every known peer
+// (-revoke-identity). The database is left as it is, but the system won't start again;
+// running it again on a revoked identity only sends the revocation again
+func revokeIdentityFromCLI(system *System, storage *Storage, listenAddr string) error {
+	revoked, err := storage.IdentityRevoked(system.ID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		if _, err := revokeLocalIdentity(system, storage); err != nil {
+			return err
+		}
+	}
+	dht := NewDHT(system, storage, listenAddr)
+	if dht.broadcastKeyRotations(dht.localKeyRotations(math.MaxInt64)) == 0 {
+		log.Printf("Warning: no peer heard the revocation; run -revoke-identity again to resend it")
+	}
+	return nil
+}
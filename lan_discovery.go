@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// LANDiscoveryGroup is the UDP multicast group presence packets are sent to
+	LANDiscoveryGroup = "239.255.78.67:7867"
+
+	// LANPresenceInterval is how often we broadcast our presence
+	LANPresenceInterval = 30 * time.Second
+
+	// LANBootstrapWait is how long a node with no peers listens for a LAN peer before bootstrapping without one
+	LANBootstrapWait = 35 * time.Second
+
+	// LANPresenceMaxAge rejects presence packets signed longer ago than this (replays)
+	LANPresenceMaxAge = 2 * time.Minute
+
+	// lanContactCooldown is how long to wait before pinging the same LAN system again
+	lanContactCooldown = 5 * time.Minute
+
+	// lanReplyCooldown limits how often a newcomer's presence makes us broadcast ours early
+	lanReplyCooldown = 5 * time.Second
+
+	// lanMaxPacket is the largest presence packet read
+	lanMaxPacket = 2048
+)
+
+// LANPresence is the signed packet a node multicasts to announce itself on the local network
+// It only gets the sender pinged; the ping itself is verified like any other DHT message
+type LANPresence struct {
+	SystemID    uuid.UUID `json:"system_id"`
+	PeerAddress string    `json:"peer_address"`
+	Version     string    `json:"version"`
+	Timestamp   int64     `json:"timestamp"`
+	PublicKey   string    `json:"public_key"` // Base64
+	Signature   string    `json:"signature"`  // Base64, over signableMessage
+}
+
+// NewLANPresence signs a presence packet for sys
+func NewLANPresence(sys *System) (*LANPresence, error) {
+	if sys.Keys == nil {
+		return nil, ErrNoKeys
+	}
+	p := &LANPresence{
+		SystemID:    sys.ID,
+		PeerAddress: sys.PeerAddress,
+		Version:     CurrentProtocolVersion.String(),
+		Timestamp:   time.Now().Unix(),
+		PublicKey:   base64.StdEncoding.EncodeToString(sys.Keys.PublicKey),
+	}
+	p.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(sys.Keys.PrivateKey, p.signableMessage()))
+	return p, nil
+}
+
+func (p *LANPresence) signableMessage() []byte {
+	msg := struct {
+		ID          string `json:"id"`
+		PeerAddress string `json:"peer_address"`
+		Version     string `json:"version"`
+		Timestamp   int64  `json:"timestamp"`
+	}{p.SystemID.String(), p.PeerAddress, p.Version, p.Timestamp}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// Verify checks the packet's signature against the key it carries
+func (p *LANPresence) Verify() bool {
+	pubKey, err := base64.StdEncoding.DecodeString(p.PublicKey)
+	if err != nil || len(pubKey) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(p.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pubKey, p.signableMessage(), sig)
+}
+
+// lanDiscovery finds peers on the local network (nil on the DHT when -lan-discovery is off)
+type lanDiscovery struct {
+	conn  *net.UDPConn // Multicast listener
+	group *net.UDPAddr
+
+	mu          sync.Mutex
+	lastContact map[uuid.UUID]time.Time
+	lastReply   time.Time
+
+	found chan string // Addresses heard, for a node still waiting to bootstrap
+}
+
+// EnableLANDiscovery joins the LAN discovery multicast group
+// Must be called before Start
+func (dht *DHT) EnableLANDiscovery() error {
+	group, err := net.ResolveUDPAddr("udp4", LANDiscoveryGroup)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return fmt.Errorf("failed to join %s: %w", LANDiscoveryGroup, err)
+	}
+	dht.lan = &lanDiscovery{
+		conn:        conn,
+		group:       group,
+		lastContact: make(map[uuid.UUID]time.Time),
+		found:       make(chan string, 1),
+	}
+	log.Printf("LAN discovery enabled (multicast %s)", LANDiscoveryGroup)
+	return nil
+}
+
+// WaitForLANPeer returns the address of the first LAN system heard within timeout, or ""
+func (dht *DHT) WaitForLANPeer(timeout time.Duration) string {
+	if dht.lan == nil {
+		return ""
+	}
+	select {
+	case addr := <-dht.lan.found:
+		return addr
+	case <-time.After(timeout):
+		return ""
+	case <-dht.shutdown:
+		return ""
+	}
+}
+
+// lanPresenceLoop broadcasts our presence every LANPresenceInterval
+func (dht *DHT) lanPresenceLoop() {
+	defer dht.wg.Done()
+
+	dht.sendLANPresence()
+
+	ticker := time.NewTicker(LANPresenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			dht.sendLANPresence()
+		}
+	}
+}
+
+// sendLANPresence multicasts one signed presence packet
+func (dht *DHT) sendLANPresence() {
+	sys := dht.GetLocalSystem()
+	if sys.PeerAddress == "" {
+		return
+	}
+	p, err := NewLANPresence(sys)
+	if err != nil {
+		log.Printf("LAN discovery: failed to sign presence: %v", err)
+		return
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+
+	conn, err := net.DialUDP("udp4", nil, dht.lan.group)
+	if err != nil {
+		log.Printf("LAN discovery: failed to send presence: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write(data); err != nil {
+		log.Printf("LAN discovery: failed to send presence: %v", err)
+	}
+}
+
+// lanListenLoop reads presence packets until shutdown
+func (dht *DHT) lanListenLoop() {
+	defer dht.wg.Done()
+
+	// Closing the socket is the only way to unblock the read
+	go func() {
+		<-dht.shutdown
+		dht.lan.conn.Close()
+	}()
+
+	buf := make([]byte, lanMaxPacket)
+	for {
+		n, _, err := dht.lan.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-dht.shutdown:
+				return
+			default:
+			}
+			log.Printf("LAN discovery: read failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var p LANPresence
+		if err := json.Unmarshal(buf[:n], &p); err != nil {
+			continue
+		}
+		dht.handleLANPresence(&p)
+	}
+}
+
+// handleLANPresence checks a presence packet and pings its sender if we don't know it yet
+func (dht *DHT) handleLANPresence(p *LANPresence) {
+	// Our own packets loop back, and nobody else may claim our UUID
+	if p.SystemID == dht.localSystem.ID || p.PeerAddress == "" {
+		return
+	}
+	if !p.Verify() {
+		return
+	}
+	age := time.Since(time.Unix(p.Timestamp, 0))
+	if age > LANPresenceMaxAge || age < -LANPresenceMaxAge {
+		return
+	}
+	if version, err := ParseProtocolVersion(p.Version); err != nil || !CurrentProtocolVersion.IsCompatibleWith(version) {
+		return
+	}
+	if dht.routingTable.IsBlocked(p.SystemID) {
+		return
+	}
+	if bound, err := dht.storage.GetIdentityBinding(p.SystemID); err == nil && bound != "" && bound != p.PublicKey {
+		log.Printf("LAN discovery: presence for %s signed with the wrong key, ignoring", p.SystemID.String()[:8])
+		return
+	}
+
+	lan := dht.lan
+	select {
+	case lan.found <- p.PeerAddress:
+	default:
+	}
+
+	if dht.routingTable.IsRoutingTablePeer(p.SystemID) {
+		dht.routingTable.MarkLANDiscovered(p.SystemID)
+		return
+	}
+
+	now := time.Now()
+	lan.mu.Lock()
+	if now.Sub(lan.lastContact[p.SystemID]) < lanContactCooldown {
+		lan.mu.Unlock()
+		return
+	}
+	lan.lastContact[p.SystemID] = now
+	replyNow := now.Sub(lan.lastReply) >= lanReplyCooldown
+	if replyNow {
+		lan.lastReply = now
+	}
+	lan.mu.Unlock()
+
+	// A newcomer shouldn't have to wait a whole interval to hear about us
+	if replyNow {
+		dht.sendLANPresence()
+	}
+
+	// Until we have coordinates our pings fail validation; bootstrap picks the address up instead
+	if dht.localSystem.SponsorID == nil && dht.localSystem.Stars.Primary.Class != "X" {
+		return
+	}
+
+	go func() {
+		sys, err := dht.Ping(p.PeerAddress)
+		if err != nil {
+			log.Printf("LAN discovery: ping to %s failed: %v", p.PeerAddress, err)
+			return
+		}
+		if sys.ID != p.SystemID {
+			log.Printf("LAN discovery: %s answered as %s, not %s", p.PeerAddress, sys.ID.String()[:8], p.SystemID.String()[:8])
+			return
+		}
+		dht.routingTable.MarkLANDiscovered(sys.ID)
+		log.Printf("LAN discovery: found %s (%s) at %s", sys.Name, sys.ID.String()[:8], p.PeerAddress)
+	}()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// LatencyEWMAWeight is how much each new round trip moves a peer's latency
+	LatencyEWMAWeight = 0.3
+
+	// LatencyDegradedFactor is how many times its baseline a peer's latency must grow
+	// before the liveness loop logs it
+	LatencyDegradedFactor = 3.0
+
+	// LatencyDegradedFloor keeps fast peers' jitter (5 ms to 20 ms) out of the log
+	LatencyDegradedFloor = 200 * time.Millisecond
+)
+
+// LatencyBucketBounds are the upper bounds of the /api/stats latency histogram buckets
+// (the last bucket counts everything slower)
+var LatencyBucketBounds = []time.Duration{
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// LatencyBucket is one histogram bucket: peers whose latency is at most MaxMs
+// (MaxMs 0 for the open-ended last bucket)
+type LatencyBucket struct {
+	MaxMs float64 `json:"max_ms,omitempty"`
+	Count int     `json:"count"`
+}
+
+// LatencyHistogram is the latency part of /api/stats, over cached systems we've measured
+type LatencyHistogram struct {
+	Measured int             `json:"measured"`
+	MedianMs float64         `json:"median_ms"`
+	Buckets  []LatencyBucket `json:"buckets"`
+}
+
+// latencyMs converts a latency for the API and storage
+func latencyMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// RecordLatency folds a request's round trip into a peer's latency
+func (rt *RoutingTable) RecordLatency(id uuid.UUID, rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	cached, ok := rt.systemCache[id]
+	if !ok {
+		return
+	}
+	if cached.Latency == 0 {
+		cached.Latency = rtt
+	} else {
+		cached.Latency += time.Duration(LatencyEWMAWeight * float64(rtt-cached.Latency))
+	}
+}
+
+// GetLatency returns a peer's latency (0 if never measured)
+func (rt *RoutingTable) GetLatency(id uuid.UUID) time.Duration {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	if cached, ok := rt.systemCache[id]; ok {
+		return cached.Latency
+	}
+	return 0
+}
+
+// checkLatencyBaseline compares a peer's latency with its baseline: the best it has
+// recently been. Returns the old baseline if latency has grown LatencyDegradedFactor
+// times past it, which then becomes the new baseline so it's reported once
+func (rt *RoutingTable) checkLatencyBaseline(id uuid.UUID) (baseline, latency time.Duration, degraded bool) {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	cached, ok := rt.systemCache[id]
+	if !ok || cached.Latency == 0 {
+		return 0, 0, false
+	}
+	baseline, latency = cached.LatencyBaseline, cached.Latency
+	switch {
+	case baseline == 0 || latency < baseline:
+		cached.LatencyBaseline = latency
+	case latency >= LatencyDegradedFloor && float64(latency) >= LatencyDegradedFactor*float64(baseline):
+		cached.LatencyBaseline = latency
+		return baseline, latency, true
+	}
+	return baseline, latency, false
+}
+
+// sortByLatency orders systems fastest first, unmeasured ones last (stable otherwise)
+func (rt *RoutingTable) sortByLatency(nodes []*System) []*System {
+	latency := make(map[uuid.UUID]time.Duration, len(nodes))
+	rt.cacheMu.RLock()
+	for _, sys := range nodes {
+		if cached, ok := rt.systemCache[sys.ID]; ok {
+			latency[sys.ID] = cached.Latency
+		}
+	}
+	rt.cacheMu.RUnlock()
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := latency[nodes[i].ID], latency[nodes[j].ID]
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		return a < b
+	})
+	return nodes
+}
+
+// GetLatencyHistogram buckets the latencies of every cached system we've measured
+func (rt *RoutingTable) GetLatencyHistogram() LatencyHistogram {
+	var latencies []time.Duration
+	rt.cacheMu.RLock()
+	for _, cached := range rt.systemCache {
+		if cached.Latency > 0 {
+			latencies = append(latencies, cached.Latency)
+		}
+	}
+	rt.cacheMu.RUnlock()
+
+	h := LatencyHistogram{Measured: len(latencies), Buckets: make([]LatencyBucket, len(LatencyBucketBounds)+1)}
+	for i, bound := range LatencyBucketBounds {
+		h.Buckets[i].MaxMs = latencyMs(bound)
+	}
+	for _, l := range latencies {
+		i := sort.Search(len(LatencyBucketBounds), func(i int) bool { return l <= LatencyBucketBounds[i] })
+		h.Buckets[i].Count++
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		h.MedianMs = latencyMs(latencies[len(latencies)/2])
+	}
+	return h
+}
+
+// checkLatency logs a peer whose latency has degraded sharply and saves its latency
+// (called after each liveness ping)
+func (dht *DHT) checkLatency(sys *System) {
+	baseline, latency, degraded := dht.routingTable.checkLatencyBaseline(sys.ID)
+	if latency == 0 {
+		return
+	}
+	if degraded {
+		log.Printf("Latency to %s (%s) degraded from %v to %v", sys.Name, sys.ID.String()[:8],
+			baseline.Round(time.Millisecond), latency.Round(time.Millisecond))
+	}
+	if err := dht.storage.SetPeerLatency(sys.ID, latencyMs(latency)); err != nil {
+		log.Printf("Failed to save latency for %s: %v", sys.Name, err)
+	}
+}
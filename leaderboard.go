@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// RankClaimRefresh is how long our own rank claim and its proof are reused
+	RankClaimRefresh = time.Hour
+
+	// RankVerifyInterval is how often the verification task asks one peer to prove its rank
+	RankVerifyInterval = 10 * time.Minute
+
+	// RankVerificationTTL is how long a peer's proven rank stands before it's asked again
+	RankVerificationTTL = 24 * time.Hour
+
+	// DefaultLeaderboardLimit is how many systems /api/leaderboard lists by default
+	DefaultLeaderboardLimit = 100
+	MaxLeaderboardLimit     = 1000
+)
+
+// Leaderboard statuses: whether a rank is only what the system says, or a proof covered it
+const (
+	RankClaimed  = "claimed"
+	RankVerified = "verified"
+)
+
+// RankClaim is the credit rank a system shares in its announces, with a summary of the
+// proof behind it. It's signed, but only a proof (see verifyRank) shows it's earned
+type RankClaim struct {
+	Rank        string `json:"rank"`
+	ProvenHours int64  `json:"proven_hours"` // Uptime its attestations prove (see CalculateCreditsFromAttestations)
+	Attesters   int    `json:"attesters"`    // Distinct systems whose attestations it holds
+	AsOf        int64  `json:"as_of"`
+	Signature   string `json:"signature,omitempty"`
+}
+
+// signedData is what the claimer's key signs
+func (c *RankClaim) signedData(id uuid.UUID) []byte {
+	data := fmt.Sprintf("rank_claim:%s:%s:%d:%d:%d", id, c.Rank, c.ProvenHours, c.Attesters, c.AsOf)
+	hash := sha256.Sum256([]byte(data))
+	return hash[:]
+}
+
+// Verify checks a claim names a known rank and is signed by the sender's attested key
+func (c *RankClaim) Verify(id uuid.UUID, publicKey string) error {
+	if rankIndex(c.Rank) < 0 {
+		return &DHTError{Code: ErrCodeInvalidMessage, Message: "unknown rank in rank claim"}
+	}
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid rank claim signature"}
+	}
+	sig, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(key, c.signedData(id), sig) {
+		return &DHTError{Code: ErrCodeInvalidAttestation, Message: "invalid rank claim signature"}
+	}
+	return nil
+}
+
+// rankIndex is a rank's position in CreditRanks (0 is the highest; -1 if unknown)
+func rankIndex(name string) int {
+	for i, rank := range CreditRanks {
+		if rank.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// rankByName returns a rank by name (Unranked if unknown)
+func rankByName(name string) CreditRank {
+	if i := rankIndex(name); i >= 0 {
+		return CreditRanks[i]
+	}
+	return CreditRanks[len(CreditRanks)-1]
+}
+
+// BuildRankProof creates a proof that covers a rank's threshold with as few attestations
+// as possible. Credits are proven by the span between signed attestations, so the newest
+// one and the newest at least threshold hours older make the whole proof; the earliest
+// and latest of each day survive compaction, so old spans stay provable
+func BuildRankProof(system *System, threshold int64, allAttestations []*Attestation) *CreditProof {
+	var valid []*Attestation
+	for _, att := range allAttestations {
+		if att.addressedTo(system.ID) && att.FromSystemID != system.ID {
+			valid = append(valid, att)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].Timestamp > valid[j].Timestamp })
+
+	// Short of the threshold, the oldest verifiable one proves as much as there is
+	var newest, oldest *Attestation
+	for _, att := range valid {
+		if !att.Verify() {
+			continue
+		}
+		if newest == nil {
+			newest = att
+			continue
+		}
+		oldest = att
+		if newest.Timestamp-att.Timestamp >= threshold*3600 {
+			break
+		}
+	}
+	var included []*Attestation
+	for _, att := range []*Attestation{newest, oldest} {
+		if att != nil {
+			included = append(included, att)
+		}
+	}
+	return GenerateCreditProof(system, CalculateCreditsFromAttestations(included, system.ID), 0, included)
+}
+
+// verifyRankProof returns the rank a system's proof covers. The proof must be signed by
+// the key bound to the system; its attestations are checked like a transfer proof's
+func verifyRankProof(proof *CreditProof, id uuid.UUID, boundKey string) (CreditRank, error) {
+	if proof == nil {
+		return CreditRank{}, fmt.Errorf("no proof")
+	}
+	if proof.SystemID != id {
+		return CreditRank{}, fmt.Errorf("proof is for %s", proof.SystemID)
+	}
+	if boundKey == "" || proof.PublicKey != boundKey {
+		return CreditRank{}, fmt.Errorf("proof isn't signed by the system's key")
+	}
+	key, err := base64.StdEncoding.DecodeString(proof.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return CreditRank{}, fmt.Errorf("invalid proof key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(proof.Signature)
+	if err != nil {
+		return CreditRank{}, fmt.Errorf("invalid proof signature")
+	}
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d:%d", proof.SystemID, proof.ClaimedTotal, proof.AsOfTime, len(proof.Attestations))))
+	if !ed25519.Verify(key, hash[:], sig) {
+		return CreditRank{}, fmt.Errorf("invalid proof signature")
+	}
+	return GetRank(CalculateCreditsFromAttestations(proof.Attestations, id)), nil
+}
+
+// rankSharing holds our own rank claim and proof (rebuilt at most every RankClaimRefresh)
+type rankSharing struct {
+	mu      sync.Mutex
+	private bool // -private-credits: no claims, no proofs, not on our own leaderboard
+	claim   *RankClaim
+	proof   *CreditProof
+	builtAt time.Time
+}
+
+// EnablePrivateCredits keeps our rank to ourselves (-private-credits)
+func (dht *DHT) EnablePrivateCredits() {
+	dht.ranks.mu.Lock()
+	dht.ranks.private = true
+	dht.ranks.mu.Unlock()
+	log.Printf("Credit rank sharing disabled (-private-credits)")
+}
+
+// PrivateCredits reports whether we keep our rank to ourselves
+func (dht *DHT) PrivateCredits() bool {
+	dht.ranks.mu.Lock()
+	defer dht.ranks.mu.Unlock()
+	return dht.ranks.private
+}
+
+// localRank returns our rank claim and the proof behind it (nil with -private-credits)
+func (dht *DHT) localRank() (*RankClaim, *CreditProof) {
+	dht.ranks.mu.Lock()
+	defer dht.ranks.mu.Unlock()
+	if dht.ranks.private || dht.localSystem.Keys == nil {
+		return nil, nil
+	}
+	if dht.ranks.claim != nil && time.Since(dht.ranks.builtAt) < RankClaimRefresh {
+		return dht.ranks.claim, dht.ranks.proof
+	}
+
+	balance, err := dht.storage.GetCreditBalance(dht.localSystem.ID)
+	if err != nil {
+		return nil, nil
+	}
+	if err := dht.FlushAttestations(); err != nil {
+		log.Printf("Failed to save buffered attestations: %v", err)
+	}
+	rank := GetRank(balance.Balance)
+	candidates, err := dht.rankProofCandidates(rank.Threshold)
+	if err != nil {
+		log.Printf("Failed to load attestations for rank proof: %v", err)
+		return nil, nil
+	}
+	proof := BuildRankProof(dht.localSystem, rank.Threshold, candidates)
+	attesters, err := dht.storage.CountAttestersForSystem(dht.localSystem.ID)
+	if err != nil {
+		log.Printf("Failed to count attesters for rank proof: %v", err)
+		return nil, nil
+	}
+
+	claim := &RankClaim{
+		Rank:        rank.Name,
+		ProvenHours: proof.ClaimedTotal,
+		Attesters:   attesters,
+		AsOf:        time.Now().Unix(),
+	}
+	claim.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(dht.localSystem.Keys.PrivateKey, claim.signedData(dht.localSystem.ID)))
+
+	dht.ranks.claim, dht.ranks.proof, dht.ranks.builtAt = claim, proof, time.Now()
+	return claim, proof
+}
+
+// rankProofCandidates loads the only attestations BuildRankProof can pick: the newest,
+// the newest at least threshold hours older and the oldest
+func (dht *DHT) rankProofCandidates(threshold int64) ([]*Attestation, error) {
+	id := dht.localSystem.ID
+	newest, err := dht.storage.GetRecentAttestationsForSystem(id, 1, math.MaxInt64)
+	if err != nil || len(newest) == 0 {
+		return nil, err
+	}
+	older, err := dht.storage.GetRecentAttestationsForSystem(id, 1, newest[0].Timestamp-threshold*3600+1)
+	if err != nil {
+		return nil, err
+	}
+	oldest, err := dht.storage.GetOldestAttestationForSystem(id)
+	if err != nil {
+		return nil, err
+	}
+	candidates := append(newest, older...)
+	if oldest != nil {
+		candidates = append(candidates, oldest)
+	}
+	return candidates, nil
+}
+
+// attachRankClaim adds our rank claim to an outgoing announce
+func (dht *DHT) attachRankClaim(msg *DHTMessage) {
+	msg.RankClaim, _ = dht.localRank()
+}
+
+// recordRankClaim stores the rank claim (or its absence) in an announce we received
+// Claims only count first-hand; nodes that never share ranks are left alone
+func (dht *DHT) recordRankClaim(msg *DHTMessage) {
+	if msg.RankClaim == nil && !msg.PeerCapabilities().Has(CapRankClaims) {
+		return
+	}
+	if dht.routingTable.SetRankClaim(msg.FromSystem.ID, msg.RankClaim) {
+		if err := dht.storage.SetPeerRankClaim(msg.FromSystem.ID, msg.RankClaim); err != nil {
+			log.Printf("Failed to save rank claim of %s: %v", msg.FromSystem.Name, err)
+		}
+	}
+}
+
+// handleRankProof answers a rank_proof request with the proof behind our claim
+func (dht *DHT) handleRankProof(msg *DHTMessage) (*DHTMessage, error) {
+	_, proof := dht.localRank()
+	if proof == nil {
+		return nil, &DHTError{Code: ErrCodeInvalidMessage, Message: "this system keeps its credits private"}
+	}
+	return NewRankProofResponse(dht.localSystem, msg.FromSystem.ID, proof, msg.RequestID)
+}
+
+// SetRankClaim records a system's rank claim (nil: it stopped sharing one); a different
+// rank drops the old one's verification. Returns false if the system isn't cached
+func (rt *RoutingTable) SetRankClaim(id uuid.UUID, claim *RankClaim) bool {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	cached, ok := rt.systemCache[id]
+	if !ok {
+		return false
+	}
+	if claim == nil || cached.RankClaim == nil || cached.RankClaim.Rank != claim.Rank {
+		cached.RankVerified = ""
+		cached.RankCheckedAt = time.Time{}
+	}
+	cached.RankClaim = claim
+	return true
+}
+
+// nextRankToVerify picks the system whose claim most needs a proof: never or longest
+// ago checked, highest rank first. Unranked claims need no proof
+func (rt *RoutingTable) nextRankToVerify(now time.Time) *System {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	var best *CachedSystem
+	for _, cached := range rt.systemCache {
+		claim := cached.RankClaim
+		if claim == nil || rankByName(claim.Rank).Threshold == 0 || cached.System.PeerAddress == "" ||
+			now.Sub(cached.RankCheckedAt) < RankVerificationTTL {
+			continue
+		}
+		if best == nil || cached.RankCheckedAt.Before(best.RankCheckedAt) ||
+			(cached.RankCheckedAt.Equal(best.RankCheckedAt) && rankIndex(claim.Rank) < rankIndex(best.RankClaim.Rank)) {
+			best = cached
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.System
+}
+
+// verifyRank asks a system to prove its claimed rank and records the rank the proof
+// covers. Unreachable systems are asked again after RankVerificationTTL like any other
+func (dht *DHT) verifyRank(sys *System) error {
+	dht.routingTable.cacheMu.Lock()
+	if cached, ok := dht.routingTable.systemCache[sys.ID]; ok {
+		cached.RankCheckedAt = time.Now()
+	}
+	dht.routingTable.cacheMu.Unlock()
+
+	if !dht.peerSupports(sys.ID, CapRankClaims) {
+		return fmt.Errorf("%s doesn't serve rank proofs", sys.Name)
+	}
+	msg, err := NewRankProofRequest(dht.localSystem, sys.ID, "")
+	if err != nil {
+		return err
+	}
+	resp, err := dht.sendRequest(sys.PeerAddress, msg)
+	if err != nil {
+		return err
+	}
+	boundKey, err := dht.storage.GetIdentityBinding(sys.ID)
+	if err != nil {
+		return err
+	}
+
+	rank, err := verifyRankProof(resp.RankProof, sys.ID, boundKey)
+	if err != nil {
+		log.Printf("Rank proof from %s rejected: %v", sys.Name, err)
+		rank = CreditRanks[len(CreditRanks)-1]
+	}
+	now := time.Now()
+	dht.routingTable.cacheMu.Lock()
+	cached, ok := dht.routingTable.systemCache[sys.ID]
+	if ok {
+		cached.RankVerified = rank.Name
+		cached.RankCheckedAt = now
+		if cached.RankClaim != nil && rankIndex(rank.Name) > rankIndex(cached.RankClaim.Rank) {
+			log.Printf("%s claims %s but its proof only covers %s", sys.Name, cached.RankClaim.Rank, rank.Name)
+		}
+	}
+	dht.routingTable.cacheMu.Unlock()
+	if ok {
+		if err := dht.storage.SetPeerRankVerification(sys.ID, rank.Name, now); err != nil {
+			log.Printf("Failed to save rank verification of %s: %v", sys.Name, err)
+		}
+	}
+	return nil
+}
+
+// rankVerificationLoop spot-checks one peer's claimed rank every RankVerifyInterval
+func (dht *DHT) rankVerificationLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskRankVerification, every(RankVerifyInterval))
+
+	ticker := time.NewTicker(RankVerifyInterval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(RankVerifyInterval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(RankVerifyInterval))
+		case <-t.trigger:
+		}
+		t.run(func() (int, error) {
+			sys := dht.routingTable.nextRankToVerify(time.Now())
+			if sys == nil {
+				return 0, nil
+			}
+			return 1, dht.verifyRank(sys)
+		})
+	}
+}
+
+// leaderboardEntries lists the cached systems that shared their rank, unsorted
+func (rt *RoutingTable) leaderboardEntries() []LeaderboardEntry {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	var entries []LeaderboardEntry
+	for _, cached := range rt.systemCache {
+		claim := cached.RankClaim
+		if claim == nil {
+			continue
+		}
+		rank := rankByName(claim.Rank)
+		entry := LeaderboardEntry{
+			ID:          cached.System.ID.String(),
+			Name:        cached.System.Name,
+			StarClass:   cached.System.Stars.Primary.Class,
+			FirstSeen:   cached.LearnedAt.Unix(),
+			Rank:        rank.Name,
+			RankColor:   rank.Color,
+			Status:      RankClaimed,
+			ProvenHours: claim.ProvenHours,
+		}
+		switch {
+		case rank.Threshold == 0:
+			entry.Status = RankVerified
+		case cached.RankVerified == "":
+		case rankIndex(cached.RankVerified) <= rankIndex(rank.Name):
+			entry.Status = RankVerified
+		default:
+			entry.VerifiedRank = cached.RankVerified
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// LeaderboardEntry is one system on /api/leaderboard
+type LeaderboardEntry struct {
+	Position     int    `json:"position"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	StarClass    string `json:"star_class"`
+	FirstSeen    int64  `json:"first_seen,omitempty"` // When we learned of it (our own: when it was created)
+	Rank         string `json:"rank"`
+	RankColor    string `json:"rank_color"`
+	Status       string `json:"status"`                  // claimed or verified
+	VerifiedRank string `json:"verified_rank,omitempty"` // What its last proof covered, when below its claim
+	ProvenHours  int64  `json:"proven_hours"`
+	Local        bool   `json:"local,omitempty"`
+}
+
+// Leaderboard is the /api/leaderboard response
+type Leaderboard struct {
+	Total   int                `json:"total"` // Systems with a known rank
+	Systems []LeaderboardEntry `json:"systems"`
+	Local   *LeaderboardEntry  `json:"local,omitempty"` // Our own entry, wherever it ranks (left out with -private-credits)
+}
+
+// standing is the rank an entry is placed by: a claim its proof fell short of counts
+// only for what the proof covered
+func (e *LeaderboardEntry) standing() int {
+	if e.VerifiedRank != "" {
+		return rankIndex(e.VerifiedRank)
+	}
+	return rankIndex(e.Rank)
+}
+
+// GetLeaderboard ranks the systems that shared their rank, and us unless includeLocal is
+// false or our credits are private: highest rank first, proven ranks ahead of claims
+func (dht *DHT) GetLeaderboard(limit int, includeLocal bool) *Leaderboard {
+	entries := dht.routingTable.leaderboardEntries()
+	var claim *RankClaim
+	if includeLocal {
+		claim, _ = dht.localRank()
+	}
+	if claim != nil {
+		rank := rankByName(claim.Rank)
+		entries = append(entries, LeaderboardEntry{
+			ID:          dht.localSystem.ID.String(),
+			Name:        dht.localSystem.Name,
+			StarClass:   dht.localSystem.Stars.Primary.Class,
+			FirstSeen:   dht.localSystem.CreatedAt.Unix(),
+			Rank:        rank.Name,
+			RankColor:   rank.Color,
+			Status:      RankVerified, // Our own balance
+			ProvenHours: claim.ProvenHours,
+			Local:       true,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if ra, rb := a.standing(), b.standing(); ra != rb {
+			return ra < rb
+		}
+		if a.Status != b.Status {
+			return a.Status == RankVerified
+		}
+		if a.ProvenHours != b.ProvenHours {
+			return a.ProvenHours > b.ProvenHours
+		}
+		return a.Name < b.Name
+	})
+
+	board := &Leaderboard{Total: len(entries), Systems: []LeaderboardEntry{}}
+	for i := range entries {
+		entries[i].Position = i + 1
+		if entries[i].Local {
+			local := entries[i]
+			board.Local = &local
+		}
+		if i < limit {
+			board.Systems = append(board.Systems, entries[i])
+		}
+	}
+	return board
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Lookups and the routing table otherwise go by XOR distance, which has nothing to do with
+// where systems sit in space: two neighbours on the map may never peer. A share of each
+// system's peer capacity is therefore kept as local slots for the systems nearest to it by
+// Euclidean distance; the rest are routing slots, filled as before. Both kinds are routing
+// table peers in every other respect, reciprocity credit included.
+const (
+	// DefaultLocalPeerPercent is the share of GetMaxPeers kept for local slots (-local-peer-percent)
+	DefaultLocalPeerPercent = 25
+
+	// LocalPeerInterval is how often local slots are reassigned
+	LocalPeerInterval = 15 * time.Minute
+
+	// LocalPeerCandidates caps the systems tried per run at this many times the quota,
+	// nearest first, so a cluster of full neighbours doesn't send us announcing across the galaxy
+	LocalPeerCandidates = 2
+)
+
+// Slot kinds in /api/peers
+const (
+	SlotLocal   = "local"
+	SlotRouting = "routing"
+)
+
+// SetLocalPeerPercent changes the share of peer capacity kept for local slots (0 turns them off)
+func (dht *DHT) SetLocalPeerPercent(percent int) {
+	dht.localPeerPercent = percent
+}
+
+// localPeerQuota is how many local slots we have
+func (dht *DHT) localPeerQuota() int {
+	return dht.localSystem.GetMaxPeers() * dht.localPeerPercent / 100
+}
+
+// localPeerLoop periodically gives the local slots to the nearest systems that take us
+func (dht *DHT) localPeerLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskLocalPeers, every(LocalPeerInterval))
+
+	ticker := time.NewTicker(LocalPeerInterval)
+	defer ticker.Stop()
+
+	// First run once bootstrap has filled the cache, or on request
+	t.scheduleNext(time.Now().Add(2 * time.Minute))
+	first := time.After(2 * time.Minute)
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-first:
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(LocalPeerInterval))
+		case <-t.trigger:
+		}
+		t.run(dht.refreshLocalPeers)
+	}
+}
+
+// refreshLocalPeers walks the nearest verified systems, keeping those already in the routing
+// table and announcing to the ones that went stale, until the quota is filled. A system that
+// turns us away (at capacity or unreachable) leaves its slot to the next nearest.
+// Returns how many systems were announced to
+func (dht *DHT) refreshLocalPeers() (int, error) {
+	rt := dht.routingTable
+	quota := dht.localPeerQuota()
+	if quota == 0 {
+		rt.SetLocalSlots(nil)
+		return 0, nil
+	}
+
+	var slots []uuid.UUID
+	announced := 0
+	for _, sys := range rt.GetNearest(dht.localSystem, quota*LocalPeerCandidates) {
+		if len(slots) == quota {
+			break
+		}
+		if rt.IsRoutingTablePeer(sys.ID) {
+			slots = append(slots, sys.ID)
+			continue
+		}
+		if sys.PeerAddress == "" {
+			continue
+		}
+
+		announced++
+		err := dht.AnnounceToSystem(sys)
+		var full *AtCapacityError
+		switch {
+		case err == nil:
+			log.Printf("  %s took a local peer slot (%.1f units away)", sys.Name, dht.localSystem.DistanceTo(sys))
+			slots = append(slots, sys.ID)
+		case errors.As(err, &full):
+			log.Printf("  %s is at capacity, skipping it for a local peer slot", sys.Name)
+		default:
+			log.Printf("  Failed to announce to %s for a local peer slot: %v", sys.Name, err)
+		}
+	}
+	rt.SetLocalSlots(slots)
+	return announced, nil
+}
+
+// GetNearest returns up to n verified systems (ones we've had direct contact with, however
+// long ago) nearest to point by Euclidean distance, nearest first, ties broken by ID.
+// Retracted and quarantined systems and ones whose coordinates are unchecked are left out,
+// as are point and the local system
+func (rt *RoutingTable) GetNearest(point *System, n int) []*System {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+
+	type candidate struct {
+		sys      *System
+		distance float64
+	}
+	var candidates []candidate
+	for id, cached := range rt.systemCache {
+		if id == point.ID || id == rt.localID || !cached.Verified {
+			continue
+		}
+		if cached.Retracted || cached.Quarantined || cached.CoordsUnverified {
+			continue
+		}
+		candidates = append(candidates, candidate{cached.System, point.DistanceTo(cached.System)})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return bytes.Compare(candidates[i].sys.ID[:], candidates[j].sys.ID[:]) < 0
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	result := make([]*System, len(candidates))
+	for i, c := range candidates {
+		result[i] = c.sys
+	}
+	return result
+}
+
+// SetLocalSlots gives the local slots to ids, taking them from everyone else
+func (rt *RoutingTable) SetLocalSlots(ids []uuid.UUID) {
+	slots := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		slots[id] = true
+	}
+
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	for id, cached := range rt.systemCache {
+		cached.LocalSlot = slots[id]
+	}
+}
+
+// IsLocalSlot reports whether a system holds one of our local slots
+func (rt *RoutingTable) IsLocalSlot(id uuid.UUID) bool {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	cached, ok := rt.systemCache[id]
+	return ok && cached.LocalSlot
+}
+
+// SlotCounts returns how many routing table peers hold local and routing slots
+func (rt *RoutingTable) SlotCounts() (local, routing int) {
+	for _, cached := range rt.GetAllRoutingTableNodesWithMeta() {
+		if cached.LocalSlot {
+			local++
+		} else {
+			routing++
+		}
+	}
+	return local, routing
+}
+
+// claimLocalSlot gives id a local slot if one is free, or if it's nearer to point than the
+// farthest holder, which then goes back to being a routing peer. Reports whether id holds one
+func (rt *RoutingTable) claimLocalSlot(id uuid.UUID, point *System, quota int) bool {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+
+	cached, ok := rt.systemCache[id]
+	if !ok || cached.Quarantined || cached.CoordsUnverified || cached.Retracted {
+		return false
+	}
+	if cached.LocalSlot {
+		return true
+	}
+	if quota == 0 {
+		return false
+	}
+
+	var farthest *CachedSystem
+	holders := 0
+	for _, other := range rt.systemCache {
+		if !other.LocalSlot {
+			continue
+		}
+		holders++
+		if farthest == nil || point.DistanceTo(other.System) > point.DistanceTo(farthest.System) {
+			farthest = other
+		}
+	}
+	if holders >= quota {
+		if point.DistanceTo(cached.System) >= point.DistanceTo(farthest.System) {
+			return false
+		}
+		farthest.LocalSlot = false
+	}
+	cached.LocalSlot = true
+	return true
+}
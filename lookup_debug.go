@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// ErrLookupBusy is returned while another debug lookup is running
+var ErrLookupBusy = errors.New("a lookup is already running, try again when it finishes")
+
+// LookupNode is a system a debug lookup returned
+type LookupNode struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	PeerAddress string `json:"peer_address"`
+}
+
+// LookupQueryReport is one peer a debug lookup asked
+type LookupQueryReport struct {
+	LookupNode
+	Hop        int     `json:"hop"`
+	Outcome    string  `json:"outcome"`  // answered, timed_out, failed, rejected, held_back or abandoned
+	Returned   int     `json:"returned"` // Systems in its answer
+	DurationMs float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// LookupReport is the outcome of a debug lookup (GET /api/lookup/{id})
+type LookupReport struct {
+	Target      string              `json:"target"`
+	Found       *LookupNode         `json:"found,omitempty"`
+	WasCached   bool                `json:"was_cached"` // We held the target before asking
+	Closest     []LookupNode        `json:"closest"`
+	Hops        int                 `json:"hops"`
+	DurationMs  float64             `json:"duration_ms"`
+	TimedOut    int                 `json:"timed_out"`
+	DeadlineHit bool                `json:"deadline_hit"`
+	Queries     []LookupQueryReport `json:"queries"`
+}
+
+// lookupNode describes a system for a LookupReport
+func lookupNode(sys *System) LookupNode {
+	return LookupNode{ID: sys.ID.String(), Name: sys.Name, PeerAddress: sys.PeerAddress}
+}
+
+// DebugLookup runs a find_node lookup for target over the network, even when it's cached,
+// and reports every query. Only one runs at a time, since each one sends real traffic
+func (dht *DHT) DebugLookup(target uuid.UUID) (*LookupReport, error) {
+	if !dht.debugLookupMu.TryLock() {
+		return nil, ErrLookupBusy
+	}
+	defer dht.debugLookupMu.Unlock()
+
+	report := &LookupReport{
+		Target:    target.String(),
+		WasCached: dht.routingTable.GetCachedSystem(target) != nil,
+		Closest:   []LookupNode{},
+		Queries:   []LookupQueryReport{},
+	}
+	log.Printf("Debug lookup for %s requested", target.String()[:8])
+	result := dht.findNode(target, false)
+
+	if result.Found != nil {
+		found := lookupNode(result.Found)
+		report.Found = &found
+	}
+	for _, sys := range result.ClosestNodes {
+		report.Closest = append(report.Closest, lookupNode(sys))
+	}
+	report.Hops = result.Hops
+	report.DurationMs = latencyMs(result.Duration)
+	report.TimedOut = result.TimedOut
+	report.DeadlineHit = result.DeadlineHit
+	for _, q := range result.Queries {
+		r := LookupQueryReport{
+			LookupNode: lookupNode(q.System),
+			Hop:        q.Hop,
+			Outcome:    q.Outcome,
+			Returned:   q.Returned,
+			DurationMs: latencyMs(q.Duration),
+		}
+		if q.Err != nil {
+			r.Error = q.Err.Error()
+		}
+		report.Queries = append(report.Queries, r)
+	}
+	return report, nil
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,14 +25,239 @@ var isolatedMode *bool
 func main() {
 	// Parse command line flags (CLI args override environment variables)
 	name := flag.String("name", getEnv("STELLAR_NAME", ""), "Name for this star system")
+	rename := flag.String("rename", getEnv("STELLAR_RENAME", ""), "Rename an existing star system at startup (no-op once applied)")
 	seed := flag.String("seed", getEnv("STELLAR_SEED", ""), "Seed for deterministic UUID generation (optional)")
+	saltUUID := flag.Bool("salt-uuid", getEnv("STELLAR_SALT_UUID", "") == "true", "With -seed, mix a random salt kept in the database into a new system's UUID, so it can't be tied to the hardware fingerprint (the UUID then can't be rebuilt without the database)")
+	showFingerprint := flag.Bool("show-fingerprint", false, "Log the full hardware fingerprint at startup instead of a truncated hash (it identifies the machine; keep it out of shared logs)")
 	dbPath := flag.String("db", getEnv("STELLAR_DB", "/data/stellar-lab.db"), "Path to SQLite database")
+	dataDir := flag.String("data-dir", getEnv("STELLAR_DATA_DIR", ""), "Directory holding the database and log instead of -db (default with -profile: ~/.local/share/stellar-lab or the OS equivalent)")
+	profile := flag.String("profile", getEnv("STELLAR_PROFILE", ""), "Named node under the data directory, with its own database and automatically assigned ports (recorded in profile.json)")
 	address := flag.String("address", getEnv("STELLAR_ADDRESS", "0.0.0.0:8080"), "Address to bind web UI server (host:port)")
 	publicAddr := flag.String("public-address", getEnv("STELLAR_PUBLIC_ADDRESS", ""), "Public address for peer connections (host:port)")
-	bootstrapPeer := flag.String("bootstrap", getEnv("STELLAR_BOOTSTRAP", ""), "Bootstrap peer address (host:port)")
+	listenHost := flag.String("listen-host", getEnv("STELLAR_LISTEN_HOST", ""), "Interface IP to bind the DHT port on (default all interfaces, IPv4 and IPv6); the port always comes from -public-address")
+	detectAddr := flag.Bool("detect-public-address", getEnv("STELLAR_DETECT_PUBLIC_ADDRESS", "") == "true", "Update the public address host when peers report a different source IP (for dynamic IPs)")
+	publicUI := flag.Bool("public-ui", getEnv("STELLAR_PUBLIC_UI", "") == "true", "Serve a read-only web UI safe to expose publicly (no credits, attestations, IDs or addresses)")
+	lanDiscovery := flag.Bool("lan-discovery", getEnv("STELLAR_LAN_DISCOVERY", "") == "true", "Find peers on the local network via UDP multicast (for LAN parties and demos)")
+	noUPnP := flag.Bool("no-upnp", getEnv("STELLAR_NO_UPNP", "") == "true", "Don't try to forward the peer port through the router with UPnP/NAT-PMP")
+	adminToken := flag.String("admin-token", getEnv("STELLAR_ADMIN_TOKEN", ""), "Token for mutating web API calls (Authorization: Bearer); default is generated on first run and stored")
+	peerTLS := flag.Bool("peer-tls", getEnv("STELLAR_PEER_TLS", "") == "true", "Also accept TLS on the DHT port, with a certificate pinned to this system's identity key")
+	operatorHandle := flag.String("operator-handle", getEnv("STELLAR_OPERATOR_HANDLE", ""), "Handle shown as \"operated by @handle\" on peers' maps and detail pages (optional, signed and shared with the system's info)")
+	operatorBio := flag.String("operator-bio", getEnv("STELLAR_OPERATOR_BIO", ""), fmt.Sprintf("Short bio shared with the operator handle (at most %d bytes)", MaxProfileBioLength))
+	operatorURL := flag.String("operator-url", getEnv("STELLAR_OPERATOR_URL", ""), "http or https link shared with the operator handle")
+	operatorPrivate := flag.Bool("operator-private", getEnv("STELLAR_OPERATOR_PRIVATE", "") == "true", "Ask peers to leave the operator profile out of their public web UIs (-public-ui)")
+	privateCredits := flag.Bool("private-credits", getEnv("STELLAR_PRIVATE_CREDITS", "") == "true", "Don't share this system's credit rank with peers or prove it to them")
+	var bootstrapPeers addressList
+	flag.Var(&bootstrapPeers, "bootstrap", "Bootstrap peer addresses (host:port), comma-separated or repeated; remembered for later restarts")
+	sendCredits := flag.String("send-credits", "", "Send credits to another system and exit (format: \"uuid:amount:memo\")")
+	blockList := flag.String("block", getEnv("STELLAR_BLOCK", ""), "Comma-separated systems to block at startup (\"uuid\", \"uuid:24h\" or \"uuid:24h:reason\")")
+	supersede := flag.String("supersede", "", "UUID of this node's previous identity to replace (merges its local history and tells peers)")
+	supersedeKey := flag.String("supersede-key", "", "Base64 private key of the previous identity (makes -supersede authoritative instead of advisory)")
+	rotateKey := flag.Bool("rotate-key", false, "Move this system's UUID to a new keypair at startup, signed over by the old key (for a leaked key)")
+	exportPeers := flag.String("export-peers", "", "Write this node's verified peers to a JSON file and exit (for onboarding machines onto a private mesh)")
+	importPeers := flag.String("import-peers", "", "Cache the peers in an -export-peers file at startup and verify them straight away")
+	revokeIdentity := flag.Bool("revoke-identity", false, "Revoke this system's identity, tell known peers and exit; the system can't be started again")
+	maxFullSync := flag.Int("max-full-sync", getEnvInt("STELLAR_MAX_FULL_SYNC", DefaultMaxFullSyncSystems), "Most systems to accept from, or serve in, one full-sync")
+	maxCachedSystems := flag.Int("max-cached-systems", getEnvInt("STELLAR_MAX_CACHED_SYSTEMS", DefaultMaxCachedSystems), "Most systems to keep in the in-memory cache; never-verified gossip is evicted first, routing table peers never")
+	maxMessageKB := flag.Int("max-message-kb", getEnvInt("STELLAR_MAX_MESSAGE_KB", DefaultMaxMessageBytes>>10), "Largest DHT message body, in KB, this node accepts (advertised to peers)")
+	localPeerPercent := flag.Int("local-peer-percent", getEnvInt("STELLAR_LOCAL_PEER_PERCENT", DefaultLocalPeerPercent), "Percent of this system's max peers kept for the systems nearest to it in space (0 = none)")
+	lookupTimeout := flag.Int("lookup-timeout-seconds", getEnvInt("STELLAR_LOOKUP_TIMEOUT_SECONDS", int(DefaultLookupTimeout/time.Second)), "Seconds a peer lookup may take before it settles for the closest systems found so far")
+	bandwidthBudget := flag.Int("bandwidth-budget", getEnvInt("STELLAR_BANDWIDTH_BUDGET", 0), "Megabytes a day the DHT may use, for metered connections; the node cuts back in stages as it nears it (0 = no budget)")
+	attestationFlush := flag.Int("attestation-flush-seconds", getEnvInt("STELLAR_ATTESTATION_FLUSH_SECONDS", int(DefaultAttestationFlushInterval/time.Second)), "Seconds to buffer received attestations before writing them in one batch (0 = write each immediately)")
+	compactNow := flag.Bool("compact", false, "Compact old attestations and exit")
+	status := flag.Bool("status", false, "Print this node's status as JSON and exit (exit code 0 healthy, 1 low connectivity, 2 isolated or not running)")
+	doctor := flag.Bool("doctor", false, "Check the database for corruption and inconsistencies and exit (non-zero if problems remain)")
+	doctorFix := flag.Bool("doctor-fix", false, "With -doctor: back up the database, then repair what can be repaired safely")
+	installService := flag.Bool("install-service", false, "Install this node as a systemd unit (or Windows service) running with the flags given here, and exit")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "List the schema migrations the database needs, without running them, and exit")
+	compactSchedule := flag.String("compact-schedule", getEnv("STELLAR_COMPACT_SCHEDULE", DefaultCompactionSchedule), "When to compact attestations (\"HH:MM\" local time, \"@hourly\" or \"every 6h\")")
+	compactKeepDays := flag.Int("compact-keep-days", getEnvInt("STELLAR_COMPACT_KEEP_DAYS", DefaultCompactionKeepDays), "Days of attestations to keep in full when compacting")
+	retentionSpec := flag.String("retention", getEnv("STELLAR_RETENTION", ""), "Comma-separated table limits overriding the defaults (\"table:max_rows:max_age\", e.g. \"peer_connections:50000:48h,galaxy_snapshots::90d\"; 0 lifts a limit)")
+	compactMaxDBMB := flag.Int("compact-max-db-mb", getEnvInt("STELLAR_COMPACT_MAX_DB_MB", 0), "Compact immediately when the database exceeds this size in MB (0 = disabled)")
 	isolatedMode = flag.Bool("isolated", false, "Isolated network mode (skips seed nodes, first node becomes genesis)")
+	configFile := flag.String("config", getEnv("STELLAR_CONFIG", ""), "Config file (default: stellar-lab.toml in the data directory); command line flags override it")
+	initSetup := flag.Bool("init", false, "Interactively write (or edit) the config file and exit")
+	devAssets := flag.String("dev-assets", getEnv("STELLAR_DEV_ASSETS", ""), "Serve the web UI from this web/ directory instead of the copy built in, re-reading templates on every request (for UI development)")
 	flag.Parse()
 
+	// The config file fills in whatever the command line and environment leave unset
+	cfgPath := configFilePath(*configFile, *dataDir, *profile)
+	if *initSetup {
+		var dir *DataDir
+		if *configFile == "" || *dataDir != "" || *profile != "" {
+			var err error
+			if dir, err = OpenDataDir(*dataDir, *profile, true); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		start := "stellar-lab"
+		for _, f := range []string{"config", "data-dir", "profile"} {
+			if v := flag.Lookup(f).Value.String(); v != "" {
+				start += fmt.Sprintf(" -%s %q", f, v)
+			}
+		}
+		os.Exit(runInit(os.Stdin, os.Stdout, cfgPath, dir, start))
+	}
+	if cfgPath != "" {
+		switch err := LoadConfig(cfgPath); {
+		case err == nil:
+			// A config found in the default data directory puts the node there
+			if *configFile == "" && *dataDir == "" && *profile == "" {
+				*dataDir = filepath.Dir(cfgPath)
+			}
+		case !os.IsNotExist(err) || *configFile != "":
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if len(bootstrapPeers) == 0 {
+		bootstrapPeers.Set(getEnv("STELLAR_BOOTSTRAP", ""))
+	}
+
+	// Validate compaction settings up front so a typo fails fast
+	schedule, err := ParseCompactionSchedule(*compactSchedule)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *compactKeepDays < 1 {
+		log.Fatal("Error: -compact-keep-days must be at least 1")
+	}
+	retentionLimits, err := ParseRetentionSpec(*retentionSpec)
+	if err != nil {
+		log.Fatalf("Error: -retention: %v", err)
+	}
+	if *maxFullSync < 1 {
+		log.Fatal("Error: -max-full-sync must be at least 1")
+	}
+	if *maxCachedSystems < MaxPeers {
+		log.Fatalf("Error: -max-cached-systems must be at least %d", MaxPeers)
+	}
+	if *maxMessageKB < MinMaxMessageBytes>>10 {
+		log.Fatalf("Error: -max-message-kb must be at least %d", MinMaxMessageBytes>>10)
+	}
+	if *lookupTimeout < 1 {
+		log.Fatal("Error: -lookup-timeout-seconds must be at least 1")
+	}
+	if *localPeerPercent < 0 || *localPeerPercent > 100 {
+		log.Fatal("Error: -local-peer-percent must be between 0 and 100")
+	}
+	if *attestationFlush < 0 {
+		log.Fatal("Error: -attestation-flush-seconds can't be negative")
+	}
+	if *bandwidthBudget < 0 {
+		log.Fatal("Error: -bandwidth-budget can't be negative")
+	}
+
+	// A data directory (or profile) owns the database, the log and, for a profile, the ports
+	// The status, doctor, migration and compaction modes only use one that already exists
+	var dir *DataDir
+	flatDBPath := *dbPath
+	runningNode := !*status && !*doctor && !*doctorFix && !*compactNow && !*migrateDryRun && !*installService
+	if *dataDir != "" || *profile != "" {
+		if dir, err = OpenDataDir(*dataDir, *profile, runningNode); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		*dbPath = dir.DatabasePath()
+		if dir.Profile != nil && !flagGiven("address", "STELLAR_ADDRESS") {
+			*address = dir.Profile.WebAddress()
+		}
+	}
+
+	// Status mode: ask the running node (or read its database) and exit with its health
+	if *status {
+		os.Exit(runStatus(*address, *dbPath))
+	}
+
+	// Doctor mode: check (and optionally repair) the database and exit
+	if *doctor || *doctorFix {
+		os.Exit(runDoctor(*dbPath, *doctorFix))
+	}
+
+	// Service install: write the unit file (or register the Windows service) and exit
+	if *installService {
+		os.Exit(runInstallService(*profile))
+	}
+
+	// Migration dry run: report what opening the database would change and exit
+	if *migrateDryRun {
+		os.Exit(runMigrateDryRun(*dbPath))
+	}
+
+	// Manual compaction mode: compact and exit without touching the system identity
+	if *compactNow {
+		storage, err := NewStorage(*dbPath)
+		if err != nil {
+			log.Fatalf("Failed to initialize storage: %v", err)
+		}
+		removed, err := storage.CompactAttestations(*compactKeepDays)
+		if err != nil {
+			log.Fatalf("Compaction failed: %v", err)
+		}
+		thinned, err := storage.ThinGalaxySnapshots(*compactKeepDays)
+		if err != nil {
+			log.Printf("Thinning galaxy history failed: %v", err)
+		}
+		rolled, err := storage.CompactCreditEarnings(*compactKeepDays)
+		if err != nil {
+			log.Printf("Rolling up credit history failed: %v", err)
+		}
+		if err := storage.Vacuum(); err != nil {
+			log.Printf("Vacuum failed: %v", err)
+		}
+		size, _ := storage.GetDatabaseSize()
+		log.Printf("Compacted %d attestations, %d galaxy snapshots and %d credit calculations older than %d days (database now %s)", removed, thinned, rolled, *compactKeepDays, formatBytes(size))
+		storage.Close()
+		return
+	}
+
+	// Validate identity supersession before anything is written
+	var supersedeID uuid.UUID
+	var supersedeOldKey ed25519.PrivateKey
+	if *supersede != "" {
+		if supersedeID, err = uuid.Parse(strings.TrimSpace(*supersede)); err != nil {
+			log.Fatalf("Error: invalid -supersede UUID: %v", err)
+		}
+		if *supersedeKey != "" {
+			if supersedeOldKey, err = parseSupersedeKey(*supersedeKey); err != nil {
+				log.Fatalf("Error: invalid -supersede-key: %v", err)
+			}
+		}
+	} else if *supersedeKey != "" {
+		log.Fatal("Error: -supersede-key requires -supersede")
+	}
+
+	// Claim the data directory so a second process can't share its database, then move
+	// in a flat database from before data directories (the -db path, or the usual ones)
+	if dir != nil {
+		if err := dir.Lock(); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		defer dir.Unlock()
+
+		logFile, err := dir.OpenLog()
+		if err != nil {
+			log.Fatalf("Failed to open log: %v", err)
+		}
+		defer logFile.Close()
+		log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+
+		candidates := []string{flatDBPath}
+		if !flagGiven("db", "STELLAR_DB") {
+			candidates = append(candidates, DatabaseFileName)
+		}
+		moved, err := dir.MigrateDatabase(candidates)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if moved != "" {
+			log.Printf("Moved %s into %s", moved, dir.Path)
+		}
+
+		if dir.Profile != nil {
+			if *publicAddr, err = dir.Profile.ResolvePublicAddress(dir, *publicAddr); err != nil {
+				log.Fatalf("Error: failed to save profile: %v", err)
+			}
+		}
+	}
+
 	// Clean and validate the star system name
 	cleanName := sanitizeStarName(*name)
 	if err := validateStarName(cleanName); err != nil {
@@ -37,34 +266,22 @@ func main() {
 
 	// Validate public address is specified
 	if *publicAddr == "" {
-		log.Fatal("Error: -public-address or STELLAR_PUBLIC_ADDRESS is required (e.g., \"myhost.com:7867\")")
+		log.Fatal("Error: -public-address or STELLAR_PUBLIC_ADDRESS is required (e.g., \"myhost.com:7867\"; with -profile a host is enough)")
 	}
 
-	peerAddr := *publicAddr
-
-	// Extract port from public address for local binding and UPnP
-	peerPort := 7867 // default
-	if idx := strings.LastIndex(*publicAddr, ":"); idx != -1 {
-		fmt.Sscanf((*publicAddr)[idx+1:], "%d", &peerPort)
+	// Accepts hostnames and IPv6 ("[2001:db8::1]:7867"); stored in canonical form
+	peerAddr, err := NormalizePeerAddress(*publicAddr)
+	if err != nil {
+		log.Fatalf("Error: invalid -public-address: %v", err)
 	}
-	listenAddr := fmt.Sprintf("0.0.0.0:%d", peerPort)
 
-	// Attempt UPnP/NAT-PMP port forwarding automatically
-	// This helps users behind NAT without manual router configuration
-	var natTraversal *NATTraversal
-	natTraversal = NewNATTraversal()
-	extAddr, err := natTraversal.Setup(NATConfig{
-		InternalPort:  peerPort,
-		ExternalPort:  peerPort,
-		Description:   "Stellar Lab P2P",
-		LeaseDuration: 2 * time.Hour,
-	})
-	if err != nil {
-		log.Printf("UPnP/NAT-PMP: not available (%v) - ensure port %d is forwarded manually if behind NAT", err, peerPort)
-		natTraversal = nil // Clear so we don't try to close it later
-	} else {
-		log.Printf("UPnP/NAT-PMP: port %d forwarded via %s (external: %s)", peerPort, natTraversal.GetProtocol(), extAddr)
+	// Port from public address for local binding and UPnP, on -listen-host or all interfaces
+	peerPort := addressPort(peerAddr)
+	bindHost := strings.Trim(strings.TrimSpace(*listenHost), "[]")
+	if bindHost != "" && net.ParseIP(bindHost) == nil {
+		log.Fatalf("Error: invalid -listen-host %q: want an IP address such as 127.0.0.1 or ::1", *listenHost)
 	}
+	listenAddr := net.JoinHostPort(bindHost, strconv.Itoa(peerPort))
 
 	// Generate addresses
 	webAddr := *address
@@ -75,19 +292,30 @@ func main() {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 
+	// Logs get pasted into issues, so only a hash of the fingerprint unless asked for
+	if *showFingerprint {
+		log.Printf("Hardware fingerprint: %s", GetHardwareFingerprint())
+	} else {
+		log.Printf("Hardware fingerprint: %s (hashed; -show-fingerprint logs it in full)", fingerprintDigest(GetHardwareFingerprint()))
+	}
+
 	// Try to load existing system or create new one
 	system, err := storage.LoadSystem()
+	newSystem := err != nil
+	movedFrom := ""
 	if err != nil {
 		// Create new system
 		log.Printf("Creating new star system: %s", cleanName)
 
 		// Generate UUID (deterministic if seed provided)
-		var systemID uuid.UUID
-		if *seed != "" {
+		if *seed != "" && *saltUUID {
+			log.Printf("Using semi-deterministic UUID (seed: %s, salted for this install)", *seed)
+		} else if *seed != "" {
 			log.Printf("Using semi-deterministic UUID (seed: %s)", *seed)
-			systemID = generateDeterministicUUID(*seed)
-		} else {
-			systemID = uuid.New()
+		}
+		systemID, err := newSystemID(storage, *seed, *saltUUID)
+		if err != nil {
+			log.Fatalf("Failed to generate the system's UUID: %v", err)
 		}
 
 		// Generate cryptographic keys
@@ -122,16 +350,110 @@ func main() {
 		}
 	} else {
 		log.Printf("Loaded existing star system: %s", system.Name)
+		// Peers still hold the address we advertised last run; tell them once we've joined
+		if system.PeerAddress != peerAddr {
+			movedFrom = system.PeerAddress
+		}
 		// Update addresses in case ports changed
 		system.Address = webAddr
 		system.PeerAddress = peerAddr
 		storage.SaveSystem(system)
 	}
 
+	// Apply a startup rename (harmless to leave set - it's a no-op once the name matches)
+	if *rename != "" {
+		newName := sanitizeStarName(*rename)
+		if err := validateStarName(newName); err != nil {
+			log.Fatalf("Error: -rename: %v", err)
+		}
+		if newName != system.Name {
+			log.Printf("Renaming star system: %s -> %s", system.Name, newName)
+			system.Name = newName
+			if err := storage.SaveSystem(system); err != nil {
+				log.Fatalf("Failed to save new name: %v", err)
+			}
+		}
+	}
+
+	// A revoked identity only gets to send its revocation again
+	if revoked, err := storage.IdentityRevoked(system.ID); err != nil {
+		log.Fatalf("Failed to check key history: %v", err)
+	} else if revoked && !*revokeIdentity {
+		log.Fatalf("Identity %s was revoked; start with a new database to rejoin", system.ID)
+	}
+
+	// Move to a new key before anything is signed with the old one
+	if *rotateKey {
+		if _, err := rotateLocalKey(system, storage); err != nil {
+			log.Fatalf("Error: -rotate-key: %v", err)
+		}
+	}
+
 	// Set InfoVersion to current timestamp (milliseconds) on every startup
 	// This ensures our info is considered "fresh" and prevents stale gossip
 	// from overwriting our current state
-	system.InfoVersion = time.Now().UnixMilli()
+	system.BumpInfoVersion()
+	system.ProcessStartTime = time.Now().Unix()
+
+	// Sign the operator profile at the new version (an emptied one is signed to clear it)
+	if err := system.SetOperatorProfile(NewOperatorProfile(*operatorHandle, *operatorBio, *operatorURL, *operatorPrivate)); err != nil {
+		log.Fatalf("Error: operator profile: %v", err)
+	}
+	if system.Profile != nil {
+		if err := storage.SaveSystem(system); err != nil {
+			log.Fatalf("Failed to save operator profile: %v", err)
+		}
+	}
+
+	// Fold a previous identity into this one (claim is sent to peers after bootstrap)
+	if *supersede != "" {
+		if _, err := supersedeIdentity(system, storage, supersedeID, supersedeOldKey); err != nil {
+			log.Fatalf("Error: -supersede: %v", err)
+		}
+	}
+
+	// Headless transfer mode: send credits and exit without starting servers
+	if *sendCredits != "" {
+		if err := sendCreditsFromCLI(system, storage, listenAddr, *sendCredits); err != nil {
+			log.Fatalf("Credit transfer failed: %v", err)
+		}
+		storage.Close()
+		return
+	}
+
+	// Headless peer export: write the verified peers we have cached and exit
+	if *exportPeers != "" {
+		n, err := NewDHT(system, storage, listenAddr).writePeerExport(*exportPeers)
+		if err != nil {
+			log.Fatalf("Peer export failed: %v", err)
+		}
+		log.Printf("Exported %d verified peers to %s", n, *exportPeers)
+		storage.Close()
+		return
+	}
+	var peerImport *PeerExport
+	if *importPeers != "" {
+		if peerImport, err = readPeerExport(*importPeers); err != nil {
+			log.Fatalf("Error: -import-peers: %v", err)
+		}
+	}
+
+	// Headless revocation: sign it, tell peers and exit
+	if *revokeIdentity {
+		if err := revokeIdentityFromCLI(system, storage, listenAddr); err != nil {
+			log.Fatalf("Revocation failed: %v", err)
+		}
+		storage.Close()
+		return
+	}
+
+	// Count this start unless the system was only just created
+	var restarts int64
+	if !newSystem {
+		if restarts, err = storage.IncrementRestartCount(system.ID); err != nil {
+			log.Printf("Warning: failed to count restart: %v", err)
+		}
+	}
 
 	// Log system info
 	log.Printf("System ID: %s", system.ID)
@@ -141,9 +463,69 @@ func main() {
 
 	// Create DHT (listenAddr for binding, peerAddr is already set on system)
 	dht := NewDHT(system, storage, listenAddr)
+	dht.SetRestartCount(restarts)
+	if *detectAddr {
+		dht.EnableAddressDetection()
+	}
+	if !*noUPnP {
+		// Helps users behind NAT without manual router configuration (mapping happens in Start)
+		dht.EnablePortMapping(peerPort)
+	}
+	if *peerTLS {
+		if err := dht.EnablePeerTLS(); err != nil {
+			log.Fatalf("Error: -peer-tls: %v", err)
+		}
+	}
+	if *privateCredits {
+		dht.EnablePrivateCredits()
+	}
+	if *lanDiscovery {
+		if err := dht.EnableLANDiscovery(); err != nil {
+			log.Fatalf("Error: -lan-discovery: %v", err)
+		}
+	}
+	if *blockList != "" {
+		for _, spec := range strings.Split(*blockList, ",") {
+			id, duration, reason, err := parseBlockSpec(spec)
+			if err != nil {
+				log.Fatalf("Error: -block: %v", err)
+			}
+			if _, err := dht.BlockSystem(id, reason, duration); err != nil {
+				log.Fatalf("Error: -block: %v", err)
+			}
+		}
+	}
+	dht.SetMaxFullSyncSystems(*maxFullSync)
+	dht.SetMaxCachedSystems(*maxCachedSystems)
+	dht.SetLookupTimeout(time.Duration(*lookupTimeout) * time.Second)
+	dht.SetLocalPeerPercent(*localPeerPercent)
+	dht.SetMaxMessageBytes(*maxMessageKB << 10)
+	dht.SetAttestationFlushInterval(time.Duration(*attestationFlush) * time.Second)
+	dht.SetBandwidthBudget(*bandwidthBudget)
+	dht.EnableCompaction(CompactionConfig{
+		Schedule:   schedule,
+		KeepDays:   *compactKeepDays,
+		MaxDBBytes: int64(*compactMaxDBMB) * 1024 * 1024,
+	})
+	dht.SetRetentionLimits(retentionLimits)
+
+	// Stop on a signal, or when the service manager asks (see service.go)
+	ctx, stopService := shutdownContext()
+	defer stopService()
 
 	// Create web interface
 	webInterface := NewWebInterface(dht, storage, webAddr)
+	if *publicUI {
+		webInterface.EnablePublicMode()
+	}
+	token, err := loadAdminToken(storage, system.ID, *adminToken)
+	if err != nil {
+		log.Fatalf("Failed to set up admin token: %v", err)
+	}
+	webInterface.SetAdminToken(token)
+	if *devAssets != "" {
+		webInterface.SetDevAssets(*devAssets)
+	}
 
 	// Start DHT (HTTP server + maintenance loops)
 	if err := dht.Start(); err != nil {
@@ -165,18 +547,50 @@ func main() {
 		time.Sleep(2 * time.Second) // Wait for servers to start
 
 		config := DefaultBootstrapConfig()
-		if *bootstrapPeer != "" {
-			config.BootstrapPeer = *bootstrapPeer
+		if len(bootstrapPeers) > 0 {
+			config.BootstrapPeers = bootstrapPeers
+			if err := storage.SaveBootstrapPeers(bootstrapPeers); err != nil {
+				log.Printf("Warning: failed to remember bootstrap peers: %v", err)
+			}
+		} else if peerImport != nil && len(peerImport.Addresses()) > 0 {
+			log.Printf("Bootstrapping from %d imported peers", len(peerImport.Addresses()))
+			config.BootstrapPeers = peerImport.Addresses()
+			config.FallbackToSeeds = true
+		} else if remembered, _ := storage.GetBootstrapPeers(); len(remembered) > 0 {
+			log.Printf("Using %d bootstrap peers remembered from an earlier -bootstrap", len(remembered))
+			config.BootstrapPeers = remembered
+			config.FallbackToSeeds = true
+		} else if *lanDiscovery && dht.GetRoutingTable().GetRoutingTableSize() == 0 {
+			// Give systems already on the LAN a chance to answer before falling back to seeds
+			log.Printf("Listening for LAN peers (up to %s)...", LANBootstrapWait)
+			if addr := dht.WaitForLANPeer(LANBootstrapWait); addr != "" {
+				log.Printf("Found LAN peer at %s", addr)
+				config.BootstrapPeers = []string{addr}
+			}
 		}
 
 		// In isolated mode, never fetch seed nodes
 		if !*isolatedMode {
-			config.SeedNodes = FetchSeedNodes()
+			config.SeedNodes = dht.LoadSeedNodes()
 		}
 
+		// Peers must hear about a recent key rotation before the new key pings them
+		dht.broadcastKeyRotations(dht.localKeyRotations(KeyRotationAnnounceWindow))
+
 		if err := dht.Bootstrap(config); err != nil {
 			log.Printf("Bootstrap warning: %v", err)
 		}
+		if movedFrom != "" {
+			dht.announceAddressChange(movedFrom)
+		}
+
+		// Imported peers are verified once we've joined (a new system's pings are refused before)
+		if peerImport != nil {
+			dht.ImportPeers(peerImport)
+		}
+
+		// Tell peers about any identity we recently replaced
+		dht.broadcastSupersedeClaims()
 
 		// If this is a new node at origin (0,0,0), update coordinates near a peer
 		// Exception: Class X (genesis black hole) stays at origin
@@ -187,30 +601,77 @@ func main() {
 				log.Printf("Updating coordinates to cluster near %s", sponsor.Name)
 				system.GenerateCoordinates(sponsor)
 				system.SponsorID = &sponsor.ID
+				system.BumpInfoVersion()
 				storage.SaveSystem(system)
 				log.Printf("New coordinates: (%.2f, %.2f, %.2f), sponsored by %s", system.X, system.Y, system.Z, sponsor.Name)
 			}
 		}
+
+		// Bootstrap is done, joined or not: /readyz answers 200 and systemd hears READY=1
+		dht.MarkReady()
 	}()
 
-	// Wait for shutdown signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	// Wait for shutdown signal (or the service manager's stop request)
+	waitForShutdown(ctx, dht)
 
 	log.Printf("Shutting down...")
-	if natTraversal != nil {
-		natTraversal.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	// Stop taking web requests first, then drain the DHT and flush peers,
+	// and only close storage once nothing else can write to it
+	if err := webInterface.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Web interface shutdown: %v", err)
+	}
+	dht.Stop(shutdownCtx)
+	if err := storage.Close(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
 	}
-	dht.Stop()
 	log.Printf("Goodbye!")
 }
 
+// sendCreditsFromCLI parses a -send-credits value ("uuid:amount:memo", memo optional)
+// and delivers the transfer using the cached peer list, without starting any servers
+func sendCreditsFromCLI(system *System, storage *Storage, listenAddr, spec string) error {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 {
+		return fmt.Errorf("invalid -send-credits value %q, expected \"uuid:amount:memo\"", spec)
+	}
+
+	toID, err := uuid.Parse(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return fmt.Errorf("invalid recipient UUID: %w", err)
+	}
+
+	amount, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount: %w", err)
+	}
+
+	memo := ""
+	if len(parts) == 3 {
+		memo = parts[2]
+	}
+
+	dht := NewDHT(system, storage, listenAddr)
+	transfer, err := dht.SendCredits(toID, amount, memo)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Transfer %s complete: %d credits sent to %s", transfer.ID, transfer.Amount, transfer.ToSystemID)
+	return nil
+}
+
 // generateDeterministicUUID creates a UUID from a seed string
-func generateDeterministicUUID(seed string) uuid.UUID {
+// An empty salt gives the UUID installs made before salting existed
+func generateDeterministicUUID(seed, salt string) uuid.UUID {
 	// Include hardware fingerprint for uniqueness
 	fingerprint := GetHardwareFingerprint()
 	data := seed + fingerprint
+	if salt != "" {
+		data += "|" + salt
+	}
 
 	hash := sha256.Sum256([]byte(data))
 
@@ -265,6 +726,17 @@ func logStarSystem(sys *System) {
 	}
 }
 
+// flagGiven reports whether a flag was set on the command line or through its environment variable
+func flagGiven(name, envKey string) bool {
+	given := os.Getenv(envKey) != ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
 // getEnv returns environment variable value or default if not set
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -273,6 +745,32 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// addressList is a flag taking host:port addresses, comma-separated and/or repeated
+type addressList []string
+
+func (l *addressList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *addressList) Set(value string) error {
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			*l = append(*l, address)
+		}
+	}
+	return nil
+}
+
+// getEnvInt returns an integer environment variable or a default if unset or invalid
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
 // sanitizeStarName cleans up a star name by removing quotes and extra whitespace
 func sanitizeStarName(name string) string {
 	// Trim whitespace
@@ -316,9 +814,9 @@ func validateStarName(name string) error {
 		return fmt.Errorf("star system name must be at least 2 characters long")
 	}
 
-	// Check maximum length
-	if len(name) > 64 {
-		return fmt.Errorf("star system name must be 64 characters or less")
+	// Peers reject names that fail sanitization, so catch them here (see sanitize.go)
+	if err := CheckSystemName(name); err != nil {
+		return fmt.Errorf("star system name is not allowed: %v", err)
 	}
 
 	return nil
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MapFilter narrows /api/known-systems and /api/map to the systems an operator asked for.
+// Filtering happens here rather than in the browser so a large galaxy isn't sent in full
+// just to show a few systems of it
+type MapFilter struct {
+	StarClasses   map[string]bool // Primary classes to keep (empty = any)
+	VerifiedOnly  bool            // Only systems we've been in direct contact with lately
+	LearnedWithin time.Duration   // Only systems first heard of this recently (0 = any)
+	NamePrefix    string          // Case-insensitive
+	IDPrefix      string          // Lowercase UUID prefix
+
+	// Only systems within MaxDistance of From (MaxDistance 0 = any distance)
+	From        [3]float64
+	MaxDistance float64
+}
+
+// validMapClasses are the primary star classes a filter can ask for
+var validMapClasses = "OBAFGKMX"
+
+// parseMapFilter reads a filter from query parameters; nil when none were given
+//
+//	star_class=M,K           primary class (comma-separated for several)
+//	verified_only=true       recently verified systems
+//	learned_within=7d        first heard of within a Go duration or whole days
+//	name_prefix=Sol          name starts with (case-insensitive)
+//	id_prefix=3fa8           UUID starts with
+//	max_distance_from=x,y,z  with max_distance=N: within N map units of x,y,z
+func parseMapFilter(q url.Values) (*MapFilter, error) {
+	f := &MapFilter{StarClasses: make(map[string]bool)}
+	active := false
+
+	if v := q.Get("star_class"); v != "" {
+		for _, class := range strings.Split(strings.ToUpper(v), ",") {
+			class = strings.TrimSpace(class)
+			if len(class) != 1 || !strings.Contains(validMapClasses, class) {
+				return nil, fmt.Errorf("invalid star_class %q", class)
+			}
+			f.StarClasses[class] = true
+		}
+		active = true
+	}
+	if v := q.Get("verified_only"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid verified_only %q", v)
+		}
+		f.VerifiedOnly = b
+		active = active || b
+	}
+	if v := q.Get("learned_within"); v != "" {
+		d, err := parseRetentionAge(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid learned_within %q", v)
+		}
+		f.LearnedWithin = d
+		active = active || d > 0
+	}
+	if v := strings.TrimSpace(q.Get("name_prefix")); v != "" {
+		f.NamePrefix = strings.ToLower(v)
+		active = true
+	}
+	if v := strings.TrimSpace(q.Get("id_prefix")); v != "" {
+		f.IDPrefix = strings.ToLower(v)
+		active = true
+	}
+
+	from, dist := q.Get("max_distance_from"), q.Get("max_distance")
+	if (from == "") != (dist == "") {
+		return nil, fmt.Errorf("max_distance_from and max_distance go together")
+	}
+	if from != "" {
+		parts := strings.Split(from, ",")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("max_distance_from must be x,y,z")
+		}
+		for i, p := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+				return nil, fmt.Errorf("invalid max_distance_from coordinate %q", p)
+			}
+			f.From[i] = n
+		}
+		n, err := strconv.ParseFloat(dist, 64)
+		if err != nil || n <= 0 || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("max_distance must be a positive number")
+		}
+		f.MaxDistance = n
+		active = true
+	}
+
+	if !active {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// Matches reports whether a cached system passes the filter
+func (f *MapFilter) Matches(c *CachedSystem, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+	sys := c.System
+	if len(f.StarClasses) > 0 && !f.StarClasses[sys.Stars.Primary.Class] {
+		return false
+	}
+	if f.VerifiedOnly {
+		if !cachedPeerStatus(c, now.Add(-VerificationCutoff)).state.inRoutingTable() {
+			return false
+		}
+	}
+	if f.LearnedWithin > 0 && c.LearnedAt.Before(now.Add(-f.LearnedWithin)) {
+		return false
+	}
+	if f.NamePrefix != "" && !strings.HasPrefix(strings.ToLower(sys.Name), f.NamePrefix) {
+		return false
+	}
+	if f.IDPrefix != "" && !strings.HasPrefix(sys.ID.String(), f.IDPrefix) {
+		return false
+	}
+	if f.MaxDistance > 0 {
+		dx, dy, dz := sys.X-f.From[0], sys.Y-f.From[1], sys.Z-f.From[2]
+		if math.Sqrt(dx*dx+dy*dy+dz*dz) > f.MaxDistance {
+			return false
+		}
+	}
+	return true
+}
+
+// filterCached keeps the cached systems that pass the filter (all of them for a nil filter)
+func (f *MapFilter) filterCached(cached []*CachedSystem) []*CachedSystem {
+	if f == nil {
+		return cached
+	}
+	now := time.Now()
+	kept := make([]*CachedSystem, 0, len(cached))
+	for _, c := range cached {
+		if f.Matches(c, now) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
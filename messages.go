@@ -0,0 +1,611 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Direct messages between operators. A message request carries the text sealed to the
+// recipient's identity key, converted from ed25519 to X25519: an ephemeral X25519 key
+// agrees a secret with it, and AES-256-GCM seals the text under a key hashed from both.
+// The attestation names the recipient, so only it takes the message, and the sealed
+// text is bound to both IDs and the message ID, so it can't be resent under another
+// sender. Received messages are the inbox; sent ones are kept to track delivery. An
+// offline recipient is retried after each of messageRetryDelays and the message then
+// marked undelivered; nothing is passed through third parties. Blocked systems are
+// refused like any request, and each sender gets MessagesPerSenderDay per UTC day.
+const (
+	// MaxMessageBodyLength caps a message's text in bytes
+	MaxMessageBodyLength = 2048
+
+	// MaxSealedMessageLength bounds the sealed text on the wire (base64 of the key,
+	// nonce, text and tag, with room to spare)
+	MaxSealedMessageLength = 4096
+
+	// MessagesPerSenderDay is how many messages one system may leave us per UTC day
+	MessagesPerSenderDay = 20
+
+	// MessageDeliveryInterval is how often messages due a retry are looked for
+	MessageDeliveryInterval = 30 * time.Second
+
+	// AttestationMessage is the attestation type of a message request
+	AttestationMessage = "dht_message"
+)
+
+// messageRetryDelays is the wait after each failed delivery attempt; once they're used
+// up the message is undelivered (a var so the simulation can shorten it)
+var messageRetryDelays = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+// Message directions and states
+const (
+	MessageSent     = "sent"
+	MessageReceived = "received"
+
+	MessagePending     = "pending"     // Sent, waiting on a retry
+	MessageDelivered   = "delivered"   // Sent, and the recipient took it
+	MessageUndelivered = "undelivered" // Sent, and given up on
+)
+
+// Message send errors (checked with errors.Is by callers to pick a response)
+var (
+	ErrMessageEmpty       = errors.New("message is empty")
+	ErrMessageTooLong     = fmt.Errorf("message must be %d bytes or less", MaxMessageBodyLength)
+	ErrMessageInvalid     = errors.New("message must be valid UTF-8")
+	ErrMessageToSelf      = errors.New("cannot message this system")
+	ErrMessageBlocked     = errors.New("recipient is on the blocklist")
+	ErrMessageUnsupported = errors.New("recipient's version doesn't take messages")
+)
+
+// Message is one message in the inbox (received) or out of it (sent)
+type Message struct {
+	ID          uuid.UUID `json:"id"`
+	Direction   string    `json:"direction"` // MessageSent or MessageReceived
+	PeerID      uuid.UUID `json:"peer_id"`   // The recipient of a sent message, the sender of a received one
+	PeerName    string    `json:"peer_name,omitempty"`
+	Body        string    `json:"body"`
+	SentAt      int64     `json:"sent_at"`
+	ReceivedAt  int64     `json:"received_at,omitempty"` // When it arrived, or for a sent one when it was delivered
+	Read        bool      `json:"read"`                  // Received messages only
+	Status      string    `json:"status,omitempty"`      // Sent messages only: pending, delivered or undelivered
+	Attempts    int       `json:"attempts,omitempty"`
+	NextAttempt int64     `json:"next_attempt,omitempty"` // When a pending one is retried
+	LastError   string    `json:"last_error,omitempty"`   // Why the last attempt failed
+}
+
+// SealedMessage is the message field of a message request
+type SealedMessage struct {
+	ID     uuid.UUID `json:"id"`
+	SentAt int64     `json:"sent_at"`
+	Sealed string    `json:"sealed"` // base64: ephemeral X25519 key, GCM nonce, then the sealed text
+}
+
+// checkMessageBody applies the limits on a message's text
+func checkMessageBody(body string) error {
+	switch {
+	case strings.TrimSpace(body) == "":
+		return ErrMessageEmpty
+	case len(body) > MaxMessageBodyLength:
+		return ErrMessageTooLong
+	case !utf8.ValidString(body):
+		return ErrMessageInvalid
+	}
+	return nil
+}
+
+// === Sealing ===
+
+// curve25519P is the field prime 2^255 - 19
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// x25519PublicKey converts an ed25519 public key to the X25519 key of the same secret:
+// the Montgomery u = (1 + y) / (1 - y) of the Edwards point's y
+func x25519PublicKey(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("bad ed25519 public key length")
+	}
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 0x7f // The top bit is the sign of x
+	y := new(big.Int).SetBytes(reverseBytes(le))
+	if y.Cmp(curve25519P) >= 0 {
+		return nil, errors.New("ed25519 public key out of range")
+	}
+
+	num := new(big.Int).Add(y, big.NewInt(1))
+	den := new(big.Int).Sub(big.NewInt(1), y)
+	den.Mod(den, curve25519P)
+	if den.Sign() == 0 {
+		return nil, errors.New("ed25519 public key has no X25519 form")
+	}
+	u := num.Mul(num, den.ModInverse(den, curve25519P))
+	u.Mod(u, curve25519P)
+	return ecdh.X25519().NewPublicKey(reverseBytes(u.FillBytes(make([]byte, 32))))
+}
+
+// x25519PrivateKey converts an ed25519 private key to X25519: the scalar ed25519
+// signs with, which ecdh clamps the same way
+func x25519PrivateKey(priv ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	h := sha512.Sum512(priv.Seed())
+	return ecdh.X25519().NewPrivateKey(h[:32])
+}
+
+func reverseBytes(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+// messageKey derives the AES key from the agreed secret and both public keys
+func messageKey(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("stellar-lab message v1"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+// messageAAD binds sealed text to its sender, recipient and message
+func messageAAD(from, to uuid.UUID, m *SealedMessage) []byte {
+	return []byte(fmt.Sprintf("%s|%s|%s|%d", from, to, m.ID, m.SentAt))
+}
+
+// sealMessage seals body to the recipient's ed25519 public key
+func sealMessage(body string, from, to uuid.UUID, recipientKey ed25519.PublicKey, id uuid.UUID, sentAt int64) (*SealedMessage, error) {
+	recipient, err := x25519PublicKey(recipientKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newMessageGCM(messageKey(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SealedMessage{ID: id, SentAt: sentAt}
+	out := append([]byte{}, ephemeral.PublicKey().Bytes()...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	out = gcm.Seal(out, nonce, []byte(body), messageAAD(from, to, m))
+	m.Sealed = base64.StdEncoding.EncodeToString(out)
+	return m, nil
+}
+
+// openMessage opens a message sealed to our key
+func openMessage(m *SealedMessage, from, to uuid.UUID, priv ed25519.PrivateKey) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(m.Sealed)
+	if err != nil {
+		return "", err
+	}
+	key, err := x25519PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < 32 {
+		return "", errors.New("sealed message too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:32])
+	if err != nil {
+		return "", err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newMessageGCM(messageKey(shared, data[:32], key.PublicKey().Bytes()))
+	if err != nil {
+		return "", err
+	}
+	data = data[32:]
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("sealed message too short")
+	}
+	body, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], messageAAD(from, to, m))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func newMessageGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// === Sending ===
+
+// SendMessage stores a message to toID and makes the first delivery attempt; the
+// message comes back delivered, pending a retry, or undelivered if it can't be
+func (dht *DHT) SendMessage(toID uuid.UUID, body string) (*Message, error) {
+	if dht.localSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+	if toID == dht.localSystem.ID {
+		return nil, ErrMessageToSelf
+	}
+	if err := checkMessageBody(body); err != nil {
+		return nil, err
+	}
+	if dht.routingTable.IsBlocked(toID) {
+		return nil, ErrMessageBlocked
+	}
+
+	now := time.Now()
+	m := &Message{
+		ID:        uuid.New(),
+		Direction: MessageSent,
+		PeerID:    toID,
+		Body:      body,
+		SentAt:    now.Unix(),
+		Status:    MessagePending,
+		// Out of the delivery loop's way while the first attempt runs
+		NextAttempt: now.Add(messageRetryDelays[0]).Unix(),
+	}
+	if _, err := dht.storage.SaveMessage(m); err != nil {
+		return nil, err
+	}
+	dht.attemptDelivery(m, now)
+	return m, nil
+}
+
+// attemptDelivery tries to deliver a pending message once and records the outcome
+func (dht *DHT) attemptDelivery(m *Message, now time.Time) {
+	m.Attempts++
+	err := dht.deliverMessage(m)
+	switch {
+	case err == nil:
+		m.Status, m.ReceivedAt, m.NextAttempt, m.LastError = MessageDelivered, time.Now().Unix(), 0, ""
+		log.Printf("✉ Delivered message %s to %s", m.ID.String()[:8], m.PeerID.String()[:8])
+	case finalDeliveryError(err) || m.Attempts > len(messageRetryDelays):
+		m.Status, m.NextAttempt, m.LastError = MessageUndelivered, 0, err.Error()
+		log.Printf("✉ Message %s to %s undelivered after %d attempts: %v", m.ID.String()[:8], m.PeerID.String()[:8], m.Attempts, err)
+	default:
+		m.NextAttempt, m.LastError = now.Add(messageRetryDelays[m.Attempts-1]).Unix(), err.Error()
+	}
+	if err := dht.storage.UpdateMessageDelivery(m); err != nil {
+		log.Printf("Failed to save delivery of message %s: %v", m.ID.String()[:8], err)
+	}
+}
+
+// finalDeliveryError reports whether a failed delivery isn't worth retrying
+func finalDeliveryError(err error) bool {
+	var dhtErr *DHTError
+	if errors.As(err, &dhtErr) && (dhtErr.Code == ErrCodeBlocked || dhtErr.Code == ErrCodeMessageRefused) {
+		return true
+	}
+	return errors.Is(err, ErrMessageBlocked) || errors.Is(err, ErrMessageUnsupported)
+}
+
+// deliverMessage seals a message to its recipient's bound key and sends it
+func (dht *DHT) deliverMessage(m *Message) error {
+	if dht.routingTable.IsBlocked(m.PeerID) {
+		return ErrMessageBlocked
+	}
+	if !dht.peerSupports(m.PeerID, CapMessages) {
+		return ErrMessageUnsupported
+	}
+
+	recipient := dht.routingTable.GetCachedSystem(m.PeerID)
+	if recipient == nil || recipient.PeerAddress == "" {
+		found, err := dht.Lookup(m.PeerID)
+		if err != nil || found.PeerAddress == "" {
+			return fmt.Errorf("%w: %s wasn't found", ErrRecipientUnreachable, m.PeerID)
+		}
+		recipient = found
+	}
+
+	key, err := dht.recipientKey(recipient)
+	if err != nil {
+		return err
+	}
+	pub, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("recipient's key is unusable")
+	}
+
+	sealed, err := sealMessage(m.Body, dht.localSystem.ID, m.PeerID, pub, m.ID, m.SentAt)
+	if err != nil {
+		return err
+	}
+	msg, err := NewMessageRequest(dht.localSystem, m.PeerID, sealed, "")
+	if err != nil {
+		return err
+	}
+	_, err = dht.sendRequest(recipient.PeerAddress, msg)
+	return err
+}
+
+// recipientKey is the key to seal to: the one bound to the recipient if it ever contacted
+// us, otherwise the one it signs a ping response with
+func (dht *DHT) recipientKey(recipient *System) (string, error) {
+	key, err := dht.storage.GetIdentityBinding(recipient.ID)
+	if err != nil || key != "" {
+		return key, err
+	}
+	ping, err := NewPingRequest(dht.localSystem, recipient.ID, "")
+	if err != nil {
+		return "", err
+	}
+	// sendRequest makes sure the answer is signed by the system we asked
+	resp, err := dht.sendRequest(recipient.PeerAddress, ping)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrRecipientUnreachable, err)
+	}
+	return resp.Attestation.PublicKey, nil
+}
+
+// messageDeliveryLoop retries pending messages as they come due
+func (dht *DHT) messageDeliveryLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskMessageDelivery, every(MessageDeliveryInterval))
+
+	ticker := time.NewTicker(MessageDeliveryInterval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(MessageDeliveryInterval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(MessageDeliveryInterval))
+		case <-t.trigger:
+		}
+		t.run(func() (int, error) {
+			return dht.deliverDueMessages(time.Now())
+		})
+	}
+}
+
+// deliverDueMessages makes the next attempt on each pending message due by now
+// Returns how many were attempted
+func (dht *DHT) deliverDueMessages(now time.Time) (int, error) {
+	due, err := dht.storage.GetDueMessages(now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range due {
+		dht.attemptDelivery(m, now)
+	}
+	return len(due), nil
+}
+
+// === Receiving ===
+
+// handleMessage takes a message into the inbox (blocked senders never get this far)
+func (dht *DHT) handleMessage(msg *DHTMessage) (*DHTMessage, error) {
+	if msg.Attestation.ToSystemID != dht.localSystem.ID {
+		return nil, &DHTError{Code: ErrCodeInvalidAttestation, Message: "message is addressed to another system"}
+	}
+	if dht.localSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+	from := msg.FromSystem.ID
+	in := msg.Message
+
+	// A retry of one we already took (its answer got lost) is acknowledged again
+	seen, err := dht.storage.HasMessage(MessageReceived, from, in.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !seen {
+		now := time.Now()
+		dayStart := now.UTC().Truncate(24 * time.Hour).Unix()
+		count, err := dht.storage.CountMessagesFrom(from, dayStart)
+		if err != nil {
+			return nil, err
+		}
+		if count >= MessagesPerSenderDay {
+			return nil, &DHTError{Code: ErrCodeMessageRefused, Message: fmt.Sprintf("daily limit of %d messages reached", MessagesPerSenderDay)}
+		}
+
+		body, err := openMessage(in, from, dht.localSystem.ID, dht.localSystem.Keys.PrivateKey)
+		if err != nil {
+			return nil, &DHTError{Code: ErrCodeInvalidMessage, Message: "message can't be opened with our key"}
+		}
+		if err := checkMessageBody(body); err != nil {
+			return nil, &DHTError{Code: ErrCodeMessageRefused, Message: err.Error()}
+		}
+
+		m := &Message{
+			ID:         in.ID,
+			Direction:  MessageReceived,
+			PeerID:     from,
+			Body:       body,
+			SentAt:     in.SentAt,
+			ReceivedAt: now.Unix(),
+		}
+		if _, err := dht.storage.SaveMessage(m); err != nil {
+			return nil, err
+		}
+		log.Printf("✉ Message from %s (%s)", msg.FromSystem.Name, from.String()[:8])
+	}
+	return NewMessageResponse(dht.localSystem, from, msg.RequestID)
+}
+
+// === Web API ===
+
+// MessagesPage is the GET /api/messages response
+type MessagesPage struct {
+	Messages []*Message `json:"messages"`
+	Total    int        `json:"total"`
+	Unread   int        `json:"unread"` // In the whole inbox, whichever box was asked for
+}
+
+// handleMessagesAPI lists messages or sends one
+// GET /api/messages?box=inbox|sent&limit=&offset= (newest first)
+// POST /api/messages {"to_system_id": "...", "body": "..."}
+func (w *WebInterface) handleMessagesAPI(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.listMessages(rw, r)
+	case http.MethodPost:
+		w.sendMessage(rw, r)
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (w *WebInterface) listMessages(rw http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	direction := MessageReceived
+	switch params.Get("box") {
+	case "", "inbox":
+	case "sent":
+		direction = MessageSent
+	default:
+		http.Error(rw, "box must be inbox or sent", http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(rw, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n > 100 {
+			n = 100
+		}
+		limit = n
+	}
+	offset := 0
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(rw, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	messages, total, err := w.storage.GetMessages(direction, limit, offset)
+	if err != nil {
+		http.Error(rw, "Failed to query messages", http.StatusInternalServerError)
+		return
+	}
+	unread, err := w.storage.CountUnreadMessages()
+	if err != nil {
+		http.Error(rw, "Failed to query messages", http.StatusInternalServerError)
+		return
+	}
+	rt := w.dht.GetRoutingTable()
+	for _, m := range messages {
+		if sys := rt.GetCachedSystem(m.PeerID); sys != nil {
+			m.PeerName = sys.Name
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(MessagesPage{Messages: messages, Total: total, Unread: unread})
+}
+
+func (w *WebInterface) sendMessage(rw http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(rw, r.Body, 4*MaxMessageBodyLength)
+
+	var req struct {
+		ToSystemID string `json:"to_system_id"`
+		Body       string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	toID, err := uuid.Parse(req.ToSystemID)
+	if err != nil {
+		http.Error(rw, "Invalid to_system_id", http.StatusBadRequest)
+		return
+	}
+
+	m, err := w.dht.SendMessage(toID, req.Body)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == ErrNoKeys {
+			status = http.StatusInternalServerError
+		}
+		http.Error(rw, err.Error(), status)
+		return
+	}
+	if sys := w.dht.GetRoutingTable().GetCachedSystem(toID); sys != nil {
+		m.PeerName = sys.Name
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(m)
+}
+
+// handleMessagesReadAPI marks received messages read
+// POST /api/messages/read {"ids": ["..."]}; no ids marks the whole inbox
+func (w *WebInterface) handleMessagesReadAPI(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(rw, r.Body, 1<<16)
+
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids := make([]uuid.UUID, 0, len(req.IDs))
+	for _, s := range req.IDs {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			http.Error(rw, "Invalid message id: "+s, http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	marked, err := w.storage.MarkMessagesRead(ids)
+	if err != nil {
+		http.Error(rw, "Failed to update messages", http.StatusInternalServerError)
+		return
+	}
+	unread, err := w.storage.CountUnreadMessages()
+	if err != nil {
+		http.Error(rw, "Failed to query messages", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]int64{"marked": marked, "unread": int64(unread)})
+}
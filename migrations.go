@@ -0,0 +1,468 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Schema changes to existing databases are numbered migrations, each run exactly once in
+// its own transaction and recorded in schema_version. New tables need no migration:
+// createTables makes any that are missing at their current layout, and indexes are created
+// after migrations have run, so they can cover added columns. Anything else (new columns,
+// data rewrites) goes on the end of the migrations list; never edit or reorder past ones.
+//
+// Databases from before schema_version ran every ALTER TABLE on each start and ignored
+// the errors, so they can hold any mix of migrations 1-16. Their version is detected from
+// their columns (the longest run of migrations already in place), and those 16 check
+// before changing anything, so running one that was partly in place is harmless.
+
+// schemaVersionTable records each migration applied to the database
+// detected = 1 marks ones found already in place when versioning began
+const schemaVersionTable = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL,
+		detected INTEGER NOT NULL DEFAULT 0
+	)`
+
+// schemaReader is what migrations inspect the schema through (a transaction, or the
+// database itself for a dry run)
+type schemaReader interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// migration is one numbered schema change (its version is its position in migrations, from 1)
+type migration struct {
+	name string
+
+	// present reports whether a database from before schema_version already has it
+	// (nil: it can't tell, so the migration runs)
+	present func(r schemaReader) (bool, error)
+
+	apply func(tx *sql.Tx) error
+}
+
+// migrations is every schema change, oldest first
+var migrations = []migration{
+	addColumns("add sponsor_id to system", "system", "sponsor_id TEXT"),
+	addColumns("add admin_token to system", "system", "admin_token TEXT NOT NULL DEFAULT ''"),
+	addColumns("add sponsor_id to peer_systems", "peer_systems", "sponsor_id TEXT"),
+	addColumns("add proof_hash to credit_transfers", "credit_transfers", "proof_hash TEXT"),
+	addColumns("add received_by to attestations", "attestations", "received_by TEXT NOT NULL DEFAULT ''"),
+	addColumns("add pending_credits to credit_balance", "credit_balance", "pending_credits REAL NOT NULL DEFAULT 0"),
+	addColumns("add info_version to peer_systems", "peer_systems", "info_version INTEGER NOT NULL DEFAULT 0"),
+	addColumns("add info_signature to peer_systems", "peer_systems", "info_signature TEXT NOT NULL DEFAULT ''"),
+	addColumns("add last_verified to peer_systems", "peer_systems", "last_verified INTEGER"),
+	addColumns("add clock_skew to attestations", "attestations", "clock_skew INTEGER NOT NULL DEFAULT 0"),
+	addColumns("add latency_ms to peer_systems", "peer_systems", "latency_ms REAL NOT NULL DEFAULT 0"),
+	addColumns("add last rejection to peer_systems", "peer_systems",
+		"rejection_code INTEGER NOT NULL DEFAULT 0",
+		"rejection_reason TEXT NOT NULL DEFAULT ''",
+		"rejected_at INTEGER NOT NULL DEFAULT 0"),
+	addColumns("add claimed and verified ranks to peer_systems", "peer_systems",
+		"rank TEXT NOT NULL DEFAULT ''",
+		"rank_proven_hours INTEGER NOT NULL DEFAULT 0",
+		"rank_attesters INTEGER NOT NULL DEFAULT 0",
+		"rank_claimed_at INTEGER NOT NULL DEFAULT 0",
+		"rank_verified TEXT NOT NULL DEFAULT ''",
+		"rank_verified_at INTEGER NOT NULL DEFAULT 0"),
+	{
+		// Worked out for existing rows
+		name:    "add reciprocal to peer_connections",
+		present: columnsPresent("peer_connections", "reciprocal"),
+		apply: func(tx *sql.Tx) error {
+			if err := addMissingColumns(tx, "peer_connections", "reciprocal INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			_, err := tx.Exec(refreshReciprocalSQL)
+			return err
+		},
+	},
+	{
+		// The first layout had no from_system_id; its rows can't be attributed to a peer
+		name:    "replace attestation_summaries with per-peer rollups",
+		present: columnsPresent("attestation_summaries", "from_system_id"),
+		apply: func(tx *sql.Tx) error {
+			if ok, err := hasColumns(tx, "attestation_summaries", "from_system_id"); err != nil || ok {
+				return err
+			}
+			if _, err := tx.Exec("DROP TABLE attestation_summaries"); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`CREATE TABLE attestation_summaries (
+				from_system_id TEXT NOT NULL,
+				received_by TEXT NOT NULL,
+				day TEXT NOT NULL,
+				attestation_count INTEGER NOT NULL,
+				first_timestamp INTEGER NOT NULL,
+				last_timestamp INTEGER NOT NULL,
+				PRIMARY KEY (from_system_id, received_by, day)
+			)`)
+			return err
+		},
+	},
+	addColumns("add bonus inputs to credit_earnings", "credit_earnings",
+		"bridge_score REAL NOT NULL DEFAULT 0",
+		"reciprocity_ratio REAL NOT NULL DEFAULT 0",
+		"avg_connectivity REAL NOT NULL DEFAULT 0"),
+	addColumns("add nonce to attestations", "attestations", "nonce TEXT NOT NULL DEFAULT ''"),
+	addColumns("add restart_count to system", "system", "restart_count INTEGER NOT NULL DEFAULT 0"),
+	addColumns("add coords_version to system", "system", "coords_version INTEGER NOT NULL DEFAULT 0"),
+	addColumns("add memo to verified_transfers", "verified_transfers", "memo TEXT NOT NULL DEFAULT ''"),
+	addColumns("add observations to peer_connections", "peer_connections", "observations INTEGER NOT NULL DEFAULT 1"),
+	addColumns("add service to credit_earnings", "credit_earnings", "service REAL NOT NULL DEFAULT 0"),
+	addColumns("add calculation window to credit_earnings", "credit_earnings",
+		"window_start INTEGER NOT NULL DEFAULT 0",
+		"window_end INTEGER NOT NULL DEFAULT 0"),
+	addColumns("add operator profile to system", "system",
+		"profile_handle TEXT NOT NULL DEFAULT ''",
+		"profile_bio TEXT NOT NULL DEFAULT ''",
+		"profile_url TEXT NOT NULL DEFAULT ''",
+		"profile_private INTEGER NOT NULL DEFAULT 0",
+		"profile_version INTEGER NOT NULL DEFAULT 0",
+		"profile_signature TEXT NOT NULL DEFAULT ''"),
+	addColumns("add operator profile to peer_systems", "peer_systems",
+		"profile_handle TEXT NOT NULL DEFAULT ''",
+		"profile_bio TEXT NOT NULL DEFAULT ''",
+		"profile_url TEXT NOT NULL DEFAULT ''",
+		"profile_private INTEGER NOT NULL DEFAULT 0",
+		"profile_version INTEGER NOT NULL DEFAULT 0",
+		"profile_signature TEXT NOT NULL DEFAULT ''"),
+	{
+		// Rows stored before received_by existed were left at '', invisible to credits
+		name:  "backfill received_by on legacy attestations",
+		apply: backfillReceivedBy,
+	},
+	addColumns("add stars_version to system", "system", "stars_version INTEGER NOT NULL DEFAULT 0"),
+	{
+		// Systems whose signed info we've cached have upgraded; nothing else is known yet
+		name:    "add signs_info to identity_bindings",
+		present: columnsPresent("identity_bindings", "signs_info"),
+		apply: func(tx *sql.Tx) error {
+			if err := addMissingColumns(tx, "identity_bindings", "signs_info INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`UPDATE identity_bindings SET signs_info = 1
+				WHERE system_id IN (SELECT id FROM peer_systems WHERE info_signature != '')`)
+			return err
+		},
+	},
+	addColumns("add status to credit_transfers", "credit_transfers", "status TEXT NOT NULL DEFAULT 'sent'"),
+	addColumns("add payload to credit_transfers", "credit_transfers", "payload TEXT NOT NULL DEFAULT ''"),
+	addColumns("add peer_tls to peer_systems", "peer_systems", "peer_tls INTEGER NOT NULL DEFAULT 0"),
+	addColumns("add derivation versions to peer_systems", "peer_systems",
+		"stars_version INTEGER NOT NULL DEFAULT 0", "coords_version INTEGER NOT NULL DEFAULT 0"),
+}
+
+// backfillReceivedBy attributes attestations stored with no received_by to the local
+// system, so credit cycles and proofs count them. Only ones clearly received here move:
+// signed by another system, to this one or untargeted (uuid.Nil, from before v1.6.0);
+// anything this system signed or addressed elsewhere stays as it was. Their compacted
+// summaries (which roll up only stored, so received, attestations) move the same way
+func backfillReceivedBy(tx *sql.Tx) error {
+	var local string
+	err := tx.QueryRow("SELECT id FROM system LIMIT 1").Scan(&local)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var before int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM attestations WHERE received_by = ''").Scan(&before); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`
+		UPDATE attestations SET received_by = ?1
+		WHERE received_by = '' AND from_system_id != ?1 AND to_system_id IN (?1, ?2)
+	`, local, uuid.Nil.String())
+	if err != nil {
+		return fmt.Errorf("failed to backfill attestations: %w", err)
+	}
+	moved, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO attestation_summaries (from_system_id, received_by, day, attestation_count, first_timestamp, last_timestamp)
+		SELECT from_system_id, ?1, day, attestation_count, first_timestamp, last_timestamp
+		FROM attestation_summaries WHERE received_by = '' AND from_system_id != ?1
+		ON CONFLICT(from_system_id, received_by, day) DO UPDATE SET
+			attestation_count = attestation_count + excluded.attestation_count,
+			first_timestamp = MIN(first_timestamp, excluded.first_timestamp),
+			last_timestamp = MAX(last_timestamp, excluded.last_timestamp)
+	`, local)
+	if err != nil {
+		return fmt.Errorf("failed to backfill attestation summaries: %w", err)
+	}
+	res, err = tx.Exec(`DELETE FROM attestation_summaries WHERE received_by = '' AND from_system_id != ?`, local)
+	if err != nil {
+		return err
+	}
+	summaries, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Attestations without received_by: %d before, %d after (%d attributed to %s, the rest sent by it or to another system); %d daily summaries attributed",
+		before, before-moved, moved, local[:8], summaries)
+	return nil
+}
+
+// addColumns is a migration adding columns to a table, skipping any it already has
+// Columns are full definitions, e.g. "latency_ms REAL NOT NULL DEFAULT 0"
+func addColumns(name, table string, columns ...string) migration {
+	names := make([]string, len(columns))
+	for i, def := range columns {
+		names[i] = strings.Fields(def)[0]
+	}
+	return migration{
+		name:    name,
+		present: columnsPresent(table, names...),
+		apply: func(tx *sql.Tx) error {
+			return addMissingColumns(tx, table, columns...)
+		},
+	}
+}
+
+// addMissingColumns adds each column definition whose column the table doesn't have
+func addMissingColumns(tx *sql.Tx, table string, columns ...string) error {
+	for _, def := range columns {
+		ok, err := hasColumns(tx, table, strings.Fields(def)[0])
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, def)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// columnsPresent is a present check for a table having all the given columns
+func columnsPresent(table string, columns ...string) func(r schemaReader) (bool, error) {
+	return func(r schemaReader) (bool, error) {
+		return hasColumns(r, table, columns...)
+	}
+}
+
+// hasColumns reports whether a table exists with all the given columns
+func hasColumns(r schemaReader, table string, columns ...string) (bool, error) {
+	rows, err := r.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	have := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		have[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	for _, c := range columns {
+		if !have[c] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// tableExists reports whether the database has a table by that name
+func tableExists(r schemaReader, table string) (bool, error) {
+	rows, err := r.Query("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// schemaState is where a database stands against the migrations list
+type schemaState struct {
+	Fresh    bool // No tables yet: createTables makes them at the latest layout
+	Detected bool // From before schema_version: Version was inferred from its columns
+	Version  int  // Last migration applied
+}
+
+// readSchemaState works out a database's schema version without changing anything
+func readSchemaState(r schemaReader) (schemaState, error) {
+	var state schemaState
+
+	if ok, err := tableExists(r, "system"); err != nil || !ok {
+		state.Fresh = err == nil
+		return state, err
+	}
+
+	versioned, err := tableExists(r, "schema_version")
+	if err != nil {
+		return state, err
+	}
+	if versioned {
+		rows, err := r.Query("SELECT COALESCE(MAX(version), 0) FROM schema_version")
+		if err != nil {
+			return state, err
+		}
+		for rows.Next() {
+			err = rows.Scan(&state.Version)
+		}
+		rows.Close() // Before querying again: the writer has only one connection
+		if err != nil || state.Version > 0 {
+			return state, err
+		}
+	}
+
+	// Unversioned: the longest run of migrations already in place
+	state.Detected = true
+	for _, m := range migrations {
+		if m.present == nil {
+			break
+		}
+		ok, err := m.present(r)
+		if err != nil {
+			return state, err
+		}
+		if !ok {
+			break
+		}
+		state.Version++
+	}
+	return state, nil
+}
+
+// migrate brings the schema up to date, recording each migration as it commits
+// state is what readSchemaState found before createTables ran
+// Fails on the first migration that errors, leaving the database at the version before it
+func (s *Storage) migrate(state schemaState) error {
+	if state.Version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d): upgrade stellar-lab", state.Version, len(migrations))
+	}
+	if _, err := s.db.Exec(schemaVersionTable); err != nil {
+		return fmt.Errorf("failed to create schema_version: %w", err)
+	}
+
+	// Already in place: everything for a new database, or what was detected in an old one
+	record := state.Version
+	if state.Fresh {
+		record = len(migrations)
+	}
+	if state.Fresh || state.Detected {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		now := time.Now().Unix()
+		for i := 0; i < record; i++ {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO schema_version (version, name, applied_at, detected) VALUES (?, ?, ?, 1)",
+				i+1, migrations[i].name, now); err != nil {
+				return fmt.Errorf("failed to record schema version: %w", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to record schema version: %w", err)
+		}
+		if state.Detected {
+			log.Printf("Database schema detected at version %d of %d", record, len(migrations))
+		}
+	}
+
+	for v := record + 1; v <= len(migrations); v++ {
+		if err := s.applyMigration(v); err != nil {
+			return fmt.Errorf("schema migration %d (%s) failed, database left at version %d: %w", v, migrations[v-1].name, v-1, err)
+		}
+		log.Printf("Migrated database schema to version %d: %s", v, migrations[v-1].name)
+	}
+	return nil
+}
+
+// applyMigration runs one migration and records it, in one transaction
+func (s *Storage) applyMigration(version int) error {
+	m := migrations[version-1]
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		version, m.name, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SchemaVersion returns the last migration applied to the database
+func (s *Storage) SchemaVersion() (int, error) {
+	var version int
+	err := s.read.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// runMigrateDryRun reports which migrations opening the database would run, without
+// changing it
+func runMigrateDryRun(dbPath string) int {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		log.Printf("No database at %s: one would be created at schema version %d", dbPath, len(migrations))
+		return 0
+	}
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000&_query_only=true")
+	if err != nil {
+		log.Printf("Failed to open database: %v", err)
+		return 1
+	}
+	defer db.Close()
+
+	state, err := readSchemaState(db)
+	if err != nil {
+		log.Printf("Failed to read schema version: %v", err)
+		return 1
+	}
+
+	switch {
+	case state.Fresh:
+		log.Printf("%s has no tables yet: they would be created at schema version %d", dbPath, len(migrations))
+		return 0
+	case state.Version > len(migrations):
+		log.Printf("Database schema version %d is newer than this build supports (%d): upgrade stellar-lab", state.Version, len(migrations))
+		return 1
+	}
+
+	how := "recorded"
+	if state.Detected {
+		how = "detected from its columns; it would be recorded"
+	}
+	log.Printf("Database at schema version %d of %d (%s)", state.Version, len(migrations), how)
+	if state.Version == len(migrations) {
+		log.Printf("No migrations to run")
+		return 0
+	}
+	log.Printf("%d migrations would run:", len(migrations)-state.Version)
+	for v := state.Version + 1; v <= len(migrations); v++ {
+		log.Printf("  %2d  %s", v, migrations[v-1].name)
+	}
+	return 0
+}
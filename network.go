@@ -8,7 +8,9 @@ import (
 	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -115,33 +117,28 @@ func GetHardwareFingerprint() string {
 // === NAT Traversal ===
 
 // NATTraversal handles automatic port forwarding via UPnP or NAT-PMP
+// The mapping is kept alive by calling Renew before the lease runs out (see port_mapping.go)
 type NATTraversal struct {
-	nat      nat.NAT
-	port     int
-	stopChan chan struct{}
+	mu     sync.Mutex
+	nat    nat.NAT
+	config NATConfig
 }
 
 // NATConfig holds configuration for NAT traversal
 type NATConfig struct {
 	InternalPort  int
-	ExternalPort  int
 	Description   string
 	LeaseDuration time.Duration
 }
 
 // NewNATTraversal creates a new NAT traversal handler
 func NewNATTraversal() *NATTraversal {
-	return &NATTraversal{
-		stopChan: make(chan struct{}),
-	}
+	return &NATTraversal{}
 }
 
 // Setup attempts to configure port forwarding using UPnP or NAT-PMP
 // Returns the external address (ip:port) if successful
 func (n *NATTraversal) Setup(config NATConfig) (string, error) {
-	if config.ExternalPort == 0 {
-		config.ExternalPort = config.InternalPort
-	}
 	if config.Description == "" {
 		config.Description = "Stellar Lab P2P"
 	}
@@ -149,6 +146,15 @@ func (n *NATTraversal) Setup(config NATConfig) (string, error) {
 		config.LeaseDuration = 2 * time.Hour
 	}
 
+	n.mu.Lock()
+	n.config = config
+	n.mu.Unlock()
+	return n.Remap()
+}
+
+// Remap discovers the gateway again and maps the port from scratch
+// Needed after a router reboot, when the old gateway handle may point at nothing
+func (n *NATTraversal) Remap() (string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -158,55 +164,60 @@ func (n *NATTraversal) Setup(config NATConfig) (string, error) {
 		return "", fmt.Errorf("no NAT gateway found: %w", err)
 	}
 
+	n.mu.Lock()
 	n.nat = gateway
-	n.port = config.ExternalPort
+	n.mu.Unlock()
+	return n.addMapping(ctx)
+}
+
+// Renew extends the lease on the current gateway, returning the external address
+// (which changes if the router got a new IP)
+func (n *NATTraversal) Renew() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return n.addMapping(ctx)
+}
 
-	// Get external IP
-	extIP, err := gateway.GetExternalAddress()
+// addMapping adds (or refreshes) the port mapping and looks up the external address
+func (n *NATTraversal) addMapping(ctx context.Context) (string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.nat == nil {
+		return "", fmt.Errorf("no NAT gateway")
+	}
+
+	extIP, err := n.nat.GetExternalAddress()
 	if err != nil {
 		return "", fmt.Errorf("failed to get external address: %w", err)
 	}
 
-	// Add port mapping
-	_, err = gateway.AddPortMapping(ctx, "tcp", config.ExternalPort, config.Description, config.LeaseDuration)
+	port, err := n.nat.AddPortMapping(ctx, "tcp", n.config.InternalPort, n.config.Description, n.config.LeaseDuration)
 	if err != nil {
 		return "", fmt.Errorf("failed to add port mapping: %w", err)
 	}
+	if port == 0 {
+		return "", fmt.Errorf("failed to add port mapping: gateway returned no port")
+	}
 
-	// Start renewal loop (renew at half the lease duration)
-	go n.renewLoop(config.Description, config.LeaseDuration)
-
-	return fmt.Sprintf("%s:%d", extIP.String(), config.ExternalPort), nil
+	// The gateway may map a different external port than asked for (NAT-PMP)
+	return net.JoinHostPort(extIP.String(), strconv.Itoa(port)), nil
 }
 
-// renewLoop periodically renews the port mapping before it expires
-func (n *NATTraversal) renewLoop(description string, leaseDuration time.Duration) {
-	// Renew at half the lease duration to ensure we never expire
-	ticker := time.NewTicker(leaseDuration / 2)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			_, err := n.nat.AddPortMapping(ctx, "tcp", n.port, description, leaseDuration)
-			cancel()
-			if err != nil {
-				log.Printf("UPnP/NAT-PMP: failed to renew port mapping: %v", err)
-			}
-		case <-n.stopChan:
-			return
-		}
-	}
+// LeaseDuration returns how long each mapping or renewal lasts
+func (n *NATTraversal) LeaseDuration() time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.config.LeaseDuration
 }
 
-// Close removes the port mapping and stops the renewal loop
+// Close removes the port mapping
 func (n *NATTraversal) Close() {
-	close(n.stopChan)
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if n.nat != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		if err := n.nat.DeletePortMapping(ctx, "tcp", n.port); err != nil {
+		if err := n.nat.DeletePortMapping(ctx, "tcp", n.config.InternalPort); err != nil {
 			log.Printf("UPnP/NAT-PMP: failed to remove port mapping: %v", err)
 		}
 	}
@@ -214,6 +225,8 @@ func (n *NATTraversal) Close() {
 
 // GetProtocol returns the NAT traversal method being used ("UPnP" or "NAT-PMP")
 func (n *NATTraversal) GetProtocol() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	if n.nat != nil {
 		return n.nat.Type()
 	}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// When the network splits, each island sees the other's nodes stop answering: they go
+// degraded, get evicted, and nothing tries to reach across again. What gives a split away
+// is that gossip disagrees with us: peers (at least one of them reaching both sides) keep
+// listing systems as alive in find_node answers and full-syncs that we fail to reach.
+// Once enough of those have been reported alive but unreachable for several checks in a
+// row, we flag a suspected partition and probe a sample of them every check: directly, at
+// every address we've seen for them, and through peers asked to ping them for us
+// (relayed_ping). A peer that reaches one passes our info on to it, so the other side
+// learns where to find us too. Systems we reach again are logged and counted as healed.
+const (
+	// PartitionCheckInterval is how often the unreachable systems are counted and probed
+	PartitionCheckInterval = 5 * time.Minute
+
+	// PartitionReportWindow is how recent a peer's report of a system must be to count
+	PartitionReportWindow = 30 * time.Minute
+
+	// PartitionConfirmChecks is how many checks in a row a system must be reported alive
+	// while we can't reach it before it counts towards a partition
+	PartitionConfirmChecks = 3
+
+	// PartitionMinSystems and PartitionMinFraction make a group significant: this many
+	// systems, and this share of them plus our routing table
+	PartitionMinSystems  = 3
+	PartitionMinFraction = 0.2
+
+	// PartitionProbeSample is how many of the group are probed per check
+	PartitionProbeSample = 5
+
+	// PartitionRelayPeers is how many peers are asked to ping each probed system
+	PartitionRelayPeers = 2
+
+	// MaxRelayedPings is how many relayed pings we do for one requester per check interval
+	MaxRelayedPings = PartitionProbeSample * PartitionRelayPeers
+
+	// RelayedPingTimeout leaves a relayed ping time to answer within the requester's timeout
+	RelayedPingTimeout = RequestTimeout / 2
+
+	// maxPartitionAddresses caps the addresses remembered per system
+	maxPartitionAddresses = 4
+
+	// maxPartitionHealings is how many healed systems the status lists
+	maxPartitionHealings = 10
+
+	// partitionHealedShown is how long a healing keeps the health card row up
+	partitionHealedShown = time.Hour
+)
+
+// partitionEntry is a system we failed to reach and haven't reached since
+type partitionEntry struct {
+	sys         *System
+	failedSince time.Time
+	reporters   map[uuid.UUID]time.Time // Peers that listed it as alive since, and when
+	addresses   []string                // Peer addresses seen for it, current first
+	strikes     int                     // Checks in a row it was reported alive
+	bridges     map[uuid.UUID]bool      // Peers that reached it for us
+	agree       map[uuid.UUID]bool      // Peers that couldn't reach it either
+	via         string                  // How we're trying to reach it right now
+}
+
+// partitionWatch tracks systems gossip calls alive that we can't reach
+// Locked inside cacheMu, never the other way around
+type partitionWatch struct {
+	mu      sync.Mutex
+	entries map[uuid.UUID]*partitionEntry
+
+	suspected bool
+	since     time.Time
+	probes    int64 // Direct pings sent to the group
+	relayed   int64 // Relayed pings asked of peers
+	healed    int64
+	healings  []PartitionHealing // Newest first
+}
+
+func newPartitionWatch() *partitionWatch {
+	return &partitionWatch{entries: make(map[uuid.UUID]*partitionEntry)}
+}
+
+// failed records a failed direct contact with a cached system
+func (w *partitionWatch) failed(sys *System) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if e, ok := w.entries[sys.ID]; ok {
+		e.sys = sys
+		e.addAddress(sys.PeerAddress)
+		return
+	}
+	e := &partitionEntry{
+		sys:         sys,
+		failedSince: time.Now(),
+		reporters:   make(map[uuid.UUID]time.Time),
+		bridges:     make(map[uuid.UUID]bool),
+		agree:       make(map[uuid.UUID]bool),
+	}
+	e.addAddress(sys.PeerAddress)
+	w.entries[sys.ID] = e
+}
+
+// reported records a peer listing sys as alive; only systems we're failing to reach count
+func (w *partitionWatch) reported(sys *System, reporter uuid.UUID) {
+	if sys == nil || sys.ID == reporter {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[sys.ID]
+	if !ok {
+		return
+	}
+	e.reporters[reporter] = time.Now()
+	e.addAddress(sys.PeerAddress)
+}
+
+// reached records direct contact with a system, logging it if that healed part of a partition
+func (w *partitionWatch) reached(id uuid.UUID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[id]
+	if !ok {
+		return
+	}
+	delete(w.entries, id)
+	if e.strikes < PartitionConfirmChecks {
+		return
+	}
+
+	via := e.via
+	if via == "" {
+		via = "direct contact"
+	}
+	now := time.Now()
+	healing := PartitionHealing{
+		ID:          id.String(),
+		Name:        e.sys.Name,
+		At:          now.Unix(),
+		DownSeconds: int64(now.Sub(e.failedSince).Seconds()),
+		Via:         via,
+	}
+	w.healed++
+	w.healings = append([]PartitionHealing{healing}, w.healings...)
+	if len(w.healings) > maxPartitionHealings {
+		w.healings = w.healings[:maxPartitionHealings]
+	}
+	log.Printf("Partition healing: reached %s (%s) again after %s unreachable (%s)",
+		e.sys.Name, id.String()[:8], now.Sub(e.failedSince).Round(time.Second), via)
+}
+
+// addAddress remembers an address seen for the system, the newest first
+func (e *partitionEntry) addAddress(addr string) {
+	if addr == "" {
+		return
+	}
+	for i, a := range e.addresses {
+		if a == addr {
+			copy(e.addresses[1:i+1], e.addresses[:i])
+			e.addresses[0] = addr
+			return
+		}
+	}
+	e.addresses = append([]string{addr}, e.addresses...)
+	if len(e.addresses) > maxPartitionAddresses {
+		e.addresses = e.addresses[:maxPartitionAddresses]
+	}
+}
+
+// partitionTarget is a copy of what probing a group member needs
+type partitionTarget struct {
+	sys       *System
+	addresses []string
+	reporters []uuid.UUID
+}
+
+// check counts the systems reported alive that we still can't reach, updates the suspicion
+// and returns a sample of the group to probe (none unless a partition is suspected)
+func (w *partitionWatch) check(now time.Time, routingTableSize int) []partitionTarget {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var group []*partitionEntry
+	reporters := make(map[uuid.UUID]bool)
+	for id, e := range w.entries {
+		for reporter, at := range e.reporters {
+			if now.Sub(at) > PartitionReportWindow {
+				delete(e.reporters, reporter)
+			}
+		}
+		if len(e.reporters) == 0 {
+			e.strikes = 0
+			// Nobody has vouched for it in a while: it's just gone
+			if now.Sub(e.failedSince) > PartitionReportWindow {
+				delete(w.entries, id)
+			}
+			continue
+		}
+		e.strikes++
+		if e.strikes >= PartitionConfirmChecks {
+			group = append(group, e)
+			for reporter := range e.reporters {
+				reporters[reporter] = true
+			}
+		}
+	}
+
+	significant := len(group) >= PartitionMinSystems &&
+		float64(len(group)) >= PartitionMinFraction*float64(len(group)+routingTableSize)
+	switch {
+	case significant && !w.suspected:
+		w.suspected = true
+		w.since = now
+		log.Printf("Suspected network partition: %d systems reported alive by %d peers are unreachable from here (%d routing table peers); probing them",
+			len(group), len(reporters), routingTableSize)
+	case !significant && w.suspected:
+		w.suspected = false
+		log.Printf("Partition no longer suspected after %s: %d systems still unreachable, %d healed so far",
+			now.Sub(w.since).Round(time.Second), len(group), w.healed)
+	}
+	if !w.suspected {
+		return nil
+	}
+
+	rand.Shuffle(len(group), func(i, j int) { group[i], group[j] = group[j], group[i] })
+	if len(group) > PartitionProbeSample {
+		group = group[:PartitionProbeSample]
+	}
+	targets := make([]partitionTarget, 0, len(group))
+	for _, e := range group {
+		t := partitionTarget{sys: e.sys, addresses: append([]string(nil), e.addresses...)}
+		for reporter := range e.reporters {
+			t.reporters = append(t.reporters, reporter)
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// probing notes how we're about to try reaching a system, for the healing log
+func (w *partitionWatch) probing(id uuid.UUID, via string, relayed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if relayed {
+		w.relayed++
+	} else {
+		w.probes++
+	}
+	if e, ok := w.entries[id]; ok {
+		e.via = via
+	}
+}
+
+// relayOutcome records whether a peer reached a system for us
+func (w *partitionWatch) relayOutcome(id, peer uuid.UUID, reached bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.entries[id]
+	if !ok {
+		return
+	}
+	if reached {
+		e.bridges[peer] = true
+		delete(e.agree, peer)
+	} else {
+		e.agree[peer] = true
+		delete(e.bridges, peer)
+	}
+}
+
+// PartitionStatus is the partition section of /api/stats
+type PartitionStatus struct {
+	Suspected      bool               `json:"suspected"`
+	Since          int64              `json:"since,omitempty"`    // When the current suspicion began
+	Unreachable    int                `json:"unreachable"`        // Systems reported alive for PartitionConfirmChecks checks that we can't reach
+	Reporters      int                `json:"reporters"`          // Peers reporting them alive
+	Group          []PartitionMember  `json:"group,omitempty"`    // Those systems (omitted in public mode)
+	Probes         int64              `json:"probes"`             // Direct pings sent to them since startup
+	RelayedProbes  int64              `json:"relayed_probes"`     // Relayed pings asked of peers since startup
+	Healed         int64              `json:"healed"`             // Systems reached again since startup
+	HealedRecently bool               `json:"healed_recently"`    // The last one was within the hour
+	Healings       []PartitionHealing `json:"healings,omitempty"` // The most recent, newest first
+}
+
+// PartitionMember is one system peers report alive that we can't reach
+type PartitionMember struct {
+	ID               string   `json:"id"`
+	Name             string   `json:"name"`
+	PeerAddress      string   `json:"peer_address"`
+	UnreachableSince int64    `json:"unreachable_since"`
+	ReportedBy       int      `json:"reported_by"`       // Peers reporting it alive
+	PeersAgree       int      `json:"peers_agree"`       // Peers that can't reach it either (relayed pings and unreachable claims)
+	Bridges          []string `json:"bridges,omitempty"` // Peers that reached it for us
+}
+
+// PartitionHealing is a group member we reached again
+type PartitionHealing struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	At          int64  `json:"at"`
+	DownSeconds int64  `json:"down_seconds"`
+	Via         string `json:"via"` // How it was reached: an address we probed, a peer's relay, or its own contact
+}
+
+// PartitionStatus reports the suspected partition, if any, and the healing so far
+func (dht *DHT) PartitionStatus() PartitionStatus {
+	rt := dht.routingTable
+	w := rt.partitions
+
+	w.mu.Lock()
+	status := PartitionStatus{
+		Suspected:     w.suspected,
+		Probes:        w.probes,
+		RelayedProbes: w.relayed,
+		Healed:        w.healed,
+		Healings:      append([]PartitionHealing(nil), w.healings...),
+	}
+	if w.suspected {
+		status.Since = w.since.Unix()
+	}
+	if len(w.healings) > 0 {
+		status.HealedRecently = time.Since(time.Unix(w.healings[0].At, 0)) < partitionHealedShown
+	}
+	reporters := make(map[uuid.UUID]bool)
+	type member struct {
+		PartitionMember
+		agree   int
+		bridges []uuid.UUID
+	}
+	var members []member
+	for id, e := range w.entries {
+		if e.strikes < PartitionConfirmChecks {
+			continue
+		}
+		for reporter := range e.reporters {
+			reporters[reporter] = true
+		}
+		m := member{PartitionMember: PartitionMember{
+			ID:               id.String(),
+			Name:             e.sys.Name,
+			PeerAddress:      e.sys.PeerAddress,
+			UnreachableSince: e.failedSince.Unix(),
+			ReportedBy:       len(e.reporters),
+		}, agree: len(e.agree)}
+		for peer := range e.bridges {
+			m.bridges = append(m.bridges, peer)
+		}
+		members = append(members, m)
+	}
+	w.mu.Unlock()
+
+	status.Unreachable = len(members)
+	status.Reporters = len(reporters)
+	for _, m := range members {
+		id, _ := uuid.Parse(m.ID)
+		m.PeersAgree = m.agree + rt.GetSuspicionCount(id)
+		for _, peer := range m.bridges {
+			if sys := rt.GetCachedSystem(peer); sys != nil {
+				m.Bridges = append(m.Bridges, sys.Name)
+			}
+		}
+		status.Group = append(status.Group, m.PartitionMember)
+	}
+	sort.Slice(status.Group, func(i, j int) bool { return status.Group[i].Name < status.Group[j].Name })
+	return status
+}
+
+// partitionLoop checks for a partition and probes across it
+func (dht *DHT) partitionLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskPartition, every(PartitionCheckInterval))
+
+	ticker := time.NewTicker(PartitionCheckInterval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(PartitionCheckInterval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(PartitionCheckInterval))
+		case <-t.trigger:
+		}
+		t.run(dht.checkPartition)
+	}
+}
+
+// checkPartition updates the partition suspicion and probes a sample of the group
+// Returns how many systems were probed
+func (dht *DHT) checkPartition() (int, error) {
+	rt := dht.routingTable
+	targets := rt.partitions.check(time.Now(), rt.GetRoutingTableSize())
+	for _, target := range targets {
+		dht.probeUnreachable(target)
+	}
+	return len(targets), nil
+}
+
+// probeUnreachable tries a group member at each address we've seen for it, then asks
+// peers to ping it for us. A peer that reaches it tells us its current info (and tells
+// it ours), so a new address gets one more direct try
+func (dht *DHT) probeUnreachable(target partitionTarget) {
+	w := dht.routingTable.partitions
+	id := target.sys.ID
+
+	tried := make(map[string]bool)
+	tryAddress := func(addr, via string) bool {
+		if addr == "" || tried[addr] {
+			return false
+		}
+		tried[addr] = true
+		probe := *target.sys
+		probe.PeerAddress = addr
+		w.probing(id, via, false)
+		return dht.PingNode(&probe) == nil
+	}
+
+	for _, addr := range target.addresses {
+		if tryAddress(addr, "probe at "+addr) {
+			return
+		}
+	}
+
+	for _, peer := range dht.relayPeersFor(target) {
+		w.probing(id, "relayed through "+peer.Name, true)
+		info, err := dht.pingThrough(peer, target.sys)
+		w.relayOutcome(id, peer.ID, err == nil)
+		if err != nil {
+			log.Printf("Partition probe: %s can't reach %s either: %v", peer.Name, target.sys.Name, err)
+			continue
+		}
+		log.Printf("Partition probe: %s reached %s (%s) for us", peer.Name, target.sys.Name, info.PeerAddress)
+		if tryAddress(info.PeerAddress, "probe at "+info.PeerAddress+", learned through "+peer.Name) {
+			return
+		}
+	}
+}
+
+// relayPeersFor picks routing table peers to ping target for us, the ones reporting it alive first
+func (dht *DHT) relayPeersFor(target partitionTarget) []*System {
+	reported := make(map[uuid.UUID]bool)
+	for _, id := range target.reporters {
+		reported[id] = true
+	}
+
+	var candidates []*System
+	for _, sys := range dht.routingTable.GetAllRoutingTableNodes() {
+		if sys.ID != target.sys.ID && sys.PeerAddress != "" && dht.peerSupports(sys.ID, CapRelayedPing) {
+			candidates = append(candidates, sys)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	sort.SliceStable(candidates, func(i, j int) bool { return reported[candidates[i].ID] && !reported[candidates[j].ID] })
+
+	if len(candidates) > PartitionRelayPeers {
+		candidates = candidates[:PartitionRelayPeers]
+	}
+	return candidates
+}
+
+// pingThrough asks peer to ping target for us, returning target's info as it answered
+func (dht *DHT) pingThrough(peer, target *System) (*System, error) {
+	msg, err := NewRelayedPingRequest(dht.localSystem, peer.ID, target.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dht.sendRequest(peer.PeerAddress, msg)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Relayed == nil {
+		return nil, errors.New(resp.RelayError)
+	}
+	if resp.Relayed.ID != target.ID {
+		return nil, fmt.Errorf("answer is about %s", resp.Relayed.ID.String()[:8])
+	}
+	dht.routingTable.CacheSystem(resp.Relayed, peer.ID, false)
+	return resp.Relayed, nil
+}
+
+// relayedPings counts the relayed pings done for each requester
+type relayedPings struct {
+	mu    sync.Mutex
+	start map[uuid.UUID]time.Time // When the requester's current interval began
+	count map[uuid.UUID]int
+}
+
+func newRelayedPings() *relayedPings {
+	return &relayedPings{start: make(map[uuid.UUID]time.Time), count: make(map[uuid.UUID]int)}
+}
+
+// allow reports whether we'll do another relayed ping for requester now, and counts it
+func (r *relayedPings) allow(requester uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, at := range r.start {
+		if now.Sub(at) >= PartitionCheckInterval {
+			delete(r.start, id)
+			delete(r.count, id)
+		}
+	}
+	if _, ok := r.start[requester]; !ok {
+		r.start[requester] = now
+	}
+	if r.count[requester] >= MaxRelayedPings {
+		return false
+	}
+	r.count[requester]++
+	return true
+}
+
+// handleRelayedPing pings a cached system for a peer that can't reach it
+// The target only counts as reached if it answers as itself; it then gets the requester's
+// info, so it can try reaching the requester from its side
+func (dht *DHT) handleRelayedPing(msg *DHTMessage) (*DHTMessage, error) {
+	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	dht.routingTable.CacheSystem(msg.FromSystem, msg.FromSystem.ID, true)
+
+	if msg.PingBack != "" {
+		reached, relayErr := dht.pingBack(msg.FromSystem, msg.PingBack, msg.sourceIP)
+		return NewRelayedPingResponse(dht.localSystem, msg.FromSystem.ID, reached, relayErr, msg.RequestID)
+	}
+	reached, relayErr := dht.pingFor(msg.FromSystem, *msg.TargetID)
+	return NewRelayedPingResponse(dht.localSystem, msg.FromSystem.ID, reached, relayErr, msg.RequestID)
+}
+
+// pingFor pings target on requester's behalf, returning its info or why there is none
+func (dht *DHT) pingFor(requester *System, targetID uuid.UUID) (*System, string) {
+	if targetID == dht.localSystem.ID {
+		return dht.localSystem, ""
+	}
+	if !dht.relayedPings.allow(requester.ID) {
+		return nil, "too many relayed pings, try again later"
+	}
+	target := dht.routingTable.GetCachedSystem(targetID)
+	if target == nil || target.PeerAddress == "" {
+		return nil, "unknown system"
+	}
+
+	msg, err := NewPingRequest(dht.localSystem, target.ID, "")
+	if err != nil {
+		return nil, err.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RelayedPingTimeout)
+	defer cancel()
+	resp, err := dht.sendRequestContext(ctx, target.PeerAddress, msg)
+	if err != nil {
+		if !isPeerRejection(err) {
+			dht.routingTable.MarkFailed(target.ID)
+		}
+		return nil, "unreachable: " + err.Error()
+	}
+	if resp.FromSystem == nil || resp.FromSystem.ID != target.ID {
+		return nil, "another system answers at its address"
+	}
+
+	if requester.InfoSignature != "" && dht.peerSupports(target.ID, CapInfoRelay) {
+		go func() {
+			relay, err := NewInfoRelayRequest(dht.localSystem, target.ID, requester, "")
+			if err == nil {
+				dht.sendRequest(target.PeerAddress, relay)
+			}
+		}()
+	}
+	log.Printf("Relayed ping: reached %s for %s", target.Name, requester.Name)
+	return resp.FromSystem, ""
+}
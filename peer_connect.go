@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Connecting from the map: the operator picks a cached system and we ping it at its cached
+// address. An answer verifies it, which puts it in the routing table like any other peer.
+// Each target gets one attempt per ConnectAttemptCooldown, so clicking away at a dead
+// system from the UI doesn't turn into a stream of pings.
+const ConnectAttemptCooldown = time.Minute
+
+var (
+	ErrConnectUnknown   = errors.New("system not in the cache")
+	ErrConnectSelf      = errors.New("that's this system")
+	ErrConnectNoAddress = errors.New("no usable peer address for that system")
+	ErrConnectTooSoon   = errors.New("a connection to that system was attempted too recently")
+)
+
+// ConnectProgress is one line of a POST /api/peers/connect response
+type ConnectProgress struct {
+	Stage          string  `json:"stage"` // "pinging", then "connected" or "failed"
+	SystemID       string  `json:"system_id"`
+	Name           string  `json:"name"`
+	PeerAddress    string  `json:"peer_address"`
+	State          string  `json:"state,omitempty"` // Its peer state once the ping is done
+	InRoutingTable bool    `json:"in_routing_table"`
+	DurationMs     float64 `json:"duration_ms,omitempty"`
+	Error          string  `json:"error,omitempty"` // Why the ping failed, as sendRequest put it
+}
+
+// connectAttempts remembers when each target was last tried
+type connectAttempts struct {
+	mu   sync.Mutex
+	last map[uuid.UUID]time.Time
+}
+
+func newConnectAttempts() *connectAttempts {
+	return &connectAttempts{last: make(map[uuid.UUID]time.Time)}
+}
+
+// allow records an attempt on id, or reports false while the last one is too recent
+func (c *connectAttempts) allow(id uuid.UUID, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if last, ok := c.last[id]; ok && now.Sub(last) < ConnectAttemptCooldown {
+		return false
+	}
+	for other, last := range c.last {
+		if now.Sub(last) >= ConnectAttemptCooldown {
+			delete(c.last, other)
+		}
+	}
+	c.last[id] = now
+	return true
+}
+
+// ConnectToSystem pings a cached system at its cached address, reporting each stage to
+// progress. Errors are for attempts that never started; a failed ping is a "failed" result
+func (dht *DHT) ConnectToSystem(id uuid.UUID, progress func(ConnectProgress)) (ConnectProgress, error) {
+	if id == dht.localSystem.ID {
+		return ConnectProgress{}, ErrConnectSelf
+	}
+	cached := dht.routingTable.GetCachedSystemStatus(id)
+	if cached == nil {
+		return ConnectProgress{}, ErrConnectUnknown
+	}
+	sys := cached.System
+	if sys.PeerAddress == "" || cached.Quarantined {
+		return ConnectProgress{}, ErrConnectNoAddress
+	}
+	if !dht.connectAttempts.allow(id, time.Now()) {
+		return ConnectProgress{}, ErrConnectTooSoon
+	}
+
+	result := ConnectProgress{Stage: "pinging", SystemID: id.String(), Name: sys.Name, PeerAddress: sys.PeerAddress,
+		State: cached.State, InRoutingTable: cached.InRoutingTable}
+	progress(result)
+
+	start := time.Now()
+	err := dht.PingNode(sys)
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	result.Stage = "connected"
+	if err != nil {
+		result.Stage = "failed"
+		result.Error = err.Error()
+	}
+	if after := dht.routingTable.GetCachedSystemStatus(id); after != nil {
+		result.State, result.InRoutingTable = after.State, after.InRoutingTable
+	} else {
+		// The address answered as another system, so this entry was dropped
+		result.State, result.InRoutingTable = "", false
+		if err == nil {
+			result.Stage = "failed"
+			result.Error = fmt.Sprintf("another system answers at %s now", sys.PeerAddress)
+		}
+	}
+	progress(result)
+	return result, nil
+}
+
+// handlePeerConnectAPI attempts a connection to a cached system
+// POST /api/peers/connect {"system_id": "..."}; the response is one JSON line per stage
+func (w *WebInterface) handlePeerConnectAPI(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(rw, r.Body, 1<<12)
+
+	var req struct {
+		SystemID string `json:"system_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := uuid.Parse(req.SystemID)
+	if err != nil {
+		http.Error(rw, "Invalid system_id", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(rw)
+	flusher, _ := rw.(http.Flusher)
+	_, err = w.dht.ConnectToSystem(id, func(p ConnectProgress) {
+		if p.Stage == "pinging" {
+			rw.Header().Set("Content-Type", "application/x-ndjson")
+			rw.Header().Set("Cache-Control", "no-store")
+		}
+		enc.Encode(p)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	switch {
+	case errors.Is(err, ErrConnectUnknown):
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrConnectTooSoon):
+		rw.Header().Set("Retry-After", strconv.Itoa(int(ConnectAttemptCooldown.Seconds())))
+		http.Error(rw, err.Error(), http.StatusTooManyRequests)
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	}
+}
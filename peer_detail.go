@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PeerDetailWindow is how far back a peer's attestation exchange is counted
+const PeerDetailWindow = 7 * 24 * time.Hour
+
+// ErrUnknownSystem is returned for systems that aren't in our cache
+var ErrUnknownSystem = errors.New("unknown system")
+
+// Reciprocity states for PeerDetail
+const (
+	ReciprocityMutual = "mutual"  // In our routing table and attesting to us (counts for the credit bonus)
+	ReciprocityOneWay = "one-way" // Only one of the two
+	ReciprocityNone   = "none"
+)
+
+// PeerClaimant is a known system that lists the peer among its own peers
+type PeerClaimant struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// PeerDetail is everything we know about one cached system (/api/peer/{id})
+type PeerDetail struct {
+	System         *System             `json:"system"`
+	State          string              `json:"state"` // pending, stale, degraded or active
+	StateSince     int64               `json:"state_since"`
+	StateChanges   []PeerStateChange   `json:"state_changes"` // Recent transitions, oldest first
+	InRoutingTable bool                `json:"in_routing_table"`
+	Distance       float64             `json:"distance"` // From the local system
+	FirstSeen      int64               `json:"first_seen"`
+	LastVerified   int64               `json:"last_verified,omitempty"`
+	FailCount      int                 `json:"fail_count"`
+	LatencyMs      float64             `json:"latency_ms,omitempty"`     // Round-trip average, once measured
+	ClockSkew      float64             `json:"clock_skew_seconds"`       // How far its clock is ahead of ours (negative: behind)
+	ClockWarning   string              `json:"clock_warning,omitempty"`  // Set when the skew is large
+	Rejection      *PeerRejection      `json:"last_rejection,omitempty"` // The last protocol error it answered us with
+	Quarantined    bool                `json:"quarantined,omitempty"`    // Name or addresses failed sanitization; System is the cleaned copy
+	Capabilities   []string            `json:"capabilities,omitempty"`   // Protocol features it supports, once we've exchanged a message
+	Attestations   AttestationExchange `json:"attestations_7d"`
+	Reciprocity    string              `json:"reciprocity"`
+	ClaimedBy      []PeerClaimant      `json:"claimed_by"`            // Other known systems reporting them as a peer
+	Traffic        *PeerTraffic        `json:"traffic,omitempty"`     // DHT bytes exchanged with them since startup
+	Messages       *PeerMessageTraffic `json:"messages_7d,omitempty"` // Messages exchanged by kind (see peer_traffic.go)
+	Annotation     *PeerAnnotation     `json:"annotation,omitempty"`  // Our own private note and tags on them
+
+	// Self-reported and for display only (see process_uptime.go)
+	ProcessStartTime int64  `json:"process_start_time,omitempty"` // By our clock, once its skew is known
+	ProcessUptime    string `json:"process_uptime,omitempty"`
+}
+
+// GetPeerDetail gathers what we know about a cached system
+// Returns ErrUnknownSystem if it isn't cached (including our own ID)
+func (dht *DHT) GetPeerDetail(id uuid.UUID) (*PeerDetail, error) {
+	status := dht.routingTable.GetCachedSystemStatus(id)
+	if status == nil || id == dht.localSystem.ID {
+		return nil, ErrUnknownSystem
+	}
+
+	detail := &PeerDetail{
+		System:         status.System,
+		State:          status.State,
+		StateSince:     status.StateSince.Unix(),
+		StateChanges:   status.StateChanges,
+		InRoutingTable: status.InRoutingTable,
+		Distance:       dht.localSystem.DistanceTo(status.System),
+		FirstSeen:      status.LearnedAt.Unix(),
+		FailCount:      status.FailCount,
+		LatencyMs:      latencyMs(status.Latency),
+		Quarantined:    status.Quarantined,
+		ClaimedBy:      []PeerClaimant{},
+	}
+	if !status.LastVerified.IsZero() {
+		detail.LastVerified = status.LastVerified.Unix()
+	}
+	if status.CapabilitiesKnown {
+		detail.Capabilities = status.Capabilities.Names()
+	}
+	detail.ProcessStartTime = status.ProcessStartTime
+	if skew, ok := dht.ClockSkew(id); ok {
+		detail.ClockSkew = skew.Seconds()
+		detail.ClockWarning = clockSkewWarning(skew)
+		if detail.ProcessStartTime > 0 {
+			detail.ProcessStartTime -= int64(skew / time.Second)
+		}
+	}
+	detail.ProcessUptime = formatProcessUptime(detail.ProcessStartTime, time.Now())
+	detail.Rejection = dht.routingTable.GetRejection(id)
+	if traffic, ok := dht.PeerTraffic(id); ok {
+		detail.Traffic = &traffic
+	}
+	messages, err := dht.GetPeerMessageTraffic(id.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load peer traffic: %w", err)
+	}
+	detail.Messages = messages
+
+	annotation, err := dht.GetPeerAnnotation(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load annotation: %w", err)
+	}
+	detail.Annotation = annotation
+
+	if err := dht.FlushAttestations(); err != nil {
+		return nil, fmt.Errorf("failed to save buffered attestations: %w", err)
+	}
+	since := time.Now().Add(-PeerDetailWindow).Unix()
+	exchange, err := dht.storage.GetAttestationExchange(dht.localSystem.ID, id, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count attestations: %w", err)
+	}
+	detail.Attestations = exchange
+
+	switch attesting := exchange.Received > 0; {
+	case detail.InRoutingTable && attesting:
+		detail.Reciprocity = ReciprocityMutual
+	case detail.InRoutingTable || attesting:
+		detail.Reciprocity = ReciprocityOneWay
+	default:
+		detail.Reciprocity = ReciprocityNone
+	}
+
+	// Same freshness window as the connection map
+	claimants, err := dht.storage.GetPeerClaimants(id, time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load peer connections: %w", err)
+	}
+	for _, claimantID := range claimants {
+		parsed, err := uuid.Parse(claimantID)
+		if err != nil || parsed == dht.localSystem.ID {
+			continue
+		}
+		if sys := dht.routingTable.GetCachedSystem(parsed); sys != nil {
+			detail.ClaimedBy = append(detail.ClaimedBy, PeerClaimant{ID: claimantID, Name: sys.Name})
+		}
+	}
+
+	return detail, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Private meshes have no public seeds, so a new machine is onboarded from a file of
+// another node's verified peers (-export-peers or GET /api/peers/export, then
+// -import-peers or POST /api/peers/import). At startup the file's addresses stand in for
+// -bootstrap; imported systems are cached unverified and pinged straight away, and
+// nothing in the file is trusted further than gossip would be
+
+// MaxPeerImportBytes bounds an import file or request body
+const MaxPeerImportBytes = MaxFullSyncBytes
+
+// PeerExport is the -export-peers file
+type PeerExport struct {
+	ExportedAt int64          `json:"exported_at"`
+	ExportedBy string         `json:"exported_by"` // UUID of the exporting system
+	Peers      []ExportedPeer `json:"peers"`
+}
+
+// ExportedPeer is one verified system in a peer export
+type ExportedPeer struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	PeerAddress   string  `json:"peer_address"`
+	X             float64 `json:"x"`
+	Y             float64 `json:"y"`
+	Z             float64 `json:"z"`
+	StarClass     string  `json:"star_class"`
+	StarClasses   string  `json:"star_classes,omitempty"` // All stars for binaries and trinaries (see starClasses)
+	SponsorID     string  `json:"sponsor_id,omitempty"`
+	LastVerified  int64   `json:"last_verified"`
+	InfoVersion   int64   `json:"info_version,omitempty"`
+	InfoSignature string  `json:"info_signature,omitempty"`
+	PeerTLS       bool    `json:"peer_tls,omitempty"`       // Signed with the info
+	StarsVersion  int     `json:"stars_version,omitempty"`  // Signed with the info
+	CoordsVersion int     `json:"coords_version,omitempty"` // Signed with the info
+}
+
+// PeerImportResult says what an import did
+type PeerImportResult struct {
+	Added     int `json:"added"`     // Systems we didn't have
+	Known     int `json:"known"`     // Systems already cached (verified ones are left alone)
+	Skipped   int `json:"skipped"`   // Invalid, blocked, ourselves, or info that doesn't verify against the bound key
+	Verifying int `json:"verifying"` // Unverified systems being pinged now
+}
+
+// ExportPeers lists every verified cached system, except ones never passed on to peers
+func (dht *DHT) ExportPeers() *PeerExport {
+	export := &PeerExport{
+		ExportedAt: time.Now().Unix(),
+		ExportedBy: dht.localSystem.ID.String(),
+		Peers:      []ExportedPeer{},
+	}
+	for _, cached := range dht.routingTable.GetAllCachedSystemsWithMeta() {
+		if !cached.Verified || cached.Quarantined || cached.Retracted {
+			continue
+		}
+		sys := cached.System
+		peer := ExportedPeer{
+			ID:            sys.ID.String(),
+			Name:          sys.Name,
+			PeerAddress:   sys.PeerAddress,
+			X:             sys.X,
+			Y:             sys.Y,
+			Z:             sys.Z,
+			StarClass:     sys.Stars.Primary.Class,
+			StarClasses:   starClasses(sys.Stars),
+			LastVerified:  cached.LastVerified.Unix(),
+			InfoVersion:   sys.InfoVersion,
+			InfoSignature: sys.InfoSignature,
+			PeerTLS:       sys.PeerTLS,
+			StarsVersion:  sys.StarsVersion,
+			CoordsVersion: sys.CoordsVersion,
+		}
+		if sys.SponsorID != nil {
+			peer.SponsorID = sys.SponsorID.String()
+		}
+		export.Peers = append(export.Peers, peer)
+	}
+	sort.Slice(export.Peers, func(i, j int) bool { return export.Peers[i].ID < export.Peers[j].ID })
+	return export
+}
+
+// ImportPeers caches the systems in an export as unverified and starts pinging them.
+// Importing the same file twice changes nothing, and systems we've verified ourselves
+// are left as they are. A system whose key we haven't bound comes in unsigned at
+// InfoVersion 0, so whatever its owner sends later replaces it
+func (dht *DHT) ImportPeers(export *PeerExport) PeerImportResult {
+	var result PeerImportResult
+	var entries []CacheEntry
+	for _, peer := range export.Peers {
+		id, err := uuid.Parse(peer.ID)
+		if err != nil || id == dht.localSystem.ID || peer.PeerAddress == "" || dht.routingTable.IsBlocked(id) {
+			result.Skipped++
+			continue
+		}
+		if cached := dht.routingTable.GetCachedSystemMeta(id); cached != nil {
+			result.Known++
+			if cached.Verified {
+				continue
+			}
+		}
+
+		sys := &System{
+			ID:            id,
+			Name:          peer.Name,
+			X:             peer.X,
+			Y:             peer.Y,
+			Z:             peer.Z,
+			PeerAddress:   peer.PeerAddress,
+			StarsVersion:  peer.StarsVersion,
+			CoordsVersion: peer.CoordsVersion,
+		}
+		sys.Stars = assignStarFromClass(peer.StarClass)
+		if peer.StarClasses != "" {
+			sys.Stars = assignStarFromClass(peer.StarClasses)
+		}
+		if sponsor, err := uuid.Parse(peer.SponsorID); err == nil {
+			sys.SponsorID = &sponsor
+		}
+		if bound, _ := dht.storage.GetIdentityBinding(id); bound != "" {
+			// Checked against the key by the cache, like gossip
+			sys.InfoVersion = peer.InfoVersion
+			sys.InfoSignature = peer.InfoSignature
+			sys.PeerTLS = peer.PeerTLS
+		}
+		entries = append(entries, CacheEntry{System: sys, LearnedFrom: uuid.Nil, Verified: false})
+	}
+	result.Added = dht.routingTable.CacheSystemsBatch(entries)
+
+	var verify []*System
+	for _, e := range entries {
+		if cached := dht.routingTable.GetCachedSystemMeta(e.System.ID); cached == nil {
+			result.Skipped++
+		} else if !cached.Verified {
+			verify = append(verify, cached.System)
+		}
+	}
+	result.Verifying = len(verify)
+	log.Printf("Imported peers: %d added, %d already known, %d skipped; verifying %d",
+		result.Added, result.Known, result.Skipped, result.Verifying)
+
+	if len(verify) > 0 {
+		dht.wg.Add(1)
+		go dht.verifyImportedPeers(verify)
+	}
+	return result
+}
+
+// verifyImportedPeers pings imported systems one at a time, like gossip validation
+func (dht *DHT) verifyImportedPeers(systems []*System) {
+	defer dht.wg.Done()
+
+	verified, removed := 0, 0
+	for _, sys := range systems {
+		select {
+		case <-dht.shutdown:
+			return
+		default:
+		}
+		switch dht.validateGossipSystem(sys) {
+		case gossipVerified:
+			verified++
+		case gossipRemoved:
+			removed++
+		}
+	}
+	log.Printf("Imported peer verification: %d verified, %d removed", verified, removed)
+}
+
+// Addresses returns the export's peer addresses, most recently verified first, for bootstrap
+func (e *PeerExport) Addresses() []string {
+	peers := append([]ExportedPeer(nil), e.Peers...)
+	sort.SliceStable(peers, func(i, j int) bool { return peers[i].LastVerified > peers[j].LastVerified })
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, peer := range peers {
+		if peer.PeerAddress != "" && !seen[peer.PeerAddress] {
+			seen[peer.PeerAddress] = true
+			addresses = append(addresses, peer.PeerAddress)
+		}
+	}
+	return addresses
+}
+
+// decodePeerExport reads a peer export, rejecting anything past MaxPeerImportBytes
+func decodePeerExport(r io.Reader) (*PeerExport, error) {
+	var export PeerExport
+	dec := json.NewDecoder(io.LimitReader(r, MaxPeerImportBytes))
+	if err := dec.Decode(&export); err != nil {
+		return nil, fmt.Errorf("invalid peer export: %w", err)
+	}
+	return &export, nil
+}
+
+// readPeerExport loads an -import-peers file
+func readPeerExport(path string) (*PeerExport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodePeerExport(f)
+}
+
+// writePeerExport writes our verified peers to an -export-peers file
+func (dht *DHT) writePeerExport(path string) (int, error) {
+	export := dht.ExportPeers()
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return 0, err
+	}
+	return len(export.Peers), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+)
+
+// PeerState is where a cached system stands with us. It only changes through these
+// transitions, each recorded in the entry's StateChanges for the peer view:
+//   - pending on insert, until we first hear from it directly
+//   - active on any direct contact, from any state
+//   - degraded after DegradedAfterFailures failures in a row; a single missed ping leaves
+//     an active peer active, so one blip doesn't flap it in and out of the breakdown
+//   - stale once its last direct contact is older than VerificationCutoff, or while
+//     enough peers claim it's unreachable (see retraction.go)
+//
+// Active and degraded peers make up the routing table; only active ones are handed out
+// in FIND_NODE responses.
+type PeerState string
+
+const (
+	PeerPending  PeerState = "pending"
+	PeerActive   PeerState = "active"
+	PeerDegraded PeerState = "degraded"
+	PeerStale    PeerState = "stale"
+)
+
+const (
+	// DegradedAfterFailures is how many failures in a row demote an active peer
+	DegradedAfterFailures = 2
+
+	// MaxStateChanges is how many transitions each cache entry remembers
+	MaxStateChanges = 16
+)
+
+// PeerStateChange is one recorded transition
+type PeerStateChange struct {
+	From PeerState `json:"from,omitempty"` // Empty for the insert
+	To   PeerState `json:"to"`
+	At   int64     `json:"at"`
+}
+
+// inRoutingTable reports whether a state counts as a routing table member
+func (s PeerState) inRoutingTable() bool {
+	return s == PeerActive || s == PeerDegraded
+}
+
+// nextState is the state the transition rules give c now
+func (c *CachedSystem) nextState(cutoff time.Time) PeerState {
+	switch {
+	case !c.Verified:
+		return PeerPending
+	case c.Retracted || c.LastVerified.IsZero() || c.LastVerified.Before(cutoff):
+		return PeerStale
+	case c.FailCount >= DegradedAfterFailures:
+		return PeerDegraded
+	default:
+		return PeerActive
+	}
+}
+
+// insertState starts a new cache entry as pending and settles it (caller holds cacheMu)
+func (c *CachedSystem) insertState(now, cutoff time.Time) {
+	c.State, c.StateSince = PeerPending, now
+	c.StateChanges = []PeerStateChange{{To: PeerPending, At: now.Unix()}}
+	c.settle(now, cutoff)
+}
+
+// settle applies the transition rules after c's contact record changed, recording the
+// transition if there was one (caller holds cacheMu)
+func (c *CachedSystem) settle(now, cutoff time.Time) bool {
+	next := c.nextState(cutoff)
+	if next == c.State {
+		return false
+	}
+	c.StateChanges = append(c.StateChanges, PeerStateChange{From: c.State, To: next, At: now.Unix()})
+	if len(c.StateChanges) > MaxStateChanges {
+		c.StateChanges = c.StateChanges[len(c.StateChanges)-MaxStateChanges:]
+	}
+	c.State, c.StateSince = next, now
+	return true
+}
+
+// stateAt is c's recorded state, except that a routing table peer whose last contact
+// has aged past cutoff reads as stale before the liveness loop gets to record it
+func (c *CachedSystem) stateAt(cutoff time.Time) PeerState {
+	if c.State.inRoutingTable() && c.LastVerified.Before(cutoff) {
+		return PeerStale
+	}
+	return c.State
+}
+
+// settleAgedStates records the stale transitions of peers whose last contact aged past
+// cutoff (caller holds cacheMu and emits the returned events after releasing it)
+func (rt *RoutingTable) settleAgedStates(now, cutoff time.Time) []Event {
+	var events []Event
+	for _, cached := range rt.systemCache {
+		before := statusOf(cached, cached.State)
+		if cached.settle(now, cutoff) {
+			events = append(events, transitionEvents(cached, before, statusOf(cached, cached.State))...)
+		}
+	}
+	return events
+}
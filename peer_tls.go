@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Peer transports, as recorded per peer and shown in the peer state breakdown
+const (
+	TransportHTTP  = "http"
+	TransportHTTPS = "https"
+)
+
+const (
+	// tlsSniffTimeout bounds how long a new DHT connection may take to send its first byte
+	tlsSniffTimeout = 10 * time.Second
+
+	// tlsRecordHandshake is the first byte of every TLS ClientHello
+	tlsRecordHandshake = 0x16
+)
+
+// ErrPeerCertMismatch means a peer's TLS certificate isn't its bound identity key
+// Never retried over plain HTTP - that would let an impostor force a downgrade
+var ErrPeerCertMismatch = errors.New("peer certificate does not match bound identity key")
+
+// EnablePeerTLS serves TLS on the DHT port alongside plain HTTP and advertises it to peers
+// The certificate is self-signed with the node's identity key, so peers pin it against
+// identity_bindings instead of trusting a CA
+func (dht *DHT) EnablePeerTLS() error {
+	cert, err := newPeerCertificate(dht.localSystem)
+	if err != nil {
+		return err
+	}
+
+	dht.peerTLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}
+	dht.localSystem.PeerTLS = true
+	dht.localSystem.SignInfo() // The flag is signed
+	log.Printf("Peer TLS enabled (plain HTTP still accepted from older peers)")
+	return nil
+}
+
+// newPeerCertificate creates a self-signed certificate for the system's identity key
+// The system UUID is the subject so a peer can tell whose key it is looking at
+func newPeerCertificate(sys *System) (tls.Certificate, error) {
+	if sys.Keys == nil {
+		return tls.Certificate{}, ErrNoKeys
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: sys.ID.String()},
+		NotBefore:    now.Add(-1 * time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0), // Regenerated on every start
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, sys.Keys.PublicKey, sys.Keys.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create peer certificate: %w", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: sys.Keys.PrivateKey}, nil
+}
+
+// verifyPeerCertificate checks that the server presented the expected system's bound key
+func verifyPeerCertificate(cs tls.ConnectionState, id uuid.UUID, boundKey string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrPeerCertMismatch
+	}
+	leaf := cs.PeerCertificates[0]
+	key, ok := leaf.PublicKey.(ed25519.PublicKey)
+	if !ok || leaf.Subject.CommonName != id.String() ||
+		base64.StdEncoding.EncodeToString(key) != boundKey {
+		return ErrPeerCertMismatch
+	}
+	return nil
+}
+
+// pinnedClient is an HTTP client that only talks TLS to one system's identity key
+type pinnedClient struct {
+	boundKey string
+	client   *http.Client
+}
+
+// tlsClientFor returns a pinned client for a peer that advertises TLS at this address
+// Returns nil when the request should go over plain HTTP: unknown peer, no TLS
+// advertised, or no bound key to pin against
+func (dht *DHT) tlsClientFor(address string, msg *DHTMessage) (*http.Client, uuid.UUID) {
+	id := uuid.Nil
+	if msg.Attestation != nil {
+		id = msg.Attestation.ToSystemID
+	}
+	if id == uuid.Nil {
+		id = dht.routingTable.GetSystemIDByAddress(address)
+	}
+	if id == uuid.Nil || !dht.routingTable.AdvertisesTLS(id, address) {
+		return nil, uuid.Nil
+	}
+
+	boundKey, err := dht.storage.GetIdentityBinding(id)
+	if err != nil || boundKey == "" {
+		return nil, uuid.Nil
+	}
+
+	if cached, ok := dht.peerTLSClients.Load(id); ok && cached.(*pinnedClient).boundKey == boundKey {
+		return cached.(*pinnedClient).client, id
+	}
+
+	client := &http.Client{
+		Timeout: RequestTimeout,
+		Transport: &http.Transport{
+			DialContext: dht.bandwidth.dial,
+			TLSClientConfig: &tls.Config{
+				// No CA: VerifyConnection pins the certificate to the bound identity key instead
+				InsecureSkipVerify: true,
+				MinVersion:         tls.VersionTLS13,
+				VerifyConnection: func(cs tls.ConnectionState) error {
+					return verifyPeerCertificate(cs, id, boundKey)
+				},
+			},
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	dht.peerTLSClients.Store(id, &pinnedClient{boundKey: boundKey, client: client})
+	return client, id
+}
+
+// peerTLSURL builds an https URL for a peer's DHT port
+func peerTLSURL(address, path string) string {
+	return "https://" + strings.TrimPrefix(peerURL(address, path), "http://")
+}
+
+// requestTransport reports how an inbound request reached us
+func requestTransport(r *http.Request) string {
+	if r.TLS != nil {
+		return TransportHTTPS
+	}
+	return TransportHTTP
+}
+
+// === Listener ===
+
+// peerListener serves TLS and plain HTTP on the same port, so turning on -peer-tls
+// doesn't cut off peers that only speak HTTP. Each connection's first byte decides.
+type peerListener struct {
+	net.Listener
+	config *tls.Config
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newPeerListener wraps a listener to accept both TLS and plain connections
+func newPeerListener(inner net.Listener, config *tls.Config) net.Listener {
+	l := &peerListener{
+		Listener: inner,
+		config:   config,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop sniffs connections in their own goroutines so a slow client can't stall Accept
+func (l *peerListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.classify(c)
+	}
+}
+
+// classify peeks at the first byte and wraps TLS handshakes in a TLS server conn
+func (l *peerListener) classify(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(tlsSniffTimeout))
+	br := bufio.NewReader(c)
+	first, err := br.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	var conn net.Conn = &peekedConn{Conn: c, r: br}
+	if first[0] == tlsRecordHandshake {
+		conn = tls.Server(conn, l.config)
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// Accept returns the next classified connection
+func (l *peerListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and closes the underlying listener
+func (l *peerListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// peekedConn replays the bytes read while sniffing
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Per-peer message counts, for telling a chatty peer's legitimate find_node churn from a
+// bug on its side. Each message exchanged bumps atomic counters kept per peer and
+// direction; the flush loop moves them into hourly buckets in peer_traffic every hour
+// (and on shutdown), and retention keeps a week of those.
+//
+// Counters are keyed by the peer's UUID once its identity has checked out. A message
+// refused before then only claims a UUID, so it's counted under the IP it came from
+// instead: nobody can inflate or spoof another system's counts.
+const (
+	// TrafficFlushInterval is how often the counters are moved into their hourly bucket
+	TrafficFlushInterval = time.Hour
+
+	// PeerTrafficWindow is how far back GET /api/peers/{id}/traffic and the peer page go
+	PeerTrafficWindow = 7 * 24 * time.Hour
+)
+
+// Directions in peer_traffic: messages received from the peer, and ones sent to it
+const (
+	TrafficInbound  = "in"
+	TrafficOutbound = "out"
+)
+
+// MessageCounts is one direction's messages with a peer, by kind
+type MessageCounts struct {
+	Ping      int64 `json:"ping"`
+	FindNode  int64 `json:"find_node"`
+	Announce  int64 `json:"announce"`
+	Other     int64 `json:"other"` // Every other request type
+	Responses int64 `json:"responses"`
+	Errors    int64 `json:"errors"`   // Error responses
+	Rejected  int64 `json:"rejected"` // Refused by the receiver for failing validation: message, identity, attestation, clock or coordinates
+	Bytes     int64 `json:"bytes"`    // As they crossed the wire
+}
+
+// add sums two counts
+func (c MessageCounts) add(o MessageCounts) MessageCounts {
+	return MessageCounts{
+		Ping:      c.Ping + o.Ping,
+		FindNode:  c.FindNode + o.FindNode,
+		Announce:  c.Announce + o.Announce,
+		Other:     c.Other + o.Other,
+		Responses: c.Responses + o.Responses,
+		Errors:    c.Errors + o.Errors,
+		Rejected:  c.Rejected + o.Rejected,
+		Bytes:     c.Bytes + o.Bytes,
+	}
+}
+
+// TrafficHour is one hourly bucket of a peer's messages
+type TrafficHour struct {
+	Hour int64         `json:"hour"` // When the hour began
+	In   MessageCounts `json:"in"`
+	Out  MessageCounts `json:"out"`
+}
+
+// PeerMessageTraffic is a peer's messages over PeerTrafficWindow (GET /api/peers/{id}/traffic)
+type PeerMessageTraffic struct {
+	Since int64         `json:"since"`
+	In    MessageCounts `json:"in"` // Totals over the hours
+	Out   MessageCounts `json:"out"`
+	Hours []TrafficHour `json:"hours"` // Oldest first; the current hour includes counts not yet flushed
+}
+
+// directionCounters are one direction's counts with a peer since the last flush
+type directionCounters struct {
+	ping, findNode, announce, other, responses, errors, rejected, bytes atomic.Int64
+}
+
+// request is the counter for a request of msgType
+func (c *directionCounters) request(msgType string) *atomic.Int64 {
+	switch msgType {
+	case MessageTypePing:
+		return &c.ping
+	case MessageTypeFindNode:
+		return &c.findNode
+	case MessageTypeAnnounce:
+		return &c.announce
+	}
+	return &c.other
+}
+
+// counts reads the counters, zeroing them when take is set
+func (c *directionCounters) counts(take bool) MessageCounts {
+	read := (*atomic.Int64).Load
+	if take {
+		read = func(v *atomic.Int64) int64 { return v.Swap(0) }
+	}
+	return MessageCounts{
+		Ping:      read(&c.ping),
+		FindNode:  read(&c.findNode),
+		Announce:  read(&c.announce),
+		Other:     read(&c.other),
+		Responses: read(&c.responses),
+		Errors:    read(&c.errors),
+		Rejected:  read(&c.rejected),
+		Bytes:     read(&c.bytes),
+	}
+}
+
+// peerCounters are one peer's counts in each direction
+type peerCounters struct {
+	in, out directionCounters
+}
+
+// empty reports whether the counters hold nothing since the last flush
+func (c *peerCounters) empty() bool {
+	return c.in.counts(false) == (MessageCounts{}) && c.out.counts(false) == (MessageCounts{})
+}
+
+// messageTraffic holds every peer's counters since the last flush
+// Counting is lock-free: a peer's counters are created once and then only added to
+type messageTraffic struct {
+	peers sync.Map // Peer key (UUID or remote IP) -> *peerCounters
+
+	mu        sync.Mutex // Held by flushes
+	lastFlush time.Time  // Counts since then belong to its hour
+}
+
+func newMessageTraffic() *messageTraffic {
+	return &messageTraffic{lastFlush: time.Now()}
+}
+
+// counters returns a peer's counters, creating them on its first message
+func (m *messageTraffic) counters(peer string) *peerCounters {
+	if c, ok := m.peers.Load(peer); ok {
+		return c.(*peerCounters)
+	}
+	c, _ := m.peers.LoadOrStore(peer, &peerCounters{})
+	return c.(*peerCounters)
+}
+
+// inbound counts a message a peer sent us and our answer: failed is set when we answered
+// with an error, rejected when that was for failing validation. peer is its UUID, or the
+// remote IP if it was refused before its identity was checked
+func (m *messageTraffic) inbound(peer string, msg *DHTMessage, received, sent int64, failed, rejected bool) {
+	c := m.counters(peer)
+	c.in.bytes.Add(received)
+	c.out.bytes.Add(sent)
+	switch {
+	case rejected:
+		c.in.rejected.Add(1)
+	case msg.IsResponse:
+		c.in.responses.Add(1)
+	default:
+		c.in.request(msg.Type).Add(1)
+	}
+	if msg.IsResponse {
+		return
+	}
+	if failed {
+		c.out.errors.Add(1)
+	} else {
+		c.out.responses.Add(1)
+	}
+}
+
+// outbound counts a request we sent a peer and its answer: failed is set when it answered
+// with an error (errCode, which says whether our request failed its validation), rejected
+// when we refused its response for failing ours
+func (m *messageTraffic) outbound(peer uuid.UUID, msgType string, sent, received int64, failed bool, errCode int, rejected bool) {
+	c := m.counters(peer.String())
+	c.out.request(msgType).Add(1)
+	c.out.bytes.Add(sent)
+	c.in.bytes.Add(received)
+	switch {
+	case failed:
+		c.in.errors.Add(1)
+		if isValidationError(errCode) {
+			c.out.rejected.Add(1)
+		}
+	case rejected:
+		c.in.rejected.Add(1)
+	default:
+		c.in.responses.Add(1)
+	}
+}
+
+// isValidationError reports whether an error code refuses a message for failing validation
+func isValidationError(code int) bool {
+	switch code {
+	case ErrCodeInvalidMessage, ErrCodeMissingAttestation, ErrCodeInvalidAttestation:
+		return true
+	}
+	return false
+}
+
+// take zeroes every peer's counters, returning what they held and the hour it belongs to
+func (m *messageTraffic) take(now time.Time) (int64, map[string]TrafficHour) {
+	hour := m.lastFlush.Truncate(time.Hour).Unix()
+	m.lastFlush = now
+
+	peers := make(map[string]TrafficHour)
+	m.peers.Range(func(key, value any) bool {
+		c := value.(*peerCounters)
+		t := TrafficHour{Hour: hour, In: c.in.counts(true), Out: c.out.counts(true)}
+		if t.In != (MessageCounts{}) || t.Out != (MessageCounts{}) {
+			peers[key.(string)] = t
+		}
+		return true
+	})
+	return hour, peers
+}
+
+// forget drops the counters of peers keep doesn't want, and of remote IPs, once they've
+// been flushed. Ones still holding counts stay for the next flush to save: refused
+// senders are never cached, and theirs are the counts that matter most
+func (m *messageTraffic) forget(keep func(uuid.UUID) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peers.Range(func(key, value any) bool {
+		if !value.(*peerCounters).empty() {
+			return true
+		}
+		if id, err := uuid.Parse(key.(string)); err != nil || !keep(id) {
+			m.peers.Delete(key)
+		}
+		return true
+	})
+}
+
+// trafficFlushLoop moves the counters into their hourly bucket at the top of every hour
+func (dht *DHT) trafficFlushLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskTrafficFlush, every(TrafficFlushInterval))
+
+	// Flushing on the hour keeps each bucket to its own hour's messages
+	next := time.Now().Truncate(TrafficFlushInterval).Add(TrafficFlushInterval)
+	t.scheduleNext(next)
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-timer.C:
+			next = time.Now().Truncate(TrafficFlushInterval).Add(TrafficFlushInterval)
+			t.scheduleNext(next)
+			timer.Reset(time.Until(next))
+		case <-t.trigger:
+		}
+		t.run(dht.flushPeerTraffic)
+	}
+}
+
+// flushPeerTraffic writes the counts since the last flush to peer_traffic and trims it back
+// to its retention limit. Returns how many peers had counts
+func (dht *DHT) flushPeerTraffic() (int, error) {
+	m := dht.messageTraffic
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hour, peers := m.take(time.Now())
+	if len(peers) > 0 {
+		if err := dht.storage.AddPeerTraffic(hour, peers); err != nil {
+			log.Printf("Failed to save peer traffic: %v", err)
+			return 0, err
+		}
+	}
+	_, err := dht.trimTables(RetainPeerTraffic)
+	return len(peers), err
+}
+
+// GetPeerMessageTraffic returns a peer's messages by kind and direction over
+// PeerTrafficWindow, the counts not yet flushed included. peer is a system's UUID, or a
+// remote IP whose messages were refused before their sender's identity was checked
+func (dht *DHT) GetPeerMessageTraffic(peer string) (*PeerMessageTraffic, error) {
+	m := dht.messageTraffic
+	since := time.Now().Add(-PeerTrafficWindow).Truncate(time.Hour)
+
+	// Held so a flush can't move counts between the two reads
+	m.mu.Lock()
+	hours, err := dht.storage.GetPeerTraffic(peer, since.Unix())
+	if err != nil {
+		m.mu.Unlock()
+		return nil, err
+	}
+	pending := TrafficHour{Hour: m.lastFlush.Truncate(time.Hour).Unix()}
+	if c, ok := m.peers.Load(peer); ok {
+		pending.In = c.(*peerCounters).in.counts(false)
+		pending.Out = c.(*peerCounters).out.counts(false)
+	}
+	m.mu.Unlock()
+
+	if pending.In != (MessageCounts{}) || pending.Out != (MessageCounts{}) {
+		if n := len(hours); n > 0 && hours[n-1].Hour == pending.Hour {
+			hours[n-1].In = hours[n-1].In.add(pending.In)
+			hours[n-1].Out = hours[n-1].Out.add(pending.Out)
+		} else {
+			hours = append(hours, pending)
+		}
+	}
+
+	traffic := &PeerMessageTraffic{Since: since.Unix(), Hours: []TrafficHour{}}
+	for _, h := range hours {
+		traffic.In = traffic.In.add(h.In)
+		traffic.Out = traffic.Out.add(h.Out)
+		traffic.Hours = append(traffic.Hours, h)
+	}
+	return traffic, nil
+}
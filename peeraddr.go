@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HostResolveTTL is how long a hostname's resolved IPs are reused when matching addresses
+	// Short, since peers advertising DNS names are usually on dynamic IPs
+	HostResolveTTL = 1 * time.Minute
+
+	// HostResolveTimeout bounds a single DNS lookup during address matching
+	HostResolveTimeout = 2 * time.Second
+)
+
+// NormalizePeerAddress returns the canonical "host:port" form of a peer address
+// Accepts hostnames, IPv4, bracketed IPv6 ("[2001:db8::1]:7867") and unbracketed
+// IPv6 with a trailing port ("2001:db8::1:7867" is read as host 2001:db8::1 only
+// when the whole string is not itself a valid IP). Hostnames are lowercased and
+// kept unresolved - they are resolved at dial time so dynamic DNS keeps working.
+func NormalizePeerAddress(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", fmt.Errorf("empty address")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Unbracketed IPv6: split at the last colon if the rest is an IPv6 literal
+		if net.ParseIP(addr) != nil {
+			return "", fmt.Errorf("address %q has no port (bracket IPv6 literals: \"[addr]:port\")", addr)
+		}
+		idx := strings.LastIndex(addr, ":")
+		if idx == -1 || net.ParseIP(addr[:idx]) == nil {
+			return "", fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+		host, port = addr[:idx], addr[idx+1:]
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port in address %q", addr)
+	}
+	if host == "" {
+		return "", fmt.Errorf("address %q has no host", addr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String() // Canonical form (e.g. collapses IPv6 zeros)
+	} else {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// peerURL builds an http URL for a peer address, bracketing IPv6 literals
+func peerURL(address, path string) string {
+	if normalized, err := NormalizePeerAddress(address); err == nil {
+		address = normalized
+	}
+	return "http://" + address + path
+}
+
+// addressPort returns the numeric port of an address (0 if it has none)
+func addressPort(address string) int {
+	normalized, err := NormalizePeerAddress(address)
+	if err != nil {
+		return 0
+	}
+	_, port, _ := net.SplitHostPort(normalized)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// hostResolver caches DNS lookups used to match hostnames against IP addresses
+type hostResolver struct {
+	mu      sync.Mutex
+	entries map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	ips     []string
+	expires time.Time
+}
+
+var peerHostResolver = &hostResolver{entries: make(map[string]resolvedHost)}
+
+// lookup returns the IPs for a host (the host itself if it is already an IP)
+func (hr *hostResolver) lookup(host string) []string {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}
+	}
+
+	hr.mu.Lock()
+	entry, ok := hr.entries[host]
+	hr.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ips
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HostResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+
+	var ips []string
+	if err == nil {
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				ips = append(ips, ip.String())
+			}
+		}
+	}
+
+	hr.mu.Lock()
+	hr.entries[host] = resolvedHost{ips: ips, expires: time.Now().Add(HostResolveTTL)}
+	hr.mu.Unlock()
+	return ips
+}
+
+// resolvePeerAddress returns the "ip:port" addresses a hostname address resolves to,
+// through the cached lookup. Nil for an IP literal or an invalid address
+func resolvePeerAddress(address string) []string {
+	normalized, err := NormalizePeerAddress(address)
+	if err != nil {
+		return nil
+	}
+	host, port, _ := net.SplitHostPort(normalized)
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	var resolved []string
+	for _, ip := range peerHostResolver.lookup(host) {
+		resolved = append(resolved, net.JoinHostPort(ip, port))
+	}
+	return resolved
+}
+
+// samePeerAddress reports whether two addresses reach the same peer: identical after
+// normalization, or two hostnames on the same port that resolve to a shared IP
+// A hostname is never resolved to match an IP literal here, so checking an address against
+// many candidates costs no DNS (GetSystemIDByAddress resolves a hostname once for that)
+func samePeerAddress(a, b string) bool {
+	na, errA := NormalizePeerAddress(a)
+	nb, errB := NormalizePeerAddress(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	if na == nb {
+		return true
+	}
+
+	hostA, portA, _ := net.SplitHostPort(na)
+	hostB, portB, _ := net.SplitHostPort(nb)
+	if portA != portB || net.ParseIP(hostA) != nil || net.ParseIP(hostB) != nil {
+		return false
+	}
+
+	ipsB := peerHostResolver.lookup(hostB)
+	for _, ipA := range peerHostResolver.lookup(hostA) {
+		for _, ipB := range ipsB {
+			if ipA == ipB {
+				return true
+			}
+		}
+	}
+	return false
+}
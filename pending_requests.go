@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PendingRequestTTL is how long a pending request entry may outlive its request
+// before a sweep drops it (sendRequest normally removes its own entry)
+const PendingRequestTTL = 2 * RequestTimeout
+
+// pendingRequest is an outbound request awaiting its response
+type pendingRequest struct {
+	ch         chan *DHTMessage
+	address    string    // Where the request went
+	expectedID uuid.UUID // Who we addressed it to (uuid.Nil on first contact)
+	sentAt     time.Time
+}
+
+// registerPending records an outbound request so its response can be matched to it
+func (dht *DHT) registerPending(msg *DHTMessage, address string) *pendingRequest {
+	p := &pendingRequest{
+		ch:      make(chan *DHTMessage, 1),
+		address: address,
+		sentAt:  time.Now(),
+	}
+	if msg.Attestation != nil {
+		p.expectedID = msg.Attestation.ToSystemID
+	}
+
+	dht.pendingMu.Lock()
+	defer dht.pendingMu.Unlock()
+	dht.sweepPendingLocked(p.sentAt)
+	dht.pendingRequests[msg.RequestID] = p
+	return p
+}
+
+// unregisterPending forgets a finished request
+func (dht *DHT) unregisterPending(requestID string) {
+	dht.pendingMu.Lock()
+	delete(dht.pendingRequests, requestID)
+	dht.pendingMu.Unlock()
+}
+
+// sweepPendingLocked drops entries whose request died before removing them, at most
+// once per PendingRequestTTL (caller holds pendingMu)
+func (dht *DHT) sweepPendingLocked(now time.Time) {
+	if now.Sub(dht.lastPendingSweep) < PendingRequestTTL {
+		return
+	}
+	dht.lastPendingSweep = now
+	for id, p := range dht.pendingRequests {
+		if now.Sub(p.sentAt) > PendingRequestTTL {
+			delete(dht.pendingRequests, id)
+		}
+	}
+}
+
+// ownsAddress reports whether a responder other than the one we expected may answer
+// for address: it must claim the address itself, as when a DHCP lease or port passes
+// to a new system. remoteIP, when known, is where the response actually came from
+func ownsAddress(sys *System, address, remoteIP string) bool {
+	if sys == nil || sys.PeerAddress == "" || addressKey(sys.PeerAddress) != addressKey(address) {
+		return false
+	}
+	if remoteIP == "" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	return err == nil && host == remoteIP
+}
+
+// checkResponder verifies a response comes from the peer the request was sent to and
+// is addressed to us. Returns an error for responses to discard
+func (dht *DHT) checkResponder(p *pendingRequest, resp *DHTMessage, remoteIP string) error {
+	if resp.FromSystem == nil || resp.Attestation == nil {
+		return fmt.Errorf("response from %s carries no identity", p.address)
+	}
+	if to := resp.Attestation.ToSystemID; to != uuid.Nil && to != dht.localSystem.ID {
+		return fmt.Errorf("response from %s (%s) is addressed to %s", resp.FromSystem.Name,
+			resp.FromSystem.ID.String()[:8], to.String()[:8])
+	}
+	if p.expectedID == uuid.Nil || resp.FromSystem.ID == p.expectedID {
+		return nil
+	}
+	if ownsAddress(resp.FromSystem, p.address, remoteIP) {
+		return nil // The address changed hands; PingNode drops the old entry
+	}
+	return fmt.Errorf("response to a request for %s came from %s (%s) at %s",
+		p.expectedID.String()[:8], resp.FromSystem.Name, resp.FromSystem.ID.String()[:8], p.address)
+}
+
+// matchResponse finds the pending request an inbound response answers, if the
+// response is one we'll accept from where it came from
+func (dht *DHT) matchResponse(msg *DHTMessage, remoteIP string) (*pendingRequest, error) {
+	dht.pendingMu.RLock()
+	p, exists := dht.pendingRequests[msg.RequestID]
+	dht.pendingMu.RUnlock()
+
+	if !exists || msg.RequestID == "" {
+		return nil, fmt.Errorf("no pending request %q", msg.RequestID)
+	}
+	if err := dht.checkResponder(p, msg, remoteIP); err != nil {
+		log.Printf("Discarding response: %v", err)
+		return nil, err
+	}
+	return p, nil
+}
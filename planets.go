@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// MaxPlanets is the most planets a system can have
+const MaxPlanets = 12
+
+// Planet types
+const (
+	PlanetRocky = "rocky"
+	PlanetGas   = "gas"
+	PlanetIce   = "ice"
+)
+
+// Planet is a body orbiting a system's primary star
+// Planets are derived from the system UUID like its stars, so every node computes
+// the same planets without them ever being gossiped
+type Planet struct {
+	Name          string  `json:"name"`           // System name plus suffix, e.g. "Sol c"
+	Suffix        string  `json:"suffix"`         // b, c, d... outward from the star (exoplanet convention)
+	Type          string  `json:"type"`           // rocky, gas or ice
+	OrbitalRadius float64 `json:"orbital_radius"` // AU
+}
+
+// GeneratePlanets deterministically creates 0-12 planets from the system UUID
+// Orbits are spaced geometrically outward from the star (Titius-Bode style) and scaled
+// by the primary's luminosity; the frost line decides between rocky and gas/ice worlds.
+func (s *System) GeneratePlanets() []Planet {
+	// Nothing stable orbits the galactic core
+	if s.Stars.Primary.Class == "X" {
+		return []Planet{}
+	}
+
+	count := int(s.DeterministicSeed("planet_count") % (MaxPlanets + 1))
+	planets := make([]Planet, 0, count)
+	if count == 0 {
+		return planets
+	}
+
+	// Use the UUID-derived primary, not whatever star info was gossiped to us
+	expected := ExpectedStars(s.StarsVersion, s.ID)
+	scale := math.Sqrt(expected.Primary.Luminosity)
+	frostLine := 2.7 * scale
+
+	radius := 0.2 * scale * (1 + float64(s.DeterministicSeed("planet_inner")%100)/100)
+	for i := 0; i < count; i++ {
+		seed := s.DeterministicSeed(fmt.Sprintf("planet_%d", i))
+		if i > 0 {
+			// Each orbit is 1.4x-2.2x the previous one
+			radius *= 1.4 + float64(seed%800)/1000
+		}
+
+		roll := (seed / 1000) % 100
+		var planetType string
+		switch {
+		case radius < frostLine:
+			planetType = PlanetRocky
+			if roll < 8 {
+				planetType = PlanetGas // Hot Jupiter
+			}
+		case radius < 10*frostLine:
+			planetType = PlanetGas
+			if roll < 35 {
+				planetType = PlanetIce
+			}
+		default:
+			planetType = PlanetIce
+			if roll < 15 {
+				planetType = PlanetGas
+			}
+		}
+
+		suffix := string(rune('b' + i))
+		planets = append(planets, Planet{
+			Name:          s.Name + " " + suffix,
+			Suffix:        suffix,
+			Type:          planetType,
+			OrbitalRadius: math.Round(radius*1000) / 1000,
+		})
+	}
+	return planets
+}
+
+// ValidatePlanets checks planets against what the system's UUID should produce
+// Planets aren't exchanged today; this keeps anyone from claiming fake ones if they ever are
+func ValidatePlanets(sys *System, planets []Planet) bool {
+	expected := sys.GeneratePlanets()
+	if len(planets) != len(expected) {
+		return false
+	}
+	for i := range planets {
+		if planets[i].Suffix != expected[i].Suffix ||
+			planets[i].Type != expected[i].Type ||
+			!coordsApproxEqual(planets[i].OrbitalRadius, expected[i].OrbitalRadius) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// PortMappingLease is how long each UPnP/NAT-PMP mapping lasts; it's renewed at half that
+	PortMappingLease = 2 * time.Hour
+
+	// PortMappingSilence is how long inbound traffic may stop, after we've had some,
+	// before the mapping is assumed lost (router rebooted) and redone from scratch
+	PortMappingSilence = 30 * time.Minute
+)
+
+// portMapping is the DHT's UPnP/NAT-PMP state (see network.go for the gateway side)
+type portMapping struct {
+	nat  *NATTraversal
+	port int // Local DHT port
+
+	mu         sync.Mutex
+	active     bool      // The last mapping or renewal succeeded
+	external   string    // External ip:port the gateway last reported
+	lastMapped time.Time // Last successful mapping or renewal
+	lastRemap  time.Time // Last attempt to map from scratch
+}
+
+// EnablePortMapping asks Start to forward the DHT port through the router with UPnP/NAT-PMP
+// Must be called before Start
+func (dht *DHT) EnablePortMapping(port int) {
+	dht.portMapping = &portMapping{nat: NewNATTraversal(), port: port}
+}
+
+// setupPortMapping makes the initial mapping, advertising the external address it gets
+// Failure leaves the node as it was: manual forwarding, with the inbound warning as a reminder
+func (dht *DHT) setupPortMapping() {
+	pm := dht.portMapping
+	pm.mu.Lock()
+	pm.lastRemap = time.Now()
+	pm.mu.Unlock()
+
+	external, err := pm.nat.Setup(NATConfig{
+		InternalPort:  pm.port,
+		Description:   "Stellar Lab P2P",
+		LeaseDuration: PortMappingLease,
+	})
+	if err != nil {
+		log.Printf("UPnP/NAT-PMP: not available (%v) - ensure port %d is forwarded manually if behind NAT", err, pm.port)
+		return
+	}
+	log.Printf("UPnP/NAT-PMP: port %d forwarded via %s (external: %s)", pm.port, pm.nat.GetProtocol(), external)
+	dht.portMapped(external)
+}
+
+// portMappingLoop renews the lease and redoes the mapping when it's been lost
+func (dht *DHT) portMappingLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskPortMapping, every(PortMappingLease/2))
+	t.scheduleNext(time.Now().Add(PortMappingLease / 2))
+
+	renewTicker := time.NewTicker(PortMappingLease / 2)
+	defer renewTicker.Stop()
+	checkTicker := time.NewTicker(InboundCheckInterval)
+	defer checkTicker.Stop()
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-renewTicker.C:
+			t.scheduleNext(time.Now().Add(PortMappingLease / 2))
+		case <-t.trigger:
+		case <-checkTicker.C:
+			if !dht.portMappingLost() {
+				continue
+			}
+		}
+		t.run(dht.renewPortMapping)
+	}
+}
+
+// renewPortMapping extends the lease, or maps from scratch if the mapping is lost or won't renew
+func (dht *DHT) renewPortMapping() (int, error) {
+	pm := dht.portMapping
+
+	if !dht.portMappingLost() {
+		external, err := pm.nat.Renew()
+		if err == nil {
+			dht.portMapped(external)
+			return 1, nil
+		}
+		log.Printf("UPnP/NAT-PMP: failed to renew port mapping: %v - mapping again", err)
+	}
+
+	pm.mu.Lock()
+	pm.active = false
+	pm.lastRemap = time.Now()
+	pm.mu.Unlock()
+
+	external, err := pm.nat.Remap()
+	if err != nil {
+		log.Printf("UPnP/NAT-PMP: failed to map port %d again: %v", pm.port, err)
+		return 0, err
+	}
+	log.Printf("UPnP/NAT-PMP: port %d mapped again via %s (external: %s)", pm.port, pm.nat.GetProtocol(), external)
+	dht.portMapped(external)
+	return 1, nil
+}
+
+// portMappingLost reports whether the mapping needs redoing from scratch: the last
+// renewal failed, or inbound traffic we used to get has stopped (the router forgot it)
+// Remapping is retried at most once per PortMappingSilence
+func (dht *DHT) portMappingLost() bool {
+	pm := dht.portMapping
+	pm.mu.Lock()
+	active, lastRemap, lastMapped := pm.active, pm.lastRemap, pm.lastMapped
+	pm.mu.Unlock()
+
+	if lastMapped.IsZero() {
+		return false // Never worked: no gateway here, nothing to recover
+	}
+	if time.Since(lastRemap) < PortMappingSilence {
+		return false
+	}
+	if !active {
+		return true
+	}
+
+	dht.inboundMu.RLock()
+	lastInbound := dht.lastInbound
+	dht.inboundMu.RUnlock()
+	return !lastInbound.IsZero() && time.Since(lastInbound) > PortMappingSilence
+}
+
+// portMapped records a successful mapping and advertises the external address if it changed
+func (dht *DHT) portMapped(external string) {
+	pm := dht.portMapping
+	pm.mu.Lock()
+	changed := pm.external != external
+	pm.active = true
+	pm.external = external
+	pm.lastMapped = time.Now()
+	pm.mu.Unlock()
+
+	extIP, extPort, err := net.SplitHostPort(external)
+	if err != nil {
+		return
+	}
+	current := dht.advertisedAddress()
+	host, port, err := net.SplitHostPort(current)
+	if err != nil {
+		return
+	}
+
+	switch ip := net.ParseIP(extIP); {
+	case net.ParseIP(host) == nil:
+		// Advertising a DNS name - that already follows IP changes, only the port can differ
+	case ip == nil || ip.IsPrivate() || isSharedAddress(ip) || ip.IsUnspecified():
+		// Another NAT sits in front of the router - its address is no use to peers
+		if changed {
+			log.Printf("UPnP/NAT-PMP: router's external address %s is not public (double NAT?), keeping %s",
+				extIP, current)
+		}
+	default:
+		host = extIP
+	}
+
+	newAddr := net.JoinHostPort(host, extPort)
+	if newAddr == current {
+		return
+	}
+	if port != extPort {
+		log.Printf("UPnP/NAT-PMP: gateway mapped external port %s instead of %s", extPort, port)
+	}
+	log.Printf("Public address changed: %s -> %s (UPnP/NAT-PMP)", current, newAddr)
+
+	dht.moveAdvertisedAddress(newAddr)
+}
+
+// portMappingStatus describes the mapping for the inbound warning
+func (dht *DHT) portMappingStatus() string {
+	pm := dht.portMapping
+	if pm == nil {
+		return "UPnP/NAT-PMP is disabled (-no-upnp)"
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.active {
+		return "UPnP/NAT-PMP reports port " + strconv.Itoa(pm.port) + " mapped to " + pm.external + " via " + pm.nat.GetProtocol()
+	}
+	if pm.lastMapped.IsZero() {
+		return "UPnP/NAT-PMP found no gateway to map the port with"
+	}
+	return "the UPnP/NAT-PMP mapping was lost and couldn't be redone"
+}
+
+// closePortMapping removes the mapping on shutdown
+func (dht *DHT) closePortMapping() {
+	if dht.portMapping == nil {
+		return
+	}
+	pm := dht.portMapping
+	pm.mu.Lock()
+	mapped := !pm.lastMapped.IsZero()
+	pm.mu.Unlock()
+	if mapped {
+		pm.nat.Close()
+	}
+}
+
+// isSharedAddress reports whether ip is in the carrier-grade NAT range (100.64.0.0/10)
+func isSharedAddress(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64
+}
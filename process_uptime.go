@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Each node puts the time its process started in its own info, so peers can show how long
+// it has been up, and counts its restarts, so a crash-looping service that keeps resetting
+// its longevity streak stands out. Both are for display: the start time isn't signed or
+// relayed, and nothing in credits or liveness reads either of them
+
+// ProcessInfo is how long the local process has been running and how often it restarted
+type ProcessInfo struct {
+	StartTime    int64  `json:"process_start_time"` // Unix
+	Uptime       string `json:"process_uptime"`     // e.g. "3d 4h"
+	RestartCount int64  `json:"restart_count"`      // Starts of this system after its first
+}
+
+// SetRestartCount sets how many times this system was started before (call before Start)
+func (dht *DHT) SetRestartCount(n int64) {
+	dht.restartCount = n
+}
+
+// GetProcessInfo returns the local process' start time, uptime and restart count
+func (dht *DHT) GetProcessInfo() ProcessInfo {
+	start := dht.localSystem.ProcessStartTime
+	return ProcessInfo{
+		StartTime:    start,
+		Uptime:       formatProcessUptime(start, time.Now()),
+		RestartCount: dht.restartCount,
+	}
+}
+
+// formatProcessUptime formats the time since start as "3d 4h", "4h 12m" or "12m"
+// ("" for no start time). A start ahead of now, from a peer's fast clock, counts as just started
+func formatProcessUptime(start int64, now time.Time) string {
+	if start <= 0 {
+		return ""
+	}
+	d := now.Sub(time.Unix(start, 0))
+	if d < 0 {
+		d = 0
+	}
+	days := int(d / (24 * time.Hour))
+	hours := int(d % (24 * time.Hour) / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
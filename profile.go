@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// An operator can attach a profile to their system: a handle, a short bio and a link, set
+// with -operator-handle, -operator-bio and -operator-url. Like a genesis' demotion record
+// it's signed on its own and travels with the system's info, so peers from before it relay
+// the info untouched and only leave the profile out. The record carries the InfoVersion it
+// was signed at: a newer one replaces the cached one, and info relayed without any keeps
+// what's cached. Taking every profile flag away signs an empty record, which clears it.
+
+const (
+	// MaxProfileHandleLength is the longest operator handle, in bytes
+	MaxProfileHandleLength = 32
+
+	// MaxProfileBioLength is the longest operator bio, in bytes
+	MaxProfileBioLength = 256
+
+	// MaxProfileURLLength is the longest operator URL, in bytes
+	MaxProfileURLLength = 200
+)
+
+// OperatorProfile is a system owner's signed description of themselves
+// A record with no handle, bio or URL clears an earlier one
+type OperatorProfile struct {
+	SystemID  uuid.UUID `json:"system_id"`
+	Handle    string    `json:"handle,omitempty"` // Shown as "operated by @handle"
+	Bio       string    `json:"bio,omitempty"`
+	URL       string    `json:"url,omitempty"`     // http or https only
+	Private   bool      `json:"private,omitempty"` // Left out of public-mode web UIs
+	Version   int64     `json:"version"`           // The InfoVersion it was signed at
+	Signature string    `json:"signature"`
+}
+
+// IsEmpty reports whether the record clears the profile rather than setting one
+func (p *OperatorProfile) IsEmpty() bool {
+	return p.Handle == "" && p.Bio == "" && p.URL == ""
+}
+
+// signableMessage is what the owner signs
+func (p *OperatorProfile) signableMessage() []byte {
+	data, _ := json.Marshal(struct {
+		Type     string `json:"type"`
+		SystemID string `json:"system_id"`
+		Handle   string `json:"handle"`
+		Bio      string `json:"bio"`
+		URL      string `json:"url"`
+		Private  bool   `json:"private"`
+		Version  int64  `json:"version"`
+	}{"operator_profile", p.SystemID.String(), p.Handle, p.Bio, p.URL, p.Private, p.Version})
+	return data
+}
+
+// Verify checks the record was signed with publicKey (base64)
+func (p *OperatorProfile) Verify(publicKey string) bool {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pubKeyBytes) != ed25519.PublicKeySize {
+		return false
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(p.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pubKeyBytes, p.signableMessage(), sigBytes)
+}
+
+// CheckOperatorProfile reports every reason a profile's fields are unsafe to cache or
+// display, or nil. The handle and bio follow the rules for system names (the handle
+// without spaces), and the URL must be an absolute http or https link
+func CheckOperatorProfile(p *OperatorProfile) error {
+	var errs []error
+	if err := checkDisplayText(p.Handle, MaxProfileHandleLength); err != nil {
+		errs = append(errs, fmt.Errorf("handle %w", err))
+	} else if strings.IndexFunc(p.Handle, unicode.IsSpace) >= 0 {
+		errs = append(errs, errors.New("handle contains whitespace"))
+	}
+	if err := checkDisplayText(p.Bio, MaxProfileBioLength); err != nil {
+		errs = append(errs, fmt.Errorf("bio %w", err))
+	}
+	if err := checkProfileURL(p.URL); err != nil {
+		errs = append(errs, fmt.Errorf("url %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// checkProfileURL reports why a profile link is unsafe to show as a link, or nil
+func checkProfileURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if len(raw) > MaxProfileURLLength {
+		return fmt.Errorf("longer than %d bytes", MaxProfileURLLength)
+	}
+	for _, r := range raw {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("<>\"'\\`", r) {
+			return fmt.Errorf("contains %q", r)
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return errors.New("isn't a valid URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("must start with http:// or https://")
+	}
+	if u.Host == "" {
+		return errors.New("has no host")
+	}
+	return nil
+}
+
+// NewOperatorProfile cleans up the profile flags: surrounding whitespace and quotes
+// trimmed like names, and a leading @ dropped from the handle
+func NewOperatorProfile(handle, bio, link string, private bool) *OperatorProfile {
+	return &OperatorProfile{
+		Handle:  strings.TrimPrefix(sanitizeStarName(handle), "@"),
+		Bio:     sanitizeStarName(bio),
+		URL:     sanitizeStarName(link),
+		Private: private,
+	}
+}
+
+// SetOperatorProfile signs configured as the local system's profile at its current
+// InfoVersion (call after BumpInfoVersion). An empty one only clears a profile the
+// system had; one that never had any keeps sending none
+func (s *System) SetOperatorProfile(configured *OperatorProfile) error {
+	if err := CheckOperatorProfile(configured); err != nil {
+		return err
+	}
+	if configured.IsEmpty() && s.Profile == nil {
+		return nil
+	}
+
+	p := *configured
+	if p.IsEmpty() {
+		p.Private = false
+	}
+	p.SystemID = s.ID
+	p.Version = s.InfoVersion
+	if s.Keys != nil {
+		p.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.Keys.PrivateKey, p.signableMessage()))
+	}
+	s.Profile = &p
+	return nil
+}
+
+// visibleProfile returns sys as a public-mode web UI may show it: without its profile
+// if the operator marked it private
+func visibleProfile(sys *System, public bool) *System {
+	if !public || sys == nil || sys.Profile == nil || !sys.Profile.Private {
+		return sys
+	}
+	hidden := *sys
+	hidden.Profile = nil
+	return &hidden
+}
+
+// checkProfile vets a cached system's new info for its operator profile
+// A record that isn't the system's own, fails sanitization or doesn't verify against the
+// bound key is dropped. A cached record carries over to info relayed without one or with
+// an older one. Returns the info to cache
+// Callers hold cacheMu
+func (rt *RoutingTable) checkProfile(sys *System, existing *CachedSystem) *System {
+	if p := sys.Profile; p != nil {
+		valid := p.SystemID == sys.ID && CheckOperatorProfile(p) == nil
+		if valid && rt.storage != nil {
+			if publicKey, err := rt.storage.GetIdentityBinding(sys.ID); err == nil && publicKey != "" {
+				valid = p.Verify(publicKey)
+			}
+		}
+		if !valid {
+			log.Printf("Dropped invalid operator profile of %s", sys.ID.String()[:8])
+			stripped := *sys
+			stripped.Profile = nil
+			sys = &stripped
+		}
+	}
+	if existing == nil || existing.System.Profile == nil {
+		return sys
+	}
+
+	if sys.Profile == nil || sys.Profile.Version < existing.System.Profile.Version {
+		withProfile := *sys
+		withProfile.Profile = existing.System.Profile
+		sys = &withProfile
+	}
+	return sys
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Rejection classes: what a peer answering a request with a protocol error means for us
+const (
+	RejectionTransient = "transient" // Rate limited or the peer's own trouble: retried with backoff
+	RejectionPermanent = "permanent" // Incompatible version or blocked: the peer isn't contacted again for a day
+	RejectionSelf      = "self"      // Our coordinates, identity or clock refused: likely our node's fault
+)
+
+const (
+	// RejectionBackoffBase is how long a peer is left alone after its first transient
+	// rejection; each further one doubles it, up to RejectionBackoffMax
+	RejectionBackoffBase = 30 * time.Second
+	RejectionBackoffMax  = 30 * time.Minute
+
+	// PermanentRejectionRecheck is when a peer that refused us for good is tried again
+	// (it may have upgraded or unblocked us)
+	PermanentRejectionRecheck = 24 * time.Hour
+
+	// SelfRejectionQuorum is how many distinct peers must refuse our own info within
+	// SelfRejectionWindow before we warn that this node is misconfigured
+	SelfRejectionQuorum = 2
+	SelfRejectionWindow = time.Hour
+)
+
+// selfRejectionReasons are the error messages (see handleDHTMessage and Validate) that
+// say something is wrong with the sender rather than the request
+var selfRejectionReasons = []string{
+	"coordinates invalid",
+	"star system configuration invalid",
+	"identity mismatch",
+	"invalid system info",
+	"invalid attestation signature",
+	"attestation timestamp",
+}
+
+// classifyRejection returns the class of a peer's protocol error, or "" for one that
+// only refuses this request (a duplicate transfer, say)
+func classifyRejection(e *DHTError) string {
+	switch e.Code {
+	case ErrCodeRateLimited, ErrCodeInternalError:
+		return RejectionTransient
+	case ErrCodeIncompatibleVersion, ErrCodeBlocked:
+		return RejectionPermanent
+	case ErrCodeInvalidMessage, ErrCodeInvalidAttestation:
+		for _, reason := range selfRejectionReasons {
+			if strings.Contains(e.Message, reason) {
+				return RejectionSelf
+			}
+		}
+	}
+	return ""
+}
+
+// PeerRejection is the last protocol error a peer answered us with
+type PeerRejection struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Class   string `json:"class"`
+	At      int64  `json:"at"`
+	RetryAt int64  `json:"retry_at,omitempty"` // Not contacted before then (0 once it has answered us since)
+	Count   int    `json:"-"`                  // Rejections in a row, for the backoff
+}
+
+// holding reports whether the peer is still being left alone
+func (r *PeerRejection) holding(now time.Time) bool {
+	return r.RetryAt > now.Unix()
+}
+
+// rejectionHoldOff is how long a peer is left alone after its count-th rejection in a row
+func rejectionHoldOff(class string, count int) time.Duration {
+	if class == RejectionPermanent {
+		return PermanentRejectionRecheck
+	}
+	d := RejectionBackoffBase
+	for i := 1; i < count && d < RejectionBackoffMax; i++ {
+		d *= 2
+	}
+	if d > RejectionBackoffMax {
+		d = RejectionBackoffMax
+	}
+	return d
+}
+
+// PeerRejectionError is a protocol error a peer answered a request with, or (Held) the
+// last one, for a request not sent because the peer is being left alone
+type PeerRejectionError struct {
+	PeerID    uuid.UUID
+	Rejection PeerRejection
+	Held      bool
+	err       *DHTError
+}
+
+func (e *PeerRejectionError) Error() string {
+	if e.Held {
+		return fmt.Sprintf("not contacting %s until %s (it refused us: %s)", e.PeerID.String()[:8],
+			time.Unix(e.Rejection.RetryAt, 0).Format("15:04:05"), e.Rejection.Reason)
+	}
+	return e.err.Message
+}
+
+// Unwrap lets callers check the peer's DHTError code
+func (e *PeerRejectionError) Unwrap() error {
+	return e.err
+}
+
+// isPeerRejection reports whether err is a peer refusing us: it answered, so it's alive
+func isPeerRejection(err error) bool {
+	var rejection *PeerRejectionError
+	return errors.As(err, &rejection)
+}
+
+// SelfRejectionWarning says several peers refused our own info (/api/status and the dashboard)
+type SelfRejectionWarning struct {
+	Peers  int    `json:"peers"`
+	Reason string `json:"reason"` // The latest one
+}
+
+// RecordRejection notes a peer's rejection and how long to leave it alone
+func (rt *RoutingTable) RecordRejection(id uuid.UUID, e *DHTError, class string, now time.Time) (PeerRejection, bool) {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	cached, ok := rt.systemCache[id]
+	if !ok {
+		return PeerRejection{}, false
+	}
+	count := 1
+	if prev := cached.Rejection; prev != nil && prev.Class == class && prev.RetryAt != 0 {
+		count = prev.Count + 1
+	}
+	cached.Rejection = &PeerRejection{
+		Code:    e.Code,
+		Reason:  e.Message,
+		Class:   class,
+		At:      now.Unix(),
+		RetryAt: now.Add(rejectionHoldOff(class, count)).Unix(),
+		Count:   count,
+	}
+	return *cached.Rejection, true
+}
+
+// restoreRejection rebuilds a peer's saved rejection after a restart, still holding off
+// unless the peer has accepted us since
+func restoreRejection(meta *PeerSystemWithMeta) *PeerRejection {
+	if meta.RejectionCode == 0 {
+		return nil
+	}
+	e := &DHTError{Code: meta.RejectionCode, Message: meta.RejectionReason}
+	r := &PeerRejection{Code: e.Code, Reason: e.Message, Class: classifyRejection(e), At: meta.RejectedAt}
+	if r.Class != "" && meta.LastVerified < meta.RejectedAt {
+		r.Count = 1
+		r.RetryAt = time.Unix(meta.RejectedAt, 0).Add(rejectionHoldOff(r.Class, 1)).Unix()
+	}
+	return r
+}
+
+// rejectionHold returns the peer's rejection while it's being left alone
+func (rt *RoutingTable) rejectionHold(id uuid.UUID) (PeerRejection, bool) {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	cached, ok := rt.systemCache[id]
+	if !ok || cached.Rejection == nil || !cached.Rejection.holding(time.Now()) {
+		return PeerRejection{}, false
+	}
+	return *cached.Rejection, true
+}
+
+// GetRejection returns the last rejection a peer answered us with, if any
+func (rt *RoutingTable) GetRejection(id uuid.UUID) *PeerRejection {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	if cached, ok := rt.systemCache[id]; ok && cached.Rejection != nil {
+		r := *cached.Rejection
+		return &r
+	}
+	return nil
+}
+
+// GetSelfRejectionWarning returns a warning when SelfRejectionQuorum peers have refused
+// our own info within SelfRejectionWindow and haven't accepted us since
+func (rt *RoutingTable) GetSelfRejectionWarning() *SelfRejectionWarning {
+	cutoff := time.Now().Add(-SelfRejectionWindow).Unix()
+	var w SelfRejectionWarning
+	var latest int64
+	rt.cacheMu.RLock()
+	for _, cached := range rt.systemCache {
+		r := cached.Rejection
+		if r == nil || r.Class != RejectionSelf || r.RetryAt == 0 || r.At < cutoff {
+			continue
+		}
+		w.Peers++
+		if r.At >= latest {
+			latest, w.Reason = r.At, r.Reason
+		}
+	}
+	rt.cacheMu.RUnlock()
+	if w.Peers < SelfRejectionQuorum {
+		return nil
+	}
+	return &w
+}
+
+// checkRejectionHold stops a request to a peer that's being left alone
+func (dht *DHT) checkRejectionHold(id uuid.UUID) error {
+	if id == uuid.Nil {
+		return nil
+	}
+	if r, held := dht.routingTable.rejectionHold(id); held {
+		return &PeerRejectionError{PeerID: id, Rejection: r, Held: true, err: &DHTError{Code: r.Code, Message: r.Reason}}
+	}
+	return nil
+}
+
+// recordRejection handles a protocol error a peer answered our request with, returning
+// the error for the caller. Anything but a one-off refusal leaves the peer alone for a
+// while, and a refusal of our own info counts towards the misconfiguration warning
+func (dht *DHT) recordRejection(id uuid.UUID, e *DHTError) error {
+	class := classifyRejection(e)
+	if id == uuid.Nil || class == "" {
+		return e
+	}
+	now := time.Now()
+	r, ok := dht.routingTable.RecordRejection(id, e, class, now)
+	if !ok {
+		return e
+	}
+	if err := dht.storage.SetPeerRejection(id, e.Code, e.Message, now); err != nil {
+		log.Printf("Failed to save rejection by %s: %v", id.String()[:8], err)
+	}
+
+	name := id.String()[:8]
+	if sys := dht.routingTable.GetCachedSystem(id); sys != nil {
+		name = sys.Name
+	}
+	until := time.Unix(r.RetryAt, 0).Sub(now).Round(time.Second)
+	switch class {
+	case RejectionTransient:
+		log.Printf("%s refused our request (%s), retrying in %v", name, e.Message, until)
+	case RejectionPermanent:
+		log.Printf("%s refuses to talk to us (%s), not contacting it for %v", name, e.Message, until)
+		dht.diagnose(DiagRejection, false, "%s: %s", name, e.Message)
+	case RejectionSelf:
+		log.Printf("%s rejected our own system info (%s), retrying in %v", name, e.Message, until)
+		dht.diagnose(DiagSelfRejection, false, "%s: %s", name, e.Message)
+		if w := dht.routingTable.GetSelfRejectionWarning(); w != nil && w.Peers == SelfRejectionQuorum {
+			log.Printf("⚠ WARNING: %d peers rejected this node's own info (latest: %s). This node is probably misconfigured: check its clock, database and identity", w.Peers, w.Reason)
+		}
+	}
+	return &PeerRejectionError{PeerID: id, Rejection: r, err: e}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// RenameCooldown is the minimum time between renames of a system
+// Enforced locally for our own name, and by peers for names they cache
+const RenameCooldown = 1 * time.Hour
+
+// ErrRenameTooSoon is returned when the local system was renamed within RenameCooldown
+var ErrRenameTooSoon = errors.New("system was renamed less than an hour ago")
+
+// RenameRequest is the PUT /api/system/name body
+type RenameRequest struct {
+	Name string `json:"name"`
+}
+
+// RenameSystem changes the local system's name and announces it to every routing table peer
+// Peers pick it up through the normal InfoVersion path when caching our info
+func (dht *DHT) RenameSystem(name string) error {
+	name = sanitizeStarName(name)
+	if name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := validateStarName(name); err != nil {
+		return err
+	}
+
+	dht.renameMu.Lock()
+	defer dht.renameMu.Unlock()
+
+	oldName := dht.localSystem.Name
+	if name == oldName {
+		return fmt.Errorf("system is already named %q", name)
+	}
+	if !dht.lastRename.IsZero() && time.Since(dht.lastRename) < RenameCooldown {
+		wait := RenameCooldown - time.Since(dht.lastRename)
+		return fmt.Errorf("%w (try again in %s)", ErrRenameTooSoon, wait.Round(time.Minute))
+	}
+
+	// Sign and save a copy first so a failed write leaves the live system untouched
+	// localMu keeps a concurrent address move from signing over the old name
+	dht.localMu.Lock()
+	updated := *dht.localSystem
+	updated.Name = name
+	updated.BumpInfoVersion()
+	if err := dht.storage.SaveSystem(&updated); err != nil {
+		dht.localMu.Unlock()
+		return fmt.Errorf("failed to save new name: %w", err)
+	}
+
+	dht.localSystem.Name = updated.Name
+	dht.localSystem.InfoVersion = updated.InfoVersion
+	dht.localSystem.InfoSignature = updated.InfoSignature
+	dht.localMu.Unlock()
+	dht.lastRename = time.Now()
+
+	log.Printf("Renamed star system: %s -> %s", oldName, name)
+	dht.emit(Event{Type: EventLocalSystemChanged, SystemID: dht.localSystem.ID.String(), System: dht.GetLocalSystem()})
+
+	dht.announceInfoChange()
+	return nil
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tables with retention limits, as named by -retention and /api/stats
+const (
+	RetainAttestations      = "attestations"
+	RetainCreditEarnings    = "credit_earnings"
+	RetainCreditTransfers   = "credit_transfers"
+	RetainGalaxySnapshots   = "galaxy_snapshots"
+	RetainPeerConnections   = "peer_connections"
+	RetainPeerSystems       = "peer_systems"
+	RetainPeerTraffic       = "peer_traffic"
+	RetainVerifiedTransfers = "verified_transfers"
+)
+
+const (
+	// TransferLookbackWindow is how long a verified transfer is kept whatever the limits:
+	// a sender's earlier transfers are what its next one is checked against for double spends
+	TransferLookbackWindow = 90 * 24 * time.Hour
+
+	// RetentionPeerGuard keeps systems verified this recently out of reach of the
+	// peer_systems row cap; routing table peers are pinged far more often than that
+	RetentionPeerGuard = time.Hour
+
+	// RetentionSizeRefresh is how long the table sizes in /api/stats are reused
+	RetentionSizeRefresh = time.Minute
+)
+
+// RetentionLimit caps one table; zero means no cap
+type RetentionLimit struct {
+	MaxRows int64
+	MaxAge  time.Duration
+}
+
+// DefaultRetentionLimits keep a node on a small disk going indefinitely; a busy galaxy
+// reaches them long before anything the node still needs does
+var DefaultRetentionLimits = map[string]RetentionLimit{
+	RetainAttestations:      {}, // Compaction keeps them in check
+	RetainCreditEarnings:    {MaxAge: 2 * 365 * 24 * time.Hour},
+	RetainCreditTransfers:   {MaxRows: 10000},
+	RetainGalaxySnapshots:   {MaxRows: 5000, MaxAge: 365 * 24 * time.Hour},
+	RetainPeerConnections:   {MaxRows: 100000, MaxAge: CacheMaxAge},
+	RetainPeerSystems:       {MaxRows: 20000, MaxAge: CacheMaxAge},
+	RetainPeerTraffic:       {MaxRows: 100000, MaxAge: PeerTrafficWindow},
+	RetainVerifiedTransfers: {MaxRows: 100000, MaxAge: 365 * 24 * time.Hour},
+}
+
+// retentionGuards say what a table's guardrail keeps, whatever the limits
+var retentionGuards = map[string]string{
+	RetainAttestations:      "attestations since the last credit calculation, and each day's first and last",
+	RetainCreditTransfers:   "transfers still pending delivery",
+	RetainGalaxySnapshots:   "the latest snapshot",
+	RetainPeerSystems:       "systems verified in the last hour",
+	RetainVerifiedTransfers: "transfers verified in the last 90 days",
+}
+
+// ParseRetentionSpec parses -retention: comma-separated "table:max_rows:max_age" entries
+// ("peer_connections:50000:48h", "galaxy_snapshots::90d"). An empty field keeps the
+// default and 0 lifts the limit. Returns the defaults with the entries applied
+func ParseRetentionSpec(spec string) (map[string]RetentionLimit, error) {
+	limits := make(map[string]RetentionLimit, len(DefaultRetentionLimits))
+	for table, limit := range DefaultRetentionLimits {
+		limits[table] = limit
+	}
+	if strings.TrimSpace(spec) == "" {
+		return limits, nil
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		limit, ok := limits[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown table %q (one of %s)", parts[0], strings.Join(retentionTables(), ", "))
+		}
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid entry %q (expected \"table:max_rows:max_age\")", entry)
+		}
+		if parts[1] != "" {
+			rows, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil || rows < 0 {
+				return nil, fmt.Errorf("invalid row limit %q for %s", parts[1], parts[0])
+			}
+			limit.MaxRows = rows
+		}
+		if len(parts) == 3 && parts[2] != "" {
+			if parts[0] == RetainAttestations {
+				return nil, fmt.Errorf("attestations are aged by compaction (-compact-keep-days), not by an age limit")
+			}
+			age, err := parseRetentionAge(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid age limit %q for %s", parts[2], parts[0])
+			}
+			limit.MaxAge = age
+		}
+		limits[parts[0]] = limit
+	}
+	return limits, nil
+}
+
+// parseRetentionAge accepts Go durations plus whole days ("90d"); "0" lifts the limit
+func parseRetentionAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	if s == "0" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// retentionTables lists the tables with limits, by name
+func retentionTables() []string {
+	tables := make([]string, 0, len(DefaultRetentionLimits))
+	for table := range DefaultRetentionLimits {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// TableRetention is one table's size, limits and last trim (/api/stats)
+type TableRetention struct {
+	Table         string `json:"table"`
+	Rows          int64  `json:"rows"`
+	MaxRows       int64  `json:"max_rows,omitempty"`
+	MaxAgeSeconds int64  `json:"max_age_seconds,omitempty"`
+	LastTrimAt    int64  `json:"last_trim_at,omitempty"`
+	LastRemoved   int64  `json:"last_removed"`
+	HeldBack      int64  `json:"held_back,omitempty"` // Rows past a limit the guard kept at the last trim
+	Guard         string `json:"guard,omitempty"`
+}
+
+// RetentionStats is the "retention" section of /api/stats
+type RetentionStats struct {
+	LastRun int64            `json:"last_run,omitempty"` // Last trim of every table
+	Tables  []TableRetention `json:"tables"`
+}
+
+// retention holds the table limits and what the last trims did
+type retention struct {
+	mu      sync.Mutex
+	limits  map[string]RetentionLimit
+	tables  map[string]*TableRetention
+	sizedAt time.Time
+	lastRun time.Time
+}
+
+func newRetention() *retention {
+	limits, _ := ParseRetentionSpec("")
+	r := &retention{limits: limits, tables: make(map[string]*TableRetention)}
+	for table := range limits {
+		r.tables[table] = &TableRetention{Table: table, Guard: retentionGuards[table]}
+	}
+	return r
+}
+
+// SetRetentionLimits replaces the table limits (-retention)
+// Must be called before Start
+func (dht *DHT) SetRetentionLimits(limits map[string]RetentionLimit) {
+	dht.retention.mu.Lock()
+	dht.retention.limits = limits
+	dht.retention.mu.Unlock()
+
+	var changed []string
+	for _, table := range retentionTables() {
+		if limits[table] != DefaultRetentionLimits[table] {
+			changed = append(changed, fmt.Sprintf("%s %s", table, describeLimit(limits[table])))
+		}
+	}
+	if len(changed) > 0 {
+		log.Printf("Retention limits: %s", strings.Join(changed, ", "))
+	}
+}
+
+// describeLimit formats a limit for logs
+func describeLimit(limit RetentionLimit) string {
+	var parts []string
+	if limit.MaxRows > 0 {
+		parts = append(parts, fmt.Sprintf("%d rows", limit.MaxRows))
+	}
+	switch {
+	case limit.MaxAge > 0 && limit.MaxAge%(24*time.Hour) == 0:
+		parts = append(parts, fmt.Sprintf("%dd", limit.MaxAge/(24*time.Hour)))
+	case limit.MaxAge > 0:
+		parts = append(parts, limit.MaxAge.String())
+	}
+	if len(parts) == 0 {
+		return "unlimited"
+	}
+	return strings.Join(parts, " / ")
+}
+
+// trimTables enforces the limits of the given tables (all of them if none are given)
+// Returns how many rows were removed, and the tables that failed
+func (dht *DHT) trimTables(tables ...string) (int, error) {
+	all := len(tables) == 0
+	if all {
+		tables = retentionTables()
+	}
+	dht.retention.mu.Lock()
+	limits := dht.retention.limits
+	dht.retention.mu.Unlock()
+
+	var total int64
+	var errs []error
+	now := time.Now()
+	for _, table := range tables {
+		limit := limits[table]
+		removed, held, err := dht.trimTable(table, limit, now)
+		if err != nil {
+			log.Printf("Retention: trimming %s failed: %v", table, err)
+			errs = append(errs, fmt.Errorf("trimming %s: %w", table, err))
+			continue
+		}
+		total += removed
+
+		dht.retention.mu.Lock()
+		stats := dht.retention.tables[table]
+		wasHeld := stats.HeldBack
+		stats.LastTrimAt, stats.LastRemoved, stats.HeldBack = now.Unix(), removed, held
+		dht.retention.mu.Unlock()
+
+		if removed > 0 {
+			log.Printf("Retention: removed %d rows from %s (limit %s)", removed, table, describeLimit(limit))
+		}
+		if held > 0 && wasHeld == 0 {
+			log.Printf("Retention: kept %d rows of %s past its limit (guarding %s)", held, table, stats.Guard)
+		}
+	}
+
+	dht.retention.mu.Lock()
+	if all && len(errs) == 0 {
+		dht.retention.lastRun = now
+	}
+	if total > 0 {
+		dht.retention.sizedAt = time.Time{}
+	}
+	dht.retention.mu.Unlock()
+	return int(total), errors.Join(errs...)
+}
+
+// trimTable enforces one table's limit, returning the rows removed and how many its guard
+// kept past the limit
+func (dht *DHT) trimTable(table string, limit RetentionLimit, now time.Time) (removed, held int64, err error) {
+	var cutoff int64 // 0: no age limit
+	if limit.MaxAge > 0 {
+		cutoff = now.Add(-limit.MaxAge).Unix()
+	}
+
+	switch table {
+	case RetainAttestations:
+		// The next credit calculation reads everything since the last one
+		balance, err := dht.storage.GetCreditBalance(dht.localSystem.ID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := dht.FlushAttestations(); err != nil {
+			return 0, 0, err
+		}
+		return dht.storage.TrimAttestations(limit.MaxRows, balance.LastUpdated)
+
+	case RetainPeerSystems:
+		if limit.MaxAge > 0 {
+			if removed, err = dht.storage.PrunePeerSystems(limit.MaxAge); err != nil {
+				return 0, 0, err
+			}
+		}
+		ids, held, err := dht.storage.TrimPeerSystems(limit.MaxRows, now.Add(-RetentionPeerGuard).Unix())
+		if err != nil {
+			return removed, 0, err
+		}
+		for _, id := range ids {
+			dht.routingTable.RemoveFromCache(id)
+		}
+		return removed + int64(len(ids)), held, nil
+
+	case RetainPeerConnections:
+		removed, err := dht.storage.TrimPeerConnections(limit.MaxRows, cutoff)
+		return removed, 0, err
+
+	case RetainGalaxySnapshots:
+		removed, err := dht.storage.TrimGalaxySnapshots(limit.MaxRows, cutoff)
+		return removed, 0, err
+
+	case RetainVerifiedTransfers:
+		floor := now.Add(-TransferLookbackWindow).Unix()
+		return dht.storage.TrimOldest(table, "verified_at", limit.MaxRows, cutoff, floor)
+
+	case RetainCreditTransfers:
+		// Pending transfers sort past the floor: they are still debited and being retried
+		column := fmt.Sprintf("(CASE status WHEN '%s' THEN %d ELSE created_at END)", TransferPending, int64(math.MaxInt64))
+		return dht.storage.TrimOldest(table, column, limit.MaxRows, cutoff, math.MaxInt64)
+
+	case RetainPeerTraffic:
+		return dht.storage.TrimOldest(table, "hour", limit.MaxRows, cutoff, math.MaxInt64)
+
+	case RetainCreditEarnings:
+		return dht.storage.TrimOldest(table, "calculated_at", limit.MaxRows, cutoff, math.MaxInt64)
+	}
+	return 0, 0, fmt.Errorf("no retention for table %q", table)
+}
+
+// RetentionStats returns each table's size and limits and what the last trims did
+// Sizes are counted at most once per RetentionSizeRefresh
+func (dht *DHT) RetentionStats() *RetentionStats {
+	r := dht.retention
+	r.mu.Lock()
+	stale := time.Since(r.sizedAt) > RetentionSizeRefresh
+	r.mu.Unlock()
+
+	if stale {
+		sizes := make(map[string]int64)
+		for _, table := range retentionTables() {
+			if n, err := dht.storage.CountRows(table); err == nil {
+				sizes[table] = n
+			}
+		}
+		r.mu.Lock()
+		for table, n := range sizes {
+			r.tables[table].Rows = n
+		}
+		r.sizedAt = time.Now()
+		r.mu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := &RetentionStats{Tables: make([]TableRetention, 0, len(r.tables))}
+	if !r.lastRun.IsZero() {
+		stats.LastRun = r.lastRun.Unix()
+	}
+	for _, table := range retentionTables() {
+		t := *r.tables[table]
+		t.MaxRows = r.limits[table].MaxRows
+		t.MaxAgeSeconds = int64(r.limits[table].MaxAge / time.Second)
+		stats.Tables = append(stats.Tables, t)
+	}
+	return stats
+}
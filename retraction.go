@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Dead node retraction: a node that evicts a peer after MaxFailCount failed pings tells its
+// own peers with a signed peer_unreachable claim. One claim proves nothing (the claimer may
+// be lying, or just cut off), so receivers only demote the target to stale - out of the
+// routing table, find_node and full-sync - once RetractionQuorum distinct systems claim it
+// within RetractionWindow. Any direct contact with the target clears every claim about it.
+const (
+	// RetractionQuorum is how many distinct claimers it takes to demote a system
+	RetractionQuorum = 3
+
+	// RetractionWindow is how long a claim counts
+	RetractionWindow = 2 * time.Hour
+
+	// MaxRetractionHops caps how far a claim travels: the claimer's peers and theirs
+	MaxRetractionHops = 2
+)
+
+// UnreachableClaim is a signed statement that ClaimerID failed to reach TargetID
+type UnreachableClaim struct {
+	TargetID  uuid.UUID `json:"target_id"`
+	ClaimerID uuid.UUID `json:"claimer_id"`
+	PublicKey string    `json:"public_key"` // Claimer's, base64
+	Attempts  []int64   `json:"attempts"`   // Unix times of the failed pings
+	Timestamp int64     `json:"timestamp"`
+	Signature string    `json:"signature"`
+}
+
+// signableMessage returns the canonical statement the claimer signs
+func (c *UnreachableClaim) signableMessage() []byte {
+	msg := struct {
+		TargetID  string  `json:"target_id"`
+		ClaimerID string  `json:"claimer_id"`
+		Attempts  []int64 `json:"attempts"`
+		Timestamp int64   `json:"timestamp"`
+	}{
+		TargetID:  c.TargetID.String(),
+		ClaimerID: c.ClaimerID.String(),
+		Attempts:  c.Attempts,
+		Timestamp: c.Timestamp,
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// NewUnreachableClaim creates a claim that claimer failed to reach target at the given times
+func NewUnreachableClaim(claimer *System, target uuid.UUID, attempts []time.Time) (*UnreachableClaim, error) {
+	if claimer.Keys == nil {
+		return nil, ErrNoKeys
+	}
+
+	c := &UnreachableClaim{
+		TargetID:  target,
+		ClaimerID: claimer.ID,
+		PublicKey: base64.StdEncoding.EncodeToString(claimer.Keys.PublicKey),
+		Timestamp: time.Now().Unix(),
+	}
+	for _, at := range attempts {
+		c.Attempts = append(c.Attempts, at.Unix())
+	}
+	c.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(claimer.Keys.PrivateKey, c.signableMessage()))
+	return c, nil
+}
+
+// Verify checks the claimer's signature (not that the key is the one bound to ClaimerID)
+func (c *UnreachableClaim) Verify() bool {
+	pub, err := base64.StdEncoding.DecodeString(c.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, c.signableMessage(), sig)
+}
+
+// === Receiving claims ===
+
+// suspicions holds the claims counted against cached systems
+// Locked inside cacheMu, never the other way around
+type suspicions struct {
+	mu     sync.Mutex
+	claims map[uuid.UUID]map[uuid.UUID]time.Time // Target -> claimer -> when claimed
+}
+
+func newSuspicions() *suspicions {
+	return &suspicions{claims: make(map[uuid.UUID]map[uuid.UUID]time.Time)}
+}
+
+// count returns how many claims against target still count: made within RetractionWindow
+// and after our own last contact with it (caller holds s.mu)
+func (s *suspicions) count(target uuid.UUID, lastVerified time.Time) int {
+	cutoff := time.Now().Add(-RetractionWindow)
+	n := 0
+	for _, at := range s.claims[target] {
+		if at.After(cutoff) && at.After(lastVerified) {
+			n++
+		}
+	}
+	return n
+}
+
+// AddSuspicion counts a claim against a cached system
+// Returns whether it was news (not a repeat from the same claimer) and whether it just
+// brought the system to RetractionQuorum
+func (rt *RoutingTable) AddSuspicion(target, claimer uuid.UUID, claimedAt time.Time) (isNew, retracted bool) {
+	cutoff := time.Now().Add(-VerificationCutoff)
+	var events []Event
+
+	rt.cacheMu.Lock()
+	cached, ok := rt.systemCache[target]
+	// Claims about systems we don't know, or that predate our own last contact, are moot
+	if !ok || !claimedAt.After(cached.LastVerified) {
+		rt.cacheMu.Unlock()
+		return false, false
+	}
+
+	rt.suspicions.mu.Lock()
+	byClaimer := rt.suspicions.claims[target]
+	if byClaimer == nil {
+		byClaimer = make(map[uuid.UUID]time.Time)
+		rt.suspicions.claims[target] = byClaimer
+	}
+	if prev, seen := byClaimer[claimer]; !seen || claimedAt.After(prev) {
+		byClaimer[claimer] = claimedAt
+		isNew = !seen
+	}
+	count := rt.suspicions.count(target, cached.LastVerified)
+	rt.suspicions.mu.Unlock()
+
+	if count >= RetractionQuorum && !cached.Retracted {
+		before := cachedPeerStatus(cached, cutoff)
+		cached.Retracted = true
+		cached.settle(time.Now(), cutoff)
+		retracted = true
+		events = transitionEvents(cached, before, cachedPeerStatus(cached, cutoff))
+	}
+	rt.cacheMu.Unlock()
+
+	rt.emit(events...)
+	return isNew, retracted
+}
+
+// clearSuspicion forgets the claims against a system we just heard from directly
+// Returns whether there were any, so the caller can drop them from storage after
+// releasing cacheMu (caller holds cacheMu)
+func (rt *RoutingTable) clearSuspicion(cached *CachedSystem) bool {
+	cached.Retracted = false
+
+	rt.suspicions.mu.Lock()
+	defer rt.suspicions.mu.Unlock()
+	if _, ok := rt.suspicions.claims[cached.System.ID]; !ok {
+		return false
+	}
+	delete(rt.suspicions.claims, cached.System.ID)
+	return true
+}
+
+// suspicionCleared drops the stored claims clearSuspicion forgot
+func (rt *RoutingTable) suspicionCleared(id uuid.UUID) {
+	log.Printf("Heard from %s directly, clearing claims that it is unreachable", id.String()[:8])
+	if rt.storage == nil {
+		return
+	}
+	if err := rt.storage.DeleteSuspicions(id); err != nil {
+		log.Printf("Failed to delete suspicions about %s: %v", id.String()[:8], err)
+	}
+}
+
+// GetSuspicionCount returns how many claims against a system currently count
+func (rt *RoutingTable) GetSuspicionCount(id uuid.UUID) int {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+
+	cached, ok := rt.systemCache[id]
+	if !ok {
+		return 0
+	}
+	rt.suspicions.mu.Lock()
+	defer rt.suspicions.mu.Unlock()
+	return rt.suspicions.count(id, cached.LastVerified)
+}
+
+// PruneSuspicions forgets expired claims, restoring systems they no longer add up against
+// A restored system that really is gone is then evicted by our own liveness checks
+func (rt *RoutingTable) PruneSuspicions() {
+	cutoff := time.Now().Add(-VerificationCutoff)
+	expired := time.Now().Add(-RetractionWindow)
+	var events []Event
+
+	rt.cacheMu.Lock()
+	rt.suspicions.mu.Lock()
+	for target, byClaimer := range rt.suspicions.claims {
+		for claimer, at := range byClaimer {
+			if at.Before(expired) {
+				delete(byClaimer, claimer)
+			}
+		}
+		if len(byClaimer) == 0 {
+			delete(rt.suspicions.claims, target)
+		}
+		cached, ok := rt.systemCache[target]
+		if ok && cached.Retracted && rt.suspicions.count(target, cached.LastVerified) < RetractionQuorum {
+			before := cachedPeerStatus(cached, cutoff)
+			cached.Retracted = false
+			cached.settle(time.Now(), cutoff)
+			events = append(events, transitionEvents(cached, before, cachedPeerStatus(cached, cutoff))...)
+		}
+	}
+	rt.suspicions.mu.Unlock()
+	rt.cacheMu.Unlock()
+
+	rt.emit(events...)
+}
+
+// loadSuspicions restores unexpired claims against cached systems after a restart
+func (rt *RoutingTable) loadSuspicions() {
+	if rt.storage == nil {
+		return
+	}
+	stored, err := rt.storage.GetSuspicions(time.Now().Add(-RetractionWindow).Unix())
+	if err != nil {
+		log.Printf("Failed to load suspicions from storage: %v", err)
+		return
+	}
+
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	rt.suspicions.mu.Lock()
+	defer rt.suspicions.mu.Unlock()
+
+	for _, sus := range stored {
+		if _, ok := rt.systemCache[sus.TargetID]; !ok {
+			continue
+		}
+		if rt.suspicions.claims[sus.TargetID] == nil {
+			rt.suspicions.claims[sus.TargetID] = make(map[uuid.UUID]time.Time)
+		}
+		rt.suspicions.claims[sus.TargetID][sus.ClaimerID] = time.Unix(sus.ClaimedAt, 0)
+	}
+	for target := range rt.suspicions.claims {
+		cached := rt.systemCache[target]
+		cached.Retracted = rt.suspicions.count(target, cached.LastVerified) >= RetractionQuorum
+	}
+}
+
+// handlePeerUnreachable counts a claim that some system is unreachable and relays it onward
+func (dht *DHT) handlePeerUnreachable(msg *DHTMessage) (*DHTMessage, error) {
+	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	dht.routingTable.CacheSystem(msg.FromSystem, msg.FromSystem.ID, true)
+
+	if dht.recordUnreachableClaim(msg.Unreachable) && msg.Hops < MaxRetractionHops {
+		go dht.gossipUnreachable(msg.Unreachable, msg.Hops+1, msg.FromSystem.ID)
+	}
+
+	return NewPeerUnreachableResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+}
+
+// recordUnreachableClaim counts a claim against its target
+// Returns true only the first time a claimer's claim is seen, which is what stops relay loops.
+// The signature was checked in Validate; the key must also be the one bound to the claimer.
+func (dht *DHT) recordUnreachableClaim(claim *UnreachableClaim) bool {
+	if claim.ClaimerID == dht.localSystem.ID {
+		return false
+	}
+	if claim.TargetID == dht.localSystem.ID {
+		log.Printf("%s claims it can't reach us", claim.ClaimerID.String()[:8])
+		return false
+	}
+
+	claimedAt := time.Unix(claim.Timestamp, 0)
+	if time.Since(claimedAt) > RetractionWindow || time.Until(claimedAt) > 5*time.Minute {
+		return false
+	}
+
+	// Don't bind an identity on hearsay - only trust keys we learned first-hand
+	boundKey, err := dht.storage.GetIdentityBinding(claim.ClaimerID)
+	if err != nil {
+		log.Printf("Identity lookup failed for unreachable claim by %s: %v", claim.ClaimerID.String()[:8], err)
+		return false
+	}
+	if boundKey != claim.PublicKey {
+		return false
+	}
+
+	isNew, retracted := dht.routingTable.AddSuspicion(claim.TargetID, claim.ClaimerID, claimedAt)
+	if !isNew {
+		return false
+	}
+	if err := dht.storage.SaveSuspicion(claim.TargetID, claim.ClaimerID, claim.Timestamp); err != nil {
+		log.Printf("Failed to store unreachable claim about %s: %v", claim.TargetID.String()[:8], err)
+	}
+
+	count := dht.routingTable.GetSuspicionCount(claim.TargetID)
+	log.Printf("%s claims %s is unreachable (%d of %d claims needed)",
+		claim.ClaimerID.String()[:8], claim.TargetID.String()[:8], count, RetractionQuorum)
+
+	if retracted {
+		// Demoted until it answers; check for ourselves right away
+		log.Printf("Demoted %s to stale: %d peers can't reach it", claim.TargetID.String()[:8], count)
+		if sys := dht.routingTable.GetCachedSystem(claim.TargetID); sys != nil {
+			go dht.PingNode(sys)
+		}
+	}
+	return true
+}
+
+// === Sending claims ===
+
+// retractDeadNodes tells our peers about evicted systems we failed to reach ourselves
+func (dht *DHT) retractDeadNodes(evicted []*CachedSystem) {
+	for _, cached := range evicted {
+		// Only first-hand, repeated failures (other traffic also counts towards eviction)
+		if !cached.Verified || len(cached.FailedAt) < MaxFailCount {
+			continue
+		}
+		claim, err := NewUnreachableClaim(dht.localSystem, cached.System.ID, cached.FailedAt)
+		if err != nil {
+			return
+		}
+		dht.gossipUnreachable(claim, 1, uuid.Nil)
+	}
+}
+
+// gossipUnreachable sends a claim to every routing table peer except the ones it concerns
+// exclude is the peer we heard it from (uuid.Nil for our own claims)
+func (dht *DHT) gossipUnreachable(claim *UnreachableClaim, hops int, exclude uuid.UUID) {
+	sent := 0
+	for _, sys := range dht.routingTable.GetAllRoutingTableNodes() {
+		if sys.PeerAddress == "" || sys.ID == exclude ||
+			sys.ID == claim.ClaimerID || sys.ID == claim.TargetID {
+			continue
+		}
+		// Older nodes reject the message type; they evict on their own schedule
+		if !dht.peerSupports(sys.ID, CapPeerUnreachable) {
+			continue
+		}
+
+		msg, err := NewPeerUnreachableRequest(dht.localSystem, sys.ID, claim, hops, "")
+		if err != nil {
+			return
+		}
+		if _, err := dht.sendRequest(sys.PeerAddress, msg); err == nil {
+			sent++
+		}
+	}
+
+	if sent > 0 {
+		log.Printf("Told %d peers %s is unreachable (hop %d)", sent, claim.TargetID.String()[:8], hops)
+	}
+}
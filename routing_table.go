@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,10 +25,42 @@ type CachedSystem struct {
 	System          *System
 	LearnedAt       time.Time // When we first learned about this system
 	LearnedFrom     uuid.UUID
-	Verified        bool      // Have we directly communicated with them?
-	LastVerified    time.Time // When we last had direct contact (zero if never)
-	LastGossipHeard time.Time // When we last heard about this system via gossip
-	FailCount       int       // Consecutive ping failures
+	Verified        bool        // Have we directly communicated with them?
+	LastVerified    time.Time   // When we last had direct contact (zero if never)
+	LastGossipHeard time.Time   // When we last heard about this system via gossip
+	FailCount       int         // Consecutive ping failures
+	FailedAt        []time.Time // When those failures happened (the last MaxFailCount)
+
+	State        PeerState         // Where it stands with us (see peer_state.go)
+	StateSince   time.Time         // When it entered State
+	StateChanges []PeerStateChange // Its last MaxStateChanges transitions, oldest first
+
+	NextLivenessCheck time.Time // When the liveness loop may ping this peer again (zero = not yet scheduled)
+	LastRenamed       time.Time // When we last accepted a name change for this system
+
+	PeerTLS          bool   // Advertised TLS on the DHT port (refreshed on every direct contact)
+	ProcessStartTime int64  // When it says its process started (refreshed on every direct contact; display only)
+	Transport        string // How our last direct exchange went: TransportHTTP or TransportHTTPS ("" = none yet)
+
+	CoordsUnverified bool // Sponsor still unknown, so coordinates are unchecked; never passed on to peers
+	Quarantined      bool // Name or addresses failed sanitization; System holds a cleaned copy that is never passed on
+	LANDiscovered    bool // Found through LAN discovery (see lan_discovery.go)
+	LocalSlot        bool // Holds one of our local peer slots, for the systems nearest in space (see local_peers.go)
+	AddressConflict  bool // Another cached system claims the same peer address (see address_conflicts.go)
+	Retracted        bool // Enough peers claim it's unreachable: shown as stale and never passed on (see retraction.go)
+
+	Capabilities      Capabilities // What it supports, from its last message to or from us
+	CapabilitiesKnown bool         // False until we've exchanged a message
+	MaxMessageBytes   int          // The largest DHT message body it takes, from the same message (0 = DefaultMaxMessageBytes)
+
+	Latency         time.Duration // Moving average of our requests' round trips (0 = never measured; see latency.go)
+	LatencyBaseline time.Duration // The best it's recently been, for spotting degradation
+
+	Rejection *PeerRejection // The last protocol error it answered us with (see rejections.go)
+
+	RankClaim     *RankClaim // The credit rank it shares in its announces (see leaderboard.go)
+	RankVerified  string     // The rank its last proof covered ("" until one is checked)
+	RankCheckedAt time.Time  // When we last asked for a proof, answered or not
 }
 
 // RoutingTable manages known peers for the DHT
@@ -40,8 +74,33 @@ type RoutingTable struct {
 	systemCache map[uuid.UUID]*CachedSystem
 	cacheMu     sync.RWMutex
 
+	// Cached systems by normalized peer address, and the ones sharing one (see address_conflicts.go)
+	byAddress map[string]map[uuid.UUID]bool
+	conflicts *addressConflicts
+
+	// Other genesis systems we've come across while being one (see genesis.go)
+	genesis *genesisRivals
+
+	// Peers' claims that cached systems are unreachable (see retraction.go)
+	suspicions *suspicions
+
+	// Systems we can't reach that peers report alive (see partition.go)
+	partitions *partitionWatch
+
+	// When each ID space bucket was last touched and refreshed (see buckets.go)
+	buckets *bucketTracker
+
 	// Storage for persistence
 	storage *Storage
+
+	// Systems we refuse to cache (see blocklist.go)
+	blocklist *Blocklist
+
+	// The cache size cap and per-sender introduction limit (see cache_limit.go)
+	cacheLimit *cacheLimit
+
+	// Live event listener (nil if nobody is listening)
+	onEvent EventHandler
 }
 
 // NewRoutingTable creates a new routing table for the local node
@@ -50,18 +109,30 @@ func NewRoutingTable(localSystem *System, storage *Storage) *RoutingTable {
 		localID:     localSystem.ID,
 		localSystem: localSystem,
 		systemCache: make(map[uuid.UUID]*CachedSystem),
+		byAddress:   make(map[string]map[uuid.UUID]bool),
+		conflicts:   newAddressConflicts(),
+		genesis:     newGenesisRivals(),
+		suspicions:  newSuspicions(),
+		partitions:  newPartitionWatch(),
+		buckets:     newBucketTracker(),
 		storage:     storage,
+		blocklist:   NewBlocklist(),
+		cacheLimit:  newCacheLimit(),
 	}
 
+	// Load blocks first so blocked systems are never restored into the cache
+	rt.loadBlocklist()
+
 	// Load cached systems from storage
 	rt.loadFromStorage()
+	rt.loadSuspicions()
 
 	return rt
 }
 
 // Update adds or updates a node - simplified from Kademlia to just cache it
 func (rt *RoutingTable) Update(sys *System) {
-	if sys == nil || sys.ID == rt.localID {
+	if sys == nil || sys.ID == rt.localID || rt.IsBlocked(sys.ID) {
 		return
 	}
 	// Just cache the system - no bucket logic needed
@@ -70,51 +141,94 @@ func (rt *RoutingTable) Update(sys *System) {
 
 // MarkFailed increments the fail count for a node
 func (rt *RoutingTable) MarkFailed(nodeID uuid.UUID) {
-	rt.cacheMu.Lock()
-	defer rt.cacheMu.Unlock()
+	now := time.Now()
+	cutoff := now.Add(-VerificationCutoff)
+	var events []Event
 
+	rt.cacheMu.Lock()
 	if cached, ok := rt.systemCache[nodeID]; ok {
+		before := cachedPeerStatus(cached, cutoff)
 		cached.FailCount++
+		cached.FailedAt = append(cached.FailedAt, now)
+		if len(cached.FailedAt) > MaxFailCount {
+			cached.FailedAt = cached.FailedAt[len(cached.FailedAt)-MaxFailCount:]
+		}
+		cached.settle(now, cutoff)
+		events = transitionEvents(cached, before, cachedPeerStatus(cached, cutoff))
+		rt.partitions.failed(cached.System)
 	}
+	rt.cacheMu.Unlock()
+
+	rt.emit(events...)
 }
 
 // MarkVerified marks a node as successfully verified (ping response received)
 func (rt *RoutingTable) MarkVerified(nodeID uuid.UUID) {
 	now := time.Now()
+	cutoff := now.Add(-VerificationCutoff)
+	var events []Event
+	cleared := false
 
 	rt.cacheMu.Lock()
 	if cached, ok := rt.systemCache[nodeID]; ok {
+		before := cachedPeerStatus(cached, cutoff)
 		cached.Verified = true
 		cached.LastVerified = now
 		cached.LastGossipHeard = now
 		cached.FailCount = 0
+		cached.FailedAt = nil
+		if cached.Rejection != nil {
+			// It accepted us, so stop holding off (the reason stays for the peer view)
+			cached.Rejection.RetryAt = 0
+			cached.Rejection.Count = 0
+		}
+		cleared = rt.clearSuspicion(cached)
+		cached.settle(now, cutoff)
+		events = transitionEvents(cached, before, cachedPeerStatus(cached, cutoff))
 	}
 	rt.cacheMu.Unlock()
 
+	rt.emit(events...)
+	rt.partitions.reached(nodeID)
+	rt.touchBucket(nodeID)
+	if cleared {
+		rt.suspicionCleared(nodeID)
+	}
+
 	// Update storage timestamp
 	if rt.storage != nil {
 		rt.storage.TouchPeerSystem(nodeID)
 	}
 }
 
-// EvictDeadNodes removes nodes with too many failures
-func (rt *RoutingTable) EvictDeadNodes() int {
-	rt.cacheMu.Lock()
-	defer rt.cacheMu.Unlock()
+// EvictDeadNodes removes nodes with too many failures, returning their last cache entries
+func (rt *RoutingTable) EvictDeadNodes() []*CachedSystem {
+	var events []Event
+	var evicted []*CachedSystem
 
-	evicted := 0
+	rt.cacheMu.Lock()
 	for id, cached := range rt.systemCache {
 		if cached.FailCount >= MaxFailCount {
+			rt.unindexAddress(cached)
 			delete(rt.systemCache, id)
-			evicted++
+			evicted = append(evicted, cached)
+			events = append(events, Event{Type: EventPeerRemoved, SystemID: id.String(), Forgotten: true})
 		}
 	}
+	rt.cacheMu.Unlock()
+
+	rt.emit(events...)
 	return evicted
 }
 
 // GetAllPeers returns all verified peers (replaces GetClosest for FIND_NODE)
 // Limited to maxCount to avoid overwhelming responses
 func (rt *RoutingTable) GetAllPeers(maxCount int) []*System {
+	return rt.peersIn(maxCount, false)
+}
+
+// peersIn returns up to maxCount routing table peers, only active ones if activeOnly
+func (rt *RoutingTable) peersIn(maxCount int, activeOnly bool) []*System {
 	rt.cacheMu.RLock()
 	defer rt.cacheMu.RUnlock()
 
@@ -126,9 +240,8 @@ func (rt *RoutingTable) GetAllPeers(maxCount int) []*System {
 			break
 		}
 		// Only return verified peers with recent verification
-		if cached.Verified && !cached.LastVerified.IsZero() &&
-			cached.LastVerified.After(verificationCutoff) &&
-			cached.FailCount < MaxFailCount {
+		status := cachedPeerStatus(cached, verificationCutoff)
+		if status.inTable && (!activeOnly || status.state == PeerActive) {
 			result = append(result, cached.System)
 		}
 	}
@@ -144,6 +257,11 @@ func (rt *RoutingTable) GetClosest(targetID uuid.UUID, count int) []*System {
 	return rt.GetAllPeers(count)
 }
 
+// GetClosestActive is GetClosest without degraded peers, for handing out to others
+func (rt *RoutingTable) GetClosestActive(targetID uuid.UUID, count int) []*System {
+	return rt.peersIn(count, true)
+}
+
 // GetAllRoutingTableNodes returns all active (verified, not dead) peers
 func (rt *RoutingTable) GetAllRoutingTableNodes() []*System {
 	rt.cacheMu.RLock()
@@ -154,15 +272,21 @@ func (rt *RoutingTable) GetAllRoutingTableNodes() []*System {
 
 	for _, cached := range rt.systemCache {
 		// "Active peer" = verified recently and not failing
-		if cached.Verified && !cached.LastVerified.IsZero() &&
-			cached.LastVerified.After(verificationCutoff) &&
-			cached.FailCount < MaxFailCount {
+		if cachedPeerStatus(cached, verificationCutoff).inTable {
 			result = append(result, cached.System)
 		}
 	}
 	return result
 }
 
+// IsRoutingTablePeer reports whether a system is currently an active routing table peer
+func (rt *RoutingTable) IsRoutingTablePeer(id uuid.UUID) bool {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	cached, ok := rt.systemCache[id]
+	return ok && cachedPeerStatus(cached, time.Now().Add(-VerificationCutoff)).inTable
+}
+
 // GetRoutingTableSize returns the count of active peers
 func (rt *RoutingTable) GetRoutingTableSize() int {
 	return len(rt.GetAllRoutingTableNodes())
@@ -178,41 +302,223 @@ func (rt *RoutingTable) GetAllRoutingTableNodesWithMeta() []*CachedSystem {
 
 	for _, cached := range rt.systemCache {
 		// "Active peer" = verified recently and not failing
-		if cached.Verified && !cached.LastVerified.IsZero() &&
-			cached.LastVerified.After(verificationCutoff) &&
-			cached.FailCount < MaxFailCount {
+		if cachedPeerStatus(cached, verificationCutoff).inTable {
 			result = append(result, cached)
 		}
 	}
 	return result
 }
 
+// LivenessEntry is one routing table peer's liveness schedule (debug endpoint)
+type LivenessEntry struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	FailCount    int    `json:"fail_count"`
+	LastVerified int64  `json:"last_verified"`
+	NextCheck    int64  `json:"next_check"`
+}
+
+// DueForLiveness returns routing table peers whose next liveness check has arrived
+// Peers verified within LivenessFreshness (e.g. by an announce) are pushed back instead,
+// and peers seen for the first time get a random offset so checks don't burst together
+// stretch puts every check off by that much more (see bandwidth.go)
+// Peers whose last contact aged out are recorded as stale first
+func (rt *RoutingTable) DueForLiveness(now time.Time, stretch time.Duration) []*System {
+	cutoff := now.Add(-VerificationCutoff)
+
+	rt.cacheMu.Lock()
+	events := rt.settleAgedStates(now, cutoff)
+	var due []*System
+	for _, cached := range rt.systemCache {
+		if !cachedPeerStatus(cached, cutoff).inTable {
+			continue
+		}
+		if cached.NextLivenessCheck.IsZero() {
+			cached.NextLivenessCheck = now.Add(time.Duration(rand.Int63n(int64(rt.localSystem.LivenessInterval()))))
+			continue
+		}
+		if now.Before(cached.NextLivenessCheck.Add(stretch)) {
+			continue
+		}
+		if cached.FailCount == 0 && now.Sub(cached.LastVerified) < LivenessFreshness {
+			cached.NextLivenessCheck = cached.LastVerified.Add(livenessDelay(rt.localSystem.LivenessInterval(), 0))
+			continue
+		}
+		due = append(due, cached.System)
+	}
+	rt.cacheMu.Unlock()
+
+	rt.emit(events...)
+	return due
+}
+
+// ScheduleLivenessCheck sets a peer's next liveness check from its current FailCount
+func (rt *RoutingTable) ScheduleLivenessCheck(id uuid.UUID) {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+
+	if cached, ok := rt.systemCache[id]; ok {
+		cached.NextLivenessCheck = time.Now().Add(livenessDelay(rt.localSystem.LivenessInterval(), cached.FailCount))
+	}
+}
+
+// GetLivenessSchedule returns the liveness schedule for every routing table peer
+func (rt *RoutingTable) GetLivenessSchedule() []LivenessEntry {
+	peers := rt.GetAllRoutingTableNodesWithMeta()
+
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+
+	entries := make([]LivenessEntry, 0, len(peers))
+	for _, cached := range peers {
+		entry := LivenessEntry{
+			ID:           cached.System.ID.String(),
+			Name:         cached.System.Name,
+			FailCount:    cached.FailCount,
+			LastVerified: cached.LastVerified.Unix(),
+		}
+		if !cached.NextLivenessCheck.IsZero() {
+			entry.NextCheck = cached.NextLivenessCheck.Unix()
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
 // === System Cache Methods ===
 
+// CacheEntry is one system to cache in a batch (see CacheSystemsBatch)
+type CacheEntry struct {
+	System      *System
+	LearnedFrom uuid.UUID
+	Verified    bool
+}
+
+// peerWriteBatch collects the storage writes of a cache batch for one transaction
+type peerWriteBatch struct {
+	saves   []*System
+	touches []uuid.UUID
+}
+
 // CacheSystem adds a system to the cache
 // InfoVersion is used to prevent stale gossip from overwriting fresh info
 // LastGossipHeard is updated conditionally to prevent dead nodes from persisting
 func (rt *RoutingTable) CacheSystem(sys *System, learnedFrom uuid.UUID, verified bool) {
-	if sys == nil || sys.ID == rt.localID {
+	rt.cacheSystem(sys, learnedFrom, verified, nil)
+}
+
+// CacheSystemsBatch caches many systems at once (e.g. a full-sync response),
+// writing them to storage in a single transaction instead of one insert each
+// Returns how many systems were not cached before (and made it in)
+func (rt *RoutingTable) CacheSystemsBatch(entries []CacheEntry) int {
+	batch := &peerWriteBatch{}
+	newSystems := 0
+	for _, e := range entries {
+		known := e.System == nil || rt.GetCachedSystem(e.System.ID) != nil
+		rt.cacheSystem(e.System, e.LearnedFrom, e.Verified, batch)
+		if !known && rt.GetCachedSystem(e.System.ID) != nil {
+			newSystems++
+		}
+	}
+
+	if rt.storage != nil && (len(batch.saves) > 0 || len(batch.touches) > 0) {
+		if err := rt.storage.SavePeerSystemsBatch(batch.saves, batch.touches); err != nil {
+			log.Printf("Failed to save %d cached systems: %v", len(batch.saves), err)
+		}
+	}
+	return newSystems
+}
+
+// cacheSystem does the work of CacheSystem; storage writes go to batch when one is given
+func (rt *RoutingTable) cacheSystem(sys *System, learnedFrom uuid.UUID, verified bool, batch *peerWriteBatch) {
+	if sys == nil || sys.ID == rt.localID || rt.IsBlocked(sys.ID) {
 		return
 	}
 
+	save := func(sys *System) {
+		if rt.storage == nil {
+			return
+		}
+		if batch != nil {
+			batch.saves = append(batch.saves, sys)
+		} else {
+			rt.storage.SavePeerSystem(sys)
+		}
+	}
+	touch := func(id uuid.UUID) {
+		if rt.storage == nil {
+			return
+		}
+		if batch != nil {
+			batch.touches = append(batch.touches, id)
+		} else {
+			rt.storage.TouchPeerSystem(id)
+		}
+	}
+
 	rt.cacheMu.Lock()
-	defer rt.cacheMu.Unlock()
+	var events []Event
+	var conflicting []uuid.UUID
+	cleared := false
+	defer func() {
+		rt.cacheMu.Unlock()
+		rt.emit(events...)
+		if len(conflicting) > 0 {
+			rt.reportAddressConflict(sys, conflicting)
+		}
+		if cleared {
+			rt.suspicionCleared(sys.ID)
+		}
+	}()
 
 	now := time.Now()
+	cutoff := now.Add(-VerificationCutoff)
 	existing, exists := rt.systemCache[sys.ID]
 
+	// Info must be signed by the owner once we know their key (blocks relayed hijacks)
+	if !rt.acceptInfo(sys, existing) {
+		log.Printf("Rejected unsigned or forged info for %q (%s)", sys.Name, sys.ID.String()[:8])
+		return
+	}
+
+	// A genesis stepping down has to say so, and another genesis than us is a conflict (see genesis.go)
+	if sys = rt.checkGenesisTransition(sys, existing); sys == nil {
+		return
+	}
+	if isGenesis(sys) && isGenesis(rt.localSystem) {
+		rt.genesis.report(sys.ID)
+	}
+
+	// An operator profile has to be the owner's, and relays that leave it out don't clear it
+	sys = rt.checkProfile(sys, existing)
+
+	// Stars past the signed primary class are taken from the UUID, not the sender
+	sys = canonicalStars(sys)
+
+	// Unsafe names and addresses are cleaned up for display but stored as signed
+	signed := sys
+	sys, quarantineErr := quarantine(sys)
+	if quarantineErr != nil && (!exists || !existing.Quarantined) {
+		log.Printf("Quarantined %s: %s", sys.ID.String()[:8], strings.ReplaceAll(quarantineErr.Error(), "\n", "; "))
+	}
+
 	if exists {
+		before := cachedPeerStatus(existing, cutoff)
+
 		// Update LastVerified on direct contact regardless of version
 		if verified {
+			if learnedFrom == sys.ID {
+				// First-hand capabilities beat whatever InfoVersion we cached
+				existing.PeerTLS = sys.PeerTLS
+				existing.ProcessStartTime = sys.ProcessStartTime
+			}
 			existing.LastVerified = now
 			existing.Verified = true
 			existing.LastGossipHeard = now
 			existing.FailCount = 0
-			if rt.storage != nil {
-				rt.storage.TouchPeerSystem(sys.ID)
-			}
+			existing.FailedAt = nil
+			cleared = rt.clearSuspicion(existing)
+			touch(sys.ID)
 		} else {
 			// For gossip-only updates: only extend the prune timer if:
 			// 1. The system was verified within the cutoff, OR
@@ -238,17 +544,45 @@ func (rt *RoutingTable) CacheSystem(sys *System, learnedFrom uuid.UUID, verified
 			shouldUpdate = verified
 		}
 
+		// Rename spam guard: one accepted name change per system per RenameCooldown
+		if shouldUpdate && sys.Name != existing.System.Name {
+			if !existing.LastRenamed.IsZero() && now.Sub(existing.LastRenamed) < RenameCooldown {
+				shouldUpdate = false
+			} else {
+				existing.LastRenamed = now
+			}
+		}
+
 		if shouldUpdate {
+			moved := addressKey(sys.PeerAddress) != addressKey(existing.System.PeerAddress)
+			if moved {
+				rt.unindexAddress(existing)
+			}
 			existing.System = sys
+			if moved {
+				conflicting = rt.indexAddress(existing)
+			}
+			existing.Quarantined = quarantineErr != nil
+			existing.PeerTLS = sys.PeerTLS
 			existing.LearnedAt = now
 			// Always persist updates with newer InfoVersion to storage
 			// The storage layer has its own InfoVersion check to prevent stale overwrites
-			if rt.storage != nil {
-				rt.storage.SavePeerSystem(sys)
-			}
+			save(signed)
+			events = append(events, Event{Type: EventSystemLearned, SystemID: sys.ID.String(), System: sys, LearnedAt: now.Unix()})
 		}
+		existing.settle(now, cutoff)
+		events = append(events, transitionEvents(existing, before, cachedPeerStatus(existing, cutoff))...)
 	} else {
-		// New system - add to cache
+		// New system - within its sender's introduction limit, and room made under the cap
+		if !rt.allowIntroduction(sys, learnedFrom, now) {
+			return
+		}
+		events = append(events, rt.evictForRoom(1, now)...)
+		if len(rt.systemCache) >= rt.cacheLimit.max && learnedFrom != uuid.Nil && learnedFrom != sys.ID {
+			rt.cacheLimit.refused++
+			return // Everything cached is protected; only direct contact gets past the cap
+		}
+
 		cached := &CachedSystem{
 			System:          sys,
 			LearnedAt:       now,
@@ -256,18 +590,31 @@ func (rt *RoutingTable) CacheSystem(sys *System, learnedFrom uuid.UUID, verified
 			Verified:        verified,
 			LastGossipHeard: now,
 			FailCount:       0,
+			PeerTLS:         sys.PeerTLS,
+			Quarantined:     quarantineErr != nil,
 		}
 		if verified {
 			cached.LastVerified = now
 		}
+		if learnedFrom == sys.ID {
+			cached.ProcessStartTime = sys.ProcessStartTime
+		}
+		cached.insertState(now, cutoff)
 		rt.systemCache[sys.ID] = cached
+		conflicting = rt.indexAddress(cached)
 
 		// Persist new systems to storage
-		if rt.storage != nil {
-			rt.storage.SavePeerSystem(sys)
-			if verified {
-				rt.storage.TouchPeerSystem(sys.ID)
-			}
+		save(signed)
+		if verified {
+			touch(sys.ID)
+		}
+
+		status := cachedPeerStatus(cached, cutoff)
+		events = append(events, Event{Type: EventSystemLearned, SystemID: sys.ID.String(), System: sys,
+			LearnedAt: now.Unix(), State: string(status.state)})
+		if status.inTable {
+			events = append(events, Event{Type: EventPeerAdded, SystemID: sys.ID.String(), System: sys,
+				LearnedAt: now.Unix(), State: string(status.state), Quarantined: cached.Quarantined})
 		}
 	}
 }
@@ -294,14 +641,69 @@ func (rt *RoutingTable) GetCachedSystemMeta(id uuid.UUID) *CachedSystem {
 	return nil
 }
 
+// CachedSystemStatus is a copy of one cache entry plus its current peer state
+type CachedSystemStatus struct {
+	CachedSystem
+	State          string // "pending", "stale", "degraded" or "active"
+	InRoutingTable bool
+}
+
+// GetCachedSystemStatus returns a snapshot of a cached system's metadata, or nil if unknown
+func (rt *RoutingTable) GetCachedSystemStatus(id uuid.UUID) *CachedSystemStatus {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+
+	cached, ok := rt.systemCache[id]
+	if !ok {
+		return nil
+	}
+	status := cachedPeerStatus(cached, time.Now().Add(-VerificationCutoff))
+	return &CachedSystemStatus{CachedSystem: *cached, State: string(status.state), InRoutingTable: status.inTable}
+}
+
 // GetSystemIDByAddress looks up a system's UUID by its peer address
+// Addresses are compared normalized first. A hostname is then resolved once, so
+// "node.example.com:7867" and its IP map to one identity, and compared with cached
+// systems advertising other hostnames; an IP literal is never resolved against them
+// When several systems claim the address, the most recently verified one wins
 func (rt *RoutingTable) GetSystemIDByAddress(address string) uuid.UUID {
 	rt.cacheMu.RLock()
-	defer rt.cacheMu.RUnlock()
+	claimants := rt.systemsAtAddress(address)
+	rt.cacheMu.RUnlock()
+	if len(claimants) > 0 {
+		return claimants[0].System.ID
+	}
 
+	// DNS lookups happen without the cache lock held
+	resolved := resolvePeerAddress(address)
+	if resolved == nil {
+		return uuid.Nil
+	}
+	type candidate struct {
+		id   uuid.UUID
+		addr string
+	}
+	var candidates []candidate
+	rt.cacheMu.RLock()
+	for _, addr := range resolved {
+		if claimants := rt.systemsAtAddress(addr); len(claimants) > 0 {
+			rt.cacheMu.RUnlock()
+			return claimants[0].System.ID
+		}
+	}
+	port := addressPort(address)
 	for _, cached := range rt.systemCache {
-		if cached.System.PeerAddress == address {
-			return cached.System.ID
+		peerAddr := cached.System.PeerAddress
+		if addressPort(peerAddr) == port {
+			candidates = append(candidates, candidate{id: cached.System.ID, addr: peerAddr})
+		}
+	}
+	rt.cacheMu.RUnlock()
+
+	// Only candidates advertising a hostname are resolved (see samePeerAddress)
+	for _, c := range candidates {
+		if samePeerAddress(address, c.addr) {
+			return c.id
 		}
 	}
 	return uuid.Nil
@@ -399,10 +801,11 @@ func (rt *RoutingTable) GetUnverifiedCount() int {
 // PeerStateBreakdown provides a clear view of peer states
 type PeerStateBreakdown struct {
 	Total    int `json:"total"`    // All known systems (not including self)
-	Active   int `json:"active"`   // Verified, recent, responding (fail=0)
-	Degraded int `json:"degraded"` // Verified but failing (0 < fail < max)
+	Active   int `json:"active"`   // Verified, recent, responding (at most one missed ping)
+	Degraded int `json:"degraded"` // Verified but failing (DegradedAfterFailures or more in a row)
 	Pending  int `json:"pending"`  // Heard via gossip, not yet verified
 	Stale    int `json:"stale"`    // Was verified but outside cutoff window
+	TLS      int `json:"tls"`      // Last direct exchange was over TLS
 }
 
 // GetPeerStateBreakdown returns counts of peers in each state
@@ -418,17 +821,17 @@ func (rt *RoutingTable) GetPeerStateBreakdown() PeerStateBreakdown {
 	}
 
 	for _, cached := range rt.systemCache {
-		if !cached.Verified {
-			// Never verified - pending
+		if cached.Transport == TransportHTTPS {
+			breakdown.TLS++
+		}
+		switch cachedPeerStatus(cached, cutoff).state {
+		case PeerPending:
 			breakdown.Pending++
-		} else if cached.LastVerified.IsZero() || cached.LastVerified.Before(cutoff) {
-			// Verified but too long ago - stale
+		case PeerStale:
 			breakdown.Stale++
-		} else if cached.FailCount > 0 {
-			// Recently verified but now failing - degraded
+		case PeerDegraded:
 			breakdown.Degraded++
-		} else {
-			// Verified, recent, responding - active
+		default:
 			breakdown.Active++
 		}
 	}
@@ -436,6 +839,115 @@ func (rt *RoutingTable) GetPeerStateBreakdown() PeerStateBreakdown {
 	return breakdown
 }
 
+// AdvertisesTLS reports whether a cached system accepts TLS at this address
+func (rt *RoutingTable) AdvertisesTLS(id uuid.UUID, address string) bool {
+	rt.cacheMu.RLock()
+	cached, ok := rt.systemCache[id]
+	advertised := ok && cached.PeerTLS
+	var peerAddress string
+	if advertised {
+		peerAddress = cached.System.PeerAddress
+	}
+	rt.cacheMu.RUnlock()
+
+	// Compared outside the lock since it may resolve hostnames
+	return advertised && samePeerAddress(peerAddress, address)
+}
+
+// RecordTransport notes how our latest direct exchange with a system was carried
+func (rt *RoutingTable) RecordTransport(id uuid.UUID, transport string) {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+
+	if cached, ok := rt.systemCache[id]; ok {
+		cached.Transport = transport
+	}
+}
+
+// SetCoordsUnverified records whether a cached system's coordinates are still waiting on its sponsor
+func (rt *RoutingTable) SetCoordsUnverified(id uuid.UUID, unverified bool) {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	if cached, ok := rt.systemCache[id]; ok {
+		cached.CoordsUnverified = unverified
+	}
+}
+
+// MarkLANDiscovered flags a cached system as found on the local network
+func (rt *RoutingTable) MarkLANDiscovered(id uuid.UUID) {
+	var events []Event
+
+	rt.cacheMu.Lock()
+	if cached, ok := rt.systemCache[id]; ok && !cached.LANDiscovered {
+		cached.LANDiscovered = true
+		// Re-send peer_added so live views pick up the flag (the UI replaces the entry)
+		if status := cachedPeerStatus(cached, time.Now().Add(-VerificationCutoff)); status.inTable {
+			events = append(events, Event{Type: EventPeerAdded, SystemID: id.String(), System: cached.System,
+				LearnedAt: cached.LearnedAt.Unix(), State: string(status.state), LAN: true, Quarantined: cached.Quarantined})
+		}
+	}
+	rt.cacheMu.Unlock()
+
+	rt.emit(events...)
+}
+
+// SetCapabilities records what a cached system supports and the message size it takes,
+// as of its latest message
+func (rt *RoutingTable) SetCapabilities(id uuid.UUID, caps Capabilities, maxMessageBytes int) {
+	rt.cacheMu.Lock()
+	defer rt.cacheMu.Unlock()
+	if cached, ok := rt.systemCache[id]; ok {
+		cached.Capabilities = caps
+		cached.CapabilitiesKnown = true
+		cached.MaxMessageBytes = maxMessageBytes
+	}
+}
+
+// GetMaxMessageBytes returns the largest DHT message body a system takes
+func (rt *RoutingTable) GetMaxMessageBytes(id uuid.UUID) int {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	if cached, ok := rt.systemCache[id]; ok && cached.MaxMessageBytes > 0 {
+		return cached.MaxMessageBytes
+	}
+	return DefaultMaxMessageBytes
+}
+
+// GetCapabilities returns what a cached system supports, and whether we know yet
+func (rt *RoutingTable) GetCapabilities(id uuid.UUID) (Capabilities, bool) {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	cached, ok := rt.systemCache[id]
+	if !ok || !cached.CapabilitiesKnown {
+		return 0, false
+	}
+	return cached.Capabilities, true
+}
+
+// IsQuarantined reports whether a cached system's name or addresses failed sanitization
+func (rt *RoutingTable) IsQuarantined(id uuid.UUID) bool {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	cached, ok := rt.systemCache[id]
+	return ok && cached.Quarantined
+}
+
+// IsRetracted reports whether enough peers claim a cached system is unreachable (see retraction.go)
+func (rt *RoutingTable) IsRetracted(id uuid.UUID) bool {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	cached, ok := rt.systemCache[id]
+	return ok && cached.Retracted
+}
+
+// CoordsUnverified reports whether a system's coordinates haven't been checked against its sponsor yet
+func (rt *RoutingTable) CoordsUnverified(id uuid.UUID) bool {
+	rt.cacheMu.RLock()
+	defer rt.cacheMu.RUnlock()
+	cached, ok := rt.systemCache[id]
+	return ok && cached.CoordsUnverified
+}
+
 // GetCacheSize returns the number of cached systems
 func (rt *RoutingTable) GetCacheSize() int {
 	rt.cacheMu.RLock()
@@ -451,8 +963,67 @@ func (rt *RoutingTable) Remove(nodeID uuid.UUID) {
 // RemoveFromCache removes a system from the cache
 func (rt *RoutingTable) RemoveFromCache(id uuid.UUID) {
 	rt.cacheMu.Lock()
-	defer rt.cacheMu.Unlock()
+	cached, existed := rt.systemCache[id]
+	if existed {
+		rt.unindexAddress(cached)
+	}
 	delete(rt.systemCache, id)
+	rt.cacheMu.Unlock()
+
+	if existed {
+		rt.emit(Event{Type: EventPeerRemoved, SystemID: id.String(), Forgotten: true})
+	}
+}
+
+// IsBlocked reports whether a system is on the blocklist
+func (rt *RoutingTable) IsBlocked(id uuid.UUID) bool {
+	return rt.blocklist.IsBlocked(id)
+}
+
+// loadBlocklist loads active blocks from persistent storage
+func (rt *RoutingTable) loadBlocklist() {
+	if rt.storage == nil {
+		return
+	}
+
+	blocked, err := rt.storage.GetBlockedSystems()
+	if err != nil {
+		log.Printf("Failed to load blocklist from storage: %v", err)
+		return
+	}
+	for _, b := range blocked {
+		rt.blocklist.add(b)
+	}
+	if len(blocked) > 0 {
+		log.Printf("Loaded %d blocked systems", len(blocked))
+	}
+}
+
+// SaveSnapshot writes every cached system, its verification time and latency to storage
+// Called on shutdown so peers learned since the last write survive a restart
+func (rt *RoutingTable) SaveSnapshot() int {
+	if rt.storage == nil {
+		return 0
+	}
+
+	saved := 0
+	for _, cached := range rt.GetAllCachedSystemsWithMeta() {
+		// Quarantined systems were stored as signed when cached; System is only the cleaned copy
+		if !cached.Quarantined {
+			if err := rt.storage.SavePeerSystem(cached.System); err != nil {
+				log.Printf("Failed to persist peer %s: %v", cached.System.Name, err)
+				continue
+			}
+		}
+		if cached.Verified && !cached.LastVerified.IsZero() {
+			rt.storage.SetPeerLastVerified(cached.System.ID, cached.LastVerified)
+		}
+		if cached.Latency > 0 {
+			rt.storage.SetPeerLatency(cached.System.ID, latencyMs(cached.Latency))
+		}
+		saved++
+	}
+	return saved
 }
 
 // loadFromStorage loads cached systems from persistent storage
@@ -477,7 +1048,7 @@ func (rt *RoutingTable) loadFromStorage() {
 	skipped := 0
 	for _, meta := range systemsWithMeta {
 		sys := meta.System
-		if sys.ID == rt.localID {
+		if sys.ID == rt.localID || rt.IsBlocked(sys.ID) {
 			continue
 		}
 
@@ -504,16 +1075,34 @@ func (rt *RoutingTable) loadFromStorage() {
 			continue
 		}
 
-		rt.cacheMu.Lock()
-		rt.systemCache[sys.ID] = &CachedSystem{
+		// Storage keeps only the primary star, so companions come back from the UUID
+		sys, quarantineErr := quarantine(canonicalStars(sys))
+
+		cached := &CachedSystem{
 			System:          sys,
+			Quarantined:     quarantineErr != nil,
 			LearnedAt:       lastGossipHeard,
 			Verified:        verified,
 			LastVerified:    lastVerified,
 			LastGossipHeard: lastGossipHeard,
 			FailCount:       0,
+			Latency:         time.Duration(meta.LatencyMs * float64(time.Millisecond)),
+			Rejection:       restoreRejection(meta),
+			RankClaim:       meta.RankClaim,
+			RankVerified:    meta.RankVerified,
+		}
+		if meta.RankVerifiedAt > 0 {
+			cached.RankCheckedAt = time.Unix(meta.RankVerifiedAt, 0)
 		}
+		rt.cacheMu.Lock()
+		cached.insertState(time.Now(), time.Now().Add(-VerificationCutoff))
+		rt.systemCache[sys.ID] = cached
+		conflicting := rt.indexAddress(cached)
 		rt.cacheMu.Unlock()
+		if len(conflicting) > 0 {
+			// Left over from before the restart; settled once the DHT is running
+			rt.reportAddressConflict(sys, conflicting)
+		}
 		loaded++
 	}
 
@@ -527,7 +1116,11 @@ func (rt *RoutingTable) loadFromStorage() {
 // PruneCache removes stale entries from the cache
 func (rt *RoutingTable) PruneCache(maxAge time.Duration) int {
 	rt.cacheMu.Lock()
-	defer rt.cacheMu.Unlock()
+	var events []Event
+	defer func() {
+		rt.cacheMu.Unlock()
+		rt.emit(events...)
+	}()
 
 	cutoff := time.Now().Add(-maxAge)
 	pruned := 0
@@ -541,7 +1134,9 @@ func (rt *RoutingTable) PruneCache(maxAge time.Duration) int {
 		}
 
 		if shouldPrune {
+			rt.unindexAddress(cached)
 			delete(rt.systemCache, id)
+			events = append(events, Event{Type: EventPeerRemoved, SystemID: id.String(), Forgotten: true})
 			pruned++
 		}
 	}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Names and addresses of every system we cache end up in the web UI (templates, map
+// labels, peer lists) and in the caches of the peers we gossip to, so anything a browser
+// could misread is caught on the way in instead of relying on escaping further down.
+
+const (
+	// MaxSystemNameLength is the longest system name accepted, in bytes
+	MaxSystemNameLength = 64
+
+	// maxAddressLength is the longest address field accepted, in bytes
+	maxAddressLength = 255
+)
+
+// CheckSystemName reports why a system name is unsafe to cache or display, or nil
+// A clean name is valid UTF-8, trimmed, at most MaxSystemNameLength bytes, and made of
+// printable characters only (no control, format or bidi characters), excluding < and >
+func CheckSystemName(name string) error {
+	if utf8.ValidString(name) && strings.TrimSpace(name) == "" {
+		return errors.New("empty")
+	}
+	return checkDisplayText(name, MaxSystemNameLength)
+}
+
+// checkDisplayText holds other gossiped text (operator profiles) to the rules for names,
+// with max bytes instead of MaxSystemNameLength. Empty is fine
+func checkDisplayText(text string, max int) error {
+	if !utf8.ValidString(text) {
+		return errors.New("not valid UTF-8")
+	}
+	if text != strings.TrimSpace(text) {
+		return errors.New("leading or trailing whitespace")
+	}
+	if len(text) > max {
+		return fmt.Errorf("longer than %d bytes", max)
+	}
+	for _, r := range text {
+		if r == '<' || r == '>' {
+			return fmt.Errorf("contains %q", r)
+		}
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("contains unprintable character %U", r)
+		}
+	}
+	return nil
+}
+
+// SanitizeSystemName returns the closest clean version of name: unprintable characters
+// and < > dropped, whitespace runs collapsed to single spaces, trimmed and cut to
+// MaxSystemNameLength bytes on a character boundary. Empty if nothing printable is left.
+func SanitizeSystemName(name string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToValidUTF8(name, "") {
+		switch {
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		case r == '<' || r == '>' || !unicode.IsPrint(r):
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+
+	clean := b.String()
+	for len(clean) > MaxSystemNameLength {
+		_, size := utf8.DecodeLastRuneInString(clean)
+		clean = strings.TrimSpace(clean[:len(clean)-size])
+	}
+	return clean
+}
+
+// checkAddressField reports why an advertised address is unsafe to display or dial, or nil
+// Only the characters a host:port can contain are allowed (IPv6 brackets and zones included)
+func checkAddressField(addr string) error {
+	if len(addr) > maxAddressLength {
+		return fmt.Errorf("longer than %d bytes", maxAddressLength)
+	}
+	for _, r := range addr {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune(".-_:[]%", r):
+		default:
+			return fmt.Errorf("contains %q", r)
+		}
+	}
+	return nil
+}
+
+// checkSystemFields reports every reason a system's name or addresses fail sanitization, or nil
+func checkSystemFields(sys *System) error {
+	var errs []error
+	if err := CheckSystemName(sys.Name); err != nil {
+		errs = append(errs, fmt.Errorf("name %w", err))
+	}
+	if err := checkAddressField(sys.PeerAddress); err != nil {
+		errs = append(errs, fmt.Errorf("peer address %w", err))
+	}
+	if err := checkAddressField(sys.Address); err != nil {
+		errs = append(errs, fmt.Errorf("address %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// displayName returns name if it's clean, else the placeholder shown instead:
+// its sanitized version, or "Unnamed <id>" when too little of it survives
+func displayName(name, id string) string {
+	if CheckSystemName(name) == nil {
+		return name
+	}
+	if clean := SanitizeSystemName(name); len(clean) >= 2 {
+		return clean
+	}
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return "Unnamed " + id
+}
+
+// quarantine returns sys itself when its fields are clean, or else a copy with a
+// placeholder name and unsafe addresses cleared, along with what was wrong.
+// The copy no longer matches its info signature, so it must never be passed on.
+func quarantine(sys *System) (*System, error) {
+	err := checkSystemFields(sys)
+	if err == nil {
+		return sys, nil
+	}
+
+	clean := *sys
+	clean.Name = displayName(sys.Name, sys.ID.String())
+	if checkAddressField(clean.PeerAddress) != nil {
+		clean.PeerAddress = ""
+	}
+	if checkAddressField(clean.Address) != nil {
+		clean.Address = ""
+	}
+	return &clean, err
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Seeds come in tiers, tried in this order: the list on GitHub (or, when GitHub can't be
+// reached, the last copy of it we fetched), our personal seeds, then FallbackSeedNodes.
+// Personal seeds are our own long-lived peers, so a node that joined once can still get
+// back in from behind a proxy that blocks raw.githubusercontent.com
+
+// Where a seed address came from
+const (
+	SeedSourceGitHub    = "github"
+	SeedSourceCached    = "cached"
+	SeedSourcePersonal  = "personal"
+	SeedSourceHardcoded = "hardcoded"
+)
+
+const (
+	PersonalSeedCount    = 5                   // Most personal seeds kept
+	PersonalSeedWindow   = 14 * 24 * time.Hour // How far back attestation days are counted
+	PersonalSeedMinDays  = 7                   // Days within the window a peer must have attested to us
+	PersonalSeedInterval = 6 * time.Hour       // How often the personal seed list is rebuilt
+)
+
+// SeedNode is one address Bootstrap may try, with where it came from
+type SeedNode struct {
+	Address   string `json:"address"`
+	Source    string `json:"source"`
+	FetchedAt int64  `json:"fetched_at,omitempty"` // For cached seeds: when the list was fetched
+}
+
+// PersonalSeed is one of our own peers promoted to seed
+type PersonalSeed struct {
+	SystemID   uuid.UUID `json:"system_id"`
+	Address    string    `json:"address"`
+	DaysSeen   int       `json:"days_seen"` // Days it attested to us within PersonalSeedWindow
+	PromotedAt int64     `json:"promoted_at"`
+}
+
+// SeedStatus is the effective seed list for /api/stats
+type SeedStatus struct {
+	Sources   map[string]int `json:"sources"` // Seeds per source
+	Seeds     []SeedNode     `json:"seeds"`
+	JoinedVia *SeedNode      `json:"joined_via,omitempty"` // The seed our last bootstrap succeeded through
+}
+
+// seedSources remembers the last seed list loaded and which seed we joined through
+type seedSources struct {
+	mu        sync.Mutex
+	seeds     []SeedNode
+	joinedVia *SeedNode
+}
+
+// LoadSeedNodes fetches the seed list from GitHub and builds the full tiered list
+func (dht *DHT) LoadSeedNodes() []SeedNode {
+	log.Printf("Fetching seed node list from GitHub...")
+	fetched, err := FetchSeedNodes()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		dht.diagnose(DiagSeedFetch, false, "%v", err)
+	} else {
+		dht.diagnose(DiagSeedFetch, true, "Downloaded %d seeds from GitHub", len(fetched))
+	}
+	return dht.collectSeeds(fetched, err)
+}
+
+// collectSeeds builds the tiered seed list from a GitHub fetch's result, caching the
+// fetched list on success and falling back to the cached one on failure
+func (dht *DHT) collectSeeds(fetched []string, fetchErr error) []SeedNode {
+	var seeds []SeedNode
+	seen := make(map[string]bool)
+	add := func(address, source string, fetchedAt int64) {
+		address = strings.TrimSpace(address)
+		if address == "" || seen[address] {
+			return
+		}
+		seen[address] = true
+		seeds = append(seeds, SeedNode{Address: address, Source: source, FetchedAt: fetchedAt})
+	}
+
+	if fetchErr == nil {
+		log.Printf("Loaded %d seed nodes from GitHub", len(fetched))
+		if err := dht.storage.SaveSeedCache(fetched, time.Now().Unix()); err != nil {
+			log.Printf("Warning: failed to cache seed list: %v", err)
+		}
+		for _, address := range fetched {
+			add(address, SeedSourceGitHub, 0)
+		}
+	} else if cached, fetchedAt, err := dht.storage.GetSeedCache(); err != nil {
+		log.Printf("Warning: failed to load cached seed list: %v", err)
+	} else if len(cached) > 0 {
+		log.Printf("Using %d cached seed nodes fetched %s", len(cached), time.Unix(fetchedAt, 0).Format(time.RFC3339))
+		for _, address := range cached {
+			add(address, SeedSourceCached, fetchedAt)
+		}
+	}
+
+	personal, err := dht.storage.GetPersonalSeeds()
+	if err != nil {
+		log.Printf("Warning: failed to load personal seeds: %v", err)
+	}
+	for _, seed := range personal {
+		add(seed.Address, SeedSourcePersonal, 0)
+	}
+
+	for _, address := range FallbackSeedNodes {
+		add(address, SeedSourceHardcoded, 0)
+	}
+
+	dht.seeds.mu.Lock()
+	dht.seeds.seeds = seeds
+	dht.seeds.mu.Unlock()
+
+	status := dht.SeedStatus()
+	var parts []string
+	for _, source := range []string{SeedSourceGitHub, SeedSourceCached, SeedSourcePersonal, SeedSourceHardcoded} {
+		if n := status.Sources[source]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", source, n))
+		}
+	}
+	if len(parts) > 0 {
+		log.Printf("Seed sources: %s", strings.Join(parts, ", "))
+	} else {
+		log.Printf("Warning: no seed nodes from any source")
+	}
+	return seeds
+}
+
+// setJoinedVia records the seed our bootstrap succeeded through
+func (dht *DHT) setJoinedVia(seed SeedNode) {
+	dht.seeds.mu.Lock()
+	defer dht.seeds.mu.Unlock()
+	dht.seeds.joinedVia = &seed
+}
+
+// SeedStatus returns the last loaded seed list and the seed we joined through
+func (dht *DHT) SeedStatus() SeedStatus {
+	dht.seeds.mu.Lock()
+	defer dht.seeds.mu.Unlock()
+	status := SeedStatus{
+		Sources:   make(map[string]int),
+		Seeds:     append([]SeedNode(nil), dht.seeds.seeds...),
+		JoinedVia: dht.seeds.joinedVia,
+	}
+	for _, seed := range dht.seeds.seeds {
+		status.Sources[seed.Source]++
+	}
+	return status
+}
+
+// personalSeedLoop periodically rebuilds the personal seed list
+func (dht *DHT) personalSeedLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskPersonalSeeds, every(PersonalSeedInterval))
+
+	ticker := time.NewTicker(PersonalSeedInterval)
+	defer ticker.Stop()
+
+	// First run once the routing table has settled, or on request
+	t.scheduleNext(time.Now().Add(10 * time.Minute))
+	first := time.After(10 * time.Minute)
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-first:
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(PersonalSeedInterval))
+		case <-t.trigger:
+		}
+		t.run(dht.refreshPersonalSeeds)
+	}
+}
+
+// refreshPersonalSeeds promotes the routing-table peers that attested to us on the most
+// days lately (at least PersonalSeedMinDays of the window), fastest first on ties.
+// An empty result keeps the old list: a quiet spell shouldn't forget seeds that worked
+func (dht *DHT) refreshPersonalSeeds() (int, error) {
+	now := time.Now()
+	days, err := dht.storage.GetAttestationDays(dht.localSystem.ID, now.Add(-PersonalSeedWindow).Unix())
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := now.Add(-VerificationCutoff)
+	var candidates []*CachedSystem
+	for _, cached := range dht.routingTable.GetAllRoutingTableNodesWithMeta() {
+		if cached.System.PeerAddress == "" || days[cached.System.ID] < PersonalSeedMinDays {
+			continue
+		}
+		if cachedPeerStatus(cached, cutoff).state != PeerActive {
+			continue
+		}
+		candidates = append(candidates, cached)
+	}
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		di, dj := days[candidates[i].System.ID], days[candidates[j].System.ID]
+		if di != dj {
+			return di > dj
+		}
+		li, lj := candidates[i].Latency, candidates[j].Latency
+		if (li == 0) != (lj == 0) {
+			return lj == 0 // Measured before unmeasured
+		}
+		return li < lj
+	})
+	if len(candidates) > PersonalSeedCount {
+		candidates = candidates[:PersonalSeedCount]
+	}
+
+	seeds := make([]PersonalSeed, len(candidates))
+	for i, cached := range candidates {
+		seeds[i] = PersonalSeed{
+			SystemID:   cached.System.ID,
+			Address:    cached.System.PeerAddress,
+			DaysSeen:   days[cached.System.ID],
+			PromotedAt: now.Unix(),
+		}
+	}
+	return len(seeds), dht.storage.SavePersonalSeeds(seeds)
+}
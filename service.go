@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Running under a service manager: /healthz and /readyz for watchdogs and load balancers,
+// systemd's notify protocol when NOTIFY_SOCKET is set (READY=1 once bootstrap finished,
+// WATCHDOG=1 while /healthz would answer 200), and -install-service to write the unit
+// file or register the Windows service with the flags the node was started with.
+const (
+	// MaintenanceStallAfter is how long the liveness loop may go without finishing a run
+	// before the node counts as stuck (it runs every LivenessTickInterval)
+	MaintenanceStallAfter = 5 * LivenessTickInterval
+
+	// livenessStartDelay is how long the liveness loop waits for bootstrap before its first run
+	livenessStartDelay = 30 * time.Second
+
+	// ServiceName is the unit or Windows service name (with the profile appended, if any)
+	ServiceName = "stellar-lab"
+)
+
+// ServiceHealth is the /healthz and /readyz response
+type ServiceHealth struct {
+	Status          string   `json:"status"` // "ok" or "unhealthy" (/healthz), "ready" or "starting" (/readyz)
+	Health          string   `json:"health"` // The routing table classification, as in /api/status
+	DHTListening    bool     `json:"dht_listening"`
+	LastMaintenance int64    `json:"last_maintenance,omitempty"` // When the liveness loop last finished a run
+	ReadyAt         int64    `json:"ready_at,omitempty"`
+	Problems        []string `json:"problems,omitempty"`
+}
+
+// Liveness reports whether the node is up and its maintenance loops aren't stuck
+// It touches no storage, so a watchdog can call it as often as it likes
+func (dht *DHT) Liveness(now time.Time) ServiceHealth {
+	h := ServiceHealth{
+		Status:       "ok",
+		Health:       NodeHealth(dht.routingTable.GetRoutingTableSize()).String(),
+		DHTListening: dht.listening.Load(),
+		ReadyAt:      dht.readyAt.Load(),
+	}
+	if !h.DHTListening {
+		h.Problems = append(h.Problems, "DHT port not being served")
+	}
+
+	since := dht.startTime.Add(livenessStartDelay)
+	if t := dht.tasks.get(TaskLiveness); t != nil {
+		if s := t.status(); s.LastEnd > 0 {
+			h.LastMaintenance = s.LastEnd
+			since = time.Unix(s.LastEnd, 0)
+		}
+	}
+	if stalled := now.Sub(since); stalled > MaintenanceStallAfter {
+		h.Problems = append(h.Problems, fmt.Sprintf("liveness loop hasn't finished a run in %s", stalled.Round(time.Second)))
+	}
+
+	if len(h.Problems) > 0 {
+		h.Status = "unhealthy"
+	}
+	return h
+}
+
+// Readiness reports whether bootstrap has finished, successfully or not
+func (dht *DHT) Readiness() ServiceHealth {
+	h := ServiceHealth{
+		Status:       "starting",
+		Health:       NodeHealth(dht.routingTable.GetRoutingTableSize()).String(),
+		DHTListening: dht.listening.Load(),
+		ReadyAt:      dht.readyAt.Load(),
+	}
+	if h.ReadyAt > 0 {
+		h.Status = "ready"
+	}
+	return h
+}
+
+// MarkReady records that bootstrap finished, or was skipped, and tells systemd
+func (dht *DHT) MarkReady() {
+	if !dht.readyAt.CompareAndSwap(0, time.Now().Unix()) {
+		return
+	}
+	rtSize := dht.routingTable.GetRoutingTableSize()
+	sdNotify(fmt.Sprintf("READY=1\nSTATUS=%s, %d peers", NodeHealth(rtSize), rtSize))
+}
+
+// handleHealthz answers 200 while the node is alive (see Liveness), 503 otherwise
+func (w *WebInterface) handleHealthz(rw http.ResponseWriter, r *http.Request) {
+	h := w.dht.Liveness(time.Now())
+	writeServiceHealth(rw, h, len(h.Problems) == 0)
+}
+
+// handleReadyz answers 200 once bootstrap has finished, 503 before
+func (w *WebInterface) handleReadyz(rw http.ResponseWriter, r *http.Request) {
+	h := w.dht.Readiness()
+	writeServiceHealth(rw, h, h.ReadyAt > 0)
+}
+
+func writeServiceHealth(rw http.ResponseWriter, h ServiceHealth, ok bool) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(h)
+}
+
+// sdNotify sends a state change to systemd; without NOTIFY_SOCKET it does nothing
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // Abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("sd_notify: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("sd_notify: %v", err)
+	}
+}
+
+// sdWatchdogInterval is how often systemd wants WATCHDOG=1 (half its WatchdogSec),
+// or 0 when the watchdog isn't enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// waitForShutdown blocks until ctx is done, pinging systemd's watchdog meanwhile for
+// as long as the node is alive; a stuck node stops pinging and systemd restarts it
+func waitForShutdown(ctx context.Context, dht *DHT) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		<-ctx.Done()
+		sdNotify("STOPPING=1")
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			sdNotify("STOPPING=1")
+			return
+		case now := <-ticker.C:
+			if h := dht.Liveness(now); len(h.Problems) == 0 {
+				sdNotify("WATCHDOG=1")
+			} else {
+				log.Printf("Not pinging the systemd watchdog: %s", strings.Join(h.Problems, "; "))
+			}
+		}
+	}
+}
+
+// serviceArgs is the command line to install: ours without -install-service, with
+// relative paths made absolute since the service won't start in this directory
+func serviceArgs(args []string) ([]string, error) {
+	pathFlags := map[string]bool{"db": true, "data-dir": true, "config": true, "dev-assets": true, "import-peers": true}
+
+	var out []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		switch {
+		case !strings.HasPrefix(arg, "-"):
+			out = append(out, arg)
+		case name == "install-service":
+			continue
+		case pathFlags[name]:
+			if !hasValue {
+				if i+1 >= len(args) {
+					return nil, fmt.Errorf("-%s needs a value", name)
+				}
+				i++
+				value = args[i]
+			}
+			abs, err := filepath.Abs(value)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, "-"+name, abs)
+		default:
+			out = append(out, arg)
+		}
+	}
+	return out, nil
+}
+
+// serviceName is the service's name, one per profile so profiles install side by side
+func serviceName(profile string) string {
+	if profile == "" {
+		return ServiceName
+	}
+	return ServiceName + "-" + profile
+}
+
+// runInstallService installs the node as a service with the current flags and
+// returns the exit code
+func runInstallService(profile string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: can't find this executable: %v\n", err)
+		return 1
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: can't find this executable: %v\n", err)
+		return 1
+	}
+	args, err := serviceArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if err := installService(serviceName(profile), exe, args); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Answering full-sync and discovery requests is the expensive work of bootstrapping
+// newcomers, and uptime attestations don't reward it. A requester that got a complete
+// answer signs a service receipt for the server: a service_receipt message whose
+// attestation names what was served. Receipts are stored like any other attestation and
+// earn the server a little credit each, capped per requester per day and scaled down for
+// identities we bound only recently, so receipts farmed from fresh sybils are worth little.
+
+// Service receipt attestation types
+const (
+	AttestationFullSyncServed  = "full_sync_served"
+	AttestationDiscoveryServed = "discovery_served"
+)
+
+// ServiceReceiptCredits is what one receipt of each type is worth from a mature identity
+var ServiceReceiptCredits = map[string]float64{
+	AttestationFullSyncServed:  0.25,
+	AttestationDiscoveryServed: 0.1,
+}
+
+const (
+	// ServiceReceiptDailyCap is the most one requester's receipts earn per UTC day
+	ServiceReceiptDailyCap = 0.25
+
+	// ReceiptIdentityMaturity is how long after we bound a requester's identity its
+	// receipts count in full; until then they rise from ReceiptNewIdentityWeight
+	ReceiptIdentityMaturity  = 7 * 24 * time.Hour
+	ReceiptNewIdentityWeight = 0.25
+)
+
+// isServiceReceipt reports whether an attestation type is a service receipt
+func isServiceReceipt(messageType string) bool {
+	_, ok := ServiceReceiptCredits[messageType]
+	return ok
+}
+
+// withoutServiceReceipts drops service receipts, which are credited apart from uptime
+func withoutServiceReceipts(attestations []*Attestation) []*Attestation {
+	kept := attestations[:0:0]
+	for _, att := range attestations {
+		if !isServiceReceipt(att.MessageType) {
+			kept = append(kept, att)
+		}
+	}
+	return kept
+}
+
+// receiptWeight scales a receipt by how long its signer's identity had been bound
+func receiptWeight(age int64) float64 {
+	maturity := int64(ReceiptIdentityMaturity.Seconds())
+	if age >= maturity {
+		return 1
+	}
+	if age < 0 {
+		age = 0
+	}
+	return ReceiptNewIdentityWeight + (1-ReceiptNewIdentityWeight)*float64(age)/float64(maturity)
+}
+
+// serviceCredits is what the receipts since LastCalculation earn
+// Receipts are taken oldest first; the earlier ones of the day were credited before and
+// only use up their signer's daily cap
+func (cc *CreditCalculator) serviceCredits(input CalculationInput) float64 {
+	type requesterDay struct {
+		id  uuid.UUID
+		day int64
+	}
+	used := make(map[requesterDay]float64)
+
+	total := 0.0
+	for _, r := range input.ServiceReceipts {
+		boundAt, bound := input.ReceiptIdentities[r.FromSystemID]
+		if !bound || r.FromSystemID == r.ToSystemID || !r.Verify() {
+			continue
+		}
+		key := requesterDay{r.FromSystemID, r.LocalTime() / 86400}
+		credit := min(ServiceReceiptCredits[r.MessageType]*receiptWeight(r.LocalTime()-boundAt),
+			ServiceReceiptDailyCap-used[key])
+		if credit <= 0 {
+			continue
+		}
+		used[key] += credit
+		if r.LocalTime() > input.LastCalculation && input.inWindow(r.LocalTime()) {
+			total += credit
+		}
+	}
+	return total
+}
+
+// serviceReceiptsSince loads the receipts sent to us since the start of the UTC day of
+// since, with when each signer's identity was bound (receipts from unbound ones are left out)
+func (dht *DHT) serviceReceiptsSince(since int64) ([]*Attestation, map[uuid.UUID]int64, error) {
+	dayStart := time.Unix(since, 0).UTC().Truncate(24 * time.Hour).Unix()
+	receipts, err := dht.storage.GetServiceReceiptsSince(dht.localSystem.ID, dayStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identities := make(map[uuid.UUID]int64)
+	for _, r := range receipts {
+		if _, ok := identities[r.FromSystemID]; ok {
+			continue
+		}
+		boundAt, err := dht.storage.GetIdentityFirstSeen(r.FromSystemID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if boundAt > 0 {
+			identities[r.FromSystemID] = boundAt
+		}
+	}
+	return receipts, identities, nil
+}
+
+// sendServiceReceipt thanks a server for a completed full-sync or discovery exchange
+func (dht *DHT) sendServiceReceipt(serverID uuid.UUID, address, served string) {
+	if serverID == uuid.Nil || serverID == dht.localSystem.ID || !dht.peerSupports(serverID, CapServiceReceipt) {
+		return
+	}
+	msg, err := NewServiceReceiptRequest(dht.localSystem, serverID, served, "")
+	if err != nil {
+		return
+	}
+	if _, err := dht.sendRequest(address, msg); err != nil {
+		log.Printf("  Couldn't send a %s receipt to %s: %v", served, address, err)
+	}
+}
+
+// handleServiceReceipt acknowledges a receipt; its attestation was stored on arrival
+func (dht *DHT) handleServiceReceipt(msg *DHTMessage) (*DHTMessage, error) {
+	if msg.Attestation.ToSystemID != dht.localSystem.ID {
+		return nil, &DHTError{Code: ErrCodeInvalidAttestation, Message: "service receipt names another system"}
+	}
+	log.Printf("%s receipt from %s (%s)", msg.Attestation.MessageType, msg.FromSystem.Name, msg.FromSystem.ID)
+	return NewServiceReceiptResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+}
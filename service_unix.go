@@ -0,0 +1,94 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// SystemdUnitDir is where -install-service writes the unit file
+const SystemdUnitDir = "/etc/systemd/system"
+
+// shutdownContext is done once the node is asked to stop
+func shutdownContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// installService writes a systemd unit running exe with args from the current directory
+func installService(name, exe string, args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	unit := systemdUnit(name, exe, args, wd, os.Getenv("SUDO_USER"), os.Environ())
+
+	path := filepath.Join(SystemdUnitDir, name+".service")
+	if err := os.WriteFile(path, []byte(unit), 0644); err != nil {
+		if os.IsPermission(err) {
+			return fmt.Errorf("can't write %s (run -install-service with sudo): %w", path, err)
+		}
+		return err
+	}
+
+	fmt.Printf("Wrote %s\n", path)
+	fmt.Printf("Start it now and at every boot with:\n  sudo systemctl daemon-reload && sudo systemctl enable --now %s\n", name)
+	fmt.Printf("Follow its log with:\n  journalctl -u %s -f\n", name)
+	return nil
+}
+
+// systemdUnit is the unit file for the node: Type=notify so systemd knows when bootstrap
+// finished, and a watchdog that restarts it once the liveness loop stalls
+// user is who it runs as ("" = root); STELLAR_ variables in environ are carried over
+func systemdUnit(name, exe string, args []string, dir, user string, environ []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=Stellar Lab node (%s)\n", name)
+	fmt.Fprintf(&b, "Wants=network-online.target\n")
+	fmt.Fprintf(&b, "After=network-online.target\n\n")
+
+	fmt.Fprintf(&b, "[Service]\n")
+	fmt.Fprintf(&b, "Type=notify\n")
+	fmt.Fprintf(&b, "NotifyAccess=main\n")
+	exec := []string{systemdQuote(exe)}
+	for _, arg := range args {
+		exec = append(exec, systemdQuote(arg))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(exec, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", systemdQuote(dir))
+	if user != "" {
+		fmt.Fprintf(&b, "User=%s\n", user)
+	}
+	var env []string
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "STELLAR_") {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	for _, kv := range env {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(kv))
+	}
+	// Bootstrap may wait on LAN peers and seeds before READY=1
+	fmt.Fprintf(&b, "TimeoutStartSec=5min\n")
+	fmt.Fprintf(&b, "TimeoutStopSec=%d\n", int((3 * ShutdownTimeout).Seconds()))
+	fmt.Fprintf(&b, "WatchdogSec=%d\n", int((2 * MaintenanceStallAfter).Seconds()))
+	fmt.Fprintf(&b, "Restart=on-failure\n")
+	fmt.Fprintf(&b, "RestartSec=10\n\n")
+
+	fmt.Fprintf(&b, "[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes s for a unit file, where % and $ would otherwise be expanded
+func systemdQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `%`, `%%`, `$`, `$$`)
+	return `"` + r.Replace(s) + `"`
+}
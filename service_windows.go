@@ -0,0 +1,96 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// shutdownContext is done once the node is asked to stop: by Ctrl-C, or by the service
+// control manager when running as a Windows service
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		if err := svc.Run(ServiceName, &windowsService{stop: cancel}); err != nil {
+			log.Printf("Windows service: %v", err)
+		}
+		cancel()
+	}()
+	return ctx, func() { cancel(); stop() }
+}
+
+// windowsService reports the node running to the service control manager and turns its
+// stop and shutdown requests into a shutdown
+type windowsService struct {
+	stop context.CancelFunc
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			changes <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((ShutdownTimeout * 3) / time.Millisecond)}
+			s.stop()
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// installService registers a Windows service running exe with args, started at boot
+// and restarted if it exits unexpectedly
+func installService(name, exe string, args []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("can't reach the service manager (run -install-service as Administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists (remove it with: sc.exe delete %s)", name, name)
+	}
+
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName:      "Stellar Lab node (" + name + ")",
+		Description:      "Stellar Lab star system node",
+		StartType:        mgr.StartAutomatic,
+		DelayedAutoStart: true, // After the network is up
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 10 * time.Second}
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32((24 * time.Hour).Seconds())); err != nil {
+		log.Printf("Warning: couldn't set %s to restart on failure: %v", name, err)
+	}
+
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "STELLAR_") {
+			fmt.Printf("Note: services don't see %s; pass it as a flag or in the config file instead\n", strings.SplitN(kv, "=", 2)[0])
+		}
+	}
+	fmt.Printf("Registered service %s\n", name)
+	fmt.Printf("Start it now with:\n  sc.exe start %s\n", name)
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// SignedInfoMinVersion is the first protocol version that signs its own system info
+// Senders at or above this version must include InfoSignature on FromSystem;
+// older senders are still accepted unsigned during the transition
+var SignedInfoMinVersion = ProtocolVersion{Major: 1, Minor: 10, Patch: 0}
+
+// GetInfoSignableMessage returns the canonical serialization an owner signs over
+// the fields that gossip can overwrite. Only fields carried by both DHT messages
+// and full-sync are included, so a relayed copy can always be re-verified.
+// Fields added since are omitempty: info that leaves them at their zero value signs
+// the same bytes as before, so older nodes still verify it. The derivation versions
+// sign as 0 while they're v1, which 0 already means.
+//
+// Only the primary star class is signed: the rest of the stars (companions, colors,
+// descriptions) follow from the UUID and the signed StarsVersion, and the cache replaces
+// whatever a relay sent with that (see canonicalStars). Not covered by this signature:
+//   - SponsorID: checked against the coordinates when the owner contacts us directly,
+//     but a relayed copy can carry any. Signing it would change the bytes of every
+//     sponsored system, which older nodes would then refuse
+//   - GenesisDemotion and Profile: signed on their own
+//   - ProcessStartTime: only taken first-hand, never relayed
+//   - CreatedAt, LastSeenAt and Address: not used for anything peers rely on
+func (s *System) GetInfoSignableMessage() []byte {
+	msg := struct {
+		ID            string  `json:"id"`
+		Name          string  `json:"name"`
+		X             float64 `json:"x"`
+		Y             float64 `json:"y"`
+		Z             float64 `json:"z"`
+		PeerAddress   string  `json:"peer_address"`
+		InfoVersion   int64   `json:"info_version"`
+		StarClass     string  `json:"star_class"`
+		PeerTLS       bool    `json:"peer_tls,omitempty"`      // A relay stripping it would push us onto plain HTTP
+		StarsVersion  int     `json:"stars_version,omitempty"` // Pins the derivation the rest of the stars come from
+		CoordsVersion int     `json:"coords_version,omitempty"`
+	}{
+		ID:            s.ID.String(),
+		Name:          s.Name,
+		X:             s.X,
+		Y:             s.Y,
+		Z:             s.Z,
+		PeerAddress:   s.PeerAddress,
+		InfoVersion:   s.InfoVersion,
+		StarClass:     s.Stars.Primary.Class,
+		PeerTLS:       s.PeerTLS,
+		StarsVersion:  signedDerivation(s.StarsVersion),
+		CoordsVersion: signedDerivation(s.CoordsVersion),
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// signedDerivation is how a derivation version is signed: v1 as 0, its unrecorded form
+func signedDerivation(version int) int {
+	if version <= 1 {
+		return 0
+	}
+	return version
+}
+
+// SignInfo signs the current info with our private key
+// Must be called after any change to a signed field (see GetInfoSignableMessage)
+func (s *System) SignInfo() {
+	if s.Keys == nil {
+		return
+	}
+	sig := ed25519.Sign(s.Keys.PrivateKey, s.GetInfoSignableMessage())
+	s.InfoSignature = base64.StdEncoding.EncodeToString(sig)
+}
+
+// VerifyInfo checks InfoSignature against the owner's public key (base64)
+func (s *System) VerifyInfo(publicKey string) bool {
+	if s.InfoSignature == "" {
+		return false
+	}
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pubKeyBytes) != ed25519.PublicKeySize {
+		return false
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(s.InfoSignature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pubKeyBytes, s.GetInfoSignableMessage(), sigBytes)
+}
+
+// BumpInfoVersion marks our info as changed and re-signs it
+// InfoVersion is wall-clock milliseconds but never moves backwards
+func (s *System) BumpInfoVersion() {
+	v := time.Now().UnixMilli()
+	if v <= s.InfoVersion {
+		v = s.InfoVersion + 1
+	}
+	s.InfoVersion = v
+	s.SignInfo()
+}
+
+// requiresSignedInfo reports whether the sender of a message must sign its info: it says it
+// does, or its version is recent enough to (so leaving signed-info off the list doesn't help)
+func requiresSignedInfo(msg *DHTMessage) bool {
+	return msg.PeerCapabilities().Has(CapSignedInfo) || legacyCapabilities(msg.Version).Has(CapSignedInfo)
+}
+
+// acceptInfo decides whether gossiped info for a system may enter the cache
+// - No identity binding yet: accept (nothing to check against; first contact binds the key)
+// - Signed: the signature must verify against the bound key, and the binding remembers it
+// - Unsigned: only while we've never seen signed info for that system (legacy owner)
+// The binding keeps that across cache evictions and restarts. A sender that lists
+// signed-info (or is new enough to) must sign the info it sends (see Validate), so it's
+// marked the first time we hear from it
+func (rt *RoutingTable) acceptInfo(sys *System, existing *CachedSystem) bool {
+	if rt.storage == nil {
+		return true
+	}
+
+	publicKey, signsInfo, err := rt.storage.GetInfoBinding(sys.ID)
+	if err != nil || publicKey == "" {
+		return true
+	}
+
+	if sys.InfoSignature != "" {
+		if !sys.VerifyInfo(publicKey) {
+			return false
+		}
+		if !signsInfo {
+			if err := rt.storage.MarkSignsInfo(sys.ID); err != nil {
+				log.Printf("Failed to record that %s signs its info: %v", sys.ID.String()[:8], err)
+			}
+		}
+		return true
+	}
+
+	// The owner has upgraded - unsigned info about them is stale or forged
+	return !signsInfo && (existing == nil || existing.System.InfoSignature == "")
+}
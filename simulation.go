@@ -0,0 +1,7143 @@
+//go:build simulation
+
+package main
+
+// In-process simulation: N full nodes (real DHTs on ephemeral ports, each with its
+// own database) in one process, and scenarios that drive them.
+//
+//	go run -tags simulation . -simulate [-v] [scenario ...]
+//
+// Exits non-zero if any scenario fails. -v shows the nodes' logs.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SimulationTimeout bounds each scenario, so a whole run stays well under a minute
+const SimulationTimeout = 15 * time.Second
+
+func init() {
+	if len(os.Args) < 2 || os.Args[1] != "-simulate" {
+		return
+	}
+	os.Exit(runSimulations(os.Args[2:]))
+}
+
+// TestGalaxy is a set of in-process nodes sharing a temp directory
+type TestGalaxy struct {
+	Nodes []*TestNode
+	dir   string
+}
+
+// TestNode is one node of a TestGalaxy
+type TestNode struct {
+	System  *System
+	DHT     *DHT
+	Storage *Storage
+	Address string // DHT address (host:port)
+
+	stopped bool
+}
+
+// NewTestGalaxy starts n unconnected nodes; node 0 is the genesis black hole
+// Nodes get their sponsor (and coordinates) from the first node they connect to
+func NewTestGalaxy(n int) (*TestGalaxy, error) {
+	isolated := true
+	isolatedMode = &isolated
+
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return nil, err
+	}
+	g := &TestGalaxy{dir: dir}
+
+	for i := 0; i < n; i++ {
+		node, err := g.startNode(fmt.Sprintf("Sim-%d", i))
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("node %d: %w", i, err)
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+	g.Nodes[0].DHT.becomeGenesisNode()
+	return g, nil
+}
+
+// startNode creates a system the way main does and starts its DHT
+// Temp-file databases rather than :memory:, whose single connection serves reads too
+func (g *TestGalaxy) startNode(name string) (*TestNode, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	return g.startNodeAt(name, fmt.Sprintf("127.0.0.1:%d", port))
+}
+
+// startNodeAt is startNode on a given address
+func (g *TestGalaxy) startNodeAt(name, address string) (*TestNode, error) {
+	storage, err := NewStorage(filepath.Join(g.dir, name+".db"))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	system := &System{
+		ID:          uuid.New(),
+		Name:        name,
+		CreatedAt:   time.Now(),
+		LastSeenAt:  time.Now(),
+		Address:     address,
+		PeerAddress: address,
+		Keys:        keys,
+	}
+	system.GenerateMultiStarSystem()
+	system.BumpInfoVersion()
+	if err := storage.SaveSystem(system); err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	dht := NewDHT(system, storage, address)
+	if err := dht.Start(); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return &TestNode{System: system, DHT: dht, Storage: storage, Address: address}, nil
+}
+
+// freePort finds a port nothing is listening on
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Connect has node i contact node j, as bootstrapping from it would
+// A node without a sponsor takes j as its sponsor
+func (g *TestGalaxy) Connect(i, j int) error {
+	from, to := g.Nodes[i], g.Nodes[j]
+	if from.System.SponsorID == nil && from.System.Stars.Primary.Class != "X" {
+		return from.DHT.bootstrapFromPeer(to.Address)
+	}
+	sys, err := from.DHT.Ping(to.Address)
+	if err != nil {
+		return err
+	}
+	from.DHT.updateRoutingTable(sys)
+	from.DHT.routingTable.MarkVerified(sys.ID)
+	return nil
+}
+
+// ReplaceNode stops node i and starts a new system (new UUID, fresh database) on its
+// address, as when a DHCP lease moves to another machine. Returns the new node's index
+func (g *TestGalaxy) ReplaceNode(i int) (int, error) {
+	old := g.Nodes[i]
+	old.Stop()
+	node, err := g.startNodeAt(fmt.Sprintf("Sim-%d", len(g.Nodes)), old.Address)
+	if err != nil {
+		return 0, err
+	}
+	g.Nodes = append(g.Nodes, node)
+	return len(g.Nodes) - 1, nil
+}
+
+// MoveNode restarts node i listening on every interface of its port, then has it advertise
+// 127.0.0.2 instead of 127.0.0.1, as when a router gets a new public IP under a running node
+func (g *TestGalaxy) MoveNode(i int) error {
+	old := g.Nodes[i]
+	old.Stop()
+	storage, err := NewStorage(filepath.Join(g.dir, old.System.Name+".db"))
+	if err != nil {
+		return err
+	}
+	system, err := storage.LoadSystem()
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	_, port, err := net.SplitHostPort(old.Address)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+
+	dht := NewDHT(system, storage, ":"+port)
+	if err := dht.Start(); err != nil {
+		storage.Close()
+		return err
+	}
+	address := net.JoinHostPort("127.0.0.2", port)
+	g.Nodes[i] = &TestNode{System: system, DHT: dht, Storage: storage, Address: address}
+	dht.moveAdvertisedAddress(address)
+	return nil
+}
+
+// RestartNode stops node i and starts its system again from storage on the same address,
+// as restarting the binary with different flags would; setup runs before the DHT starts
+func (g *TestGalaxy) RestartNode(i int, setup func(*DHT) error) error {
+	old := g.Nodes[i]
+	old.Stop()
+	storage, err := NewStorage(filepath.Join(g.dir, old.System.Name+".db"))
+	if err != nil {
+		return err
+	}
+	system, err := storage.LoadSystem()
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	system.BumpInfoVersion()
+
+	dht := NewDHT(system, storage, old.Address)
+	if err := setup(dht); err != nil {
+		storage.Close()
+		return err
+	}
+	if err := dht.Start(); err != nil {
+		storage.Close()
+		return err
+	}
+	g.Nodes[i] = &TestNode{System: system, DHT: dht, Storage: storage, Address: old.Address}
+	return nil
+}
+
+// ConnectChain connects each node to the one before it: 0 - 1 - 2 - ...
+func (g *TestGalaxy) ConnectChain() error {
+	for i := 1; i < len(g.Nodes); i++ {
+		if err := g.Connect(i, i-1); err != nil {
+			return fmt.Errorf("connecting %d to %d: %w", i, i-1, err)
+		}
+	}
+	return nil
+}
+
+// ConnectStar connects every other node to the hub
+func (g *TestGalaxy) ConnectStar(hub int) error {
+	for i := range g.Nodes {
+		if i == hub {
+			continue
+		}
+		if err := g.Connect(i, hub); err != nil {
+			return fmt.Errorf("connecting %d to %d: %w", i, hub, err)
+		}
+	}
+	return nil
+}
+
+// WaitForConvergence polls predicate until it holds, or fails after timeout
+func (g *TestGalaxy) WaitForConvergence(predicate func() bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !predicate() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no convergence after %v", timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+// Close stops every node still running and removes the databases
+func (g *TestGalaxy) Close() {
+	for _, node := range g.Nodes {
+		node.Stop()
+	}
+	os.RemoveAll(g.dir)
+}
+
+// RoutingTable returns the node's routing table (and system cache)
+func (n *TestNode) RoutingTable() *RoutingTable {
+	return n.DHT.GetRoutingTable()
+}
+
+// Stop shuts the node down; it stops answering peers immediately
+func (n *TestNode) Stop() {
+	if n.stopped {
+		return
+	}
+	n.stopped = true
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n.DHT.Stop(ctx)
+	n.Storage.Close()
+}
+
+// edge returns from -> to as the node's /api/connections has it, or nil
+func (n *TestNode) edge(from, to *TestNode) *TopologyEdge {
+	for _, e := range n.DHT.GetConnections() {
+		if e.FromID == from.System.ID.String() && e.ToID == to.System.ID.String() {
+			return &e
+		}
+	}
+	return nil
+}
+
+// === Scenarios ===
+
+// simulationScenarios are run in name order
+var simulationScenarios = map[string]func() error{
+	"address-move":        simulateAddressMove,
+	"address-probe":       simulateAddressProbe,
+	"address-reuse":       simulateAddressReuse,
+	"advisor":             simulateAdvisor,
+	"annotations":         simulateAnnotations,
+	"attestation-batch":   simulateAttestationBatch,
+	"bandwidth":           simulateBandwidth,
+	"bridge-score":        simulateBridgeScore,
+	"bucket-refresh":      simulateBucketRefresh,
+	"cache-limit":         simulateCacheLimit,
+	"clock-skew":          simulateClockSkew,
+	"compression":         simulateCompression,
+	"config":              simulateConfig,
+	"connection-writes":   simulateConnectionWrites,
+	"constellation":       simulateConstellation,
+	"coordinates":         simulateCoordinates,
+	"credit-proof":        simulateCreditProof,
+	"credit-restart":      simulateCreditRestart,
+	"credit-verify":       simulateCreditVerify,
+	"diagnostics":         simulateDiagnostics,
+	"double-spend":        simulateDoubleSpend,
+	"edge-strength":       simulateEdgeStrength,
+	"fingerprint-salt":    simulateFingerprintSalt,
+	"forged-response":     simulateForgedResponse,
+	"genesis":             simulateGenesis,
+	"ghost-gossip":        simulateGhostGossip,
+	"ghost-peer":          simulateGhostPeer,
+	"info-hijack":         simulateInfoHijack,
+	"key-rotation":        simulateKeyRotation,
+	"latency":             simulateLatency,
+	"leaderboard":         simulateLeaderboard,
+	"legacy-attestations": simulateLegacyAttestations,
+	"local-peers":         simulateLocalPeers,
+	"lookup":              simulateLookup,
+	"map-filter":          simulateMapFilter,
+	"messages":            simulateMessages,
+	"migrations":          simulateMigrations,
+	"multi-star":          simulateMultiStar,
+	"operator-profile":    simulateOperatorProfile,
+	"partition":           simulatePartition,
+	"peer-addresses":      simulatePeerAddresses,
+	"peer-connect":        simulatePeerConnect,
+	"peer-import":         simulatePeerImport,
+	"peer-state":          simulatePeerState,
+	"peer-tls":            simulatePeerTLS,
+	"peer-traffic":        simulatePeerTraffic,
+	"process-uptime":      simulateProcessUptime,
+	"public-ui":           simulatePublicUI,
+	"reciprocity":         simulateReciprocity,
+	"rejections":          simulateRejections,
+	"replay":              simulateReplay,
+	"retention":           simulateRetention,
+	"retraction":          simulateRetraction,
+	"seeds":               simulateSeeds,
+	"service":             simulateService,
+	"service-receipts":    simulateServiceReceipts,
+	"signed-derivation":   simulateSignedDerivation,
+	"slow-peers":          simulateSlowPeers,
+	"sponsor-chain":       simulateSponsorChain,
+	"sqlite-contention":   simulateSQLiteContention,
+	"star-derivation":     simulateStarDerivation,
+	"star-roles":          simulateStarRoles,
+	"stats-api":           simulateStatsAPI,
+	"system-json":         simulateSystemJSON,
+	"template-escaping":   simulateTemplateEscaping,
+	"transfers":           simulateTransfers,
+	"version-matrix":      simulateVersionMatrix,
+}
+
+// bodyRecorder keeps a copy of everything a handler writes
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (br *bodyRecorder) Write(p []byte) (int, error) {
+	br.body.Write(p)
+	return br.ResponseWriter.Write(p)
+}
+
+// simulateAdvisor: hub H has leaves A and B, and has cached Vega (reported with 2 peers,
+// 50 units away), Altair (1 peer, 500 away), Busy (5 peers, 30 away), Faded (1 peer, but
+// reported 7 hours ago), Unchecked (coordinates unchecked) and Quiet (never reported).
+// Only Vega and Altair are suggested, nearest first, and the report says how old its
+// reports are. Once H's slots are 80% taken, its peer Crowded (over its capacity) is
+// pointed out while Roomy (one short) isn't. Working the suggestions out connects to nobody
+func simulateAdvisor() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub := g.Nodes[0]
+	rt := hub.RoutingTable()
+
+	// Whatever bootstrapping reported is replaced by the fixture
+	if _, err := hub.Storage.db.Exec("DELETE FROM peer_connections"); err != nil {
+		return err
+	}
+	port := 1
+	place := func(name string, distance float64) *System {
+		sys := &System{ID: uuid.New(), Name: name, PeerAddress: fmt.Sprintf("127.0.0.1:%d", port),
+			X: hub.System.X + distance, Y: hub.System.Y, Z: hub.System.Z}
+		sys.Stars = assignStarFromClass("M")
+		port++
+		rt.CacheSystem(sys, hub.System.ID, false) // Gossip only: never contacted
+		return rt.GetCachedSystem(sys.ID)         // Companions, which add slots, come from the UUID
+	}
+	others := func(n int) []uuid.UUID {
+		ids := make([]uuid.UUID, n)
+		for i := range ids {
+			ids[i] = uuid.New()
+		}
+		return ids
+	}
+	vega, altair, busy := place("Vega", 50), place("Altair", 500), place("Busy", 30)
+	faded, unchecked := place("Faded", 20), place("Unchecked", 10)
+	place("Quiet", 5)
+	rt.SetCoordsUnverified(unchecked.ID, true)
+	for sys, peers := range map[*System]int{vega: 2, altair: 1, busy: 5, unchecked: 0} {
+		if err := hub.Storage.SavePeerConnections(sys.ID, others(peers)); err != nil {
+			return err
+		}
+	}
+	if err := hub.Storage.SavePeerConnections(uuid.New(), []uuid.UUID{unchecked.ID}); err != nil {
+		return err
+	}
+	if err := hub.Storage.savePeerConnectionsAt(faded.ID, others(1), time.Now().Add(-7*time.Hour)); err != nil {
+		return err
+	}
+
+	report, err := hub.DHT.computeAdvice(time.Now())
+	if err != nil {
+		return err
+	}
+	if len(report.Suggestions) != 2 || report.Suggestions[0].SystemID != vega.ID.String() || report.Suggestions[1].SystemID != altair.ID.String() {
+		return fmt.Errorf("suggested %+v, want Vega then Altair", report.Suggestions)
+	}
+	s := report.Suggestions[0]
+	want := fmt.Sprintf("You are at 2/%d peers; Vega (2 connections, 50 units away) would benefit from a connection", hub.System.GetMaxPeers())
+	if s.Kind != AdviceConnect || s.Connections != 2 || s.Message != want || s.ID != AdviceConnect+":"+vega.ID.String() {
+		return fmt.Errorf("Vega's suggestion is %+v, want %q", s, want)
+	}
+	if report.WindowHours != AdvisorTopologyMaxAge.Hours() || report.OldestReport == 0 || time.Since(time.Unix(report.OldestReport, 0)) > time.Minute {
+		return fmt.Errorf("report covers %.0f hours from %d, want %.0f from just now", report.WindowHours, report.OldestReport, AdvisorTopologyMaxAge.Hours())
+	}
+
+	// Fill H's slots to the advisor's pressure with far peers, two of them near capacity
+	crowded, roomy := place("Crowded", 2000), place("Roomy", 2000)
+	capacity := crowded.GetMaxPeers()
+	if err := hub.Storage.SavePeerConnections(crowded.ID, others(capacity)); err != nil {
+		return err
+	}
+	if err := hub.Storage.SavePeerConnections(roomy.ID, others(roomy.GetMaxPeers()-2)); err != nil {
+		return err
+	}
+	rt.MarkVerified(crowded.ID)
+	rt.MarkVerified(roomy.ID)
+	for i := 0; float64(rt.GetRoutingTableSize()) < AdvisorPressure*float64(hub.System.GetMaxPeers()); i++ {
+		rt.MarkVerified(place(fmt.Sprintf("Filler-%d", i), 3000).ID)
+	}
+	peers := rt.GetRoutingTableSize()
+
+	if _, err := hub.DHT.refreshAdvice(); err != nil {
+		return err
+	}
+	report, err = hub.DHT.GetAdvice()
+	if err != nil {
+		return err
+	}
+	var over []AdvisorSuggestion
+	for _, s := range report.Suggestions {
+		if s.Kind == AdviceOverConnected {
+			over = append(over, s)
+		}
+	}
+	if len(over) != 1 || over[0].SystemID != crowded.ID.String() || over[0].Connections != capacity+1 {
+		return fmt.Errorf("over-connected %+v, want only Crowded with %d connections", over, capacity+1)
+	}
+
+	// Suggestions only: nobody was contacted or added
+	if rt.GetRoutingTableSize() != peers || rt.IsRoutingTablePeer(vega.ID) || rt.IsRoutingTablePeer(altair.ID) {
+		return fmt.Errorf("working out suggestions changed the routing table")
+	}
+
+	web := &WebInterface{dht: hub.DHT}
+	rec := httptest.NewRecorder()
+	web.handleAdvisorAPI(rec, httptest.NewRequest(http.MethodGet, "/api/advisor", nil))
+	var served AdvisorReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		return err
+	}
+	if len(served.Suggestions) != len(report.Suggestions) || served.Peers != peers {
+		return fmt.Errorf("/api/advisor serves %d suggestions for %d peers, want %d for %d",
+			len(served.Suggestions), served.Peers, len(report.Suggestions), peers)
+	}
+	return nil
+}
+
+// simulateAnnotations: hub H annotates A before ever hearing of it, then H, A and B
+// connect, look each other up and sync. The note and tags never cross the wire in either
+// direction, and they survive A being dropped from H's cache, showing again once A is back
+func simulateAnnotations() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	h, a := g.Nodes[0], g.Nodes[1]
+
+	const canary = "annotation-canary"
+	var leaked atomic.Bool
+	check := func(body []byte, encoding string) {
+		if data, err := readDHTBody(bytes.NewReader(body), encoding, DefaultMaxMessageBytes); err == nil && bytes.Contains(data, []byte(canary)) {
+			leaked.Store(true)
+		}
+	}
+	// Every request each node receives and every response it sends (set before any traffic)
+	for _, n := range g.Nodes {
+		handler := n.DHT.server.Handler
+		n.DHT.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			check(body, r.Header.Get("Content-Encoding"))
+
+			rec := &bodyRecorder{ResponseWriter: w}
+			handler.ServeHTTP(rec, r)
+			check(rec.body.Bytes(), rec.Header().Get("Content-Encoding"))
+		})
+	}
+
+	if _, err := h.DHT.SetPeerAnnotation(a.System.ID, AnnotationRequest{
+		Note:  canary + " note",
+		Tags:  []string{canary + "-tag"},
+		Color: "#ff8800",
+	}); err != nil {
+		return err
+	}
+
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	for _, n := range g.Nodes {
+		n.DHT.FindNode(uuid.New())
+	}
+	resp, err := http.Get(peerURL(h.Address, "/api/full-sync"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if leaked.Load() {
+		return fmt.Errorf("the annotation was sent over the DHT")
+	}
+
+	detail, err := h.DHT.GetPeerDetail(a.System.ID)
+	if err != nil {
+		return err
+	}
+	if detail.Annotation == nil || detail.Annotation.Color != "#ff8800" {
+		return fmt.Errorf("peer detail annotation: %+v", detail.Annotation)
+	}
+
+	// Dropped from the cache and the database, as a prune does
+	h.DHT.routingTable.RemoveFromCache(a.System.ID)
+	if err := h.Storage.DeletePeerSystem(a.System.ID); err != nil {
+		return err
+	}
+	if _, err := h.DHT.GetPeerDetail(a.System.ID); !errors.Is(err, ErrUnknownSystem) {
+		return fmt.Errorf("A is still cached after removal: %v", err)
+	}
+	if err := a.DHT.AnnounceToSystem(h.System); err != nil {
+		return err
+	}
+	if err := g.WaitForConvergence(func() bool {
+		return h.DHT.routingTable.GetCachedSystem(a.System.ID) != nil
+	}, 5*time.Second); err != nil {
+		return fmt.Errorf("A didn't come back: %w", err)
+	}
+	detail, err = h.DHT.GetPeerDetail(a.System.ID)
+	if err != nil {
+		return err
+	}
+	if detail.Annotation == nil || detail.Annotation.Note != canary+" note" || len(detail.Annotation.Tags) != 1 {
+		return fmt.Errorf("annotation after A came back: %+v", detail.Annotation)
+	}
+	if leaked.Load() {
+		return fmt.Errorf("the annotation was sent over the DHT")
+	}
+	return nil
+}
+
+// simulateBandwidth: a hub with a 1 MB budget counts its traffic, headers included, then
+// as usage is pushed up it refuses full-sync, shortens find_node replies and finally only
+// pings out, without blaming the peers it no longer asks. A restart picks up the day's count
+func simulateBandwidth() error {
+	g, err := NewTestGalaxy(8)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	hub, leaf := g.Nodes[0], g.Nodes[1]
+	hub.DHT.SetBandwidthBudget(1)
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+
+	usage := hub.DHT.BandwidthStats()
+	traffic := hub.DHT.TrafficSummary()
+	if usage.BytesReceived <= traffic.BytesReceived || usage.BytesSent <= traffic.BytesSent {
+		return fmt.Errorf("budget counted %d in / %d out, less than the %d / %d of message bodies",
+			usage.BytesReceived, usage.BytesSent, traffic.BytesReceived, traffic.BytesSent)
+	}
+	if usage.Stage != "normal" {
+		return fmt.Errorf("stage %s after %d bytes of a 1 MB budget", usage.Stage, usage.BytesSent+usage.BytesReceived)
+	}
+	closest, err := leaf.DHT.FindNodeDirectToSystem(hub.System, leaf.System.ID)
+	if err != nil {
+		return err
+	}
+	if len(closest) <= BudgetFindNodeResults {
+		return fmt.Errorf("hub listed %d systems before cutting back, want more than %d", len(closest), BudgetFindNodeResults)
+	}
+
+	// Pushes the hub's usage to a share of its budget
+	useUpTo := func(share float64) {
+		u := hub.DHT.BandwidthStats()
+		hub.DHT.bandwidth.add(int64(share*float64(u.BudgetBytes))-u.BytesSent-u.BytesReceived, 0)
+	}
+
+	useUpTo(0.55)
+	if hub.DHT.livenessStretch() == 0 {
+		return fmt.Errorf("liveness pings not stretched at 55%%")
+	}
+
+	useUpTo(0.75)
+	resp, err := http.Get(peerURL(hub.Address, "/api/full-sync"))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		return fmt.Errorf("full-sync at 75%%: status %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if _, err := leaf.DHT.tryFullSync(hub.Address); err == nil {
+		return fmt.Errorf("leaf got a full-sync from a hub out of budget")
+	}
+
+	useUpTo(0.9)
+	if closest, err = leaf.DHT.FindNodeDirectToSystem(hub.System, leaf.System.ID); err != nil {
+		return err
+	}
+	if len(closest) > BudgetFindNodeResults {
+		return fmt.Errorf("hub listed %d systems at 90%%, want at most %d", len(closest), BudgetFindNodeResults)
+	}
+
+	useUpTo(0.96)
+	if _, err := hub.DHT.FindNodeDirectToSystem(leaf.System, hub.System.ID); !errors.Is(err, ErrBandwidthBudget) {
+		return fmt.Errorf("hub sent a find_node at 96%%: %v", err)
+	}
+	hub.DHT.FindNode(uuid.New())
+	if meta := hub.RoutingTable().GetCachedSystemMeta(leaf.System.ID); meta == nil || meta.FailCount > 0 {
+		return fmt.Errorf("leaf blamed for requests the hub held back: %+v", meta)
+	}
+	if err := hub.DHT.PingNode(leaf.System); err != nil {
+		return fmt.Errorf("hub couldn't ping at 96%%: %w", err)
+	}
+	if _, err := leaf.DHT.FindNodeDirectToSystem(hub.System, leaf.System.ID); err != nil {
+		return fmt.Errorf("hub stopped answering at 96%%: %w", err)
+	}
+
+	// The day's count survives a restart, and a new day starts over
+	used := hub.DHT.BandwidthStats()
+	hub.Stop()
+	storage, err := NewStorage(filepath.Join(g.dir, hub.System.Name+".db"))
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	restarted := NewDHT(hub.System, storage, hub.Address)
+	restarted.SetBandwidthBudget(1)
+	restarted.restoreBandwidthUsage()
+	if got := restarted.BandwidthStats(); got.BytesSent+got.BytesReceived < used.BytesSent+used.BytesReceived || got.Stage != "inbound-only" {
+		return fmt.Errorf("after a restart: %d bytes at stage %s, want %d at inbound-only",
+			got.BytesSent+got.BytesReceived, got.Stage, used.BytesSent+used.BytesReceived)
+	}
+	tomorrow := restarted.bandwidth.usage(time.Now().Add(24 * time.Hour))
+	if tomorrow.BytesSent+tomorrow.BytesReceived != 0 || tomorrow.Stage != "normal" {
+		return fmt.Errorf("next day starts at %d bytes, stage %s", tomorrow.BytesSent+tomorrow.BytesReceived, tomorrow.Stage)
+	}
+	return nil
+}
+
+// simulateBridgeScore: hub H has leaves A, B and C. Peer exchange reported A linked to
+// X1-X4, B to X1 and X1 to X2. Linked systems: H 3 (A, B, C), A 5, B 2, C 1, X1 3, X2 2,
+// X3 1, X4 1, so the average is 18/8 = 2.25. B and C are below it and have at most 2
+// links, giving a bridge score of 0.6 * 2/3 + 0.4 * 2/3. All three leaves attested to H,
+// so its reciprocity is 1
+func simulateBridgeScore() error {
+	g, err := NewTestGalaxy(4)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+
+	hub, a, b := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	x := []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+
+	// Whatever bootstrapping reported is replaced by the fixture
+	if _, err := hub.Storage.db.Exec("DELETE FROM peer_connections"); err != nil {
+		return err
+	}
+	for id, peers := range map[uuid.UUID][]uuid.UUID{
+		a.System.ID: x,
+		b.System.ID: x[:1],
+		x[0]:        x[1:2],
+	} {
+		if err := hub.Storage.SavePeerConnections(id, peers); err != nil {
+			return err
+		}
+	}
+
+	const wantScore, wantAvg = 0.6*2/3 + 0.4*2/3, 2.25
+	score, avg := hub.DHT.calculateBridgeScore()
+	if math.Abs(score-wantScore) > 1e-9 || math.Abs(avg-wantAvg) > 1e-9 {
+		return fmt.Errorf("bridge score %.4f against average %.4f, want %.4f against %.4f", score, avg, wantScore, wantAvg)
+	}
+
+	// The calculation loop records the same inputs with its result
+	if _, err := hub.DHT.calculateCredits(); err != nil {
+		return err
+	}
+	earnings, err := hub.Storage.GetCreditEarnings(0)
+	if err != nil {
+		return err
+	}
+	if len(earnings) == 0 {
+		return fmt.Errorf("no credit calculation recorded")
+	}
+	e := earnings[len(earnings)-1]
+	if math.Abs(e.BridgeScore-wantScore) > 1e-9 || math.Abs(e.AvgConnectivity-wantAvg) > 1e-9 {
+		return fmt.Errorf("recorded bridge score %.4f against average %.4f, want %.4f against %.4f",
+			e.BridgeScore, e.AvgConnectivity, wantScore, wantAvg)
+	}
+	if e.ReciprocityRatio != 1 || e.GalaxySize != 4 {
+		return fmt.Errorf("recorded reciprocity %.3f and galaxy size %d, want 1 and 4", e.ReciprocityRatio, e.GalaxySize)
+	}
+	return nil
+}
+
+// simulateClockSkew: B's clock runs 8 minutes behind. Its pings are still accepted,
+// its peer detail warns about it, and uptime from its attestations is counted at A's
+// time. A timestamp that doesn't fit B's usual skew, or is past the hard cap, is refused
+func simulateClockSkew() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	a, b := g.Nodes[0], g.Nodes[1]
+	b.Stop() // Only its identity is needed from here on
+	// From here B's clock runs 8 minutes behind, as if it always had
+	a.DHT.clockSkews.forget(func(uuid.UUID) bool { return false })
+	before, err := a.DHT.GetUptimeHistory(1, "hour")
+	if err != nil {
+		return err
+	}
+
+	ping := func(offset time.Duration) (int, error) {
+		msg, err := NewPingRequest(b.System, a.System.ID, uuid.New().String())
+		if err != nil {
+			return 0, err
+		}
+		msg.Timestamp = msg.Timestamp.Add(offset)
+		msg.Attestation.Timestamp += int64(offset / time.Second)
+		msg.Attestation.addNonce(b.System.Keys.PrivateKey) // Signs it; pings in the same second aren't replays
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := postDHT(context.Background(), http.DefaultClient, peerURL(a.Address, "/dht"), data, false)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	time.Sleep(time.Second) // Keep the connection's attestations out of the uptime window
+	since := time.Unix(time.Now().Unix(), 0)
+	for i := 0; i < 4; i++ {
+		if status, err := ping(-8 * time.Minute); err != nil || status != http.StatusOK {
+			return fmt.Errorf("ping %d from 8 minutes behind got %d (%v)", i+1, status, err)
+		}
+	}
+
+	skew, ok := a.DHT.ClockSkew(b.System.ID)
+	if !ok || skew > -7*time.Minute || skew < -9*time.Minute {
+		return fmt.Errorf("estimated skew is %v, want about -8m", skew)
+	}
+	detail, err := a.DHT.GetPeerDetail(b.System.ID)
+	if err != nil {
+		return err
+	}
+	if detail.ClockWarning != "peer clock is ~8 minutes behind" {
+		return fmt.Errorf("peer detail warns %q", detail.ClockWarning)
+	}
+
+	// Right by A's clock is 8 minutes off B's; 20 minutes is past the cap whatever the skew
+	for _, offset := range []time.Duration{0, -20 * time.Minute} {
+		if status, err := ping(offset); err != nil || status == http.StatusOK {
+			return fmt.Errorf("ping %v off A's clock was accepted (%v)", offset, err)
+		}
+	}
+
+	// Uptime is counted at A's time: by B's stamps, the pings were 8 minutes ago
+	after, err := a.DHT.GetUptimeHistory(1, "hour")
+	if err != nil {
+		return err
+	}
+	if n := after.Days[0].Attestations - before.Days[0].Attestations; n != 4 {
+		return fmt.Errorf("today's uptime gained %d attestations, want 4", n)
+	}
+	hourly, err := a.Storage.GetUptimeHistogram(a.System.ID, time.Hour, since)
+	if err != nil {
+		return err
+	}
+	if len(hourly) == 0 || hourly[len(hourly)-1].Count != 4 || hourly[len(hourly)-1].Last > time.Now().Unix() {
+		return fmt.Errorf("uptime since the first ping is %+v, want the 4 pings", hourly)
+	}
+	return nil
+}
+
+// simulateConnectionWrites replays an hour of a lookup-heavy node's find_node answers (a
+// lookup every 6 seconds, each hearing from 9 of the 30 systems around it, which list 20
+// of their 40 neighbours) into two databases: one writing every sighting, as before the rewrite
+// cache, and one through it. The cache must write at least 80% fewer rows while keeping
+// the same edges, none more than PeerConnectionRewriteInterval behind, and every sighting
+// counted in their observations
+func simulateConnectionWrites() error {
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(name string, interval time.Duration) (*Storage, error) {
+		s, err := NewStorage(filepath.Join(dir, name+".db"))
+		if err != nil {
+			return nil, err
+		}
+		s.connWrites = newConnectionWriteCache(interval)
+		return s, nil
+	}
+	every, err := open("every", 0)
+	if err != nil {
+		return err
+	}
+	defer every.Close()
+	cached, err := open("cached", PeerConnectionRewriteInterval)
+	if err != nil {
+		return err
+	}
+	defer cached.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	systems := make([]uuid.UUID, 30)
+	for i := range systems {
+		rng.Read(systems[i][:])
+	}
+	neighbours := make([][]uuid.UUID, len(systems))
+	for i := range neighbours {
+		for len(neighbours[i]) < 40 {
+			var id uuid.UUID
+			rng.Read(id[:])
+			neighbours[i] = append(neighbours[i], id)
+		}
+	}
+
+	const lookupEvery, responders, listed = 6 * time.Second, 9, 20
+	start := time.Now().Add(-time.Hour)
+	var everyTook, cachedTook time.Duration
+	for at := time.Duration(0); at < time.Hour; at += lookupEvery {
+		now := start.Add(at)
+		for r := 0; r < responders; r++ {
+			i := rng.Intn(len(systems))
+			peers := make([]uuid.UUID, 0, listed)
+			for _, p := range rng.Perm(len(neighbours[i]))[:listed] {
+				peers = append(peers, neighbours[i][p])
+			}
+
+			t := time.Now()
+			if err := every.savePeerConnectionsAt(systems[i], peers, now); err != nil {
+				return err
+			}
+			everyTook += time.Since(t)
+			t = time.Now()
+			if err := cached.savePeerConnectionsAt(systems[i], peers, now); err != nil {
+				return err
+			}
+			cachedTook += time.Since(t)
+		}
+	}
+	// Once the hour's edges have gone quiet, a sweep writes their leftover sightings
+	if err := cached.savePeerConnectionsAt(uuid.Nil, nil, start.Add(time.Hour+PeerConnectionRewriteInterval)); err != nil {
+		return err
+	}
+
+	sightings, everyWritten := every.connWrites.stats()
+	_, cachedWritten := cached.connWrites.stats()
+	log.Printf("An hour of lookups reported %d edges: %d rows written in %v without the cache, %d in %v with it",
+		sightings, everyWritten, everyTook.Round(time.Millisecond), cachedWritten, cachedTook.Round(time.Millisecond))
+	if cachedWritten*5 > everyWritten {
+		return fmt.Errorf("the cache wrote %d rows, writing every sighting took %d: want at least 80%% fewer", cachedWritten, everyWritten)
+	}
+
+	type edge struct{ updatedAt, observations int64 }
+	load := func(s *Storage) (map[[2]string]edge, int64, error) {
+		rows, err := s.db.Query(`SELECT system_id, peer_id, updated_at, observations FROM peer_connections`)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer rows.Close()
+		edges := make(map[[2]string]edge)
+		var total int64
+		for rows.Next() {
+			var from, to string
+			var e edge
+			if err := rows.Scan(&from, &to, &e.updatedAt, &e.observations); err != nil {
+				return nil, 0, err
+			}
+			edges[[2]string{from, to}] = e
+			total += e.observations
+		}
+		return edges, total, rows.Err()
+	}
+	want, wantTotal, err := load(every)
+	if err != nil {
+		return err
+	}
+	got, gotTotal, err := load(cached)
+	if err != nil {
+		return err
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("the cache kept %d edges, writing every sighting %d", len(got), len(want))
+	}
+	for key, w := range want {
+		g, ok := got[key]
+		if !ok {
+			return fmt.Errorf("the cache lost edge %s -> %s", key[0][:8], key[1][:8])
+		}
+		if behind := w.updatedAt - g.updatedAt; behind < 0 || behind > int64(PeerConnectionRewriteInterval/time.Second) {
+			return fmt.Errorf("edge %s -> %s is %ds behind with the cache", key[0][:8], key[1][:8], behind)
+		}
+	}
+	if wantTotal != sightings || gotTotal != sightings {
+		return fmt.Errorf("observations add up to %d writing every sighting and %d with the cache, want %d", wantTotal, gotTotal, sightings)
+	}
+	return nil
+}
+
+// simulateConstellation: in a chain where each node sponsored the next, the last node's
+// constellation runs back to the first. A sponsor loop in gossiped data (the first
+// node claiming the last as its sponsor) still lists each system once
+func simulateConstellation() error {
+	g, err := NewTestGalaxy(4)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectChain(); err != nil {
+		return err
+	}
+	first, last := g.Nodes[0], g.Nodes[3]
+
+	rt := last.RoutingTable()
+	err = g.WaitForConvergence(func() bool {
+		last.DHT.FindNode(first.System.ID)
+		for _, n := range g.Nodes[:3] {
+			if rt.GetCachedSystem(n.System.ID) == nil {
+				return false
+			}
+		}
+		return true
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("node 3 never learned the whole chain: %w", err)
+	}
+
+	check := func(what string, depth, size int, root *TestNode, generation int) error {
+		c, err := last.DHT.GetConstellation(last.System.ID, depth)
+		if err != nil {
+			return err
+		}
+		if c.Size != size || c.Root.ID != root.System.ID.String() || c.Root.Generation != generation {
+			return fmt.Errorf("%s: got %d systems under %s (generation %d), want %d under %s (generation %d)",
+				what, c.Size, c.Root.Name, c.Root.Generation, size, root.System.Name, generation)
+		}
+		seen := make(map[string]bool)
+		var walk func(n *ConstellationNode) error
+		walk = func(n *ConstellationNode) error {
+			if seen[n.ID] {
+				return fmt.Errorf("%s: %s is in the tree twice", what, n.Name)
+			}
+			seen[n.ID] = true
+			for _, child := range n.Children {
+				if child.Generation != n.Generation+1 {
+					return fmt.Errorf("%s: %s is generation %d under generation %d", what, child.Name, child.Generation, n.Generation)
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := walk(c.Root); err != nil {
+			return err
+		}
+		if len(seen) != size {
+			return fmt.Errorf("%s: tree has %d systems, size says %d", what, len(seen), size)
+		}
+		return nil
+	}
+
+	if err := check("whole chain", 3, 4, first, -3); err != nil {
+		return err
+	}
+	if err := check("depth 1", 1, 2, g.Nodes[2], -1); err != nil {
+		return err
+	}
+
+	// Node 3's copy of node 0 now names node 3 as its sponsor
+	looped := *rt.GetCachedSystem(first.System.ID)
+	looped.SponsorID = &last.System.ID
+	rt.cacheMu.Lock()
+	rt.systemCache[first.System.ID].System = &looped
+	rt.cacheMu.Unlock()
+	return check("sponsor loop", MaxConstellationDepth, 4, first, -3)
+}
+
+// slowPeerDelay is how long the slow-peers scenario's slow nodes take to answer: past
+// LookupQueryTimeout, within RequestTimeout, and short enough that the round-by-round
+// lookup waiting it out for each round stays well inside the scenario's timeouts
+const slowPeerDelay = LookupQueryTimeout + 500*time.Millisecond
+
+// simulateSlowPeers: with 2 of 10 peers (20%) answering late, a lookup gives up on them
+// after LookupQueryTimeout instead of holding up a round for each, and beats the old
+// round-by-round lookup (lockstepFindNode) by seconds. A lookup past its deadline
+// returns what it has
+func simulateSlowPeers() error {
+	g, err := NewTestGalaxy(11)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	// Each node waits out its delay before handling a request (set before any traffic)
+	delays := make([]*atomic.Int64, len(g.Nodes))
+	for i, n := range g.Nodes {
+		delay, handler := new(atomic.Int64), n.DHT.server.Handler
+		n.DHT.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Duration(delay.Load()))
+			handler.ServeHTTP(w, r)
+		})
+		delays[i] = delay
+	}
+	defer func() {
+		for _, delay := range delays {
+			delay.Store(0)
+		}
+	}()
+
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	m := g.Nodes[1]
+	err = g.WaitForConvergence(func() bool {
+		m.DHT.FindNode(m.System.ID)
+		return len(m.RoutingTable().GetAllRoutingTableNodes()) == len(g.Nodes)-1
+	}, raceSlowdown*SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("node 1 never learned every node: %w", err)
+	}
+
+	delays[4].Store(int64(slowPeerDelay))
+	delays[8].Store(int64(slowPeerDelay))
+
+	result := m.DHT.FindNode(uuid.New())
+	if result.TimedOut != 2 || result.DeadlineHit || len(result.ClosestNodes) != len(g.Nodes)-1 {
+		return fmt.Errorf("lookup returned %d nodes with %d timed out (deadline hit: %v), want %d with 2",
+			len(result.ClosestNodes), result.TimedOut, result.DeadlineHit, len(g.Nodes)-1)
+	}
+	if result.Duration > LookupQueryTimeout+time.Second {
+		return fmt.Errorf("lookup took %v, want about LookupQueryTimeout (%v)", result.Duration, LookupQueryTimeout)
+	}
+
+	rounds, took := lockstepFindNode(m.DHT, uuid.New())
+	log.Printf("Lookup with 20%% slow peers: %v pipelined, %v waiting out each of %d rounds",
+		result.Duration.Round(time.Millisecond), took.Round(time.Millisecond), rounds)
+	if took < slowPeerDelay {
+		return fmt.Errorf("round-by-round lookup took %v, less than one slow peer (%v)", took, slowPeerDelay)
+	}
+
+	m.DHT.SetLookupTimeout(time.Second)
+	result = m.DHT.FindNode(uuid.New())
+	if !result.DeadlineHit || len(result.ClosestNodes) == 0 || result.Duration > 1500*time.Millisecond {
+		return fmt.Errorf("lookup with a 1s deadline took %v, returned %d nodes (deadline hit: %v)",
+			result.Duration, len(result.ClosestNodes), result.DeadlineHit)
+	}
+	return nil
+}
+
+// lockstepFindNode is FindNode as it was before queries were pipelined, for comparison:
+// Alpha queries a round, each round waiting for its slowest answer
+func lockstepFindNode(dht *DHT, targetID uuid.UUID) (rounds int, took time.Duration) {
+	start := time.Now()
+	queried := make(map[uuid.UUID]bool)
+	known := make(map[uuid.UUID]*System)
+	shortlist := dht.routingTable.GetClosest(targetID, Alpha)
+	for _, sys := range shortlist {
+		known[sys.ID] = sys
+	}
+
+	for {
+		toQuery := selectUnqueried(shortlist, queried, Alpha)
+		if len(toQuery) == 0 {
+			break
+		}
+		rounds++
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		newNodesFound := false
+		for _, sys := range toQuery {
+			queried[sys.ID] = true
+			wg.Add(1)
+			go func(sys *System) {
+				defer wg.Done()
+				nodes, err := dht.FindNodeDirectToSystem(sys, targetID)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for _, n := range nodes {
+					if _, ok := known[n.ID]; !ok && n.ID != dht.localSystem.ID {
+						known[n.ID] = n
+						newNodesFound = true
+					}
+				}
+			}(sys)
+		}
+		wg.Wait()
+
+		shortlist = sortByDistance(known, targetID)
+		if allClosestQueried(shortlist, queried, K) && !newNodesFound {
+			break
+		}
+	}
+	return rounds, time.Since(start)
+}
+
+// simulateCompression: a find_node response listing several systems comes back gzipped
+// to a requester that accepts it, with the relayed systems slimmed down, and counts
+// toward both sides' traffic. A gzip bomb is refused once it inflates past the limit
+func simulateCompression() error {
+	g, err := NewTestGalaxy(6)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub, a := g.Nodes[0], g.Nodes[1]
+
+	req, err := NewFindNodeRequest(a.System, hub.System.ID, a.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := postDHT(context.Background(), http.DefaultClient, peerURL(hub.Address, "/dht"), data, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return fmt.Errorf("find_node response wasn't gzipped")
+	}
+	body, err := readDHTBody(resp.Body, "gzip", DefaultMaxMessageBytes)
+	if err != nil {
+		return err
+	}
+	var raw struct {
+		ClosestNodes []map[string]interface{} `json:"closest_nodes"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+	if len(raw.ClosestNodes) < 4 {
+		return fmt.Errorf("hub listed %d systems, want at least 4", len(raw.ClosestNodes))
+	}
+	for _, sys := range raw.ClosestNodes {
+		for _, field := range []string{"address", "created_at", "last_seen_at"} {
+			if _, ok := sys[field]; ok {
+				return fmt.Errorf("relayed system carries %s", field)
+			}
+		}
+	}
+
+	// The same exchange through sendRequest, counted on both ends
+	a.DHT.FindNode(a.System.ID)
+	sent, ok := a.DHT.PeerTraffic(hub.System.ID)
+	if !ok || sent.BytesSent == 0 || sent.BytesReceived == 0 {
+		return fmt.Errorf("node 1 counted no traffic with the hub: %+v", sent)
+	}
+	if served, ok := hub.DHT.PeerTraffic(a.System.ID); !ok || served.BytesReceived == 0 || served.BytesSent == 0 {
+		return fmt.Errorf("hub counted no traffic with node 1: %+v", served)
+	}
+
+	// 2 MB of zeros compresses to a few KB
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, 2*DefaultMaxMessageBytes))
+	zw.Close()
+	resp, err = postDHT(context.Background(), http.DefaultClient, peerURL(hub.Address, "/dht"), bomb.Bytes(), true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("hub accepted a gzip bomb")
+	}
+	return nil
+}
+
+// simulateConfig: a config file overrides flag defaults and is overridden by flags given
+// on the command line (default < file < flag), keeps comments when edited, and rejects
+// an unknown key naming the flag that was probably meant
+func simulateConfig() error {
+	newFlags := func() (*flag.FlagSet, *string, *string, *int, *bool) {
+		fs := flag.NewFlagSet("config", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		name := fs.String("name", "", "")
+		address := fs.String("address", "0.0.0.0:8080", "")
+		keepDays := fs.Int("compact-keep-days", DefaultCompactionKeepDays, "")
+		isolated := fs.Bool("isolated", false, "")
+		fs.Bool("status", false, "")
+		return fs, name, address, keepDays, isolated
+	}
+	file := `# Test config
+name = "Vega # Prime" # the # inside the string stays
+address = '127.0.0.1:9090'
+compact-keep-days = 14
+isolated = true
+`
+	entries, err := ParseConfig(strings.NewReader(file))
+	if err != nil {
+		return err
+	}
+
+	fs, name, address, keepDays, isolated := newFlags()
+	if err := fs.Parse([]string{"-address", "127.0.0.1:7070"}); err != nil {
+		return err
+	}
+	onCommandLine := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { onCommandLine[f.Name] = true })
+	given := func(name string) bool { return onCommandLine[name] }
+	if err := ApplyConfig(fs, entries, "test.toml", given); err != nil {
+		return err
+	}
+	if *name != "Vega # Prime" || *keepDays != 14 || !*isolated {
+		return fmt.Errorf("file values not applied: name %q, keep days %d, isolated %v", *name, *keepDays, *isolated)
+	}
+	if *address != "127.0.0.1:7070" {
+		return fmt.Errorf("address is %q, want the command line's 127.0.0.1:7070", *address)
+	}
+	fs, name, address, _, _ = newFlags()
+	if err := ApplyConfig(fs, nil, "empty.toml", given); err != nil || *name != "" || *address != "0.0.0.0:8080" {
+		return fmt.Errorf("empty config changed the defaults: name %q, address %q (%v)", *name, *address, err)
+	}
+
+	for bad, want := range map[string]string{
+		"nmae = \"x\"\n":              `unknown setting "nmae" (did you mean "name"?)`,
+		"public_adress = \"x\"\n":     `unknown setting "public_adress"`,
+		"status = true\n":             "can only be given on the command line",
+		"compact-keep-days = x\n":     "quote strings",
+		"compact-keep-days = \"x\"\n": "invalid value",
+	} {
+		fs, _, _, _, _ := newFlags()
+		entries, err := ParseConfig(strings.NewReader(bad))
+		if err == nil {
+			err = ApplyConfig(fs, entries, "bad.toml", func(string) bool { return false })
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			return fmt.Errorf("config %q: got error %v, want one containing %q", bad, err, want)
+		}
+	}
+
+	// Editing keeps the comments, replaces lines in place and drops emptied keys
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ConfigFileName)
+	if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+		return err
+	}
+	if err := UpdateConfigFile(path, map[string]string{"name": "Deneb", "isolated": "", "bootstrap": "a:1,b:2"}); err != nil {
+		return err
+	}
+	edited, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	want := `# Test config
+name = "Deneb"
+address = '127.0.0.1:9090'
+compact-keep-days = 14
+bootstrap = ["a:1", "b:2"]
+`
+	if string(edited) != want {
+		return fmt.Errorf("edited config is\n%s\nwant\n%s", edited, want)
+	}
+	return nil
+}
+
+// simulateForgedResponse: B goes offline and an impostor answers at its address with a
+// pong validly signed by C, a system claiming another address. A must discard it
+// without verifying B. C's forged response pushed to A for one of A's pending requests
+// to B must be refused too
+func simulateForgedResponse() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	if err := g.Connect(2, 0); err != nil {
+		return err
+	}
+
+	a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	b.Stop()
+
+	impostor := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req DHTMessage
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := NewPingResponse(c.System, req.FromSystem.ID, req.RequestID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	})}
+	listener, err := net.Listen("tcp", b.Address)
+	if err != nil {
+		return err
+	}
+	go impostor.Serve(listener)
+	defer impostor.Close()
+
+	before := *a.RoutingTable().GetCachedSystemMeta(b.System.ID)
+
+	if err := a.DHT.PingNode(b.System); err == nil {
+		return fmt.Errorf("A accepted C's pong as B's")
+	}
+	after := a.RoutingTable().GetCachedSystemMeta(b.System.ID)
+	if after == nil {
+		return fmt.Errorf("A dropped B after C answered for it")
+	}
+	if after.LastVerified.After(before.LastVerified) {
+		return fmt.Errorf("A marked B verified on C's pong")
+	}
+	if after.FailCount <= before.FailCount {
+		return fmt.Errorf("A didn't count the ping to B as failed")
+	}
+
+	// A request to B is in flight; C answers it directly
+	req, err := NewPingRequest(a.System, b.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	pending := a.DHT.registerPending(req, b.Address)
+	defer a.DHT.unregisterPending(req.RequestID)
+
+	forged, err := NewPingResponse(c.System, a.System.ID, req.RequestID)
+	if err != nil {
+		return err
+	}
+	if _, err := c.DHT.sendRequest(a.Address, forged); err == nil {
+		return fmt.Errorf("A took C's response to its request to B")
+	}
+	select {
+	case <-pending.ch:
+		return fmt.Errorf("C's response was delivered to A's request to B")
+	default:
+	}
+	return nil
+}
+
+// simulateAddressMove: in a 15-node star, M (node 1) joined first, so its only peers are the
+// hub and two nodes it pinged; everyone else cached it from the hub's lookup answers. M's
+// address changes while it runs: over 90% of the other nodes must hold the new one well
+// within two minutes, most of them through the helpers M asked to pass its info on
+func simulateAddressMove() error {
+	g, err := NewTestGalaxy(15)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	for _, j := range []int{2, 3} {
+		if err := g.Connect(1, j); err != nil {
+			return err
+		}
+	}
+
+	m := g.Nodes[1]
+	for i, node := range g.Nodes {
+		if i != 1 && node.RoutingTable().GetCachedSystem(m.System.ID) == nil {
+			return fmt.Errorf("node %d never cached M", i)
+		}
+	}
+	direct := m.RoutingTable().GetRoutingTableSize()
+
+	start := time.Now()
+	if err := g.MoveNode(1); err != nil {
+		return err
+	}
+	m = g.Nodes[1]
+	moved := func() int {
+		n := 0
+		for i, node := range g.Nodes {
+			if sys := node.RoutingTable().GetCachedSystem(m.System.ID); i != 1 && sys != nil && sys.PeerAddress == m.Address {
+				n++
+			}
+		}
+		return n
+	}
+	others := len(g.Nodes) - 1
+	err = g.WaitForConvergence(func() bool { return moved()*10 > others*9 }, 2*time.Minute)
+	log.Printf("M announced its move to %d peers; %d of %d nodes had the new address after %v",
+		direct, moved(), others, time.Since(start).Round(time.Millisecond))
+	if err != nil {
+		return fmt.Errorf("only %d of %d nodes have M's new address: %w", moved(), others, err)
+	}
+	if direct*10 > others*9 {
+		return fmt.Errorf("M had %d of %d nodes as peers, so the relay wasn't needed", direct, others)
+	}
+	return nil
+}
+
+// simulateLookup: in a star around node 0, node 4 runs a debug lookup for node 1, which it
+// already caches from joining last, and must still ask the network and find it. With node 2
+// stopped, a lookup for an unknown ID reports the hub answering and node 2 failing, and
+// while one lookup runs another is turned away
+func simulateLookup() error {
+	g, err := NewTestGalaxy(5)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	a, hub, target, stopped := g.Nodes[4], g.Nodes[0], g.Nodes[1], g.Nodes[2]
+
+	report, err := a.DHT.DebugLookup(target.System.ID)
+	if err != nil {
+		return err
+	}
+	if !report.WasCached || len(report.Queries) == 0 {
+		return fmt.Errorf("the lookup for a cached system asked %d peers (was cached: %v), want the network asked anyway",
+			len(report.Queries), report.WasCached)
+	}
+	if report.Found == nil || report.Found.ID != target.System.ID.String() {
+		return fmt.Errorf("the lookup didn't find node 1")
+	}
+
+	stopped.Stop()
+	report, err = a.DHT.DebugLookup(uuid.New())
+	if err != nil {
+		return err
+	}
+	outcomes := make(map[string]string)
+	for _, q := range report.Queries {
+		outcomes[q.ID] = q.Outcome
+	}
+	if got := outcomes[hub.System.ID.String()]; got != QueryAnswered {
+		return fmt.Errorf("the hub's query was %q, want %q", got, QueryAnswered)
+	}
+	if got := outcomes[stopped.System.ID.String()]; got != QueryFailed {
+		return fmt.Errorf("stopped node 2's query was %q, want %q (queries: %v)", got, QueryFailed, outcomes)
+	}
+	if report.Found != nil || len(report.Closest) == 0 {
+		return fmt.Errorf("the lookup for an unknown ID found %v and %d closest systems", report.Found, len(report.Closest))
+	}
+
+	a.DHT.debugLookupMu.Lock()
+	_, err = a.DHT.DebugLookup(target.System.ID)
+	a.DHT.debugLookupMu.Unlock()
+	if !errors.Is(err, ErrLookupBusy) {
+		return fmt.Errorf("a lookup while another runs returned %v, want ErrLookupBusy", err)
+	}
+	return nil
+}
+
+// simulateAddressProbe: before moving to an address its peers report, a node asks a peer
+// to ping it back there. Its own address is reached; a port nobody listens on isn't, and
+// neither is another host, since peers only ping back at the IP the request came from.
+// A move racing a rename and inbound pings leaves info that has both, verifies and is saved
+func simulateAddressProbe() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	a := g.Nodes[1]
+	_, port, err := net.SplitHostPort(a.Address)
+	if err != nil {
+		return err
+	}
+	unused, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	if !a.DHT.probeAddress(a.Address) {
+		return fmt.Errorf("no peer reached A at its own address")
+	}
+	if a.DHT.probeAddress(fmt.Sprintf("127.0.0.1:%d", unused)) {
+		return fmt.Errorf("a peer reached A on a port nobody listens on")
+	}
+	if a.DHT.probeAddress(net.JoinHostPort("127.0.0.2", port)) {
+		return fmt.Errorf("a peer pinged back at a host other than the one A asked from")
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, n := range []*TestNode{g.Nodes[0], g.Nodes[2]} {
+		wg.Add(1)
+		go func(n *TestNode) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					n.DHT.Ping(a.Address)
+				}
+			}
+		}(n)
+	}
+	moved := net.JoinHostPort("127.0.0.2", port)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.DHT.moveAdvertisedAddress(moved)
+	}()
+	renameErr := a.DHT.RenameSystem("Probed")
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	if renameErr != nil {
+		return renameErr
+	}
+
+	key := base64.StdEncoding.EncodeToString(a.System.Keys.PublicKey)
+	if sys := a.DHT.GetLocalSystem(); sys.PeerAddress != moved || sys.Name != "Probed" || !sys.VerifyInfo(key) {
+		return fmt.Errorf("info after a move and a rename: %s at %s (verifies: %v)", sys.Name, sys.PeerAddress, sys.VerifyInfo(key))
+	}
+	stored, err := a.Storage.LoadSystem()
+	if err != nil {
+		return err
+	}
+	if stored.PeerAddress != moved || stored.Name != "Probed" {
+		return fmt.Errorf("saved %s at %s after a move and a rename", stored.Name, stored.PeerAddress)
+	}
+	return nil
+}
+
+// simulateAddressReuse: B leaves and C comes up on B's address. A ends up with two
+// systems cached at one address and must settle on C without ever dropping it
+func simulateAddressReuse() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	if err := g.Connect(0, 1); err != nil {
+		return err
+	}
+
+	a, b := g.Nodes[0], g.Nodes[1]
+	ci, err := g.ReplaceNode(1)
+	if err != nil {
+		return err
+	}
+	c := g.Nodes[ci]
+	if err := g.Connect(ci, 0); err != nil {
+		return err
+	}
+
+	rt := a.RoutingTable()
+	err = g.WaitForConvergence(func() bool {
+		if rt.GetCachedSystem(c.System.ID) == nil {
+			return false // Dropping C fails the scenario below
+		}
+		meta := rt.GetCachedSystemStatus(c.System.ID)
+		return rt.GetCachedSystem(b.System.ID) == nil && !meta.AddressConflict &&
+			rt.GetSystemIDByAddress(c.Address) == c.System.ID
+	}, SimulationTimeout)
+	if rt.GetCachedSystem(c.System.ID) == nil {
+		return fmt.Errorf("node 0 dropped the new owner of the address")
+	}
+	if err != nil {
+		return fmt.Errorf("node 0 didn't settle the address on the new owner: %w", err)
+	}
+	return nil
+}
+
+// simulateGhostPeer: a node that vanishes is gossiped by a peer that still lists it;
+// gossip validation must drop it rather than pass it on
+func simulateGhostPeer() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectChain(); err != nil {
+		return err
+	}
+
+	a, ghost := g.Nodes[0], g.Nodes[2]
+	ghost.Stop()
+
+	// a hears of the ghost only through node 1's FIND_NODE response
+	a.DHT.FindNode(a.System.ID)
+	if a.RoutingTable().GetCachedSystem(ghost.System.ID) == nil {
+		return fmt.Errorf("node 0 never heard of node 2 through node 1")
+	}
+
+	err = g.WaitForConvergence(func() bool {
+		a.DHT.validateGossipSystems()
+		return a.RoutingTable().GetCachedSystem(ghost.System.ID) == nil
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("ghost still cached by node 0: %w", err)
+	}
+	if a.RoutingTable().IsRoutingTablePeer(ghost.System.ID) {
+		return fmt.Errorf("ghost still in node 0's routing table")
+	}
+	return nil
+}
+
+// simulateLatency: requests measure each peer's latency, which feeds the stats
+// histogram, orders lookup candidates fastest first, is reported once when it degrades
+// sharply and survives a restart through storage
+func simulateLatency() error {
+	g, err := NewTestGalaxy(4)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub, a := g.Nodes[0], g.Nodes[1]
+	rt := hub.RoutingTable()
+
+	for _, node := range g.Nodes[1:] {
+		if node.RoutingTable().GetLatency(hub.System.ID) <= 0 {
+			return fmt.Errorf("%s measured no latency to the hub", node.System.Name)
+		}
+		if err := hub.DHT.PingNode(node.System); err != nil {
+			return err
+		}
+	}
+	if h := rt.GetLatencyHistogram(); h.Measured != 3 || len(h.Buckets) != len(LatencyBucketBounds)+1 || h.Buckets[0].Count == 0 {
+		return fmt.Errorf("hub's latency histogram is %+v, want 3 peers measured, mostly under 25ms", h)
+	}
+
+	// A slows down: once for the baseline, then 5 slow round trips push it past 3x and 200ms
+	if _, _, degraded := rt.checkLatencyBaseline(a.System.ID); degraded {
+		return fmt.Errorf("first latency check reported degradation")
+	}
+	for i := 0; i < 5; i++ {
+		rt.RecordLatency(a.System.ID, 2*time.Second)
+	}
+	if baseline, latency, degraded := rt.checkLatencyBaseline(a.System.ID); !degraded {
+		return fmt.Errorf("latency went from %v to %v without being reported", baseline, latency)
+	}
+	if _, _, degraded := rt.checkLatencyBaseline(a.System.ID); degraded {
+		return fmt.Errorf("the same degradation was reported twice")
+	}
+
+	order := rt.sortByLatency(rt.GetAllRoutingTableNodes())
+	if len(order) != 3 || order[2].ID != a.System.ID {
+		return fmt.Errorf("slow node 1 isn't queried last")
+	}
+
+	want := rt.GetLatency(a.System.ID)
+	rt.SaveSnapshot()
+	restored := NewRoutingTable(hub.System, hub.Storage).GetLatency(a.System.ID)
+	if diff := restored - want; diff < -time.Millisecond || diff > time.Millisecond {
+		return fmt.Errorf("latency %v came back from storage as %v", want, restored)
+	}
+	return nil
+}
+
+// simulateReciprocity: C, a peer of both A and B, hears of the A <-> B link from
+// each side and must report it reciprocal, though neither is its own link
+func simulateReciprocity() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+
+	a, c, b := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	err = g.WaitForConvergence(func() bool {
+		c.DHT.FindNode(c.System.ID)
+		ab, ba := c.edge(a, b), c.edge(b, a)
+		return ab != nil && ab.Reciprocal && ba != nil && ba.Reciprocal
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("node 1 doesn't see node 0 <-> node 2 as reciprocal: %w", err)
+	}
+	return nil
+}
+
+// simulateRetraction: one peer claiming a healthy node is unreachable - however often,
+// directly or relayed - must not demote it; a quorum of claims about a node that really
+// is gone must; and a quorum against a node that still answers is undone by our own ping
+func simulateRetraction() error {
+	g, err := NewTestGalaxy(6)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+
+	hub, liar, healthy, dead := g.Nodes[0], g.Nodes[1], g.Nodes[2], g.Nodes[5]
+	rt := hub.RoutingTable()
+
+	// Claims are timed to the second and must postdate the hub's last contact with the target
+	time.Sleep(1100 * time.Millisecond)
+
+	// A single claimer, repeating itself and relayed by another peer
+	for i := 0; i < 5; i++ {
+		if err := g.claimUnreachable(liar, hub, healthy, liar, 1); err != nil {
+			return err
+		}
+	}
+	if err := g.claimUnreachable(g.Nodes[3], hub, healthy, liar, 2); err != nil {
+		return err
+	}
+	if n := rt.GetSuspicionCount(healthy.System.ID); n != 1 {
+		return fmt.Errorf("one claimer counted %d times", n)
+	}
+	if rt.IsRetracted(healthy.System.ID) || !rt.IsRoutingTablePeer(healthy.System.ID) {
+		return fmt.Errorf("a single claimer demoted a healthy node")
+	}
+
+	// Any direct contact clears the suspicion
+	if err := g.Connect(2, 0); err != nil {
+		return err
+	}
+	if n := rt.GetSuspicionCount(healthy.System.ID); n != 0 {
+		return fmt.Errorf("%d claims left after direct contact", n)
+	}
+
+	// A node that is really gone: three of its peers fail to reach it and say so
+	for i := 1; i <= 3; i++ {
+		if err := g.Connect(i, 5); err != nil {
+			return err
+		}
+	}
+	dead.Stop()
+	time.Sleep(1100 * time.Millisecond) // The hub just relayed the claims above to it
+	for _, claimer := range g.Nodes[1:4] {
+		target := claimer.RoutingTable().GetCachedSystem(dead.System.ID)
+		if target == nil {
+			return fmt.Errorf("%s doesn't know the dead node", claimer.System.Name)
+		}
+		for i := 0; i < MaxFailCount; i++ {
+			claimer.DHT.PingNode(target)
+		}
+		claimer.DHT.retractDeadNodes(claimer.RoutingTable().EvictDeadNodes())
+	}
+	err = g.WaitForConvergence(func() bool {
+		return rt.IsRetracted(dead.System.ID) && !rt.IsRoutingTablePeer(dead.System.ID) &&
+			!hub.DHT.shareable(dead.System)
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("hub still lists the dead node after %d claims: %w", rt.GetSuspicionCount(dead.System.ID), err)
+	}
+
+	// Three liars against a node that answers the hub's own check
+	time.Sleep(1100 * time.Millisecond)
+	for _, claimer := range []*TestNode{g.Nodes[1], g.Nodes[3], g.Nodes[4]} {
+		if err := g.claimUnreachable(claimer, hub, healthy, claimer, 1); err != nil {
+			return err
+		}
+	}
+	err = g.WaitForConvergence(func() bool {
+		return !rt.IsRetracted(healthy.System.ID) && rt.IsRoutingTablePeer(healthy.System.ID) &&
+			rt.GetSuspicionCount(healthy.System.ID) == 0
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("healthy node still demoted after answering: %w", err)
+	}
+	return nil
+}
+
+// claimUnreachable has from send to a claim, made by claimer, that target is unreachable
+func (g *TestGalaxy) claimUnreachable(from, to, target, claimer *TestNode, hops int) error {
+	attempts := make([]time.Time, MaxFailCount)
+	for i := range attempts {
+		attempts[i] = time.Now()
+	}
+	claim, err := NewUnreachableClaim(claimer.System, target.System.ID, attempts)
+	if err != nil {
+		return err
+	}
+	msg, err := NewPeerUnreachableRequest(from.System, to.System.ID, claim, hops, "")
+	if err != nil {
+		return err
+	}
+	_, err = from.DHT.sendRequest(to.Address, msg)
+	return err
+}
+
+// simulateRejections: A's peers B, C, D and E are replaced by servers answering every
+// request with a protocol error. B runs an incompatible version and is left alone for
+// a day, C is rate limiting and is retried with a doubling backoff, and D and E refuse
+// A's coordinates: one refusal could be the peer's fault, the second warns A about itself
+func simulateRejections() error {
+	g, err := NewTestGalaxy(5)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+
+	refusals := []DHTError{
+		{Code: ErrCodeIncompatibleVersion, Message: "incompatible protocol version 2.0.0"},
+		{Code: ErrCodeRateLimited, Message: "rate limit reached, try again later"},
+		{Code: ErrCodeInvalidMessage, Message: "coordinates invalid for UUID and sponsor"},
+		{Code: ErrCodeInvalidMessage, Message: "coordinates invalid for UUID and sponsor"},
+	}
+	hits := make([]int32, len(refusals))
+	for i, refusal := range refusals {
+		i, refusal, n := i, refusal, g.Nodes[i+1]
+		n.Stop()
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			n.DHT.sendError(w, refusal.Code, refusal.Message)
+		})}
+		listener, err := net.Listen("tcp", n.Address)
+		if err != nil {
+			return err
+		}
+		go server.Serve(listener)
+		defer server.Close()
+	}
+
+	a, b, c, d, e := g.Nodes[0], g.Nodes[1], g.Nodes[2], g.Nodes[3], g.Nodes[4]
+	rt := a.RoutingTable()
+	ping := func(sys *System) (*PeerRejectionError, error) {
+		err := a.DHT.PingNode(sys)
+		var rejection *PeerRejectionError
+		if !errors.As(err, &rejection) {
+			return nil, fmt.Errorf("pinging %s: expected a rejection, got %v", sys.Name, err)
+		}
+		return rejection, nil
+	}
+	holdOff := func(r PeerRejection) time.Duration {
+		return time.Duration(r.RetryAt-r.At) * time.Second
+	}
+
+	// B: incompatible version, so it isn't asked again for a day
+	rejection, err := ping(b.System)
+	if err != nil {
+		return err
+	}
+	if rejection.Rejection.Class != RejectionPermanent || holdOff(rejection.Rejection) != PermanentRejectionRecheck {
+		return fmt.Errorf("B's version refusal: class %q, held %v", rejection.Rejection.Class, holdOff(rejection.Rejection))
+	}
+	if meta := rt.GetCachedSystemMeta(b.System.ID); meta.FailCount != 0 {
+		return fmt.Errorf("B answered but was counted as failed %d times", meta.FailCount)
+	}
+	if rejection, err = ping(b.System); err != nil {
+		return err
+	}
+	if !rejection.Held || atomic.LoadInt32(&hits[0]) != 1 {
+		return fmt.Errorf("B was contacted again while refusing A (held %v, %d requests)", rejection.Held, atomic.LoadInt32(&hits[0]))
+	}
+	saved, err := a.Storage.GetAllPeerSystemsWithMeta()
+	if err != nil {
+		return err
+	}
+	for _, meta := range saved {
+		if meta.System.ID == b.System.ID && meta.RejectionReason != refusals[0].Message {
+			return fmt.Errorf("saved rejection reason for B is %q", meta.RejectionReason)
+		}
+	}
+
+	// C: rate limited, so backed off and retried, backing off twice as long next time
+	if rejection, err = ping(c.System); err != nil {
+		return err
+	}
+	if rejection.Rejection.Class != RejectionTransient || holdOff(rejection.Rejection) != RejectionBackoffBase {
+		return fmt.Errorf("C's rate limit: class %q, held %v", rejection.Rejection.Class, holdOff(rejection.Rejection))
+	}
+	if rejection, err = ping(c.System); err != nil {
+		return err
+	}
+	if !rejection.Held || atomic.LoadInt32(&hits[1]) != 1 {
+		return fmt.Errorf("C was contacted again during its backoff")
+	}
+	rt.cacheMu.Lock()
+	rt.systemCache[c.System.ID].Rejection.RetryAt = time.Now().Unix() - 1 // Its backoff runs out
+	rt.cacheMu.Unlock()
+	if rejection, err = ping(c.System); err != nil {
+		return err
+	}
+	if rejection.Held || atomic.LoadInt32(&hits[1]) != 2 || holdOff(rejection.Rejection) != 2*RejectionBackoffBase {
+		return fmt.Errorf("C after its backoff: held %v, %d requests, next backoff %v",
+			rejection.Held, atomic.LoadInt32(&hits[1]), holdOff(rejection.Rejection))
+	}
+
+	// D and E: A's coordinates refused, by one peer and then by a second
+	if rejection, err = ping(d.System); err != nil {
+		return err
+	}
+	if rejection.Rejection.Class != RejectionSelf {
+		return fmt.Errorf("D's coordinates refusal classed %q", rejection.Rejection.Class)
+	}
+	if w := rt.GetSelfRejectionWarning(); w != nil {
+		return fmt.Errorf("one peer refusing A's coordinates raised a warning")
+	}
+	if _, err = ping(e.System); err != nil {
+		return err
+	}
+	w := a.DHT.NetworkStats().RejectedByPeers
+	if w.Peers != 2 || w.Reason != refusals[3].Message {
+		return fmt.Errorf("two peers refusing A's coordinates: warning %+v", w)
+	}
+
+	// Once a peer accepts A again, the warning goes
+	rt.MarkVerified(d.System.ID)
+	if w := rt.GetSelfRejectionWarning(); w != nil {
+		return fmt.Errorf("warning stayed after D accepted A")
+	}
+	return nil
+}
+
+// simulateLeaderboard: B has a Bronze balance and attestations from C spanning 200 hours;
+// D claims Gold with none; C keeps its credits private. Their announces reach A, which
+// lists B and D as claimed until it asks for proofs: B's covers Bronze, D's covers
+// nothing and drops it below B
+func simulateLeaderboard() error {
+	g, err := NewTestGalaxy(4)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b, c, d := g.Nodes[0], g.Nodes[1], g.Nodes[2], g.Nodes[3]
+
+	now := time.Now().Unix()
+	for _, ts := range []int64{now - 200*3600, now} {
+		att := &Attestation{
+			FromSystemID: c.System.ID,
+			ToSystemID:   b.System.ID,
+			Timestamp:    ts,
+			MessageType:  "dht_ping",
+			PublicKey:    base64.StdEncoding.EncodeToString(c.System.Keys.PublicKey),
+		}
+		att.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(c.System.Keys.PrivateKey, att.GetSignableMessage()))
+		if err := b.Storage.SaveAttestation(att, b.System.ID); err != nil {
+			return err
+		}
+	}
+	for _, n := range []struct {
+		node    *TestNode
+		balance int64
+	}{{b, 200}, {c, 800}, {d, 2200}} {
+		if err := n.node.Storage.SaveCreditBalance(&CreditBalance{SystemID: n.node.System.ID, Balance: n.balance}); err != nil {
+			return err
+		}
+	}
+	c.DHT.EnablePrivateCredits()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	for _, n := range []*TestNode{b, c, d} {
+		if err := n.DHT.AnnounceToSystem(a.System); err != nil {
+			return fmt.Errorf("%s announcing: %w", n.System.Name, err)
+		}
+	}
+
+	order := func(board *Leaderboard) string {
+		var names []string
+		for _, e := range board.Systems {
+			names = append(names, fmt.Sprintf("%s:%s:%s", e.Name, e.Rank, e.Status))
+		}
+		return strings.Join(names, " ")
+	}
+	want := fmt.Sprintf("%s:Gold:claimed %s:Bronze:claimed %s:Unranked:verified", d.System.Name, b.System.Name, a.System.Name)
+	board := a.DHT.GetLeaderboard(10, true)
+	if got := order(board); got != want {
+		return fmt.Errorf("leaderboard before proofs is %q, want %q", got, want)
+	}
+	if board.Local == nil || board.Local.Position != 3 || board.Total != 3 {
+		return fmt.Errorf("A's own entry is %+v of %d, want 3rd of 3", board.Local, board.Total)
+	}
+
+	// The highest claim is checked first; C answers, but with no proof
+	if sys := a.RoutingTable().nextRankToVerify(time.Now()); sys == nil || sys.ID != d.System.ID {
+		return fmt.Errorf("first claim to verify is %v, want D's", sys)
+	}
+	for _, n := range []*TestNode{d, b} {
+		if err := a.DHT.verifyRank(n.System); err != nil {
+			return fmt.Errorf("verifying %s: %w", n.System.Name, err)
+		}
+	}
+	if err := a.DHT.verifyRank(c.System); err == nil {
+		return fmt.Errorf("C proved a rank it keeps private")
+	}
+	if sys := a.RoutingTable().nextRankToVerify(time.Now()); sys != nil {
+		return fmt.Errorf("%s is due a check right after one", sys.Name)
+	}
+
+	want = fmt.Sprintf("%s:Bronze:verified %s:Unranked:verified %s:Gold:claimed", b.System.Name, a.System.Name, d.System.Name)
+	board = a.DHT.GetLeaderboard(10, true)
+	if got := order(board); got != want {
+		return fmt.Errorf("leaderboard after proofs is %q, want %q", got, want)
+	}
+	if vr := board.Systems[2].VerifiedRank; vr != "Unranked" {
+		return fmt.Errorf("D's proof covers %q, want Unranked", vr)
+	}
+	if board := a.DHT.GetLeaderboard(10, false); board.Local != nil || board.Total != 2 {
+		return fmt.Errorf("public leaderboard lists A: %+v", board.Local)
+	}
+
+	// Verifications survive a restart
+	metas, err := a.Storage.GetAllPeerSystemsWithMeta()
+	if err != nil {
+		return err
+	}
+	for _, meta := range metas {
+		if meta.System.ID == b.System.ID && (meta.RankClaim == nil || meta.RankVerified != "Bronze") {
+			return fmt.Errorf("B's saved rank is %+v verified %q", meta.RankClaim, meta.RankVerified)
+		}
+	}
+	return nil
+}
+
+// simulateRetention: with tight limits, A trims each table down to them except where a
+// guard holds: verified transfers inside the double-spend lookback, recently verified
+// systems, attestations since the last credit calculation and each day's first and last,
+// and the latest galaxy snapshot. Trimmed systems take their connections with them, and
+// galaxy history still replays from a new keyframe
+func simulateRetention() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b := g.Nodes[0], g.Nodes[1]
+
+	// Galaxy history: A alone, then A and B four more times
+	if _, err := a.DHT.takeGalaxySnapshot(); err != nil {
+		return err
+	}
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := a.DHT.takeGalaxySnapshot(); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	db := a.Storage.db
+
+	// 6 transfers verified 100 days ago, 4 today
+	for i := 0; i < 10; i++ {
+		verifiedAt := now.Unix() - int64(i)
+		if i < 6 {
+			verifiedAt = now.Add(-100 * 24 * time.Hour).Unix()
+		}
+		if _, err := db.Exec(`INSERT INTO verified_transfers (id, from_system_id, to_system_id, amount, timestamp, signature, proof_hash, verified_at)
+			VALUES (?, ?, ?, 1, ?, '', '', ?)`, uuid.New().String(), b.System.ID.String(), uuid.New().String(), verifiedAt, verifiedAt); err != nil {
+			return err
+		}
+	}
+
+	// B, just verified, and 3 systems last verified 2-4 hours ago, each linked to B
+	if err := a.Storage.SavePeerSystem(b.System); err != nil {
+		return err
+	}
+	if _, err := db.Exec(`UPDATE peer_systems SET last_verified = ? WHERE id = ?`, now.Unix(), b.System.ID.String()); err != nil {
+		return err
+	}
+	var stale []*System
+	for i := 0; i < 3; i++ {
+		sys := &System{ID: uuid.New(), Name: fmt.Sprintf("Stale-%d", i), Address: "127.0.0.1:1", PeerAddress: "127.0.0.1:1"}
+		sys.GenerateMultiStarSystem()
+		if err := a.Storage.SavePeerSystem(sys); err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE peer_systems SET last_verified = ? WHERE id = ?`, now.Add(-time.Duration(4-i)*time.Hour).Unix(), sys.ID.String()); err != nil {
+			return err
+		}
+		if err := a.Storage.SavePeerConnections(sys.ID, []uuid.UUID{b.System.ID}); err != nil {
+			return err
+		}
+		stale = append(stale, sys)
+	}
+
+	// 20 attestations from B spread over a day 10 days back; credits were last calculated yesterday
+	day := now.Add(-10*24*time.Hour).Unix() / 86400 * 86400
+	for i := 0; i < 20; i++ {
+		att := SignAttestation(b.System.ID, a.System.ID, "dht_ping", b.System.Keys.PrivateKey, b.System.Keys.PublicKey)
+		att.Timestamp = day + int64(i)*3600
+		att.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(b.System.Keys.PrivateKey, att.GetSignableMessage()))
+		if err := a.Storage.SaveAttestation(att, a.System.ID); err != nil {
+			return err
+		}
+	}
+	if err := a.DHT.FlushAttestations(); err != nil {
+		return err
+	}
+	if err := a.Storage.SaveCreditBalance(&CreditBalance{SystemID: a.System.ID, LastUpdated: now.Add(-24 * time.Hour).Unix()}); err != nil {
+		return err
+	}
+	recent, err := a.Storage.CountRows("attestations")
+	if err != nil {
+		return err
+	}
+	recent -= 20
+
+	limits, err := ParseRetentionSpec("verified_transfers:2:0,peer_systems:2,galaxy_snapshots:4:,attestations:10")
+	if err != nil {
+		return err
+	}
+	a.DHT.SetRetentionLimits(limits)
+	if _, err := a.DHT.trimTables(); err != nil {
+		return err
+	}
+
+	tables := make(map[string]TableRetention)
+	for _, t := range a.DHT.RetentionStats().Tables {
+		tables[t.Table] = t
+	}
+
+	// The 4 transfers inside the lookback stay, 2 past the cap
+	if t := tables[RetainVerifiedTransfers]; t.Rows != 4 || t.LastRemoved != 6 || t.HeldBack != 2 {
+		return fmt.Errorf("verified_transfers: %+v, want 4 rows after removing 6 with 2 held back", t)
+	}
+
+	// The two stalest systems go, with their connections; B stays
+	if t := tables[RetainPeerSystems]; t.Rows != 2 || t.LastRemoved != 2 {
+		return fmt.Errorf("peer_systems: %+v, want 2 rows after removing 2", t)
+	}
+	for i, sys := range stale {
+		var rows int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM peer_systems WHERE id = ?`, sys.ID.String()).Scan(&rows); err != nil {
+			return err
+		}
+		var links int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM peer_connections WHERE system_id = ?`, sys.ID.String()).Scan(&links); err != nil {
+			return err
+		}
+		if want := map[bool]int{true: 1, false: 0}[i == 2]; rows != want || links != want {
+			return fmt.Errorf("stale system %d has %d rows and %d connections, want %d", i, rows, links, want)
+		}
+	}
+
+	// Old attestations go down to the cap (the recent ones and the day's ends are safe),
+	// rolled into summaries
+	if t := tables[RetainAttestations]; t.Rows != 10 || t.HeldBack != 0 {
+		return fmt.Errorf("attestations: %+v, want 10 rows", t)
+	}
+	var ends, summarized int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM attestations WHERE timestamp IN (?, ?)`, day, day+19*3600).Scan(&ends); err != nil {
+		return err
+	}
+	if err := db.QueryRow(`SELECT COALESCE(SUM(attestation_count), 0) FROM attestation_summaries`).Scan(&summarized); err != nil {
+		return err
+	}
+	if ends != 2 || int64(summarized) != 10+recent {
+		return fmt.Errorf("kept %d of the day's ends and summarized %d attestations, want 2 and %d", ends, summarized, 10+recent)
+	}
+
+	// Galaxy history starts at a new keyframe holding A and B
+	snaps, err := a.Storage.GetGalaxySnapshots(0, now.Unix()+1)
+	if err != nil {
+		return err
+	}
+	if len(snaps) != 4 || !snaps[0].Keyframe || len(snaps[0].AddedSystems) != 2 {
+		return fmt.Errorf("galaxy history after trimming: %d snapshots, first %+v", len(snaps), snaps[0])
+	}
+	return nil
+}
+
+// simulateCreditProof: A has 200,000 attestations from 50 peers, one every 150 s (about
+// 347 days). A proof for 500 credits needs only the newest 12,001 of them, paged from
+// SQL, and must be built in well under 100 ms; one for the whole history (tens of MB
+// naively) is thinned to fit a transfer, or refused if even two attestations won't fit;
+// a rank proof picks from three rows
+func simulateCreditProof() error {
+	g, err := NewTestGalaxy(1)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a := g.Nodes[0]
+
+	const total, every = 200000, 150
+	peers := make([]string, 50)
+	for i := range peers {
+		peers[i] = uuid.New().String()
+	}
+	now := time.Now().Unix()
+
+	tx, err := a.Storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO attestations (from_system_id, to_system_id, received_by, timestamp,
+		message_type, signature, public_key, verified, created_at, clock_skew) VALUES (?, ?, ?, ?, 'ping', 'sig', 'key', 1, ?, 0)`)
+	if err != nil {
+		return err
+	}
+	id := a.System.ID.String()
+	for i := 0; i < total; i++ {
+		ts := now - int64(i)*every
+		if _, err := stmt.Exec(peers[i%len(peers)], id, id, ts, ts); err != nil {
+			return err
+		}
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	page := func(limit int, before int64) ([]*Attestation, error) {
+		return a.Storage.GetRecentAttestationsForSystem(a.System.ID, limit, before)
+	}
+	start := time.Now()
+	proof, err := BuildMinimalProof(a.System, 400, 100, page, TransferProofBudget)
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+	if budget := raceSlowdown * 100 * time.Millisecond; elapsed > budget {
+		return fmt.Errorf("building a 500 credit proof from %d attestations took %v, want under %v", total, elapsed, budget)
+	}
+	if want := 500 * 3600 / every; proof.ClaimedTotal != 500 || len(proof.Attestations) != want+1 {
+		return fmt.Errorf("proof claims %d credits with %d attestations, want 500 with %d", proof.ClaimedTotal, len(proof.Attestations), want+1)
+	}
+	for i := 1; i < len(proof.Attestations); i++ {
+		if proof.Attestations[i].Timestamp >= proof.Attestations[i-1].Timestamp {
+			return fmt.Errorf("proof attestations out of order at %d", i)
+		}
+	}
+	if proof.Attestations[0].Timestamp != now {
+		return fmt.Errorf("proof starts at %d, want the newest attestation %d", proof.Attestations[0].Timestamp, now)
+	}
+
+	// Asking for more than the history covers proves all of it rather than failing,
+	// thinned to fit a transfer between the newest and oldest attestation
+	all, err := BuildMinimalProof(a.System, 1000000, 0, page, TransferProofBudget)
+	if err != nil {
+		return err
+	}
+	if len(all.Attestations) >= total || all.ClaimedTotal != (total-1)*every/3600 ||
+		all.Attestations[0].Timestamp != now || all.Attestations[len(all.Attestations)-1].Timestamp != now-(total-1)*every {
+		return fmt.Errorf("whole-history proof has %d attestations for %d credits", len(all.Attestations), all.ClaimedTotal)
+	}
+	if data, err := json.Marshal(all); err != nil || len(data) > TransferProofBudget {
+		return fmt.Errorf("whole-history proof is %d bytes, over the %d budget", len(data), TransferProofBudget)
+	}
+
+	// A budget too small even for the newest and oldest attestation fails cleanly
+	if _, err := BuildMinimalProof(a.System, 1000000, 0, page, 512); !errors.Is(err, ErrProofTooLarge) {
+		return fmt.Errorf("proof over a 512-byte budget: %v, want ErrProofTooLarge", err)
+	}
+
+	candidates, err := a.DHT.rankProofCandidates(GetRank(1000).Threshold)
+	if err != nil {
+		return err
+	}
+	if len(candidates) != 3 || candidates[0].Timestamp != now || candidates[2].Timestamp != now-(total-1)*every {
+		return fmt.Errorf("rank proof candidates: %d, want the newest, one a rank older and the oldest", len(candidates))
+	}
+	attesters, err := a.Storage.CountAttestersForSystem(a.System.ID)
+	if err != nil {
+		return err
+	}
+	if attesters != len(peers) {
+		return fmt.Errorf("counted %d attesters, want %d", attesters, len(peers))
+	}
+	return nil
+}
+
+// simulateLegacyAttestations: a database from before received_by holds a peer's
+// untargeted attestations over 50 hours, another's targeted ones over the last 10, one the
+// node sent, one addressed elsewhere and a compacted summary. Migrating attributes all but
+// the sent and misaddressed ones to the node, logging the counts; the credit cycle reads
+// them all, and a transfer proof built from them is worth the 10 targeted hours plus half
+// the 50 untargeted ones, capped at another 10, survives JSON, and counts nothing for
+// untargeted attestations claimed by another system or left on their own
+func simulateLegacyAttestations() error {
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stellar-lab.db")
+
+	s, err := NewStorage(path)
+	if err != nil {
+		return err
+	}
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		s.Close()
+		return err
+	}
+	sys := &System{ID: uuid.New(), Name: "Old Timer", CreatedAt: time.Now(), LastSeenAt: time.Now(), Keys: keys}
+	sys.GenerateMultiStarSystem()
+	if err := s.SaveSystem(sys); err != nil {
+		s.Close()
+		return err
+	}
+
+	// As it was before received_by: no column, no schema_version
+	for _, stmt := range []string{
+		"DROP TABLE schema_version",
+		"DROP INDEX idx_attestations_received_by",
+		"ALTER TABLE attestations DROP COLUMN received_by",
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			s.Close()
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	legacyKeys, err := GenerateKeyPair()
+	if err != nil {
+		s.Close()
+		return err
+	}
+	targetedKeys, err := GenerateKeyPair()
+	if err != nil {
+		s.Close()
+		return err
+	}
+	legacyPeer, targetedPeer, elsewhere := uuid.New(), uuid.New(), uuid.New()
+	now := time.Now().Unix()
+	insert := func(from, to uuid.UUID, k *KeyPair, ts int64) error {
+		a := &Attestation{FromSystemID: from, ToSystemID: to, Timestamp: ts, MessageType: "ping",
+			PublicKey: base64.StdEncoding.EncodeToString(k.PublicKey)}
+		a.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(k.PrivateKey, a.GetSignableMessage()))
+		_, err := s.db.Exec(`INSERT INTO attestations (from_system_id, to_system_id, timestamp, message_type,
+			signature, public_key, verified, created_at) VALUES (?, ?, ?, ?, ?, ?, 1, ?)`,
+			from.String(), to.String(), ts, a.MessageType, a.Signature, a.PublicKey, ts)
+		return err
+	}
+	const legacyHours, targetedHours = 50, 10
+	for h := 0; h <= legacyHours; h++ {
+		if err := insert(legacyPeer, uuid.Nil, legacyKeys, now-int64(targetedHours+1+h)*3600); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	for h := 0; h <= targetedHours; h++ {
+		if err := insert(targetedPeer, sys.ID, targetedKeys, now-int64(h)*3600); err != nil {
+			s.Close()
+			return err
+		}
+	}
+	received := legacyHours + targetedHours + 2
+	if err := insert(sys.ID, legacyPeer, keys, now); err != nil {
+		s.Close()
+		return err
+	}
+	if err := insert(legacyPeer, elsewhere, legacyKeys, now); err != nil {
+		s.Close()
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO attestation_summaries (from_system_id, received_by, day, attestation_count,
+		first_timestamp, last_timestamp) VALUES (?, '', '2024-01-01', 40, 1704067200, 1704150000)`, legacyPeer.String())
+	s.Close()
+	if err != nil {
+		return err
+	}
+
+	var logged bytes.Buffer
+	w := log.Writer()
+	log.SetOutput(io.MultiWriter(w, &logged))
+	s, err = NewStorage(path)
+	log.SetOutput(w)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if v, err := s.SchemaVersion(); err != nil || v != len(migrations) {
+		return fmt.Errorf("migrated to schema version %d (%v), want %d", v, err, len(migrations))
+	}
+	if want := fmt.Sprintf("%d before, 2 after (%d attributed", received+2, received); !strings.Contains(logged.String(), want) {
+		return fmt.Errorf("migration log doesn't give the counts %q:\n%s", want, logged.String())
+	}
+
+	var unattributed, summaries int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM attestations WHERE received_by = ''").Scan(&unattributed); err != nil {
+		return err
+	}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM attestation_summaries WHERE received_by = ?", sys.ID.String()).Scan(&summaries); err != nil {
+		return err
+	}
+	if unattributed != 2 || summaries != 1 {
+		return fmt.Errorf("%d attestations left unattributed and %d summaries attributed, want 2 and 1", unattributed, summaries)
+	}
+
+	// The credit cycle counts every one it received
+	since, err := s.GetAttestationsSince(sys.ID, 0)
+	if err != nil {
+		return err
+	}
+	if len(since) != received {
+		return fmt.Errorf("credit cycle sees %d attestations, want %d", len(since), received)
+	}
+
+	// A proof weighs the hours only untargeted attestations cover at half, up to the cap
+	page := func(limit int, before int64) ([]*Attestation, error) {
+		return s.GetRecentAttestationsForSystem(sys.ID, limit, before)
+	}
+	proof, err := BuildMinimalProof(sys, 1000000, 0, page, TransferProofBudget)
+	if err != nil {
+		return err
+	}
+	want := int64(targetedHours + min(legacyHours*LegacyAttestationWeight, targetedHours*LegacyAttestationCap))
+	if proof.ClaimedTotal != want || len(proof.Attestations) != received {
+		return fmt.Errorf("proof claims %d credits with %d attestations, want %d with %d", proof.ClaimedTotal, len(proof.Attestations), want, received)
+	}
+	data, err := json.Marshal(proof)
+	if err != nil {
+		return err
+	}
+	var sent CreditProof
+	if err := json.Unmarshal(data, &sent); err != nil {
+		return err
+	}
+	transfer := NewCreditTransfer(sys, uuid.New(), want, "")
+	transfer.Proof = &sent
+	if err := ValidateTransferProof(transfer, nil); err != nil {
+		return fmt.Errorf("transfer of the proven %d credits refused: %w", want, err)
+	}
+	transfer = NewCreditTransfer(sys, uuid.New(), want+1, "")
+	transfer.Proof = &sent
+	if err := ValidateTransferProof(transfer, nil); err == nil {
+		return fmt.Errorf("transfer of %d credits accepted with %d proven", want+1, want)
+	}
+
+	// Untargeted attestations claimed by someone else prove nothing for the node
+	for _, att := range sent.Attestations {
+		if att.ToSystemID == uuid.Nil {
+			att.ReceivedBy = &elsewhere
+		}
+	}
+	if got := CalculateCreditsFromAttestations(sent.Attestations, sys.ID); got != targetedHours {
+		return fmt.Errorf("with the untargeted attestations claimed elsewhere the proof is worth %d, want %d", got, targetedHours)
+	}
+
+	// Without a targeted attestation, untargeted ones prove nothing
+	var untargeted []*Attestation
+	for _, att := range since {
+		if att.ToSystemID == uuid.Nil {
+			untargeted = append(untargeted, att)
+		}
+	}
+	if got := CalculateCreditsFromAttestations(untargeted, sys.ID); len(untargeted) != legacyHours+1 || got != 0 {
+		return fmt.Errorf("%d untargeted attestations alone are worth %d, want nothing", len(untargeted), got)
+	}
+	return nil
+}
+
+// simulateMigrations: a database from before schema_version, missing the columns of
+// migrations 13, 14 and 16, is detected at version 12 and brought up to date, with
+// reciprocal links worked out for existing rows. A migration that fails rolls back and
+// stops startup, and a database from a newer build is refused
+func simulateMigrations() error {
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stellar-lab.db")
+	latest := len(migrations)
+
+	s, err := NewStorage(path)
+	if err != nil {
+		return err
+	}
+	if v, err := s.SchemaVersion(); err != nil || v != latest {
+		s.Close()
+		return fmt.Errorf("new database at schema version %d (%v), want %d", v, err, latest)
+	}
+	for _, stmt := range []string{
+		"DROP TABLE schema_version",
+		"ALTER TABLE peer_systems DROP COLUMN rank_verified",
+		"ALTER TABLE credit_earnings DROP COLUMN avg_connectivity",
+		"INSERT INTO peer_connections (system_id, peer_id, updated_at) VALUES ('a', 'b', 1), ('b', 'a', 1), ('a', 'c', 1)",
+		"ALTER TABLE peer_connections DROP COLUMN reciprocal",
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			s.Close()
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	s.Close()
+
+	check := func(want int, detected bool) error {
+		db, err := sql.Open("sqlite3", path+"?_query_only=true")
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		state, err := readSchemaState(db)
+		if err != nil {
+			return err
+		}
+		if state.Version != want || state.Detected != detected || state.Fresh {
+			return fmt.Errorf("schema state %+v, want version %d (detected: %v)", state, want, detected)
+		}
+		return nil
+	}
+	if err := check(12, true); err != nil {
+		return err
+	}
+
+	if s, err = NewStorage(path); err != nil {
+		return err
+	}
+	var reciprocal int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM peer_connections WHERE reciprocal = 1").Scan(&reciprocal)
+	s.Close()
+	if err != nil {
+		return err
+	}
+	if reciprocal != 2 {
+		return fmt.Errorf("%d reciprocal links after migrating, want 2", reciprocal)
+	}
+	if err := check(latest, false); err != nil {
+		return err
+	}
+
+	// A failing migration leaves nothing behind and the database at the version before it
+	migrations = append(migrations, migration{
+		name: "broken",
+		apply: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("ALTER TABLE system ADD COLUMN half_done TEXT"); err != nil {
+				return err
+			}
+			return errors.New("broken on purpose")
+		},
+	})
+	_, err = NewStorage(path)
+	migrations = migrations[:latest]
+	if err == nil || !strings.Contains(err.Error(), "broken on purpose") {
+		return fmt.Errorf("opening with a failing migration: %v, want its error", err)
+	}
+	if err := check(latest, false); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", path+"?_query_only=true")
+	if err != nil {
+		return err
+	}
+	halfDone, err := hasColumns(db, "system", "half_done")
+	db.Close()
+	if err != nil || halfDone {
+		return fmt.Errorf("failed migration's column left behind (%v)", err)
+	}
+
+	// A newer build's database isn't touched
+	if s, err = NewStorage(path); err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, 'from the future', 0)", latest+1)
+	s.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := NewStorage(path); err == nil || !strings.Contains(err.Error(), "newer than this build") {
+		return fmt.Errorf("opening a newer database: %v, want a refusal", err)
+	}
+	return nil
+}
+
+// simulateGenesis: two five-node islands, each with its own genesis, are bridged. The
+// younger genesis demotes itself under the older one and keeps its peers, every node ends
+// up seeing a single genesis, the systems the loser sponsored still validate, and a class
+// change without a valid demotion record is refused
+func simulateGenesis() error {
+	g, err := NewTestGalaxy(10)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+
+	loser, winner := g.Nodes[0], g.Nodes[5]
+	winner.System.CreatedAt = time.Now().Add(-time.Hour)
+	winner.DHT.becomeGenesisNode()
+
+	for i := 1; i < 5; i++ {
+		if err := g.Connect(i, 0); err != nil {
+			return fmt.Errorf("connecting %d to 0: %w", i, err)
+		}
+		if err := g.Connect(i+5, 5); err != nil {
+			return fmt.Errorf("connecting %d to 5: %w", i+5, err)
+		}
+	}
+	if err := g.Connect(4, 9); err != nil {
+		return fmt.Errorf("bridging the islands: %w", err)
+	}
+
+	// Lookups carry each genesis across the bridge
+	err = g.WaitForConvergence(func() bool {
+		for _, node := range g.Nodes {
+			node.DHT.FindNode(uuid.New())
+		}
+		return !isGenesis(loser.System)
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("node 0 never stepped down: %w", err)
+	}
+	if loser.System.Stars.Primary.Class == "X" || loser.System.SponsorID == nil || *loser.System.SponsorID != winner.System.ID {
+		return fmt.Errorf("node 0 demoted to class %s, sponsor %v", loser.System.Stars.Primary.Class, loser.System.SponsorID)
+	}
+	if status, reason := CheckCoordinates(loser.System, func(uuid.UUID) *System { return winner.System }); status != CoordsValid {
+		return fmt.Errorf("node 0's new coordinates don't follow from its sponsor: %s", reason)
+	}
+	if !isGenesis(winner.System) {
+		return fmt.Errorf("node 5 gave up the origin too")
+	}
+	for i := 1; i < 5; i++ {
+		if !loser.RoutingTable().IsRoutingTablePeer(g.Nodes[i].System.ID) {
+			return fmt.Errorf("node 0 lost node %d from its routing table", i)
+		}
+	}
+
+	// Every node comes to know both and sees one genesis
+	child := g.Nodes[1]
+	err = g.WaitForConvergence(func() bool {
+		for _, node := range g.Nodes {
+			node.DHT.FindNode(uuid.New())
+		}
+		for _, node := range g.Nodes {
+			rt := node.RoutingTable()
+			if node != loser && !seesDemoted(rt.GetCachedSystem(loser.System.ID)) {
+				return false
+			}
+			if node != winner && rt.GetCachedSystem(winner.System.ID) == nil {
+				return false
+			}
+		}
+		return winner.RoutingTable().GetCachedSystem(child.System.ID) != nil
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("the demotion didn't reach every node: %w", err)
+	}
+	for i, node := range g.Nodes {
+		count := 0
+		for _, sys := range append(node.RoutingTable().GetAllCachedSystems(), node.System) {
+			if isGenesis(sys) {
+				count++
+			}
+		}
+		if count != 1 {
+			return fmt.Errorf("node %d sees %d genesis systems", i, count)
+		}
+	}
+
+	// Node 1 was sponsored from the origin; the record keeps it valid in node 5's eyes
+	rt := winner.RoutingTable()
+	if status, reason := CheckCoordinates(rt.GetCachedSystem(child.System.ID), rt.GetCachedSystem); status != CoordsValid {
+		return fmt.Errorf("node 5 finds node 1's coordinates %v: %s", status, reason)
+	}
+
+	// Node 5's own signature on a class change isn't enough without its own record
+	forged := *winner.System
+	forged.Stars = assignStarFromClass("G")
+	forged.GenesisDemotion = &GenesisDemotion{SystemID: forged.ID, WinnerID: loser.System.ID, DemotedAt: time.Now().Unix()}
+	forged.GenesisDemotion.Signature = base64.StdEncoding.EncodeToString(
+		ed25519.Sign(g.Nodes[6].System.Keys.PrivateKey, forged.GenesisDemotion.signableMessage()))
+	forged.BumpInfoVersion()
+	child.RoutingTable().CacheSystem(&forged, forged.ID, true)
+	if cached := child.RoutingTable().GetCachedSystem(winner.System.ID); cached.Stars.Primary.Class != "X" {
+		return fmt.Errorf("node 1 accepted node 5 as class %s without a valid demotion record", cached.Stars.Primary.Class)
+	}
+
+	// The record survives a restart on both sides of it
+	local, err := loser.Storage.LoadSystem()
+	if err != nil || local.GenesisDemotion == nil || local.GenesisDemotion.WinnerID != winner.System.ID {
+		return fmt.Errorf("node 0 didn't keep its demotion record (%v)", err)
+	}
+	if stored, err := winner.Storage.GetPeerSystem(loser.System.ID); err != nil || stored.GenesisDemotion == nil {
+		return fmt.Errorf("node 5 didn't store node 0's demotion record (%v)", err)
+	}
+	return nil
+}
+
+// seesDemoted reports whether a cached system is a former genesis with its record
+func seesDemoted(sys *System) bool {
+	return sys != nil && sys.GenesisDemotion != nil && sys.Stars.Primary.Class != "X"
+}
+
+// simulateMapFilter: the known-systems and map filters keep only the systems matching each
+// predicate, clustering goes by the systems that pass, and bad parameters are refused
+func simulateMapFilter() error {
+	g, err := NewTestGalaxy(6)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub := g.Nodes[0]
+	rt := hub.RoutingTable()
+
+	// One system only heard of, a week ago
+	gossiped := &System{ID: uuid.New(), Name: "Gossiped", X: 5000, Y: 0, Z: 0, PeerAddress: "127.0.0.1:1"}
+	gossiped.Stars = assignStarFromClass("M")
+	rt.CacheSystem(gossiped, g.Nodes[1].System.ID, false)
+	if meta := rt.GetCachedSystemMeta(gossiped.ID); meta != nil {
+		meta.LearnedAt = time.Now().Add(-7 * 24 * time.Hour)
+	} else {
+		return fmt.Errorf("the gossiped system wasn't cached")
+	}
+
+	matching := func(query string) ([]string, error) {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := parseMapFilter(q)
+		if err != nil {
+			return nil, err
+		}
+		m := hub.DHT.GetGalaxyMap(0, filter)
+		if m.Total != 6 || m.Matching != len(m.Systems) {
+			return nil, fmt.Errorf("%s: total %d, matching %d of %d sent", query, m.Total, m.Matching, len(m.Systems))
+		}
+		names := []string{}
+		for _, s := range m.Systems {
+			names = append(names, s.Name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	classOf := g.Nodes[2].System.Stars.Primary.Class
+	wantClass := []string{}
+	for _, n := range append(g.Nodes[1:], &TestNode{System: gossiped}) {
+		if n.System.Stars.Primary.Class == classOf {
+			wantClass = append(wantClass, n.System.Name)
+		}
+	}
+	sort.Strings(wantClass)
+
+	near := g.Nodes[3].System
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Gossiped", "Sim-1", "Sim-2", "Sim-3", "Sim-4", "Sim-5"}},
+		{"star_class=" + strings.ToLower(classOf), wantClass},
+		{"verified_only=true", []string{"Sim-1", "Sim-2", "Sim-3", "Sim-4", "Sim-5"}},
+		{"learned_within=1d", []string{"Sim-1", "Sim-2", "Sim-3", "Sim-4", "Sim-5"}},
+		{"learned_within=8d&verified_only=false", []string{"Gossiped", "Sim-1", "Sim-2", "Sim-3", "Sim-4", "Sim-5"}},
+		{"name_prefix=sim-4", []string{"Sim-4"}},
+		{"id_prefix=" + gossiped.ID.String()[:6], []string{"Gossiped"}},
+		{fmt.Sprintf("max_distance_from=%f,%f,%f&max_distance=0.5", near.X, near.Y, near.Z), []string{"Sim-3"}},
+		{"name_prefix=Sim&learned_within=7d&star_class=X", []string{}},
+	}
+	for _, c := range cases {
+		got, err := matching(c.query)
+		if err != nil {
+			return err
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			return fmt.Errorf("%q matched %v, want %v", c.query, got, c.want)
+		}
+	}
+
+	for _, bad := range []string{"star_class=Q", "verified_only=maybe", "learned_within=soon", "max_distance=10", "max_distance_from=1,2&max_distance=10", "max_distance_from=0,0,0&max_distance=-1"} {
+		q, _ := url.ParseQuery(bad)
+		if _, err := parseMapFilter(q); err == nil {
+			return fmt.Errorf("%q was accepted", bad)
+		}
+	}
+	if f, err := parseMapFilter(url.Values{"verified_only": {"false"}}); f != nil || err != nil {
+		return fmt.Errorf("a filter that keeps everything should be no filter: %+v, %v", f, err)
+	}
+	return nil
+}
+
+// simulateReplay: a first contact's attestation has no nonce, later ones do once the
+// capability is known. Posting a stored nonce again, or the same legacy message twice,
+// is answered but stores nothing; a legacy attestation with a new timestamp is stored
+func simulateReplay() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b := g.Nodes[0], g.Nodes[1]
+
+	stored := func(limit int) ([]*AttestationRecord, int, error) {
+		if err := a.DHT.FlushAttestations(); err != nil {
+			return nil, 0, err
+		}
+		return a.Storage.GetAttestationsPaged(AttestationQuery{FromSystem: b.System.ID.String(), Limit: limit})
+	}
+	post := func(msg *DHTMessage) error {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		resp, err := postDHT(context.Background(), http.DefaultClient, peerURL(a.Address, "/dht"), data, false)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	recs, _, err := stored(100)
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 || recs[len(recs)-1].Attestation.Nonce != "" {
+		return fmt.Errorf("first contact stored %+v, want an attestation without a nonce first", recs)
+	}
+	// B learns A's capabilities from a request of A's
+	if _, err := a.DHT.Ping(b.Address); err != nil {
+		return err
+	}
+	if _, err := b.DHT.Ping(a.Address); err != nil {
+		return err
+	}
+	recs, total, err := stored(1)
+	if err != nil {
+		return err
+	}
+	if len(recs) != 1 || len(recs[0].Attestation.Nonce) != AttestationNonceLength || !recs[0].SignatureValid {
+		return fmt.Errorf("ping after A's stored %+v, want a signed nonce", recs)
+	}
+
+	// Replay the nonce'd attestation in a fresh message
+	msg, err := NewPingRequest(b.System, a.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	msg.Attestation = recs[0].Attestation
+	if err := post(msg); err != nil {
+		return fmt.Errorf("replayed ping: %w", err)
+	}
+	if _, n, err := stored(1); err != nil || n != total {
+		return fmt.Errorf("replayed nonce stored: %d attestations, want %d (%v)", n, total, err)
+	}
+
+	// A legacy message twice stores it once; a new timestamp is a new attestation
+	legacy, err := NewPingRequest(b.System, a.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		legacy.RequestID = uuid.New().String()
+		if err := post(legacy); err != nil {
+			return fmt.Errorf("legacy ping %d: %w", i+1, err)
+		}
+	}
+	if _, n, err := stored(1); err != nil || n != total+1 {
+		return fmt.Errorf("legacy ping sent twice: %d attestations, want %d (%v)", n, total+1, err)
+	}
+	legacy.Attestation.Timestamp++
+	legacy.Attestation.Signature = base64.StdEncoding.EncodeToString(
+		ed25519.Sign(b.System.Keys.PrivateKey, legacy.Attestation.GetSignableMessage()))
+	if err := post(legacy); err != nil {
+		return fmt.Errorf("legacy ping a second later: %w", err)
+	}
+	if _, n, err := stored(1); err != nil || n != total+2 {
+		return fmt.Errorf("legacy ping a second later: %d attestations, want %d (%v)", n, total+2, err)
+	}
+
+	if err := a.Storage.SaveAttestation(recs[0].Attestation, a.System.ID); !errors.Is(err, ErrReplayedAttestation) {
+		return fmt.Errorf("saving a stored attestation again returned %v", err)
+	}
+	return nil
+}
+
+// simulateMultiStar checks that binaries and trinaries keep their companions through
+// full-sync: the classes round-trip for generated systems, and a node that learned the
+// galaxy by full-sync has every system with as many stars, still matching its UUID
+func simulateMultiStar() error {
+	for i := 0; i < 1000; i++ {
+		sys := &System{ID: uuid.New()}
+		sys.GenerateMultiStarSystem()
+		stars := assignStarFromClass((&FullSyncSystem{StarClass: sys.Stars.Primary.Class, StarClasses: starClasses(sys.Stars)}).classes())
+		if stars.Count != sys.Stars.Count || stars.IsBinary != sys.Stars.IsBinary || stars.IsTrinary != sys.Stars.IsTrinary {
+			return fmt.Errorf("%s round-tripped to %d stars, want %d", starClasses(sys.Stars), stars.Count, sys.Stars.Count)
+		}
+		if starClasses(stars) != starClasses(sys.Stars) {
+			return fmt.Errorf("%s round-tripped to %s", starClasses(sys.Stars), starClasses(stars))
+		}
+	}
+	if stars := assignStarFromClass("K"); stars.Count != 1 || stars.Secondary != nil {
+		return fmt.Errorf("an older node's single class gave %d stars", stars.Count)
+	}
+
+	g, err := NewTestGalaxy(6)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	for i := 1; i < 5; i++ {
+		if err := g.Connect(i, 0); err != nil {
+			return err
+		}
+	}
+	late := g.Nodes[5]
+	if _, err := late.DHT.tryFullSync(g.Nodes[0].Address); err != nil {
+		return err
+	}
+	for _, node := range g.Nodes[1:5] {
+		got := late.RoutingTable().GetCachedSystem(node.System.ID)
+		if got == nil {
+			return fmt.Errorf("full-sync left out %s", node.System.Name)
+		}
+		if got.Stars.Count != node.System.Stars.Count || !ValidateStarSystem(got) {
+			return fmt.Errorf("%s came through full-sync as %q, want %q", node.System.Name, got.Stars.Primary.Class+"/"+starClasses(got.Stars), starClasses(node.System.Stars))
+		}
+	}
+	return nil
+}
+
+// simulateProcessUptime: B announces a process up for 3 days 4 hours. A shows it; C, which only heard of B through A, doesn't. The restart counter survives
+// saving the system again
+func simulateProcessUptime() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	b.System.ProcessStartTime = time.Now().Add(-(76*time.Hour + 10*time.Minute)).Unix()
+
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	if err := b.DHT.AnnounceToSystem(a.System); err != nil {
+		return err
+	}
+	if err := g.Connect(2, 0); err != nil {
+		return err
+	}
+	if err := g.WaitForConvergence(func() bool {
+		return c.RoutingTable().GetCachedSystem(b.System.ID) != nil
+	}, SimulationTimeout); err != nil {
+		return fmt.Errorf("C never heard of B")
+	}
+
+	detail, err := a.DHT.GetPeerDetail(b.System.ID)
+	if err != nil {
+		return err
+	}
+	if detail.ProcessUptime != "3d 4h" {
+		return fmt.Errorf("A shows B up %q, want 3d 4h", detail.ProcessUptime)
+	}
+	detail, err = c.DHT.GetPeerDetail(b.System.ID)
+	if err != nil {
+		return err
+	}
+	if detail.ProcessUptime != "" {
+		return fmt.Errorf("C shows B up %q from relayed info", detail.ProcessUptime)
+	}
+
+	for want := int64(1); want <= 2; want++ {
+		n, err := a.Storage.IncrementRestartCount(a.System.ID)
+		if err != nil {
+			return err
+		}
+		if n != want {
+			return fmt.Errorf("restart %d counted as %d", want, n)
+		}
+		if err := a.Storage.SaveSystem(a.System); err != nil {
+			return err
+		}
+	}
+	if n, err := a.Storage.IncrementRestartCount(a.System.ID); err != nil || n != 3 {
+		return fmt.Errorf("third restart counted as %d (%v); saving the system reset it", n, err)
+	}
+	return nil
+}
+
+// simulatePublicUI: with -public-ui the index page and /api/connections leave out the
+// node's own ID (the map's links to it are still there, under a blank ID), while the
+// private UI shows it; private APIs answer 404
+func simulatePublicUI() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	hub := g.Nodes[0]
+	selfID := hub.System.ID.String()
+	assets, err := loadWebAssets("")
+	if err != nil {
+		return err
+	}
+	private := &WebInterface{dht: hub.DHT, storage: hub.Storage, assets: assets}
+	public := &WebInterface{dht: hub.DHT, storage: hub.Storage, assets: assets, public: true}
+
+	for _, web := range []*WebInterface{private, public} {
+		rec := httptest.NewRecorder()
+		web.handleIndex(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("index (public: %v): status %d", web.public, rec.Code)
+		}
+		if shown := strings.Contains(rec.Body.String(), selfID); shown == web.public {
+			return fmt.Errorf("index (public: %v) shows our ID: %v", web.public, shown)
+		}
+
+		rec = httptest.NewRecorder()
+		web.handleConnectionsAPI(rec, httptest.NewRequest(http.MethodGet, "/api/connections", nil))
+		var edges []TopologyEdge
+		if err := json.NewDecoder(rec.Body).Decode(&edges); err != nil {
+			return err
+		}
+		want := selfID
+		if web.public {
+			want = ""
+		}
+		ours := 0
+		for _, e := range edges {
+			if (e.FromID == selfID || e.ToID == selfID) && web.public {
+				return fmt.Errorf("public /api/connections has our ID in %+v", e)
+			}
+			if e.FromID == want || e.ToID == want {
+				ours++
+			}
+		}
+		if ours == 0 {
+			return fmt.Errorf("/api/connections (public: %v) has no edges to us under %q: %+v", web.public, want, edges)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	public.privateOnly(public.handleCreditsAPI)(rec, httptest.NewRequest(http.MethodGet, "/api/credits", nil))
+	if rec.Code != http.StatusNotFound {
+		return fmt.Errorf("public /api/credits: status %d, want 404", rec.Code)
+	}
+	return nil
+}
+
+// simulatePeerAddresses: addresses normalize to one form (IPv6 bracketed and collapsed,
+// hostnames lowercased and left unresolved) and bad ones are refused. A node on an IPv6
+// literal joins and is reached at it, and a node bootstrapping from the genesis by
+// hostname holds the genesis as one identity under both the name and its IP. Looking up
+// an IP never resolves the hostnames other systems advertise
+func simulatePeerAddresses() error {
+	cases := []struct{ in, want string }{
+		{"127.0.0.1:7867", "127.0.0.1:7867"},
+		{" 10.0.0.5:80 ", "10.0.0.5:80"},
+		{"[2001:db8:0:0:0:0:0:1]:7867", "[2001:db8::1]:7867"},
+		{"2001:db8:0:0:0:0:0:1:7867", "[2001:db8::1]:7867"}, // Unbracketed, port last
+		{"[::1]:7867", "[::1]:7867"},
+		{"Node.Example.COM.:7867", "node.example.com:7867"},
+	}
+	for _, c := range cases {
+		if got, err := NormalizePeerAddress(c.in); err != nil || got != c.want {
+			return fmt.Errorf("NormalizePeerAddress(%q) = %q, %v; want %q", c.in, got, err, c.want)
+		}
+	}
+	for _, bad := range []string{"", "node.example.com", "2001:db8::1", ":7867", "host:0", "host:65536", "host:port"} {
+		if got, err := NormalizePeerAddress(bad); err == nil {
+			return fmt.Errorf("NormalizePeerAddress(%q) = %q, want an error", bad, got)
+		}
+	}
+	if url := peerURL("2001:db8:0:0:0:0:0:1:7867", "/dht"); url != "http://[2001:db8::1]:7867/dht" {
+		return fmt.Errorf("peerURL gave %q", url)
+	}
+	if port := addressPort("[2001:db8::1]:7867"); port != 7867 {
+		return fmt.Errorf("addressPort of an IPv6 address gave %d", port)
+	}
+	same := []struct {
+		a, b string
+		want bool
+	}{
+		{"[2001:db8::1]:7867", "2001:db8:0:0:0:0:0:1:7867", true},
+		{"LocalHost.:7867", "localhost:7867", true},
+		{"localhost:7867", "127.0.0.1:7867", false}, // Name to IP is left to GetSystemIDByAddress
+		{"127.0.0.1:7867", "127.0.0.2:7867", false},
+	}
+	for _, c := range same {
+		if got := samePeerAddress(c.a, c.b); got != c.want {
+			return fmt.Errorf("samePeerAddress(%q, %q) = %v", c.a, c.b, got)
+		}
+	}
+
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	genesis := g.Nodes[0]
+
+	// A node on IPv6 loopback
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		return fmt.Errorf("no IPv6 loopback: %w", err)
+	}
+	v6Addr := l.Addr().String()
+	l.Close()
+	v6, err := g.startNodeAt("Sim-v6", v6Addr)
+	if err != nil {
+		return err
+	}
+	g.Nodes = append(g.Nodes, v6)
+	if err := g.Connect(2, 0); err != nil {
+		return fmt.Errorf("IPv6 node joining: %w", err)
+	}
+	if sys, err := genesis.DHT.Ping(v6.Address); err != nil || sys.ID != v6.System.ID {
+		return fmt.Errorf("pinging the IPv6 node at %s: %v", v6.Address, err)
+	}
+	if cached := genesis.RoutingTable().GetCachedSystemStatus(v6.System.ID); cached == nil || cached.System.PeerAddress != v6Addr {
+		return fmt.Errorf("genesis holds the IPv6 node as %+v, want it at %s", cached, v6Addr)
+	}
+
+	// A node bootstrapping by hostname
+	_, port, _ := net.SplitHostPort(genesis.Address)
+	byName := net.JoinHostPort("localhost", port)
+	named := g.Nodes[1]
+	if err := named.DHT.bootstrapFromPeer(byName); err != nil {
+		return fmt.Errorf("bootstrapping from %s: %w", byName, err)
+	}
+	rt := named.RoutingTable()
+	for _, addr := range []string{byName, genesis.Address} {
+		if id := rt.GetSystemIDByAddress(addr); id != genesis.System.ID {
+			return fmt.Errorf("%s maps to %s, want the genesis", addr, id)
+		}
+	}
+	if n := len(rt.GetAllRoutingTableNodes()); n != 1 {
+		return fmt.Errorf("bootstrapping by hostname left %d routing table entries, want the genesis once", n)
+	}
+
+	// An IP matching nothing isn't resolved against every hostname on its port
+	unresolved := &System{ID: uuid.New(), Name: "Named", PeerAddress: net.JoinHostPort("peer.invalid", port)}
+	unresolved.Stars = assignStarFromClass("M")
+	rt.CacheSystem(unresolved, genesis.System.ID, false)
+	if id := rt.GetSystemIDByAddress(net.JoinHostPort("127.0.0.9", port)); id != uuid.Nil {
+		return fmt.Errorf("an unknown IP maps to %s", id)
+	}
+	peerHostResolver.mu.Lock()
+	_, looked := peerHostResolver.entries["peer.invalid"]
+	peerHostResolver.mu.Unlock()
+	if looked {
+		return fmt.Errorf("looking up an IP resolved a hostname another system advertises")
+	}
+	return nil
+}
+
+// simulatePeerTLS: a node restarted with -peer-tls is reached over HTTPS pinned to its
+// bound key, and a failed TLS exchange is never retried in plain HTTP. The flag is signed
+// with its info, so a copy with it stripped no longer verifies, and it survives full-sync
+// and storage with the signature intact
+func simulatePeerTLS() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.RestartNode(1, (*DHT).EnablePeerTLS); err != nil {
+		return err
+	}
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	key := base64.StdEncoding.EncodeToString(b.System.Keys.PublicKey)
+
+	if _, err := a.DHT.Ping(b.Address); err != nil {
+		return fmt.Errorf("pinging the TLS node: %w", err)
+	}
+	if st := a.RoutingTable().GetCachedSystemStatus(b.System.ID); st == nil || st.Transport != TransportHTTPS {
+		return fmt.Errorf("last exchange with the TLS node was %+v, want %s", st, TransportHTTPS)
+	}
+
+	// Cut only the TLS path: the ping has to fail rather than go out in plain HTTP
+	entry, ok := a.DHT.peerTLSClients.Load(b.System.ID)
+	if !ok {
+		return fmt.Errorf("no pinned client cached for the TLS node")
+	}
+	pinned := entry.(*pinnedClient)
+	cut := &atomic.Bool{}
+	cut.Store(true)
+	a.DHT.peerTLSClients.Store(b.System.ID, &pinnedClient{boundKey: pinned.boundKey, client: &http.Client{
+		Timeout:   RequestTimeout,
+		Transport: &splitTransport{base: pinned.client.Transport, split: cut, blocked: map[string]bool{b.Address: true}},
+	}})
+	if _, err := a.DHT.Ping(b.Address); err == nil {
+		return fmt.Errorf("ping succeeded with TLS cut, want no fallback to plain HTTP")
+	}
+	cut.Store(false)
+	if _, err := a.DHT.Ping(b.Address); err != nil {
+		return fmt.Errorf("pinging the TLS node once TLS is back: %w", err)
+	}
+	if strings.Contains(string(c.System.GetInfoSignableMessage()), "peer_tls") {
+		return fmt.Errorf("a node without TLS signs peer_tls, older nodes can't verify it")
+	}
+
+	cached := a.RoutingTable().GetCachedSystem(b.System.ID)
+	if cached == nil || !cached.PeerTLS || !cached.VerifyInfo(key) {
+		return fmt.Errorf("genesis holds the TLS node as %+v, want peer_tls with a valid signature", cached)
+	}
+	stripped := *cached
+	stripped.PeerTLS = false
+	if stripped.VerifyInfo(key) {
+		return fmt.Errorf("info with peer_tls stripped still verifies")
+	}
+
+	if err := g.Connect(2, 1); err != nil {
+		return err
+	}
+	viaSync := c.RoutingTable().GetCachedSystem(b.System.ID)
+	if viaSync == nil || !viaSync.PeerTLS || !viaSync.VerifyInfo(key) {
+		return fmt.Errorf("third node holds the TLS node as %+v, want peer_tls with a valid signature", viaSync)
+	}
+	stored, err := c.Storage.GetPeerSystem(b.System.ID)
+	if err != nil {
+		return err
+	}
+	if !stored.PeerTLS || !stored.VerifyInfo(key) {
+		return fmt.Errorf("stored peer lost peer_tls or its signature (peer_tls=%v)", stored.PeerTLS)
+	}
+	return nil
+}
+
+// simulateSeeds checks the seed tiers: a fetched list is cached and used when the fetch
+// fails, a long-lived peer is promoted to personal seed, and a node whose GitHub and
+// cached seeds are all unreachable still joins through a personal seed
+func simulateSeeds() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	unreachable := "127.0.0.1:1"
+
+	seeds := b.DHT.collectSeeds([]string{unreachable}, nil)
+	if len(seeds) != 1 || seeds[0].Source != SeedSourceGitHub {
+		return fmt.Errorf("fetched list gave %+v", seeds)
+	}
+	seeds = b.DHT.collectSeeds(nil, errors.New("GitHub unreachable"))
+	if len(seeds) != 1 || seeds[0].Source != SeedSourceCached || seeds[0].Address != unreachable || seeds[0].FetchedAt == 0 {
+		return fmt.Errorf("failed fetch gave %+v, want the cached list", seeds)
+	}
+
+	// A attested to B on PersonalSeedMinDays+1 of the last days, the oldest compacted
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	now := time.Now()
+	for d := 0; d <= PersonalSeedMinDays; d++ {
+		ts := now.Add(-time.Duration(d) * 24 * time.Hour).Unix()
+		if _, err := b.Storage.db.Exec(`INSERT OR IGNORE INTO attestation_summaries
+			(from_system_id, received_by, day, attestation_count, first_timestamp, last_timestamp)
+			VALUES (?, ?, date(?, 'unixepoch'), 1, ?, ?)`,
+			a.System.ID.String(), b.System.ID.String(), ts, ts, ts); err != nil {
+			return err
+		}
+	}
+	if n, err := b.DHT.refreshPersonalSeeds(); err != nil || n != 1 {
+		return fmt.Errorf("promoted %d personal seeds (%v), want 1", n, err)
+	}
+	personal, err := b.Storage.GetPersonalSeeds()
+	if err != nil {
+		return err
+	}
+	if len(personal) != 1 || personal[0].SystemID != a.System.ID || personal[0].Address != a.Address {
+		return fmt.Errorf("personal seeds are %+v, want A", personal)
+	}
+
+	// C has B's cached and personal seeds but GitHub is down. Bootstrap skips seeds in
+	// isolated mode, so it's off while C joins (which leaves C unable to check genesis)
+	if err := c.Storage.SaveSeedCache([]string{unreachable}, now.Unix()); err != nil {
+		return err
+	}
+	if err := c.Storage.SavePersonalSeeds(personal); err != nil {
+		return err
+	}
+	seeds = c.DHT.collectSeeds(nil, errors.New("GitHub unreachable"))
+	if len(seeds) != 2 || seeds[0].Source != SeedSourceCached || seeds[1].Source != SeedSourcePersonal {
+		return fmt.Errorf("C's seeds are %+v, want cached then personal", seeds)
+	}
+
+	notIsolated := false
+	saved := isolatedMode
+	isolatedMode = &notIsolated
+	defer func() { isolatedMode = saved }()
+	config := DefaultBootstrapConfig()
+	config.SeedNodes = seeds
+	if err := c.DHT.Bootstrap(config); err != nil {
+		return err
+	}
+	status := c.DHT.SeedStatus()
+	if c.RoutingTable().GetRoutingTableSize() == 0 || status.JoinedVia == nil ||
+		status.JoinedVia.Source != SeedSourcePersonal || status.JoinedVia.Address != a.Address {
+		return fmt.Errorf("C joined via %+v, want the personal seed", status.JoinedVia)
+	}
+	if status.Sources[SeedSourceCached] != 1 || status.Sources[SeedSourcePersonal] != 1 {
+		return fmt.Errorf("C reports sources %v", status.Sources)
+	}
+	return nil
+}
+
+// simulateInfoHijack: C relays B's info to A with a bumped InfoVersion and another address,
+// both with B's old signature and with none. A keeps B's own info either way, and still
+// refuses the unsigned copy once B has left its cache, since the identity binding remembers
+// that B signs. A legacy system that never signed is still taken unsigned
+func simulateInfoHijack() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	rt := a.RoutingTable()
+
+	// C answers A's find_node with whatever relay holds, signed as itself
+	var relay []*System
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := readDHTBody(r.Body, r.Header.Get("Content-Encoding"), DefaultMaxMessageBytes)
+		var req DHTMessage
+		if err == nil {
+			err = json.Unmarshal(body, &req)
+		}
+		if err != nil || req.FromSystem == nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp, err := NewFindNodeResponse(c.System, req.FromSystem.ID, relay, req.RequestID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	relayed := *c.System
+	relayed.PeerAddress = srv.Listener.Addr().String()
+	gossip := func(systems ...*System) error {
+		relay = systems
+		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		defer cancel()
+		_, err := a.DHT.findNodeDirect(ctx, &relayed, b.System.ID)
+		return err
+	}
+
+	original := rt.GetCachedSystemStatus(b.System.ID)
+	if original == nil || original.System.InfoSignature == "" {
+		return fmt.Errorf("A doesn't hold B's signed info")
+	}
+	hijacked := *original.System
+	hijacked.InfoVersion += 1000
+	hijacked.PeerAddress = "203.0.113.66:7867"
+	unsigned := hijacked
+	unsigned.InfoSignature = ""
+
+	kept := func() error {
+		now := rt.GetCachedSystemStatus(b.System.ID)
+		if now == nil {
+			return nil
+		}
+		if now.System.PeerAddress != b.Address || now.System.InfoVersion != original.System.InfoVersion {
+			return fmt.Errorf("A holds B at %s (info version %d), want %s (%d)",
+				now.System.PeerAddress, now.System.InfoVersion, b.Address, original.System.InfoVersion)
+		}
+		return nil
+	}
+	for _, forged := range []*System{&hijacked, &unsigned} {
+		if err := gossip(forged); err != nil {
+			return err
+		}
+		if err := kept(); err != nil {
+			return fmt.Errorf("signature %q: %w", forged.InfoSignature, err)
+		}
+	}
+
+	// With B gone from the cache there's no entry to compare against; the binding still knows
+	if _, signs, err := a.Storage.GetInfoBinding(b.System.ID); err != nil || !signs {
+		return fmt.Errorf("A's binding for B doesn't record that it signs (%v)", err)
+	}
+	rt.RemoveFromCache(b.System.ID)
+	if err := gossip(&unsigned); err != nil {
+		return err
+	}
+	if rt.GetCachedSystemStatus(b.System.ID) != nil {
+		return fmt.Errorf("unsigned info for B taken once B left the cache")
+	}
+
+	// A bound system that has never signed is a legacy owner: its unsigned info goes in
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	legacy := &System{ID: uuid.New(), Name: "Sim-legacy", PeerAddress: "203.0.113.7:7867", InfoVersion: 1}
+	legacy.GenerateMultiStarSystem()
+	legacy.GenerateDeterministicCoordinates()
+	if _, _, err := a.Storage.ValidateIdentityBinding(legacy.ID, base64.StdEncoding.EncodeToString(keys.PublicKey), nil); err != nil {
+		return err
+	}
+	if err := gossip(legacy); err != nil {
+		return err
+	}
+	if rt.GetCachedSystemStatus(legacy.ID) == nil {
+		return fmt.Errorf("a legacy system's unsigned info was refused")
+	}
+	return nil
+}
+
+// simulateKeyRotation: B moves to a new key and tells A, which follows the chain from the
+// key it bound and lets B's new key in while refusing the old one. Attestations B signed
+// before the rotation still check out against the old key, a chain signed by a stranger
+// moves nothing, and B's revocation gets it blocked
+func simulateKeyRotation() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b := g.Nodes[0], g.Nodes[1]
+	id := b.System.ID.String()
+
+	post := func(msg *DHTMessage) error {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		resp, err := postDHT(context.Background(), http.DefaultClient, peerURL(a.Address, "/dht"), data, false)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("got status %d", resp.StatusCode)
+		}
+		return nil
+	}
+
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	old := *b.System
+	oldKey := base64.StdEncoding.EncodeToString(old.Keys.PublicKey)
+
+	r, err := rotateLocalKey(b.System, b.Storage)
+	if err != nil {
+		return err
+	}
+	b.System.BumpInfoVersion()
+	newKey := base64.StdEncoding.EncodeToString(b.System.Keys.PublicKey)
+	if stored, err := b.Storage.LoadSystem(); err != nil || stored.Keys == nil ||
+		base64.StdEncoding.EncodeToString(stored.Keys.PublicKey) != newKey {
+		return fmt.Errorf("B's stored keys weren't replaced with its rotation (%v)", err)
+	}
+	if n := b.DHT.broadcastKeyRotations(b.DHT.localKeyRotations(KeyRotationAnnounceWindow)); n != 1 {
+		return fmt.Errorf("rotation reached %d peers, want 1", n)
+	}
+	if bound, err := a.Storage.GetIdentityBinding(b.System.ID); err != nil || bound != newKey {
+		return fmt.Errorf("A binds %s to %q (%v), want the new key", id[:8], bound, err)
+	}
+	if _, err := b.DHT.Ping(a.Address); err != nil {
+		return fmt.Errorf("ping with the new key: %w", err)
+	}
+
+	// The old key no longer speaks for B
+	ping, err := NewPingRequest(&old, a.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	if err := post(ping); err == nil {
+		return fmt.Errorf("A accepted a ping signed with B's old key")
+	}
+
+	// ...but what it signed before the rotation is still B's
+	if key, err := a.Storage.KeyAt(b.System.ID, r.Timestamp-1); err != nil || key != oldKey {
+		return fmt.Errorf("key before the rotation is %q (%v), want the old key", key, err)
+	}
+	if key, err := a.Storage.KeyAt(b.System.ID, r.Timestamp); err != nil || key != newKey {
+		return fmt.Errorf("key after the rotation is %q (%v), want the new key", key, err)
+	}
+	before := SignAttestation(b.System.ID, a.System.ID, "ping", old.Keys.PrivateKey, old.Keys.PublicKey)
+	before.Timestamp = r.Timestamp - 60
+	before.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(old.Keys.PrivateKey, before.GetSignableMessage()))
+	after := SignAttestation(b.System.ID, a.System.ID, "ping", old.Keys.PrivateKey, old.Keys.PublicKey)
+	if !a.Storage.attestationKeyValid(before) || a.Storage.attestationKeyValid(after) {
+		return fmt.Errorf("old key accepted before the rotation: %v, after: %v, want true then false",
+			a.Storage.attestationKeyValid(before), a.Storage.attestationKeyValid(after))
+	}
+
+	// A stranger's keys can't continue B's chain, nor revoke it
+	for _, revoke := range []bool{false, true} {
+		stranger := *b.System
+		if stranger.Keys, err = GenerateKeyPair(); err != nil {
+			return err
+		}
+		var next *KeyPair
+		if !revoke {
+			if next, err = GenerateKeyPair(); err != nil {
+				return err
+			}
+		}
+		forged, err := NewKeyRotation(&stranger, r.Sequence+1, next)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			stranger.Keys = next
+		}
+		stranger.SignInfo()
+		msg, err := NewKeyRotationRequest(&stranger, a.System.ID, []*KeyRotation{forged}, uuid.New().String())
+		if err != nil {
+			return err
+		}
+		if err := post(msg); err == nil {
+			return fmt.Errorf("A accepted a forged key rotation (revocation: %v)", revoke)
+		}
+	}
+	if bound, _ := a.Storage.GetIdentityBinding(b.System.ID); bound != newKey {
+		return fmt.Errorf("forged rotation moved A's binding for %s", id[:8])
+	}
+	if revoked, _ := a.Storage.IdentityRevoked(b.System.ID); revoked || a.RoutingTable().IsBlocked(b.System.ID) {
+		return fmt.Errorf("forged revocation retired %s", id[:8])
+	}
+
+	// B revokes its identity for real
+	if _, err := revokeLocalIdentity(b.System, b.Storage); err != nil {
+		return err
+	}
+	if n := b.DHT.broadcastKeyRotations(b.DHT.localKeyRotations(math.MaxInt64)); n != 1 {
+		return fmt.Errorf("revocation reached %d peers, want 1", n)
+	}
+	if revoked, err := a.Storage.IdentityRevoked(b.System.ID); err != nil || !revoked || !a.RoutingTable().IsBlocked(b.System.ID) {
+		return fmt.Errorf("A didn't retire %s after its revocation (revoked %v, %v)", id[:8], revoked, err)
+	}
+	if _, err := revokeLocalIdentity(b.System, b.Storage); err == nil {
+		return fmt.Errorf("revoked identity could sign another rotation")
+	}
+	return nil
+}
+
+// simulateEdgeStrength: a node's edges to a peer it just talked to are at full strength,
+// backed by its own contact and the peer's attestations; an old one-way report from
+// gossip is weak, and an edge to a peer that has started failing fades
+func simulateEdgeStrength() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	a, c, b := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	if err := a.DHT.FlushAttestations(); err != nil {
+		return err
+	}
+
+	// The hub pinged node 1 and holds its attestations
+	ac, ca := a.edge(a, c), a.edge(c, a)
+	if ac == nil || ca == nil {
+		return fmt.Errorf("node 0 has no edges to node 1")
+	}
+	if ac.Strength != 1 || ac.EvidenceType != EdgeEvidenceDirect || ca.Strength != 1 || ca.EvidenceType != EdgeEvidenceAttestation {
+		return fmt.Errorf("edges to a fresh peer are %+v and %+v, want full strength from direct contact and attestations", ac, ca)
+	}
+
+	// B reported a peer 50 minutes ago that never reported B back
+	old := time.Now().Add(-50 * time.Minute).Unix()
+	stranger := uuid.New().String()
+	if _, err := c.Storage.db.Exec(`INSERT OR REPLACE INTO peer_connections (system_id, peer_id, updated_at, reciprocal) VALUES (?, ?, ?, 0)`,
+		b.System.ID.String(), stranger, old); err != nil {
+		return err
+	}
+	var gossip *TopologyEdge
+	for _, e := range c.DHT.GetConnections() {
+		if e.FromID == b.System.ID.String() && e.ToID == stranger {
+			gossip = &e
+			break
+		}
+	}
+	if gossip == nil || gossip.EvidenceType != EdgeEvidenceGossip || gossip.LastEvidence != old || gossip.Strength <= 0 || gossip.Strength > 0.15 {
+		return fmt.Errorf("old one-way gossip edge is %+v, want weak gossip evidence", gossip)
+	}
+
+	for i := 0; i < DegradedAfterFailures; i++ {
+		c.RoutingTable().MarkFailed(a.System.ID)
+	}
+	if e := c.edge(c, a); e == nil || e.Strength > 0.6 {
+		return fmt.Errorf("edge to a degraded peer is %+v, want it faded", e)
+	}
+
+	// Sorted, so the map bundles edges the same way on every refresh
+	edges := c.DHT.GetConnections()
+	if !sort.SliceIsSorted(edges, func(i, j int) bool {
+		return edges[i].FromID+":"+edges[i].ToID < edges[j].FromID+":"+edges[j].ToID
+	}) {
+		return fmt.Errorf("connections aren't sorted by system IDs")
+	}
+	return nil
+}
+
+// simulatePeerImport: the hub exports its verified peers and node 3, having forgotten two
+// of them, imports the file and verifies them by pinging. A forged entry for a known UUID
+// can't pin its info over what the owner says, and importing again changes nothing
+func simulatePeerImport() error {
+	g, err := NewTestGalaxy(4)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	a, b, c, d := g.Nodes[0], g.Nodes[1], g.Nodes[2], g.Nodes[3]
+
+	export := a.DHT.ExportPeers()
+	if len(export.Peers) != 3 {
+		return fmt.Errorf("hub exported %d peers, want 3", len(export.Peers))
+	}
+	for _, n := range []*TestNode{b, c} {
+		d.RoutingTable().RemoveFromCache(n.System.ID)
+	}
+	verified := func(n *TestNode) bool {
+		cached := d.RoutingTable().GetCachedSystemStatus(n.System.ID)
+		return cached != nil && cached.Verified && cached.System.Name == n.System.Name
+	}
+
+	// An entry claiming B's UUID at B's address with made-up info
+	forged := &PeerExport{Peers: []ExportedPeer{{
+		ID: b.System.ID.String(), Name: "Impostor", PeerAddress: b.Address, StarClass: "O",
+		InfoVersion: math.MaxInt64, InfoSignature: "forged",
+	}}}
+	if r := d.DHT.ImportPeers(forged); r.Added+r.Known != 1 || r.Verifying != 1 {
+		return fmt.Errorf("forged import gave %+v", r)
+	}
+	if err := g.WaitForConvergence(func() bool { return verified(b) }, SimulationTimeout); err != nil {
+		return fmt.Errorf("B's own info didn't replace the forged entry: %w", err)
+	}
+
+	r := d.DHT.ImportPeers(export)
+	if r.Added != 1 || r.Known != 1 || r.Skipped != 1 || r.Verifying != 1 {
+		return fmt.Errorf("import gave %+v, want C added, B known and ourselves skipped", r)
+	}
+	if err := g.WaitForConvergence(func() bool { return verified(c) }, SimulationTimeout); err != nil {
+		return fmt.Errorf("imported C wasn't verified: %w", err)
+	}
+	if r := d.DHT.ImportPeers(export); r.Added != 0 || r.Verifying != 0 || !verified(b) || !verified(c) {
+		return fmt.Errorf("importing again gave %+v", r)
+	}
+	return nil
+}
+
+// coordsGoldenVectors pin each coordinate derivation version: a (UUID, sponsor UUID,
+// sponsor position) and where that places the system. These must never be edited - a
+// failure means the derivation changed, and every system it placed would be rejected by
+// upgraded peers. A new algorithm gets a new version and its own vectors
+var coordsGoldenVectors = []struct {
+	version         int
+	system, sponsor string
+	sx, sy, sz      float64
+	x, y, z         float64
+}{
+	{CoordsDerivationV1, "00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000000",
+		0, 0, 0, -164.680532279, -26.398771542, -64.359555840},
+	{CoordsDerivationV1, "ffffffff-ffff-ffff-ffff-ffffffffffff", "00000000-0000-0000-0000-000000000001",
+		-250.5, 1200.25, 42, -225.114762439, 1195.296839417, -129.636160080},
+	{CoordsDerivationV1, "6ba7b810-9dad-11d1-80b4-00c04fd430c8", "6ba7b811-9dad-11d1-80b4-00c04fd430c8",
+		9876.54321, -4321, -10000, 9836.632606455, -4396.679936210, -10052.250294444},
+	{CoordsDerivationV1, "3f2504e0-4f89-41d3-9a0c-0305e82c3301", "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11",
+		0.001, -0.002, 0.003, 204.481501517, 146.116643569, -69.889296944},
+	{CoordsDerivationV1, "c56a4180-65aa-42ec-a945-5fd21dec0538", "3f2504e0-4f89-41d3-9a0c-0305e82c3301",
+		123.456, 789.012, -345.678, 238.047030150, 503.771869071, -295.751707390},
+	{CoordsDerivationV1, "123e4567-e89b-12d3-a456-426614174000", "c56a4180-65aa-42ec-a945-5fd21dec0538",
+		0, 0, 0, 266.567934760, 199.531329292, -4.172501510},
+}
+
+// simulateCoordinates checks coordinate derivation against the golden vectors, that
+// regenerating gives bit-identical results (repeated, concurrently, and for systems
+// recording any known version or none), and that a tampered distance, polar angle or
+// azimuth is rejected naming that component
+func simulateCoordinates() error {
+	for i, v := range coordsGoldenVectors {
+		x, y, z := CalculateExpectedCoordinates(v.version, uuid.MustParse(v.system), uuid.MustParse(v.sponsor), v.sx, v.sy, v.sz)
+		// Golden values are printed to 9 places; math.Sin and friends may differ in the last bit on some platforms
+		if math.Abs(x-v.x) > 1e-6 || math.Abs(y-v.y) > 1e-6 || math.Abs(z-v.z) > 1e-6 {
+			return fmt.Errorf("golden vector %d (v%d): got (%.9f, %.9f, %.9f), want (%.9f, %.9f, %.9f)",
+				i, v.version, x, y, z, v.x, v.y, v.z)
+		}
+	}
+
+	// Regeneration is stable: the same inputs give the same bits, in any goroutine
+	const samples = 500
+	type result struct{ x, y, z float64 }
+	ids := make([][2]uuid.UUID, samples)
+	want := make([]result, samples)
+	for i := range ids {
+		ids[i] = [2]uuid.UUID{uuid.New(), uuid.New()}
+		x, y, z := CalculateExpectedCoordinates(CurrentCoordsDerivation, ids[i][0], ids[i][1], 1000, -2000, 3000)
+		want[i] = result{x, y, z}
+
+		off := deriveClusterOffsetV1(ids[i][0], ids[i][1])
+		if off.Distance < ClusterMinDistance || off.Distance > ClusterMaxDistance ||
+			off.Theta < 0 || off.Theta > 2*math.Pi || off.Phi < 0 || off.Phi > math.Pi {
+			return fmt.Errorf("offset out of range for %s: %+v", ids[i][0], off)
+		}
+	}
+	var wg sync.WaitGroup
+	mismatches := make(chan string, samples)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, id := range ids {
+				x, y, z := CalculateExpectedCoordinates(CurrentCoordsDerivation, id[0], id[1], 1000, -2000, 3000)
+				if (result{x, y, z}) != want[i] {
+					mismatches <- id[0].String()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(mismatches)
+	if id, ok := <-mismatches; ok {
+		return fmt.Errorf("regenerating %s's coordinates gave different bits", id)
+	}
+
+	// Generating records the version, and validators accept the system under any recorded version
+	sponsor := &System{ID: uuid.New(), X: -512.25, Y: 64, Z: 7.5}
+	sys := &System{ID: uuid.New()}
+	sys.GenerateClusteredCoordinates(sponsor)
+	if sys.CoordsVersion != CurrentCoordsDerivation || sys.SponsorID == nil || *sys.SponsorID != sponsor.ID {
+		return fmt.Errorf("generated system records version %d, sponsor %v", sys.CoordsVersion, sys.SponsorID)
+	}
+	lookup := func(uuid.UUID) *System { return sponsor }
+	for _, version := range []int{0, CoordsDerivationV1, CurrentCoordsDerivation, 99} {
+		recorded := *sys
+		recorded.CoordsVersion = version
+		if status, reason := CheckCoordinates(&recorded, lookup); status != CoordsValid {
+			return fmt.Errorf("system recording derivation %d rejected: %s", version, reason)
+		}
+	}
+
+	// Tampering with one component is reported as that component
+	off := deriveClusterOffsetV1(sys.ID, sponsor.ID)
+	towardMiddle := 1.0
+	if off.Distance > (ClusterMinDistance+ClusterMaxDistance)/2 {
+		towardMiddle = -1
+	}
+	polar := 0.1
+	if off.Phi > math.Pi/2 {
+		polar = -0.1
+	}
+	tampered := []struct {
+		name   string
+		offset clusterOffset
+		reason string
+	}{
+		{"far away", clusterOffset{ClusterMaxDistance + 100, off.Theta, off.Phi}, "outside the 100-500 band"},
+		{"too close", clusterOffset{ClusterMinDistance / 2, off.Theta, off.Phi}, "outside the 100-500 band"},
+		{"distance", clusterOffset{off.Distance + towardMiddle, off.Theta, off.Phi}, "distance"},
+		{"polar angle", clusterOffset{off.Distance, off.Theta, off.Phi + polar}, "polar angle"},
+		{"azimuth", clusterOffset{off.Distance, math.Mod(off.Theta+0.1, 2*math.Pi), off.Phi}, "azimuth"},
+	}
+	for _, t := range tampered {
+		moved := *sys
+		dx, dy, dz := t.offset.cartesian()
+		moved.X, moved.Y, moved.Z = sponsor.X+dx, sponsor.Y+dy, sponsor.Z+dz
+		status, reason := CheckCoordinates(&moved, lookup)
+		if status != CoordsInvalid || !strings.Contains(reason, t.reason) {
+			return fmt.Errorf("%s: got %v %q, want invalid %q", t.name, status, reason, t.reason)
+		}
+	}
+
+	// A genesis away from the origin says so
+	genesis := &System{ID: uuid.New(), X: 1, Stars: assignStarFromClass("X")}
+	if status, reason := CheckCoordinates(genesis, lookup); status != CoordsInvalid || !strings.Contains(reason, "origin") {
+		return fmt.Errorf("genesis off the origin: got %v %q", status, reason)
+	}
+	return nil
+}
+
+// simulateSponsorChain: A and B join through the genesis, then C joins through B, so C's
+// sponsor is a system A has never heard of when C first contacts it. A takes C's message,
+// keeps C out of its find_node answers while the coordinates are unchecked, looks B up
+// through the genesis and then passes C on. A system claiming B as sponsor with coordinates
+// that don't fit is evicted and blocked once B is known
+func simulateSponsorChain() error {
+	g, err := NewTestGalaxy(4)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	genesis, a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2], g.Nodes[3]
+	for _, pair := range [][2]int{{1, 0}, {2, 0}, {3, 2}} {
+		if err := g.Connect(pair[0], pair[1]); err != nil {
+			return err
+		}
+	}
+	if c.System.SponsorID == nil || *c.System.SponsorID != b.System.ID {
+		return fmt.Errorf("C wasn't sponsored by B")
+	}
+	rt := a.RoutingTable()
+	rt.RemoveFromCache(b.System.ID)
+	if err := a.Storage.DeletePeerSystem(b.System.ID); err != nil {
+		return err
+	}
+
+	// First contact: C is taken, but not passed on. A's lookup of B (through the genesis,
+	// or C itself) is held until that's checked
+	gate := &gatedTransport{base: a.DHT.httpClient.Transport, open: make(chan struct{})}
+	a.DHT.httpClient.Transport = gate
+	if _, err := c.DHT.Ping(a.Address); err != nil {
+		close(gate.open)
+		return fmt.Errorf("A refused C before knowing its sponsor: %w", err)
+	}
+	status := rt.GetCachedSystemStatus(c.System.ID)
+	if status == nil || !status.CoordsUnverified {
+		close(gate.open)
+		return fmt.Errorf("A holds C as %+v, want its coordinates unchecked", status)
+	}
+	passedOn := func() (bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		defer cancel()
+		found, err := genesis.DHT.findNodeDirect(ctx, a.System, c.System.ID)
+		for _, sys := range found {
+			if sys.ID == c.System.ID {
+				return true, err
+			}
+		}
+		return false, err
+	}
+	shared, err := passedOn()
+	close(gate.open)
+	if err != nil || shared {
+		return fmt.Errorf("A passed on C with unchecked coordinates (%v)", err)
+	}
+
+	// A finds B through the genesis and checks C against it
+	checked := func() bool {
+		status := rt.GetCachedSystemStatus(c.System.ID)
+		return status != nil && !status.CoordsUnverified && a.DHT.lookupSponsor(b.System.ID) != nil
+	}
+	if err := g.WaitForConvergence(checked, SimulationTimeout); err != nil {
+		return fmt.Errorf("A never verified C's coordinates: %w", err)
+	}
+	if shared, err := passedOn(); err != nil || !shared {
+		return fmt.Errorf("A doesn't pass on C once its coordinates check out (%v)", err)
+	}
+
+	// Coordinates C's sponsor wouldn't give this UUID
+	forged := *c.System
+	forged.ID = uuid.New()
+	forged.Name = "Sim-misplaced"
+	forged.InfoSignature = ""
+	rt.CacheSystem(&forged, c.System.ID, false)
+	if rt.GetCachedSystemStatus(forged.ID) == nil {
+		return fmt.Errorf("A didn't cache the misplaced system")
+	}
+	a.DHT.deferCoordsValidation(&forged)
+	blocked := func() bool {
+		return rt.IsBlocked(forged.ID) && rt.GetCachedSystemStatus(forged.ID) == nil
+	}
+	if err := g.WaitForConvergence(blocked, SimulationTimeout); err != nil {
+		return fmt.Errorf("misplaced system sponsored by B not evicted and blocked: %w", err)
+	}
+	return nil
+}
+
+// simulateAttestationBatch: 1000 pings reach A, and their attestations are written in at most
+// one transaction per full batch rather than one each. A credit calculation writes whatever
+// is still buffered before it counts, and stopping A writes the rest, so a restart finds
+// every attestation
+func simulateAttestationBatch() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	a, b := g.Nodes[0], g.Nodes[1]
+
+	buffered := func() int {
+		a.DHT.attestations.mu.Lock()
+		defer a.DHT.attestations.mu.Unlock()
+		return len(a.DHT.attestations.pending)
+	}
+	count := func() int {
+		n, _ := a.Storage.GetAttestationCount(b.System.ID)
+		return n
+	}
+	// Connecting left a few, stored or still buffered, and B's background loops may add more
+	base := count() + buffered()
+	stored := func() int { return count() - base }
+	flushes := a.DHT.tasks.get(TaskAttestationFlush)
+	runsBefore := flushes.status().Runs
+
+	ping := func(n int) error {
+		work := make(chan struct{}, n)
+		for i := 0; i < n; i++ {
+			work <- struct{}{}
+		}
+		close(work)
+		errs := make(chan error, 8)
+		for w := 0; w < 8; w++ {
+			go func() {
+				var err error
+				for range work {
+					if _, err = b.DHT.Ping(a.Address); err != nil {
+						break
+					}
+				}
+				errs <- err
+			}()
+		}
+		for w := 0; w < 8; w++ {
+			if err := <-errs; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := ping(1000); err != nil {
+		return err
+	}
+	// A flush may still be writing the last full batch
+	settled := func() bool { return stored()+buffered() >= 1000 && !flushes.status().Running }
+	if err := g.WaitForConvergence(settled, SimulationTimeout); err != nil {
+		return fmt.Errorf("%d stored and %d buffered of 1000: %w", stored(), buffered(), err)
+	}
+	// Each full batch signals a flush, and one filling up while a flush writes can signal a
+	// second, smaller one
+	if runs, most := flushes.status().Runs-runsBefore, int64(2*1000/AttestationBatchSize+1); runs > most {
+		return fmt.Errorf("1000 attestations took %d flushes, want at most %d", runs, most)
+	}
+
+	// The credit cycle reads attestations from storage, so it writes the buffer first
+	if _, err := a.DHT.calculateCredits(); err != nil {
+		return err
+	}
+	if n, left := stored(), buffered(); n < 1000 || left != 0 {
+		return fmt.Errorf("after a credit calculation %d are stored and %d buffered, want 1000 and 0", n, left)
+	}
+
+	// Fewer than a batch, so only stopping writes them
+	if err := ping(50); err != nil {
+		return err
+	}
+	if left := buffered(); left < 50 {
+		return fmt.Errorf("%d of 50 attestations buffered before stopping", left)
+	}
+	// B's spare connections would otherwise hold up A's shutdown for 5s
+	b.DHT.httpClient.CloseIdleConnections()
+	received := count() + buffered()
+	a.Stop()
+	restarted, err := NewStorage(filepath.Join(g.dir, a.System.Name+".db"))
+	if err != nil {
+		return err
+	}
+	defer restarted.Close()
+	if n, err := restarted.GetAttestationCount(b.System.ID); err != nil || n < received {
+		return fmt.Errorf("after a restart %d of %d attestations are stored (%v)", n, received, err)
+	}
+	return nil
+}
+
+// simulateTemplateEscaping: the index and peer pages rendered with names and an annotation
+// built to break out of their HTML and script contexts. Every hostile string is escaped
+// where it lands, the selfSystem name in the page's script reads back as the name itself,
+// and a hostile name arriving by gossip is shown sanitized
+func simulateTemplateEscaping() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	hub, peer := g.Nodes[0], g.Nodes[1]
+	assets, err := loadWebAssets("")
+	if err != nil {
+		return err
+	}
+	web := &WebInterface{dht: hub.DHT, storage: hub.Storage, assets: assets}
+	index, peerPage, err := assets.templates()
+	if err != nil {
+		return err
+	}
+
+	const hostile = "Evil</script><script>alert('name')</script>\"\n<img src=x onerror=alert(1)>"
+	const hostileNote = "</p><script>alert(\"note\")</script><a href=\"javascript:alert(2)\">"
+	rawTags := []string{"</script><script>", "<script>alert(", "<img src=x", "<a href=\"javascript:"}
+	noRaw := func(page, html string) error {
+		for _, raw := range rawTags {
+			if strings.Contains(html, raw) {
+				return fmt.Errorf("%s contains %q unescaped", page, raw)
+			}
+		}
+		return nil
+	}
+
+	// The index, with the local system and a listed peer named to break out
+	data := web.buildTemplateData()
+	local := *hub.System
+	local.Name = hostile
+	data.System = &local
+	listed := *peer.System
+	listed.Name = hostile
+	data.Peers = append(data.Peers, PeerData{System: &listed})
+	var buf bytes.Buffer
+	if err := index.Execute(&buf, data); err != nil {
+		return err
+	}
+	html := buf.String()
+	if err := noRaw("index", html); err != nil {
+		return err
+	}
+	script := html[strings.Index(html, "const selfSystem"):]
+	start := strings.Index(script, "name: ")
+	if start < 0 {
+		return fmt.Errorf("no selfSystem name in the index script")
+	}
+	literal := script[start+len("name: "):]
+	literal = literal[:strings.Index(literal, ",\n")]
+	var name string
+	if err := json.Unmarshal([]byte(literal), &name); err != nil || name != hostile {
+		return fmt.Errorf("selfSystem name %s reads back as %q (%v)", literal, name, err)
+	}
+	if !strings.Contains(html, "<h1 id=\"system-name\">Evil&lt;/script&gt;&lt;script&gt;alert(&#39;name&#39;)") {
+		return fmt.Errorf("index heading doesn't show the escaped name")
+	}
+
+	// The peer page, with an annotation and a peer named to break out
+	if _, err := hub.DHT.SetPeerAnnotation(peer.System.ID, AnnotationRequest{Note: hostileNote, Tags: []string{"evil"}}); err != nil {
+		return err
+	}
+	detail, err := hub.DHT.GetPeerDetail(peer.System.ID)
+	if err != nil {
+		return err
+	}
+	if detail.Annotation == nil || detail.Annotation.Note != hostileNote {
+		return fmt.Errorf("annotation not on the peer detail")
+	}
+	detail.System = &listed
+	buf.Reset()
+	if err := peerPage.Execute(&buf, PeerPageData{Local: &local, Peer: detail}); err != nil {
+		return err
+	}
+	html = buf.String()
+	if err := noRaw("peer page", html); err != nil {
+		return err
+	}
+	if !strings.Contains(html, "&lt;/p&gt;&lt;script&gt;alert(&#34;note&#34;)&lt;/script&gt;") {
+		return fmt.Errorf("peer page doesn't show the escaped note")
+	}
+
+	// A hostile name gossiped in is shown cleaned up, through the real handlers
+	gossiped := &System{ID: uuid.New(), Name: hostile, PeerAddress: "203.0.113.9:7867", InfoVersion: 1}
+	gossiped.GenerateMultiStarSystem()
+	gossiped.GenerateDeterministicCoordinates()
+	hub.RoutingTable().CacheSystem(gossiped, peer.System.ID, false)
+	for _, path := range []string{"/", "/peer/" + gossiped.ID.String()} {
+		rec := httptest.NewRecorder()
+		if path == "/" {
+			web.handleIndex(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		} else {
+			web.handlePeerPage(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		}
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("%s: status %d", path, rec.Code)
+		}
+		if err := noRaw(path, rec.Body.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simulateTransfers: A, holding 10 hours of signed attestations from the hub, previews a
+// transfer to B (proof size, B online), sends two, and both sides list them, paged and
+// newest first. Asking for more than the balance fails before anything is built. While a
+// third is on its way the amount is already debited and listed pending, without the credit
+// lock held; B turning it down gives it back. Once B is down the preview says so and sending
+// fails with an unreachable error
+func simulateTransfers() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub, a, b := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+
+	// An attestation from the hub every half hour for 10 hours: 10 credits of proof
+	now := time.Now().Unix()
+	for i := 0; i <= 20; i++ {
+		att := SignAttestation(hub.System.ID, a.System.ID, "ping", hub.System.Keys.PrivateKey, hub.System.Keys.PublicKey)
+		att.Timestamp = now - int64(i)*1800
+		att.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(hub.System.Keys.PrivateKey, att.GetSignableMessage()))
+		if err := a.Storage.SaveAttestation(att, a.System.ID); err != nil {
+			return err
+		}
+	}
+	balance, err := a.Storage.GetCreditBalance(a.System.ID)
+	if err != nil {
+		return err
+	}
+	balance.Balance = 10
+	if err := a.Storage.SaveCreditBalance(balance); err != nil {
+		return err
+	}
+
+	preview, err := a.DHT.PreviewTransfer(b.System.ID, 3, "thanks")
+	if err != nil {
+		return fmt.Errorf("preview: %w", err)
+	}
+	if !preview.RecipientOnline || preview.Balance != 10 || preview.ProofAttestations == 0 || preview.ProofBytes == 0 {
+		return fmt.Errorf("preview: %+v", preview)
+	}
+	if _, err := a.DHT.PreviewTransfer(b.System.ID, 11, ""); !errors.Is(err, ErrInsufficientCredits) {
+		return fmt.Errorf("previewing more than the balance: %v", err)
+	}
+
+	for _, amount := range []int64{3, 4} {
+		if _, err := a.DHT.SendCredits(b.System.ID, amount, fmt.Sprintf("round %d", amount)); err != nil {
+			return fmt.Errorf("sending %d: %w", amount, err)
+		}
+		time.Sleep(1100 * time.Millisecond) // Transfers are timestamped to the second
+	}
+
+	sent, total, err := a.Storage.GetTransferHistory(a.System.ID, "", 1, 0)
+	if err != nil {
+		return err
+	}
+	if total != 2 || len(sent) != 1 || sent[0].Direction != TransferSent || sent[0].Amount != 4 ||
+		sent[0].PeerID != b.System.ID.String() || sent[0].Memo != "round 4" {
+		return fmt.Errorf("A's newest transfer of %d: %+v", total, sent)
+	}
+	older, _, err := a.Storage.GetTransferHistory(a.System.ID, "", 1, 1)
+	if err != nil || len(older) != 1 || older[0].Amount != 3 {
+		return fmt.Errorf("A's second page: %+v, %v", older, err)
+	}
+	received, total, err := b.Storage.GetTransferHistory(b.System.ID, TransferReceived, 10, 0)
+	if err != nil {
+		return err
+	}
+	if total != 2 || received[0].Direction != TransferReceived || received[0].PeerID != a.System.ID.String() || received[1].Memo != "round 3" {
+		return fmt.Errorf("B received %d: %+v", total, received)
+	}
+	if _, total, _ := b.Storage.GetTransferHistory(b.System.ID, TransferSent, 10, 0); total != 0 {
+		return fmt.Errorf("B lists %d sent transfers", total)
+	}
+
+	// Hold the next delivery on the wire, then have B refuse it
+	held := &heldTransferTransport{base: a.DHT.httpClient.Transport, arrived: make(chan struct{}), release: make(chan struct{})}
+	a.DHT.httpClient.Transport = held
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := a.DHT.SendCredits(b.System.ID, 2, "held")
+		sendErr <- err
+	}()
+	select {
+	case <-held.arrived:
+	case err := <-sendErr:
+		return fmt.Errorf("held transfer returned before delivery: %v", err)
+	case <-time.After(SimulationTimeout):
+		return fmt.Errorf("held transfer never reached the wire")
+	}
+	if !a.DHT.creditMu.TryLock() {
+		close(held.release)
+		return fmt.Errorf("credit lock held during delivery")
+	}
+	a.DHT.creditMu.Unlock()
+	balance, _ = a.Storage.GetCreditBalance(a.System.ID)
+	pending, _, _ := a.Storage.GetTransferHistory(a.System.ID, TransferSent, 1, 0)
+	close(held.release)
+	if balance.Balance != 1 || balance.TotalSent != 9 {
+		return fmt.Errorf("during delivery A has %d (sent %d), want 1 (9)", balance.Balance, balance.TotalSent)
+	}
+	if len(pending) != 1 || pending[0].Memo != "held" || !pending[0].Pending {
+		return fmt.Errorf("during delivery A's newest transfer is %+v", pending)
+	}
+	if err := <-sendErr; err == nil || !strings.Contains(err.Error(), "held back") {
+		return fmt.Errorf("refused transfer: %v", err)
+	}
+	a.DHT.httpClient.Transport = held.base
+	balance, _ = a.Storage.GetCreditBalance(a.System.ID)
+	if _, total, _ := a.Storage.GetTransferHistory(a.System.ID, TransferSent, 10, 0); balance.Balance != 3 || balance.TotalSent != 7 || total != 2 {
+		return fmt.Errorf("after the refusal A has %d (sent %d) and %d transfers, want 3 (7) and 2", balance.Balance, balance.TotalSent, total)
+	}
+
+	// B takes the next one but its answer is lost: A can't know, so it stays debited and
+	// pending until a resend with the same ID is answered as a duplicate
+	before, _ := b.Storage.GetCreditBalance(b.System.ID)
+	a.DHT.httpClient.Transport = &lostAnswerTransport{base: held.base}
+	if _, err := a.DHT.SendCredits(b.System.ID, 1, "lost"); !errors.Is(err, ErrTransferUnconfirmed) {
+		a.DHT.httpClient.Transport = held.base
+		return fmt.Errorf("transfer with a lost answer: %v", err)
+	}
+	a.DHT.httpClient.Transport = held.base
+	balance, _ = a.Storage.GetCreditBalance(a.System.ID)
+	if n, _ := a.Storage.CountPendingCreditTransfers(); balance.Balance != 2 || n != 1 {
+		return fmt.Errorf("after a lost answer A has %d with %d pending, want 2 with 1", balance.Balance, n)
+	}
+	if attempted, err := a.DHT.retryPendingTransfers(); attempted != 1 || err != nil {
+		return fmt.Errorf("retry attempted %d (%v)", attempted, err)
+	}
+	if n, _ := a.Storage.CountPendingCreditTransfers(); n != 0 {
+		return fmt.Errorf("%d transfers still pending after the retry was answered", n)
+	}
+	if after, _ := b.Storage.GetCreditBalance(b.System.ID); after.Balance != before.Balance+1 || after.TotalReceived != before.TotalReceived+1 {
+		return fmt.Errorf("B went from %d to %d credits over a delivery and its retry, want one credit more", before.Balance, after.Balance)
+	}
+
+	// An offline recipient is an error, not a wait
+	b.Stop()
+	preview, err = a.DHT.PreviewTransfer(b.System.ID, 1, "")
+	if err != nil {
+		return fmt.Errorf("preview to an offline recipient: %w", err)
+	}
+	if preview.RecipientOnline || preview.RecipientError == "" {
+		return fmt.Errorf("offline recipient previewed as %+v", preview)
+	}
+	start := time.Now()
+	if _, err := a.DHT.SendCredits(b.System.ID, 1, ""); !errors.Is(err, ErrRecipientUnreachable) {
+		return fmt.Errorf("sending to an offline recipient: %v", err)
+	}
+	if took := time.Since(start); took > RequestTimeout+time.Second {
+		return fmt.Errorf("sending to an offline recipient took %v", took)
+	}
+	if balance, _ := a.Storage.GetCreditBalance(a.System.ID); balance.Balance != 2 {
+		return fmt.Errorf("A's balance is %d after sending 8 of 10", balance.Balance)
+	}
+	return nil
+}
+
+// simulateDoubleSpend: A signs two transfers of 8 against the same 10 hours of proof, one
+// to B and one to C, each claiming nothing sent before. B takes its transfer and gossips
+// it, C and B each record it once, and C refuses the second spend, leaving its balance alone
+func simulateDoubleSpend() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	if err := g.Connect(1, 2); err != nil {
+		return err
+	}
+	if err := g.Connect(2, 1); err != nil {
+		return err
+	}
+	// C only takes announces of transfers from systems it has heard from itself
+	if err := g.Connect(0, 2); err != nil {
+		return err
+	}
+	a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+
+	// An attestation from B every half hour for 10 hours: 10 credits of proof
+	now := time.Now().Unix()
+	for i := 0; i <= 20; i++ {
+		att := SignAttestation(b.System.ID, a.System.ID, "ping", b.System.Keys.PrivateKey, b.System.Keys.PublicKey)
+		att.Timestamp = now - int64(i)*1800
+		att.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(b.System.Keys.PrivateKey, att.GetSignableMessage()))
+		if err := a.Storage.SaveAttestation(att, a.System.ID); err != nil {
+			return err
+		}
+	}
+	balance, err := a.Storage.GetCreditBalance(a.System.ID)
+	if err != nil {
+		return err
+	}
+	balance.Balance = 10
+	if err := a.Storage.SaveCreditBalance(balance); err != nil {
+		return err
+	}
+
+	// Both are built before either is sent, so each proof claims the full 10
+	a.DHT.creditMu.Lock()
+	toB, _, errB := a.DHT.buildTransfer(b.System.ID, 8, "first")
+	toC, _, errC := a.DHT.buildTransfer(c.System.ID, 8, "second")
+	a.DHT.creditMu.Unlock()
+	if errB != nil || errC != nil {
+		return fmt.Errorf("building the transfers: %v, %v", errB, errC)
+	}
+
+	if err := a.DHT.deliverTransfer(b.Address, toB); err != nil {
+		return fmt.Errorf("B refused the first spend: %w", err)
+	}
+	learned := func() bool {
+		known, _ := c.Storage.HasVerifiedTransfer(toB.ID)
+		return known
+	}
+	if err := g.WaitForConvergence(learned, SimulationTimeout); err != nil {
+		return fmt.Errorf("C never heard of A's transfer to B: %w", err)
+	}
+	for _, n := range []*TestNode{b, c} {
+		known, err := n.Storage.GetVerifiedTransfersFor(a.System.ID)
+		if err != nil {
+			return err
+		}
+		if len(known) != 1 || known[0].ID != toB.ID {
+			return fmt.Errorf("%s knows of %d transfers from A, want just the one to B", n.System.Name, len(known))
+		}
+	}
+
+	err = a.DHT.deliverTransfer(c.Address, toC)
+	if err == nil {
+		return fmt.Errorf("C accepted a second spend of A's balance")
+	}
+	if !strings.Contains(err.Error(), "insufficient balance") {
+		return fmt.Errorf("C refused the second spend for the wrong reason: %v", err)
+	}
+	if known, _ := c.Storage.HasVerifiedTransfer(toC.ID); known {
+		return fmt.Errorf("C recorded the refused spend")
+	}
+	if balance, _ := c.Storage.GetCreditBalance(c.System.ID); balance.Balance != 0 || balance.TotalReceived != 0 {
+		return fmt.Errorf("C's balance is %d after refusing the spend", balance.Balance)
+	}
+	return nil
+}
+
+// heldTransferTransport holds a credit transfer delivery until release is closed, then
+// answers for the recipient with a refusal
+type heldTransferTransport struct {
+	base    http.RoundTripper
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (t *heldTransferTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Path != "/api/transfer" {
+		return t.base.RoundTrip(r)
+	}
+	close(t.arrived)
+	<-t.release
+	return &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"error":{"code":400,"message":"held back"}}`)),
+		Request:    r,
+	}, nil
+}
+
+// lostAnswerTransport delivers transfers but loses the recipient's answer, as a timeout
+// or reset after the request went out would
+type lostAnswerTransport struct {
+	base http.RoundTripper
+}
+
+func (t *lostAnswerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	if err != nil || r.URL.Path != "/api/transfer" {
+		return resp, err
+	}
+	resp.Body.Close()
+	return nil, errors.New("read: connection reset by peer")
+}
+
+// gatedTransport holds every request until open is closed
+type gatedTransport struct {
+	base http.RoundTripper
+	open chan struct{}
+}
+
+func (t *gatedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	<-t.open
+	return t.base.RoundTrip(r)
+}
+
+// splitTransport fails requests to blocked addresses while split is set, as if the
+// network between the two were cut
+type splitTransport struct {
+	base    http.RoundTripper
+	split   *atomic.Bool
+	blocked map[string]bool
+}
+
+func (t *splitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.split.Load() && t.blocked[r.URL.Host] {
+		return nil, errors.New("network unreachable (simulated partition)")
+	}
+	return t.base.RoundTrip(r)
+}
+
+// simulatePartition: a star of 9 splits into islands {0-3} and {5-8}, with node 4 still
+// reaching both. Island A's nodes fail the other side's and evict it, but node 4 keeps
+// reporting it alive, so after PartitionConfirmChecks checks node 1 suspects a partition,
+// and its probes find node 4 reaching the other side while its own island can't. Once
+// the split is repaired the next check reaches them again and records the healing
+func simulatePartition() error {
+	g, err := NewTestGalaxy(9)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	m, bridge := g.Nodes[1], g.Nodes[4]
+	err = g.WaitForConvergence(func() bool {
+		for _, n := range []*TestNode{m, bridge} {
+			n.DHT.FindNode(n.System.ID)
+			if n.RoutingTable().GetRoutingTableSize() != len(g.Nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("nodes 1 and 4 never peered with every node: %w", err)
+	}
+
+	islandA, islandB := g.Nodes[0:4], g.Nodes[5:9]
+	split := new(atomic.Bool)
+	cut := func(from, to []*TestNode) {
+		blocked := make(map[string]bool)
+		for _, n := range to {
+			blocked[n.Address] = true
+		}
+		for _, n := range from {
+			n.DHT.httpClient.Transport = &splitTransport{base: n.DHT.httpClient.Transport, split: split, blocked: blocked}
+		}
+	}
+	cut(islandA, islandB)
+	cut(islandB, islandA)
+	split.Store(true)
+
+	// Island A gives up on the other side
+	for _, n := range islandA {
+		for _, other := range islandB {
+			if sys := n.RoutingTable().GetCachedSystem(other.System.ID); sys != nil {
+				for i := 0; i < MaxFailCount; i++ {
+					n.DHT.PingNode(sys)
+				}
+			}
+		}
+		n.RoutingTable().EvictDeadNodes()
+	}
+
+	// Node 4 still lists them in its answers
+	for i := 0; i < PartitionConfirmChecks; i++ {
+		m.DHT.FindNode(uuid.New())
+		m.DHT.checkPartition()
+	}
+	status := m.DHT.PartitionStatus()
+	if !status.Suspected || status.Unreachable != len(islandB) {
+		return fmt.Errorf("node 1 suspects a partition: %v, with %d unreachable, want %d", status.Suspected, status.Unreachable, len(islandB))
+	}
+	for _, member := range status.Group {
+		if len(member.Bridges) != 1 || member.Bridges[0] != bridge.System.Name {
+			return fmt.Errorf("%s was reached for us by %v, want only %s", member.Name, member.Bridges, bridge.System.Name)
+		}
+		if member.PeersAgree == 0 {
+			return fmt.Errorf("no peer in node 1's island failed to reach %s too", member.Name)
+		}
+	}
+	if status.RelayedProbes < int64(len(islandB)) {
+		return fmt.Errorf("%d relayed probes, want one per unreachable system", status.RelayedProbes)
+	}
+
+	// The other side heard from node 4 where node 1 is
+	err = g.WaitForConvergence(func() bool {
+		for _, n := range islandB {
+			if n.RoutingTable().GetCachedSystem(m.System.ID) == nil {
+				return false
+			}
+		}
+		return true
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("node 4 didn't pass node 1's info across: %w", err)
+	}
+
+	split.Store(false)
+	m.DHT.checkPartition()
+	status = m.DHT.PartitionStatus()
+	if status.Healed != int64(len(islandB)) || !status.HealedRecently || status.Unreachable != 0 {
+		return fmt.Errorf("after the repair %d systems healed and %d still unreachable, want %d and 0",
+			status.Healed, status.Unreachable, len(islandB))
+	}
+	for _, other := range islandB {
+		if !m.RoutingTable().IsRoutingTablePeer(other.System.ID) {
+			return fmt.Errorf("%s isn't node 1's peer again", other.System.Name)
+		}
+	}
+	m.DHT.checkPartition()
+	if status = m.DHT.PartitionStatus(); status.Suspected {
+		return fmt.Errorf("partition still suspected after healing")
+	}
+	log.Printf("Healed %d systems, the first via %s", status.Healed, status.Healings[len(status.Healings)-1].Via)
+	return nil
+}
+
+// simulateServiceReceipts: a newcomer's full-sync leaves its server a signed receipt,
+// credited at a brand-new identity's weight, while a receipt smuggled into a ping is
+// refused. The calculator caps each requester per UTC day, counting the day's receipts
+// from before the last calculation against the cap, weighs signers by how long their
+// identity has been bound and ignores unbound ones
+func simulateServiceReceipts() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	server, newcomer := g.Nodes[0], g.Nodes[1]
+
+	if _, err := newcomer.DHT.tryFullSync(server.Address); err != nil {
+		return fmt.Errorf("full-sync: %w", err)
+	}
+	if err := server.DHT.FlushAttestations(); err != nil {
+		return err
+	}
+	receipts, err := server.Storage.GetServiceReceiptsSince(server.System.ID, 0)
+	if err != nil {
+		return err
+	}
+	if len(receipts) != 1 || receipts[0].MessageType != AttestationFullSyncServed || receipts[0].FromSystemID != newcomer.System.ID {
+		return fmt.Errorf("server holds %d receipts, want the newcomer's full-sync receipt", len(receipts))
+	}
+
+	ping, err := NewPingRequest(newcomer.System, server.System.ID, "")
+	if err != nil {
+		return err
+	}
+	ping.Attestation = SignAttestation(newcomer.System.ID, server.System.ID, AttestationDiscoveryServed,
+		newcomer.System.Keys.PrivateKey, newcomer.System.Keys.PublicKey)
+	if _, err := newcomer.DHT.sendRequest(server.Address, ping); err == nil || !strings.Contains(err.Error(), "outside a service_receipt") {
+		return fmt.Errorf("receipt in a ping: %v, want a refusal", err)
+	}
+
+	if _, err := server.DHT.calculateCredits(); err != nil {
+		return err
+	}
+	earnings, err := server.Storage.GetCreditEarnings(0)
+	if err != nil {
+		return err
+	}
+	want := ServiceReceiptCredits[AttestationFullSyncServed] * ReceiptNewIdentityWeight
+	if len(earnings) == 0 || math.Abs(earnings[len(earnings)-1].Service-want) > 0.001 {
+		return fmt.Errorf("credit cycle after the newcomer's receipt: %d entries, want one with %.4f service credits", len(earnings), want)
+	}
+
+	// Yesterday noon (UTC) is the last calculation
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	noon := time.Now().Unix()/86400*86400 - 12*3600
+	receipt := func(from uuid.UUID, served string, at int64) *Attestation {
+		r := SignAttestation(from, server.System.ID, served, keys.PrivateKey, keys.PublicKey)
+		r.Timestamp = at
+		r.addNonce(keys.PrivateKey)
+		return r
+	}
+	veteran, fresh, unbound := uuid.New(), uuid.New(), uuid.New()
+	input := CalculationInput{
+		LastCalculation: noon,
+		ServiceReceipts: []*Attestation{
+			receipt(veteran, AttestationDiscoveryServed, noon-7200), // Credited last time, uses 0.1 of the cap
+			receipt(unbound, AttestationFullSyncServed, noon+1800),
+			receipt(veteran, AttestationFullSyncServed, noon+3600), // Capped to 0.15
+			receipt(fresh, AttestationFullSyncServed, noon+3600),
+			receipt(veteran, AttestationFullSyncServed, noon+7200),  // Over the cap
+			receipt(veteran, AttestationFullSyncServed, noon+86400), // A new day
+		},
+		ReceiptIdentities: map[uuid.UUID]int64{
+			veteran: noon - 30*86400,
+			fresh:   noon,
+		},
+	}
+	result := NewCreditCalculator().CalculateEarnedCredits(input)
+	want = 0.15 + ServiceReceiptCredits[AttestationFullSyncServed]*receiptWeight(3600) + ServiceReceiptDailyCap
+	if math.Abs(result.ServiceCredits-want) > 1e-9 || result.CreditsEarned != result.ServiceCredits {
+		return fmt.Errorf("receipts earned %.4f service credits (%.4f in all), want %.4f", result.ServiceCredits, result.CreditsEarned, want)
+	}
+	return nil
+}
+
+// inFlightTransport delays every request and records the most in flight at once
+type inFlightTransport struct {
+	base     http.RoundTripper
+	delay    time.Duration
+	cur, max atomic.Int32
+}
+
+func (t *inFlightTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	n := t.cur.Add(1)
+	defer t.cur.Add(-1)
+	for m := t.max.Load(); n > m && !t.max.CompareAndSwap(m, n); m = t.max.Load() {
+	}
+	time.Sleep(t.delay)
+	return t.base.RoundTrip(r)
+}
+
+// simulateBucketRefresh: random IDs land in the bucket asked for. A node holding systems
+// in 20 far buckets wakes from a two-hour sleep with all of them stale; one refresh run
+// looks up the stalest MaxBucketRefreshes buckets, BucketRefreshConcurrency at a time,
+// leaves the rest for later runs, and the health summary shows what it did
+func simulateBucketRefresh() error {
+	g, err := NewTestGalaxy(6)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	node := g.Nodes[1]
+	rt := node.RoutingTable()
+
+	for idx := 0; idx < IDBits; idx++ {
+		for i := 0; i < 4; i++ {
+			if got := bucketIndex(rt.localID, rt.RandomIDInBucket(idx)); got != idx {
+				return fmt.Errorf("random ID for bucket %d fell in bucket %d", idx, got)
+			}
+		}
+	}
+
+	for idx := 10; idx < 30; idx++ {
+		far := &System{ID: rt.RandomIDInBucket(idx), Name: fmt.Sprintf("Far-%d", idx), X: 5000,
+			PeerAddress: fmt.Sprintf("127.0.0.1:%d", idx)}
+		far.Stars = assignStarFromClass("M")
+		rt.CacheSystem(far, g.Nodes[0].System.ID, false)
+	}
+	b := rt.buckets
+	b.mu.Lock()
+	b.started = time.Now().Add(-2 * time.Hour)
+	b.lastAccess = [IDBits]time.Time{}
+	b.mu.Unlock()
+
+	stale := rt.StaleBuckets(time.Now())
+	if len(stale) < 20 {
+		return fmt.Errorf("%d stale buckets after the sleep, want at least 20", len(stale))
+	}
+	due := make(map[int]bool)
+	for _, idx := range stale[:MaxBucketRefreshes] {
+		due[idx] = true
+	}
+
+	counter := &inFlightTransport{base: node.DHT.httpClient.Transport, delay: 100 * time.Millisecond}
+	node.DHT.httpClient.Transport = counter
+	n, err := node.DHT.refreshBuckets()
+	if err != nil {
+		return err
+	}
+	if n != MaxBucketRefreshes {
+		return fmt.Errorf("refreshed %d buckets, want %d", n, MaxBucketRefreshes)
+	}
+	if max := int(counter.max.Load()); max > BucketRefreshConcurrency*Alpha {
+		return fmt.Errorf("%d requests in flight at once, want at most %d", max, BucketRefreshConcurrency*Alpha)
+	}
+	for _, idx := range rt.StaleBuckets(time.Now()) {
+		if due[idx] {
+			return fmt.Errorf("bucket %d still stale after its refresh", idx)
+		}
+	}
+
+	h := rt.RoutingHealth()
+	if h.Refreshes != MaxBucketRefreshes || h.RefreshFailures != 0 {
+		return fmt.Errorf("health counts %d refreshes (%d unanswered), want %d", h.Refreshes, h.RefreshFailures, MaxBucketRefreshes)
+	}
+	refreshed := 0
+	for _, bh := range h.Buckets {
+		if bh.LastRefresh > 0 {
+			if !due[bh.Index] {
+				return fmt.Errorf("bucket %d refreshed ahead of staler ones", bh.Index)
+			}
+			refreshed++
+		}
+	}
+	if refreshed != MaxBucketRefreshes || h.Populated < 20 || h.FillRatio <= 0 {
+		return fmt.Errorf("health lists %d refreshed buckets, %d populated, fill ratio %.2f", refreshed, h.Populated, h.FillRatio)
+	}
+	if got := node.DHT.NetworkStats().RoutingHealth; got.Populated != h.Populated {
+		return fmt.Errorf("/api/stats reports %d populated buckets, want %d", got.Populated, h.Populated)
+	}
+	return nil
+}
+
+// simulateLocalPeers: a hub among 60 synthetic systems scattered 1000-3000 units out gives
+// its local slots to exactly the nearest verified ones (its two real peers first), passing
+// over a nearer system whose coordinates are unchecked. A neighbour gone stale is announced
+// to and takes its slot back. However the share is set or newcomers claim slots, the local
+// slots never exceed the quota, and /api/peers tags local and routing peers
+func simulateLocalPeers() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub := g.Nodes[0]
+	rt := hub.RoutingTable()
+
+	quota := hub.DHT.localPeerQuota()
+	if want := hub.System.GetMaxPeers() * DefaultLocalPeerPercent / 100; quota != want || quota < 2 {
+		return fmt.Errorf("local peer quota %d, want %d", quota, want)
+	}
+
+	rng := rand.New(rand.NewSource(102))
+	place := func(name string, r float64) *System {
+		theta, phi := rng.Float64()*2*math.Pi, math.Acos(2*rng.Float64()-1)
+		sys := &System{ID: uuid.New(), Name: name, PeerAddress: fmt.Sprintf("127.0.0.1:%d", 1+rng.Intn(1000)),
+			X: r * math.Sin(phi) * math.Cos(theta), Y: r * math.Sin(phi) * math.Sin(theta), Z: r * math.Cos(phi)}
+		sys.Stars = assignStarFromClass("M")
+		return sys
+	}
+	galaxy := []*System{g.Nodes[1].System, g.Nodes[2].System}
+	for i := 0; i < 60; i++ {
+		sys := place(fmt.Sprintf("Synth-%d", i), 1000+rng.Float64()*2000)
+		rt.CacheSystem(sys, hub.System.ID, true)
+		rt.MarkVerified(sys.ID)
+		galaxy = append(galaxy, sys)
+	}
+	unchecked := place("Unchecked", 50)
+	rt.CacheSystem(unchecked, hub.System.ID, true)
+	rt.SetCoordsUnverified(unchecked.ID, true)
+
+	nearestTo := func(point *System, n int) []uuid.UUID {
+		var others []*System
+		for _, sys := range galaxy {
+			if sys.ID != point.ID {
+				others = append(others, sys)
+			}
+		}
+		sort.Slice(others, func(i, j int) bool { return point.DistanceTo(others[i]) < point.DistanceTo(others[j]) })
+		ids := make([]uuid.UUID, n)
+		for i := range ids {
+			ids[i] = others[i].ID
+		}
+		return ids
+	}
+	for _, point := range []*System{hub.System, galaxy[10], galaxy[40]} {
+		want := nearestTo(point, 7)
+		got := rt.GetNearest(point, 7)
+		if len(got) != len(want) {
+			return fmt.Errorf("GetNearest from %s returned %d systems, want %d", point.Name, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].ID != want[i] {
+				return fmt.Errorf("GetNearest from %s: #%d is %s, want %s", point.Name, i+1, got[i].Name, rt.GetCachedSystem(want[i]).Name)
+			}
+		}
+	}
+
+	holders := func() []uuid.UUID {
+		var ids []uuid.UUID
+		for _, cached := range rt.GetAllCachedSystemsWithMeta() {
+			if cached.LocalSlot {
+				ids = append(ids, cached.System.ID)
+			}
+		}
+		return ids
+	}
+	expectSlots := func(label string, want []uuid.UUID) error {
+		got := holders()
+		if len(got) != len(want) {
+			return fmt.Errorf("%s: %d local slots held, want %d", label, len(got), len(want))
+		}
+		for _, id := range want {
+			if !rt.IsLocalSlot(id) {
+				return fmt.Errorf("%s: %s holds no local slot", label, rt.GetCachedSystem(id).Name)
+			}
+		}
+		return nil
+	}
+
+	// Node 2 goes stale: the refresh announces to it, and it's a local peer again
+	stale := g.Nodes[2].System.ID
+	rt.cacheMu.Lock()
+	rt.systemCache[stale].LastVerified = time.Now().Add(-VerificationCutoff - time.Minute)
+	rt.cacheMu.Unlock()
+	announced, err := hub.DHT.refreshLocalPeers()
+	if err != nil {
+		return err
+	}
+	if announced != 1 || !rt.IsRoutingTablePeer(stale) {
+		return fmt.Errorf("refresh announced to %d systems (want 1), stale neighbour back in the table: %v", announced, rt.IsRoutingTablePeer(stale))
+	}
+	if err := expectSlots("after the refresh", nearestTo(hub.System, quota)); err != nil {
+		return err
+	}
+	if local, _ := rt.SlotCounts(); local != quota {
+		return fmt.Errorf("%d local peers in the routing table, want %d", local, quota)
+	}
+
+	// Routing slots are long full: a newcomer nearer than the farthest local peer takes its
+	// slot, one farther out is turned away
+	near, far := place("Near", 700), place("Far", 5000)
+	rt.CacheSystem(near, near.ID, false)
+	rt.CacheSystem(far, far.ID, false)
+	if !hub.DHT.hasCapacityFor(near) {
+		return fmt.Errorf("near newcomer turned away")
+	}
+	if hub.DHT.hasCapacityFor(far) {
+		return fmt.Errorf("far newcomer taken on with the routing slots full")
+	}
+	galaxy = append(galaxy, near)
+	if err := expectSlots("after the near newcomer", nearestTo(hub.System, quota)); err != nil {
+		return err
+	}
+
+	for _, percent := range []int{50, 100, 0, DefaultLocalPeerPercent} {
+		hub.DHT.SetLocalPeerPercent(percent)
+		want := hub.System.GetMaxPeers() * percent / 100
+		if _, err := hub.DHT.refreshLocalPeers(); err != nil {
+			return err
+		}
+		// Near never answered, so its slot goes to the next nearest
+		var nearest []uuid.UUID
+		for _, id := range nearestTo(hub.System, want+1) {
+			if id != near.ID && len(nearest) < want {
+				nearest = append(nearest, id)
+			}
+		}
+		if err := expectSlots(fmt.Sprintf("at %d%%", percent), nearest); err != nil {
+			return err
+		}
+		if n := len(holders()); n > hub.DHT.localPeerQuota() {
+			return fmt.Errorf("at %d%%: %d local slots held, quota %d", percent, n, hub.DHT.localPeerQuota())
+		}
+	}
+
+	web := &WebInterface{dht: hub.DHT}
+	rec := httptest.NewRecorder()
+	web.handlePeersAPI(rec, httptest.NewRequest(http.MethodGet, "/api/peers", nil))
+	var peers []struct {
+		ID   uuid.UUID `json:"id"`
+		Slot string    `json:"slot"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &peers); err != nil {
+		return err
+	}
+	slots := map[string]int{}
+	for _, p := range peers {
+		slots[p.Slot]++
+		if (p.Slot == SlotLocal) != rt.IsLocalSlot(p.ID) {
+			return fmt.Errorf("/api/peers tags %s as %q", p.ID, p.Slot)
+		}
+	}
+	if slots[SlotLocal] != quota || slots[SlotRouting] != len(peers)-quota {
+		return fmt.Errorf("/api/peers tags %v, want %d local of %d", slots, quota, len(peers))
+	}
+	return nil
+}
+
+// starsGoldenVectors pin each star derivation version: a UUID, the star classes it derives
+// and the primary's temperature. Like coordsGoldenVectors they must never be edited; a new
+// algorithm gets a new version and its own vectors
+var starsGoldenVectors = []struct {
+	version     int
+	system      string
+	classes     string
+	temperature int
+}{
+	{StarsDerivationV1, "00000000-0000-4000-8000-000000000001", "M+M+K", 3022},
+	{StarsDerivationV1, "3f2504e0-4f89-41d3-9a0c-0305e82c3301", "G", 5981},
+	{StarsDerivationV1, "6ba7b810-9dad-41d1-80b4-00c04fd430c8", "G", 5682},
+	{StarsDerivationV1, "9b2d5c1e-7a43-4e8f-b6d0-1c2e3f405162", "M+G", 2796},
+	{StarsDerivationV1, "c0ffee00-1234-4abc-9def-0123456789ab", "M+K", 2700},
+	{StarsDerivationV1, "d4e5f6a7-b8c9-4d0e-8f1a-2b3c4d5e6f70", "A", 8207},
+	{StarsDerivationV1, "e1a2b3c4-d5e6-4f70-8192-a3b4c5d6e7f8", "M", 2798},
+	{StarsDerivationV1, "ffffffff-ffff-4fff-bfff-ffffffffffff", "M", 2451},
+}
+
+// deriveStarsTestV2 stands in for a future star derivation: v1 with the primary rolled
+// from another seed, so most UUIDs get a different class than under v1
+func deriveStarsTestV2(id uuid.UUID) MultiStarSystem {
+	stars := deriveStarsV1(id)
+	stars.Primary = generateSingleStar((&System{ID: id}).DeterministicSeed("primary_star_v2"))
+	return stars
+}
+
+// simulateStarRoles: each star class gets its part, from stars that match the UUID. Peer
+// capacity runs from 18 for O down to 10 for M, plus 3 for a binary and 5 for a trinary;
+// O and B giants are relays, taking four times the announces and going first in a lookup
+// shortlist; M dwarfs ping healthy peers half as often. A system wearing O stars its UUID
+// doesn't derive is no relay
+func simulateStarRoles() error {
+	find := func(class string, count int) (*System, error) {
+		for i := 0; i < 1000000; i++ {
+			sys := &System{ID: uuid.New()}
+			sys.GenerateMultiStarSystem()
+			if sys.Stars.Primary.Class == class && sys.Stars.Count == count {
+				return sys, nil
+			}
+		}
+		return nil, fmt.Errorf("no %d-star %s system in a million UUIDs", count, class)
+	}
+
+	classes := []struct {
+		class    string
+		maxPeers int
+		relay    bool
+	}{
+		{"O", 18, true}, {"B", 16, true}, {"A", 15, false}, {"F", 14, false},
+		{"G", 12, false}, {"K", 11, false}, {"M", 10, false},
+	}
+	for _, c := range classes {
+		for count, bonus := range map[int]int{1: 0, 2: 3, 3: 5} {
+			sys, err := find(c.class, count)
+			if err != nil {
+				return err
+			}
+			if got := sys.GetMaxPeers(); got != c.maxPeers+bonus {
+				return fmt.Errorf("%d-star %s: %d max peers, want %d", count, c.class, got, c.maxPeers+bonus)
+			}
+			if sys.IsRelay() != c.relay {
+				return fmt.Errorf("%d-star %s: relay %v, want %v", count, c.class, sys.IsRelay(), c.relay)
+			}
+
+			wantRate := AnnounceRateLimit
+			if c.relay {
+				wantRate = RelayAnnounceRateLimit
+			}
+			var limiter rateLimiter
+			allowed := 0
+			for limiter.allow(sys.AnnounceRateLimit()) {
+				allowed++
+			}
+			if allowed != wantRate {
+				return fmt.Errorf("%d-star %s: took %d announces in a burst, want %d", count, c.class, allowed, wantRate)
+			}
+
+			base := LivenessInterval
+			if c.class == "M" {
+				base *= DwarfLivenessMultiplier
+			}
+			if got := sys.LivenessInterval(); got != base {
+				return fmt.Errorf("%d-star %s: liveness interval %v, want %v", count, c.class, got, base)
+			}
+			delay := livenessDelay(sys.LivenessInterval(), 0)
+			if low, high := time.Duration(float64(base)*(1-LivenessJitter)), time.Duration(float64(base)*(1+LivenessJitter)); delay < low || delay > high {
+				return fmt.Errorf("%d-star %s: next liveness ping in %v, want %v-%v", count, c.class, delay, low, high)
+			}
+		}
+	}
+
+	// The genesis black hole is a hub, but not a relay
+	genesis := &System{ID: uuid.New(), Stars: assignStarFromClass("X")}
+	if genesis.GetMaxPeers() != 20 || genesis.IsRelay() {
+		return fmt.Errorf("genesis: %d max peers, relay %v", genesis.GetMaxPeers(), genesis.IsRelay())
+	}
+
+	// Stars the UUID doesn't derive earn nothing
+	giant, err := find("O", 1)
+	if err != nil {
+		return err
+	}
+	dwarf, err := find("M", 1)
+	if err != nil {
+		return err
+	}
+	impostor := *dwarf
+	impostor.Stars = giant.Stars
+	if impostor.IsRelay() || impostor.AnnounceRateLimit() != AnnounceRateLimit {
+		return fmt.Errorf("a system claiming O stars its UUID doesn't derive is treated as a relay")
+	}
+
+	// Relays go first in a shortlist, everything else keeps its order
+	b, err := find("B", 1)
+	if err != nil {
+		return err
+	}
+	g, err := find("G", 1)
+	if err != nil {
+		return err
+	}
+	shortlist := preferRelays([]*System{g, giant, &impostor, dwarf, b})
+	for i, want := range []*System{giant, b, g, &impostor, dwarf} {
+		if shortlist[i] != want {
+			return fmt.Errorf("shortlist position %d is %s, want %s", i, shortlist[i].Stars.Primary.Class, want.Stars.Primary.Class)
+		}
+	}
+	return nil
+}
+
+// simulateSignedDerivation checks that signed info covers the derivation versions without
+// changing what a v1 system signs, and that a relayed copy's stars past the signed primary
+// class are replaced with what its UUID derives, in the cache and in storage
+func simulateSignedDerivation() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b := g.Nodes[0], g.Nodes[1]
+	key := base64.StdEncoding.EncodeToString(b.System.Keys.PublicKey)
+
+	signed := b.DHT.GetLocalSystem()
+	if signed.StarsVersion != StarsDerivationV1 || signed.CoordsVersion > 1 {
+		return fmt.Errorf("node generated with star derivation %d, coordinates %d", signed.StarsVersion, signed.CoordsVersion)
+	}
+	if msg := string(signed.GetInfoSignableMessage()); strings.Contains(msg, "stars_version") || strings.Contains(msg, "coords_version") {
+		return fmt.Errorf("a v1 system signs its derivation versions, older nodes can't verify it: %s", msg)
+	}
+	if !signed.VerifyInfo(key) {
+		return fmt.Errorf("node's own info doesn't verify")
+	}
+	for _, field := range []string{"stars_version", "coords_version"} {
+		changed := *signed
+		if field == "stars_version" {
+			changed.StarsVersion = 2
+		} else {
+			changed.CoordsVersion = 2
+		}
+		if changed.VerifyInfo(key) {
+			return fmt.Errorf("info with %s changed to 2 still verifies", field)
+		}
+	}
+
+	// A relay keeps the primary class, which is signed, and rewrites everything else
+	forged := *signed
+	forged.Stars.Primary.Color = "#000000"
+	forged.Stars.Primary.Description = "Forged"
+	forged.Stars.Secondary = &StarType{Class: "O", Color: "#9bb0ff", Temperature: 40000}
+	forged.Stars.IsBinary, forged.Stars.Count = true, 2
+	if !forged.VerifyInfo(key) {
+		return fmt.Errorf("forged companions broke the signature, this check needs a signed-only change")
+	}
+	a.RoutingTable().CacheSystem(&forged, uuid.Nil, false)
+	want := ExpectedStars(signed.StarsVersion, signed.ID)
+	cached := a.RoutingTable().GetCachedSystem(signed.ID)
+	if cached == nil {
+		return fmt.Errorf("relayed copy wasn't cached")
+	}
+	got, _ := json.Marshal(cached.Stars)
+	derived, _ := json.Marshal(want)
+	if string(got) != string(derived) {
+		return fmt.Errorf("relayed copy cached with stars %s, its UUID derives %s", got, derived)
+	}
+	stored, err := a.Storage.GetPeerSystem(signed.ID)
+	if err != nil {
+		return err
+	}
+	if stored.StarsVersion != signed.StarsVersion || stored.CoordsVersion != signed.CoordsVersion {
+		return fmt.Errorf("stored with star derivation %d, coordinates %d, want %d and %d",
+			stored.StarsVersion, stored.CoordsVersion, signed.StarsVersion, signed.CoordsVersion)
+	}
+	return nil
+}
+
+// simulateStarDerivation checks star derivation against the golden vectors and that a
+// system validates whatever version it records, then adds a v2 derivation the way a future
+// release would. Systems generated before it still validate, new ones are generated with
+// v2 and validate too, a nonsense configuration is still refused, and over the network a
+// v2 node joins through a v1 hub and pings v1 nodes both ways. Stars are checked against
+// the version a system records, which relayed and full-synced copies keep, so their planets
+// come out as their own. Without v2 in the table (an older build), the v2 node is refused
+// naming the unknown version
+func simulateStarDerivation() error {
+	for i, v := range starsGoldenVectors {
+		stars := ExpectedStars(v.version, uuid.MustParse(v.system))
+		classes := starClasses(stars)
+		if classes == "" {
+			classes = stars.Primary.Class
+		}
+		if classes != v.classes || stars.Primary.Temperature != v.temperature {
+			return fmt.Errorf("golden vector %d (v%d): got %s at %d K, want %s at %d K",
+				i, v.version, classes, stars.Primary.Temperature, v.classes, v.temperature)
+		}
+	}
+
+	old := &System{ID: uuid.New()}
+	old.GenerateMultiStarSystem()
+	if old.StarsVersion != StarsDerivationV1 {
+		return fmt.Errorf("generated system records star derivation %d, want %d", old.StarsVersion, StarsDerivationV1)
+	}
+	for _, version := range []int{0, StarsDerivationV1, 99} {
+		recorded := *old
+		recorded.StarsVersion = version
+		if want := version != 99; ValidateStarSystem(&recorded) != want {
+			return fmt.Errorf("system recording star derivation %d: valid is %v, want %v", version, !want, want)
+		}
+	}
+
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	hub, v1 := g.Nodes[0], g.Nodes[1]
+
+	// A later release adds v2; the table keeps v1 so nothing generated before fails
+	saved := starsDerivations
+	starsDerivations = append(append([]starsDerivation(nil), saved...), starsDerivation{2, deriveStarsTestV2})
+	defer func() { starsDerivations = saved }()
+
+	fresh := &System{ID: uuid.New()}
+	fresh.GenerateMultiStarSystem()
+	if fresh.StarsVersion != 2 || fresh.Stars.Primary.Class != deriveStarsTestV2(fresh.ID).Primary.Class {
+		return fmt.Errorf("new system generated with star derivation %d (%s)", fresh.StarsVersion, fresh.Stars.Primary.Class)
+	}
+	for _, sys := range []*System{old, fresh, v1.System} {
+		if !ValidateStarSystem(sys) {
+			return fmt.Errorf("%s (star derivation v%d) rejected once v2 was added", sys.ID, sys.StarsVersion)
+		}
+	}
+	// Stars are checked against the version recorded, not whichever happens to match
+	if claimed := *old; ExpectedStars(2, old.ID).Primary.Class != old.Stars.Primary.Class {
+		claimed.StarsVersion = 2
+		if ValidateStarSystem(&claimed) {
+			return fmt.Errorf("v1 stars accepted from a system recording star derivation v2")
+		}
+	}
+	bogus := *old
+	for _, class := range []string{"O", "B", "A", "F", "G", "K", "M"} {
+		if class != ExpectedStars(1, old.ID).Primary.Class && class != ExpectedStars(2, old.ID).Primary.Class {
+			bogus.Stars.Primary = assignStarFromClass(class).Primary
+			break
+		}
+	}
+	if ValidateStarSystem(&bogus) {
+		return fmt.Errorf("a %s primary, which no derivation gives %s, accepted", bogus.Stars.Primary.Class, old.ID)
+	}
+
+	// A node started now gets v2 stars; start them until one differs from what v1 derives
+	var v2 *TestNode
+	for i := 0; i < 20 && v2 == nil; i++ {
+		node, err := g.startNode(fmt.Sprintf("Sim-v2-%d", i))
+		if err != nil {
+			return err
+		}
+		g.Nodes = append(g.Nodes, node)
+		if node.System.Stars.Primary.Class != ExpectedStars(1, node.System.ID).Primary.Class {
+			v2 = node
+		}
+	}
+	if v2 == nil {
+		return fmt.Errorf("no node out of 20 got stars v1 wouldn't derive")
+	}
+	if err := g.Connect(len(g.Nodes)-1, 0); err != nil {
+		return fmt.Errorf("v2 node joining through the hub: %w", err)
+	}
+	for _, pair := range [][2]*TestNode{{hub, v2}, {v1, v2}, {v2, v1}} {
+		if _, err := pair[0].DHT.Ping(pair[1].Address); err != nil {
+			return fmt.Errorf("%s pinging %s: %w", pair[0].System.Name, pair[1].System.Name, err)
+		}
+	}
+	caps, known := hub.RoutingTable().GetCapabilities(v2.System.ID)
+	if !known || !caps.Has(CapStarsVersion) {
+		return fmt.Errorf("v2 node's capabilities don't list stars-version")
+	}
+
+	// The version travels with the system when it's relayed and in full-sync
+	closest, err := v1.DHT.FindNodeDirectToSystem(hub.System, v2.System.ID)
+	if err != nil {
+		return err
+	}
+	relayed := false
+	for _, sys := range closest {
+		if sys.ID == v2.System.ID {
+			relayed = true
+			if sys.StarsVersion != 2 || sys.CoordsVersion != v2.System.CoordsVersion {
+				return fmt.Errorf("v2 node relayed with star derivation %d, coordinates %d", sys.StarsVersion, sys.CoordsVersion)
+			}
+		}
+	}
+	if !relayed {
+		return fmt.Errorf("hub's find_node answer left out the v2 node")
+	}
+	late, err := g.startNode("Sim-late")
+	if err != nil {
+		return err
+	}
+	g.Nodes = append(g.Nodes, late)
+	if _, err := late.DHT.tryFullSync(hub.Address); err != nil {
+		return err
+	}
+	synced := late.RoutingTable().GetCachedSystem(v2.System.ID)
+	if synced == nil || synced.StarsVersion != 2 || synced.CoordsVersion != v2.System.CoordsVersion {
+		return fmt.Errorf("v2 node full-synced as %+v", synced)
+	}
+	if got, want := synced.GeneratePlanets(), v2.System.GeneratePlanets(); fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("full-synced v2 node has planets %v, its own are %v", got, want)
+	}
+
+	// An older build, without v2, can't validate the v2 node and says why
+	starsDerivations = saved
+	if _, err := v2.DHT.Ping(hub.Address); err == nil || !strings.Contains(err.Error(), "unknown star derivation v2") {
+		return fmt.Errorf("v2 node pinging a build without v2: got %v", err)
+	}
+	return nil
+}
+
+// simulateSystemJSON: nothing a node serializes - its System, the key pair itself, a
+// DHT message carrying it, or its /system response - holds the private key (or its seed)
+// in any encoding. /system is versioned, gives the public key, and turns back into a
+// System whose signed info checks out; tampered info doesn't, and a parser that still
+// decodes a plain System reads it too
+func simulateSystemJSON() error {
+	g, err := NewTestGalaxy(1)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a := g.Nodes[0]
+	keys := a.System.Keys
+
+	var secrets []string
+	for _, b := range [][]byte{keys.PrivateKey, keys.PrivateKey.Seed()} {
+		secrets = append(secrets, string(b), fmt.Sprintf("%x", b),
+			base64.StdEncoding.EncodeToString(b), base64.RawStdEncoding.EncodeToString(b),
+			base64.URLEncoding.EncodeToString(b), base64.RawURLEncoding.EncodeToString(b))
+	}
+
+	resp, err := http.Get("http://" + a.Address + "/system")
+	if err != nil {
+		return err
+	}
+	served, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	ping, err := NewPingRequest(a.System, uuid.New(), "")
+	if err != nil {
+		return err
+	}
+	outputs := map[string][]byte{"/system": served}
+	for name, v := range map[string]interface{}{"System": a.System, "KeyPair": keys, "DHT message": ping, "SystemInfo": NewSystemInfo(a.System)} {
+		if outputs[name], err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	for name, out := range outputs {
+		for _, secret := range secrets {
+			if strings.Contains(string(out), secret) {
+				return fmt.Errorf("%s JSON contains the private key", name)
+			}
+		}
+	}
+
+	var info SystemInfo
+	if err := json.Unmarshal(served, &info); err != nil {
+		return err
+	}
+	if info.Schema != SystemInfoSchema || info.PublicKey != base64.StdEncoding.EncodeToString(keys.PublicKey) {
+		return fmt.Errorf("/system gave schema %d and public key %q", info.Schema, info.PublicKey)
+	}
+	sys, err := info.System()
+	if err != nil || sys.ID != a.System.ID || sys.Keys != nil {
+		return fmt.Errorf("/system as a System: %v", err)
+	}
+	info.Name = "Tampered"
+	if _, err := info.System(); err == nil {
+		return fmt.Errorf("tampered system info accepted")
+	}
+
+	var legacy System
+	if err := json.Unmarshal(served, &legacy); err != nil || legacy.ID != a.System.ID || legacy.PeerAddress != a.System.PeerAddress {
+		return fmt.Errorf("/system decoded as a plain System: %v", err)
+	}
+	return nil
+}
+
+// simulatePeerState: a peer goes pending on insert, active on direct contact, survives one
+// missed ping, degrades on the second, goes stale when its last contact ages out and comes
+// back on any success. Every transition is recorded, and the breakdown, GetClosest,
+// FIND_NODE responses and the liveness loop all go by the recorded state
+func simulatePeerState() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub, peer, asker := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	rt := hub.RoutingTable()
+	id := peer.System.ID
+
+	state := func() PeerState {
+		return PeerState(rt.GetCachedSystemStatus(id).State)
+	}
+	expect := func(step string, want PeerState, inTable, handedOut bool) error {
+		if got := state(); got != want {
+			return fmt.Errorf("%s: state %s, want %s", step, got, want)
+		}
+		if rt.IsRoutingTablePeer(id) != inTable {
+			return fmt.Errorf("%s: in routing table %v, want %v", step, !inTable, inTable)
+		}
+		closest := false
+		for _, sys := range rt.GetClosest(id, K) {
+			closest = closest || sys.ID == id
+		}
+		if closest != inTable {
+			return fmt.Errorf("%s: GetClosest included it %v, want %v", step, closest, inTable)
+		}
+		msg, err := NewFindNodeRequest(asker.System, hub.System.ID, id, "")
+		if err != nil {
+			return err
+		}
+		resp, err := hub.DHT.handleFindNode(msg)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, sys := range resp.ClosestNodes {
+			found = found || sys.ID == id
+		}
+		if found != handedOut {
+			return fmt.Errorf("%s: FIND_NODE response included it %v, want %v", step, found, handedOut)
+		}
+		breakdown := rt.GetPeerStateBreakdown()
+		counts := map[PeerState]int{PeerActive: breakdown.Active, PeerDegraded: breakdown.Degraded,
+			PeerPending: breakdown.Pending, PeerStale: breakdown.Stale}
+		if counts[want] < 1 || breakdown.Active+breakdown.Degraded+breakdown.Pending+breakdown.Stale != breakdown.Total {
+			return fmt.Errorf("%s: breakdown %+v doesn't count it as %s", step, breakdown, want)
+		}
+		return nil
+	}
+
+	// A system heard of through gossip starts pending
+	gossiped := &System{ID: uuid.New(), Name: "Gossiped", PeerAddress: "127.0.0.1:1"}
+	gossiped.Stars = assignStarFromClass("M")
+	rt.CacheSystem(gossiped, peer.System.ID, false)
+	if status := rt.GetCachedSystemStatus(gossiped.ID); PeerState(status.State) != PeerPending ||
+		len(status.StateChanges) != 1 || status.StateChanges[0].To != PeerPending {
+		return fmt.Errorf("gossiped system is %s with transitions %+v", status.State, status.StateChanges)
+	}
+
+	if err := expect("after contact", PeerActive, true, true); err != nil {
+		return err
+	}
+	rt.MarkFailed(id)
+	if err := expect("one missed ping", PeerActive, true, true); err != nil {
+		return err
+	}
+	rt.MarkFailed(id)
+	if err := expect("two missed pings", PeerDegraded, true, false); err != nil {
+		return err
+	}
+	rt.MarkFailed(id)
+	if err := expect("three missed pings", PeerDegraded, true, false); err != nil {
+		return err
+	}
+	rt.MarkVerified(id)
+	if err := expect("answered again", PeerActive, true, true); err != nil {
+		return err
+	}
+
+	// Its last contact ages out: read as stale at once, recorded by the liveness loop
+	rt.cacheMu.Lock()
+	rt.systemCache[id].LastVerified = time.Now().Add(-VerificationCutoff - time.Minute)
+	rt.cacheMu.Unlock()
+	if err := expect("aged out", PeerStale, false, false); err != nil {
+		return err
+	}
+	if changes := rt.GetCachedSystemStatus(id).StateChanges; changes[len(changes)-1].To != PeerActive {
+		return fmt.Errorf("stale transition recorded before the liveness loop ran: %+v", changes[len(changes)-1])
+	}
+	for _, sys := range rt.DueForLiveness(time.Now(), 0) {
+		if sys.ID == id {
+			return fmt.Errorf("liveness loop still checks a stale peer")
+		}
+	}
+	rt.MarkVerified(id)
+	if err := expect("back from stale", PeerActive, true, true); err != nil {
+		return err
+	}
+
+	want := []PeerStateChange{{To: PeerPending}, {From: PeerPending, To: PeerActive},
+		{From: PeerActive, To: PeerDegraded}, {From: PeerDegraded, To: PeerActive},
+		{From: PeerActive, To: PeerStale}, {From: PeerStale, To: PeerActive}}
+	detail, err := hub.DHT.GetPeerDetail(id)
+	if err != nil {
+		return err
+	}
+	if len(detail.StateChanges) != len(want) {
+		return fmt.Errorf("recorded transitions %+v, want %d", detail.StateChanges, len(want))
+	}
+	for i, change := range detail.StateChanges {
+		if change.From != want[i].From || change.To != want[i].To || change.At == 0 {
+			return fmt.Errorf("transition %d is %+v, want %s -> %s", i, change, want[i].From, want[i].To)
+		}
+	}
+	if detail.State != string(PeerActive) || detail.StateSince != detail.StateChanges[len(want)-1].At {
+		return fmt.Errorf("peer detail is %s since %d", detail.State, detail.StateSince)
+	}
+	return nil
+}
+
+// simulatePeerTraffic: every message with a peer is counted by kind on both ends, a request
+// refused for failing validation shows as rejected on the side that refused it and on the
+// side it was refused from, one refused before its claimed UUID checked out is counted
+// under the address it came from, pruning keeps counts until they're flushed, counts survive a flush into hourly buckets (and merge with ones
+// not yet flushed), concurrent counting loses nothing across flushes, a week of buckets is
+// kept and GET /api/peers/{id}/traffic serves the same totals
+func simulatePeerTraffic() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	a, b := g.Nodes[0], g.Nodes[1]
+
+	traffic := func(n *TestNode, id uuid.UUID) (*PeerMessageTraffic, error) {
+		return n.DHT.GetPeerMessageTraffic(id.String())
+	}
+	aBefore, err := traffic(a, b.System.ID)
+	if err != nil {
+		return err
+	}
+	bBefore, err := traffic(b, a.System.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := b.DHT.PingNode(a.System); err != nil {
+			return fmt.Errorf("ping %d: %v", i+1, err)
+		}
+	}
+	post := func(msg *DHTMessage) (int, error) {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := postDHT(context.Background(), http.DefaultClient, peerURL(a.Address, "/dht"), data, false)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// 20 minutes off is past the clock skew cap, so A refuses it before checking B's
+	// identity: A counts it under the address it came from
+	msg, err := NewPingRequest(b.System, a.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	msg.Timestamp = msg.Timestamp.Add(-20 * time.Minute)
+	msg.Attestation.Timestamp -= int64(20 * time.Minute / time.Second)
+	msg.Attestation.addNonce(b.System.Keys.PrivateKey)
+	if _, err := b.DHT.sendRequest(a.Address, msg); err == nil {
+		return fmt.Errorf("a ping 20 minutes off was answered")
+	}
+	// A response to nothing A asked is refused once B is identified, so it's B's
+	unsolicited, err := NewPingResponse(b.System, a.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	if status, err := post(unsolicited); err != nil || status == http.StatusOK {
+		return fmt.Errorf("an unsolicited response got %d (%v)", status, err)
+	}
+
+	aAfter, err := traffic(a, b.System.ID)
+	if err != nil {
+		return err
+	}
+	bAfter, err := traffic(b, a.System.ID)
+	if err != nil {
+		return err
+	}
+	since := func(after, before MessageCounts) MessageCounts {
+		return MessageCounts{
+			Ping:      after.Ping - before.Ping,
+			Responses: after.Responses - before.Responses,
+			Errors:    after.Errors - before.Errors,
+			Rejected:  after.Rejected - before.Rejected,
+			Bytes:     after.Bytes - before.Bytes,
+		}
+	}
+	aIn, aOut := since(aAfter.In, aBefore.In), since(aAfter.Out, aBefore.Out)
+	bIn, bOut := since(bAfter.In, bBefore.In), since(bAfter.Out, bBefore.Out)
+	if aIn.Ping != 3 || aIn.Rejected != 1 || aOut.Responses != 3 || aOut.Errors != 0 {
+		return fmt.Errorf("A counted from B %+v and to B %+v, want 3 pings and 1 rejected in, 3 responses out", aIn, aOut)
+	}
+	if bOut.Ping != 4 || bOut.Rejected != 1 || bIn.Responses != 3 || bIn.Errors != 1 {
+		return fmt.Errorf("B counted to A %+v and from A %+v, want 4 pings with 1 rejected out, 3 responses and 1 error in", bOut, bIn)
+	}
+	if aIn.Bytes == 0 || aOut.Bytes == 0 || bIn.Bytes == 0 || bOut.Bytes == 0 {
+		return fmt.Errorf("bytes not counted: A %d in %d out, B %d in %d out", aIn.Bytes, aOut.Bytes, bIn.Bytes, bOut.Bytes)
+	}
+
+	const remote = "127.0.0.1"
+	fromAddr, err := a.DHT.GetPeerMessageTraffic(remote)
+	if err != nil {
+		return err
+	}
+	if fromAddr.In.Rejected != 1 || fromAddr.Out.Errors != 1 {
+		return fmt.Errorf("counted from %s %+v and to it %+v, want 1 rejected in and 1 error out", remote, fromAddr.In, fromAddr.Out)
+	}
+
+	// Nor can a ping claiming B's UUID under another key touch B's counts
+	forger := *b.System
+	if forger.Keys, err = GenerateKeyPair(); err != nil {
+		return err
+	}
+	spoof, err := NewPingRequest(&forger, a.System.ID, uuid.New().String())
+	if err != nil {
+		return err
+	}
+	if status, err := post(spoof); err != nil || status == http.StatusOK {
+		return fmt.Errorf("a ping claiming B's UUID under another key got %d (%v)", status, err)
+	}
+	if now, err := traffic(a, b.System.ID); err != nil || now.In != aAfter.In {
+		return fmt.Errorf("the spoofed ping changed B's counts to %+v (%v)", now.In, err)
+	}
+	if fromAddr, err = a.DHT.GetPeerMessageTraffic(remote); err != nil || fromAddr.In.Rejected != 2 {
+		return fmt.Errorf("after the spoofed ping %s has %+v (%v), want 2 rejected", remote, fromAddr.In, err)
+	}
+
+	// Pruning forgets uncached peers only once their counts are flushed
+	a.DHT.messageTraffic.forget(func(uuid.UUID) bool { return false })
+	if kept, err := a.DHT.GetPeerMessageTraffic(remote); err != nil || kept.In != fromAddr.In {
+		return fmt.Errorf("after pruning, %s's unflushed counts are %+v (%v)", remote, kept.In, err)
+	}
+
+	// Flushing moves the counts to peer_traffic without changing what's reported
+	if n, err := a.DHT.flushPeerTraffic(); err != nil || n == 0 {
+		return fmt.Errorf("flush saved %d peers (%v)", n, err)
+	}
+	stored, err := a.Storage.GetPeerTraffic(b.System.ID.String(), 0)
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return fmt.Errorf("nothing in peer_traffic after flushing")
+	}
+	a.DHT.messageTraffic.forget(func(uuid.UUID) bool { return false })
+	if _, ok := a.DHT.messageTraffic.peers.Load(remote); ok {
+		return fmt.Errorf("%s's counters kept after they were flushed", remote)
+	}
+	if saved, err := a.DHT.GetPeerMessageTraffic(remote); err != nil || saved.In != fromAddr.In {
+		return fmt.Errorf("%s's flushed counts are %+v (%v)", remote, saved.In, err)
+	}
+	flushed, err := traffic(a, b.System.ID)
+	if err != nil {
+		return err
+	}
+	if flushed.In != aAfter.In || flushed.Out != aAfter.Out {
+		return fmt.Errorf("after flushing A reports %+v / %+v, want %+v / %+v", flushed.In, flushed.Out, aAfter.In, aAfter.Out)
+	}
+
+	// Counting never waits on a flush, and nothing is lost or counted twice across one
+	busy := uuid.New()
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				a.DHT.messageTraffic.outbound(busy, MessageTypeFindNode, 100, 200, false, 0, false)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for flushing := true; flushing; {
+		select {
+		case <-done:
+			flushing = false
+		default:
+			if _, err := a.DHT.flushPeerTraffic(); err != nil {
+				return err
+			}
+		}
+	}
+	busyTraffic, err := traffic(a, busy)
+	if err != nil {
+		return err
+	}
+	if busyTraffic.Out.FindNode != 4000 || busyTraffic.In.Responses != 4000 || busyTraffic.Out.Bytes != 400000 {
+		return fmt.Errorf("concurrent counting across flushes gave %+v / %+v, want 4000 find_node and responses", busyTraffic.Out, busyTraffic.In)
+	}
+	if n := len(busyTraffic.Hours); n == 0 || n > 2 {
+		return fmt.Errorf("%d hourly buckets for a few milliseconds of counting", n)
+	}
+
+	// Buckets older than the window are trimmed on the next flush
+	old := time.Now().Add(-PeerTrafficWindow - 2*time.Hour).Truncate(time.Hour).Unix()
+	if err := a.Storage.AddPeerTraffic(old, map[string]TrafficHour{b.System.ID.String(): {In: MessageCounts{Ping: 99}}}); err != nil {
+		return err
+	}
+	if _, err := a.DHT.flushPeerTraffic(); err != nil {
+		return err
+	}
+	stored, err = a.Storage.GetPeerTraffic(b.System.ID.String(), 0)
+	if err != nil {
+		return err
+	}
+	for _, h := range stored {
+		if h.Hour == old {
+			return fmt.Errorf("an %v old bucket survived retention", time.Since(time.Unix(old, 0)).Round(time.Hour))
+		}
+	}
+
+	// The API and the peer page report the same
+	web := &WebInterface{dht: a.DHT, storage: a.Storage}
+	rec := httptest.NewRecorder()
+	web.handlePeerAnnotationAPI(rec, httptest.NewRequest(http.MethodGet, "/api/peers/"+b.System.ID.String()+"/traffic", nil))
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("GET /api/peers/{id}/traffic: %d %s", rec.Code, rec.Body.String())
+	}
+	var served PeerMessageTraffic
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		return err
+	}
+	if served.In != flushed.In || served.Out != flushed.Out || len(served.Hours) == 0 {
+		return fmt.Errorf("API served %+v / %+v, want %+v / %+v", served.In, served.Out, flushed.In, flushed.Out)
+	}
+	rec = httptest.NewRecorder()
+	web.handlePeerAnnotationAPI(rec, httptest.NewRequest(http.MethodGet, "/api/peers/"+remote+"/traffic", nil))
+	served = PeerMessageTraffic{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil || served.In != fromAddr.In {
+		return fmt.Errorf("GET /api/peers/%s/traffic: %d %s", remote, rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	web.handlePeerAnnotationAPI(rec, httptest.NewRequest(http.MethodGet, "/api/peers/not-a-uuid/traffic", nil))
+	if rec.Code != http.StatusBadRequest {
+		return fmt.Errorf("GET traffic for a bad ID: %d, want 400", rec.Code)
+	}
+	detail, err := a.DHT.GetPeerDetail(b.System.ID)
+	if err != nil {
+		return err
+	}
+	if detail.Messages == nil || detail.Messages.In != flushed.In {
+		return fmt.Errorf("peer detail messages are %+v", detail.Messages)
+	}
+	return nil
+}
+
+// simulateCreditRestart: a node that goes down after working out a credit cycle but
+// before saving it counts the same window again on the next run and ends up with the
+// balance a single run gives; committing that first cycle afterwards changes nothing, and
+// a clock set back behind the last calculation earns nothing rather than a negative span
+func simulateCreditRestart() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	hub, a := g.Nodes[0], g.Nodes[1]
+
+	// An attestation from the hub every 5 minutes for 3 hours
+	now := time.Now()
+	for i := 1; i <= 36; i++ {
+		att := SignAttestation(hub.System.ID, a.System.ID, "ping", hub.System.Keys.PrivateKey, hub.System.Keys.PublicKey)
+		att.Timestamp = now.Unix() - int64(i)*300
+		att.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(hub.System.Keys.PrivateKey, att.GetSignableMessage()))
+		if err := a.Storage.SaveAttestation(att, a.System.ID); err != nil {
+			return err
+		}
+	}
+	before, err := a.Storage.GetCreditBalance(a.System.ID)
+	if err != nil {
+		return err
+	}
+
+	a.DHT.creditMu.Lock()
+	defer a.DHT.creditMu.Unlock()
+
+	// Worked out, then the node went down before saving
+	crashed, err := a.DHT.computeCreditCycle(now)
+	if err != nil {
+		return err
+	}
+	if crashed == nil || !crashed.advanced || crashed.balance.Balance < 2 {
+		return fmt.Errorf("3 hours of attestations earned nothing")
+	}
+	if stored, err := a.Storage.GetCreditBalance(a.System.ID); err != nil || *stored != *before {
+		return fmt.Errorf("balance changed before the cycle was committed (%v)", err)
+	}
+
+	// After the restart the same window comes round again
+	cycle, err := a.DHT.computeCreditCycle(now)
+	if err != nil {
+		return err
+	}
+	if cycle.input.LastCalculation != crashed.input.LastCalculation || cycle.input.WindowEnd != now.Unix() {
+		return fmt.Errorf("window after restart is %d-%d, want %d-%d", cycle.input.LastCalculation,
+			cycle.input.WindowEnd, crashed.input.LastCalculation, now.Unix())
+	}
+	if ok, err := a.Storage.CommitCreditCalculation(cycle.input.LastCalculation, cycle.balance, cycle.earning); err != nil || !ok {
+		return fmt.Errorf("committing the cycle: %v (committed %v)", err, ok)
+	}
+	single := crashed.balance
+	stored, err := a.Storage.GetCreditBalance(a.System.ID)
+	if err != nil {
+		return err
+	}
+	if stored.Balance != single.Balance || math.Abs(stored.PendingCredits-single.PendingCredits) > 1e-9 ||
+		stored.LastUpdated != now.Unix() {
+		return fmt.Errorf("balance %d + %.3f (calculated %d), want %d + %.3f (calculated %d)", stored.Balance,
+			stored.PendingCredits, stored.LastUpdated, single.Balance, single.PendingCredits, now.Unix())
+	}
+
+	// Committing the same window again is a no-op
+	if ok, err := a.Storage.CommitCreditCalculation(crashed.input.LastCalculation, crashed.balance, crashed.earning); err != nil || ok {
+		return fmt.Errorf("the window was committed twice (%v)", err)
+	}
+	if again, err := a.Storage.GetCreditBalance(a.System.ID); err != nil || *again != *stored {
+		return fmt.Errorf("balance changed when the window was committed twice (%v)", err)
+	}
+	earnings, err := a.Storage.GetCreditEarnings(0)
+	if err != nil {
+		return err
+	}
+	if len(earnings) != 1 || earnings[0].WindowStart != before.LastUpdated || earnings[0].WindowEnd != now.Unix() {
+		return fmt.Errorf("%d earnings rows, want one for the window", len(earnings))
+	}
+
+	// The clock is set back an hour: an empty window, not a negative one
+	back, err := a.DHT.computeCreditCycle(now.Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	if back != nil && (back.input.WindowEnd != now.Unix() || back.result.CreditsEarned != 0 || back.advanced) {
+		return fmt.Errorf("clock set back: window ends %d, earned %.3f", back.input.WindowEnd, back.result.CreditsEarned)
+	}
+	result := NewCreditCalculator().CalculateEarnedCredits(CalculationInput{
+		Attestations:    crashed.input.Attestations,
+		PeerCount:       1,
+		LastCalculation: now.Unix() + 3600,
+		WindowEnd:       now.Unix() + 3600,
+		LongevityStart:  now.Unix() + 7200,
+	})
+	if result.CreditsEarned != 0 || result.BaseCredits != 0 || result.Bonuses.Longevity < 0 {
+		return fmt.Errorf("evidence older than the last calculation earned %.3f (longevity %+.3f)",
+			result.CreditsEarned, result.Bonuses.Longevity)
+	}
+	return nil
+}
+
+// simulateCacheLimit floods a node with made-up systems and checks the cache cap holds
+// them off without costing it its real peers
+func simulateCacheLimit() error {
+	g, err := NewTestGalaxy(4)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub := g.Nodes[0]
+	rt := hub.RoutingTable()
+	rt.SetMaxCachedSystems(1000)
+
+	// A peer verified long ago: evictable, but only after every never-verified system
+	old := &System{ID: uuid.New(), Name: "Old Friend", PeerAddress: "127.0.0.1:2"}
+	old.Stars = assignStarFromClass("K")
+	rt.CacheSystem(old, old.ID, true)
+	rt.cacheMu.Lock()
+	rt.systemCache[old.ID].LastVerified = time.Now().Add(-2 * VerificationCutoff)
+	rt.cacheMu.Unlock()
+
+	flood := func(from uuid.UUID, n int) int {
+		entries := make([]CacheEntry, 0, n)
+		for i := 0; i < n; i++ {
+			sys := &System{ID: uuid.New(), Name: fmt.Sprintf("Fake %d", i), PeerAddress: fmt.Sprintf("10.1.%d.%d:7867", i/250, i%250)}
+			sys.Stars = assignStarFromClass("M")
+			entries = append(entries, CacheEntry{System: sys, LearnedFrom: from})
+		}
+		return rt.CacheSystemsBatch(entries)
+	}
+	realPeersSurvive := func(step string) error {
+		for _, n := range g.Nodes[1:] {
+			if !rt.IsRoutingTablePeer(n.System.ID) {
+				return fmt.Errorf("%s: real peer %s was evicted", step, n.System.Name)
+			}
+		}
+		return nil
+	}
+
+	// One sender gets half the cap an hour, no more
+	flooder := g.Nodes[1].System.ID
+	if added := flood(flooder, 10000); added != 500 {
+		return fmt.Errorf("one sender flooding 10000 systems got %d in, want 500", added)
+	}
+	stats := rt.GetCacheLimitStats()
+	if stats.RefusedIntroductions != 9500 || stats.Evicted != 0 || stats.Size > stats.Max {
+		return fmt.Errorf("after one sender's flood: %+v", stats)
+	}
+	if err := realPeersSurvive("one sender"); err != nil {
+		return err
+	}
+
+	// Several senders together push it over the cap: gossip is evicted, real peers stay
+	for i := 0; i < 3; i++ {
+		flood(uuid.New(), 500)
+	}
+	stats = rt.GetCacheLimitStats()
+	if stats.Size > stats.Max || stats.Evicted == 0 {
+		return fmt.Errorf("after several senders' floods: %+v", stats)
+	}
+	if err := realPeersSurvive("several senders"); err != nil {
+		return err
+	}
+	if rt.GetCachedSystem(old.ID) == nil {
+		return fmt.Errorf("a once-verified system was evicted while never-verified ones were left")
+	}
+	if reported := hub.DHT.NetworkStats().SystemCache; reported.Evicted != stats.Evicted {
+		return fmt.Errorf("stats report %+v, want %+v", reported, stats)
+	}
+
+	// The sender's window closes and it may introduce again
+	rt.cacheMu.Lock()
+	rt.cacheLimit.introductions[flooder].windowStart = time.Now().Add(-IntroductionWindow)
+	rt.cacheMu.Unlock()
+	if added := flood(flooder, 10); added != 10 {
+		return fmt.Errorf("an hour later the sender got %d of 10 in", added)
+	}
+	if stats := rt.GetCacheLimitStats(); stats.Size > stats.Max {
+		return fmt.Errorf("cache over its cap: %+v", stats)
+	}
+	return realPeersSurvive("an hour later")
+}
+
+// simulateService checks what a service manager sees: readiness once bootstrap is done,
+// liveness going bad when the maintenance loop stalls, and the systemd notifications
+func simulateService() error {
+	g, err := NewTestGalaxy(1)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	dht := g.Nodes[0].DHT
+
+	// Stand in for systemd's notify socket
+	socket := filepath.Join(g.dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for k, v := range map[string]string{"NOTIFY_SOCKET": socket, "WATCHDOG_USEC": "100000", "WATCHDOG_PID": ""} {
+		old, had := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if had {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+	notified := func(want string) error {
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("waiting for %s: %w", want, err)
+		}
+		if got := string(buf[:n]); !strings.HasPrefix(got, want) {
+			return fmt.Errorf("systemd was sent %q, want %s", got, want)
+		}
+		return nil
+	}
+
+	if err := g.WaitForConvergence(func() bool { return dht.Liveness(time.Now()).DHTListening }, 2*time.Second); err != nil {
+		return fmt.Errorf("DHT listener never reported up")
+	}
+	if h := dht.Liveness(time.Now()); h.Status != "ok" || h.Health != HealthIsolated.String() {
+		return fmt.Errorf("fresh node liveness is %+v", h)
+	}
+	if h := dht.Readiness(); h.Status != "starting" {
+		return fmt.Errorf("node is %s before bootstrap finished", h.Status)
+	}
+	dht.MarkReady()
+	if err := notified("READY=1"); err != nil {
+		return err
+	}
+	if h := dht.Readiness(); h.Status != "ready" || h.ReadyAt == 0 {
+		return fmt.Errorf("node is %+v after bootstrap finished", h)
+	}
+
+	// A liveness loop that never got going, then one that stopped finishing runs
+	if h := dht.Liveness(time.Now().Add(MaintenanceStallAfter + time.Minute)); h.Status != "unhealthy" || len(h.Problems) != 1 {
+		return fmt.Errorf("a node whose liveness loop never ran is %+v", h)
+	}
+	t := dht.tasks.register(TaskLiveness, every(LivenessTickInterval))
+	t.begin()
+	t.end(0, nil)
+	t.mu.Lock()
+	t.lastEnd = time.Now().Add(-MaintenanceStallAfter - time.Minute)
+	t.mu.Unlock()
+	if h := dht.Liveness(time.Now()); h.Status != "unhealthy" {
+		return fmt.Errorf("a stalled liveness loop leaves the node %+v", h)
+	}
+
+	// The watchdog stays quiet while the node is stuck, pings once it recovers, and
+	// says so when the node stops
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		waitForShutdown(ctx, dht)
+		close(done)
+	}()
+	if err := notified("WATCHDOG=1"); err == nil {
+		cancel()
+		return fmt.Errorf("the watchdog was pinged while the liveness loop was stalled")
+	}
+	t.run(func() (int, error) { return 0, nil })
+	if err := notified("WATCHDOG=1"); err != nil {
+		cancel()
+		return err
+	}
+	cancel()
+	<-done
+	for {
+		if err := notified("WATCHDOG=1"); err != nil {
+			break // Drained the pings sent before the stop
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// The installed command line keeps our flags, with paths that work from anywhere
+	args, err := serviceArgs([]string{"-name", "Sol 50%", "-db", "sol.db", "-install-service", "-data-dir=nodes", "-public-ui"})
+	if err != nil {
+		return err
+	}
+	wd, _ := os.Getwd()
+	want := []string{"-name", "Sol 50%", "-db", filepath.Join(wd, "sol.db"), "-data-dir", filepath.Join(wd, "nodes"), "-public-ui"}
+	if strings.Join(args, "|") != strings.Join(want, "|") {
+		return fmt.Errorf("service args %q, want %q", args, want)
+	}
+	unit := systemdUnit("stellar-lab", "/usr/bin/stellar-lab", args, wd, "ann", []string{"STELLAR_NAME=Sol", "HOME=/root"})
+	for _, line := range []string{"Type=notify", `ExecStart="/usr/bin/stellar-lab" "-name" "Sol 50%%"`, "User=ann",
+		`Environment="STELLAR_NAME=Sol"`, fmt.Sprintf("WatchdogSec=%d", int((2 * MaintenanceStallAfter).Seconds()))} {
+		if !strings.Contains(unit, line) {
+			return fmt.Errorf("unit file is missing %q:\n%s", line, unit)
+		}
+	}
+	if strings.Contains(unit, "HOME=") {
+		return fmt.Errorf("unit file carries over environment beyond STELLAR_ variables:\n%s", unit)
+	}
+	return nil
+}
+
+// simulatePeerConnect connects to a system only known from gossip, as the map's connect
+// panel does, and checks dead, unknown and repeated targets are turned away
+func simulatePeerConnect() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	hub, target := g.Nodes[0], g.Nodes[1]
+	rt := hub.RoutingTable()
+	web := &WebInterface{dht: hub.DHT}
+
+	connect := func(id uuid.UUID) (*httptest.ResponseRecorder, []ConnectProgress) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/peers/connect", strings.NewReader(`{"system_id":"`+id.String()+`"}`))
+		web.handlePeerConnectAPI(rec, req)
+		var lines []ConnectProgress
+		dec := json.NewDecoder(rec.Body)
+		for {
+			var p ConnectProgress
+			if dec.Decode(&p) != nil {
+				break
+			}
+			lines = append(lines, p)
+		}
+		return rec, lines
+	}
+
+	// Heard of through gossip only: pending, and not a peer until we reach it
+	rt.CacheSystem(target.System, uuid.New(), false)
+	if rt.IsRoutingTablePeer(target.System.ID) {
+		return fmt.Errorf("a gossiped system is already in the routing table")
+	}
+	rec, lines := connect(target.System.ID)
+	if rec.Code != http.StatusOK || len(lines) != 2 || lines[0].Stage != "pinging" || lines[0].State != string(PeerPending) {
+		return fmt.Errorf("connecting answered %d with %+v", rec.Code, lines)
+	}
+	if done := lines[1]; done.Stage != "connected" || done.State != string(PeerActive) || !done.InRoutingTable {
+		return fmt.Errorf("connecting ended with %+v", done)
+	}
+	if !rt.IsRoutingTablePeer(target.System.ID) {
+		return fmt.Errorf("the connected system isn't in the routing table")
+	}
+
+	// Trying the same system again within the cooldown is refused without a ping
+	if rec, _ := connect(target.System.ID); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		return fmt.Errorf("a second attempt within the cooldown answered %d", rec.Code)
+	}
+
+	// A dead system fails with sendRequest's error and stays out of the routing table
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	dead := &System{ID: uuid.New(), Name: "Dead", PeerAddress: fmt.Sprintf("127.0.0.1:%d", port)}
+	dead.Stars = assignStarFromClass("M")
+	rt.CacheSystem(dead, uuid.New(), false)
+	rec, lines = connect(dead.ID)
+	if rec.Code != http.StatusOK || len(lines) != 2 || lines[1].Stage != "failed" || lines[1].Error == "" || lines[1].InRoutingTable {
+		return fmt.Errorf("connecting to a dead system answered %d with %+v", rec.Code, lines)
+	}
+	if rec, _ := connect(dead.ID); rec.Code != http.StatusTooManyRequests {
+		return fmt.Errorf("retrying a dead system right away answered %d", rec.Code)
+	}
+
+	// Systems we can't try
+	if rec, _ := connect(uuid.New()); rec.Code != http.StatusNotFound {
+		return fmt.Errorf("an unknown system answered %d", rec.Code)
+	}
+	if rec, _ := connect(hub.System.ID); rec.Code != http.StatusBadRequest {
+		return fmt.Errorf("connecting to ourselves answered %d", rec.Code)
+	}
+	return nil
+}
+
+// simulateMessages: A writes to B through the web API and B finds it in its inbox, once
+// even when A's retry repeats it. The sealed text opens only for B, and only as A's.
+// B takes MessagesPerSenderDay from A and refuses the next without a retry; a sender B
+// blocked gets no retries either. A message to a stopped node is retried on schedule
+// and then marked undelivered
+func simulateMessages() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub, a, b := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+	webA := &WebInterface{dht: a.DHT, storage: a.Storage}
+	webB := &WebInterface{dht: b.DHT, storage: b.Storage}
+
+	// The converted public key is the one the converted private key has
+	pub, err := x25519PublicKey(b.System.Keys.PublicKey)
+	if err != nil {
+		return err
+	}
+	priv, err := x25519PrivateKey(b.System.Keys.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if !pub.Equal(priv.PublicKey()) {
+		return fmt.Errorf("ed25519 to X25519 conversion disagrees between public and private key")
+	}
+
+	rec := httptest.NewRecorder()
+	webA.handleMessagesAPI(rec, httptest.NewRequest(http.MethodPost, "/api/messages",
+		strings.NewReader(`{"to_system_id":"`+b.System.ID.String()+`","body":"Hello from A"}`)))
+	var sent Message
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &sent) != nil || sent.Status != MessageDelivered || sent.Attempts != 1 {
+		return fmt.Errorf("sending answered %d: %s", rec.Code, rec.Body)
+	}
+
+	inbox := func() MessagesPage {
+		var page MessagesPage
+		rec := httptest.NewRecorder()
+		webB.handleMessagesAPI(rec, httptest.NewRequest(http.MethodGet, "/api/messages?box=inbox", nil))
+		json.Unmarshal(rec.Body.Bytes(), &page)
+		return page
+	}
+	page := inbox()
+	if page.Total != 1 || page.Unread != 1 || page.Messages[0].Body != "Hello from A" || page.Messages[0].PeerID != a.System.ID || page.Messages[0].Read {
+		return fmt.Errorf("B's inbox: %+v", page)
+	}
+
+	// A retry whose answer got lost is acknowledged again, not stored twice
+	sealed, err := sealMessage("Hello from A", a.System.ID, b.System.ID, b.System.Keys.PublicKey, sent.ID, sent.SentAt)
+	if err != nil {
+		return err
+	}
+	msg, err := NewMessageRequest(a.System, b.System.ID, sealed, "")
+	if err != nil {
+		return err
+	}
+	if _, err := a.DHT.sendRequest(b.Address, msg); err != nil {
+		return fmt.Errorf("repeating a message: %w", err)
+	}
+	if page := inbox(); page.Total != 1 {
+		return fmt.Errorf("a repeated message was stored %d times", page.Total)
+	}
+
+	// Only B opens it, and only as A's
+	if _, err := openMessage(sealed, a.System.ID, b.System.ID, a.System.Keys.PrivateKey); err == nil {
+		return fmt.Errorf("the sender's key opened a message sealed to B")
+	}
+	if _, err := openMessage(sealed, hub.System.ID, b.System.ID, b.System.Keys.PrivateKey); err == nil {
+		return fmt.Errorf("a message opened as another sender's")
+	}
+
+	rec = httptest.NewRecorder()
+	webB.handleMessagesReadAPI(rec, httptest.NewRequest(http.MethodPost, "/api/messages/read", strings.NewReader(`{}`)))
+	if page := inbox(); rec.Code != http.StatusOK || page.Unread != 0 || !page.Messages[0].Read {
+		return fmt.Errorf("marking read answered %d, inbox %+v", rec.Code, page)
+	}
+
+	// The daily limit: the rest of A's allowance arrives, the next one is refused for good
+	for i := 1; i < MessagesPerSenderDay; i++ {
+		if m, err := a.DHT.SendMessage(b.System.ID, fmt.Sprintf("message %d", i)); err != nil || m.Status != MessageDelivered {
+			return fmt.Errorf("message %d within the limit: %+v, %v", i, m, err)
+		}
+	}
+	over, err := a.DHT.SendMessage(b.System.ID, "one too many")
+	if err != nil || over.Status != MessageUndelivered || over.Attempts != 1 || !strings.Contains(over.LastError, "daily limit") {
+		return fmt.Errorf("a message over the limit: %+v, %v", over, err)
+	}
+	if page := inbox(); page.Total != MessagesPerSenderDay || page.Unread != MessagesPerSenderDay-1 {
+		return fmt.Errorf("B's inbox after the limit holds %d (%d unread)", page.Total, page.Unread)
+	}
+
+	// Blocked, either way round
+	if _, err := b.DHT.BlockSystem(hub.System.ID, "no messages", 0); err != nil {
+		return err
+	}
+	if m, err := hub.DHT.SendMessage(b.System.ID, "let me in"); err != nil || m.Status != MessageUndelivered || m.Attempts != 1 {
+		return fmt.Errorf("a message to a system that blocked us: %+v, %v", m, err)
+	}
+	if _, err := b.DHT.SendMessage(hub.System.ID, "hi"); !errors.Is(err, ErrMessageBlocked) {
+		return fmt.Errorf("messaging a blocked system: %v", err)
+	}
+
+	// Offline: each retry comes due after its delay, then it's given up on
+	defer func(delays []time.Duration) { messageRetryDelays = delays }(messageRetryDelays)
+	messageRetryDelays = []time.Duration{time.Minute, time.Hour}
+	b.Stop()
+	m, err := a.DHT.SendMessage(b.System.ID, "are you there?")
+	if err != nil || m.Status != MessagePending || m.LastError == "" {
+		return fmt.Errorf("a message to a stopped node: %+v, %v", m, err)
+	}
+	now := time.Now()
+	if n, err := a.DHT.deliverDueMessages(now); err != nil || n != 0 {
+		return fmt.Errorf("%d messages retried before their delay (%v)", n, err)
+	}
+	for i, after := range []time.Duration{time.Minute, time.Minute + time.Hour} {
+		if n, err := a.DHT.deliverDueMessages(now.Add(after + time.Second)); err != nil || n != 1 {
+			return fmt.Errorf("retry %d attempted %d messages (%v)", i+1, n, err)
+		}
+	}
+	sentBox, _, err := a.Storage.GetMessages(MessageSent, 1, 0)
+	if err != nil {
+		return err
+	}
+	if got := sentBox[0]; got.ID != m.ID || got.Status != MessageUndelivered || got.Attempts != 3 || got.NextAttempt != 0 {
+		return fmt.Errorf("after its retries the message is %+v", got)
+	}
+	if n, _ := a.DHT.deliverDueMessages(now.Add(24 * time.Hour)); n != 0 {
+		return fmt.Errorf("an undelivered message was tried again")
+	}
+	return nil
+}
+
+// simulateGhostGossip: five peers still list a node that went offline. The observer
+// caches it from their FIND_NODE answers but never lets it into its routing table;
+// a lookup that turns it up pings it, and that ping fails
+func simulateGhostGossip() error {
+	g, err := NewTestGalaxy(7)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, ghost := g.Nodes[0], g.Nodes[6]
+	for i := 1; i <= 5; i++ {
+		if err := g.Connect(i, 6); err != nil {
+			return err
+		}
+	}
+	ghost.Stop()
+	for i := 1; i <= 5; i++ {
+		if err := g.Connect(0, i); err != nil {
+			return err
+		}
+	}
+
+	rt := a.RoutingTable()
+	for i := 1; i <= 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), RequestTimeout)
+		nodes, err := a.DHT.findNodeDirect(ctx, g.Nodes[i].System, ghost.System.ID)
+		cancel()
+		if err != nil {
+			return err
+		}
+		listed := false
+		for _, sys := range nodes {
+			listed = listed || sys.ID == ghost.System.ID
+		}
+		if !listed {
+			return fmt.Errorf("node %d didn't list the ghost", i)
+		}
+		if rt.IsRoutingTablePeer(ghost.System.ID) {
+			return fmt.Errorf("the ghost joined node 0's routing table on node %d's word", i)
+		}
+	}
+	status := rt.GetCachedSystemStatus(ghost.System.ID)
+	if status == nil || status.State != string(PeerPending) {
+		return fmt.Errorf("the gossiped ghost is cached as %+v, want pending", status)
+	}
+
+	// The lookup finds it through a peer and stops there, leaving it to a verification ping
+	if result := a.DHT.findNode(ghost.System.ID, false); result.Found == nil {
+		return fmt.Errorf("the lookup didn't turn up the ghost")
+	}
+	err = g.WaitForConvergence(func() bool {
+		status := rt.GetCachedSystemStatus(ghost.System.ID)
+		return status != nil && status.FailCount > 0
+	}, SimulationTimeout)
+	if err != nil {
+		return fmt.Errorf("the ghost was never pinged: %w", err)
+	}
+	if rt.IsRoutingTablePeer(ghost.System.ID) {
+		return fmt.Errorf("the ghost is in node 0's routing table without answering a ping")
+	}
+	return nil
+}
+
+// simulateStatsAPI: /api/stats sends every StatsResponse field with the same JSON type
+// whether or not the node is public, agrees with the index page, and still serves the
+// old map with ?legacy=1
+func simulateStatsAPI() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.ConnectStar(0); err != nil {
+		return err
+	}
+	hub := g.Nodes[0]
+
+	get := func(web *WebInterface, query string) (map[string]interface{}, error) {
+		rec := httptest.NewRecorder()
+		web.handleStatsAPI(rec, httptest.NewRequest(http.MethodGet, "/api/stats"+query, nil))
+		var fields map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&fields); err != nil {
+			return nil, fmt.Errorf("/api/stats%s: %v", query, err)
+		}
+		return fields, nil
+	}
+	schema, err := json.Marshal(StatsResponse{})
+	if err != nil {
+		return err
+	}
+	var want map[string]interface{}
+	if err := json.Unmarshal(schema, &want); err != nil {
+		return err
+	}
+
+	private := &WebInterface{dht: hub.DHT, storage: hub.Storage}
+	public := &WebInterface{dht: hub.DHT, storage: hub.Storage, public: true}
+	for _, web := range []*WebInterface{private, public} {
+		got, err := get(web, "")
+		if err != nil {
+			return err
+		}
+		for key, zero := range want {
+			v, ok := got[key]
+			if !ok {
+				return fmt.Errorf("/api/stats (public: %v) has no %s", web.public, key)
+			}
+			if fmt.Sprintf("%T", v) != fmt.Sprintf("%T", zero) && zero != nil {
+				return fmt.Errorf("/api/stats (public: %v) sends %s as %T, want %T", web.public, key, v, zero)
+			}
+		}
+		if len(got) != len(want) {
+			return fmt.Errorf("/api/stats (public: %v) sends %d fields, want %d", web.public, len(got), len(want))
+		}
+		if got["schema_version"] != float64(StatsSchemaVersion) || got["generated_at"].(float64) == 0 {
+			return fmt.Errorf("/api/stats is schema %v, generated at %v", got["schema_version"], got["generated_at"])
+		}
+		if web.public && (got["local_id"] != "" || got["attestation_count"] != float64(0)) {
+			return fmt.Errorf("public /api/stats gives away local_id %v and attestation_count %v", got["local_id"], got["attestation_count"])
+		}
+	}
+
+	stats, data := private.collectStats(), private.buildTemplateData()
+	if data.AttestationCount != stats.AttestationCount || data.DatabaseSize != stats.DatabaseSize ||
+		data.MaxPeers != stats.MaxPeers || data.TotalSystems != stats.TotalSystems || data.RoutingTableSize != stats.RoutingTableSize {
+		return fmt.Errorf("the index page shows %+v, /api/stats %+v", data, stats)
+	}
+
+	legacy, err := get(private, "?legacy=1")
+	if err != nil {
+		return err
+	}
+	if _, ok := legacy["schema_version"]; ok || legacy["verified_peers"] != float64(stats.RoutingTableSize) {
+		return fmt.Errorf("?legacy=1 isn't the old map: %v", legacy)
+	}
+	if legacy, err = get(public, "?legacy=1"); err != nil {
+		return err
+	}
+	if _, ok := legacy["attestation_count"]; ok {
+		return fmt.Errorf("public ?legacy=1 has attestation_count")
+	}
+	return nil
+}
+
+// simulateFingerprintSalt: a seeded UUID made before salting existed comes out the same
+// after the upgrade, and a database from then keeps its system and gets no salt. A salted
+// UUID is stable on its install and differs from the unsalted one and another install's,
+// and the log's fingerprint hash doesn't give the fingerprint away
+func simulateFingerprintSalt() error {
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	open := func(name string) (*Storage, error) { return NewStorage(filepath.Join(dir, name)) }
+
+	// The derivation before salting: SHA-256 of the seed and fingerprint, as a version 5 UUID
+	sum := sha256.Sum256([]byte("seed" + GetHardwareFingerprint()))
+	var before uuid.UUID
+	copy(before[:], sum[:16])
+	before[6] = (before[6] & 0x0f) | 0x50
+	before[8] = (before[8] & 0x3f) | 0x80
+
+	old, err := open("old.db")
+	if err != nil {
+		return err
+	}
+	id, err := newSystemID(old, "seed", false)
+	if err != nil || id != before {
+		old.Close()
+		return fmt.Errorf("unsalted seeded UUID %s (%v), want %s as before", id, err, before)
+	}
+	keys, err := GenerateKeyPair()
+	if err != nil {
+		old.Close()
+		return err
+	}
+	sys := &System{ID: id, Name: "Old", CreatedAt: time.Now(), LastSeenAt: time.Now(), Keys: keys}
+	sys.GenerateMultiStarSystem()
+	if err := old.SaveSystem(sys); err != nil {
+		old.Close()
+		return err
+	}
+	// As it was before the upgrade: no salt table
+	_, err = old.db.Exec("DROP TABLE install_salt")
+	old.Close()
+	if err != nil {
+		return err
+	}
+
+	upgraded, err := open("old.db")
+	if err != nil {
+		return err
+	}
+	loaded, err := upgraded.LoadSystem()
+	if err != nil || loaded.ID != before {
+		upgraded.Close()
+		return fmt.Errorf("after the upgrade the system is %v (%v), want %s", loaded, err, before)
+	}
+	salt, err := upgraded.InstallSalt()
+	upgraded.Close()
+	if err != nil || salt != "" {
+		return fmt.Errorf("the upgrade made a salt %q (%v) for an existing system", salt, err)
+	}
+
+	var salted [2]uuid.UUID
+	for i, name := range []string{"a.db", "b.db"} {
+		s, err := open(name)
+		if err != nil {
+			return err
+		}
+		first, err := newSystemID(s, "seed", true)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		again, err := newSystemID(s, "seed", true)
+		s.Close()
+		if err != nil || again != first {
+			return fmt.Errorf("install %s salted the same seed to %s, then %s (%v)", name, first, again, err)
+		}
+		if first == before {
+			return fmt.Errorf("the salted UUID is the unsalted one")
+		}
+		salted[i] = first
+	}
+	if salted[0] == salted[1] {
+		return fmt.Errorf("two installs salted the same seed to the same UUID")
+	}
+
+	fingerprint := GetHardwareFingerprint()
+	if digest := fingerprintDigest(fingerprint); len(digest) != 8 || strings.Contains(fingerprint, digest) {
+		return fmt.Errorf("the logged fingerprint hash %q gives away %q", digest, fingerprint)
+	}
+	return nil
+}
+
+// simulateCreditVerify: a credit cycle over a 10,000-attestation window, timed the old way
+// (every signature checked again) and the new way (trusting the verified column). Both
+// earn the same, a forged attestation is left out by the query, and the verification cache
+// answers a repeat check but not a valid signature copied onto other fields
+func simulateCreditVerify() error {
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStorage(filepath.Join(dir, "credits.db"))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	const window, peers = 10000, 20
+	local := uuid.New()
+	start := time.Now().Add(-7 * 24 * time.Hour).Unix()
+	batch := make([]PendingAttestation, 0, window+1)
+	for p := 0; p < peers; p++ {
+		keys, err := GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		from := uuid.New()
+		for i := p; i < window; i += peers {
+			a := SignAttestation(from, local, "ping", keys.PrivateKey, keys.PublicKey)
+			a.Timestamp = start + int64(i)*60
+			a.addNonce(keys.PrivateKey)
+			batch = append(batch, PendingAttestation{Attestation: a, ReceivedBy: local, ReceivedAt: a.Timestamp})
+		}
+	}
+	forged := *batch[0].Attestation
+	forged.Timestamp += 30
+	forged.Nonce = "forged"
+	batch = append(batch, PendingAttestation{Attestation: &forged, ReceivedBy: local, ReceivedAt: forged.Timestamp})
+	if _, err := s.SaveAttestationsBatch(batch); err != nil {
+		return err
+	}
+
+	all := make([]*Attestation, len(batch))
+	for i, p := range batch {
+		all[i] = p.Attestation
+	}
+	input := func(atts []*Attestation) CalculationInput {
+		return CalculationInput{Attestations: atts, PeerCount: peers, LastCalculation: start - 1, GalaxySize: peers + 1}
+	}
+	calc := NewCreditCalculator()
+
+	// Before: the window came back unfiltered and every signature was checked again
+	began := time.Now()
+	var checked []*Attestation
+	for _, a := range all {
+		if a.Verify() {
+			checked = append(checked, a)
+		}
+	}
+	before := calc.CalculateEarnedCredits(input(checked))
+	beforeTook := time.Since(began)
+
+	// After: the query returns only rows verified when they were saved
+	began = time.Now()
+	stored, err := s.GetAttestationsSince(local, start-1)
+	if err != nil {
+		return err
+	}
+	after := calc.CalculateEarnedCredits(input(stored))
+	afterTook := time.Since(began)
+
+	log.Printf("Credit cycle over %d attestations: %v re-verifying them, %v trusting the verified column",
+		window, beforeTook.Round(time.Millisecond), afterTook.Round(time.Millisecond))
+	if len(stored) != window {
+		return fmt.Errorf("the window has %d verified attestations, want %d (the forged one left out)", len(stored), window)
+	}
+	if math.Abs(before.CreditsEarned-after.CreditsEarned) > 1e-9 || after.CreditsEarned <= 0 {
+		return fmt.Errorf("earned %.4f trusting the column, %.4f re-verifying", after.CreditsEarned, before.CreditsEarned)
+	}
+	if afterTook >= beforeTook {
+		return fmt.Errorf("trusting the column took %v, no faster than re-verifying (%v)", afterTook, beforeTook)
+	}
+
+	a := stored[len(stored)-1]
+	a.VerifyCached()
+	hits, _ := attestationVerifications.stats()
+	if !a.VerifyCached() {
+		return fmt.Errorf("a valid attestation failed its cached check")
+	}
+	if again, _ := attestationVerifications.stats(); again != hits+1 {
+		return fmt.Errorf("checking an attestation again missed the cache")
+	}
+	copied := *a
+	copied.MessageType = "announce"
+	if copied.VerifyCached() {
+		return fmt.Errorf("a valid signature copied onto another message type passed the cached check")
+	}
+	return nil
+}
+
+// simulateDiagnostics: a new node whose only seed is down is told no seed answered and,
+// once it's been up a while without inbound requests, that its port looks closed. After
+// joining through a live seed both findings clear, and rejections of its own info and a
+// clock peers agree is off are explained. Only the latest MaxDiagnosticEvents are kept
+func simulateDiagnostics() error {
+	g, err := NewTestGalaxy(3)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	a, b, c := g.Nodes[0], g.Nodes[1], g.Nodes[2]
+
+	finding := func(title string) (DiagnosticFinding, error) {
+		report, err := c.DHT.Diagnostics()
+		if err != nil {
+			return DiagnosticFinding{}, err
+		}
+		for _, f := range report.Findings {
+			if strings.HasPrefix(f.Title, title) {
+				return f, nil
+			}
+		}
+		return DiagnosticFinding{}, fmt.Errorf("no %q finding in %+v", title, report.Findings)
+	}
+
+	notIsolated := false
+	saved := isolatedMode
+	isolatedMode = &notIsolated
+	defer func() { isolatedMode = saved }()
+	config := DefaultBootstrapConfig()
+	config.SeedNodes = []SeedNode{{Address: "127.0.0.1:1", Source: SeedSourceHardcoded}}
+	if err := c.DHT.Bootstrap(config); err != nil {
+		return err
+	}
+	f, err := finding("Couldn't reach any seed")
+	if err != nil {
+		return err
+	}
+	if f.Severity != FindingProblem || !strings.Contains(f.Detail, "127.0.0.1:1") || f.Advice == "" {
+		return fmt.Errorf("unreachable seed finding is %+v", f)
+	}
+
+	// Ten minutes in with nobody having contacted it
+	c.DHT.startTime = c.DHT.startTime.Add(-InboundWarningDelay)
+	c.DHT.checkInboundStatus()
+	if f, err = finding("No other node has connected"); err != nil {
+		return err
+	}
+	if f.Severity != FindingProblem || !strings.Contains(f.Detail, c.DHT.portMappingStatus()) {
+		return fmt.Errorf("closed port finding is %+v", f)
+	}
+
+	config.SeedNodes = []SeedNode{{Address: a.Address, Source: SeedSourceHardcoded}}
+	if err := c.DHT.Bootstrap(config); err != nil {
+		return err
+	}
+	if _, err := b.DHT.Ping(c.Address); err != nil {
+		return err
+	}
+	for _, title := range []string{"Reached the network", "Sponsor chosen", "Other nodes can reach this one"} {
+		if f, err = finding(title); err != nil {
+			return err
+		}
+		if f.Severity != FindingOK {
+			return fmt.Errorf("%q is %s after joining", title, f.Severity)
+		}
+	}
+	if _, err := finding("Couldn't reach any seed"); err == nil {
+		return fmt.Errorf("the unreachable seed is still reported after joining")
+	}
+
+	// Two peers refuse our attestations, and both clocks are ten minutes ahead of ours
+	for _, peer := range []*TestNode{a, b} {
+		if c.RoutingTable().GetCachedSystem(peer.System.ID) == nil {
+			return fmt.Errorf("C doesn't know %s", peer.System.Name)
+		}
+		c.DHT.recordRejection(peer.System.ID, &DHTError{Code: ErrCodeInvalidAttestation,
+			Message: "attestation timestamp is 10m0s off your clock's usual 0s skew"})
+		for i := 0; i < ClockSkewSamples; i++ {
+			c.DHT.clockSkews.observe(peer.System.ID, 10*time.Minute)
+		}
+	}
+	if f, err = finding("Peers are rejecting this node's own info"); err != nil {
+		return err
+	}
+	if !strings.Contains(f.Advice, "NTP") {
+		return fmt.Errorf("a timestamp rejection advises %q", f.Advice)
+	}
+	if f, err = finding("This machine's clock is about 10 minutes behind"); err != nil {
+		return err
+	}
+
+	rec := httptest.NewRecorder()
+	(&WebInterface{dht: c.DHT, storage: c.Storage}).handleDiagnosticsAPI(rec, httptest.NewRequest(http.MethodGet, "/api/diagnostics", nil))
+	var report DiagnosticsReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		return fmt.Errorf("/api/diagnostics: %v", err)
+	}
+	inbound := 0
+	for _, e := range report.Events {
+		if e.Stage == DiagInbound && e.OK {
+			inbound++
+		}
+	}
+	if report.Health == "" || len(report.Findings) == 0 || inbound != 1 {
+		return fmt.Errorf("/api/diagnostics gave %s health, %d findings, %d first inbound events",
+			report.Health, len(report.Findings), inbound)
+	}
+
+	for i := 0; i < MaxDiagnosticEvents; i++ {
+		c.DHT.diagnose(DiagAnnounce, true, "Announced to %d of 3 closest nodes", i)
+	}
+	events, err := c.Storage.GetDiagnosticEvents()
+	if err != nil {
+		return err
+	}
+	if len(events) != MaxDiagnosticEvents || events[0].Message != "Announced to 0 of 3 closest nodes" {
+		return fmt.Errorf("kept %d events from %q, want the latest %d", len(events), events[0].Message, MaxDiagnosticEvents)
+	}
+	return nil
+}
+
+// simulateOperatorProfile: A's signed profile reaches B when it joins and is stored.
+// Info relayed without it, or with a record B's key signed, leaves it as it was; hostile
+// fields and non-http links are refused. A public-mode UI hides it once marked private,
+// and an emptied profile clears it everywhere, where none was ever set sends nothing
+func simulateOperatorProfile() error {
+	g, err := NewTestGalaxy(2)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	a, b := g.Nodes[0], g.Nodes[1]
+
+	a.System.BumpInfoVersion()
+	if err := a.System.SetOperatorProfile(NewOperatorProfile(" @sargonas ", "Runs a node in a closet", "https://example.com/about", true)); err != nil {
+		return err
+	}
+	if err := g.Connect(1, 0); err != nil {
+		return err
+	}
+	if _, err := a.DHT.Ping(b.System.PeerAddress); err != nil { // B binds A's key
+		return err
+	}
+	cached := b.RoutingTable().GetCachedSystem(a.System.ID)
+	if cached == nil || cached.Profile == nil || cached.Profile.Handle != "sargonas" || cached.Profile.URL != "https://example.com/about" {
+		return fmt.Errorf("B's copy of A has profile %+v", cached.Profile)
+	}
+	if stored, err := b.Storage.GetPeerSystem(a.System.ID); err != nil || stored.Profile == nil || !stored.Profile.Private {
+		return fmt.Errorf("B didn't store A's profile (%v)", err)
+	}
+
+	// Newer info relayed by a node that doesn't know profiles keeps the one cached
+	relayed := *a.System
+	relayed.Profile = nil
+	relayed.BumpInfoVersion()
+	b.RoutingTable().CacheSystem(&relayed, uuid.New(), false)
+	if p := b.RoutingTable().GetCachedSystem(a.System.ID).Profile; p == nil || p.Handle != "sargonas" {
+		return fmt.Errorf("info relayed without a profile cleared it")
+	}
+	if err := b.Storage.SavePeerSystem(&relayed); err != nil {
+		return err
+	}
+	if stored, err := b.Storage.GetPeerSystem(a.System.ID); err != nil || stored.Profile == nil {
+		return fmt.Errorf("saving info without a profile cleared the stored one (%v)", err)
+	}
+
+	// A newer profile signed by someone else is dropped
+	forged := relayed
+	forged.Profile = &OperatorProfile{SystemID: a.System.ID, Handle: "impostor", Version: time.Now().UnixMilli() + 1000}
+	forged.Profile.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(b.System.Keys.PrivateKey, forged.Profile.signableMessage()))
+	forged.BumpInfoVersion()
+	b.RoutingTable().CacheSystem(&forged, uuid.New(), false)
+	if p := b.RoutingTable().GetCachedSystem(a.System.ID).Profile; p == nil || p.Handle != "sargonas" {
+		return fmt.Errorf("B took a profile A never signed")
+	}
+
+	hostile := []*OperatorProfile{
+		{Handle: "two words"},
+		{Handle: "<b>"},
+		{Bio: "<script>alert(1)</script>"},
+		{Bio: strings.Repeat("x", MaxProfileBioLength+1)},
+		{Bio: "bidi \u202e"},
+		{URL: "javascript:alert(1)"},
+		{URL: "https://example.com/\"onmouseover=\"x"},
+		{URL: "ftp://example.com"},
+		{URL: "https:///nohost"},
+	}
+	for _, p := range hostile {
+		if CheckOperatorProfile(p) == nil {
+			return fmt.Errorf("profile %+v passed the checks", *p)
+		}
+	}
+
+	// Private profiles are for the operator's own UI
+	if visibleProfile(cached, true).Profile != nil || visibleProfile(cached, false).Profile == nil {
+		return fmt.Errorf("public mode didn't hide a private profile")
+	}
+
+	// Taking the flags away sends a signed empty record that clears it, and keeps it cleared
+	a.System.InfoVersion = forged.InfoVersion // Versions move on from the copies above
+	a.System.BumpInfoVersion()
+	if err := a.System.SetOperatorProfile(NewOperatorProfile("", "", "", false)); err != nil {
+		return err
+	}
+	if a.System.Profile == nil || !a.System.Profile.IsEmpty() {
+		return fmt.Errorf("emptied profile gave %+v, want a clearing record", a.System.Profile)
+	}
+	if err := a.Storage.SaveSystem(a.System); err != nil {
+		return err
+	}
+	b.RoutingTable().CacheSystem(a.System, a.System.ID, true)
+	if p := b.RoutingTable().GetCachedSystem(a.System.ID).Profile; p == nil || !p.IsEmpty() {
+		return fmt.Errorf("the clearing record didn't clear B's copy: %+v", p)
+	}
+	if local, err := a.Storage.LoadSystem(); err != nil || local.Profile == nil || !local.Profile.IsEmpty() {
+		return fmt.Errorf("A didn't keep its cleared profile (%v)", err)
+	}
+
+	// A system that never had a profile doesn't start sending one
+	b.System.BumpInfoVersion()
+	if err := b.System.SetOperatorProfile(NewOperatorProfile("", "", "", true)); err != nil || b.System.Profile != nil {
+		return fmt.Errorf("a system without a profile got %+v (%v)", b.System.Profile, err)
+	}
+	return nil
+}
+
+// simulateVersionMatrix: Versions parse in every form peers send them, order the way semver
+// orders them (numerically, pre-releases before their release), and the capabilities inferred
+// for peers too old to list theirs switch on at exactly the versions that introduced them
+func simulateVersionMatrix() error {
+	for in, want := range map[string]ProtocolVersion{
+		"1.10.0":          {Major: 1, Minor: 10},
+		"v1.10.0-rc.1":    {Major: 1, Minor: 10, Pre: "rc.1"},
+		"1.10.0+build.5":  {Major: 1, Minor: 10},
+		"1.10":            {Major: 1, Minor: 10},
+		" v2.0.1-beta.2 ": {Major: 2, Patch: 1, Pre: "beta.2"},
+		"1.2.3-rc.1+sha":  {Major: 1, Minor: 2, Patch: 3, Pre: "rc.1"},
+	} {
+		got, err := ParseProtocolVersion(in)
+		if err != nil {
+			return fmt.Errorf("parsing %q: %w", in, err)
+		}
+		if got != want {
+			return fmt.Errorf("parsing %q gave %+v, want %+v", in, got, want)
+		}
+	}
+	for _, in := range []string{"", "dev", "1", "1.2.3.4", "1.x.0", "1.-2.0", "1.2.0-", "a.b.c"} {
+		if v, err := ParseProtocolVersion(in); err == nil {
+			return fmt.Errorf("parsing %q gave %s, want an error", in, v)
+		}
+	}
+
+	// Oldest first; every pair must compare by position
+	ordered := []string{
+		"0.9.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.2.0", "1.9.0",
+		"1.9.10", "1.10.0-rc.1", "1.10.0", "1.10.1", "2.0.0",
+	}
+	versions := make([]ProtocolVersion, len(ordered))
+	for i, s := range ordered {
+		v, err := ParseProtocolVersion(s)
+		if err != nil {
+			return fmt.Errorf("parsing %q: %w", s, err)
+		}
+		versions[i] = v
+	}
+	for i, a := range versions {
+		for j, b := range versions {
+			if got := a.Compare(b); got != sign(i-j) {
+				return fmt.Errorf("%s compared with %s gave %d, want %d", a, b, got, sign(i-j))
+			}
+			if a.IsNewerThan(b) != (i > j) {
+				return fmt.Errorf("%s newer than %s: %v, want %v", a, b, a.IsNewerThan(b), i > j)
+			}
+			if want := a.Major == b.Major; a.IsCompatibleWith(b) != want {
+				return fmt.Errorf("%s compatible with %s: %v, want %v", a, b, !want, want)
+			}
+		}
+	}
+	for _, same := range [][2]string{{"v1.10.0", "1.10"}, {"1.10.0+build.5", "1.10.0+build.9"}, {"1.10.0-rc.1", "v1.10.0-rc.1+x"}} {
+		a, _ := ParseProtocolVersion(same[0])
+		b, _ := ParseProtocolVersion(same[1])
+		if a.Compare(b) != 0 {
+			return fmt.Errorf("%s and %s should compare equal", same[0], same[1])
+		}
+	}
+
+	for _, c := range []struct {
+		version string
+		has     []Capability
+		lacks   []Capability
+	}{
+		{"1.5.9", nil, []Capability{CapTargetedAttestation, CapFullSync, CapSignedInfo}},
+		{"1.6.0-rc.1", nil, []Capability{CapTargetedAttestation}},
+		{"1.6.0", []Capability{CapTargetedAttestation}, []Capability{CapFullSync, CapSignedInfo}},
+		{"1.9.0", []Capability{CapTargetedAttestation, CapFullSync}, []Capability{CapSignedInfo}},
+		{"1.9.10", []Capability{CapTargetedAttestation, CapFullSync}, []Capability{CapSignedInfo}},
+		{"1.10.0-rc.1", []Capability{CapFullSync}, []Capability{CapSignedInfo}},
+		{"1.10.0", []Capability{CapTargetedAttestation, CapFullSync, CapSignedInfo}, []Capability{CapInfoVersion, CapGzip}},
+		{"v2.0.0+build.1", []Capability{CapTargetedAttestation, CapFullSync, CapSignedInfo}, []Capability{CapMessages}},
+		{"dev", nil, []Capability{CapTargetedAttestation, CapFullSync, CapSignedInfo}},
+	} {
+		caps := legacyCapabilities(c.version)
+		for _, want := range c.has {
+			if !caps.Has(want) {
+				return fmt.Errorf("version %s should imply %v, got %v", c.version, Capabilities(want).Names(), caps.Names())
+			}
+		}
+		for _, unwanted := range c.lacks {
+			if caps.Has(unwanted) {
+				return fmt.Errorf("version %s should not imply %v, got %v", c.version, Capabilities(unwanted).Names(), caps.Names())
+			}
+		}
+	}
+
+	// A listed set wins over the version, and names round-trip
+	msg := &DHTMessage{Version: "1.10.0", Capabilities: []string{"gzip", "no-such-capability"}}
+	if caps := msg.PeerCapabilities(); caps != Capabilities(CapGzip) {
+		return fmt.Errorf("listed capabilities gave %v, want [gzip]", caps.Names())
+	}
+	if got := ParseCapabilities(LocalCapabilities.Names()); got != LocalCapabilities {
+		return fmt.Errorf("capability names don't round-trip: %v", got.Names())
+	}
+	return nil
+}
+
+// simulateSQLiteContention: attestation flushes and single writes hammer one database for
+// two seconds while the stats, credit and paging reads the web UI and credit cycle run go
+// on alongside. None of them may fail with SQLITE_BUSY ("database is locked"), every write
+// must land, and a read issued while a write transaction holds the lock is answered from the
+// last commit instead of waiting for it
+func simulateSQLiteContention() error {
+	dir, err := os.MkdirTemp("", "stellar-sim-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewStorage(filepath.Join(dir, "stellar-lab.db"))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	local := uuid.New()
+	peers := make([]*KeyPair, 20)
+	peerIDs := make([]uuid.UUID, len(peers))
+	for i := range peers {
+		if peers[i], err = GenerateKeyPair(); err != nil {
+			return err
+		}
+		peerIDs[i] = uuid.New()
+	}
+	attest := func(i int) *Attestation {
+		k := peers[i%len(peers)]
+		a := SignAttestation(peerIDs[i%len(peers)], local, "ping", k.PrivateKey, k.PublicKey)
+		a.addNonce(k.PrivateKey)
+		return a
+	}
+
+	var (
+		mu       sync.Mutex
+		failures []error
+		written  int64
+		reads    int64
+	)
+	fail := func(what string, err error) {
+		if strings.Contains(err.Error(), "locked") || strings.Contains(err.Error(), "busy") {
+			err = fmt.Errorf("SQLITE_BUSY: %w", err)
+		}
+		mu.Lock()
+		failures = append(failures, fmt.Errorf("%s: %w", what, err))
+		mu.Unlock()
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	// Four buffers flushing a batch every 20ms, as attestation_buffer.go does under load
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(20 * time.Millisecond):
+				}
+				batch := make([]PendingAttestation, AttestationBatchSize)
+				for i := range batch {
+					batch[i] = PendingAttestation{Attestation: attest(w + i), ReceivedBy: local, ReceivedAt: time.Now().Unix()}
+				}
+				replayed, err := s.SaveAttestationsBatch(batch)
+				if err != nil {
+					fail("batch flush", err)
+					return
+				}
+				atomic.AddInt64(&written, int64(len(batch)-replayed))
+			}
+		}(w)
+	}
+	// Two writers saving one at a time, as when the buffer is bypassed
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := s.SaveAttestation(attest(w+i), local); err != nil {
+					fail("single save", err)
+					return
+				}
+				atomic.AddInt64(&written, 1)
+			}
+		}(w)
+	}
+	// Readers: the stats endpoint, the credit cycle and the attestation browser
+	readers := []struct {
+		what string
+		read func() error
+	}{
+		{"database stats", func() error { _, err := s.GetDatabaseStats(); return err }},
+		{"database size", func() error { _, err := s.GetDatabaseSize(); return err }},
+		{"attestation count", func() error { _, err := s.GetAttestationCount(local); return err }},
+		{"attestations since", func() error {
+			_, err := s.GetAttestationsSince(local, time.Now().Add(-time.Minute).Unix())
+			return err
+		}},
+		{"attestation page", func() error {
+			_, _, err := s.GetAttestationsPaged(AttestationQuery{Limit: 50})
+			return err
+		}},
+	}
+	for _, r := range readers {
+		wg.Add(1)
+		go func(what string, read func() error) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := read(); err != nil {
+					fail(what, err)
+					return
+				}
+				atomic.AddInt64(&reads, 1)
+			}
+		}(r.what, r.read)
+	}
+
+	const soak = 2 * time.Second
+	time.Sleep(soak)
+	close(stop)
+	wg.Wait()
+	if len(failures) > 0 {
+		return errors.Join(failures...)
+	}
+	if count, err := s.GetAttestationCount(local); err != nil || int64(count) != written {
+		return fmt.Errorf("%d attestations stored, %d written (%v)", count, written, err)
+	}
+	stats, err := s.GetDatabaseStats()
+	if err != nil || int64(stats.AttestationCount) != written {
+		return fmt.Errorf("stats report %d attestations, %d written (%v)", stats.AttestationCount, written, err)
+	}
+	if written == 0 || reads == 0 {
+		return fmt.Errorf("no progress: %d writes, %d reads", written, reads)
+	}
+	log.Printf("SQLite contention: %d attestations written and %d reads in %v without a busy error", written, reads, soak)
+
+	// A write transaction holding the lock doesn't hold up the read pool
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	a := attest(0)
+	if _, err := tx.Stmt(s.insertAttestation).Exec(a.FromSystemID.String(), a.ToSystemID.String(),
+		local.String(), a.Timestamp, a.MessageType, a.Signature, a.PublicKey, 1, time.Now().Unix(), 0, a.Nonce); err != nil {
+		return err
+	}
+	start := time.Now()
+	count, err := s.GetAttestationCount(local)
+	if err != nil {
+		return fmt.Errorf("read during a write transaction: %w", err)
+	}
+	if took := time.Since(start); took > raceSlowdown*100*time.Millisecond {
+		return fmt.Errorf("a read during a write transaction took %v", took)
+	}
+	if int64(count) != written {
+		return fmt.Errorf("a read during a write transaction saw %d attestations, want the committed %d", count, written)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if count, err := s.GetAttestationCount(local); err != nil || int64(count) != written+1 {
+		return fmt.Errorf("%d attestations after the commit, want %d (%v)", count, written+1, err)
+	}
+	return nil
+}
+
+// runSimulations runs the named scenarios (all of them if none are named)
+// Returns the process exit code
+func runSimulations(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "Show node logs")
+	fs.Parse(args)
+
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	names := fs.Args()
+	if len(names) == 0 {
+		for name := range simulationScenarios {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	failed := 0
+	for _, name := range names {
+		scenario, ok := simulationScenarios[name]
+		if !ok {
+			fmt.Printf("???  %s (unknown scenario)\n", name)
+			failed++
+			continue
+		}
+		start := time.Now()
+		if err := scenario(); err != nil {
+			fmt.Printf("FAIL %s (%v): %v\n", name, time.Since(start).Round(time.Millisecond), err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s (%v)\n", name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
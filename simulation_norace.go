@@ -0,0 +1,6 @@
+//go:build simulation && !race
+
+package main
+
+// raceSlowdown scales the scenarios' timing budgets under the race detector (see simulation_race.go)
+const raceSlowdown = 1
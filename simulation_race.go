@@ -0,0 +1,7 @@
+//go:build simulation && race
+
+package main
+
+// raceSlowdown scales the scenarios' timing budgets under the race detector, which runs
+// this kind of code several times slower
+const raceSlowdown = 10
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Star class roles beyond peer capacity (see GetMaxPeers). Every role is derived from
+// the star classes, which are checked against the UUID, so nobody can claim one falsely.
+const (
+	// AnnounceRateLimit is how many inbound announces per minute a node accepts
+	AnnounceRateLimit = 60
+
+	// RelayAnnounceRateLimit is the inbound announce limit for relay systems
+	RelayAnnounceRateLimit = 240
+
+	// DwarfLivenessMultiplier stretches the liveness interval of M-class systems to save resources
+	DwarfLivenessMultiplier = 2
+)
+
+// IsRelay reports whether a system is a relay: an O or B giant whose stars match its UUID
+// Relays take more announces and are queried first during lookups
+func (s *System) IsRelay() bool {
+	switch s.Stars.Primary.Class {
+	case "O", "B":
+		return ValidateStarSystem(s)
+	}
+	return false
+}
+
+// AnnounceRateLimit returns how many inbound announces per minute this system accepts
+func (s *System) AnnounceRateLimit() int {
+	if s.IsRelay() {
+		return RelayAnnounceRateLimit
+	}
+	return AnnounceRateLimit
+}
+
+// LivenessInterval returns the base time between this system's liveness pings to a healthy peer
+func (s *System) LivenessInterval() time.Duration {
+	if s.Stars.Primary.Class == "M" {
+		return LivenessInterval * DwarfLivenessMultiplier
+	}
+	return LivenessInterval
+}
+
+// preferRelays moves relays to the front of a lookup shortlist, otherwise keeping its order
+func preferRelays(nodes []*System) []*System {
+	relay := make(map[*System]bool, len(nodes))
+	for _, sys := range nodes {
+		relay[sys] = sys.IsRelay()
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return relay[nodes[i]] && !relay[nodes[j]] })
+	return nodes
+}
+
+// rateLimiter is a token bucket refilled continuously at a per-minute rate
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available; the bucket holds at most one minute's worth
+func (l *rateLimiter) allow(perMinute int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = float64(perMinute)
+	} else {
+		l.tokens += now.Sub(l.last).Minutes() * float64(perMinute)
+		if l.tokens > float64(perMinute) {
+			l.tokens = float64(perMinute)
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"time"
+)
+
+// StatsSchemaVersion is bumped whenever a StatsResponse field is renamed, retyped or removed
+const StatsSchemaVersion = 1
+
+// StatsResponse is /api/stats. Every field is always sent; what a node doesn't know
+// (or, in public mode, doesn't tell) is left at its zero value
+type StatsResponse struct {
+	SchemaVersion int   `json:"schema_version"`
+	GeneratedAt   int64 `json:"generated_at"` // Unix
+
+	LocalID          string             `json:"local_id"` // Empty in public mode
+	LocalName        string             `json:"local_name"`
+	RoutingTableSize int                `json:"routing_table_size"`
+	CacheSize        int                `json:"cache_size"`
+	TotalSystems     int                `json:"total_systems"` // The cache plus ourselves
+	UnverifiedPeers  int                `json:"unverified_peers"`
+	MaxPeers         int                `json:"max_peers"` // This system's own limit
+	PeerStates       PeerStateBreakdown `json:"peer_states"`
+
+	AttestationCount  int    `json:"attestation_count"`
+	DatabaseSizeBytes int64  `json:"database_size_bytes"`
+	DatabaseSize      string `json:"database_size"`   // database_size_bytes for display
+	NextCompaction    int64  `json:"next_compaction"` // Unix, 0 when none is scheduled
+
+	RejectedByPeers SelfRejectionWarning `json:"rejected_by_peers"` // Peers is 0 unless 2 or more refused our info
+	Traffic         TrafficSummary       `json:"traffic"`
+	Latency         LatencyHistogram     `json:"latency"`
+	Bandwidth       BandwidthUsage       `json:"bandwidth"`
+	SystemCache     CacheLimitStats      `json:"system_cache"`
+	Process         ProcessInfo          `json:"process"`
+	Retention       RetentionStats       `json:"retention"`
+	Seeds           SeedStatus           `json:"seeds"`
+	Partition       PartitionStatus      `json:"partition"`
+	RoutingHealth   RoutingHealth        `json:"routing_health"`
+}
+
+// NetworkStats collects the DHT's side of /api/stats
+func (dht *DHT) NetworkStats() StatsResponse {
+	rt := dht.routingTable
+	stats := StatsResponse{
+		SchemaVersion:    StatsSchemaVersion,
+		GeneratedAt:      time.Now().Unix(),
+		LocalID:          dht.localSystem.ID.String(),
+		LocalName:        dht.localSystem.Name,
+		RoutingTableSize: rt.GetRoutingTableSize(),
+		CacheSize:        rt.GetCacheSize(),
+		UnverifiedPeers:  rt.GetUnverifiedCount(),
+		MaxPeers:         dht.localSystem.GetMaxPeers(),
+		PeerStates:       rt.GetPeerStateBreakdown(),
+		Traffic:          dht.TrafficSummary(),
+		Latency:          rt.GetLatencyHistogram(),
+		Bandwidth:        dht.BandwidthStats(),
+		SystemCache:      rt.GetCacheLimitStats(),
+		Process:          dht.GetProcessInfo(),
+		Seeds:            dht.SeedStatus(),
+		Partition:        dht.PartitionStatus(),
+		RoutingHealth:    rt.RoutingHealth(),
+	}
+	stats.TotalSystems = stats.CacheSize + 1
+	if w := rt.GetSelfRejectionWarning(); w != nil {
+		stats.RejectedByPeers = *w
+	}
+	if next := dht.NextCompaction(); !next.IsZero() {
+		stats.NextCompaction = next.Unix()
+	}
+	if r := dht.RetentionStats(); r != nil {
+		stats.Retention = *r
+	}
+	return stats
+}
+
+// collectStats is /api/stats, and what the index page is rendered from
+func (w *WebInterface) collectStats() StatsResponse {
+	stats := w.dht.NetworkStats()
+	if db, err := w.storage.GetDatabaseStats(); err == nil {
+		stats.AttestationCount = db.AttestationCount
+		stats.DatabaseSizeBytes = db.SizeBytes
+		stats.DatabaseSize = formatBytes(db.SizeBytes)
+	}
+
+	if w.public {
+		stats.LocalID = ""
+		stats.AttestationCount = 0
+		stats.DatabaseSizeBytes = 0
+		stats.DatabaseSize = ""
+		stats.NextCompaction = 0
+		stats.Bandwidth = BandwidthUsage{}
+		stats.Seeds = SeedStatus{}
+		stats.Traffic.Peers = nil
+		stats.Partition.Group = nil
+		stats.Partition.Healings = nil
+	}
+	return stats
+}
+
+// legacyStats is the /api/stats map from before StatsResponse (?legacy=1), for one release:
+// fields that didn't apply were left out rather than zero
+func legacyStats(stats StatsResponse, public bool) map[string]interface{} {
+	legacy := map[string]interface{}{
+		"local_name":         stats.LocalName,
+		"routing_table_size": stats.RoutingTableSize,
+		"cache_size":         stats.CacheSize,
+		"verified_peers":     stats.RoutingTableSize,
+		"unverified_peers":   stats.UnverifiedPeers,
+		"max_peers":          MaxPeers,
+		"peer_states":        stats.PeerStates,
+		"traffic":            stats.Traffic,
+		"latency":            stats.Latency,
+		"system_cache":       stats.SystemCache,
+		"process":            stats.Process,
+		"retention":          &stats.Retention,
+		"partition":          stats.Partition,
+		"routing_health":     stats.RoutingHealth,
+	}
+	if stats.RejectedByPeers.Peers > 0 {
+		legacy["rejected_by_peers"] = &stats.RejectedByPeers
+	}
+	if public {
+		return legacy
+	}
+
+	legacy["local_id"] = stats.LocalID
+	legacy["attestation_count"] = stats.AttestationCount
+	legacy["database_size_bytes"] = stats.DatabaseSizeBytes
+	legacy["database_size"] = stats.DatabaseSize
+	legacy["bandwidth"] = stats.Bandwidth
+	legacy["seeds"] = stats.Seeds
+	if stats.NextCompaction > 0 {
+		legacy["next_compaction"] = time.Unix(stats.NextCompaction, 0).Format(time.RFC3339)
+	}
+	return legacy
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Health is a node's connectivity classification; its value is the -status exit code
+type Health int
+
+const (
+	HealthHealthy         Health = iota // 2+ routing table peers
+	HealthLowConnectivity               // 1 peer
+	HealthIsolated                      // No peers (or the node isn't running)
+)
+
+// NodeHealth classifies a node by the size of its routing table
+func NodeHealth(routingTableSize int) Health {
+	switch {
+	case routingTableSize >= 2:
+		return HealthHealthy
+	case routingTableSize == 1:
+		return HealthLowConnectivity
+	default:
+		return HealthIsolated
+	}
+}
+
+func (h Health) String() string {
+	switch h {
+	case HealthHealthy:
+		return "Healthy"
+	case HealthLowConnectivity:
+		return "Low Connectivity"
+	default:
+		return "Isolated"
+	}
+}
+
+// CSSClass is the web UI class the health is shown with
+func (h Health) CSSClass() string {
+	switch h {
+	case HealthHealthy:
+		return "health-healthy"
+	case HealthLowConnectivity:
+		return "health-warning"
+	default:
+		return "health-critical"
+	}
+}
+
+// NodeStatus is the /api/status response and what -status prints
+// In public mode the ID, database and credits are left out
+type NodeStatus struct {
+	Running          bool                  `json:"running"` // False when read from the database of a stopped node
+	Health           string                `json:"health"`
+	ID               string                `json:"id,omitempty"`
+	Name             string                `json:"name"`
+	X                float64               `json:"x"`
+	Y                float64               `json:"y"`
+	Z                float64               `json:"z"`
+	ProtocolVersion  string                `json:"protocol_version"`
+	RoutingTableSize int                   `json:"routing_table_size"`
+	PeerStates       PeerStateBreakdown    `json:"peer_states"`
+	KnownSystems     int                   `json:"known_systems"` // Not including self
+	LastAnnounce     int64                 `json:"last_announce,omitempty"`
+	InboundReceived  bool                  `json:"inbound_received"`
+	LastInbound      int64                 `json:"last_inbound,omitempty"`
+	Database         *DatabaseStatus       `json:"database,omitempty"`
+	Credits          *CreditStatus         `json:"credits,omitempty"`
+	RejectedByPeers  *SelfRejectionWarning `json:"rejected_by_peers,omitempty"` // Several peers refused our own info
+}
+
+// DatabaseStatus is the database part of a NodeStatus
+type DatabaseStatus struct {
+	SizeBytes        int64 `json:"size_bytes"`
+	AttestationCount int   `json:"attestation_count"`
+}
+
+// CreditStatus is the credits part of a NodeStatus
+type CreditStatus struct {
+	Balance        int64   `json:"balance"`
+	Rank           string  `json:"rank"`
+	LongevityWeeks float64 `json:"longevity_weeks"`
+}
+
+// handleStatusAPI serves the node's status for monitoring (see -status)
+func (w *WebInterface) handleStatusAPI(rw http.ResponseWriter, r *http.Request) {
+	rt := w.dht.GetRoutingTable()
+	sys := w.dht.GetLocalSystem()
+	rtSize := rt.GetRoutingTableSize()
+
+	status := NodeStatus{
+		Running:          true,
+		Health:           NodeHealth(rtSize).String(),
+		Name:             sys.Name,
+		X:                sys.X,
+		Y:                sys.Y,
+		Z:                sys.Z,
+		ProtocolVersion:  CurrentProtocolVersion.String(),
+		RoutingTableSize: rtSize,
+		PeerStates:       rt.GetPeerStateBreakdown(),
+		KnownSystems:     rt.GetCacheSize(),
+		RejectedByPeers:  rt.GetSelfRejectionWarning(),
+	}
+	if last := w.dht.LastAnnounce(); !last.IsZero() {
+		status.LastAnnounce = last.Unix()
+	}
+	received, last := w.dht.InboundStatus()
+	status.InboundReceived = received
+	if received {
+		status.LastInbound = last.Unix()
+	}
+
+	if !w.public {
+		status.ID = sys.ID.String()
+		status.Database = databaseStatus(w.storage)
+		status.Credits = creditStatus(w.storage, sys.ID)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(status)
+}
+
+// databaseStatus returns the database size and attestation count
+func databaseStatus(storage *Storage) *DatabaseStatus {
+	stats, err := storage.GetDatabaseStats()
+	if err != nil {
+		return nil
+	}
+	return &DatabaseStatus{SizeBytes: stats.SizeBytes, AttestationCount: stats.AttestationCount}
+}
+
+// creditStatus returns the system's credit balance, rank and longevity streak (nil if it has none yet)
+func creditStatus(storage *Storage, id uuid.UUID) *CreditStatus {
+	balance, err := storage.GetCreditBalance(id)
+	if err != nil {
+		return nil
+	}
+	credits := &CreditStatus{Balance: balance.Balance, Rank: GetRank(balance.Balance).Name}
+	if balance.LongevityStart > 0 {
+		credits.LongevityWeeks = float64(time.Now().Unix()-balance.LongevityStart) / (7 * 24 * 3600)
+	}
+	return credits
+}
+
+// LastAnnounce returns when the last announce round finished (zero if none has yet)
+func (dht *DHT) LastAnnounce() time.Time {
+	t := dht.tasks.get(TaskAnnounce)
+	if t == nil {
+		return time.Time{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastEnd
+}
+
+// InboundStatus reports whether any peer has contacted us since startup, and when one last did
+func (dht *DHT) InboundStatus() (bool, time.Time) {
+	dht.inboundMu.RLock()
+	defer dht.inboundMu.RUnlock()
+	return dht.hasReceivedInbound, dht.lastInbound
+}
+
+// runStatus prints the node's status as JSON and returns its health as the exit code
+// It asks the running node's web API at webAddr, and reads dbPath directly if nothing answers;
+// a node that isn't running is reported isolated
+func runStatus(webAddr, dbPath string) int {
+	status, err := fetchStatus(webAddr)
+	if err != nil {
+		status, err = statusFromDatabase(dbPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: no node answering at %s and can't read %s: %v\n", webAddr, dbPath, err)
+			return int(HealthIsolated)
+		}
+	}
+
+	out, _ := json.MarshalIndent(status, "", "  ")
+	fmt.Println(string(out))
+
+	switch status.Health {
+	case HealthHealthy.String():
+		return int(HealthHealthy)
+	case HealthLowConnectivity.String():
+		return int(HealthLowConnectivity)
+	default:
+		return int(HealthIsolated)
+	}
+}
+
+// fetchStatus asks a running node's /api/status
+// A wildcard bind address (the default 0.0.0.0:8080) is reached over loopback
+func fetchStatus(webAddr string) (NodeStatus, error) {
+	var status NodeStatus
+
+	host, port, err := net.SplitHostPort(webAddr)
+	if err != nil {
+		return status, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/api/status")
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return status, fmt.Errorf("status API returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	return status, err
+}
+
+// statusFromDatabase builds a stopped node's status from its database
+func statusFromDatabase(dbPath string) (NodeStatus, error) {
+	var status NodeStatus
+
+	// NewStorage would create a missing database
+	if _, err := os.Stat(dbPath); err != nil {
+		return status, err
+	}
+	storage, err := NewStorage(dbPath)
+	if err != nil {
+		return status, err
+	}
+	defer storage.Close()
+
+	sys, err := storage.LoadSystem()
+	if err != nil {
+		return status, err
+	}
+	known, err := storage.GetAllPeerSystems()
+	if err != nil {
+		return status, err
+	}
+
+	return NodeStatus{
+		Health:          NodeHealth(0).String(),
+		ID:              sys.ID.String(),
+		Name:            sys.Name,
+		X:               sys.X,
+		Y:               sys.Y,
+		Z:               sys.Z,
+		ProtocolVersion: CurrentProtocolVersion.String(),
+		PeerStates:      PeerStateBreakdown{Total: len(known)},
+		KnownSystems:    len(known),
+		Database:        databaseStatus(storage),
+		Credits:         creditStatus(storage, sys.ID),
+	}, nil
+}
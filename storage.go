@@ -3,36 +3,103 @@ package main
 import (
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Storage is the node's SQLite database
+// SQLite allows one writer at a time, so every write goes through db, which holds a single
+// connection: writes queue in the pool instead of failing with "database is locked".
+// Read-only queries (web UI, API, stats) use the read pool, which WAL lets run alongside them.
 type Storage struct {
-	db *sql.DB
+	db   *sql.DB // Writer: one connection, transactions take the write lock up front
+	read *sql.DB // Readers: query-only connections
+
+	// Hot statements, prepared once (see prepareStatements)
+	insertAttestation *sql.Stmt
+	upsertPeerSystem  *sql.Stmt
+	touchPeerSystem   *sql.Stmt
+	getIdentity       *sql.Stmt // On the read pool
+	bindIdentity      *sql.Stmt
+
+	connWrites *connectionWriteCache // Recently written peer_connections rows (see connection_writes.go)
 }
 
 // NewStorage initializes SQLite database and creates tables
 func NewStorage(dbPath string) (*Storage, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	// PRAGMAs only apply to the connection they run on, so they're set in the DSN
+	// to cover every connection the pools open
+	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(1)
 
-	// Enable WAL mode for better concurrent access
-	db.Exec("PRAGMA journal_mode=WAL")
-	db.Exec("PRAGMA busy_timeout=5000")
+	read := db
+	if dbPath != ":memory:" { // Every connection to :memory: is a separate database
+		read, err = sql.Open("sqlite3", dbPath+"?_busy_timeout=5000&_query_only=true")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
 
-	storage := &Storage{db: db}
+	storage := &Storage{db: db, read: read, connWrites: newConnectionWriteCache(PeerConnectionRewriteInterval)}
 	if err := storage.createTables(); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	if err := storage.prepareStatements(); err != nil {
+		storage.Close()
 		return nil, err
 	}
 
 	return storage, nil
 }
 
+// prepareStatements prepares the statements run on every message or cache update
+func (s *Storage) prepareStatements() error {
+	var err error
+	prepare := func(db *sql.DB, query string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var stmt *sql.Stmt
+		stmt, err = db.Prepare(query)
+		return stmt
+	}
+
+	// A nonce the sender already used hits idx_attestations_from_nonce and is ignored.
+	// Legacy attestations have none, so the same signature again is ignored instead
+	s.insertAttestation = prepare(s.db, `
+		INSERT OR IGNORE INTO attestations (
+			from_system_id, to_system_id, received_by, timestamp, message_type,
+			signature, public_key, verified, created_at, clock_skew, nonce
+		) SELECT ?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11
+		WHERE ?11 != '' OR NOT EXISTS (
+			SELECT 1 FROM attestations
+			WHERE from_system_id = ?1 AND timestamp = ?4 AND signature = ?6 AND nonce = ''
+		)
+	`)
+	s.upsertPeerSystem = prepare(s.db, upsertPeerSystemSQL)
+	s.touchPeerSystem = prepare(s.db, `UPDATE peer_systems SET last_verified = ?, updated_at = ? WHERE id = ?`)
+	s.getIdentity = prepare(s.read, "SELECT public_key FROM identity_bindings WHERE system_id = ?")
+	s.bindIdentity = prepare(s.db,
+		"INSERT INTO identity_bindings (system_id, public_key, first_seen) VALUES (?, ?, ?) ON CONFLICT(system_id) DO NOTHING")
+	if err != nil {
+		return fmt.Errorf("failed to prepare statements: %w", err)
+	}
+	return nil
+}
+
 func (s *Storage) createTables() error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS system (
@@ -71,7 +138,22 @@ func (s *Storage) createTables() error {
 		sponsor_id TEXT,
 		-- Cryptographic identity (keys stored as base64)
 		public_key TEXT NOT NULL,
-		private_key TEXT NOT NULL
+		private_key TEXT NOT NULL,
+		-- Bearer token for mutating web API calls (never leaves this node)
+		admin_token TEXT NOT NULL DEFAULT '',
+		-- Node starts after the first (see process_uptime.go)
+		restart_count INTEGER NOT NULL DEFAULT 0,
+		-- Coordinate derivation that placed it, 0 for v1 (see system.go)
+		coords_version INTEGER NOT NULL DEFAULT 0,
+		-- Star derivation that gave it its stars, 0 for v1 (see system.go)
+		stars_version INTEGER NOT NULL DEFAULT 0,
+		-- Operator profile as last signed, profile_version 0 if it never had one (see profile.go)
+		profile_handle TEXT NOT NULL DEFAULT '',
+		profile_bio TEXT NOT NULL DEFAULT '',
+		profile_url TEXT NOT NULL DEFAULT '',
+		profile_private INTEGER NOT NULL DEFAULT 0,
+		profile_version INTEGER NOT NULL DEFAULT 0,
+		profile_signature TEXT NOT NULL DEFAULT ''
 	);
 
 	CREATE TABLE IF NOT EXISTS attestations (
@@ -84,7 +166,10 @@ func (s *Storage) createTables() error {
 		signature TEXT NOT NULL,
 		public_key TEXT NOT NULL,
 		verified INTEGER DEFAULT 0,
-		created_at INTEGER NOT NULL
+		created_at INTEGER NOT NULL,
+		-- Seconds the signer's clock was ahead of ours; timestamp - clock_skew is our clock's time
+		clock_skew INTEGER NOT NULL DEFAULT 0,
+		nonce TEXT NOT NULL DEFAULT '' -- Signed by senders that got our attestation-nonce capability
 	);
 
 	CREATE TABLE IF NOT EXISTS peer_systems (
@@ -99,25 +184,49 @@ func (s *Storage) createTables() error {
 	peer_address TEXT NOT NULL DEFAULT '',
 	sponsor_id TEXT,
 	info_version INTEGER NOT NULL DEFAULT 0,
+	info_signature TEXT NOT NULL DEFAULT '',
 	last_verified INTEGER,
-	updated_at INTEGER NOT NULL
+	updated_at INTEGER NOT NULL,
+	latency_ms REAL NOT NULL DEFAULT 0,
+	rejection_code INTEGER NOT NULL DEFAULT 0,
+	rejection_reason TEXT NOT NULL DEFAULT '',
+	rejected_at INTEGER NOT NULL DEFAULT 0,
+	rank TEXT NOT NULL DEFAULT '',
+	rank_proven_hours INTEGER NOT NULL DEFAULT 0,
+	rank_attesters INTEGER NOT NULL DEFAULT 0,
+	rank_claimed_at INTEGER NOT NULL DEFAULT 0,
+	rank_verified TEXT NOT NULL DEFAULT '',
+	rank_verified_at INTEGER NOT NULL DEFAULT 0,
+	profile_handle TEXT NOT NULL DEFAULT '',
+	profile_bio TEXT NOT NULL DEFAULT '',
+	profile_url TEXT NOT NULL DEFAULT '',
+	profile_private INTEGER NOT NULL DEFAULT 0,
+	profile_version INTEGER NOT NULL DEFAULT 0,
+	profile_signature TEXT NOT NULL DEFAULT '',
+	peer_tls INTEGER NOT NULL DEFAULT 0,
+	stars_version INTEGER NOT NULL DEFAULT 0,
+	coords_version INTEGER NOT NULL DEFAULT 0
 	);
 
 	CREATE TABLE IF NOT EXISTS peer_connections (
 		system_id TEXT NOT NULL,
 		peer_id TEXT NOT NULL,
 		updated_at INTEGER NOT NULL,
+		reciprocal INTEGER NOT NULL DEFAULT 0,
+		observations INTEGER NOT NULL DEFAULT 1, -- Times the system reported the peer (approximate, see connection_writes.go)
 		PRIMARY KEY (system_id, peer_id)
 	);
 
-	CREATE INDEX IF NOT EXISTS idx_peer_connections_updated ON peer_connections(updated_at);
-	CREATE INDEX IF NOT EXISTS idx_system_coords ON system(x, y, z);
-	CREATE INDEX IF NOT EXISTS idx_system_primary_class ON system(primary_class);
-	CREATE INDEX IF NOT EXISTS idx_system_star_count ON system(star_count);
-	CREATE INDEX IF NOT EXISTS idx_attestations_from ON attestations(from_system_id);
-	CREATE INDEX IF NOT EXISTS idx_attestations_to ON attestations(to_system_id);
-	CREATE INDEX IF NOT EXISTS idx_attestations_timestamp ON attestations(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_attestations_verified ON attestations(verified);
+	-- Per-peer, per-day rollup of attestations removed by compaction
+	CREATE TABLE IF NOT EXISTS attestation_summaries (
+		from_system_id TEXT NOT NULL,
+		received_by TEXT NOT NULL,
+		day TEXT NOT NULL,
+		attestation_count INTEGER NOT NULL,
+		first_timestamp INTEGER NOT NULL,
+		last_timestamp INTEGER NOT NULL,
+		PRIMARY KEY (from_system_id, received_by, day)
+	);
 
 	-- Stellar Credits balance tracking
 	CREATE TABLE IF NOT EXISTS credit_balance (
@@ -143,6 +252,8 @@ func (s *Storage) createTables() error {
 		signature TEXT NOT NULL,
 		public_key TEXT NOT NULL,
 		proof_hash TEXT,
+		status TEXT NOT NULL DEFAULT 'sent', -- 'pending' while being delivered
+		payload TEXT NOT NULL DEFAULT '', -- The signed transfer as sent, kept while pending to retry it
 		created_at INTEGER NOT NULL
 	);
 
@@ -155,7 +266,8 @@ func (s *Storage) createTables() error {
 		timestamp INTEGER NOT NULL,
 		signature TEXT NOT NULL,
 		proof_hash TEXT NOT NULL,
-		verified_at INTEGER NOT NULL
+		verified_at INTEGER NOT NULL,
+		memo TEXT NOT NULL DEFAULT ''
 	);
 
 	-- Identity bindings: locks UUID to public key on first contact
@@ -163,73 +275,232 @@ func (s *Storage) createTables() error {
 	CREATE TABLE IF NOT EXISTS identity_bindings (
 		system_id TEXT PRIMARY KEY,
 		public_key TEXT NOT NULL,
-		first_seen INTEGER NOT NULL
+		first_seen INTEGER NOT NULL,
+		signs_info INTEGER NOT NULL DEFAULT 0
 	);
 
-	CREATE INDEX IF NOT EXISTS idx_credit_transfers_from ON credit_transfers(from_system_id);
-	CREATE INDEX IF NOT EXISTS idx_credit_transfers_to ON credit_transfers(to_system_id);
-	CREATE INDEX IF NOT EXISTS idx_credit_transfers_timestamp ON credit_transfers(timestamp);
-	CREATE INDEX IF NOT EXISTS idx_verified_transfers_from ON verified_transfers(from_system_id);
-	CREATE INDEX IF NOT EXISTS idx_verified_transfers_to ON verified_transfers(to_system_id);
+	-- Signed key rotations (ours and peers'): the binding's earlier keys, for older attestations
+	CREATE TABLE IF NOT EXISTS key_rotations (
+		system_id TEXT NOT NULL,
+		sequence INTEGER NOT NULL,
+		old_public_key TEXT NOT NULL,
+		new_public_key TEXT NOT NULL DEFAULT '', -- Empty for a revocation
+		revoked INTEGER NOT NULL DEFAULT 0,
+		timestamp INTEGER NOT NULL,
+		signature TEXT NOT NULL,
+		PRIMARY KEY (system_id, sequence)
+	);
+
+	CREATE TABLE IF NOT EXISTS blocked_systems (
+		system_id TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		blocked_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0
+	);
+
+	-- The operator's private notes on systems (see annotations.go); kept when the system
+	-- leaves the cache, never sent to peers
+	CREATE TABLE IF NOT EXISTS peer_annotations (
+		system_id TEXT PRIMARY KEY,
+		note TEXT NOT NULL DEFAULT '',
+		tags TEXT NOT NULL DEFAULT '',
+		color TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL
+	);
+
+	-- DHT bytes each local day, for the bandwidth budget (see bandwidth.go)
+	CREATE TABLE IF NOT EXISTS bandwidth_usage (
+		day TEXT PRIMARY KEY,
+		bytes_sent INTEGER NOT NULL,
+		bytes_received INTEGER NOT NULL
+	);
+
+	-- Messages exchanged with each peer by kind, in hourly buckets (see peer_traffic.go)
+	-- peer_id is a UUID, or the remote IP for messages refused before their sender was identified
+	CREATE TABLE IF NOT EXISTS peer_traffic (
+		peer_id TEXT NOT NULL,
+		hour INTEGER NOT NULL,
+		direction TEXT NOT NULL,
+		ping INTEGER NOT NULL DEFAULT 0,
+		find_node INTEGER NOT NULL DEFAULT 0,
+		announce INTEGER NOT NULL DEFAULT 0,
+		other INTEGER NOT NULL DEFAULT 0,
+		responses INTEGER NOT NULL DEFAULT 0,
+		errors INTEGER NOT NULL DEFAULT 0,
+		rejected INTEGER NOT NULL DEFAULT 0,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (peer_id, hour, direction)
+	);
+
+	-- Former genesis systems' signed records of leaving the origin (see genesis.go)
+	CREATE TABLE IF NOT EXISTS genesis_demotions (
+		system_id TEXT PRIMARY KEY,
+		winner_id TEXT NOT NULL,
+		demoted_at INTEGER NOT NULL,
+		signature TEXT NOT NULL
+	);
+
+	-- Last -bootstrap list, retried on restarts without the flag
+	CREATE TABLE IF NOT EXISTS bootstrap_peers (
+		address TEXT PRIMARY KEY,
+		position INTEGER NOT NULL
+	);
+
+	-- Last seed list fetched from GitHub, used when it can't be reached (see seeds.go)
+	CREATE TABLE IF NOT EXISTS seed_cache (
+		address TEXT PRIMARY KEY,
+		position INTEGER NOT NULL,
+		fetched_at INTEGER NOT NULL
+	);
+
+	-- Our own long-lived peers, tried as seeds after the fetched or cached list
+	CREATE TABLE IF NOT EXISTS personal_seeds (
+		system_id TEXT PRIMARY KEY,
+		address TEXT NOT NULL,
+		days_seen INTEGER NOT NULL,
+		promoted_at INTEGER NOT NULL
+	);
+
+	-- Cached systems seen claiming the same peer address, and who kept it
+	CREATE TABLE IF NOT EXISTS address_conflicts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		address TEXT NOT NULL,
+		system_id TEXT NOT NULL,
+		other_id TEXT NOT NULL,
+		detected_at INTEGER NOT NULL,
+		resolved_at INTEGER NOT NULL DEFAULT 0,
+		kept_id TEXT NOT NULL DEFAULT ''
+	);
+
+	-- Peers' signed claims that a system is unreachable; enough of them demote it (see retraction.go)
+	CREATE TABLE IF NOT EXISTS peer_suspicions (
+		target_id TEXT NOT NULL,
+		claimer_id TEXT NOT NULL,
+		claimed_at INTEGER NOT NULL,
+		PRIMARY KEY (target_id, claimer_id)
+	);
+
+	-- Signed claims that this node replaced an earlier identity of its own
+	CREATE TABLE IF NOT EXISTS identity_supersessions (
+		old_id TEXT PRIMARY KEY,
+		new_id TEXT NOT NULL,
+		new_public_key TEXT NOT NULL,
+		timestamp INTEGER NOT NULL,
+		new_signature TEXT NOT NULL,
+		old_public_key TEXT NOT NULL DEFAULT '',
+		old_signature TEXT NOT NULL DEFAULT ''
+	);
+
+	-- Hourly record of the known galaxy; data is a JSON SnapshotDelta against the previous row
+	CREATE TABLE IF NOT EXISTS galaxy_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		taken_at INTEGER NOT NULL,
+		keyframe INTEGER NOT NULL,
+		system_count INTEGER NOT NULL,
+		routing_table_size INTEGER NOT NULL,
+		data TEXT NOT NULL
+	);
+
+	-- One row per credit calculation; compaction rolls older days into one row each (cycles > 1)
+	CREATE TABLE IF NOT EXISTS credit_earnings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		calculated_at INTEGER NOT NULL,
+		cycles INTEGER NOT NULL DEFAULT 1,
+		base REAL NOT NULL,
+		bridge REAL NOT NULL,
+		longevity REAL NOT NULL,
+		pioneer REAL NOT NULL,
+		reciprocity REAL NOT NULL,
+		earned REAL NOT NULL,
+		peer_count INTEGER NOT NULL,
+		galaxy_size INTEGER NOT NULL,
+		bridge_score REAL NOT NULL DEFAULT 0,
+		reciprocity_ratio REAL NOT NULL DEFAULT 0,
+		avg_connectivity REAL NOT NULL DEFAULT 0,
+		service REAL NOT NULL DEFAULT 0,
+		window_start INTEGER NOT NULL DEFAULT 0, -- The calculation window: from last_calculated as it was
+		window_end INTEGER NOT NULL DEFAULT 0    -- to the time evidence was counted up to (0 = before windows were recorded)
+	);
+
+	-- Random salt for seeded UUIDs (-salt-uuid), made once per install
+	CREATE TABLE IF NOT EXISTS install_salt (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		salt TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	-- Direct messages: received ones are the inbox, sent ones track their delivery
+	CREATE TABLE IF NOT EXISTS messages (
+		id TEXT NOT NULL,
+		direction TEXT NOT NULL,
+		peer_id TEXT NOT NULL,
+		body TEXT NOT NULL,
+		sent_at INTEGER NOT NULL,
+		received_at INTEGER NOT NULL DEFAULT 0,
+		read INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (direction, peer_id, id)
+	);
+
+	-- Outcomes of joining the network for /api/diagnostics; only the latest MaxDiagnosticEvents are kept
+	CREATE TABLE IF NOT EXISTS diagnostic_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		at INTEGER NOT NULL,
+		stage TEXT NOT NULL,
+		ok INTEGER NOT NULL,
+		message TEXT NOT NULL
+	);
 	`
 
-	_, err := s.db.Exec(schema)
+	// What was there before anything is created decides which migrations run
+	state, err := readSchemaState(s.db)
 	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+	if err := s.migrate(state); err != nil {
 		return err
 	}
 
-	// Run migrations for existing databases
-	return s.runMigrations()
+	// Indexes last, so they can cover columns migrations added
+	_, err = s.db.Exec(schemaIndexes)
+	return err
 }
 
-// runMigrations handles schema updates for existing databases
-func (s *Storage) runMigrations() error {
-	// Add sponsor_id to system table if it doesn't exist
-	s.db.Exec("ALTER TABLE system ADD COLUMN sponsor_id TEXT")
-	
-	// Add sponsor_id to peer_systems table if it doesn't exist
-	s.db.Exec("ALTER TABLE peer_systems ADD COLUMN sponsor_id TEXT")
-	
-	// Add proof_hash to credit_transfers if it doesn't exist
-	s.db.Exec("ALTER TABLE credit_transfers ADD COLUMN proof_hash TEXT")
-	
-	// Add received_by to attestations if it doesn't exist
-	s.db.Exec("ALTER TABLE attestations ADD COLUMN received_by TEXT NOT NULL DEFAULT ''")
-	s.db.Exec("CREATE INDEX IF NOT EXISTS idx_attestations_received_by ON attestations(received_by)")
-	
-	// Add pending_credits to credit_balance if it doesn't exist
-	s.db.Exec("ALTER TABLE credit_balance ADD COLUMN pending_credits REAL NOT NULL DEFAULT 0")
-	
-	// Create verified_transfers table if it doesn't exist
-	s.db.Exec(`CREATE TABLE IF NOT EXISTS verified_transfers (
-		id TEXT PRIMARY KEY,
-		from_system_id TEXT NOT NULL,
-		to_system_id TEXT NOT NULL,
-		amount INTEGER NOT NULL,
-		timestamp INTEGER NOT NULL,
-		signature TEXT NOT NULL,
-		proof_hash TEXT NOT NULL,
-		verified_at INTEGER NOT NULL
-	)`)
-	s.db.Exec("CREATE INDEX IF NOT EXISTS idx_verified_transfers_from ON verified_transfers(from_system_id)")
-	s.db.Exec("CREATE INDEX IF NOT EXISTS idx_verified_transfers_to ON verified_transfers(to_system_id)")
-	
-	// Create identity_bindings table if it doesn't exist
-	s.db.Exec(`CREATE TABLE IF NOT EXISTS identity_bindings (
-		system_id TEXT PRIMARY KEY,
-		public_key TEXT NOT NULL,
-		first_seen INTEGER NOT NULL
-	)`)
-	
-	// Add info_version to peer_systems table if it doesn't exist
-	s.db.Exec("ALTER TABLE peer_systems ADD COLUMN info_version INTEGER NOT NULL DEFAULT 0")
-	
-	// Add last_verified to peer_systems table if it doesn't exist
-	s.db.Exec("ALTER TABLE peer_systems ADD COLUMN last_verified INTEGER")
-	s.db.Exec("CREATE INDEX IF NOT EXISTS idx_peer_systems_last_verified ON peer_systems(last_verified)")
-	
-	return nil
-}
+// schemaIndexes are created (if missing) on every start, after migrations
+const schemaIndexes = `
+	CREATE INDEX IF NOT EXISTS idx_peer_connections_updated ON peer_connections(updated_at);
+	CREATE INDEX IF NOT EXISTS idx_peer_traffic_hour ON peer_traffic(hour);
+	CREATE INDEX IF NOT EXISTS idx_system_coords ON system(x, y, z);
+	CREATE INDEX IF NOT EXISTS idx_system_primary_class ON system(primary_class);
+	CREATE INDEX IF NOT EXISTS idx_system_star_count ON system(star_count);
+	CREATE INDEX IF NOT EXISTS idx_attestations_from ON attestations(from_system_id);
+	CREATE INDEX IF NOT EXISTS idx_attestations_to ON attestations(to_system_id);
+	CREATE INDEX IF NOT EXISTS idx_attestations_timestamp ON attestations(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_attestations_verified ON attestations(verified);
+	CREATE INDEX IF NOT EXISTS idx_attestations_from_timestamp ON attestations(from_system_id, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_attestations_type_timestamp ON attestations(message_type, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_attestations_to_timestamp ON attestations(to_system_id, timestamp);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_attestations_from_nonce ON attestations(from_system_id, nonce) WHERE nonce != '';
+	CREATE INDEX IF NOT EXISTS idx_credit_transfers_from ON credit_transfers(from_system_id);
+	CREATE INDEX IF NOT EXISTS idx_credit_earnings_calculated_at ON credit_earnings(calculated_at);
+	CREATE INDEX IF NOT EXISTS idx_galaxy_snapshots_taken_at ON galaxy_snapshots(taken_at);
+	CREATE INDEX IF NOT EXISTS idx_credit_transfers_to ON credit_transfers(to_system_id);
+	CREATE INDEX IF NOT EXISTS idx_credit_transfers_timestamp ON credit_transfers(timestamp);
+	CREATE INDEX IF NOT EXISTS idx_verified_transfers_from ON verified_transfers(from_system_id);
+	CREATE INDEX IF NOT EXISTS idx_verified_transfers_to ON verified_transfers(to_system_id);
+	CREATE INDEX IF NOT EXISTS idx_attestations_received_by ON attestations(received_by);
+	CREATE INDEX IF NOT EXISTS idx_peer_systems_last_verified ON peer_systems(last_verified);
+	CREATE INDEX IF NOT EXISTS idx_attestation_summaries_received_last ON attestation_summaries(received_by, last_timestamp);
+	CREATE INDEX IF NOT EXISTS idx_messages_direction_sent ON messages(direction, sent_at);
+	CREATE INDEX IF NOT EXISTS idx_messages_status_next ON messages(status, next_attempt);
+	`
 
 // SaveSystem persists the local system info
 func (s *Storage) SaveSystem(sys *System) error {
@@ -282,6 +553,14 @@ func (s *Storage) SaveSystem(sys *System) error {
 		sponsorID = &s
 	}
 
+	args := []interface{}{sys.ID.String(), sys.Name, sys.X, sys.Y, sys.Z,
+		sys.Stars.Primary.Class, sys.Stars.Primary.Description, sys.Stars.Primary.Color,
+		sys.Stars.Primary.Temperature, sys.Stars.Primary.Luminosity,
+		secondaryClass, secondaryDesc, secondaryColor, secondaryTemp, secondaryLum,
+		tertiaryClass, tertiaryDesc, tertiaryColor, tertiaryTemp, tertiaryLum,
+		isBinary, isTrinary, sys.Stars.Count,
+		sys.CreatedAt.Unix(), sys.LastSeenAt.Unix(), sys.Address, sys.PeerAddress, sponsorID, publicKey, privateKey,
+		sys.CoordsVersion, sys.StarsVersion}
 	_, err := s.db.Exec(`
 		INSERT OR REPLACE INTO system (
 			id, name, x, y, z,
@@ -289,19 +568,41 @@ func (s *Storage) SaveSystem(sys *System) error {
 			secondary_class, secondary_description, secondary_color, secondary_temperature, secondary_luminosity,
 			tertiary_class, tertiary_description, tertiary_color, tertiary_temperature, tertiary_luminosity,
 			is_binary, is_trinary, star_count,
-			created_at, last_seen_at, address, peer_address, sponsor_id, public_key, private_key
+			created_at, last_seen_at, address, peer_address, sponsor_id, public_key, private_key, coords_version,
+			stars_version, `+profileColumns+`, admin_token, restart_count
 		)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, sys.ID.String(), sys.Name, sys.X, sys.Y, sys.Z,
-		sys.Stars.Primary.Class, sys.Stars.Primary.Description, sys.Stars.Primary.Color,
-		sys.Stars.Primary.Temperature, sys.Stars.Primary.Luminosity,
-		secondaryClass, secondaryDesc, secondaryColor, secondaryTemp, secondaryLum,
-		tertiaryClass, tertiaryDesc, tertiaryColor, tertiaryTemp, tertiaryLum,
-		isBinary, isTrinary, sys.Stars.Count,
-		sys.CreatedAt.Unix(), sys.LastSeenAt.Unix(), sys.Address, sys.PeerAddress, sponsorID, publicKey, privateKey)
+		VALUES (?1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+			?, ?, ?, ?, ?, ?,
+			COALESCE((SELECT admin_token FROM system WHERE id = ?1), ''),
+			COALESCE((SELECT restart_count FROM system WHERE id = ?1), 0))
+	`, append(args, profileArgs(sys.Profile)...)...)
+	if err == nil && sys.GenesisDemotion != nil {
+		err = s.SaveGenesisDemotion(sys.GenesisDemotion)
+	}
+	return err
+}
+
+// GetAdminToken returns the local system's web API admin token ("" if none yet)
+func (s *Storage) GetAdminToken(systemID uuid.UUID) (string, error) {
+	var token string
+	err := s.read.QueryRow(`SELECT admin_token FROM system WHERE id = ?`, systemID.String()).Scan(&token)
+	return token, err
+}
+
+// SaveAdminToken stores the local system's web API admin token
+func (s *Storage) SaveAdminToken(systemID uuid.UUID, token string) error {
+	_, err := s.db.Exec(`UPDATE system SET admin_token = ? WHERE id = ?`, token, systemID.String())
 	return err
 }
 
+// IncrementRestartCount counts another start of the local system and returns the new count
+func (s *Storage) IncrementRestartCount(systemID uuid.UUID) (int64, error) {
+	var count int64
+	err := s.db.QueryRow(`UPDATE system SET restart_count = restart_count + 1 WHERE id = ? RETURNING restart_count`,
+		systemID.String()).Scan(&count)
+	return count, err
+}
+
 // LoadSystem retrieves the local system info
 func (s *Storage) LoadSystem() (*System, error) {
 	var sys System
@@ -318,22 +619,25 @@ func (s *Storage) LoadSystem() (*System, error) {
 	var tertiaryTemp sql.NullInt64
 	var tertiaryLum sql.NullFloat64
 	var publicKeyB64, privateKeyB64, sponsorIDStr sql.NullString
+	var profile scannedProfile
 
-	err := s.db.QueryRow(`
+	err := s.read.QueryRow(`
 		SELECT id, name, x, y, z,
 			primary_class, primary_description, primary_color, primary_temperature, primary_luminosity,
 			secondary_class, secondary_description, secondary_color, secondary_temperature, secondary_luminosity,
 			tertiary_class, tertiary_description, tertiary_color, tertiary_temperature, tertiary_luminosity,
 			is_binary, is_trinary, star_count,
-			created_at, last_seen_at, address, peer_address, sponsor_id, public_key, private_key
+			created_at, last_seen_at, address, peer_address, sponsor_id, public_key, private_key, coords_version,
+			stars_version, `+profileColumns+`
 		FROM system LIMIT 1
-	`).Scan(&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
+	`).Scan(append([]interface{}{&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
 		&sys.Stars.Primary.Class, &sys.Stars.Primary.Description, &sys.Stars.Primary.Color,
 		&sys.Stars.Primary.Temperature, &sys.Stars.Primary.Luminosity,
 		&secondaryClass, &secondaryDesc, &secondaryColor, &secondaryTemp, &secondaryLum,
 		&tertiaryClass, &tertiaryDesc, &tertiaryColor, &tertiaryTemp, &tertiaryLum,
 		&isBinary, &isTrinary, &starCount,
-		&createdAt, &lastSeenAt, &sys.Address, &sys.PeerAddress, &sponsorIDStr, &publicKeyB64, &privateKeyB64)
+		&createdAt, &lastSeenAt, &sys.Address, &sys.PeerAddress, &sponsorIDStr, &publicKeyB64, &privateKeyB64,
+		&sys.CoordsVersion, &sys.StarsVersion}, profile.dest()...)...)
 
 	if err != nil {
 		return nil, err
@@ -342,6 +646,7 @@ func (s *Storage) LoadSystem() (*System, error) {
 	sys.ID = uuid.MustParse(idStr)
 	sys.CreatedAt = time.Unix(createdAt, 0)
 	sys.LastSeenAt = time.Unix(lastSeenAt, 0)
+	sys.Profile = profile.profile(sys.ID)
 
 	// Load sponsor ID if present
 	if sponsorIDStr.Valid && sponsorIDStr.String != "" {
@@ -401,38 +706,103 @@ func (s *Storage) LoadSystem() (*System, error) {
 		sys.Keys = keys
 	}
 
+	if sys.GenesisDemotion, err = s.GetGenesisDemotion(sys.ID); err != nil {
+		return nil, fmt.Errorf("failed to load genesis demotion: %w", err)
+	}
+
 	return &sys, nil
 }
 
-// Close closes the database connection
+// Close closes the database connections
+// Checkpoints the WAL first so the next start doesn't have to replay it
 func (s *Storage) Close() error {
+	for _, stmt := range []*sql.Stmt{s.insertAttestation, s.upsertPeerSystem, s.touchPeerSystem, s.getIdentity, s.bindIdentity} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	if s.read != s.db {
+		s.read.Close()
+	}
+	s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
 	return s.db.Close()
 }
 
+// PendingAttestation is a received attestation waiting to be written
+type PendingAttestation struct {
+	Attestation *Attestation
+	ReceivedBy  uuid.UUID // Local system ID that received it (for credit tracking)
+	ReceivedAt  int64     // Stored as created_at, so a delayed write keeps the arrival time
+}
+
+// ErrReplayedAttestation is returned for an attestation already stored: the same nonce
+// from the same sender, or for legacy ones the same signature
+var ErrReplayedAttestation = errors.New("attestation already stored (replayed)")
+
 // SaveAttestation stores a cryptographically signed attestation
 // receivedBy is the local system ID that received this attestation (for credit tracking)
 func (s *Storage) SaveAttestation(attestation *Attestation, receivedBy uuid.UUID) error {
+	a := attestation
 	verified := 0
-	if attestation.Verify() {
+	if a.VerifyCached() && s.attestationKeyValid(a) {
 		verified = 1
 	}
+	res, err := s.insertAttestation.Exec(a.FromSystemID.String(), a.ToSystemID.String(),
+		receivedBy.String(), a.Timestamp, a.MessageType,
+		a.Signature, a.PublicKey, verified, time.Now().Unix(), a.ClockSkew, a.Nonce)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrReplayedAttestation
+	}
+	return nil
+}
+
+// SaveAttestationsBatch stores several attestations in one transaction
+// Either all of them are written or none are; replayed ones are skipped, and the count
+// returned is how many were
+func (s *Storage) SaveAttestationsBatch(batch []PendingAttestation) (int, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
 
-	_, err := s.db.Exec(`
-		INSERT INTO attestations (
-			from_system_id, to_system_id, received_by, timestamp, message_type,
-			signature, public_key, verified, created_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, attestation.FromSystemID.String(), attestation.ToSystemID.String(),
-		receivedBy.String(), attestation.Timestamp, attestation.MessageType,
-		attestation.Signature, attestation.PublicKey, verified, time.Now().Unix())
+	// Signatures are checked before the transaction starts, keeping the write lock short
+	verified := make([]int, len(batch))
+	for i, p := range batch {
+		if p.Attestation.VerifyCached() && s.attestationKeyValid(p.Attestation) {
+			verified[i] = 1
+		}
+	}
 
-	return err
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	replayed := 0
+	stmt := tx.Stmt(s.insertAttestation)
+	for i, p := range batch {
+		a := p.Attestation
+		res, err := stmt.Exec(a.FromSystemID.String(), a.ToSystemID.String(),
+			p.ReceivedBy.String(), a.Timestamp, a.MessageType,
+			a.Signature, a.PublicKey, verified[i], p.ReceivedAt, a.ClockSkew, a.Nonce)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			replayed++
+		}
+	}
+
+	return replayed, tx.Commit()
 }
 
 // GetAttestationCount returns the count of verified attestations
 func (s *Storage) GetAttestationCount(systemID uuid.UUID) (int, error) {
 	var count int
-	err := s.db.QueryRow(`
+	err := s.read.QueryRow(`
 		SELECT COUNT(*) FROM attestations
 		WHERE (from_system_id = ? OR to_system_id = ?)
 		AND verified = 1
@@ -441,10 +811,49 @@ func (s *Storage) GetAttestationCount(systemID uuid.UUID) (int, error) {
 	return count, err
 }
 
-// SavePeerSystem caches a peer's full system info
-// Only updates if: entry is new OR incoming info_version > existing
-// This prevents stale gossip from overwriting fresh data
-func (s *Storage) SavePeerSystem(sys *System) error {
+// upsertPeerSystemSQL inserts or updates a peer system, never replacing newer info
+// The version check is part of the statement, so there's no gap between check and write
+const upsertPeerSystemSQL = `
+	INSERT INTO peer_systems (
+		id, name, x, y, z,
+		star_class, star_color, star_description,
+		peer_address, sponsor_id, info_version, info_signature, peer_tls, stars_version, coords_version, updated_at,
+		`+profileColumns+`
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id) DO UPDATE SET
+		name = excluded.name,
+		x = excluded.x,
+		y = excluded.y,
+		z = excluded.z,
+		star_class = excluded.star_class,
+		star_color = excluded.star_color,
+		star_description = excluded.star_description,
+		peer_address = excluded.peer_address,
+		sponsor_id = excluded.sponsor_id,
+		info_version = excluded.info_version,
+		info_signature = excluded.info_signature,
+		peer_tls = excluded.peer_tls,
+		stars_version = excluded.stars_version,
+		coords_version = excluded.coords_version,
+		updated_at = excluded.updated_at,
+		-- Info saved without its profile (or with an older one) keeps the stored one
+		profile_handle = CASE WHEN excluded.profile_version >= peer_systems.profile_version THEN excluded.profile_handle ELSE peer_systems.profile_handle END,
+		profile_bio = CASE WHEN excluded.profile_version >= peer_systems.profile_version THEN excluded.profile_bio ELSE peer_systems.profile_bio END,
+		profile_url = CASE WHEN excluded.profile_version >= peer_systems.profile_version THEN excluded.profile_url ELSE peer_systems.profile_url END,
+		profile_private = CASE WHEN excluded.profile_version >= peer_systems.profile_version THEN excluded.profile_private ELSE peer_systems.profile_private END,
+		profile_signature = CASE WHEN excluded.profile_version >= peer_systems.profile_version THEN excluded.profile_signature ELSE peer_systems.profile_signature END,
+		profile_version = MAX(excluded.profile_version, peer_systems.profile_version)
+	WHERE
+		-- Accept if incoming version is newer
+		excluded.info_version > peer_systems.info_version
+		-- OR incoming is versioned and existing is legacy (0)
+		OR (excluded.info_version > 0 AND peer_systems.info_version = 0)
+		-- OR both are legacy (0) - can't tell which is newer, accept update
+		OR (excluded.info_version = 0 AND peer_systems.info_version = 0)
+`
+
+// peerSystemArgs returns the upsertPeerSystemSQL arguments for a system
+func peerSystemArgs(sys *System, now int64) []interface{} {
 	// Handle nullable sponsor_id
 	var sponsorID *string
 	if sys.SponsorID != nil {
@@ -452,51 +861,87 @@ func (s *Storage) SavePeerSystem(sys *System) error {
 		sponsorID = &str
 	}
 
-	now := time.Now().Unix()
-
-	// Use INSERT OR REPLACE with version check to avoid race condition
-	// This is atomic - no gap between check and write
-	result, err := s.db.Exec(`
-		INSERT INTO peer_systems (
-			id, name, x, y, z,
-			star_class, star_color, star_description,
-			peer_address, sponsor_id, info_version, updated_at
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(id) DO UPDATE SET
-			name = excluded.name,
-			x = excluded.x,
-			y = excluded.y,
-			z = excluded.z,
-			star_class = excluded.star_class,
-			star_color = excluded.star_color,
-			star_description = excluded.star_description,
-			peer_address = excluded.peer_address,
-			sponsor_id = excluded.sponsor_id,
-			info_version = excluded.info_version,
-			updated_at = excluded.updated_at
-		WHERE
-			-- Accept if incoming version is newer
-			excluded.info_version > peer_systems.info_version
-			-- OR incoming is versioned and existing is legacy (0)
-			OR (excluded.info_version > 0 AND peer_systems.info_version = 0)
-			-- OR both are legacy (0) - can't tell which is newer, accept update
-			OR (excluded.info_version = 0 AND peer_systems.info_version = 0)
-	`, sys.ID.String(), sys.Name, sys.X, sys.Y, sys.Z,
+	args := []interface{}{sys.ID.String(), sys.Name, sys.X, sys.Y, sys.Z,
 		sys.Stars.Primary.Class, sys.Stars.Primary.Color, sys.Stars.Primary.Description,
-		sys.PeerAddress, sponsorID, sys.InfoVersion, now)
+		sys.PeerAddress, sponsorID, sys.InfoVersion, sys.InfoSignature, sys.PeerTLS, sys.StarsVersion, sys.CoordsVersion, now}
+	return append(args, profileArgs(sys.Profile)...)
+}
+
+// profileColumns are the operator profile columns of system and peer_systems, in the
+// order profileArgs and scannedProfile.dest give them
+const profileColumns = `profile_handle, profile_bio, profile_url, profile_private, profile_version, profile_signature`
+
+// profileArgs returns a profile's column values (profile_version 0 without one)
+func profileArgs(p *OperatorProfile) []interface{} {
+	if p == nil {
+		return []interface{}{"", "", "", false, 0, ""}
+	}
+	return []interface{}{p.Handle, p.Bio, p.URL, p.Private, p.Version, p.Signature}
+}
+
+// scannedProfile receives the profile columns of a row
+type scannedProfile struct {
+	OperatorProfile
+}
+
+// dest returns the Scan destinations for profileColumns
+func (sp *scannedProfile) dest() []interface{} {
+	return []interface{}{&sp.Handle, &sp.Bio, &sp.URL, &sp.Private, &sp.Version, &sp.Signature}
+}
+
+// profile returns the scanned record of system id, or nil if it never had one
+func (sp *scannedProfile) profile(id uuid.UUID) *OperatorProfile {
+	if sp.Version == 0 {
+		return nil
+	}
+	p := sp.OperatorProfile
+	p.SystemID = id
+	return &p
+}
+
+// SavePeerSystem caches a peer's full system info
+// Only updates if: entry is new OR incoming info_version > existing
+// This prevents stale gossip from overwriting fresh data
+func (s *Storage) SavePeerSystem(sys *System) error {
+	// A version-check miss (stale data) affects no rows and is not an error
+	_, err := s.upsertPeerSystem.Exec(peerSystemArgs(sys, time.Now().Unix())...)
+	if err == nil && sys.GenesisDemotion != nil {
+		err = s.SaveGenesisDemotion(sys.GenesisDemotion)
+	}
+	return err
+}
 
+// SavePeerSystemsBatch saves many peer systems and marks some as verified in one transaction
+// One commit instead of one per system keeps bulk imports fast on slow storage (SD cards)
+func (s *Storage) SavePeerSystemsBatch(systems []*System, verified []uuid.UUID) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Check if the update was actually applied (for debugging)
-	rows, _ := result.RowsAffected()
-	if rows == 0 {
-		// Version check prevented update - stale data
-		return nil
+	now := time.Now().Unix()
+
+	upsert := tx.Stmt(s.upsertPeerSystem)
+	for _, sys := range systems {
+		if _, err := upsert.Exec(peerSystemArgs(sys, now)...); err != nil {
+			return fmt.Errorf("failed to save %s: %w", sys.ID, err)
+		}
+		if sys.GenesisDemotion != nil {
+			if _, err := tx.Exec(saveGenesisDemotionSQL, genesisDemotionArgs(sys.GenesisDemotion)...); err != nil {
+				return err
+			}
+		}
 	}
 
-	return nil
+	touch := tx.Stmt(s.touchPeerSystem)
+	for _, id := range verified {
+		if _, err := touch.Exec(now, now, id.String()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
 // TouchPeerSystem sets last_verified timestamp for a peer system
@@ -504,8 +949,50 @@ func (s *Storage) SavePeerSystem(sys *System) error {
 // This is what keeps a peer "alive" for FIND_NODE response filtering
 func (s *Storage) TouchPeerSystem(systemID uuid.UUID) error {
 	now := time.Now().Unix()
-	_, err := s.db.Exec(`UPDATE peer_systems SET last_verified = ?, updated_at = ? WHERE id = ?`,
-		now, now, systemID.String())
+	_, err := s.touchPeerSystem.Exec(now, now, systemID.String())
+	return err
+}
+
+// SetPeerLastVerified records a known last-contact time (used when flushing the routing table)
+// Never moves last_verified backwards
+func (s *Storage) SetPeerLastVerified(systemID uuid.UUID, t time.Time) error {
+	_, err := s.db.Exec(`UPDATE peer_systems SET last_verified = ? WHERE id = ? AND COALESCE(last_verified, 0) < ?`,
+		t.Unix(), systemID.String(), t.Unix())
+	return err
+}
+
+// SetPeerLatency records a peer's round-trip latency in milliseconds
+func (s *Storage) SetPeerLatency(systemID uuid.UUID, ms float64) error {
+	_, err := s.db.Exec(`UPDATE peer_systems SET latency_ms = ? WHERE id = ?`, ms, systemID.String())
+	return err
+}
+
+// SetPeerRejection records the last protocol error a peer answered us with
+func (s *Storage) SetPeerRejection(systemID uuid.UUID, code int, reason string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE peer_systems SET rejection_code = ?, rejection_reason = ?, rejected_at = ? WHERE id = ?`,
+		code, reason, at.Unix(), systemID.String())
+	return err
+}
+
+// SetPeerRankClaim records the credit rank a peer last claimed (nil: it stopped sharing one)
+// A changed rank clears the verification of the old one
+func (s *Storage) SetPeerRankClaim(systemID uuid.UUID, claim *RankClaim) error {
+	if claim == nil {
+		claim = &RankClaim{}
+	}
+	_, err := s.db.Exec(`UPDATE peer_systems SET
+			rank_verified = CASE WHEN rank = ?1 THEN rank_verified ELSE '' END,
+			rank_verified_at = CASE WHEN rank = ?1 THEN rank_verified_at ELSE 0 END,
+			rank = ?1, rank_proven_hours = ?2, rank_attesters = ?3, rank_claimed_at = ?4
+		WHERE id = ?5`,
+		claim.Rank, claim.ProvenHours, claim.Attesters, claim.AsOf, systemID.String())
+	return err
+}
+
+// SetPeerRankVerification records the rank a peer's last proof covered
+func (s *Storage) SetPeerRankVerification(systemID uuid.UUID, rank string, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE peer_systems SET rank_verified = ?, rank_verified_at = ? WHERE id = ?`,
+		rank, at.Unix(), systemID.String())
 	return err
 }
 
@@ -521,67 +1008,231 @@ func (s *Storage) GetPeerSystem(systemID uuid.UUID) (*System, error) {
 	var idStr string
 	var updatedAt int64
 	var sponsorIDStr sql.NullString
+	var profile scannedProfile
 
-	err := s.db.QueryRow(`
-		SELECT id, name, x, y, z, star_class, star_color, star_description, peer_address, sponsor_id, info_version, updated_at
+	err := s.read.QueryRow(`
+		SELECT id, name, x, y, z, star_class, star_color, star_description, peer_address, sponsor_id, info_version, info_signature, peer_tls, stars_version, coords_version, updated_at,
+			`+profileColumns+`
 		FROM peer_systems WHERE id = ?
-	`, systemID.String()).Scan(&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
+	`, systemID.String()).Scan(append([]interface{}{&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
 		&sys.Stars.Primary.Class, &sys.Stars.Primary.Color, &sys.Stars.Primary.Description,
-		&sys.PeerAddress, &sponsorIDStr, &sys.InfoVersion, &updatedAt)
+		&sys.PeerAddress, &sponsorIDStr, &sys.InfoVersion, &sys.InfoSignature, &sys.PeerTLS, &sys.StarsVersion, &sys.CoordsVersion, &updatedAt}, profile.dest()...)...)
 
 	if err != nil {
 		return nil, err
 	}
 
-	sys.ID = uuid.MustParse(idStr)
+	// A corrupt row is an error, not a panic (-doctor reports and repairs these)
+	if sys.ID, err = uuid.Parse(idStr); err != nil {
+		return nil, fmt.Errorf("invalid peer system ID %q: %w", idStr, err)
+	}
 	
 	// Load sponsor ID if present
 	if sponsorIDStr.Valid && sponsorIDStr.String != "" {
-		sponsorID := uuid.MustParse(sponsorIDStr.String)
-		sys.SponsorID = &sponsorID
+		if sponsorID, err := uuid.Parse(sponsorIDStr.String); err == nil {
+			sys.SponsorID = &sponsorID
+		}
+	}
+
+	sys.Profile = profile.profile(sys.ID)
+
+	if sys.GenesisDemotion, err = s.GetGenesisDemotion(sys.ID); err != nil {
+		return nil, err
 	}
 	
 	return &sys, nil
 }
 
-// GetDatabaseStats returns current database statistics
-func (s *Storage) GetDatabaseStats() (map[string]interface{}, error) {
-    stats := make(map[string]interface{})
+// DatabaseStats is what GetDatabaseStats counts; a count that can't be read is 0
+type DatabaseStats struct {
+    AttestationCount  int
+    KnownSystems      int
+    SizeBytes         int64
+    OldestAttestation int64 // Unix, 0 with no attestations
+    NewestAttestation int64
+}
 
-    // Count attestations
-    var attestationCount int
-    s.db.QueryRow("SELECT COUNT(*) FROM attestations").Scan(&attestationCount)
-    stats["attestation_count"] = attestationCount
+// GetDatabaseStats returns current database statistics
+func (s *Storage) GetDatabaseStats() (*DatabaseStats, error) {
+    stats := &DatabaseStats{}
 
-    // Count known systems
-    var systemCount int
-    s.db.QueryRow("SELECT COUNT(*) FROM peer_systems").Scan(&systemCount)
-    stats["known_systems"] = systemCount
+    // Count attestations and known systems
+    s.read.QueryRow("SELECT COUNT(*) FROM attestations").Scan(&stats.AttestationCount)
+    s.read.QueryRow("SELECT COUNT(*) FROM peer_systems").Scan(&stats.KnownSystems)
 
     // Database size
     var pageCount, pageSize int64
-    s.db.QueryRow("SELECT page_count FROM pragma_page_count()").Scan(&pageCount)
-    s.db.QueryRow("SELECT page_size FROM pragma_page_size()").Scan(&pageSize)
-    stats["database_size_bytes"] = pageCount * pageSize
+    s.read.QueryRow("SELECT page_count FROM pragma_page_count()").Scan(&pageCount)
+    s.read.QueryRow("SELECT page_size FROM pragma_page_size()").Scan(&pageSize)
+    stats.SizeBytes = pageCount * pageSize
 
     // Oldest and newest attestation
-    var oldest, newest int64
-    s.db.QueryRow("SELECT MIN(timestamp) FROM attestations").Scan(&oldest)
-    s.db.QueryRow("SELECT MAX(timestamp) FROM attestations").Scan(&newest)
-    if oldest > 0 {
-        stats["oldest_attestation"] = time.Unix(oldest, 0).Format(time.RFC3339)
-    }
-    if newest > 0 {
-        stats["newest_attestation"] = time.Unix(newest, 0).Format(time.RFC3339)
-    }
+    s.read.QueryRow("SELECT COALESCE(MIN(timestamp), 0), COALESCE(MAX(timestamp), 0) FROM attestations").
+        Scan(&stats.OldestAttestation, &stats.NewestAttestation)
 
     return stats, nil
 }
 
-// GetAllPeerSystems returns all cached peer system info (not just direct peers)
-func (s *Storage) GetAllPeerSystems() ([]*System, error) {
-    rows, err := s.db.Query(`
-        SELECT id, name, x, y, z, star_class, star_color, star_description, peer_address, sponsor_id, info_version
+// GetDatabaseSize returns the database size in bytes (same measure as database_size_bytes)
+func (s *Storage) GetDatabaseSize() (int64, error) {
+	var pageCount, pageSize int64
+	if err := s.read.QueryRow("SELECT page_count FROM pragma_page_count()").Scan(&pageCount); err != nil {
+		return 0, err
+	}
+	if err := s.read.QueryRow("SELECT page_size FROM pragma_page_size()").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pageCount * pageSize, nil
+}
+
+// CompactAttestations rolls attestations older than keepDays into per-peer daily
+// attestation_summaries and deletes them.
+// The summaries remain uptime and reciprocity evidence (see GetAttestationSpansSince).
+// The earliest and latest attestation of each day are kept in full:
+// credit proofs measure uptime as the span between signed attestations, so thinning
+// the middle of a day loses nothing a proof can use.
+// Returns the number of attestations removed.
+func (s *Storage) CompactAttestations(keepDays int) (int64, error) {
+	if keepDays < 1 {
+		return 0, fmt.Errorf("keepDays must be at least 1, got %d", keepDays)
+	}
+	cutoff := time.Now().AddDate(0, 0, -keepDays).Unix()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// SQLite returns the row holding MIN()/MAX() for bare columns, giving us each day's endpoints
+	_, err = tx.Exec(`
+		CREATE TEMP TABLE compact_doomed AS
+		SELECT id FROM attestations
+		WHERE timestamp < ?1 AND id NOT IN (
+			SELECT id FROM (
+				SELECT id, MIN(timestamp) FROM attestations WHERE timestamp < ?1
+				GROUP BY received_by, timestamp / 86400
+			)
+			UNION
+			SELECT id FROM (
+				SELECT id, MAX(timestamp) FROM attestations WHERE timestamp < ?1
+				GROUP BY received_by, timestamp / 86400
+			)
+		)
+	`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select attestations: %w", err)
+	}
+
+	removed, err := summarizeDoomedAttestations(tx)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// TrimAttestations removes the oldest attestations beyond maxRows, rolling them into
+// attestation_summaries like compaction does. Each day's earliest and latest attestation
+// (what credit proofs are built from) and anything at or after floor are kept.
+// Returns the attestations removed and how many the guards kept past the cap
+func (s *Storage) TrimAttestations(maxRows, floor int64) (int64, int64, error) {
+	var count int64
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM attestations").Scan(&count); err != nil {
+		return 0, 0, err
+	}
+	excess := count - maxRows
+	if maxRows <= 0 || excess <= 0 {
+		return 0, 0, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TEMP TABLE compact_doomed AS
+		SELECT id FROM attestations
+		WHERE timestamp - clock_skew < ?1 AND id NOT IN (
+			SELECT id FROM (
+				SELECT id, MIN(timestamp) FROM attestations
+				GROUP BY received_by, timestamp / 86400
+			)
+			UNION
+			SELECT id FROM (
+				SELECT id, MAX(timestamp) FROM attestations
+				GROUP BY received_by, timestamp / 86400
+			)
+		)
+		ORDER BY timestamp
+		LIMIT ?2
+	`, floor, excess)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to select attestations: %w", err)
+	}
+	removed, err := summarizeDoomedAttestations(tx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return removed, excess - removed, nil
+}
+
+// summarizeDoomedAttestations rolls the attestations listed in temp.compact_doomed into
+// attestation_summaries, deletes them and drops the list. Returns how many were deleted
+func summarizeDoomedAttestations(tx *sql.Tx) (int64, error) {
+	_, err := tx.Exec(`
+		INSERT INTO attestation_summaries (from_system_id, received_by, day, attestation_count, first_timestamp, last_timestamp)
+		SELECT from_system_id, received_by, date(timestamp - clock_skew, 'unixepoch'), COUNT(*),
+			MIN(timestamp - clock_skew), MAX(timestamp - clock_skew)
+		FROM attestations
+		WHERE id IN (SELECT id FROM compact_doomed) AND verified = 1
+		GROUP BY from_system_id, received_by, date(timestamp - clock_skew, 'unixepoch')
+		ON CONFLICT(from_system_id, received_by, day) DO UPDATE SET
+			attestation_count = attestation_count + excluded.attestation_count,
+			first_timestamp = MIN(first_timestamp, excluded.first_timestamp),
+			last_timestamp = MAX(last_timestamp, excluded.last_timestamp)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to summarize attestations: %w", err)
+	}
+
+	result, err := tx.Exec("DELETE FROM attestations WHERE id IN (SELECT id FROM compact_doomed)")
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete attestations: %w", err)
+	}
+	removed, _ := result.RowsAffected()
+
+	if _, err := tx.Exec("DROP TABLE temp.compact_doomed"); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Vacuum returns free pages to the filesystem (no-op when there are none)
+func (s *Storage) Vacuum() error {
+	var freePages int64
+	if err := s.db.QueryRow("SELECT freelist_count FROM pragma_freelist_count()").Scan(&freePages); err != nil {
+		return err
+	}
+	if freePages == 0 {
+		return nil
+	}
+	_, err := s.db.Exec("VACUUM")
+	return err
+}
+
+// GetAllPeerSystems returns all cached peer system info (not just direct peers)
+func (s *Storage) GetAllPeerSystems() ([]*System, error) {
+    rows, err := s.read.Query(`
+        SELECT id, name, x, y, z, star_class, star_color, star_description, peer_address, sponsor_id, info_version, info_signature, peer_tls, stars_version, coords_version,
+               `+profileColumns+`
         FROM peer_systems
     `)
     if err != nil {
@@ -589,29 +1240,42 @@ func (s *Storage) GetAllPeerSystems() ([]*System, error) {
     }
     defer rows.Close()
 
+    demotions, err := s.GetGenesisDemotions()
+    if err != nil {
+        return nil, err
+    }
+
     var systems []*System
     for rows.Next() {
         var sys System
         var idStr string
         var peerAddress string
         var sponsorIDStr sql.NullString
+        var profile scannedProfile
 
-        err := rows.Scan(&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
+        err := rows.Scan(append([]interface{}{&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
             &sys.Stars.Primary.Class, &sys.Stars.Primary.Color, &sys.Stars.Primary.Description,
-            &peerAddress, &sponsorIDStr, &sys.InfoVersion)
+            &peerAddress, &sponsorIDStr, &sys.InfoVersion, &sys.InfoSignature, &sys.PeerTLS, &sys.StarsVersion, &sys.CoordsVersion}, profile.dest()...)...)
         if err != nil {
             continue
         }
 
-        sys.ID = uuid.MustParse(idStr)
+        // Skip corrupt rows rather than panic (-doctor reports and repairs these)
+        if sys.ID, err = uuid.Parse(idStr); err != nil {
+            continue
+        }
         sys.PeerAddress = peerAddress
 
         // Load sponsor ID if present
         if sponsorIDStr.Valid && sponsorIDStr.String != "" {
-            sponsorID := uuid.MustParse(sponsorIDStr.String)
-            sys.SponsorID = &sponsorID
+            if sponsorID, err := uuid.Parse(sponsorIDStr.String); err == nil {
+                sys.SponsorID = &sponsorID
+            }
         }
 
+        sys.GenesisDemotion = demotions[sys.ID]
+        sys.Profile = profile.profile(sys.ID)
+
         systems = append(systems, &sys)
     }
 
@@ -621,17 +1285,31 @@ func (s *Storage) GetAllPeerSystems() ([]*System, error) {
 // PeerSystemWithMeta contains a system and its storage metadata
 type PeerSystemWithMeta struct {
     System       *System
-    LastVerified int64 // Unix timestamp, 0 if never verified
-    UpdatedAt    int64 // Unix timestamp of last update
+    LastVerified int64   // Unix timestamp, 0 if never verified
+    UpdatedAt    int64   // Unix timestamp of last update
+    LatencyMs    float64 // Round-trip latency when last saved, 0 if never measured
+
+    // Last protocol error the peer answered us with (code 0 if none)
+    RejectionCode   int
+    RejectionReason string
+    RejectedAt      int64
+
+    // Credit rank it last claimed ("" if none) and what its last proof covered
+    RankClaim      *RankClaim
+    RankVerified   string
+    RankVerifiedAt int64
 }
 
 // GetAllPeerSystemsWithMeta returns all cached peer systems with verification timestamps
 // Used during cache loading to preserve actual age information
 func (s *Storage) GetAllPeerSystemsWithMeta() ([]*PeerSystemWithMeta, error) {
-    rows, err := s.db.Query(`
+    rows, err := s.read.Query(`
         SELECT id, name, x, y, z, star_class, star_color, star_description,
-               peer_address, sponsor_id, info_version,
-               COALESCE(last_verified, 0), COALESCE(updated_at, 0)
+               peer_address, sponsor_id, info_version, info_signature, peer_tls, stars_version, coords_version,
+               COALESCE(last_verified, 0), COALESCE(updated_at, 0), latency_ms,
+               rejection_code, rejection_reason, rejected_at,
+               rank, rank_proven_hours, rank_attesters, rank_claimed_at, rank_verified, rank_verified_at,
+               `+profileColumns+`
         FROM peer_systems
     `)
     if err != nil {
@@ -639,6 +1317,11 @@ func (s *Storage) GetAllPeerSystemsWithMeta() ([]*PeerSystemWithMeta, error) {
     }
     defer rows.Close()
 
+    demotions, err := s.GetGenesisDemotions()
+    if err != nil {
+        return nil, err
+    }
+
     var results []*PeerSystemWithMeta
     for rows.Next() {
         var sys System
@@ -646,37 +1329,81 @@ func (s *Storage) GetAllPeerSystemsWithMeta() ([]*PeerSystemWithMeta, error) {
         var peerAddress string
         var sponsorIDStr sql.NullString
         var lastVerified, updatedAt int64
-
-        err := rows.Scan(&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
+        var latency float64
+        var rejectionCode int
+        var rejectionReason string
+        var rejectedAt int64
+        var rank RankClaim
+        var rankVerified string
+        var rankVerifiedAt int64
+        var profile scannedProfile
+
+        err := rows.Scan(append([]interface{}{&idStr, &sys.Name, &sys.X, &sys.Y, &sys.Z,
             &sys.Stars.Primary.Class, &sys.Stars.Primary.Color, &sys.Stars.Primary.Description,
-            &peerAddress, &sponsorIDStr, &sys.InfoVersion,
-            &lastVerified, &updatedAt)
+            &peerAddress, &sponsorIDStr, &sys.InfoVersion, &sys.InfoSignature, &sys.PeerTLS, &sys.StarsVersion, &sys.CoordsVersion,
+            &lastVerified, &updatedAt, &latency, &rejectionCode, &rejectionReason, &rejectedAt,
+            &rank.Rank, &rank.ProvenHours, &rank.Attesters, &rank.AsOf, &rankVerified, &rankVerifiedAt}, profile.dest()...)...)
         if err != nil {
             continue
         }
 
-        sys.ID = uuid.MustParse(idStr)
+        // Skip corrupt rows rather than panic (-doctor reports and repairs these)
+        if sys.ID, err = uuid.Parse(idStr); err != nil {
+            continue
+        }
         sys.PeerAddress = peerAddress
 
         // Load sponsor ID if present
         if sponsorIDStr.Valid && sponsorIDStr.String != "" {
-            sponsorID := uuid.MustParse(sponsorIDStr.String)
-            sys.SponsorID = &sponsorID
+            if sponsorID, err := uuid.Parse(sponsorIDStr.String); err == nil {
+                sys.SponsorID = &sponsorID
+            }
         }
 
-        results = append(results, &PeerSystemWithMeta{
-            System:       &sys,
-            LastVerified: lastVerified,
-            UpdatedAt:    updatedAt,
-        })
+        sys.GenesisDemotion = demotions[sys.ID]
+        sys.Profile = profile.profile(sys.ID)
+
+        meta := &PeerSystemWithMeta{
+            System:          &sys,
+            LastVerified:    lastVerified,
+            UpdatedAt:       updatedAt,
+            LatencyMs:       latency,
+            RejectionCode:   rejectionCode,
+            RejectionReason: rejectionReason,
+            RejectedAt:      rejectedAt,
+            RankVerified:    rankVerified,
+            RankVerifiedAt:  rankVerifiedAt,
+        }
+        if rank.Rank != "" {
+            meta.RankClaim = &rank
+        }
+        results = append(results, meta)
     }
 
     return results, nil
 }
 
+// refreshReciprocalSQL recomputes every peer_connections row's reciprocal flag
+// (the reverse row may have been pruned, deleted or relinked since it was set)
+const refreshReciprocalSQL = `
+	UPDATE peer_connections SET reciprocal = EXISTS (
+		SELECT 1 FROM peer_connections r
+		WHERE r.system_id = peer_connections.peer_id AND r.peer_id = peer_connections.system_id
+	)`
+
 // SavePeerConnections stores a system's peer list (learned from peer exchange)
+// A system listing a peer that already lists it back marks both rows reciprocal
+// Rows written within PeerConnectionRewriteInterval are only counted, not rewritten
 func (s *Storage) SavePeerConnections(systemID uuid.UUID, peerIDs []uuid.UUID) error {
-	now := time.Now().Unix()
+	return s.savePeerConnectionsAt(systemID, peerIDs, time.Now())
+}
+
+// savePeerConnectionsAt is SavePeerConnections as of now
+func (s *Storage) savePeerConnectionsAt(systemID uuid.UUID, peerIDs []uuid.UUID, now time.Time) error {
+	updates := s.connWrites.plan(systemID, peerIDs, now)
+	if len(updates) == 0 {
+		return nil
+	}
 
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -684,19 +1411,45 @@ func (s *Storage) SavePeerConnections(systemID uuid.UUID, peerIDs []uuid.UUID) e
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(`
-		INSERT OR REPLACE INTO peer_connections (system_id, peer_id, updated_at)
-		VALUES (?, ?, ?)
+	upsert, err := tx.Prepare(`
+		INSERT INTO peer_connections (system_id, peer_id, updated_at, reciprocal, observations)
+		VALUES (?1, ?2, ?3, EXISTS (SELECT 1 FROM peer_connections WHERE system_id = ?2 AND peer_id = ?1), ?4)
+		ON CONFLICT(system_id, peer_id) DO UPDATE SET
+			updated_at = excluded.updated_at,
+			reciprocal = excluded.reciprocal,
+			observations = observations + excluded.observations
 	`)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	defer upsert.Close()
 
-	for _, peerID := range peerIDs {
-		_, err = stmt.Exec(systemID.String(), peerID.String(), now)
-		if err != nil {
-			return err
+	markReverse, err := tx.Prepare(`UPDATE peer_connections SET reciprocal = 1 WHERE system_id = ? AND peer_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer markReverse.Close()
+
+	addObservations, err := tx.Prepare(`UPDATE peer_connections SET observations = observations + ? WHERE system_id = ? AND peer_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer addObservations.Close()
+
+	for system, edges := range updates {
+		for _, e := range edges {
+			if !e.touch {
+				if _, err := addObservations.Exec(e.observations, system.String(), e.peer.String()); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := upsert.Exec(system.String(), e.peer.String(), now.Unix(), e.observations); err != nil {
+				return err
+			}
+			if _, err := markReverse.Exec(e.peer.String(), system.String()); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -704,11 +1457,12 @@ func (s *Storage) SavePeerConnections(systemID uuid.UUID, peerIDs []uuid.UUID) e
 }
 
 // GetAllConnections returns all known connections for map visualization
+// Edges are directed (as reported); Reciprocal says the other end lists the link too
 func (s *Storage) GetAllConnections(maxAge time.Duration) ([]TopologyEdge, error) {
 	cutoff := time.Now().Add(-maxAge).Unix()
 
-	rows, err := s.db.Query(`
-		SELECT DISTINCT system_id, peer_id
+	rows, err := s.read.Query(`
+		SELECT system_id, peer_id, reciprocal, updated_at, observations
 		FROM peer_connections
 		WHERE updated_at > ?
 	`, cutoff)
@@ -717,220 +1471,2427 @@ func (s *Storage) GetAllConnections(maxAge time.Duration) ([]TopologyEdge, error
 	}
 	defer rows.Close()
 
-	edgeMap := make(map[string]TopologyEdge)
+	edges := []TopologyEdge{}
 
 	for rows.Next() {
 		var fromID, toID string
-		if err := rows.Scan(&fromID, &toID); err != nil {
+		var reciprocal bool
+		var updatedAt, observations int64
+		if err := rows.Scan(&fromID, &toID, &reciprocal, &updatedAt, &observations); err != nil {
 			continue
 		}
-
-		// Deduplicate A→B and B→A
-		var key string
-		if fromID < toID {
-			key = fromID + ":" + toID
-		} else {
-			key = toID + ":" + fromID
-		}
-
-		if _, exists := edgeMap[key]; !exists {
-			edgeMap[key] = TopologyEdge{
-				FromID:   fromID,
-				FromName: s.getSystemName(fromID),
-				ToID:     toID,
-				ToName:   s.getSystemName(toID),
-			}
-		}
-	}
-
-	edges := make([]TopologyEdge, 0, len(edgeMap))
-	for _, edge := range edgeMap {
-		edges = append(edges, edge)
+		edges = append(edges, TopologyEdge{
+			FromID:       fromID,
+			FromName:     s.getSystemName(fromID),
+			ToID:         toID,
+			ToName:       s.getSystemName(toID),
+			Reciprocal:   reciprocal,
+			LastEvidence: updatedAt,
+			EvidenceType: EdgeEvidenceGossip,
+			Observations: observations,
+		})
 	}
 
+	scoreEdges(edges, maxAge, time.Now())
 	return edges, nil
 }
 
-// PrunePeerConnections removes stale connection data
-func (s *Storage) PrunePeerConnections(maxAge time.Duration) (int64, error) {
+// GetPeerLinks returns, for every system in peer_connections updated within maxAge, the
+// distinct systems linked to it in either direction
+func (s *Storage) GetPeerLinks(maxAge time.Duration) (map[uuid.UUID]map[uuid.UUID]bool, error) {
 	cutoff := time.Now().Add(-maxAge).Unix()
-	result, err := s.db.Exec(`DELETE FROM peer_connections WHERE updated_at < ?`, cutoff)
+
+	rows, err := s.read.Query(`SELECT system_id, peer_id FROM peer_connections WHERE updated_at > ?`, cutoff)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return result.RowsAffected()
-}
+	defer rows.Close()
 
-// PrunePeerSystems removes stale peer system data
-// - Unverified systems (last_verified IS NULL): pruned after maxAge since updated_at
-// - Verified systems: pruned after 2x maxAge since last_verified
-func (s *Storage) PrunePeerSystems(maxAge time.Duration) (int64, error) {
-	unverifiedCutoff := time.Now().Add(-maxAge).Unix()
-	verifiedCutoff := time.Now().Add(-2 * maxAge).Unix() // Give verified systems more time
-	
-	result, err := s.db.Exec(`
-		DELETE FROM peer_systems 
-		WHERE (last_verified IS NULL AND updated_at < ?)
-		   OR (last_verified IS NOT NULL AND last_verified < ?)
-	`, unverifiedCutoff, verifiedCutoff)
-	if err != nil {
-		return 0, err
+	links := make(map[uuid.UUID]map[uuid.UUID]bool)
+	link := func(a, b uuid.UUID) {
+		if links[a] == nil {
+			links[a] = make(map[uuid.UUID]bool)
+		}
+		links[a][b] = true
 	}
-	return result.RowsAffected()
+	for rows.Next() {
+		var fromStr, toStr string
+		if err := rows.Scan(&fromStr, &toStr); err != nil {
+			continue
+		}
+		from, err1 := uuid.Parse(fromStr)
+		to, err2 := uuid.Parse(toStr)
+		if err1 != nil || err2 != nil || from == to {
+			continue
+		}
+		link(from, to)
+		link(to, from)
+	}
+	return links, rows.Err()
 }
 
-// TopologyEdge represents a connection between two systems
-type TopologyEdge struct {
-	FromID   string `json:"from_id"`
-	FromName string `json:"from_name"`
-	ToID     string `json:"to_id"`
-	ToName   string `json:"to_name"`
+// GetPeerLinksSpan returns when the oldest and newest peer_connections reports within maxAge
+// were made (both zero when there are none)
+func (s *Storage) GetPeerLinksSpan(maxAge time.Duration) (oldest, newest int64, err error) {
+	cutoff := time.Now().Add(-maxAge).Unix()
+	err = s.read.QueryRow(`
+		SELECT COALESCE(MIN(updated_at), 0), COALESCE(MAX(updated_at), 0)
+		FROM peer_connections WHERE updated_at > ?
+	`, cutoff).Scan(&oldest, &newest)
+	return oldest, newest, err
 }
 
-// getSystemName looks up a system name from peer_systems cache
-func (s *Storage) getSystemName(systemID string) string {
-	var name string
-	err := s.db.QueryRow(`SELECT name FROM peer_systems WHERE id = ?`, systemID).Scan(&name)
+// GetPeerClaimants returns the systems that reported peerID as one of their peers within maxAge
+func (s *Storage) GetPeerClaimants(peerID uuid.UUID, maxAge time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-maxAge).Unix()
+
+	rows, err := s.read.Query(`
+		SELECT system_id FROM peer_connections
+		WHERE peer_id = ? AND updated_at > ?
+		ORDER BY system_id
+	`, peerID.String(), cutoff)
 	if err != nil {
-		if len(systemID) >= 8 {
-			return systemID[:8] + "..."
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			continue
 		}
-		return systemID
+		ids = append(ids, id)
 	}
-	return name
+	return ids, rows.Err()
 }
 
-// =============================================================================
-// STELLAR CREDITS STORAGE
-// =============================================================================
-
-// GetCreditBalance retrieves the credit balance for a system
-func (s *Storage) GetCreditBalance(systemID uuid.UUID) (*CreditBalance, error) {
-	var balance CreditBalance
-	var updatedAt int64 // unused but needed for scan
-	err := s.db.QueryRow(`
-		SELECT system_id, balance, pending_credits, total_earned, total_sent, total_received, last_calculated, longevity_start, updated_at
-		FROM credit_balance WHERE system_id = ?
-	`, systemID.String()).Scan(
-		&balance.SystemID,
-		&balance.Balance,
-		&balance.PendingCredits,
-		&balance.TotalEarned,
-		&balance.TotalSent,
-		&balance.TotalReceived,
-		&balance.LastUpdated,
-		&balance.LongevityStart,
-		&updatedAt,
-	)
-	if err == sql.ErrNoRows {
-		// Return zero balance for new systems
-		return &CreditBalance{
-			SystemID:       systemID,
-			Balance:        0,
-			PendingCredits: 0,
-			TotalEarned:    0,
-			LastUpdated:    0,
-			LongevityStart: 0,
-		}, nil
+// TrimPeerConnections removes connections not reported since cutoff, then the least
+// recently reported beyond maxRows (see TrimOldest)
+func (s *Storage) TrimPeerConnections(maxRows, cutoff int64) (int64, error) {
+	pruned, _, err := s.TrimOldest("peer_connections", "updated_at", maxRows, cutoff, math.MaxInt64)
+	if err != nil || pruned == 0 {
+		return pruned, err
 	}
-	if err != nil {
-		return nil, err
+	s.connWrites.reset() // Rows past maxRows can be recent ones
+	if _, err := s.db.Exec(refreshReciprocalSQL); err != nil {
+		return pruned, err
 	}
-	return &balance, nil
+	return pruned, nil
 }
 
-// SaveCreditBalance persists a credit balance
-func (s *Storage) SaveCreditBalance(balance *CreditBalance) error {
-	_, err := s.db.Exec(`
-		INSERT INTO credit_balance (system_id, balance, pending_credits, total_earned, total_sent, total_received, last_calculated, longevity_start, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(system_id) DO UPDATE SET
-			balance = excluded.balance,
-			pending_credits = excluded.pending_credits,
-			total_earned = excluded.total_earned,
-			total_sent = excluded.total_sent,
-			total_received = excluded.total_received,
-			last_calculated = excluded.last_calculated,
-			longevity_start = excluded.longevity_start,
-			updated_at = excluded.updated_at
-	`, balance.SystemID.String(), balance.Balance, balance.PendingCredits, balance.TotalEarned,
-		balance.TotalSent, balance.TotalReceived, balance.LastUpdated, balance.LongevityStart, time.Now().Unix())
+// DeletePeerConnections removes every peer_connections row involving a system
+func (s *Storage) DeletePeerConnections(systemID uuid.UUID) error {
+	_, err := s.db.Exec(`DELETE FROM peer_connections WHERE system_id = ? OR peer_id = ?`,
+		systemID.String(), systemID.String())
+	s.connWrites.reset()
 	return err
 }
 
-// GetAttestationsSince retrieves attestations since a given timestamp
-// Returns attestations where this system was the receiver (for credit calculation)
-func (s *Storage) GetAttestationsSince(systemID uuid.UUID, since int64) ([]*Attestation, error) {
-	rows, err := s.db.Query(`
-		SELECT from_system_id, to_system_id, timestamp, message_type, signature, public_key
-		FROM attestations
-		WHERE received_by = ? AND timestamp > ?
-		ORDER BY timestamp ASC
-	`, systemID.String(), since)
+// RelinkPeerConnections moves an old identity's peer_connections rows to its successor
+// Rows the new ID already has win; leftovers and self-links are dropped
+func (s *Storage) RelinkPeerConnections(oldID, newID uuid.UUID) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var attestations []*Attestation
-	for rows.Next() {
-		var fromID, toID, msgType, sig, pubKey string
-		var timestamp int64
-		if err := rows.Scan(&fromID, &toID, &timestamp, &msgType, &sig, &pubKey); err != nil {
-			continue
+	for _, stmt := range []string{
+		`UPDATE OR IGNORE peer_connections SET system_id = ? WHERE system_id = ?`,
+		`UPDATE OR IGNORE peer_connections SET peer_id = ? WHERE peer_id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, newID.String(), oldID.String()); err != nil {
+			return err
 		}
+	}
+	if _, err := tx.Exec(`DELETE FROM peer_connections WHERE system_id = ?1 OR peer_id = ?1 OR system_id = peer_id`,
+		oldID.String()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(refreshReciprocalSQL); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.connWrites.reset()
+	return nil
+}
 
-		fromUUID, _ := uuid.Parse(fromID)
-		toUUID, _ := uuid.Parse(toID)
+// SaveBlockedSystem adds or replaces a block
+func (s *Storage) SaveBlockedSystem(b *BlockedSystem) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO blocked_systems (system_id, reason, blocked_at, expires_at)
+		VALUES (?, ?, ?, ?)
+	`, b.SystemID.String(), b.Reason, b.BlockedAt, b.ExpiresAt)
+	return err
+}
 
-		attestations = append(attestations, &Attestation{
-			FromSystemID: fromUUID,
-			ToSystemID:   toUUID,
-			Timestamp:    timestamp,
-			MessageType:  msgType,
-			Signature:    sig,
-			PublicKey:    pubKey,
-		})
+// SaveBootstrapPeers replaces the remembered bootstrap peer list
+func (s *Storage) SaveBootstrapPeers(addresses []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	return attestations, nil
+	if _, err := tx.Exec(`DELETE FROM bootstrap_peers`); err != nil {
+		return err
+	}
+	for i, address := range addresses {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO bootstrap_peers (address, position) VALUES (?, ?)`, address, i); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
+// SaveSeedCache replaces the cached seed list with one just fetched
+func (s *Storage) SaveSeedCache(addresses []string, fetchedAt int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM seed_cache`); err != nil {
+		return err
+	}
+	for i, address := range addresses {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO seed_cache (address, position, fetched_at) VALUES (?, ?, ?)`,
+			address, i, fetchedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSeedCache returns the cached seed list, in its fetched order, and when it was fetched
+func (s *Storage) GetSeedCache() ([]string, int64, error) {
+	rows, err := s.read.Query(`SELECT address, fetched_at FROM seed_cache ORDER BY position`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var addresses []string
+	var fetchedAt int64
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address, &fetchedAt); err != nil {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, fetchedAt, rows.Err()
+}
+
+// SavePersonalSeeds replaces the personal seed list
+func (s *Storage) SavePersonalSeeds(seeds []PersonalSeed) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM personal_seeds`); err != nil {
+		return err
+	}
+	for _, seed := range seeds {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO personal_seeds (system_id, address, days_seen, promoted_at) VALUES (?, ?, ?, ?)`,
+			seed.SystemID.String(), seed.Address, seed.DaysSeen, seed.PromotedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPersonalSeeds returns the personal seeds, most days seen first
+func (s *Storage) GetPersonalSeeds() ([]PersonalSeed, error) {
+	rows, err := s.read.Query(`SELECT system_id, address, days_seen, promoted_at FROM personal_seeds ORDER BY days_seen DESC, system_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var seeds []PersonalSeed
+	for rows.Next() {
+		var seed PersonalSeed
+		var id string
+		if err := rows.Scan(&id, &seed.Address, &seed.DaysSeen, &seed.PromotedAt); err != nil {
+			continue
+		}
+		if seed.SystemID, err = uuid.Parse(id); err != nil {
+			continue
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, rows.Err()
+}
+
+// GetLatestAttestations returns, per sender, when the newest verified attestation received
+// by receivedBy since the given Unix time was made (our clock)
+func (s *Storage) GetLatestAttestations(receivedBy uuid.UUID, since int64) (map[uuid.UUID]int64, error) {
+	rows, err := s.read.Query(`
+		SELECT from_system_id, MAX(timestamp - clock_skew)
+		FROM attestations
+		WHERE received_by = ? AND timestamp >= ? AND verified = 1
+		GROUP BY from_system_id
+	`, receivedBy.String(), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	latest := make(map[uuid.UUID]int64)
+	for rows.Next() {
+		var id string
+		var at int64
+		if err := rows.Scan(&id, &at); err != nil {
+			continue
+		}
+		if sysID, err := uuid.Parse(id); err == nil {
+			latest[sysID] = at
+		}
+	}
+	return latest, rows.Err()
+}
+
+// GetAttestationDays counts, per sender, the days since since on which it sent receivedBy
+// verified attestations, compacted days included
+func (s *Storage) GetAttestationDays(receivedBy uuid.UUID, since int64) (map[uuid.UUID]int, error) {
+	rows, err := s.read.Query(`
+		SELECT from_system_id, COUNT(DISTINCT day) FROM (
+			SELECT from_system_id, date(timestamp - clock_skew, 'unixepoch') AS day
+			FROM attestations
+			WHERE received_by = ?1 AND timestamp - clock_skew >= ?2 AND verified = 1
+			UNION
+			SELECT from_system_id, day
+			FROM attestation_summaries
+			WHERE received_by = ?1 AND last_timestamp >= ?2
+		)
+		GROUP BY from_system_id
+	`, receivedBy.String(), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make(map[uuid.UUID]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			continue
+		}
+		if sysID, err := uuid.Parse(id); err == nil {
+			days[sysID] = n
+		}
+	}
+	return days, rows.Err()
+}
+
+// GetBootstrapPeers returns the remembered bootstrap peer list, in the order it was given
+func (s *Storage) GetBootstrapPeers() ([]string, error) {
+	rows, err := s.read.Query(`SELECT address FROM bootstrap_peers ORDER BY position`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addresses []string
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			continue
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
+
+// LogAddressConflict records two systems claiming one address
+// A pair already logged and still unresolved isn't logged again
+func (s *Storage) LogAddressConflict(address string, systemID, otherID uuid.UUID) error {
+	_, err := s.db.Exec(`
+		INSERT INTO address_conflicts (address, system_id, other_id, detected_at)
+		SELECT ?1, ?2, ?3, ?4
+		WHERE NOT EXISTS (
+			SELECT 1 FROM address_conflicts
+			WHERE address = ?1 AND resolved_at = 0
+			AND ((system_id = ?2 AND other_id = ?3) OR (system_id = ?3 AND other_id = ?2))
+		)
+	`, address, systemID.String(), otherID.String(), time.Now().Unix())
+	return err
+}
+
+// ResolveAddressConflicts closes the open conflicts at address in favor of keptID
+func (s *Storage) ResolveAddressConflicts(address string, keptID uuid.UUID) error {
+	_, err := s.db.Exec(`
+		UPDATE address_conflicts SET resolved_at = ?, kept_id = ?
+		WHERE address = ? AND resolved_at = 0
+	`, time.Now().Unix(), keptID.String(), address)
+	return err
+}
+
+// PruneAddressConflicts deletes conflicts resolved more than maxAge ago
+func (s *Storage) PruneAddressConflicts(maxAge time.Duration) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM address_conflicts WHERE resolved_at > 0 AND resolved_at < ?`,
+		time.Now().Add(-maxAge).Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteBlockedSystem removes a block, returning whether one existed
+func (s *Storage) DeleteBlockedSystem(systemID uuid.UUID) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM blocked_systems WHERE system_id = ?`, systemID.String())
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// GetBlockedSystems returns blocks that have not expired
+func (s *Storage) GetBlockedSystems() ([]*BlockedSystem, error) {
+	rows, err := s.read.Query(`
+		SELECT system_id, reason, blocked_at, expires_at FROM blocked_systems
+		WHERE expires_at = 0 OR expires_at > ?
+	`, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blocked []*BlockedSystem
+	for rows.Next() {
+		var idStr string
+		var b BlockedSystem
+		if err := rows.Scan(&idStr, &b.Reason, &b.BlockedAt, &b.ExpiresAt); err != nil {
+			continue
+		}
+		id, err := uuid.Parse(idStr)
+		if err != nil {
+			continue
+		}
+		b.SystemID = id
+		blocked = append(blocked, &b)
+	}
+
+	return blocked, nil
+}
+
+// PruneExpiredBlocks removes temporary blocks that have run out
+func (s *Storage) PruneExpiredBlocks() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM blocked_systems WHERE expires_at > 0 AND expires_at <= ?`, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SavePeerAnnotation creates or replaces the annotation on a system
+// Tags are stored comma-separated (normalizeAnnotation keeps commas out of them)
+func (s *Storage) SavePeerAnnotation(a *PeerAnnotation) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO peer_annotations (system_id, note, tags, color, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, a.SystemID.String(), a.Note, strings.Join(a.Tags, ","), a.Color, a.UpdatedAt)
+	return err
+}
+
+// DeletePeerAnnotation removes the annotation on a system, returning whether there was one
+func (s *Storage) DeletePeerAnnotation(systemID uuid.UUID) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM peer_annotations WHERE system_id = ?`, systemID.String())
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// GetPeerAnnotation returns the annotation on a system, or nil if it has none
+func (s *Storage) GetPeerAnnotation(systemID uuid.UUID) (*PeerAnnotation, error) {
+	rows, err := s.read.Query(`
+		SELECT system_id, note, tags, color, updated_at FROM peer_annotations WHERE system_id = ?
+	`, systemID.String())
+	if err != nil {
+		return nil, err
+	}
+	annotations, err := scanPeerAnnotations(rows)
+	if err != nil || len(annotations) == 0 {
+		return nil, err
+	}
+	return annotations[0], nil
+}
+
+// GetPeerAnnotations returns every annotation, whether or not its system is still cached
+func (s *Storage) GetPeerAnnotations() ([]*PeerAnnotation, error) {
+	rows, err := s.read.Query(`SELECT system_id, note, tags, color, updated_at FROM peer_annotations`)
+	if err != nil {
+		return nil, err
+	}
+	return scanPeerAnnotations(rows)
+}
+
+// scanPeerAnnotations reads peer_annotations rows and closes them
+func scanPeerAnnotations(rows *sql.Rows) ([]*PeerAnnotation, error) {
+	defer rows.Close()
+
+	annotations := []*PeerAnnotation{}
+	for rows.Next() {
+		var idStr, tags string
+		a := &PeerAnnotation{Tags: []string{}}
+		if err := rows.Scan(&idStr, &a.Note, &tags, &a.Color, &a.UpdatedAt); err != nil {
+			continue
+		}
+		id, err := uuid.Parse(idStr)
+		if err != nil {
+			continue
+		}
+		a.SystemID = id
+		if tags != "" {
+			a.Tags = strings.Split(tags, ",")
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
+
+// saveGenesisDemotionSQL keeps the first record of a system's demotion; it only happens once
+const saveGenesisDemotionSQL = `
+	INSERT OR IGNORE INTO genesis_demotions (system_id, winner_id, demoted_at, signature) VALUES (?, ?, ?, ?)`
+
+func genesisDemotionArgs(d *GenesisDemotion) []interface{} {
+	return []interface{}{d.SystemID.String(), d.WinnerID.String(), d.DemotedAt, d.Signature}
+}
+
+// SaveGenesisDemotion stores a former genesis' demotion record
+func (s *Storage) SaveGenesisDemotion(d *GenesisDemotion) error {
+	_, err := s.db.Exec(saveGenesisDemotionSQL, genesisDemotionArgs(d)...)
+	return err
+}
+
+// GetGenesisDemotion returns a system's demotion record, or nil if it never was a genesis that stepped down
+func (s *Storage) GetGenesisDemotion(systemID uuid.UUID) (*GenesisDemotion, error) {
+	demotions, err := s.queryGenesisDemotions(`WHERE system_id = ?`, systemID.String())
+	if err != nil {
+		return nil, err
+	}
+	return demotions[systemID], nil
+}
+
+// GetGenesisDemotions returns every stored demotion record by system
+func (s *Storage) GetGenesisDemotions() (map[uuid.UUID]*GenesisDemotion, error) {
+	return s.queryGenesisDemotions(``)
+}
+
+func (s *Storage) queryGenesisDemotions(where string, args ...interface{}) (map[uuid.UUID]*GenesisDemotion, error) {
+	rows, err := s.read.Query(`SELECT system_id, winner_id, demoted_at, signature FROM genesis_demotions `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	demotions := make(map[uuid.UUID]*GenesisDemotion)
+	for rows.Next() {
+		var idStr, winnerStr string
+		d := &GenesisDemotion{}
+		if err := rows.Scan(&idStr, &winnerStr, &d.DemotedAt, &d.Signature); err != nil {
+			continue
+		}
+		var errID, errWinner error
+		d.SystemID, errID = uuid.Parse(idStr)
+		d.WinnerID, errWinner = uuid.Parse(winnerStr)
+		if errID != nil || errWinner != nil {
+			continue
+		}
+		demotions[d.SystemID] = d
+	}
+	return demotions, rows.Err()
+}
+
+// SaveBandwidthUsage records a day's DHT bytes, dropping days past BandwidthHistoryDays
+func (s *Storage) SaveBandwidthUsage(day string, sent, received int64) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO bandwidth_usage (day, bytes_sent, bytes_received) VALUES (?, ?, ?)
+	`, day, sent, received)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().AddDate(0, 0, -BandwidthHistoryDays).Format(time.DateOnly)
+	_, err = s.db.Exec(`DELETE FROM bandwidth_usage WHERE day < ?`, cutoff)
+	return err
+}
+
+// GetBandwidthUsage returns a day's DHT bytes, zero if none were recorded
+func (s *Storage) GetBandwidthUsage(day string) (int64, int64, error) {
+	var sent, received int64
+	err := s.read.QueryRow(`
+		SELECT bytes_sent, bytes_received FROM bandwidth_usage WHERE day = ?
+	`, day).Scan(&sent, &received)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return sent, received, err
+}
+
+// AddPeerTraffic adds flushed message counts to each peer's bucket for hour, by peer key
+// (a UUID, or a remote IP; see peer_traffic.go)
+func (s *Storage) AddPeerTraffic(hour int64, peers map[string]TrafficHour) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upsert, err := tx.Prepare(`
+		INSERT INTO peer_traffic (peer_id, hour, direction, ping, find_node, announce, other, responses, errors, rejected, bytes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(peer_id, hour, direction) DO UPDATE SET
+			ping = ping + excluded.ping,
+			find_node = find_node + excluded.find_node,
+			announce = announce + excluded.announce,
+			other = other + excluded.other,
+			responses = responses + excluded.responses,
+			errors = errors + excluded.errors,
+			rejected = rejected + excluded.rejected,
+			bytes = bytes + excluded.bytes
+	`)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+
+	for peer, t := range peers {
+		for direction, c := range map[string]MessageCounts{TrafficInbound: t.In, TrafficOutbound: t.Out} {
+			if c == (MessageCounts{}) {
+				continue
+			}
+			if _, err := upsert.Exec(peer, hour, direction,
+				c.Ping, c.FindNode, c.Announce, c.Other, c.Responses, c.Errors, c.Rejected, c.Bytes); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPeerTraffic returns a peer's hourly message counts from since on, oldest first
+func (s *Storage) GetPeerTraffic(peer string, since int64) ([]TrafficHour, error) {
+	rows, err := s.read.Query(`
+		SELECT hour, direction, ping, find_node, announce, other, responses, errors, rejected, bytes
+		FROM peer_traffic WHERE peer_id = ? AND hour >= ?
+		ORDER BY hour
+	`, peer, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours []TrafficHour
+	for rows.Next() {
+		var hour int64
+		var direction string
+		var c MessageCounts
+		if err := rows.Scan(&hour, &direction, &c.Ping, &c.FindNode, &c.Announce, &c.Other,
+			&c.Responses, &c.Errors, &c.Rejected, &c.Bytes); err != nil {
+			return nil, err
+		}
+		if len(hours) == 0 || hours[len(hours)-1].Hour != hour {
+			hours = append(hours, TrafficHour{Hour: hour})
+		}
+		if direction == TrafficInbound {
+			hours[len(hours)-1].In = c
+		} else {
+			hours[len(hours)-1].Out = c
+		}
+	}
+	return hours, rows.Err()
+}
+
+// PrunePeerSystems removes stale peer system data
+// - Unverified systems (last_verified IS NULL): pruned after maxAge since updated_at
+// - Verified systems: pruned after 2x maxAge since last_verified
+func (s *Storage) PrunePeerSystems(maxAge time.Duration) (int64, error) {
+	unverifiedCutoff := time.Now().Add(-maxAge).Unix()
+	verifiedCutoff := time.Now().Add(-2 * maxAge).Unix() // Give verified systems more time
+	
+	result, err := s.db.Exec(`
+		DELETE FROM peer_systems 
+		WHERE (last_verified IS NULL AND updated_at < ?)
+		   OR (last_verified IS NOT NULL AND last_verified < ?)
+	`, unverifiedCutoff, verifiedCutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// TrimPeerSystems removes the least recently seen systems beyond maxRows, with their
+// peer_connections rows (which would otherwise point at nothing). Systems seen at or
+// after floor are kept regardless. Returns the removed IDs and how many rows the floor
+// kept past the cap
+func (s *Storage) TrimPeerSystems(maxRows, floor int64) ([]uuid.UUID, int64, error) {
+	var count int64
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM peer_systems").Scan(&count); err != nil {
+		return nil, 0, err
+	}
+	excess := count - maxRows
+	if maxRows <= 0 || excess <= 0 {
+		return nil, 0, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id FROM peer_systems
+		WHERE COALESCE(last_verified, updated_at) < ?
+		ORDER BY COALESCE(last_verified, updated_at)
+		LIMIT ?
+	`, floor, excess)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ids []uuid.UUID
+	for rows.Next() {
+		var idStr string
+		if err := rows.Scan(&idStr); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		if id, err := uuid.Parse(idStr); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`DELETE FROM peer_systems WHERE id = ?`, id.String()); err != nil {
+			return nil, 0, err
+		}
+		if _, err := tx.Exec(`DELETE FROM peer_connections WHERE system_id = ? OR peer_id = ?`, id.String(), id.String()); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(ids) > 0 {
+		if _, err := tx.Exec(refreshReciprocalSQL); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	if len(ids) > 0 {
+		s.connWrites.reset()
+	}
+	return ids, excess - int64(len(ids)), nil
+}
+
+// CountRows returns how many rows a table holds
+func (s *Storage) CountRows(table string) (int64, error) {
+	var n int64
+	err := s.read.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+	return n, err
+}
+
+// TrimOldest deletes a table's rows older than cutoff (0: no age limit), then its oldest
+// rows beyond maxRows (0: no cap), going by column (a column or expression holding a
+// unix time). Rows at or after floor are never deleted. Returns the rows removed and
+// how many are still past a limit because of the floor
+func (s *Storage) TrimOldest(table, column string, maxRows, cutoff, floor int64) (removed, held int64, err error) {
+	if cutoff > 0 {
+		result, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s < ? AND %s < ?", table, column, column), cutoff, floor)
+		if err != nil {
+			return 0, 0, err
+		}
+		removed, _ = result.RowsAffected()
+		if err := s.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s < ?", table, column), cutoff).Scan(&held); err != nil {
+			return removed, 0, err
+		}
+	}
+	if maxRows <= 0 {
+		return removed, held, nil
+	}
+
+	var count int64
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+		return removed, held, err
+	}
+	excess := count - maxRows
+	if excess <= 0 {
+		return removed, held, nil
+	}
+	result, err := s.db.Exec(fmt.Sprintf(`
+		DELETE FROM %[1]s WHERE rowid IN (
+			SELECT rowid FROM %[1]s WHERE %[2]s < ? ORDER BY %[2]s LIMIT ?
+		)`, table, column), floor, excess)
+	if err != nil {
+		return removed, held, err
+	}
+	n, _ := result.RowsAffected()
+	removed += n
+	if excess-n > held {
+		held = excess - n
+	}
+	return removed, held, nil
+}
+
+// What a topology edge's newest evidence was
+const (
+	EdgeEvidenceAttestation = "attestation" // A signed attestation the peer sent us
+	EdgeEvidenceDirect      = "direct"      // Our own verified contact with a routing table peer
+	EdgeEvidenceGossip      = "gossip"      // The system listed the peer in an announce (peer_connections)
+)
+
+// EdgeRecentEvidence is how new the reverse edge's evidence must be for an edge to count
+// as confirmed both ways when scoring it
+const EdgeRecentEvidence = 15 * time.Minute
+
+// TopologyEdge represents a connection between two systems
+type TopologyEdge struct {
+	FromID   string `json:"from_id"`
+	FromName string `json:"from_name"`
+	ToID     string `json:"to_id"`
+	ToName   string `json:"to_name"`
+
+	// Both systems list each other (or it's us and a routing table peer)
+	Reciprocal bool `json:"reciprocal"`
+
+	LastEvidence int64   `json:"last_evidence,omitempty"` // Unix time of the newest evidence for the edge
+	EvidenceType string  `json:"evidence_type,omitempty"` // EdgeEvidence* kind of that evidence
+	Strength     float64 `json:"strength"`                // 0-1, from the evidence's age and whether both directions have recent evidence
+	Observations int64   `json:"observations,omitempty"`  // Times the system reported the peer (peer_connections edges only; approximate)
+}
+
+// addEvidence records evidence for the edge if it's newer than what the edge has
+func (e *TopologyEdge) addEvidence(at int64, kind string) {
+	if at > e.LastEvidence {
+		e.LastEvidence = at
+		e.EvidenceType = kind
+	}
+}
+
+// scoreEdges sets each edge's strength: 1 for evidence from just now, falling to 0 at
+// maxAge, and 60% of that unless the reverse edge has evidence within EdgeRecentEvidence
+func scoreEdges(edges []TopologyEdge, maxAge time.Duration, now time.Time) {
+	latest := make(map[string]int64, len(edges))
+	for _, e := range edges {
+		latest[e.FromID+":"+e.ToID] = e.LastEvidence
+	}
+	recent := now.Add(-EdgeRecentEvidence).Unix()
+
+	for i := range edges {
+		e := &edges[i]
+		strength := 1 - float64(now.Sub(time.Unix(e.LastEvidence, 0)))/float64(maxAge)
+		strength = math.Max(0, math.Min(1, strength))
+		if latest[e.ToID+":"+e.FromID] < recent {
+			strength *= 0.6
+		}
+		e.Strength = math.Round(strength*100) / 100
+	}
+}
+
+// getSystemName looks up a system name from peer_systems cache
+func (s *Storage) getSystemName(systemID string) string {
+	var name string
+	err := s.read.QueryRow(`SELECT name FROM peer_systems WHERE id = ?`, systemID).Scan(&name)
+	if err != nil {
+		if len(systemID) >= 8 {
+			return systemID[:8] + "..."
+		}
+		return systemID
+	}
+	// Stored as signed; quarantined names are only ever shown cleaned up
+	return displayName(name, systemID)
+}
+
+// =============================================================================
+// STELLAR CREDITS STORAGE
+// =============================================================================
+
+// GetCreditBalance retrieves the credit balance for a system
+func (s *Storage) GetCreditBalance(systemID uuid.UUID) (*CreditBalance, error) {
+	var balance CreditBalance
+	var updatedAt int64 // unused but needed for scan
+	err := s.read.QueryRow(`
+		SELECT system_id, balance, pending_credits, total_earned, total_sent, total_received, last_calculated, longevity_start, updated_at
+		FROM credit_balance WHERE system_id = ?
+	`, systemID.String()).Scan(
+		&balance.SystemID,
+		&balance.Balance,
+		&balance.PendingCredits,
+		&balance.TotalEarned,
+		&balance.TotalSent,
+		&balance.TotalReceived,
+		&balance.LastUpdated,
+		&balance.LongevityStart,
+		&updatedAt,
+	)
+	if err == sql.ErrNoRows {
+		// Return zero balance for new systems
+		return &CreditBalance{
+			SystemID:       systemID,
+			Balance:        0,
+			PendingCredits: 0,
+			TotalEarned:    0,
+			LastUpdated:    0,
+			LongevityStart: 0,
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &balance, nil
+}
+
+// SaveCreditBalance persists a credit balance
+func (s *Storage) SaveCreditBalance(balance *CreditBalance) error {
+	return upsertCreditBalance(s.db, balance)
+}
+
+// sqlExecer is what both *sql.DB and *sql.Tx offer for statements without results
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// upsertCreditBalance writes a credit balance with db or within a transaction
+func upsertCreditBalance(db sqlExecer, balance *CreditBalance) error {
+	_, err := db.Exec(`
+		INSERT INTO credit_balance (system_id, balance, pending_credits, total_earned, total_sent, total_received, last_calculated, longevity_start, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(system_id) DO UPDATE SET
+			balance = excluded.balance,
+			pending_credits = excluded.pending_credits,
+			total_earned = excluded.total_earned,
+			total_sent = excluded.total_sent,
+			total_received = excluded.total_received,
+			last_calculated = excluded.last_calculated,
+			longevity_start = excluded.longevity_start,
+			updated_at = excluded.updated_at
+	`, balance.SystemID.String(), balance.Balance, balance.PendingCredits, balance.TotalEarned,
+		balance.TotalSent, balance.TotalReceived, balance.LastUpdated, balance.LongevityStart, time.Now().Unix())
+	return err
+}
+
+// SaveCreditEarning records the breakdown of one credit calculation
+func (s *Storage) SaveCreditEarning(e *CreditEarning) error {
+	return insertCreditEarning(s.db, e)
+}
+
+// insertCreditEarning writes a credit earnings row with db or within a transaction
+func insertCreditEarning(db sqlExecer, e *CreditEarning) error {
+	_, err := db.Exec(`
+		INSERT INTO credit_earnings (calculated_at, cycles, base, bridge, longevity, pioneer, reciprocity, earned, peer_count, galaxy_size,
+			bridge_score, reciprocity_ratio, avg_connectivity, service, window_start, window_end)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, e.CalculatedAt, e.Cycles, e.Base, e.Bonuses.Bridge, e.Bonuses.Longevity, e.Bonuses.Pioneer,
+		e.Bonuses.Reciprocity, e.Earned, e.PeerCount, e.GalaxySize, e.BridgeScore, e.ReciprocityRatio, e.AvgConnectivity, e.Service,
+		e.WindowStart, e.WindowEnd)
+	return err
+}
+
+// CommitCreditCalculation saves a credit calculation in one transaction: the balance,
+// with last_calculated advanced past the window, and its earnings row. A window is known
+// by where it starts, so one starting anywhere but the stored last_calculated (committed
+// already, or overtaken by a later one) changes nothing, and false is returned
+func (s *Storage) CommitCreditCalculation(windowStart int64, balance *CreditBalance, earning *CreditEarning) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var lastCalculated int64
+	err = tx.QueryRow("SELECT last_calculated FROM credit_balance WHERE system_id = ?",
+		balance.SystemID.String()).Scan(&lastCalculated)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if lastCalculated != windowStart {
+		return false, nil
+	}
+
+	if err := upsertCreditBalance(tx, balance); err != nil {
+		return false, fmt.Errorf("failed to save credit balance: %w", err)
+	}
+	if err := insertCreditEarning(tx, earning); err != nil {
+		return false, fmt.Errorf("failed to save credit breakdown: %w", err)
+	}
+	return true, tx.Commit()
+}
+
+// GetCreditEarnings returns the credit calculations since a Unix time, oldest first
+func (s *Storage) GetCreditEarnings(since int64) ([]*CreditEarning, error) {
+	rows, err := s.read.Query(`
+		SELECT calculated_at, cycles, base, bridge, longevity, pioneer, reciprocity, earned, peer_count, galaxy_size,
+			bridge_score, reciprocity_ratio, avg_connectivity, service, window_start, window_end
+		FROM credit_earnings
+		WHERE calculated_at >= ?
+		ORDER BY calculated_at, id
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var earnings []*CreditEarning
+	for rows.Next() {
+		var e CreditEarning
+		if err := rows.Scan(&e.CalculatedAt, &e.Cycles, &e.Base, &e.Bonuses.Bridge, &e.Bonuses.Longevity,
+			&e.Bonuses.Pioneer, &e.Bonuses.Reciprocity, &e.Earned, &e.PeerCount, &e.GalaxySize,
+			&e.BridgeScore, &e.ReciprocityRatio, &e.AvgConnectivity, &e.Service, &e.WindowStart, &e.WindowEnd); err != nil {
+			return nil, err
+		}
+		e.Bonuses.Total = e.Bonuses.Bridge + e.Bonuses.Longevity + e.Bonuses.Pioneer + e.Bonuses.Reciprocity
+		earnings = append(earnings, &e)
+	}
+	return earnings, rows.Err()
+}
+
+// CompactCreditEarnings rolls the credit calculations of each UTC day older than keepDays
+// into a single row: credits are summed, and bonuses and the recorded inputs are
+// averaged over the day's cycles (so rolling up an already rolled-up day is harmless)
+// Returns the number of rows removed
+func (s *Storage) CompactCreditEarnings(keepDays int) (int64, error) {
+	if keepDays < 1 {
+		return 0, fmt.Errorf("keepDays must be at least 1, got %d", keepDays)
+	}
+	cutoff := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -keepDays).Unix()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TEMP TABLE compact_credit_days AS
+		SELECT calculated_at / 86400 AS day FROM credit_earnings
+		WHERE calculated_at < ?
+		GROUP BY day HAVING COUNT(*) > 1
+	`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select credit earnings: %w", err)
+	}
+
+	// Rows up to here are the originals; the rollups get higher IDs
+	var lastID int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM credit_earnings").Scan(&lastID); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO credit_earnings (calculated_at, cycles, base, bridge, longevity, pioneer, reciprocity, earned, peer_count, galaxy_size,
+			bridge_score, reciprocity_ratio, avg_connectivity, service, window_start, window_end)
+		SELECT MIN(calculated_at), SUM(cycles), SUM(base),
+			SUM(bridge * cycles) / SUM(cycles), SUM(longevity * cycles) / SUM(cycles),
+			SUM(pioneer * cycles) / SUM(cycles), SUM(reciprocity * cycles) / SUM(cycles),
+			SUM(earned),
+			CAST(ROUND(SUM(peer_count * cycles) * 1.0 / SUM(cycles)) AS INTEGER),
+			CAST(ROUND(SUM(galaxy_size * cycles) * 1.0 / SUM(cycles)) AS INTEGER),
+			SUM(bridge_score * cycles) / SUM(cycles), SUM(reciprocity_ratio * cycles) / SUM(cycles),
+			SUM(avg_connectivity * cycles) / SUM(cycles), SUM(service), MIN(window_start), MAX(window_end)
+		FROM credit_earnings
+		WHERE calculated_at / 86400 IN (SELECT day FROM compact_credit_days)
+		GROUP BY calculated_at / 86400
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to summarize credit earnings: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		DELETE FROM credit_earnings
+		WHERE id <= ? AND calculated_at / 86400 IN (SELECT day FROM compact_credit_days)
+	`, lastID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete credit earnings: %w", err)
+	}
+	removed, _ := result.RowsAffected()
+
+	if _, err := tx.Exec("DROP TABLE temp.compact_credit_days"); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// GetUptimeHistogram counts attestations received by a system per time bucket, grouped in SQL
+// Each bucket also carries its earliest and latest attestation for gap analysis.
+// Compacted summaries are added to the bucket holding their first attestation.
+// Times are our clock's (corrected for each signer's skew)
+func (s *Storage) GetUptimeHistogram(systemID uuid.UUID, bucket time.Duration, since time.Time) ([]UptimeBucket, error) {
+	bucketSec := int64(bucket.Seconds())
+	if bucketSec <= 0 {
+		return nil, fmt.Errorf("bucket must be at least one second, got %s", bucket)
+	}
+
+	rows, err := s.read.Query(`
+		SELECT bucket, SUM(n), MIN(first), MAX(last) FROM (
+			SELECT (timestamp - clock_skew) / ?1 AS bucket, COUNT(*) AS n,
+				MIN(timestamp - clock_skew) AS first, MAX(timestamp - clock_skew) AS last
+			FROM attestations
+			WHERE received_by = ?2 AND timestamp - clock_skew >= ?3 AND verified = 1
+			GROUP BY bucket
+			UNION ALL
+			SELECT first_timestamp / ?1, attestation_count, first_timestamp, last_timestamp
+			FROM attestation_summaries
+			WHERE received_by = ?2 AND last_timestamp >= ?3
+		)
+		GROUP BY bucket
+		ORDER BY bucket ASC
+	`, bucketSec, systemID.String(), since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []UptimeBucket
+	for rows.Next() {
+		var b UptimeBucket
+		var index int64
+		if err := rows.Scan(&index, &b.Count, &b.First, &b.Last); err != nil {
+			return nil, err
+		}
+		b.Start = index * bucketSec
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// GetAttestationSpansSince retrieves compacted per-peer daily summaries that end after since
+// These stand in for attestations GetAttestationsSince no longer has after compaction
+func (s *Storage) GetAttestationSpansSince(systemID uuid.UUID, since int64) ([]*AttestationSpan, error) {
+	rows, err := s.read.Query(`
+		SELECT from_system_id, attestation_count, first_timestamp, last_timestamp
+		FROM attestation_summaries
+		WHERE received_by = ? AND last_timestamp > ?
+		ORDER BY first_timestamp ASC
+	`, systemID.String(), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var spans []*AttestationSpan
+	for rows.Next() {
+		var fromID string
+		var span AttestationSpan
+		if err := rows.Scan(&fromID, &span.Count, &span.First, &span.Last); err != nil {
+			continue
+		}
+		span.FromSystemID, _ = uuid.Parse(fromID)
+		spans = append(spans, &span)
+	}
+
+	return spans, nil
+}
+
+// AttestationExchange counts verified attestations between us and one peer
+type AttestationExchange struct {
+	Received int `json:"received"` // Signed by the peer, received by us
+	Sent     int `json:"sent"`     // Signed by us, received by the peer
+}
+
+// GetAttestationExchange counts attestations between localID and peerID since a unix time,
+// grouped by signer and receiver. Compacted summaries are included.
+// A node only stores what it receives, so Sent is zero unless the rows came from elsewhere.
+func (s *Storage) GetAttestationExchange(localID, peerID uuid.UUID, since int64) (AttestationExchange, error) {
+	var ex AttestationExchange
+
+	rows, err := s.read.Query(`
+		SELECT from_system_id, SUM(n) FROM (
+			SELECT from_system_id, received_by, COUNT(*) AS n FROM attestations
+			WHERE verified = 1 AND timestamp > ?1
+			AND ((from_system_id = ?2 AND received_by = ?3) OR (from_system_id = ?3 AND received_by = ?2))
+			GROUP BY from_system_id, received_by
+			UNION ALL
+			SELECT from_system_id, received_by, SUM(attestation_count) FROM attestation_summaries
+			WHERE last_timestamp > ?1
+			AND ((from_system_id = ?2 AND received_by = ?3) OR (from_system_id = ?3 AND received_by = ?2))
+			GROUP BY from_system_id, received_by
+		) GROUP BY from_system_id, received_by
+	`, since, peerID.String(), localID.String())
+	if err != nil {
+		return ex, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var fromID string
+		var n int
+		if err := rows.Scan(&fromID, &n); err != nil {
+			return ex, err
+		}
+		if fromID == peerID.String() {
+			ex.Received += n
+		} else {
+			ex.Sent += n
+		}
+	}
+	return ex, rows.Err()
+}
+
+// GetAttestationsSince retrieves attestations since a given timestamp
+// Returns attestations where this system was the receiver (for credit calculation), only
+// ones whose signature and key checked out when they were saved, so they aren't checked again
+// Untargeted (legacy) ones count here in full: received_by is our own record
+func (s *Storage) GetAttestationsSince(systemID uuid.UUID, since int64) ([]*Attestation, error) {
+	rows, err := s.read.Query(`
+		SELECT from_system_id, to_system_id, timestamp, message_type, signature, public_key, clock_skew, nonce, received_by
+		FROM attestations
+		WHERE received_by = ? AND verified = 1 AND timestamp - clock_skew > ?
+		ORDER BY timestamp - clock_skew ASC
+	`, systemID.String(), since)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttestations(rows)
+}
+
+// GetServiceReceiptsSince returns the service receipts other systems sent systemID (and it
+// received) since a Unix time by our clock, oldest first. Only ones whose signature and
+// key checked out on arrival are returned (see service_receipts.go)
+func (s *Storage) GetServiceReceiptsSince(systemID uuid.UUID, since int64) ([]*Attestation, error) {
+	rows, err := s.read.Query(`
+		SELECT from_system_id, to_system_id, timestamp, message_type, signature, public_key, clock_skew, nonce, received_by
+		FROM attestations
+		WHERE to_system_id = ?1 AND received_by = ?1 AND from_system_id != ?1
+		  AND verified = 1 AND message_type IN (?2, ?3) AND timestamp - clock_skew > ?4
+		ORDER BY timestamp - clock_skew ASC
+	`, systemID.String(), AttestationFullSyncServed, AttestationDiscoveryServed, since)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttestations(rows)
+}
+
+// GetRecentAttestationsForSystem returns up to limit attestations other systems sent to
+// systemID (and it received) before the given time, newest first, untargeted (legacy) ones
+// included. Only ones whose signature checked out on arrival are returned: this is what
+// credit proofs page through
+func (s *Storage) GetRecentAttestationsForSystem(systemID uuid.UUID, limit int, before int64) ([]*Attestation, error) {
+	// Targeted and untargeted ones each read newest first from the index, then merged
+	rows, err := s.read.Query(`
+		SELECT * FROM (
+			SELECT from_system_id, to_system_id, timestamp, message_type, signature, public_key, clock_skew, nonce, received_by
+			FROM attestations
+			WHERE to_system_id = ?1 AND received_by = ?1 AND from_system_id != ?1
+			  AND verified = 1 AND timestamp < ?2
+			ORDER BY timestamp DESC
+			LIMIT ?3
+		)
+		UNION ALL
+		SELECT * FROM (
+			SELECT from_system_id, to_system_id, timestamp, message_type, signature, public_key, clock_skew, nonce, received_by
+			FROM attestations
+			WHERE to_system_id = ?4 AND received_by = ?1 AND from_system_id != ?1
+			  AND verified = 1 AND timestamp < ?2
+			ORDER BY timestamp DESC
+			LIMIT ?3
+		)
+		ORDER BY timestamp DESC
+		LIMIT ?3
+	`, systemID.String(), before, limit, uuid.Nil.String())
+	if err != nil {
+		return nil, err
+	}
+	return scanAttestations(rows)
+}
+
+// GetOldestAttestationForSystem returns the oldest attestation GetRecentAttestationsForSystem
+// would return, or nil if there is none
+func (s *Storage) GetOldestAttestationForSystem(systemID uuid.UUID) (*Attestation, error) {
+	rows, err := s.read.Query(`
+		SELECT * FROM (
+			SELECT from_system_id, to_system_id, timestamp, message_type, signature, public_key, clock_skew, nonce, received_by
+			FROM attestations
+			WHERE to_system_id = ?1 AND received_by = ?1 AND from_system_id != ?1 AND verified = 1
+			ORDER BY timestamp ASC
+			LIMIT 1
+		)
+		UNION ALL
+		SELECT * FROM (
+			SELECT from_system_id, to_system_id, timestamp, message_type, signature, public_key, clock_skew, nonce, received_by
+			FROM attestations
+			WHERE to_system_id = ?2 AND received_by = ?1 AND from_system_id != ?1 AND verified = 1
+			ORDER BY timestamp ASC
+			LIMIT 1
+		)
+		ORDER BY timestamp ASC
+		LIMIT 1
+	`, systemID.String(), uuid.Nil.String())
+	if err != nil {
+		return nil, err
+	}
+	attestations, err := scanAttestations(rows)
+	if err != nil || len(attestations) == 0 {
+		return nil, err
+	}
+	return attestations[0], nil
+}
+
+// CountAttestersForSystem returns how many distinct systems have attested to systemID
+func (s *Storage) CountAttestersForSystem(systemID uuid.UUID) (int, error) {
+	var n int
+	err := s.read.QueryRow(`
+		SELECT COUNT(DISTINCT from_system_id) FROM attestations
+		WHERE received_by = ?1 AND from_system_id != ?1
+	`, systemID.String()).Scan(&n)
+	return n, err
+}
+
+// scanAttestations reads attestation rows (from_system_id, to_system_id, timestamp,
+// message_type, signature, public_key, clock_skew, nonce, received_by) and closes them
+// Untargeted ones carry who received them, for credit proofs
+func scanAttestations(rows *sql.Rows) ([]*Attestation, error) {
+	defer rows.Close()
+
+	var attestations []*Attestation
+	for rows.Next() {
+		var fromID, toID, msgType, sig, pubKey, nonce, receivedBy string
+		var timestamp, skew int64
+		if err := rows.Scan(&fromID, &toID, &timestamp, &msgType, &sig, &pubKey, &skew, &nonce, &receivedBy); err != nil {
+			continue
+		}
+
+		fromUUID, _ := uuid.Parse(fromID)
+		toUUID, _ := uuid.Parse(toID)
+
+		att := &Attestation{
+			FromSystemID: fromUUID,
+			ToSystemID:   toUUID,
+			Timestamp:    timestamp,
+			MessageType:  msgType,
+			Signature:    sig,
+			PublicKey:    pubKey,
+			Nonce:        nonce,
+			ClockSkew:    skew,
+		}
+		if receivedByUUID, err := uuid.Parse(receivedBy); err == nil && toUUID == uuid.Nil {
+			att.ReceivedBy = &receivedByUUID
+		}
+		attestations = append(attestations, att)
+	}
+
+	return attestations, rows.Err()
+}
+
+// AttestationQuery filters for GetAttestationsPaged (zero values mean "no filter")
+type AttestationQuery struct {
+	FromSystem  string // Signer UUID
+	MessageType string
+	Since       int64 // Unix timestamp, exclusive
+	Limit       int
+	Offset      int
+}
+
+// AttestationRecord is a stored attestation plus display metadata
+type AttestationRecord struct {
+	ID             int64        `json:"id"`
+	Attestation    *Attestation `json:"attestation"`
+	SignerName     string       `json:"signer_name,omitempty"` // From peer_systems, empty if unknown
+	ReceivedBy     string       `json:"received_by"`
+	CreatedAt      int64        `json:"created_at"`
+	SignatureValid bool         `json:"signature_valid"` // Re-verified at query time
+}
+
+// GetAttestationsPaged returns attestations newest first, filtered and paginated
+// Also returns the total number of rows matching the filters
+func (s *Storage) GetAttestationsPaged(q AttestationQuery) ([]*AttestationRecord, int, error) {
+	where := "1=1"
+	args := []interface{}{}
+	if q.FromSystem != "" {
+		where += " AND a.from_system_id = ?"
+		args = append(args, q.FromSystem)
+	}
+	if q.MessageType != "" {
+		where += " AND a.message_type = ?"
+		args = append(args, q.MessageType)
+	}
+	if q.Since > 0 {
+		where += " AND a.timestamp > ?"
+		args = append(args, q.Since)
+	}
+
+	var total int
+	if err := s.read.QueryRow("SELECT COUNT(*) FROM attestations a WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.read.Query(`
+		SELECT a.id, a.from_system_id, a.to_system_id, a.received_by, a.timestamp, a.message_type,
+		       a.signature, a.public_key, a.nonce, a.created_at, COALESCE(p.name, '')
+		FROM attestations a
+		LEFT JOIN peer_systems p ON p.id = a.from_system_id
+		WHERE `+where+`
+		ORDER BY a.timestamp DESC, a.id DESC
+		LIMIT ? OFFSET ?
+	`, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records := []*AttestationRecord{}
+	for rows.Next() {
+		var rec AttestationRecord
+		var fromID, toID, msgType, sig, pubKey, nonce string
+		var timestamp int64
+		if err := rows.Scan(&rec.ID, &fromID, &toID, &rec.ReceivedBy, &timestamp, &msgType,
+			&sig, &pubKey, &nonce, &rec.CreatedAt, &rec.SignerName); err != nil {
+			continue
+		}
+
+		fromUUID, _ := uuid.Parse(fromID)
+		toUUID, _ := uuid.Parse(toID)
+
+		rec.Attestation = &Attestation{
+			FromSystemID: fromUUID,
+			ToSystemID:   toUUID,
+			Timestamp:    timestamp,
+			MessageType:  msgType,
+			Signature:    sig,
+			PublicKey:    pubKey,
+			Nonce:        nonce,
+		}
+		rec.SignatureValid = rec.Attestation.Verify()
+		records = append(records, &rec)
+	}
+
+	return records, total, nil
+}
+
+// Statuses of a transfer in credit_transfers
+const (
+	TransferPending   = "pending" // Debited and being delivered
+	TransferDelivered = "sent"
+)
+
+// ReserveCreditTransfer debits a transfer from the sender's balance and records it as
+// pending, in one transaction, before it is delivered. The signed transfer is kept with
+// it, so a delivery that may or may not have landed is retried exactly as it was sent.
+// Returns ErrInsufficientCredits if the balance no longer covers it
+func (s *Storage) ReserveCreditTransfer(t *CreditTransfer) error {
+	proofHash := ""
+	if t.Proof != nil {
+		proofHash = t.Proof.ProofHash()
+	}
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE credit_balance SET balance = balance - ?1, total_sent = total_sent + ?1, updated_at = ?2
+		WHERE system_id = ?3 AND balance >= ?1
+	`, t.Amount, time.Now().Unix(), t.FromSystemID.String())
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: balance no longer covers %d", ErrInsufficientCredits, t.Amount)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO credit_transfers (
+			id, from_system_id, to_system_id, amount, memo,
+			timestamp, signature, public_key, proof_hash, status, payload, created_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, t.ID.String(), t.FromSystemID.String(), t.ToSystemID.String(), t.Amount, t.Memo,
+		t.Timestamp, t.Signature, t.PublicKey, proofHash, TransferPending, string(payload), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FinalizeCreditTransfer marks a pending transfer as delivered
+func (s *Storage) FinalizeCreditTransfer(transferID uuid.UUID) error {
+	_, err := s.db.Exec(`UPDATE credit_transfers SET status = ?, payload = '' WHERE id = ? AND status = ?`,
+		TransferDelivered, transferID.String(), TransferPending)
+	return err
+}
+
+// ReleaseCreditTransfer drops a pending transfer the recipient didn't take and gives its
+// amount back to the sender's balance, in one transaction
+func (s *Storage) ReleaseCreditTransfer(t *CreditTransfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM credit_transfers WHERE id = ? AND status = ?`, t.ID.String(), TransferPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE credit_balance SET balance = balance + ?1, total_sent = total_sent - ?1, updated_at = ?2
+		WHERE system_id = ?3
+	`, t.Amount, time.Now().Unix(), t.FromSystemID.String())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CountPendingCreditTransfers returns how many transfers are still debited but not known delivered
+func (s *Storage) CountPendingCreditTransfers() (int, error) {
+	var count int
+	err := s.read.QueryRow(`SELECT COUNT(*) FROM credit_transfers WHERE status = ?`, TransferPending).Scan(&count)
+	return count, err
+}
+
+// GetPendingCreditTransfers returns the signed transfers still debited but not known
+// delivered, oldest first. Rows reserved before payloads were kept can't be resent and
+// are left out
+func (s *Storage) GetPendingCreditTransfers() ([]*CreditTransfer, error) {
+	rows, err := s.read.Query(`
+		SELECT payload FROM credit_transfers
+		WHERE status = ? AND payload != ''
+		ORDER BY created_at
+	`, TransferPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []*CreditTransfer
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var t CreditTransfer
+		if err := json.Unmarshal([]byte(payload), &t); err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, &t)
+	}
+	return transfers, rows.Err()
+}
+
+// HasVerifiedTransfer returns true if we've already accepted a transfer with this ID
+func (s *Storage) HasVerifiedTransfer(transferID uuid.UUID) (bool, error) {
+	var count int
+	err := s.read.QueryRow(`SELECT COUNT(*) FROM verified_transfers WHERE id = ?`,
+		transferID.String()).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// SaveVerifiedTransfer stores a transfer from another system after its proof was validated
+func (s *Storage) SaveVerifiedTransfer(t *CreditTransfer) error {
+	_, err := insertVerifiedTransfer(s.db, t)
+	return err
+}
+
+// AcceptCreditTransfer stores a validated transfer addressed to us and credits it to the
+// recipient's balance in one transaction, so a transfer is never recorded without being
+// credited. Returns ErrDuplicateTransfer if it was already accepted
+func (s *Storage) AcceptCreditTransfer(t *CreditTransfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := insertVerifiedTransfer(tx, t)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrDuplicateTransfer
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO credit_balance (system_id, balance, total_received, updated_at)
+		VALUES (?1, ?2, ?2, ?3)
+		ON CONFLICT(system_id) DO UPDATE SET
+			balance = balance + excluded.balance,
+			total_received = total_received + excluded.total_received,
+			updated_at = excluded.updated_at
+	`, t.ToSystemID.String(), t.Amount, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertVerifiedTransfer records a validated transfer with db or within a transaction
+// A transfer already recorded is left alone (no rows affected)
+func insertVerifiedTransfer(db sqlExecer, t *CreditTransfer) (sql.Result, error) {
+	proofHash := ""
+	if t.Proof != nil {
+		proofHash = t.Proof.ProofHash()
+	}
+
+	return db.Exec(`
+		INSERT OR IGNORE INTO verified_transfers (
+			id, from_system_id, to_system_id, amount, timestamp, signature, proof_hash, verified_at, memo
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, t.ID.String(), t.FromSystemID.String(), t.ToSystemID.String(), t.Amount,
+		t.Timestamp, t.Signature, proofHash, time.Now().Unix(), t.Memo)
+}
+
+// TransferRecord is one transfer in the local system's history
+type TransferRecord struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"` // TransferSent or TransferReceived
+	PeerID    string `json:"peer_id"`   // The recipient of a sent transfer, the sender of a received one
+	PeerName  string `json:"peer_name,omitempty"`
+	Amount    int64  `json:"amount"`
+	Memo      string `json:"memo,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	Pending   bool   `json:"pending,omitempty"` // Sent but not yet known to be delivered
+}
+
+// Transfer directions
+const (
+	TransferSent     = "sent"
+	TransferReceived = "received"
+)
+
+// GetTransferHistory returns transfers systemID sent (credit_transfers) and received
+// (verified_transfers), newest first, plus how many match in all
+// direction is TransferSent, TransferReceived or "" for both
+func (s *Storage) GetTransferHistory(systemID uuid.UUID, direction string, limit, offset int) ([]*TransferRecord, int, error) {
+	var parts []string
+	if direction != TransferReceived {
+		parts = append(parts, `SELECT id, 'sent' AS direction, to_system_id AS peer_id, amount, COALESCE(memo, '') AS memo, timestamp,
+			status = 'pending' AS pending
+			FROM credit_transfers WHERE from_system_id = ?1`)
+	}
+	if direction != TransferSent {
+		parts = append(parts, `SELECT id, 'received', from_system_id, amount, memo, timestamp, 0
+			FROM verified_transfers WHERE to_system_id = ?1`)
+	}
+	union := strings.Join(parts, " UNION ALL ")
+
+	var total int
+	if err := s.read.QueryRow(`SELECT COUNT(*) FROM (`+union+`)`, systemID.String()).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.read.Query(union+` ORDER BY timestamp DESC, id LIMIT ?2 OFFSET ?3`, systemID.String(), limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records := []*TransferRecord{}
+	for rows.Next() {
+		var rec TransferRecord
+		if err := rows.Scan(&rec.ID, &rec.Direction, &rec.PeerID, &rec.Amount, &rec.Memo, &rec.Timestamp, &rec.Pending); err != nil {
+			return nil, 0, err
+		}
+		records = append(records, &rec)
+	}
+	return records, total, rows.Err()
+}
+
+// GetVerifiedTransfersFor returns all verified transfers sent or received by a system
+// Used as the knownTransfers input to ValidateTransferProof (double-spend prevention)
+func (s *Storage) GetVerifiedTransfersFor(systemID uuid.UUID) ([]*CreditTransfer, error) {
+	rows, err := s.read.Query(`
+		SELECT id, from_system_id, to_system_id, amount, timestamp, signature
+		FROM verified_transfers
+		WHERE from_system_id = ? OR to_system_id = ?
+	`, systemID.String(), systemID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []*CreditTransfer
+	for rows.Next() {
+		var idStr, fromID, toID, sig string
+		var amount, timestamp int64
+		if err := rows.Scan(&idStr, &fromID, &toID, &amount, &timestamp, &sig); err != nil {
+			continue
+		}
+
+		id, _ := uuid.Parse(idStr)
+		fromUUID, _ := uuid.Parse(fromID)
+		toUUID, _ := uuid.Parse(toID)
+
+		transfers = append(transfers, &CreditTransfer{
+			ID:           id,
+			FromSystemID: fromUUID,
+			ToSystemID:   toUUID,
+			Amount:       amount,
+			Timestamp:    timestamp,
+			Signature:    sig,
+		})
+	}
+
+	return transfers, nil
+}
+
+// =============================================================================
+// IDENTITY BINDING (UUID spoofing prevention)
+// =============================================================================
+
+// GetIdentityBinding returns the public key bound to a UUID, or "" if we've never seen it
+func (s *Storage) GetIdentityBinding(systemID uuid.UUID) (string, error) {
+	var publicKey string
+	err := s.getIdentity.QueryRow(systemID.String()).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return publicKey, err
+}
+
+// GetInfoBinding returns a UUID's bound public key ("" if unbound) and whether it has ever
+// signed its info (see acceptInfo)
+func (s *Storage) GetInfoBinding(systemID uuid.UUID) (string, bool, error) {
+	var publicKey string
+	var signsInfo bool
+	err := s.read.QueryRow("SELECT public_key, signs_info FROM identity_bindings WHERE system_id = ?",
+		systemID.String()).Scan(&publicKey, &signsInfo)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return publicKey, signsInfo, err
+}
+
+// MarkSignsInfo records that a bound system signs its info, so unsigned info about it is
+// refused from then on, whether or not it's still cached
+func (s *Storage) MarkSignsInfo(systemID uuid.UUID) error {
+	_, err := s.db.Exec("UPDATE identity_bindings SET signs_info = 1 WHERE system_id = ?", systemID.String())
+	return err
+}
+
+// GetIdentityFirstSeen returns when we bound a UUID's identity, or 0 if we never have
+func (s *Storage) GetIdentityFirstSeen(systemID uuid.UUID) (int64, error) {
+	var firstSeen int64
+	err := s.read.QueryRow("SELECT first_seen FROM identity_bindings WHERE system_id = ?",
+		systemID.String()).Scan(&firstSeen)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return firstSeen, err
+}
+
+// ValidateIdentityBinding checks if a system's public key matches what we've seen before
+// A key rotation chain sent along moves the binding on first (see key_rotation.go)
+// Returns: (isValid bool, isNewIdentity bool, error)
+// - If we've never seen this UUID: saves binding, returns (true, true, nil)
+// - If we've seen it with same key, or the chain leads from that key to it: returns (true, false, nil)
+// - If we've seen it with different key: returns (false, false, nil) - spoofing attempt
+func (s *Storage) ValidateIdentityBinding(systemID uuid.UUID, publicKey string, chain []*KeyRotation) (bool, bool, error) {
+	var existingKey string
+	err := s.getIdentity.QueryRow(systemID.String()).Scan(&existingKey)
+
+	if err == sql.ErrNoRows {
+		// First time seeing this UUID - bind it
+		result, err := s.bindIdentity.Exec(systemID.String(), publicKey, time.Now().Unix())
+		if err != nil {
+			return false, false, fmt.Errorf("failed to save identity binding: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			s.recordKeyHistory(systemID, publicKey, chain)
+			return true, true, nil
+		}
+		// Another message from the same UUID bound it first - check against that key
+		err = s.db.QueryRow("SELECT public_key FROM identity_bindings WHERE system_id = ?",
+			systemID.String()).Scan(&existingKey)
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("failed to check identity binding: %w", err)
+	}
+
+	if len(chain) > 0 {
+		if existingKey, err = s.applyKeyRotations(systemID, existingKey, chain); err != nil {
+			return false, false, fmt.Errorf("failed to apply key rotation: %w", err)
+		}
+	}
+
+	// We've seen this UUID before - verify key matches
+	if existingKey != publicKey {
+		return false, false, nil // Spoofing attempt!
+	}
+	return true, false, nil
+}
+
+// =============================================================================
+// KEY ROTATION (moving an identity to a new key, see key_rotation.go)
+// =============================================================================
+
+// applyKeyRotations moves a binding along the rotations in chain that follow what we
+// already hold, and returns the key it is bound to afterwards. A revocation is recorded
+// but leaves the binding on the revoked key; a chain that doesn't follow changes nothing
+func (s *Storage) applyKeyRotations(systemID uuid.UUID, bound string, chain []*KeyRotation) (string, error) {
+	var latest int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(sequence), 0) FROM key_rotations WHERE system_id = ?`,
+		systemID.String()).Scan(&latest); err != nil {
+		return bound, err
+	}
+	if latest == 0 {
+		// First contact came after some rotations: pick the chain up at the key we bound
+		for _, r := range chain {
+			if r.OldPublicKey == bound {
+				latest = r.Sequence - 1
+				break
+			}
+		}
+	}
+
+	key, steps, err := followKeyChain(systemID, bound, latest, chain)
+	if err != nil {
+		log.Printf("Ignoring key rotation for %s: %v", systemID.String()[:8], err)
+		return bound, nil
+	}
+	if len(steps) == 0 {
+		return bound, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return bound, err
+	}
+	defer tx.Rollback()
+	if err := insertKeyRotations(tx, steps); err != nil {
+		return bound, err
+	}
+	if key == "" {
+		return bound, tx.Commit() // Revoked: what the sender signed with is still the last key
+	}
+	if _, err := tx.Exec(`UPDATE identity_bindings SET public_key = ? WHERE system_id = ? AND public_key = ?`,
+		key, systemID.String(), bound); err != nil {
+		return bound, err
+	}
+	if err := tx.Commit(); err != nil {
+		return bound, err
+	}
+	log.Printf("Identity %s moved to a new key (rotation %d)", systemID.String()[:8], steps[len(steps)-1].Sequence)
+	return key, nil
+}
+
+// recordKeyHistory keeps the rotations that led to a key we just bound, so attestations
+// signed with its earlier keys still check out. A chain that doesn't end at it is ignored
+func (s *Storage) recordKeyHistory(systemID uuid.UUID, bound string, chain []*KeyRotation) {
+	if len(chain) == 0 {
+		return
+	}
+	first := chain[0]
+	for _, r := range chain {
+		if r.Sequence < first.Sequence {
+			first = r
+		}
+	}
+	key, steps, err := followKeyChain(systemID, first.OldPublicKey, first.Sequence-1, chain)
+	if err != nil || key != bound {
+		return
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+	if insertKeyRotations(tx, steps) == nil {
+		tx.Commit()
+	}
+}
+
+// insertKeyRotations writes rotation records, keeping any already stored
+func insertKeyRotations(tx *sql.Tx, rotations []*KeyRotation) error {
+	for _, r := range rotations {
+		revoked := 0
+		if r.Revoked {
+			revoked = 1
+		}
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO key_rotations
+				(system_id, sequence, old_public_key, new_public_key, revoked, timestamp, signature)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, r.SystemID.String(), r.Sequence, r.OldPublicKey, r.NewPublicKey, revoked, r.Timestamp, r.Signature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveLocalKeyRotation stores a rotation of this system's own key together with the new
+// keys it moves to, in one transaction, so neither is on disk without the other.
+// keys is nil for a revocation, which leaves the stored keys alone
+func (s *Storage) SaveLocalKeyRotation(r *KeyRotation, keys *KeyPair) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertKeyRotations(tx, []*KeyRotation{r}); err != nil {
+		return err
+	}
+	if keys != nil {
+		result, err := tx.Exec(`UPDATE system SET public_key = ?, private_key = ? WHERE id = ?`,
+			base64.StdEncoding.EncodeToString(keys.PublicKey), base64.StdEncoding.EncodeToString(keys.PrivateKey),
+			r.SystemID.String())
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return fmt.Errorf("system %s is not stored", r.SystemID)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetKeyRotations returns a system's known rotations, oldest first
+func (s *Storage) GetKeyRotations(systemID uuid.UUID) ([]*KeyRotation, error) {
+	rows, err := s.read.Query(`
+		SELECT sequence, old_public_key, new_public_key, revoked, timestamp, signature
+		FROM key_rotations WHERE system_id = ? ORDER BY sequence
+	`, systemID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rotations []*KeyRotation
+	for rows.Next() {
+		r := &KeyRotation{SystemID: systemID}
+		if err := rows.Scan(&r.Sequence, &r.OldPublicKey, &r.NewPublicKey, &r.Revoked, &r.Timestamp, &r.Signature); err != nil {
+			return nil, err
+		}
+		rotations = append(rotations, r)
+	}
+	return rotations, rows.Err()
+}
+
+// IdentityRevoked reports whether a system's latest rotation revoked it
+func (s *Storage) IdentityRevoked(systemID uuid.UUID) (bool, error) {
+	var revoked bool
+	err := s.read.QueryRow(`SELECT revoked FROM key_rotations WHERE system_id = ? ORDER BY sequence DESC LIMIT 1`,
+		systemID.String()).Scan(&revoked)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return revoked, err
+}
+
+// KeyAt returns the key a system signed with at Unix time t (its own clock): the old key
+// of the first rotation after t, else the key bound now. "" if we've never seen the system
+func (s *Storage) KeyAt(systemID uuid.UUID, t int64) (string, error) {
+	var key string
+	err := s.read.QueryRow(`SELECT old_public_key FROM key_rotations WHERE system_id = ? AND timestamp > ? ORDER BY sequence LIMIT 1`,
+		systemID.String(), t).Scan(&key)
+	if err == sql.ErrNoRows {
+		return s.GetIdentityBinding(systemID)
+	}
+	return key, err
+}
+
+// attestationKeyValid reports whether an attestation is signed with the key its sender
+// held when it was made (true when we don't know the sender's key)
+func (s *Storage) attestationKeyValid(a *Attestation) bool {
+	key, err := s.KeyAt(a.FromSystemID, a.Timestamp)
+	return err != nil || key == "" || key == a.PublicKey
+}
 
 // =============================================================================
-// IDENTITY BINDING (UUID spoofing prevention)
+// IDENTITY SUPERSESSION (replacing an earlier identity of this node)
 // =============================================================================
 
-// ValidateIdentityBinding checks if a system's public key matches what we've seen before
-// Returns: (isValid bool, isNewIdentity bool, error)
-// - If we've never seen this UUID: saves binding, returns (true, true, nil)
-// - If we've seen it with same key: returns (true, false, nil)
-// - If we've seen it with different key: returns (false, false, nil) - spoofing attempt
-func (s *Storage) ValidateIdentityBinding(systemID uuid.UUID, publicKey string) (bool, bool, error) {
-	var existingKey string
-	err := s.db.QueryRow(
-		"SELECT public_key FROM identity_bindings WHERE system_id = ?",
-		systemID.String(),
-	).Scan(&existingKey)
+// MigrateIdentity moves everything this node recorded under oldID over to newID:
+// attestations it received, their compacted summaries, and its credit balance.
+// Attestations oldID signed itself are left alone - their signatures name the old ID.
+func (s *Storage) MigrateIdentity(oldID, newID uuid.UUID) error {
+	if oldID == newID {
+		return fmt.Errorf("old and new identity are the same")
+	}
+	oldStr, newStr := oldID.String(), newID.String()
 
-	if err == sql.ErrNoRows {
-		// First time seeing this UUID - bind it
-		_, err := s.db.Exec(
-			"INSERT INTO identity_bindings (system_id, public_key, first_seen) VALUES (?, ?, ?)",
-			systemID.String(), publicKey, time.Now().Unix(),
-		)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE attestations SET received_by = ? WHERE received_by = ?`, newStr, oldStr); err != nil {
+		return fmt.Errorf("failed to migrate attestations: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO attestation_summaries (from_system_id, received_by, day, attestation_count, first_timestamp, last_timestamp)
+		SELECT from_system_id, ?, day, attestation_count, first_timestamp, last_timestamp
+		FROM attestation_summaries WHERE received_by = ?
+		ON CONFLICT(from_system_id, received_by, day) DO UPDATE SET
+			attestation_count = attestation_count + excluded.attestation_count,
+			first_timestamp = MIN(first_timestamp, excluded.first_timestamp),
+			last_timestamp = MAX(last_timestamp, excluded.last_timestamp)
+	`, newStr, oldStr)
+	if err != nil {
+		return fmt.Errorf("failed to migrate attestation summaries: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM attestation_summaries WHERE received_by = ?`, oldStr); err != nil {
+		return err
+	}
+
+	// Merge the old balance into the new one (the new row may already have earned credits)
+	_, err = tx.Exec(`
+		INSERT INTO credit_balance (system_id, balance, pending_credits, total_earned, total_sent, total_received, last_calculated, longevity_start, updated_at)
+		SELECT ?, balance, pending_credits, total_earned, total_sent, total_received, last_calculated, longevity_start, ?
+		FROM credit_balance WHERE system_id = ?
+		ON CONFLICT(system_id) DO UPDATE SET
+			balance = balance + excluded.balance,
+			pending_credits = pending_credits + excluded.pending_credits,
+			total_earned = total_earned + excluded.total_earned,
+			total_sent = total_sent + excluded.total_sent,
+			total_received = total_received + excluded.total_received,
+			last_calculated = MAX(last_calculated, excluded.last_calculated),
+			longevity_start = CASE
+				WHEN longevity_start = 0 THEN excluded.longevity_start
+				WHEN excluded.longevity_start = 0 THEN longevity_start
+				ELSE MIN(longevity_start, excluded.longevity_start) END,
+			updated_at = excluded.updated_at
+	`, newStr, time.Now().Unix(), oldStr)
+	if err != nil {
+		return fmt.Errorf("failed to migrate credit balance: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM credit_balance WHERE system_id = ?`, oldStr); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SaveSupersedeClaim stores a claim this node made so it can be re-sent to peers
+func (s *Storage) SaveSupersedeClaim(c *SupersedeClaim) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO identity_supersessions
+			(old_id, new_id, new_public_key, timestamp, new_signature, old_public_key, old_signature)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, c.OldID.String(), c.NewID.String(), c.NewPublicKey, c.Timestamp, c.NewSignature, c.OldPublicKey, c.OldSignature)
+	return err
+}
+
+// GetSupersedeClaims returns claims made by newID since the given Unix time
+func (s *Storage) GetSupersedeClaims(newID uuid.UUID, since int64) ([]*SupersedeClaim, error) {
+	rows, err := s.read.Query(`
+		SELECT old_id, new_id, new_public_key, timestamp, new_signature, old_public_key, old_signature
+		FROM identity_supersessions
+		WHERE new_id = ? AND timestamp >= ?
+	`, newID.String(), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claims []*SupersedeClaim
+	for rows.Next() {
+		var c SupersedeClaim
+		var oldStr, newStr string
+		if err := rows.Scan(&oldStr, &newStr, &c.NewPublicKey, &c.Timestamp, &c.NewSignature, &c.OldPublicKey, &c.OldSignature); err != nil {
+			return nil, err
+		}
+		if c.OldID, err = uuid.Parse(oldStr); err != nil {
+			continue
+		}
+		if c.NewID, err = uuid.Parse(newStr); err != nil {
+			continue
+		}
+		claims = append(claims, &c)
+	}
+	return claims, rows.Err()
+}
+
+// Suspicion is one peer's claim that a system is unreachable
+type Suspicion struct {
+	TargetID  uuid.UUID
+	ClaimerID uuid.UUID
+	ClaimedAt int64
+}
+
+// SaveSuspicion records a claim, replacing the claimer's earlier one about the same target
+func (s *Storage) SaveSuspicion(targetID, claimerID uuid.UUID, claimedAt int64) error {
+	_, err := s.db.Exec(`
+		INSERT INTO peer_suspicions (target_id, claimer_id, claimed_at) VALUES (?, ?, ?)
+		ON CONFLICT(target_id, claimer_id) DO UPDATE SET claimed_at = excluded.claimed_at
+	`, targetID.String(), claimerID.String(), claimedAt)
+	return err
+}
+
+// DeleteSuspicions forgets every claim about a target
+func (s *Storage) DeleteSuspicions(targetID uuid.UUID) error {
+	_, err := s.db.Exec(`DELETE FROM peer_suspicions WHERE target_id = ?`, targetID.String())
+	return err
+}
+
+// GetSuspicions returns the claims made since the given Unix time
+func (s *Storage) GetSuspicions(since int64) ([]Suspicion, error) {
+	rows, err := s.read.Query(`SELECT target_id, claimer_id, claimed_at FROM peer_suspicions WHERE claimed_at >= ?`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var suspicions []Suspicion
+	for rows.Next() {
+		var targetStr, claimerStr string
+		var sus Suspicion
+		if err := rows.Scan(&targetStr, &claimerStr, &sus.ClaimedAt); err != nil {
+			return nil, err
+		}
+		if sus.TargetID, err = uuid.Parse(targetStr); err != nil {
+			continue
+		}
+		if sus.ClaimerID, err = uuid.Parse(claimerStr); err != nil {
+			continue
+		}
+		suspicions = append(suspicions, sus)
+	}
+	return suspicions, rows.Err()
+}
+
+// PruneSuspicions deletes claims made before the given Unix time
+func (s *Storage) PruneSuspicions(before int64) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM peer_suspicions WHERE claimed_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SaveGalaxySnapshot stores one galaxy snapshot
+func (s *Storage) SaveGalaxySnapshot(snap *GalaxySnapshot) error {
+	data, err := json.Marshal(snap.SnapshotDelta)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+		INSERT INTO galaxy_snapshots (taken_at, keyframe, system_count, routing_table_size, data)
+		VALUES (?, ?, ?, ?, ?)
+	`, snap.TakenAt, snap.Keyframe, snap.SystemCount, snap.RoutingTableSize, string(data))
+	return err
+}
+
+// GetGalaxySnapshots returns the snapshots needed to replay from..to, oldest first
+// Starts at the last keyframe at or before from, so the first row is always full state
+func (s *Storage) GetGalaxySnapshots(from, to int64) ([]*GalaxySnapshot, error) {
+	return s.queryGalaxySnapshots(`
+		SELECT id, taken_at, keyframe, system_count, routing_table_size, data
+		FROM galaxy_snapshots
+		WHERE taken_at >= COALESCE((SELECT MAX(taken_at) FROM galaxy_snapshots WHERE keyframe = 1 AND taken_at <= ?1), 0)
+		  AND taken_at <= ?2
+		ORDER BY taken_at, id
+	`, from, to)
+}
+
+func (s *Storage) queryGalaxySnapshots(query string, args ...interface{}) ([]*GalaxySnapshot, error) {
+	rows, err := s.read.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snaps []*GalaxySnapshot
+	for rows.Next() {
+		var snap GalaxySnapshot
+		var data string
+		if err := rows.Scan(&snap.ID, &snap.TakenAt, &snap.Keyframe, &snap.SystemCount, &snap.RoutingTableSize, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &snap.SnapshotDelta); err != nil {
+			return nil, fmt.Errorf("galaxy snapshot %d: %w", snap.ID, err)
+		}
+		snaps = append(snaps, &snap)
+	}
+	return snaps, rows.Err()
+}
+
+// ThinGalaxySnapshots reduces snapshots older than keepDays to one per UTC day
+// Kept rows whose delta base was removed are re-encoded in the same transaction
+func (s *Storage) ThinGalaxySnapshots(keepDays int) (int64, error) {
+	if keepDays < 1 {
+		return 0, fmt.Errorf("keepDays must be at least 1, got %d", keepDays)
+	}
+	cutoff := time.Now().AddDate(0, 0, -keepDays).Unix()
+
+	snaps, err := s.queryGalaxySnapshots(`
+		SELECT id, taken_at, keyframe, system_count, routing_table_size, data
+		FROM galaxy_snapshots
+		ORDER BY taken_at, id
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	doomed, rewritten := thinGalaxySnapshots(snaps, cutoff)
+	if len(doomed) == 0 {
+		return 0, nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, id := range doomed {
+		if _, err := tx.Exec("DELETE FROM galaxy_snapshots WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	for _, snap := range rewritten {
+		data, err := json.Marshal(snap.SnapshotDelta)
 		if err != nil {
-			return false, false, fmt.Errorf("failed to save identity binding: %w", err)
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE galaxy_snapshots SET keyframe = ?, data = ? WHERE id = ?",
+			snap.Keyframe, string(data), snap.ID); err != nil {
+			return 0, err
 		}
-		return true, true, nil
 	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(doomed)), nil
+}
+
+// TrimGalaxySnapshots removes snapshots taken before cutoff (0: no age limit) and the
+// oldest beyond maxRows (0: no cap), re-encoding the first kept one as a keyframe
+func (s *Storage) TrimGalaxySnapshots(maxRows, cutoff int64) (int64, error) {
+	snaps, err := s.queryGalaxySnapshots(`
+		SELECT id, taken_at, keyframe, system_count, routing_table_size, data
+		FROM galaxy_snapshots
+		ORDER BY taken_at, id
+	`)
 	if err != nil {
-		return false, false, fmt.Errorf("failed to check identity binding: %w", err)
+		return 0, err
 	}
 
-	// We've seen this UUID before - verify key matches
-	if existingKey != publicKey {
-		return false, false, nil // Spoofing attempt!
+	doomed, rewritten := trimGalaxySnapshots(snaps, int(maxRows), cutoff)
+	if len(doomed) == 0 {
+		return 0, nil
 	}
-	return true, false, nil
-}
\ No newline at end of file
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, id := range doomed {
+		if _, err := tx.Exec("DELETE FROM galaxy_snapshots WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+	}
+	if rewritten != nil {
+		data, err := json.Marshal(rewritten.SnapshotDelta)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE galaxy_snapshots SET keyframe = 1, data = ? WHERE id = ?",
+			string(data), rewritten.ID); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int64(len(doomed)), nil
+}
+
+// messageColumns are the messages columns scanMessages reads, in order
+const messageColumns = `id, direction, peer_id, body, sent_at, received_at, read, status, attempts, next_attempt, last_error`
+
+// SaveMessage stores a new message, returning false if it was already there
+func (s *Storage) SaveMessage(m *Message) (bool, error) {
+	result, err := s.db.Exec(`
+		INSERT OR IGNORE INTO messages (`+messageColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, m.ID.String(), m.Direction, m.PeerID.String(), m.Body, m.SentAt, m.ReceivedAt, m.Read, m.Status,
+		m.Attempts, m.NextAttempt, m.LastError)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// UpdateMessageDelivery saves a sent message's delivery state
+func (s *Storage) UpdateMessageDelivery(m *Message) error {
+	_, err := s.db.Exec(`
+		UPDATE messages SET status = ?, received_at = ?, attempts = ?, next_attempt = ?, last_error = ?
+		WHERE direction = ? AND peer_id = ? AND id = ?
+	`, m.Status, m.ReceivedAt, m.Attempts, m.NextAttempt, m.LastError, MessageSent, m.PeerID.String(), m.ID.String())
+	return err
+}
+
+// HasMessage reports whether a message is already stored
+func (s *Storage) HasMessage(direction string, peerID, id uuid.UUID) (bool, error) {
+	var n int
+	err := s.read.QueryRow(`SELECT COUNT(*) FROM messages WHERE direction = ? AND peer_id = ? AND id = ?`,
+		direction, peerID.String(), id.String()).Scan(&n)
+	return n > 0, err
+}
+
+// CountMessagesFrom counts the messages a system left us since the given Unix time
+func (s *Storage) CountMessagesFrom(peerID uuid.UUID, since int64) (int, error) {
+	var n int
+	err := s.read.QueryRow(`SELECT COUNT(*) FROM messages WHERE direction = ? AND peer_id = ? AND received_at >= ?`,
+		MessageReceived, peerID.String(), since).Scan(&n)
+	return n, err
+}
+
+// CountUnreadMessages counts the unread messages in the inbox
+func (s *Storage) CountUnreadMessages() (int, error) {
+	var n int
+	err := s.read.QueryRow(`SELECT COUNT(*) FROM messages WHERE direction = ? AND read = 0`, MessageReceived).Scan(&n)
+	return n, err
+}
+
+// GetMessages returns one direction's messages, newest first, plus how many there are in all
+func (s *Storage) GetMessages(direction string, limit, offset int) ([]*Message, int, error) {
+	var total int
+	if err := s.read.QueryRow(`SELECT COUNT(*) FROM messages WHERE direction = ?`, direction).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.read.Query(`SELECT `+messageColumns+` FROM messages WHERE direction = ?
+		ORDER BY sent_at DESC, rowid DESC LIMIT ? OFFSET ?`, direction, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	messages, err := scanMessages(rows)
+	return messages, total, err
+}
+
+// GetDueMessages returns the sent messages pending a retry due by now
+func (s *Storage) GetDueMessages(now int64) ([]*Message, error) {
+	rows, err := s.read.Query(`SELECT `+messageColumns+` FROM messages
+		WHERE status = ? AND next_attempt <= ? AND direction = ? ORDER BY next_attempt`, MessagePending, now, MessageSent)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// MarkMessagesRead marks the given received messages read, or all of them if ids is
+// empty, returning how many were unread
+func (s *Storage) MarkMessagesRead(ids []uuid.UUID) (int64, error) {
+	query := `UPDATE messages SET read = 1 WHERE direction = ? AND read = 0`
+	args := []interface{}{MessageReceived}
+	if len(ids) > 0 {
+		query += ` AND id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)`
+		for _, id := range ids {
+			args = append(args, id.String())
+		}
+	}
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// scanMessages reads messages rows and closes them
+func scanMessages(rows *sql.Rows) ([]*Message, error) {
+	defer rows.Close()
+
+	messages := []*Message{}
+	for rows.Next() {
+		var m Message
+		var id, peerID string
+		if err := rows.Scan(&id, &m.Direction, &peerID, &m.Body, &m.SentAt, &m.ReceivedAt, &m.Read, &m.Status,
+			&m.Attempts, &m.NextAttempt, &m.LastError); err != nil {
+			return nil, err
+		}
+		var err error
+		if m.ID, err = uuid.Parse(id); err != nil {
+			continue
+		}
+		if m.PeerID, err = uuid.Parse(peerID); err != nil {
+			continue
+		}
+		messages = append(messages, &m)
+	}
+	return messages, rows.Err()
+}
+
+// InstallSalt returns this install's UUID salt ("" if none was ever made)
+func (s *Storage) InstallSalt() (string, error) {
+	var salt string
+	err := s.read.QueryRow(`SELECT salt FROM install_salt WHERE id = 1`).Scan(&salt)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return salt, err
+}
+
+// EnsureInstallSalt returns this install's UUID salt, making it the first time
+func (s *Storage) EnsureInstallSalt() (string, error) {
+	salt, err := newInstallSalt()
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.db.Exec(`INSERT OR IGNORE INTO install_salt (id, salt, created_at) VALUES (1, ?, ?)`,
+		salt, time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return s.InstallSalt()
+}
+
+// SaveDiagnosticEvent records a diagnostic event, dropping all but the latest keep
+func (s *Storage) SaveDiagnosticEvent(e DiagnosticEvent, keep int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO diagnostic_events (at, stage, ok, message) VALUES (?, ?, ?, ?)`,
+		e.At, e.Stage, e.OK, e.Message); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM diagnostic_events WHERE id NOT IN (
+		SELECT id FROM diagnostic_events ORDER BY id DESC LIMIT ?)`, keep); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetDiagnosticEvents returns the saved diagnostic events, oldest first
+func (s *Storage) GetDiagnosticEvents() ([]DiagnosticEvent, error) {
+	rows, err := s.read.Query(`SELECT at, stage, ok, message FROM diagnostic_events ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []DiagnosticEvent{}
+	for rows.Next() {
+		var e DiagnosticEvent
+		if err := rows.Scan(&e.At, &e.Stage, &e.OK, &e.Message); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
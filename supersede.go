@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SupersedeRebroadcastWindow is how long after a restart under a new identity
+// the supersede claim keeps being sent to peers on every startup
+const SupersedeRebroadcastWindow = 7 * 24 * time.Hour
+
+// SupersedeClaim states that NewID replaces OldID (e.g. after a DB wipe or -random-uuid restart)
+// The new key always signs it. If the old private key is still around it signs the same
+// statement too, which makes the claim authoritative; otherwise it is only advisory.
+type SupersedeClaim struct {
+	OldID        uuid.UUID `json:"old_id"`
+	NewID        uuid.UUID `json:"new_id"`
+	NewPublicKey string    `json:"new_public_key"` // base64
+	Timestamp    int64     `json:"timestamp"`
+	NewSignature string    `json:"new_signature"`
+	OldPublicKey string    `json:"old_public_key,omitempty"` // base64; empty when the old key is lost
+	OldSignature string    `json:"old_signature,omitempty"`
+}
+
+// signableMessage returns the canonical statement both keys sign
+func (c *SupersedeClaim) signableMessage() []byte {
+	msg := struct {
+		OldID        string `json:"old_id"`
+		NewID        string `json:"new_id"`
+		NewPublicKey string `json:"new_public_key"`
+		Timestamp    int64  `json:"timestamp"`
+	}{
+		OldID:        c.OldID.String(),
+		NewID:        c.NewID.String(),
+		NewPublicKey: c.NewPublicKey,
+		Timestamp:    c.Timestamp,
+	}
+	data, _ := json.Marshal(msg)
+	return data
+}
+
+// NewSupersedeClaim creates a claim signed by the new key, and by the old key when given
+func NewSupersedeClaim(oldID uuid.UUID, newSystem *System, oldKey ed25519.PrivateKey) (*SupersedeClaim, error) {
+	if newSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+	if oldID == newSystem.ID {
+		return nil, fmt.Errorf("a system cannot supersede itself")
+	}
+
+	c := &SupersedeClaim{
+		OldID:        oldID,
+		NewID:        newSystem.ID,
+		NewPublicKey: base64.StdEncoding.EncodeToString(newSystem.Keys.PublicKey),
+		Timestamp:    time.Now().Unix(),
+	}
+	msg := c.signableMessage()
+	c.NewSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(newSystem.Keys.PrivateKey, msg))
+
+	if oldKey != nil {
+		c.OldPublicKey = base64.StdEncoding.EncodeToString(oldKey.Public().(ed25519.PublicKey))
+		c.OldSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(oldKey, msg))
+	}
+	return c, nil
+}
+
+// verifySignature checks one base64 signature over the claim
+func (c *SupersedeClaim) verifySignature(publicKey, signature string) bool {
+	pub, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, c.signableMessage(), sig)
+}
+
+// VerifyNew checks the new key's signature
+func (c *SupersedeClaim) VerifyNew() bool {
+	return c.verifySignature(c.NewPublicKey, c.NewSignature)
+}
+
+// VerifyOld checks the old key's signature (false if the claim has none)
+func (c *SupersedeClaim) VerifyOld() bool {
+	if c.OldPublicKey == "" || c.OldSignature == "" {
+		return false
+	}
+	return c.verifySignature(c.OldPublicKey, c.OldSignature)
+}
+
+// parseSupersedeKey decodes a -supersede-key value: the old node's base64 private key,
+// as stored in the system table of its database
+func parseSupersedeKey(value string) (ed25519.PrivateKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("expected a %d-byte Ed25519 private key, got %d bytes", ed25519.PrivateKeySize, len(raw))
+	}
+	return ed25519.PrivateKey(raw), nil
+}
+
+// supersedeIdentity folds a previous identity's local history into the current one
+// and records a signed claim so peers can drop the old ghost entry
+func supersedeIdentity(system *System, storage *Storage, oldID uuid.UUID, oldKey ed25519.PrivateKey) (*SupersedeClaim, error) {
+	claim, err := NewSupersedeClaim(oldID, system, oldKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if oldKey != nil {
+		// Refuse a key that provably isn't the old identity's
+		if bound, err := storage.GetIdentityBinding(oldID); err == nil && bound != "" && bound != claim.OldPublicKey {
+			return nil, fmt.Errorf("-supersede-key does not match the key known for %s", oldID)
+		}
+	}
+
+	if err := storage.MigrateIdentity(oldID, system.ID); err != nil {
+		return nil, fmt.Errorf("failed to migrate local history: %w", err)
+	}
+	if err := storage.SaveSupersedeClaim(claim); err != nil {
+		return nil, fmt.Errorf("failed to save supersede claim: %w", err)
+	}
+
+	if claim.OldSignature != "" {
+		log.Printf("Superseding %s (signed by old key)", oldID)
+	} else {
+		log.Printf("Superseding %s (advisory only - no old key given)", oldID)
+	}
+	return claim, nil
+}
+
+// handleSupersede processes a supersede request: the sender says it replaces an older identity
+func (dht *DHT) handleSupersede(msg *DHTMessage) (*DHTMessage, error) {
+	claim := msg.Supersede
+	log.Printf("SUPERSEDE from %s (%s): replaces %s", msg.FromSystem.Name, msg.FromSystem.ID, claim.OldID)
+
+	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	dht.routingTable.CacheSystem(msg.FromSystem, msg.FromSystem.ID, true)
+
+	dht.applySupersede(claim, msg.FromSystem)
+
+	return NewSupersedeResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+}
+
+// applySupersede replaces an old identity with the sender
+// With a valid old-key signature matching the key we bound to the old UUID, the old ID is
+// retired for good: its peer_connections move to the new ID and it is blocked.
+// Without one the claim is advisory - we only forget a cached entry at the sender's address.
+func (dht *DHT) applySupersede(claim *SupersedeClaim, sender *System) {
+	if claim.OldID == dht.localSystem.ID {
+		return
+	}
+
+	boundKey, err := dht.storage.GetIdentityBinding(claim.OldID)
+	if err != nil {
+		log.Printf("Supersede: identity lookup failed for %s: %v", claim.OldID, err)
+		return
+	}
+
+	if boundKey != "" && claim.OldPublicKey == boundKey && claim.VerifyOld() {
+		if err := dht.storage.RelinkPeerConnections(claim.OldID, claim.NewID); err != nil {
+			log.Printf("Supersede: failed to re-link connections of %s: %v", claim.OldID, err)
+		}
+		// Blocking purges the cache, peer_systems and remaining connection rows
+		if _, err := dht.BlockSystem(claim.OldID, "superseded by "+claim.NewID.String(), 0); err != nil {
+			log.Printf("Supersede: failed to retire %s: %v", claim.OldID, err)
+			return
+		}
+		log.Printf("%s now replaces %s", sender.Name, claim.OldID.String()[:8])
+		return
+	}
+
+	// Advisory: anyone can claim anything, so only clean up a ghost at the sender's own address
+	old := dht.routingTable.GetCachedSystem(claim.OldID)
+	if old == nil || !samePeerAddress(old.PeerAddress, sender.PeerAddress) {
+		return
+	}
+	dht.routingTable.RemoveFromCache(claim.OldID)
+	if err := dht.storage.DeletePeerSystem(claim.OldID); err != nil {
+		log.Printf("Supersede: failed to delete %s: %v", claim.OldID, err)
+	}
+	log.Printf("Removed %s (%s) at %s, superseded by %s (advisory)",
+		old.Name, claim.OldID.String()[:8], old.PeerAddress, sender.Name)
+}
+
+// SupersedeToSystem sends a supersede claim to a known system
+func (dht *DHT) SupersedeToSystem(sys *System, claim *SupersedeClaim) error {
+	if sys.PeerAddress == "" {
+		return fmt.Errorf("no peer address for %s", sys.Name)
+	}
+
+	msg, err := NewSupersedeRequest(dht.localSystem, sys.ID, claim, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = dht.sendRequest(sys.PeerAddress, msg)
+	return err
+}
+
+// broadcastSupersedeClaims sends our recent supersede claims to every known peer
+// Called after bootstrap, so peers that were offline hear about it on a later restart
+func (dht *DHT) broadcastSupersedeClaims() {
+	since := time.Now().Add(-SupersedeRebroadcastWindow).Unix()
+	claims, err := dht.storage.GetSupersedeClaims(dht.localSystem.ID, since)
+	if err != nil {
+		log.Printf("Failed to load supersede claims: %v", err)
+		return
+	}
+
+	for _, claim := range claims {
+		sent := 0
+		for _, sys := range dht.routingTable.GetAllCachedSystems() {
+			if sys.ID == claim.OldID || !dht.peerSupports(sys.ID, CapSupersede) {
+				continue
+			}
+			if err := dht.SupersedeToSystem(sys, claim); err == nil {
+				sent++
+			}
+		}
+		log.Printf("Sent supersede claim for %s to %d peers", claim.OldID.String()[:8], sent)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 	"math"
 	"time"
 
@@ -43,6 +44,13 @@ type System struct {
 	PeerAddress string          `json:"peer_address"` // Peer mesh address
 	SponsorID   *uuid.UUID      `json:"sponsor_id,omitempty"` // Node that sponsored our network entry
 	InfoVersion int64           `json:"info_version"` // Monotonic version for stale gossip detection
+	InfoSignature string        `json:"info_signature,omitempty"` // Owner's signature over gossiped fields (see signed_info.go)
+	PeerTLS     bool            `json:"peer_tls,omitempty"` // DHT port also accepts TLS (see peer_tls.go); signed, so relays can't strip it
+	GenesisDemotion *GenesisDemotion `json:"genesis_demotion,omitempty"` // Set once a genesis has stepped down (see genesis.go); signed on its own
+	CoordsVersion int `json:"coords_version,omitempty"` // Derivation that placed it (see CheckCoordinates); signed, though validators try every version
+	StarsVersion int `json:"stars_version,omitempty"` // Derivation that gave it its stars (see ValidateStarSystem); signed, validators check the stars against it
+	ProcessStartTime int64 `json:"process_start_time,omitempty"` // When its process started (Unix, its clock); display only, not signed or relayed (see process_uptime.go)
+	Profile *OperatorProfile `json:"profile,omitempty"` // Its operator's, if they set one (see profile.go); signed on its own
 }
 
 // generateSingleStar creates a deterministic star from a seed
@@ -112,12 +120,72 @@ func generateSingleStar(seed uint64) StarType {
 	}
 }
 
-// GenerateMultiStarSystem creates a deterministic multi-star system from UUID
+// Star classes are derived from the UUID, and every node checks a sender's against it.
+// Like coordinates, the derivation is versioned so it can change without the network
+// splitting into nodes that reject each other: a system records the version that gave it
+// its stars (StarsVersion), and validators check them against that version, which may be
+// any in starsDerivations. A version, once released, must never change - the golden vectors in
+// the star-derivation simulation pin each one.
+
+// Star derivation versions (0 on systems from before versioning means v1)
+const StarsDerivationV1 = 1
+
+// starsDerivation is one version of the star derivation
+type starsDerivation struct {
+	version int
+	derive  func(id uuid.UUID) MultiStarSystem
+}
+
+// starsDerivations lists every version validators accept, oldest first
+// New systems are generated with the last one
+var starsDerivations = []starsDerivation{
+	{StarsDerivationV1, deriveStarsV1},
+}
+
+// currentStarsDerivation is the version new systems are generated with
+func currentStarsDerivation() starsDerivation {
+	return starsDerivations[len(starsDerivations)-1]
+}
+
+// findStarsDerivation returns the derivation with the given version
+func findStarsDerivation(version int) (starsDerivation, bool) {
+	if version == 0 {
+		version = StarsDerivationV1
+	}
+	for _, d := range starsDerivations {
+		if d.version == version {
+			return d, true
+		}
+	}
+	return starsDerivation{}, false
+}
+
+// GenerateMultiStarSystem gives this system the stars its UUID derives under the current
+// derivation, which it records in StarsVersion
+func (s *System) GenerateMultiStarSystem() {
+	d := currentStarsDerivation()
+	s.Stars = d.derive(s.ID)
+	s.StarsVersion = d.version
+}
+
+// ExpectedStars returns the stars a UUID derives under the given version (the current
+// one if it isn't known)
+func ExpectedStars(version int, id uuid.UUID) MultiStarSystem {
+	d, ok := findStarsDerivation(version)
+	if !ok {
+		d = currentStarsDerivation()
+	}
+	return d.derive(id)
+}
+
+// deriveStarsV1 creates a deterministic multi-star system from UUID
 // Distribution:
 // - Single stars: ~50%
 // - Binary systems: ~40%
 // - Trinary systems: ~10%
-func (s *System) GenerateMultiStarSystem() {
+func deriveStarsV1(id uuid.UUID) MultiStarSystem {
+	s := &System{ID: id}
+
 	// Determine if single, binary, or trinary
 	systemTypeSeed := s.DeterministicSeed("system_type")
 	systemTypeRoll := systemTypeSeed % 100
@@ -177,7 +245,7 @@ func (s *System) GenerateMultiStarSystem() {
 		tertiary = &tertiaryStar
 	}
 
-	s.Stars = MultiStarSystem{
+	return MultiStarSystem{
 		Primary:   primary,
 		Secondary: secondary,
 		Tertiary:  tertiary,
@@ -187,8 +255,10 @@ func (s *System) GenerateMultiStarSystem() {
 	}
 }
 
-// ValidateStarSystem checks if a system's stars match what its UUID should deterministically produce
-// Returns true if valid, false if the star configuration appears to be spoofed
+// ValidateStarSystem checks if a system's stars match what its UUID should deterministically
+// produce under the derivation it records
+// Returns true if valid, false if the star configuration appears to be spoofed or the
+// version is unknown (see describeStarsMismatch)
 func ValidateStarSystem(sys *System) bool {
 	// Skip validation for class X (genesis black hole - special case)
 	if sys.Stars.Primary.Class == "X" {
@@ -200,14 +270,42 @@ func ValidateStarSystem(sys *System) bool {
 		return sys.ID.String() == "f467e75d-00b8-5ac7-9f0f-4e7cd1c8eb20"
 	}
 
-	// Generate expected star configuration from UUID
-	expected := &System{ID: sys.ID}
-	expected.GenerateMultiStarSystem()
+	// Compare primary class and multi-star status with what the recorded version derives
+	d, ok := findStarsDerivation(sys.StarsVersion)
+	if !ok {
+		return false
+	}
+	expected := d.derive(sys.ID)
+	return sys.Stars.Primary.Class == expected.Primary.Class &&
+		sys.Stars.IsBinary == expected.IsBinary &&
+		sys.Stars.IsTrinary == expected.IsTrinary
+}
+
+// canonicalStars returns sys with its stars as its recorded derivation gives them, when
+// that agrees on the signed primary class. Only the primary class is signed, so this is
+// what keeps a relay from changing companions, colors or descriptions. Returns sys
+// itself when they disagree (class X) or the derivation is one we don't know
+func canonicalStars(sys *System) *System {
+	d, ok := findStarsDerivation(sys.StarsVersion)
+	if !ok {
+		return sys
+	}
+	expected := d.derive(sys.ID)
+	if expected.Primary.Class != sys.Stars.Primary.Class {
+		return sys
+	}
+	canonical := *sys
+	canonical.Stars = expected
+	return &canonical
+}
 
-	// Compare primary class and multi-star status
-	return sys.Stars.Primary.Class == expected.Stars.Primary.Class &&
-		sys.Stars.IsBinary == expected.Stars.IsBinary &&
-		sys.Stars.IsTrinary == expected.Stars.IsTrinary
+// describeStarsMismatch says why ValidateStarSystem rejected sys, naming a derivation
+// version this build doesn't know (the sender is probably newer, not spoofing)
+func describeStarsMismatch(sys *System) string {
+	if _, ok := findStarsDerivation(sys.StarsVersion); !ok {
+		return fmt.Sprintf("star system configuration invalid for UUID (unknown star derivation v%d)", sys.StarsVersion)
+	}
+	return "star system configuration invalid for UUID"
 }
 
 // GenerateCoordinates creates spatial coordinates
@@ -240,110 +338,222 @@ func (s *System) GenerateDeterministicCoordinates() {
 	s.Z = (float64(zSeed) / maxUint64 * 20000) - 10000
 }
 
-// GenerateClusteredCoordinates places this system near its sponsor
-// Uses Hash(UUID + SponsorID) to deterministically generate offset
-// This makes coordinates verifiable by any node that knows both UUIDs
-func (s *System) GenerateClusteredCoordinates(sponsor *System) {
-	// Hash our UUID + sponsor's UUID together for deterministic positioning
-	combined := append(s.ID[:], sponsor.ID[:]...)
-	hash := sha256.Sum256(combined)
-
-	// Use hash to generate deterministic spherical coordinates
-	// This gives more natural distribution than axis-aligned offsets
-	distSeed := binary.BigEndian.Uint64(hash[0:8])
-	thetaSeed := binary.BigEndian.Uint64(hash[8:16])  // azimuth angle
-	phiSeed := binary.BigEndian.Uint64(hash[16:24])   // polar angle
-
-	maxUint64 := float64(math.MaxUint64)
+// Clustered coordinates are derived, not chosen: any node that knows a system's UUID,
+// its sponsor's UUID and the sponsor's position can recompute them. The derivation is
+// versioned so it can change without stranding systems placed by an older one: a system
+// records the version that placed it (CoordsVersion), and validators accept any version
+// in coordsDerivations. A version, once released, must never change - the committed
+// golden vectors in the coordinates simulation pin each one.
+
+// Coordinate derivation versions (0 on systems from before versioning means v1)
+const (
+	CoordsDerivationV1      = 1
+	CurrentCoordsDerivation = CoordsDerivationV1
+)
 
-	// Distance: 100-500 units from sponsor
-	distance := (float64(distSeed)/maxUint64)*400.0 + 100.0
+// Clustered systems sit this far from their sponsor
+const (
+	ClusterMinDistance = 100.0
+	ClusterMaxDistance = 500.0
+)
 
-	// Spherical coordinates for even distribution
-	theta := (float64(thetaSeed) / maxUint64) * 2 * math.Pi        // 0 to 2π
-	phi := math.Acos(2*(float64(phiSeed)/maxUint64) - 1)           // 0 to π (uniform on sphere)
+// coordsEpsilon is how far a coordinate may be from the derived one and still match
+const coordsEpsilon = 0.01
 
-	// Convert to Cartesian offsets
-	xOffset := distance * math.Sin(phi) * math.Cos(theta)
-	yOffset := distance * math.Sin(phi) * math.Sin(theta)
-	zOffset := distance * math.Cos(phi)
+// clusterOffset is a system's position relative to its sponsor, in spherical coordinates
+type clusterOffset struct {
+	Distance float64 // ClusterMinDistance to ClusterMaxDistance
+	Theta    float64 // Azimuth, 0 to 2π
+	Phi      float64 // Polar angle, 0 to π
+}
 
-	// Apply offsets to sponsor's coordinates
-	s.X = sponsor.X + xOffset
-	s.Y = sponsor.Y + yOffset
-	s.Z = sponsor.Z + zOffset
+// coordsDerivation is one version of the offset derivation
+type coordsDerivation struct {
+	version int
+	derive  func(systemID, sponsorID uuid.UUID) clusterOffset
+}
 
-	// Store sponsor reference
-	s.SponsorID = &sponsor.ID
+// coordsDerivations lists every version validators accept, oldest first
+var coordsDerivations = []coordsDerivation{
+	{CoordsDerivationV1, deriveClusterOffsetV1},
 }
 
-// CalculateExpectedCoordinates computes where a system should be based on UUID + Sponsor
-// Used for validation - any node can verify coordinates are legitimate
-func CalculateExpectedCoordinates(systemID, sponsorID uuid.UUID, sponsorX, sponsorY, sponsorZ float64) (x, y, z float64) {
-	combined := append(systemID[:], sponsorID[:]...)
-	hash := sha256.Sum256(combined)
+// deriveClusterOffsetV1 splits Hash(UUID + SponsorUUID) into distance, azimuth and polar
+// angle seeds. The explicit float64 conversions round each step: without them Go may fuse
+// a multiply and an add into one FMA instruction (arm64, ppc64le, s390x, amd64 v3),
+// which changes the low bits from one architecture to the next
+func deriveClusterOffsetV1(systemID, sponsorID uuid.UUID) clusterOffset {
+	var combined [32]byte
+	copy(combined[:16], systemID[:])
+	copy(combined[16:], sponsorID[:])
+	hash := sha256.Sum256(combined[:])
 
 	distSeed := binary.BigEndian.Uint64(hash[0:8])
-	thetaSeed := binary.BigEndian.Uint64(hash[8:16])
-	phiSeed := binary.BigEndian.Uint64(hash[16:24])
+	thetaSeed := binary.BigEndian.Uint64(hash[8:16]) // azimuth angle
+	phiSeed := binary.BigEndian.Uint64(hash[16:24])  // polar angle
 
 	maxUint64 := float64(math.MaxUint64)
+	return clusterOffset{
+		Distance: float64(float64(distSeed)/maxUint64*(ClusterMaxDistance-ClusterMinDistance)) + ClusterMinDistance,
+		Theta:    float64(thetaSeed) / maxUint64 * 2 * math.Pi,
+		Phi:      math.Acos(float64(2*(float64(phiSeed)/maxUint64)) - 1), // uniform on the sphere
+	}
+}
+
+// cartesian converts the offset to x, y and z, rounded before anything is added to them
+func (o clusterOffset) cartesian() (x, y, z float64) {
+	x = float64(float64(o.Distance*math.Sin(o.Phi)) * math.Cos(o.Theta))
+	y = float64(float64(o.Distance*math.Sin(o.Phi)) * math.Sin(o.Theta))
+	z = float64(o.Distance * math.Cos(o.Phi))
+	return x, y, z
+}
+
+// findCoordsDerivation returns the derivation with the given version
+func findCoordsDerivation(version int) (coordsDerivation, bool) {
+	if version == 0 {
+		version = CoordsDerivationV1
+	}
+	for _, d := range coordsDerivations {
+		if d.version == version {
+			return d, true
+		}
+	}
+	return coordsDerivation{}, false
+}
 
-	distance := (float64(distSeed)/maxUint64)*400.0 + 100.0
-	theta := (float64(thetaSeed) / maxUint64) * 2 * math.Pi
-	phi := math.Acos(2*(float64(phiSeed)/maxUint64) - 1)
+// GenerateClusteredCoordinates places this system near its sponsor using the current
+// derivation, which it records in CoordsVersion
+func (s *System) GenerateClusteredCoordinates(sponsor *System) {
+	s.X, s.Y, s.Z = CalculateExpectedCoordinates(CurrentCoordsDerivation, s.ID, sponsor.ID, sponsor.X, sponsor.Y, sponsor.Z)
+	s.CoordsVersion = CurrentCoordsDerivation
 
-	xOffset := distance * math.Sin(phi) * math.Cos(theta)
-	yOffset := distance * math.Sin(phi) * math.Sin(theta)
-	zOffset := distance * math.Cos(phi)
+	// Store sponsor reference
+	s.SponsorID = &sponsor.ID
+}
 
+// CalculateExpectedCoordinates computes where a system should be based on UUID + Sponsor
+// under the given derivation version (the current one if it isn't known)
+// Used for validation - any node can verify coordinates are legitimate
+func CalculateExpectedCoordinates(version int, systemID, sponsorID uuid.UUID, sponsorX, sponsorY, sponsorZ float64) (x, y, z float64) {
+	d, ok := findCoordsDerivation(version)
+	if !ok {
+		d, _ = findCoordsDerivation(CurrentCoordsDerivation)
+	}
+	xOffset, yOffset, zOffset := d.derive(systemID, sponsorID).cartesian()
 	return sponsorX + xOffset, sponsorY + yOffset, sponsorZ + zOffset
 }
 
-// ValidateCoordinates checks if a system's coordinates match expected position
-// Returns true if valid (or unverifiable), false if definitely spoofed
+// CoordsStatus is the outcome of checking a system's coordinates
+type CoordsStatus int
+
+const (
+	CoordsValid      CoordsStatus = iota
+	CoordsInvalid                 // Definitely spoofed
+	CoordsUnverified              // Sponsor unknown to us; checked again once we learn it (see coords.go)
+)
+
+// CheckCoordinates checks if a system's coordinates match expected position
 // lookupSponsor returns sponsor System or nil if unknown
-func ValidateCoordinates(sys *System, lookupSponsor func(uuid.UUID) *System) bool {
+// For invalid coordinates it also says what failed (distance band, angle, ...)
+func CheckCoordinates(sys *System, lookupSponsor func(uuid.UUID) *System) (CoordsStatus, string) {
 	// No sponsor = must be genesis
 	if sys.SponsorID == nil {
 		// Class X (genesis) is allowed without a sponsor if at origin
 		if sys.Stars.Primary.Class == "X" {
-			// In isolated mode, any Class X at origin is valid
-			if isolatedMode != nil && *isolatedMode {
-				return sys.X == 0 && sys.Y == 0 && sys.Z == 0
+			atOrigin := sys.X == 0 && sys.Y == 0 && sys.Z == 0
+			// In isolated mode any Class X at origin is valid; in production only the real genesis UUID is at origin
+			if !atOrigin {
+				return CoordsInvalid, "unsponsored class X away from the origin"
 			}
-			// In production, only the real genesis UUID at origin is valid
-			return sys.X == 0 && sys.Y == 0 && sys.Z == 0
+			return CoordsValid, ""
 		}
 		// All other nodes must have a sponsor
-		return false
+		return CoordsInvalid, fmt.Sprintf("no sponsor for a class %s system", sys.Stars.Primary.Class)
 	}
 
 	// Has sponsor - look them up
 	sponsor := lookupSponsor(*sys.SponsorID)
 	if sponsor == nil {
-		// Can't verify - sponsor unknown to us
-		// Accept for now (lenient) - we'll learn sponsor eventually
-		return true
+		return CoordsUnverified, ""
+	}
+
+	reason := matchClusteredCoordinates(sys, sponsor.X, sponsor.Y, sponsor.Z)
+	if reason == "" {
+		return CoordsValid, ""
+	}
+
+	// A former genesis sponsored its older systems from the origin
+	if sponsor.GenesisDemotion != nil && matchClusteredCoordinates(sys, 0, 0, 0) == "" {
+		return CoordsValid, ""
+	}
+	return CoordsInvalid, reason
+}
+
+// matchClusteredCoordinates checks sys against every derivation version
+// Returns "" on a match, otherwise how it differs from the version it records
+func matchClusteredCoordinates(sys *System, sponsorX, sponsorY, sponsorZ float64) string {
+	for _, d := range coordsDerivations {
+		x, y, z := CalculateExpectedCoordinates(d.version, sys.ID, *sys.SponsorID, sponsorX, sponsorY, sponsorZ)
+		if coordsApproxEqual(sys.X, x) && coordsApproxEqual(sys.Y, y) && coordsApproxEqual(sys.Z, z) {
+			return ""
+		}
+	}
+
+	d, ok := findCoordsDerivation(sys.CoordsVersion)
+	prefix := ""
+	if !ok {
+		prefix = fmt.Sprintf("unknown derivation v%d, ", sys.CoordsVersion)
+		d, _ = findCoordsDerivation(CurrentCoordsDerivation)
+	}
+	return prefix + describeCoordsMismatch(d, sys, sponsorX, sponsorY, sponsorZ)
+}
+
+// describeCoordsMismatch names the first component of sys's offset from its sponsor
+// that doesn't follow from derivation d: distance band, distance, polar angle, azimuth
+func describeCoordsMismatch(d coordsDerivation, sys *System, sponsorX, sponsorY, sponsorZ float64) string {
+	expected := d.derive(sys.ID, *sys.SponsorID)
+	dx, dy, dz := sys.X-sponsorX, sys.Y-sponsorY, sys.Z-sponsorZ
+	distance := math.Sqrt(dx*dx + dy*dy + dz*dz)
+
+	if distance < ClusterMinDistance-coordsEpsilon || distance > ClusterMaxDistance+coordsEpsilon {
+		return fmt.Sprintf("distance %.2f from sponsor outside the %.0f-%.0f band",
+			distance, ClusterMinDistance, ClusterMaxDistance)
+	}
+	if math.Abs(distance-expected.Distance) >= coordsEpsilon {
+		return fmt.Sprintf("distance %.4f from sponsor, v%d expects %.4f", distance, d.version, expected.Distance)
 	}
 
-	// Calculate expected position
-	expX, expY, expZ := CalculateExpectedCoordinates(sys.ID, *sys.SponsorID, sponsor.X, sponsor.Y, sponsor.Z)
+	// Angles are compared by the arc they move the system along, so the tolerance stays coordsEpsilon
+	phi := math.Acos(math.Max(-1, math.Min(1, dz/distance)))
+	if math.Abs(phi-expected.Phi)*distance >= coordsEpsilon {
+		return fmt.Sprintf("polar angle %.6f rad, v%d expects %.6f", phi, d.version, expected.Phi)
+	}
+	theta := math.Atan2(dy, dx)
+	if theta < 0 {
+		theta += 2 * math.Pi
+	}
+	dTheta := math.Abs(theta - expected.Theta)
+	if dTheta > math.Pi {
+		dTheta = 2*math.Pi - dTheta
+	}
+	if dTheta*distance*math.Sin(phi) >= coordsEpsilon {
+		return fmt.Sprintf("azimuth %.6f rad, v%d expects %.6f", theta, d.version, expected.Theta)
+	}
 
-	return coordsApproxEqual(sys.X, expX) &&
-		coordsApproxEqual(sys.Y, expY) &&
-		coordsApproxEqual(sys.Z, expZ)
+	// Each component is within tolerance but their errors add up
+	x, y, z := expected.cartesian()
+	return fmt.Sprintf("offset (%.4f, %.4f, %.4f) from sponsor, v%d expects (%.4f, %.4f, %.4f)",
+		dx, dy, dz, d.version, x, y, z)
 }
 
 // coordsApproxEqual checks if two coordinates are approximately equal
 // Allows for small floating point differences
 func coordsApproxEqual(a, b float64) bool {
-	const epsilon = 0.01 // Allow tiny rounding differences
 	diff := a - b
 	if diff < 0 {
 		diff = -diff
 	}
-	return diff < epsilon
+	return diff < coordsEpsilon
 }
 
 // DistanceTo calculates Euclidean distance to another system
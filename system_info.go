@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SystemInfoSchema versions the /system response. Fields are only ever added, under the
+// names System has always used, so older parsers (even ones decoding a System) keep
+// working; a change they would misread needs a new version. Responses from nodes before
+// versioning have no schema field and read as version 0.
+const SystemInfoSchema = 1
+
+// SystemInfo is a system as served at /system: what a peer needs to bootstrap from it and
+// check its signed info. It's copied field by field, so anything added to System stays
+// private until it's added here too, and the key pair never leaves as anything but the
+// public key
+type SystemInfo struct {
+	Schema           int              `json:"schema"`
+	ID               uuid.UUID        `json:"id"`
+	Name             string           `json:"name"`
+	X                float64          `json:"x"`
+	Y                float64          `json:"y"`
+	Z                float64          `json:"z"`
+	Stars            MultiStarSystem  `json:"stars"`
+	CreatedAt        time.Time        `json:"created_at"`
+	LastSeenAt       time.Time        `json:"last_seen_at"`
+	Address          string           `json:"address"`
+	PeerAddress      string           `json:"peer_address"`
+	PublicKey        string           `json:"public_key,omitempty"` // Base64 Ed25519 identity key
+	SponsorID        *uuid.UUID       `json:"sponsor_id,omitempty"`
+	InfoVersion      int64            `json:"info_version"`
+	InfoSignature    string           `json:"info_signature,omitempty"`
+	PeerTLS          bool             `json:"peer_tls,omitempty"`
+	GenesisDemotion  *GenesisDemotion `json:"genesis_demotion,omitempty"`
+	CoordsVersion    int              `json:"coords_version,omitempty"`
+	StarsVersion     int              `json:"stars_version,omitempty"`
+	ProcessStartTime int64            `json:"process_start_time,omitempty"`
+	Profile          *OperatorProfile `json:"profile,omitempty"`
+	ProtocolVersion  string           `json:"protocol_version"`
+	Capabilities     []string         `json:"capabilities"`
+}
+
+// NewSystemInfo describes sys for /system
+func NewSystemInfo(sys *System) *SystemInfo {
+	info := &SystemInfo{
+		Schema:           SystemInfoSchema,
+		ID:               sys.ID,
+		Name:             sys.Name,
+		X:                sys.X,
+		Y:                sys.Y,
+		Z:                sys.Z,
+		Stars:            sys.Stars,
+		CreatedAt:        sys.CreatedAt,
+		LastSeenAt:       sys.LastSeenAt,
+		Address:          sys.Address,
+		PeerAddress:      sys.PeerAddress,
+		SponsorID:        sys.SponsorID,
+		InfoVersion:      sys.InfoVersion,
+		InfoSignature:    sys.InfoSignature,
+		PeerTLS:          sys.PeerTLS,
+		GenesisDemotion:  sys.GenesisDemotion,
+		CoordsVersion:    sys.CoordsVersion,
+		StarsVersion:     sys.StarsVersion,
+		ProcessStartTime: sys.ProcessStartTime,
+		Profile:          sys.Profile,
+		ProtocolVersion:  CurrentProtocolVersion.String(),
+		Capabilities:     LocalCapabilities.Names(),
+	}
+	if sys.Keys != nil {
+		info.PublicKey = base64.StdEncoding.EncodeToString(sys.Keys.PublicKey)
+	}
+	return info
+}
+
+// System turns a peer's /system response back into a System (without keys), checking
+// its info signature against the key it gave when it gave both
+func (info *SystemInfo) System() (*System, error) {
+	sys := &System{
+		ID:               info.ID,
+		Name:             info.Name,
+		X:                info.X,
+		Y:                info.Y,
+		Z:                info.Z,
+		Stars:            info.Stars,
+		CreatedAt:        info.CreatedAt,
+		LastSeenAt:       info.LastSeenAt,
+		Address:          info.Address,
+		PeerAddress:      info.PeerAddress,
+		SponsorID:        info.SponsorID,
+		InfoVersion:      info.InfoVersion,
+		InfoSignature:    info.InfoSignature,
+		PeerTLS:          info.PeerTLS,
+		GenesisDemotion:  info.GenesisDemotion,
+		CoordsVersion:    info.CoordsVersion,
+		StarsVersion:     info.StarsVersion,
+		ProcessStartTime: info.ProcessStartTime,
+		Profile:          info.Profile,
+	}
+	if info.PublicKey != "" && info.InfoSignature != "" && !sys.VerifyInfo(info.PublicKey) {
+		return nil, fmt.Errorf("system info signature doesn't match its public key")
+	}
+	return sys, nil
+}
+
+// MarshalJSON writes only the public key, whatever the struct tags say, so a key pair
+// that ends up in a response by mistake still can't leak the private key
+func (k *KeyPair) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		PublicKey []byte `json:"public_key"`
+	}{k.PublicKey})
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background task names, as listed by /api/tasks
+const (
+	TaskAnnounce           = "announce"
+	TaskLiveness           = "liveness"
+	TaskGossipValidation   = "gossip-validation"
+	TaskCachePrune         = "cache-prune"
+	TaskCredits            = "credits"
+	TaskGalaxySnapshot     = "galaxy-snapshot"
+	TaskCoordsVerification = "coords-verification"
+	TaskCompaction         = "compaction"
+	TaskAttestationFlush   = "attestation-flush"
+	TaskPortMapping        = "port-mapping"
+	TaskAddressConflicts   = "address-conflicts"
+	TaskRankVerification   = "rank-verification"
+	TaskRetention          = "retention"
+	TaskPersonalSeeds      = "personal-seeds"
+	TaskPartition          = "partition"
+	TaskBucketRefresh      = "bucket-refresh"
+	TaskMessageDelivery    = "message-delivery"
+	TaskLocalPeers         = "local-peers"
+	TaskAdvisor            = "advisor"
+	TaskTrafficFlush       = "traffic-flush"
+	TaskTransferRetry      = "transfer-retry"
+)
+
+var (
+	// ErrUnknownTask is returned when running a task that isn't registered
+	ErrUnknownTask = errors.New("unknown task")
+)
+
+// task is one background loop's bookkeeping
+// Loops update it once per run, so a mutex per task costs nothing measurable
+type task struct {
+	name     string
+	schedule string        // Human readable, e.g. "every 10m"
+	trigger  chan struct{} // Manual run requests, picked up by the loop itself
+
+	mu        sync.Mutex
+	running   bool
+	runs      int64
+	lastStart time.Time
+	lastEnd   time.Time
+	lastItems int
+	lastErr   string
+	nextRun   time.Time
+}
+
+// TaskStatus is a snapshot of one background task (/api/tasks)
+type TaskStatus struct {
+	Name         string `json:"name"`
+	Schedule     string `json:"schedule"`
+	Running      bool   `json:"running"`
+	Runs         int64  `json:"runs"`
+	LastStart    int64  `json:"last_start,omitempty"`
+	LastEnd      int64  `json:"last_end,omitempty"`
+	LastDuration int64  `json:"last_duration_ms"`
+	LastItems    int    `json:"last_items"` // What the last run processed (peers pinged, rows written...)
+	LastError    string `json:"last_error,omitempty"`
+	NextRun      int64  `json:"next_run,omitempty"`
+}
+
+// taskRegistry tracks the background loops of a DHT
+type taskRegistry struct {
+	mu    sync.RWMutex
+	tasks map[string]*task
+}
+
+func newTaskRegistry() *taskRegistry {
+	return &taskRegistry{tasks: make(map[string]*task)}
+}
+
+// register adds a task, or returns the existing one after a restart of its loop
+func (r *taskRegistry) register(name, schedule string) *task {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.tasks[name]; ok {
+		return t
+	}
+	t := &task{name: name, schedule: schedule, trigger: make(chan struct{}, 1)}
+	r.tasks[name] = t
+	return t
+}
+
+func (r *taskRegistry) get(name string) *task {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.tasks[name]
+}
+
+// begin marks the start of a run
+func (t *task) begin() {
+	t.mu.Lock()
+	t.running = true
+	t.lastStart = time.Now()
+	t.mu.Unlock()
+}
+
+// end records the outcome of the run started by begin
+func (t *task) end(items int, err error) {
+	t.mu.Lock()
+	t.running = false
+	t.runs++
+	t.lastEnd = time.Now()
+	t.lastItems = items
+	t.lastErr = ""
+	if err != nil {
+		t.lastErr = err.Error()
+	}
+	t.mu.Unlock()
+}
+
+// run wraps one run of fn in begin/end
+func (t *task) run(fn func() (int, error)) {
+	t.begin()
+	items, err := fn()
+	t.end(items, err)
+}
+
+// scheduleNext records when the loop will next run on its own
+func (t *task) scheduleNext(at time.Time) {
+	t.mu.Lock()
+	t.nextRun = at
+	t.mu.Unlock()
+}
+
+// next returns when the task will next run on its own (zero if unknown)
+func (t *task) next() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nextRun
+}
+
+func (t *task) status() TaskStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := TaskStatus{
+		Name:      t.name,
+		Schedule:  t.schedule,
+		Running:   t.running,
+		Runs:      t.runs,
+		LastItems: t.lastItems,
+		LastError: t.lastErr,
+	}
+	if !t.lastStart.IsZero() {
+		s.LastStart = t.lastStart.Unix()
+	}
+	if !t.lastEnd.IsZero() {
+		s.LastEnd = t.lastEnd.Unix()
+		if !t.running {
+			s.LastDuration = t.lastEnd.Sub(t.lastStart).Milliseconds()
+		}
+	}
+	if !t.nextRun.IsZero() {
+		s.NextRun = t.nextRun.Unix()
+	}
+	return s
+}
+
+// GetTasks returns the state of every registered background task, by name
+func (dht *DHT) GetTasks() []TaskStatus {
+	dht.tasks.mu.RLock()
+	statuses := make([]TaskStatus, 0, len(dht.tasks.tasks))
+	for _, t := range dht.tasks.tasks {
+		statuses = append(statuses, t.status())
+	}
+	dht.tasks.mu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// RunTask asks a background loop to run now instead of waiting for its schedule
+// The loop runs it as soon as it's free; requests made while one is queued are merged
+func (dht *DHT) RunTask(name string) error {
+	t := dht.tasks.get(name)
+	if t == nil {
+		return ErrUnknownTask
+	}
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// every describes a fixed interval schedule ("every 10m", not "every 10m0s")
+func every(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return "every " + s
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// MaxTransferMemoLength caps the optional memo attached to a transfer
+	MaxTransferMemoLength = 140
+
+	// MaxTransferBodySize limits inbound transfer requests
+	// Larger than the 1MB DHT limit since proofs carry attestations
+	MaxTransferBodySize = 4 << 20
+
+	// TransferProofBudget is how big a transfer's proof may get, leaving room in
+	// MaxTransferBodySize for the rest of the signed transfer
+	TransferProofBudget = MaxTransferBodySize - 16<<10
+
+	// MaxTransferGossipHops is how far an accepted transfer travels from its recipient
+	// Each relay only forwards transfers it hadn't seen, so this just bounds fan-out
+	MaxTransferGossipHops = 3
+
+	// TransferRetryInterval is how often transfers whose delivery went unconfirmed are resent
+	TransferRetryInterval = time.Minute
+)
+
+// Transfer errors (checked with errors.Is by callers to pick a response)
+var (
+	ErrInsufficientCredits  = errors.New("insufficient credits")
+	ErrRecipientUnreachable = errors.New("recipient unreachable")
+	ErrDuplicateTransfer    = errors.New("duplicate transfer")
+	ErrTransferRefused      = errors.New("transfer refused")
+	ErrTransferUnconfirmed  = errors.New("transfer delivery unconfirmed")
+)
+
+// === Sending ===
+
+// SendCredits signs a transfer with a minimal proof and delivers it to the recipient
+// The debit is reserved with a pending record before delivery, so a concurrent send or
+// credit calculation sees it, and the lock isn't held across the network call. If the
+// recipient refuses the transfer, or was never reached, the reservation is released,
+// leaving our balance as it was. If the delivery was cut off after it went out (a
+// timeout or reset), the recipient may have credited it already, so it stays pending and
+// debited and is resent with the same ID until the recipient answers.
+func (dht *DHT) SendCredits(toID uuid.UUID, amount int64, memo string) (*CreditTransfer, error) {
+	recipient, err := dht.transferRecipient(toID, amount, memo)
+	if err != nil {
+		return nil, err
+	}
+
+	dht.creditMu.Lock()
+	transfer, _, err := dht.buildTransfer(toID, amount, memo)
+	if err == nil {
+		err = dht.storage.ReserveCreditTransfer(transfer)
+	}
+	dht.creditMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	err = dht.deliverTransfer(recipient.PeerAddress, transfer)
+
+	dht.creditMu.Lock()
+	defer dht.creditMu.Unlock()
+
+	switch {
+	case err == nil, errors.Is(err, ErrDuplicateTransfer):
+		// A duplicate means an earlier attempt at this same transfer got through
+	case errors.Is(err, ErrTransferUnconfirmed):
+		log.Printf("Transfer %s to %s unconfirmed, will retry: %v", transfer.ID.String()[:8], toID.String()[:8], err)
+		return nil, fmt.Errorf("%w; it stays debited and is resent until %s answers", err, recipient.Name)
+	default:
+		if releaseErr := dht.storage.ReleaseCreditTransfer(transfer); releaseErr != nil {
+			log.Printf("ERROR: transfer %s failed but its debit wasn't released: %v", transfer.ID, releaseErr)
+		}
+		return nil, err
+	}
+	if err := dht.storage.FinalizeCreditTransfer(transfer.ID); err != nil {
+		log.Printf("Warning: transfer %s delivered but still marked pending: %v", transfer.ID, err)
+	}
+
+	log.Printf("✦ Sent %d stellar credits to %s (%s) [transfer %s]",
+		amount, recipient.Name, toID.String()[:8], transfer.ID.String()[:8])
+
+	return transfer, nil
+}
+
+// TransferPreview is what a transfer would look like, for confirming it before sending
+type TransferPreview struct {
+	ToSystemID        string `json:"to_system_id"`
+	ToName            string `json:"to_name"`
+	Amount            int64  `json:"amount"`
+	Balance           int64  `json:"balance"`            // Before the transfer
+	ProofAttestations int    `json:"proof_attestations"` // Attestations the proof carries
+	ProofBytes        int    `json:"proof_bytes"`        // Size of the signed transfer, proof included
+	RecipientOnline   bool   `json:"recipient_online"`
+	RecipientError    string `json:"recipient_error,omitempty"` // Why the recipient didn't answer a ping
+}
+
+// PreviewTransfer builds the transfer SendCredits would send, without sending it, and
+// pings the recipient so an offline one is caught before anything is signed for real
+func (dht *DHT) PreviewTransfer(toID uuid.UUID, amount int64, memo string) (*TransferPreview, error) {
+	recipient, err := dht.transferRecipient(toID, amount, memo)
+	if err != nil {
+		return nil, err
+	}
+
+	dht.creditMu.Lock()
+	transfer, balance, err := dht.buildTransfer(toID, amount, memo)
+	dht.creditMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(transfer)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &TransferPreview{
+		ToSystemID:        toID.String(),
+		ToName:            recipient.Name,
+		Amount:            amount,
+		Balance:           balance.Balance,
+		ProofAttestations: len(transfer.Proof.Attestations),
+		ProofBytes:        len(data),
+		RecipientOnline:   true,
+	}
+	if err := dht.PingNode(recipient); err != nil {
+		preview.RecipientOnline = false
+		preview.RecipientError = fmt.Sprintf("%s didn't answer: %v", recipient.Name, err)
+	}
+	return preview, nil
+}
+
+// transferRecipient checks a transfer's arguments and finds where the recipient lives,
+// before anything touches the balance
+func (dht *DHT) transferRecipient(toID uuid.UUID, amount int64, memo string) (*System, error) {
+	if dht.localSystem.Keys == nil {
+		return nil, ErrNoKeys
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	if toID == dht.localSystem.ID {
+		return nil, fmt.Errorf("cannot send credits to self")
+	}
+	if len(memo) > MaxTransferMemoLength {
+		return nil, fmt.Errorf("memo must be %d characters or less", MaxTransferMemoLength)
+	}
+
+	recipient, err := dht.Lookup(toID)
+	if err != nil || recipient.PeerAddress == "" {
+		return nil, fmt.Errorf("%w: %s is not a known system", ErrRecipientUnreachable, toID)
+	}
+	return recipient, nil
+}
+
+// buildTransfer signs a transfer with a minimal proof and runs the check the recipient
+// will, so we fail fast with a clear reason. Returns the balance it was built against
+// Call with creditMu held
+func (dht *DHT) buildTransfer(toID uuid.UUID, amount int64, memo string) (*CreditTransfer, *CreditBalance, error) {
+	balance, err := dht.storage.GetCreditBalance(dht.localSystem.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get credit balance: %w", err)
+	}
+	if balance.Balance < amount {
+		return nil, nil, fmt.Errorf("%w: have %d, need %d", ErrInsufficientCredits, balance.Balance, amount)
+	}
+
+	// Build a proof from attestations other systems have sent us
+	if err := dht.FlushAttestations(); err != nil {
+		return nil, nil, fmt.Errorf("failed to save buffered attestations: %w", err)
+	}
+	page := func(limit int, before int64) ([]*Attestation, error) {
+		return dht.storage.GetRecentAttestationsForSystem(dht.localSystem.ID, limit, before)
+	}
+
+	transfer := NewCreditTransfer(dht.localSystem, toID, amount, memo)
+	transfer.Proof, err = BuildMinimalProof(dht.localSystem, amount, balance.TotalSent, page, TransferProofBudget)
+	if errors.Is(err, ErrProofTooLarge) {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load attestations: %w", err)
+	}
+
+	if err := ValidateTransferProof(transfer, nil); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInsufficientCredits, err)
+	}
+	return transfer, balance, nil
+}
+
+// deliverTransfer posts a signed transfer to the recipient's DHT port
+// Errors say what the recipient did with it: ErrRecipientUnreachable if it was never
+// reached or doesn't take transfers, ErrTransferRefused or ErrDuplicateTransfer if it
+// answered, and ErrTransferUnconfirmed if the request went out but no answer came back
+func (dht *DHT) deliverTransfer(address string, transfer *CreditTransfer) error {
+	data, err := json.Marshal(transfer)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxTransferBodySize {
+		return fmt.Errorf("%w: transfer is %d bytes, over the %d a recipient takes", ErrMessageTooLarge, len(data), MaxTransferBodySize)
+	}
+
+	url := peerURL(address, "/api/transfer")
+	resp, err := dht.httpClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		// Only a failed dial is sure not to have reached the recipient
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("%w: %v", ErrRecipientUnreachable, err)
+		}
+		return fmt.Errorf("%w: %v", ErrTransferUnconfirmed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: recipient does not accept transfers (older version)", ErrRecipientUnreachable)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error DHTError `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error.Code == 0 {
+			// Not the recipient's answer (a proxy, or the body was cut off)
+			return fmt.Errorf("%w: status %d", ErrTransferUnconfirmed, resp.StatusCode)
+		}
+
+		if errResp.Error.Code == ErrCodeDuplicateTransfer {
+			return fmt.Errorf("%w: %s", ErrDuplicateTransfer, errResp.Error.Message)
+		}
+		return fmt.Errorf("%w: recipient rejected transfer: %s", ErrTransferRefused, errResp.Error.Message)
+	}
+
+	return nil
+}
+
+// transferRetryLoop resends transfers whose delivery went unconfirmed
+func (dht *DHT) transferRetryLoop() {
+	defer dht.wg.Done()
+
+	t := dht.tasks.register(TaskTransferRetry, every(TransferRetryInterval))
+
+	ticker := time.NewTicker(TransferRetryInterval)
+	defer ticker.Stop()
+	t.scheduleNext(time.Now().Add(TransferRetryInterval))
+
+	for {
+		select {
+		case <-dht.shutdown:
+			return
+		case <-ticker.C:
+			t.scheduleNext(time.Now().Add(TransferRetryInterval))
+		case <-t.trigger:
+		}
+		t.run(dht.retryPendingTransfers)
+	}
+}
+
+// retryPendingTransfers resends every pending transfer once, with its original ID and
+// signature. Returns how many were attempted
+func (dht *DHT) retryPendingTransfers() (int, error) {
+	pending, err := dht.storage.GetPendingCreditTransfers()
+	if err != nil {
+		return 0, err
+	}
+	for _, transfer := range pending {
+		dht.retryTransfer(transfer)
+	}
+	return len(pending), nil
+}
+
+// retryTransfer resends a pending transfer and settles it once the recipient answers
+// An earlier attempt may have landed, so only an explicit refusal gives the amount back;
+// a recipient that is unreachable or still doesn't answer leaves it pending
+func (dht *DHT) retryTransfer(transfer *CreditTransfer) {
+	recipient, err := dht.Lookup(transfer.ToSystemID)
+	if err != nil || recipient.PeerAddress == "" {
+		return
+	}
+	err = dht.deliverTransfer(recipient.PeerAddress, transfer)
+
+	dht.creditMu.Lock()
+	defer dht.creditMu.Unlock()
+
+	switch {
+	case err == nil, errors.Is(err, ErrDuplicateTransfer):
+		if err := dht.storage.FinalizeCreditTransfer(transfer.ID); err != nil {
+			log.Printf("Warning: transfer %s delivered but still marked pending: %v", transfer.ID, err)
+			return
+		}
+		log.Printf("✦ Transfer %s of %d stellar credits to %s confirmed on retry",
+			transfer.ID.String()[:8], transfer.Amount, transfer.ToSystemID.String()[:8])
+	case errors.Is(err, ErrTransferRefused):
+		if err := dht.storage.ReleaseCreditTransfer(transfer); err != nil {
+			log.Printf("ERROR: transfer %s was refused but its debit wasn't released: %v", transfer.ID, err)
+			return
+		}
+		log.Printf("Transfer %s to %s refused on retry, %d credits returned: %v",
+			transfer.ID.String()[:8], transfer.ToSystemID.String()[:8], transfer.Amount, err)
+	}
+}
+
+// === Receiving ===
+
+// handleCreditTransfer accepts a transfer addressed to this system
+// The proof is validated against every transfer we've already seen from the sender
+func (dht *DHT) handleCreditTransfer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		dht.sendError(w, ErrCodeInvalidMessage, "method not allowed")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxTransferBodySize)
+
+	var transfer CreditTransfer
+	if err := json.NewDecoder(r.Body).Decode(&transfer); err != nil {
+		dht.sendError(w, ErrCodeInvalidMessage, "invalid JSON: "+err.Error())
+		return
+	}
+
+	if transfer.ToSystemID != dht.localSystem.ID {
+		dht.sendError(w, ErrCodeInvalidTransfer, "transfer not addressed to this system")
+		return
+	}
+	if transfer.FromSystemID == dht.localSystem.ID {
+		dht.sendError(w, ErrCodeInvalidTransfer, "cannot receive transfer from self")
+		return
+	}
+	if transfer.Amount <= 0 {
+		dht.sendError(w, ErrCodeInvalidTransfer, "amount must be positive")
+		return
+	}
+	if len(transfer.Memo) > MaxTransferMemoLength {
+		dht.sendError(w, ErrCodeInvalidTransfer, "memo too long")
+		return
+	}
+
+	// Sender's key must match the one bound to their UUID
+	valid, _, err := dht.storage.ValidateIdentityBinding(transfer.FromSystemID, transfer.PublicKey, nil)
+	if err != nil {
+		log.Printf("Identity binding check failed: %v", err)
+		dht.sendError(w, ErrCodeInternalError, "identity validation error")
+		return
+	}
+	if !valid {
+		dht.sendError(w, ErrCodeInvalidTransfer, "identity mismatch: UUID bound to different key")
+		return
+	}
+
+	dht.creditMu.Lock()
+	defer dht.creditMu.Unlock()
+
+	exists, err := dht.storage.HasVerifiedTransfer(transfer.ID)
+	if err != nil {
+		dht.sendError(w, ErrCodeInternalError, "failed to check transfer history")
+		return
+	}
+	if exists {
+		dht.sendError(w, ErrCodeDuplicateTransfer, "transfer already received")
+		return
+	}
+
+	known, err := dht.storage.GetVerifiedTransfersFor(transfer.FromSystemID)
+	if err != nil {
+		dht.sendError(w, ErrCodeInternalError, "failed to load transfer history")
+		return
+	}
+
+	if err := ValidateTransferProof(&transfer, known); err != nil {
+		log.Printf("Rejected transfer %s from %s: %v", transfer.ID.String()[:8], transfer.FromSystemID.String()[:8], err)
+		dht.sendError(w, ErrCodeInvalidTransfer, err.Error())
+		return
+	}
+
+	// Recorded and credited together, so a failure leaves neither and a resend is taken
+	if err := dht.storage.AcceptCreditTransfer(&transfer); errors.Is(err, ErrDuplicateTransfer) {
+		dht.sendError(w, ErrCodeDuplicateTransfer, "transfer already received")
+		return
+	} else if err != nil {
+		dht.sendError(w, ErrCodeInternalError, "failed to store transfer")
+		return
+	}
+
+	log.Printf("✦ Received %d stellar credits from %s [transfer %s]",
+		transfer.Amount, transfer.FromSystemID.String()[:8], transfer.ID.String()[:8])
+
+	// Tell our peers, so the sender can't spend the same balance again elsewhere
+	go dht.gossipTransfer(&transfer, 1, transfer.FromSystemID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "accepted",
+		"transfer_id": transfer.ID.String(),
+	})
+}
+
+// === Gossip ===
+
+// handleTransferAnnounce records a transfer another node accepted and relays it onward
+func (dht *DHT) handleTransferAnnounce(msg *DHTMessage) (*DHTMessage, error) {
+	dht.routingTable.MarkVerified(msg.FromSystem.ID)
+	dht.routingTable.CacheSystem(msg.FromSystem, msg.FromSystem.ID, true)
+
+	if dht.recordGossipedTransfer(msg.Transfer) && msg.Hops < MaxTransferGossipHops {
+		go dht.gossipTransfer(msg.Transfer, msg.Hops+1, msg.FromSystem.ID)
+	}
+
+	return NewTransferAnnounceResponse(dht.localSystem, msg.FromSystem.ID, msg.RequestID)
+}
+
+// recordGossipedTransfer stores a relayed transfer for double-spend checks
+// Returns true only the first time a transfer is seen, which is what stops relay loops.
+// The signature was checked in Validate; the key must also be the one bound to the sender.
+func (dht *DHT) recordGossipedTransfer(transfer *CreditTransfer) bool {
+	// Our own transfers are in credit_transfers, and transfers to us are only
+	// ever credited through direct delivery
+	if transfer.FromSystemID == dht.localSystem.ID || transfer.ToSystemID == dht.localSystem.ID {
+		return false
+	}
+
+	// Don't bind an identity on hearsay - only trust keys we learned first-hand
+	boundKey, err := dht.storage.GetIdentityBinding(transfer.FromSystemID)
+	if err != nil {
+		log.Printf("Identity lookup failed for gossiped transfer %s: %v", transfer.ID.String()[:8], err)
+		return false
+	}
+	if boundKey != transfer.PublicKey {
+		return false
+	}
+
+	dht.creditMu.Lock()
+	defer dht.creditMu.Unlock()
+
+	exists, err := dht.storage.HasVerifiedTransfer(transfer.ID)
+	if err != nil || exists {
+		return false
+	}
+
+	transfer.Proof = nil
+	if err := dht.storage.SaveVerifiedTransfer(transfer); err != nil {
+		log.Printf("Failed to store gossiped transfer %s: %v", transfer.ID.String()[:8], err)
+		return false
+	}
+
+	log.Printf("Learned of transfer %s: %d credits from %s to %s",
+		transfer.ID.String()[:8], transfer.Amount,
+		transfer.FromSystemID.String()[:8], transfer.ToSystemID.String()[:8])
+	return true
+}
+
+// gossipTransfer sends a transfer to every routing table peer except the ones that already have it
+// exclude is the peer we heard it from (or the sender, when we are the recipient)
+func (dht *DHT) gossipTransfer(transfer *CreditTransfer, hops int, exclude uuid.UUID) {
+	sent := 0
+	for _, sys := range dht.routingTable.GetAllRoutingTableNodes() {
+		if sys.PeerAddress == "" || sys.ID == exclude ||
+			sys.ID == transfer.FromSystemID || sys.ID == transfer.ToSystemID {
+			continue
+		}
+		// Older nodes reject the message type; they just won't help catch double spends
+		if !dht.peerSupports(sys.ID, CapTransferAnnounce) {
+			continue
+		}
+
+		msg, err := NewTransferAnnounceRequest(dht.localSystem, sys.ID, transfer, hops, "")
+		if err != nil {
+			return
+		}
+		if _, err := dht.sendRequest(sys.PeerAddress, msg); err == nil {
+			sent++
+		}
+	}
+
+	if sent > 0 {
+		log.Printf("Relayed transfer %s to %d peers (hop %d)", transfer.ID.String()[:8], sent, hops)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// DefaultUptimeHistoryDays is how far back /api/uptime looks by default
+	DefaultUptimeHistoryDays = 30
+
+	// MaxUptimeHistoryDays bounds the /api/uptime range
+	MaxUptimeHistoryDays = 90
+)
+
+// UptimeBucket is the attestations received in one time bucket
+type UptimeBucket struct {
+	Start int64 `json:"start"` // Unix time the bucket begins
+	Count int   `json:"count"`
+	First int64 `json:"first"` // Earliest attestation in the bucket
+	Last  int64 `json:"last"`  // Latest attestation in the bucket
+}
+
+// DayUptime is one UTC day of derived uptime
+type DayUptime struct {
+	Date         string  `json:"date"` // YYYY-MM-DD (UTC)
+	Start        int64   `json:"start"`
+	Attestations int     `json:"attestations"`
+	UptimePct    float64 `json:"uptime_pct"`
+}
+
+// UptimeHistory is the /api/uptime response
+type UptimeHistory struct {
+	Since          int64          `json:"since"`
+	Bucket         string         `json:"bucket"` // "hour" or "day"
+	GracePeriodSec int64          `json:"grace_period_seconds"`
+	Buckets        []UptimeBucket `json:"buckets"`
+	Days           []DayUptime    `json:"days"`
+}
+
+// DailyUptime derives per-day uptime from hourly buckets, using the same coverage and
+// gap rules as CalculateEarnedCredits: silence longer than the grace period is downtime,
+// and so is the time before the first attestation in range and after the last one
+func (cc *CreditCalculator) DailyUptime(hourly []UptimeBucket, since, now time.Time) []DayUptime {
+	start, end := since.Unix(), now.Unix()
+	gracePeriodSec := int64(cc.GracePeriod.Seconds())
+
+	var covered []interval
+	for _, b := range hourly {
+		covered = append(covered, cc.coverage(b.Count, b.First, b.Last)...)
+	}
+
+	// Downtime is each gap minus the grace period at its start
+	var downtime []interval
+	addGap := func(from, to int64) {
+		if to-from > gracePeriodSec {
+			downtime = append(downtime, interval{from + gracePeriodSec, to})
+		}
+	}
+	if len(covered) == 0 {
+		downtime = append(downtime, interval{start, end})
+	} else {
+		gaps := cc.downtimeGaps(covered) // Sorts covered
+		if covered[0].start > start {
+			// No grace here: nothing says we were up just before the range
+			downtime = append(downtime, interval{start, covered[0].start})
+		}
+		for _, gap := range gaps {
+			addGap(gap.start, gap.end)
+		}
+		last := covered[0].end
+		for _, iv := range covered {
+			if iv.end > last {
+				last = iv.end
+			}
+		}
+		addGap(last, end)
+	}
+
+	var days []DayUptime
+	for day := since.UTC().Truncate(24 * time.Hour); day.Unix() < end; day = day.Add(24 * time.Hour) {
+		from := day.Unix()
+		to := day.Add(24 * time.Hour).Unix()
+		if from < start {
+			from = start
+		}
+		if to > end {
+			to = end
+		}
+
+		d := DayUptime{Date: day.Format("2006-01-02"), Start: day.Unix()}
+		for _, b := range hourly {
+			if b.Start >= d.Start && b.Start < d.Start+86400 {
+				d.Attestations += b.Count
+			}
+		}
+
+		var down int64
+		for _, iv := range downtime {
+			lo, hi := iv.start, iv.end
+			if lo < from {
+				lo = from
+			}
+			if hi > to {
+				hi = to
+			}
+			if hi > lo {
+				down += hi - lo
+			}
+		}
+		if to > from {
+			d.UptimePct = math.Round(1000*(1-float64(down)/float64(to-from))) / 10
+		}
+		days = append(days, d)
+	}
+	return days
+}
+
+// GetUptimeHistory builds the uptime report for the last days (including today, UTC)
+// bucket is "hour" or "day" and only affects the raw buckets returned
+func (dht *DHT) GetUptimeHistory(days int, bucket string) (*UptimeHistory, error) {
+	now := time.Now()
+	since := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+
+	if err := dht.FlushAttestations(); err != nil {
+		return nil, err
+	}
+	hourly, err := dht.storage.GetUptimeHistogram(dht.localSystem.ID, time.Hour, since)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := hourly
+	if bucket == "day" {
+		if buckets, err = dht.storage.GetUptimeHistogram(dht.localSystem.ID, 24*time.Hour, since); err != nil {
+			return nil, err
+		}
+	}
+	if buckets == nil {
+		buckets = []UptimeBucket{}
+	}
+
+	cc := NewCreditCalculator()
+	return &UptimeHistory{
+		Since:          since.Unix(),
+		Bucket:         bucket,
+		GracePeriodSec: int64(cc.GracePeriod.Seconds()),
+		Buckets:        buckets,
+		Days:           cc.DailyUptime(hourly, since, now),
+	}, nil
+}
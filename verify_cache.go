@@ -0,0 +1,84 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// AttestationVerifyCacheSize is how many signature checks VerifyCached remembers
+// An attestation is checked in Validate and again when it's saved, and transfer proofs
+// check theirs twice; a few thousand covers that without holding on to much
+const AttestationVerifyCacheSize = 4096
+
+// verifyCache is a small LRU of attestation signature checks
+// Keyed by the signature together with the key and signed bytes, so a valid signature
+// copied onto different fields or another key is checked afresh
+type verifyCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	order   *list.List // Front is the most recently used
+	hits    int64
+	misses  int64
+}
+
+type verifyCacheEntry struct {
+	key   string
+	valid bool
+}
+
+// attestationVerifications is the process-wide cache VerifyCached consults
+var attestationVerifications = newVerifyCache(AttestationVerifyCacheSize)
+
+func newVerifyCache(max int) *verifyCache {
+	return &verifyCache{max: max, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns a remembered result
+func (c *verifyCache) get(key string) (valid, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return false, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*verifyCacheEntry).valid, true
+}
+
+// put remembers a result, dropping the least recently used past max
+func (c *verifyCache) put(key string, valid bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*verifyCacheEntry).valid = valid
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&verifyCacheEntry{key: key, valid: valid})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*verifyCacheEntry).key)
+	}
+}
+
+// stats returns the hits and misses so far
+func (c *verifyCache) stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// VerifyCached is Verify, remembering the result for an attestation seen again
+func (a *Attestation) VerifyCached() bool {
+	key := a.Signature + "\x00" + a.PublicKey + "\x00" + string(a.GetSignableMessage())
+	if valid, ok := attestationVerifications.get(key); ok {
+		return valid
+	}
+	valid := a.Verify()
+	attestationVerifications.put(key, valid)
+	return valid
+}
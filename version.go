@@ -14,7 +14,7 @@ var BuildVersion = "dev"
 var CurrentProtocolVersion ProtocolVersion
 
 func init() {
-	v, err := ParseVersion(BuildVersion)
+	v, err := ParseProtocolVersion(BuildVersion)
 	if err != nil {
 		// Fallback for dev builds - obviously not a release
 		CurrentProtocolVersion = ProtocolVersion{Major: 0, Minor: 0, Patch: 0}
@@ -25,42 +25,50 @@ func init() {
 
 // ProtocolVersion represents a semantic version
 type ProtocolVersion struct {
-	Major int `json:"major"`
-	Minor int `json:"minor"`
-	Patch int `json:"patch"`
+	Major int    `json:"major"`
+	Minor int    `json:"minor"`
+	Patch int    `json:"patch"`
+	Pre   string `json:"pre,omitempty"` // Pre-release (e.g. "rc.1"), sorts before the release itself
 }
 
-// String returns the version as a string (e.g., "1.0.0")
+// String returns the version as a string (e.g., "1.0.0" or "1.10.0-rc.1")
 func (v ProtocolVersion) String() string {
-	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
 }
 
-// ParseVersion parses a version string into a ProtocolVersion
-func ParseVersion(s string) (ProtocolVersion, error) {
+// ParseProtocolVersion parses a semantic version such as "1.10.0", "v1.10.0-rc.1" or "1.10.0+build.5"
+// Build metadata is ignored and a missing patch ("1.10") counts as 0
+func ParseProtocolVersion(s string) (ProtocolVersion, error) {
 	// Strip leading 'v' if present
-	s = strings.TrimPrefix(s, "v")
-	
-	parts := strings.Split(s, ".")
-	if len(parts) != 3 {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	s, _, _ = strings.Cut(s, "+")
+	core, pre, hasPre := strings.Cut(s, "-")
+	if hasPre && pre == "" {
 		return ProtocolVersion{}, fmt.Errorf("invalid version format: %s", s)
 	}
 
-	major, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return ProtocolVersion{}, fmt.Errorf("invalid major version: %s", parts[0])
+	parts := strings.Split(core, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return ProtocolVersion{}, fmt.Errorf("invalid version format: %s", s)
 	}
-
-	minor, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return ProtocolVersion{}, fmt.Errorf("invalid minor version: %s", parts[1])
+	if len(parts) == 2 {
+		parts = append(parts, "0")
 	}
 
-	patch, err := strconv.Atoi(parts[2])
-	if err != nil {
-		return ProtocolVersion{}, fmt.Errorf("invalid patch version: %s", parts[2])
+	nums := make([]int, 3)
+	for i, name := range []string{"major", "minor", "patch"} {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil || n < 0 {
+			return ProtocolVersion{}, fmt.Errorf("invalid %s version: %s", name, parts[i])
+		}
+		nums[i] = n
 	}
 
-	return ProtocolVersion{Major: major, Minor: minor, Patch: patch}, nil
+	return ProtocolVersion{Major: nums[0], Minor: nums[1], Patch: nums[2], Pre: pre}, nil
 }
 
 // IsCompatibleWith checks if this version is compatible with another
@@ -69,13 +77,61 @@ func (v ProtocolVersion) IsCompatibleWith(other ProtocolVersion) bool {
 	return v.Major == other.Major
 }
 
-// IsNewerThan returns true if this version is newer than other
-func (v ProtocolVersion) IsNewerThan(other ProtocolVersion) bool {
-	if v.Major != other.Major {
-		return v.Major > other.Major
+// Compare returns -1, 0 or +1 as v is older than, the same as or newer than other
+// Components compare as numbers (1.10.0 is newer than 1.9.0), and a pre-release is
+// older than its release, with pre-release identifiers ordered as semver orders them
+func (v ProtocolVersion) Compare(other ProtocolVersion) int {
+	for _, d := range []int{v.Major - other.Major, v.Minor - other.Minor, v.Patch - other.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+
+	switch {
+	case v.Pre == other.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case other.Pre == "":
+		return -1
+	}
+
+	a, b := strings.Split(v.Pre, "."), strings.Split(other.Pre, ".")
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := comparePreIdentifier(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(a) - len(b))
+}
+
+// comparePreIdentifier orders one dot-separated pre-release identifier:
+// numeric ones by value and before alphanumeric ones, alphanumeric ones in ASCII order
+func comparePreIdentifier(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return sign(an - bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
 	}
-	if v.Minor != other.Minor {
-		return v.Minor > other.Minor
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n > 0:
+		return 1
+	case n < 0:
+		return -1
 	}
-	return v.Patch > other.Patch
-}
\ No newline at end of file
+	return 0
+}
+
+// IsNewerThan returns true if this version is newer than other
+func (v ProtocolVersion) IsNewerThan(other ProtocolVersion) bool {
+	return v.Compare(other) > 0
+}
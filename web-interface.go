@@ -2,13 +2,18 @@ package main
 
 import (
     "bytes"
+    "context"
     "encoding/json"
+    "errors"
     "fmt"
-    "html/template"
     "log"
     "net"
     "net/http"
+    "strconv"
+    "strings"
     "time"
+
+    "github.com/google/uuid"
 )
 
 // WebInterface handles the web UI and API endpoints
@@ -16,12 +21,14 @@ type WebInterface struct {
     dht      *DHT
     storage  *Storage
     addr     string
-}
+    server   *http.Server
+    live     *LiveHub
+    public   bool // Read-only public mode: hides credits, attestations, IDs and addresses
 
-// KnownSystemData holds system info plus metadata for the template
-type KnownSystemData struct {
-    System    *System
-    LearnedAt int64
+    adminToken string // Required by mutating endpoints (see admin_auth.go)
+
+    devAssets string     // Read web assets from this directory instead of the binary
+    assets    *webAssets // Templates and static files (see assets.go)
 }
 
 // PeerData holds peer info plus metadata for the template
@@ -30,6 +37,9 @@ type PeerData struct {
     LearnedAt    int64
     FirstSeenStr string // pre-convert LearnedAt to human readable
     IsNew        bool   // Discovered within last 24 hours
+    LAN          bool   // Found through LAN discovery
+    Local        bool   // Holds a local peer slot (see local_peers.go)
+    Quarantined  bool   // Name or addresses failed sanitization (System is the cleaned copy)
 }
 
 // WebInterfaceData holds data for the web template
@@ -40,13 +50,15 @@ type WebInterfaceData struct {
     PeerCount         int
     MaxPeers          int
     PeerCapacityDesc  string
-    KnownSystems      []KnownSystemData
     TotalSystems      int
     ProtocolVersion   string
     AttestationCount  int
     DatabaseSize      string
     NodeHealth        string
     NodeHealthClass   string
+    SelfRejection     *SelfRejectionWarning // Set when several peers refused our own info
+    Partition         PartitionStatus       // Systems peers report alive that we can't reach (see partition.go)
+    Process           ProcessInfo
     RoutingTableSize  int
     CacheSize         int
     // Peer state breakdown
@@ -61,20 +73,58 @@ type WebInterfaceData struct {
     LongevityBonus       float64
     LongevityBonusPct    float64
     LongevityProgressPct float64
+    PublicMode           bool
+    ThreeJSURL           string // Vendored Three.js build, or the CDN copy
 }
 
 // NewWebInterface creates a new web interface
 func NewWebInterface(dht *DHT, storage *Storage, addr string) *WebInterface {
-    return &WebInterface{
+    w := &WebInterface{
         dht:     dht,
         storage: storage,
         addr:    addr,
     }
+
+    // Push DHT state changes to connected browsers
+    w.live = NewLiveHub(w)
+    dht.SetEventHandler(w.live.Publish)
+
+    return w
+}
+
+// EnablePublicMode restricts the UI and API to what's safe to expose to the internet
+// Must be called before Start
+func (w *WebInterface) EnablePublicMode() {
+    w.public = true
+    log.Printf("Web interface in read-only public mode")
+}
+
+// SetDevAssets serves templates, styles and scripts from dir (a checkout's web/ directory)
+// Must be called before Start
+func (w *WebInterface) SetDevAssets(dir string) {
+    w.devAssets = dir
+}
+
+// privateOnly wraps handlers that must not be reachable in public mode
+func (w *WebInterface) privateOnly(handler http.HandlerFunc) http.HandlerFunc {
+    return func(rw http.ResponseWriter, r *http.Request) {
+        if w.public {
+            http.NotFound(rw, r)
+            return
+        }
+        handler(rw, r)
+    }
 }
 
 // Start begins the web server
 // Returns an error if the server fails to bind
 func (w *WebInterface) Start() error {
+    assets, err := loadWebAssets(w.devAssets)
+    if err != nil {
+        return fmt.Errorf("Web assets failed to load: %w", err)
+    }
+    w.assets = assets
+
     // Try to bind BEFORE starting goroutine
     listener, err := net.Listen("tcp", w.addr)
     if err != nil {
@@ -84,20 +134,62 @@ func (w *WebInterface) Start() error {
     mux := http.NewServeMux()
 
     // Web UI
+    // Handlers that change anything are wrapped in mutating (admin token required)
     mux.HandleFunc("/", w.handleIndex)
+    mux.HandleFunc("/peer/", w.privateOnly(w.handlePeerPage))
+    mux.HandleFunc("/widget", w.handleWidget) // Embeddable status card (see widget.go)
+    mux.Handle("/static/", w.assets.handler())
 
     // API endpoints
     mux.HandleFunc("/api/system", w.handleSystemAPI)
+    mux.HandleFunc("/api/system/name", w.privateOnly(w.mutating(w.handleRenameAPI)))
+    mux.HandleFunc("/api/system/", w.handlePlanetsAPI)
     mux.HandleFunc("/api/peers", w.handlePeersAPI)
+    mux.HandleFunc("/api/peers/", w.privateOnly(w.mutating(w.handlePeerAnnotationAPI)))
+    mux.HandleFunc("/api/peer/", w.privateOnly(w.handlePeerAPI))
     mux.HandleFunc("/api/known-systems", w.handleKnownSystemsAPI)
+    mux.HandleFunc("/api/map", w.handleMapAPI)
+    mux.HandleFunc("/api/constellation/", w.handleConstellationAPI)
+    mux.HandleFunc("/api/leaderboard", w.handleLeaderboardAPI)
     mux.HandleFunc("/api/stats", w.handleStatsAPI)
-    mux.HandleFunc("/api/credits", w.handleCreditsAPI)
+    mux.HandleFunc("/api/status", w.handleStatusAPI)
+    mux.HandleFunc("/api/credits", w.privateOnly(w.handleCreditsAPI))
+    mux.HandleFunc("/api/credits/transfer", w.privateOnly(w.mutating(w.handleCreditTransferAPI)))
+    mux.HandleFunc("/api/credits/transfer/preview", w.privateOnly(w.adminOnly(w.handleCreditTransferPreviewAPI)))
+    mux.HandleFunc("/api/credits/transfers", w.privateOnly(w.handleCreditTransfersAPI))
+    mux.HandleFunc("/api/credits/history", w.privateOnly(w.handleCreditHistoryAPI))
+    mux.HandleFunc("/api/uptime", w.privateOnly(w.handleUptimeAPI))
     mux.HandleFunc("/api/version", w.handleVersionAPI)
     mux.HandleFunc("/api/connections", w.handleConnectionsAPI)
+    mux.HandleFunc("/api/history", w.handleHistoryAPI)
+    mux.HandleFunc("/api/attestations", w.privateOnly(w.handleAttestationsAPI))
+    mux.HandleFunc("/api/messages", w.privateOnly(w.mutating(w.handleMessagesAPI)))
+    mux.HandleFunc("/api/messages/read", w.privateOnly(w.mutating(w.handleMessagesReadAPI)))
+    mux.HandleFunc("/api/blocklist", w.privateOnly(w.mutating(w.handleBlocklistAPI)))
+    mux.HandleFunc("/api/peers/export", w.privateOnly(w.handlePeerExportAPI))
+    mux.HandleFunc("/api/peers/import", w.privateOnly(w.mutating(w.handlePeerImportAPI)))
+    mux.HandleFunc("/api/peers/connect", w.privateOnly(w.mutating(w.handlePeerConnectAPI)))
+    mux.HandleFunc("/api/debug/liveness", w.privateOnly(w.handleLivenessDebugAPI))
+    mux.HandleFunc("/api/diagnostics", w.privateOnly(w.handleDiagnosticsAPI))
+    mux.HandleFunc("/api/lookup/", w.privateOnly(w.adminOnly(w.handleLookupAPI)))
+    mux.HandleFunc("/api/tasks", w.privateOnly(w.handleTasksAPI))
+    mux.HandleFunc("/api/advisor", w.privateOnly(w.handleAdvisorAPI))
+    mux.HandleFunc("/api/tasks/", w.privateOnly(w.mutating(w.handleTaskRunAPI)))
+    mux.HandleFunc("/api/widget-data", w.handleWidgetDataAPI)
+
+    // Health checks for service managers and watchdogs (see service.go)
+    mux.HandleFunc("/healthz", w.handleHealthz)
+    mux.HandleFunc("/readyz", w.handleReadyz)
+
+    // Live updates (the page falls back to polling the APIs above)
+    mux.Handle("/ws", w.live.Handler())
+    go w.live.statsLoop()
+
+    w.server = &http.Server{Handler: mux}
 
     log.Printf("Web interface listening on %s", w.addr)
     go func() {
-        if err := http.Serve(listener, mux); err != nil {
+        if err := w.server.Serve(listener); err != nil && err != http.ErrServerClosed {
             log.Printf("Web server error: %v", err)
         }
     }()
@@ -105,6 +197,15 @@ func (w *WebInterface) Start() error {
     return nil
 }
 
+// Shutdown stops accepting new requests and waits for in-flight ones until ctx expires
+func (w *WebInterface) Shutdown(ctx context.Context) error {
+    if w.server == nil {
+        return nil
+    }
+    w.live.Close()
+    return w.server.Shutdown(ctx)
+}
+
 // handleIndex serves the main web page
 func (w *WebInterface) handleIndex(rw http.ResponseWriter, r *http.Request) {
     if r.URL.Path != "/" {
@@ -112,10 +213,14 @@ func (w *WebInterface) handleIndex(rw http.ResponseWriter, r *http.Request) {
         return
     }
 
+    tmpl, _, err := w.assets.templates()
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusInternalServerError)
+        return
+    }
     data := w.buildTemplateData()
+    data.ThreeJSURL = w.assets.threeJSURL()
 
-    tmpl := template.Must(template.New("index").Parse(indexTemplate))
-    
     var buf bytes.Buffer
     if err := tmpl.Execute(&buf, data); err != nil {
         http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -141,45 +246,26 @@ func (w *WebInterface) buildTemplateData() WebInterfaceData {
             LearnedAt:    cached.LearnedAt.Unix(),
             FirstSeenStr: cached.LearnedAt.Format("01/02/06"),
             IsNew:        cached.LearnedAt.After(oneDayAgo),
+            LAN:          cached.LANDiscovered,
+            Local:        cached.LocalSlot,
+            Quarantined:  cached.Quarantined,
         })
     }
 
-    // Get all cached systems (known galaxy) with metadata
-    cachedSystems := rt.GetAllCachedSystemsWithMeta()
-    knownSystems := make([]KnownSystemData, 0, len(cachedSystems))
-    for _, cached := range cachedSystems {
-        knownSystems = append(knownSystems, KnownSystemData{
-            System:    cached.System,
-            LearnedAt: cached.LearnedAt.Unix(),
-        })
+    // The same numbers /api/stats serves, so a refresh doesn't change them
+    stats := w.collectStats()
+    dbSizeStr := stats.DatabaseSize
+    if dbSizeStr == "" {
+        dbSizeStr = "unknown"
     }
-
-    // Get attestation count (use GetDatabaseStats)
-    dbStats, _ := w.storage.GetDatabaseStats()
-    attestationCount := 0
-    if count, ok := dbStats["attestation_count"].(int); ok {
-        attestationCount = count
-    }
-
-    // Get database size
-    dbSizeStr := "unknown"
-    if sizeBytes, ok := dbStats["database_size_bytes"].(int64); ok {
-        dbSizeStr = formatBytes(sizeBytes)
+    var selfRejection *SelfRejectionWarning
+    if stats.RejectedByPeers.Peers > 0 {
+        selfRejection = &stats.RejectedByPeers
     }
 
     // Determine node health
-    rtSize := rt.GetRoutingTableSize()
-    var health, healthClass string
-    if rtSize >= 2 {
-        health = "Healthy"
-        healthClass = "health-healthy"
-    } else if rtSize == 1 {
-        health = "Low Connectivity"
-        healthClass = "health-warning"
-    } else {
-        health = "Isolated"
-        healthClass = "health-critical"
-    }
+    rtSize := stats.RoutingTableSize
+    health := NodeHealth(rtSize)
 
     // Peer capacity description
     capacityDesc := fmt.Sprintf("%s-class", sys.Stars.Primary.Class)
@@ -224,23 +310,25 @@ func (w *WebInterface) buildTemplateData() WebInterfaceData {
         peerIDs[i] = p.System.ID.String()
     }
 
-    return WebInterfaceData{
+    data := WebInterfaceData{
         System:           sys,
         Peers:            peers,
         PeerIDs:          peerIDs,
         PeerCount:        rtSize,
-        MaxPeers:         sys.GetMaxPeers(),
+        MaxPeers:         stats.MaxPeers,
         PeerCapacityDesc: capacityDesc,
-        KnownSystems:     knownSystems,
-        TotalSystems:     len(knownSystems) + 1, // +1 for self
+        TotalSystems:     stats.TotalSystems, // The map fetches the systems from /api/map
         ProtocolVersion:  CurrentProtocolVersion.String(),
-        AttestationCount: attestationCount,
+        AttestationCount: stats.AttestationCount,
         DatabaseSize:     dbSizeStr,
-        NodeHealth:       health,
-        NodeHealthClass:  healthClass,
+        NodeHealth:       health.String(),
+        NodeHealthClass:  health.CSSClass(),
+        SelfRejection:    selfRejection,
+        Partition:        stats.Partition,
+        Process:          stats.Process,
         RoutingTableSize: rtSize,
-        CacheSize:        rt.GetCacheSize(),
-        PeerStates:       rt.GetPeerStateBreakdown(),
+        CacheSize:        stats.CacheSize,
+        PeerStates:       stats.PeerStates,
         // Credits
         CreditBalance:     creditBalance,
         CreditRank:        creditRank,
@@ -251,20 +339,213 @@ func (w *WebInterface) buildTemplateData() WebInterfaceData {
         LongevityBonus:       longevityBonus,
         LongevityBonusPct:    longevityBonusPct,
         LongevityProgressPct: longevityProgressPct,
+        PublicMode:           w.public,
+    }
+
+    // Don't even hand private values to the template in public mode
+    if w.public {
+        data.AttestationCount = 0
+        data.DatabaseSize = ""
+        data.CreditBalance = 0
+        data.CreditRank = ""
+        data.NextRank = ""
+        data.CreditsToNextRank = 0
     }
+
+    return data
 }
 
 // API handlers
 
+// PublicSystemInfo is the /api/system response in public mode (no ID or addresses)
+type PublicSystemInfo struct {
+    Name      string          `json:"name"`
+    X         float64         `json:"x"`
+    Y         float64         `json:"y"`
+    Z         float64         `json:"z"`
+    Stars     MultiStarSystem `json:"stars"`
+    CreatedAt time.Time       `json:"created_at"`
+    Profile   *OperatorProfile `json:"profile,omitempty"` // Unless marked private
+}
+
 func (w *WebInterface) handleSystemAPI(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+
+    sys := w.dht.GetLocalSystem()
+    if w.public {
+        json.NewEncoder(rw).Encode(PublicSystemInfo{
+            Name:      sys.Name,
+            X:         sys.X,
+            Y:         sys.Y,
+            Z:         sys.Z,
+            Stars:     sys.Stars,
+            CreatedAt: sys.CreatedAt,
+            Profile:   visibleProfile(sys, true).Profile,
+        })
+        return
+    }
+    json.NewEncoder(rw).Encode(struct {
+        *SystemInfo
+        RestartCount int64 `json:"restart_count"`
+    }{NewSystemInfo(sys), w.dht.GetProcessInfo().RestartCount})
+}
+
+// handleRenameAPI renames the local system (PUT {"name": "..."})
+func (w *WebInterface) handleRenameAPI(rw http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPut {
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    r.Body = http.MaxBytesReader(rw, r.Body, 1<<16)
+
+    var req RenameRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(rw, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := w.dht.RenameSystem(req.Name); err != nil {
+        status := http.StatusBadRequest
+        if errors.Is(err, ErrRenameTooSoon) {
+            status = http.StatusTooManyRequests
+        }
+        http.Error(rw, err.Error(), status)
+        return
+    }
+
     rw.Header().Set("Content-Type", "application/json")
     json.NewEncoder(rw).Encode(w.dht.GetLocalSystem())
 }
 
+// handlePlanetsAPI returns the UUID-derived planets of the local or any cached system
+// GET /api/system/{id}/planets
+func (w *WebInterface) handlePlanetsAPI(rw http.ResponseWriter, r *http.Request) {
+    rest := strings.TrimPrefix(r.URL.Path, "/api/system/")
+    idStr, ok := strings.CutSuffix(rest, "/planets")
+    if !ok {
+        http.NotFound(rw, r)
+        return
+    }
+    id, err := uuid.Parse(idStr)
+    if err != nil {
+        http.Error(rw, "Invalid system ID", http.StatusBadRequest)
+        return
+    }
+
+    sys := w.dht.GetLocalSystem()
+    if id != sys.ID {
+        sys = w.dht.GetRoutingTable().GetCachedSystem(id)
+        if sys == nil {
+            http.Error(rw, "Unknown system", http.StatusNotFound)
+            return
+        }
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(sys.GeneratePlanets())
+}
+
+// peerDetailFor parses the peer ID at the end of the path and looks it up
+// Writes the error response itself and returns nil on failure
+func (w *WebInterface) peerDetailFor(rw http.ResponseWriter, r *http.Request, prefix string) *PeerDetail {
+    id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, prefix))
+    if err != nil {
+        http.Error(rw, "Invalid system ID", http.StatusBadRequest)
+        return nil
+    }
+
+    detail, err := w.dht.GetPeerDetail(id)
+    if errors.Is(err, ErrUnknownSystem) {
+        http.Error(rw, "Unknown system", http.StatusNotFound)
+        return nil
+    }
+    if err != nil {
+        http.Error(rw, "Failed to load peer", http.StatusInternalServerError)
+        return nil
+    }
+    return detail
+}
+
+// handlePeerAPI returns what we know about one cached system
+// GET /api/peer/{id}
+func (w *WebInterface) handlePeerAPI(rw http.ResponseWriter, r *http.Request) {
+    detail := w.peerDetailFor(rw, r, "/api/peer/")
+    if detail == nil {
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(detail)
+}
+
+// PeerPageData is the data for the peer detail page
+type PeerPageData struct {
+    Local           *System
+    Peer            *PeerDetail
+    FirstSeenStr    string
+    LastVerifiedStr string
+    RejectionStr    string // When it last refused us, and until when we're leaving it alone
+    StateSinceStr   string
+    StateHistory    []string // Its recorded transitions, newest first
+}
+
+// handlePeerPage serves the detail page for one cached system
+// GET /peer/{id}
+func (w *WebInterface) handlePeerPage(rw http.ResponseWriter, r *http.Request) {
+    detail := w.peerDetailFor(rw, r, "/peer/")
+    if detail == nil {
+        return
+    }
+
+    data := PeerPageData{
+        Local:           w.dht.GetLocalSystem(),
+        Peer:            detail,
+        FirstSeenStr:    time.Unix(detail.FirstSeen, 0).Format("2006-01-02 15:04"),
+        LastVerifiedStr: "Never",
+        StateSinceStr:   time.Unix(detail.StateSince, 0).Format("2006-01-02 15:04"),
+    }
+    for i := len(detail.StateChanges) - 1; i >= 0; i-- {
+        change := detail.StateChanges[i]
+        entry := time.Unix(change.At, 0).Format("2006-01-02 15:04") + "  "
+        if change.From != "" {
+            entry += string(change.From) + " → "
+        }
+        data.StateHistory = append(data.StateHistory, entry+string(change.To))
+    }
+    if detail.LastVerified > 0 {
+        data.LastVerifiedStr = time.Unix(detail.LastVerified, 0).Format("2006-01-02 15:04")
+    }
+    if rej := detail.Rejection; rej != nil {
+        data.RejectionStr = time.Unix(rej.At, 0).Format("2006-01-02 15:04")
+        if rej.RetryAt > time.Now().Unix() {
+            data.RejectionStr += ", not contacting it until " + time.Unix(rej.RetryAt, 0).Format("2006-01-02 15:04")
+        }
+    }
+
+    _, tmpl, err := w.assets.templates()
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    var buf bytes.Buffer
+    if err := tmpl.Execute(&buf, data); err != nil {
+        http.Error(rw, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+    buf.WriteTo(rw)
+}
+
 // PeerResponse includes peer data plus cache metadata for API
 type PeerResponse struct {
     *System
-    LearnedAt int64 `json:"learned_at"` // Unix timestamp
+    LearnedAt   int64   `json:"learned_at"`            // Unix timestamp
+    LAN         bool    `json:"lan,omitempty"`         // Found through LAN discovery
+    Slot        string  `json:"slot"`                  // SlotLocal or SlotRouting (see local_peers.go)
+    Quarantined bool    `json:"quarantined,omitempty"` // Name or addresses failed sanitization
+    LatencyMs   float64 `json:"latency_ms,omitempty"`  // Round-trip average, once measured
 }
 
 func (w *WebInterface) handlePeersAPI(rw http.ResponseWriter, r *http.Request) {
@@ -273,9 +554,17 @@ func (w *WebInterface) handlePeersAPI(rw http.ResponseWriter, r *http.Request) {
     // Build response with learned_at timestamps
     response := make([]PeerResponse, 0, len(cachedPeers))
     for _, cached := range cachedPeers {
+        slot := SlotRouting
+        if cached.LocalSlot {
+            slot = SlotLocal
+        }
         response = append(response, PeerResponse{
-            System:    cached.System,
-            LearnedAt: cached.LearnedAt.Unix(),
+            System:      visibleProfile(cached.System, w.public),
+            LearnedAt:   cached.LearnedAt.Unix(),
+            LAN:         cached.LANDiscovered,
+            Slot:        slot,
+            Quarantined: cached.Quarantined,
+            LatencyMs:   latencyMs(cached.Latency),
         })
     }
 
@@ -283,20 +572,138 @@ func (w *WebInterface) handlePeersAPI(rw http.ResponseWriter, r *http.Request) {
     json.NewEncoder(rw).Encode(response)
 }
 
+// handlePeerAnnotationAPI reads and writes the operator's private annotations
+// GET /api/peers/annotations lists them all; GET, PUT or DELETE /api/peers/{id}/annotation
+// handles one (a PUT with nothing in it removes it too). GET /api/peers/{id}/traffic is
+// served here as well, sharing the path
+func (w *WebInterface) handlePeerAnnotationAPI(rw http.ResponseWriter, r *http.Request) {
+    rest := strings.TrimPrefix(r.URL.Path, "/api/peers/")
+    if idStr, ok := strings.CutSuffix(rest, "/traffic"); ok {
+        w.handlePeerTrafficAPI(rw, r, idStr)
+        return
+    }
+    if rest == "annotations" {
+        if r.Method != http.MethodGet {
+            http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+        annotations, err := w.dht.GetPeerAnnotations()
+        if err != nil {
+            http.Error(rw, "Failed to load annotations", http.StatusInternalServerError)
+            return
+        }
+        rw.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(rw).Encode(annotations)
+        return
+    }
+
+    idStr, ok := strings.CutSuffix(rest, "/annotation")
+    if !ok {
+        http.NotFound(rw, r)
+        return
+    }
+    id, err := uuid.Parse(idStr)
+    if err != nil {
+        http.Error(rw, "Invalid system ID", http.StatusBadRequest)
+        return
+    }
+
+    var annotation *PeerAnnotation
+    switch r.Method {
+    case http.MethodGet:
+        annotation, err = w.dht.GetPeerAnnotation(id)
+        if err != nil {
+            http.Error(rw, "Failed to load annotation", http.StatusInternalServerError)
+            return
+        }
+
+    case http.MethodPut:
+        r.Body = http.MaxBytesReader(rw, r.Body, 1<<16)
+
+        var req AnnotationRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(rw, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        annotation, err = w.dht.SetPeerAnnotation(id, req)
+        if err != nil {
+            http.Error(rw, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if annotation == nil {
+            rw.WriteHeader(http.StatusNoContent)
+            return
+        }
+
+    case http.MethodDelete:
+        if _, err := w.dht.SetPeerAnnotation(id, AnnotationRequest{}); err != nil {
+            http.Error(rw, err.Error(), http.StatusBadRequest)
+            return
+        }
+        rw.WriteHeader(http.StatusNoContent)
+        return
+
+    default:
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if annotation == nil {
+        http.Error(rw, "System has no annotation", http.StatusNotFound)
+        return
+    }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(annotation)
+}
+
+// handlePeerTrafficAPI returns a peer's messages by kind and direction, hour by hour
+// GET /api/peers/{id}/traffic, where {id} may also be the IP of messages refused before
+// their sender was identified
+func (w *WebInterface) handlePeerTrafficAPI(rw http.ResponseWriter, r *http.Request, idStr string) {
+    if r.Method != http.MethodGet {
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var peer string
+    if id, err := uuid.Parse(idStr); err == nil {
+        peer = id.String()
+    } else if ip := net.ParseIP(idStr); ip != nil {
+        peer = ip.String()
+    } else {
+        http.Error(rw, "Invalid system ID or IP", http.StatusBadRequest)
+        return
+    }
+
+    traffic, err := w.dht.GetPeerMessageTraffic(peer)
+    if err != nil {
+        http.Error(rw, "Failed to load peer traffic", http.StatusInternalServerError)
+        return
+    }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(traffic)
+}
+
 // KnownSystemResponse includes system data plus cache metadata
 type KnownSystemResponse struct {
     *System
     LearnedAt int64 `json:"learned_at"` // Unix timestamp
 }
 
+// handleKnownSystemsAPI returns the cached systems, narrowed by the filter parameters
+// parseMapFilter takes (see map_filter.go)
 func (w *WebInterface) handleKnownSystemsAPI(rw http.ResponseWriter, r *http.Request) {
-    cachedSystems := w.dht.GetRoutingTable().GetAllCachedSystemsWithMeta()
+    filter, err := parseMapFilter(r.URL.Query())
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
+    cachedSystems := filter.filterCached(w.dht.GetRoutingTable().GetAllCachedSystemsWithMeta())
 
     // Build response with learned_at timestamps
     response := make([]KnownSystemResponse, 0, len(cachedSystems))
     for _, cached := range cachedSystems {
         response = append(response, KnownSystemResponse{
-            System:    cached.System,
+            System:    visibleProfile(cached.System, w.public),
             LearnedAt: cached.LearnedAt.Unix(),
         })
     }
@@ -305,29 +712,122 @@ func (w *WebInterface) handleKnownSystemsAPI(rw http.ResponseWriter, r *http.Req
     json.NewEncoder(rw).Encode(response)
 }
 
-func (w *WebInterface) handleStatsAPI(rw http.ResponseWriter, r *http.Request) {
-    stats := w.dht.GetNetworkStats()
+// handleMapAPI returns the galaxy map, clustered at the requested level of detail once it's large
+// Takes the same filter parameters as /api/known-systems
+func (w *WebInterface) handleMapAPI(rw http.ResponseWriter, r *http.Request) {
+    lod := 0
+    if v := r.URL.Query().Get("lod"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            http.Error(rw, "Invalid lod", http.StatusBadRequest)
+            return
+        }
+        lod = n
+    }
+    filter, err := parseMapFilter(r.URL.Query())
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    galaxy := w.dht.GetGalaxyMap(lod, filter)
+    for i := range galaxy.Systems {
+        galaxy.Systems[i].System = visibleProfile(galaxy.Systems[i].System, w.public)
+    }
 
-    // Merge in database stats for AJAX refresh
-    dbStats, err := w.storage.GetDatabaseStats()
-    if err == nil && dbStats != nil {
-        if count, ok := dbStats["attestation_count"].(int); ok {
-            stats["attestation_count"] = count
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(galaxy)
+}
+
+// handleConstellationAPI returns a system's sponsor lineage
+// GET /api/constellation/{id}?depth=N
+func (w *WebInterface) handleConstellationAPI(rw http.ResponseWriter, r *http.Request) {
+    id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/api/constellation/"))
+    if err != nil {
+        http.Error(rw, "Invalid system ID", http.StatusBadRequest)
+        return
+    }
+    depth := DefaultConstellationDepth
+    if v := r.URL.Query().Get("depth"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > MaxConstellationDepth {
+            http.Error(rw, fmt.Sprintf("depth must be between 1 and %d", MaxConstellationDepth), http.StatusBadRequest)
+            return
         }
-        if sizeBytes, ok := dbStats["database_size_bytes"].(int64); ok {
-            stats["database_size_bytes"] = sizeBytes
-            stats["database_size"] = formatBytes(sizeBytes)
+        depth = n
+    }
+
+    constellation, err := w.dht.GetConstellation(id, depth)
+    if errors.Is(err, ErrUnknownSystem) {
+        http.Error(rw, "Unknown system", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(rw, "Failed to load constellation", http.StatusInternalServerError)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(constellation)
+}
+
+// handleLeaderboardAPI ranks the systems sharing their credit rank, flagging which ranks
+// a proof has covered. Our own entry is left out in public mode, like our credits
+// GET /api/leaderboard?limit=N
+func (w *WebInterface) handleLeaderboardAPI(rw http.ResponseWriter, r *http.Request) {
+    limit := DefaultLeaderboardLimit
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > MaxLeaderboardLimit {
+            http.Error(rw, fmt.Sprintf("limit must be between 1 and %d", MaxLeaderboardLimit), http.StatusBadRequest)
+            return
         }
+        limit = n
     }
 
-    // Add peer state breakdown
-    breakdown := w.dht.GetRoutingTable().GetPeerStateBreakdown()
-    stats["peer_states"] = breakdown
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(w.dht.GetLeaderboard(limit, !w.public))
+}
+
+// handleStatsAPI serves /api/stats; ?legacy=1 gets the old untyped map for one more release
+func (w *WebInterface) handleStatsAPI(rw http.ResponseWriter, r *http.Request) {
+    stats := w.collectStats()
 
     rw.Header().Set("Content-Type", "application/json")
+    if r.URL.Query().Get("legacy") == "1" {
+        json.NewEncoder(rw).Encode(legacyStats(stats, w.public))
+        return
+    }
     json.NewEncoder(rw).Encode(stats)
 }
 
+// liveStats gathers the stats pushed over /ws (compared between pushes to send only changes)
+func (w *WebInterface) liveStats() map[string]interface{} {
+    rt := w.dht.GetRoutingTable()
+    stats := map[string]interface{}{
+        "peer_states":   rt.GetPeerStateBreakdown(),
+        "routing_size":  rt.GetRoutingTableSize(),
+        "total_systems": rt.GetCacheSize() + 1,
+    }
+    if w.public {
+        return stats
+    }
+
+    if db, err := w.storage.GetDatabaseStats(); err == nil {
+        stats["attestation_count"] = db.AttestationCount
+        stats["database_size"] = formatBytes(db.SizeBytes)
+    }
+
+    if balance, err := w.storage.GetCreditBalance(w.dht.GetLocalSystem().ID); err == nil {
+        rank := GetRank(balance.Balance)
+        stats["balance"] = balance.Balance
+        stats["rank"] = rank.Name
+        stats["rank_color"] = rank.Color
+    }
+
+    return stats
+}
+
 func (w *WebInterface) handleCreditsAPI(rw http.ResponseWriter, r *http.Request) {
     sys := w.dht.GetLocalSystem()
     balance, err := w.storage.GetCreditBalance(sys.ID)
@@ -365,1306 +865,542 @@ func (w *WebInterface) handleCreditsAPI(rw http.ResponseWriter, r *http.Request)
     json.NewEncoder(rw).Encode(response)
 }
 
-func (w *WebInterface) handleVersionAPI(rw http.ResponseWriter, r *http.Request) {
-    response := map[string]interface{}{
-        "version":  BuildVersion,
-        "protocol": CurrentProtocolVersion.String(),
-        "software": "stellar-lab",
+// handleUptimeAPI returns attestation counts per hour or day plus derived daily uptime
+func (w *WebInterface) handleUptimeAPI(rw http.ResponseWriter, r *http.Request) {
+    params := r.URL.Query()
+
+    days := DefaultUptimeHistoryDays
+    if v := params.Get("days"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            http.Error(rw, "Invalid days", http.StatusBadRequest)
+            return
+        }
+        if n > MaxUptimeHistoryDays {
+            n = MaxUptimeHistoryDays
+        }
+        days = n
+    }
+
+    bucket := params.Get("bucket")
+    if bucket == "" {
+        bucket = "hour"
+    }
+    if bucket != "hour" && bucket != "day" {
+        http.Error(rw, "bucket must be hour or day", http.StatusBadRequest)
+        return
     }
+
+    history, err := w.dht.GetUptimeHistory(days, bucket)
+    if err != nil {
+        http.Error(rw, "Failed to get uptime history", http.StatusInternalServerError)
+        return
+    }
+
     rw.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(rw).Encode(response)
+    json.NewEncoder(rw).Encode(history)
 }
 
-func (w *WebInterface) handleConnectionsAPI(rw http.ResponseWriter, r *http.Request) {
-    // Get connections from peer_connections table (1 hour max age)
-    connections, err := w.storage.GetAllConnections(time.Hour)
+// handleCreditHistoryAPI returns the per-cycle credit breakdown plus daily totals
+func (w *WebInterface) handleCreditHistoryAPI(rw http.ResponseWriter, r *http.Request) {
+    days := DefaultCreditHistoryDays
+    if v := r.URL.Query().Get("days"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            http.Error(rw, "Invalid days", http.StatusBadRequest)
+            return
+        }
+        if n > MaxCreditHistoryDays {
+            n = MaxCreditHistoryDays
+        }
+        days = n
+    }
+
+    history, err := w.dht.GetCreditHistory(days)
     if err != nil {
-        connections = []TopologyEdge{} // Continue with empty if error
+        http.Error(rw, "Failed to get credit history", http.StatusInternalServerError)
+        return
     }
 
-    // Also add our direct connections (routing table peers)
-    // Peers in our routing table have had bidirectional communication with us,
-    // so we add BOTH directions to enable proper reciprocity detection
-    selfID := w.dht.GetLocalSystem().ID.String()
-    selfName := w.dht.GetLocalSystem().Name
-    peers := w.dht.GetRoutingTable().GetAllRoutingTableNodes()
-    
-    // Build a set of existing connections to avoid duplicates
-    existingEdges := make(map[string]bool)
-    for _, c := range connections {
-        key1 := c.FromID + ":" + c.ToID
-        key2 := c.ToID + ":" + c.FromID
-        existingEdges[key1] = true
-        existingEdges[key2] = true
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(history)
+}
+
+// CreditTransferRequest is the body accepted by POST /api/credits/transfer
+type CreditTransferRequest struct {
+    ToSystemID string `json:"to_system_id"`
+    Amount     int64  `json:"amount"`
+    Memo       string `json:"memo,omitempty"`
+}
+
+// handleCreditTransferAPI sends credits from this system to another system
+func (w *WebInterface) handleCreditTransferAPI(rw http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
     }
-    
-    // Add our direct peer connections (both directions for reciprocity)
-    for _, peer := range peers {
-        peerID := peer.ID.String()
-        
-        // Add self → peer
-        keyOut := selfID + ":" + peerID
-        if !existingEdges[keyOut] {
-            connections = append(connections, TopologyEdge{
-                FromID:   selfID,
-                FromName: selfName,
-                ToID:     peerID,
-                ToName:   peer.Name,
-            })
-            existingEdges[keyOut] = true
-        }
-        
-        // Add peer → self (reciprocal direction)
-        // This is valid because peers in routing table have communicated with us
-        keyIn := peerID + ":" + selfID
-        if !existingEdges[keyIn] {
-            connections = append(connections, TopologyEdge{
-                FromID:   peerID,
-                FromName: peer.Name,
-                ToID:     selfID,
-                ToName:   selfName,
-            })
-            existingEdges[keyIn] = true
-        }
+
+    r.Body = http.MaxBytesReader(rw, r.Body, 1<<16)
+
+    var req CreditTransferRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(rw, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    toID, err := uuid.Parse(req.ToSystemID)
+    if err != nil {
+        http.Error(rw, "Invalid to_system_id", http.StatusBadRequest)
+        return
+    }
+
+    transfer, err := w.dht.SendCredits(toID, req.Amount, req.Memo)
+    if err != nil {
+        transferError(rw, err)
+        return
+    }
+
+    response := map[string]interface{}{
+        "transfer_id":  transfer.ID.String(),
+        "to_system_id": transfer.ToSystemID.String(),
+        "amount":       transfer.Amount,
+        "memo":         transfer.Memo,
+        "timestamp":    transfer.Timestamp,
+    }
+    if balance, err := w.storage.GetCreditBalance(w.dht.GetLocalSystem().ID); err == nil {
+        response["balance"] = balance.Balance
     }
 
     rw.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(rw).Encode(connections)
+    json.NewEncoder(rw).Encode(response)
 }
 
-// formatBytes formats a byte count as a human-readable string
-func formatBytes(bytes int64) string {
-    const unit = 1024
-    if bytes < unit {
-        return fmt.Sprintf("%d B", bytes)
+// transferError writes a SendCredits or PreviewTransfer error with a status that says what went wrong
+func transferError(rw http.ResponseWriter, err error) {
+    status := http.StatusBadRequest
+    switch {
+    case errors.Is(err, ErrInsufficientCredits):
+        status = http.StatusPaymentRequired
+    case errors.Is(err, ErrRecipientUnreachable):
+        status = http.StatusBadGateway
+    case errors.Is(err, ErrTransferUnconfirmed):
+        status = http.StatusGatewayTimeout
+    case errors.Is(err, ErrDuplicateTransfer):
+        status = http.StatusConflict
+    case errors.Is(err, ErrProofTooLarge), errors.Is(err, ErrMessageTooLarge):
+        status = http.StatusRequestEntityTooLarge
     }
-    div, exp := int64(unit), 0
-    for n := bytes / unit; n >= unit; n /= unit {
-        div *= unit
-        exp++
+    http.Error(rw, err.Error(), status)
+}
+
+// handleCreditTransferPreviewAPI shows what a transfer would send, for the confirmation step
+// GET /api/credits/transfer/preview?to=<id>&amount=N&memo=...
+func (w *WebInterface) handleCreditTransferPreviewAPI(rw http.ResponseWriter, r *http.Request) {
+    params := r.URL.Query()
+    toID, err := uuid.Parse(params.Get("to"))
+    if err != nil {
+        http.Error(rw, "Invalid to", http.StatusBadRequest)
+        return
     }
-    return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+    amount, err := strconv.ParseInt(params.Get("amount"), 10, 64)
+    if err != nil {
+        http.Error(rw, "Invalid amount", http.StatusBadRequest)
+        return
+    }
+
+    preview, err := w.dht.PreviewTransfer(toID, amount, params.Get("memo"))
+    if err != nil {
+        transferError(rw, err)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(preview)
 }
 
-// HTML template
-const indexTemplate = `<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>{{.System.Name}} - Stellar Lab</title>
-    <style>
-        * { box-sizing: border-box; margin: 0; padding: 0; }
-        body {
-            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
-            background: linear-gradient(135deg, #0a0a1a 0%, #1a1a3a 100%);
-            color: #e0e0e0;
-            min-height: 100vh;
-            padding: 20px;
-        }
-        .container { max-width: 1600px; margin: 0 auto; }
-        h1 {
-            font-size: 2.5em;
-            margin-bottom: 10px;
-            background: linear-gradient(90deg, #60a5fa, #a78bfa);
-            -webkit-background-clip: text;
-            -webkit-text-fill-color: transparent;
-            background-clip: text;
-        }
-        .subtitle { color: #888; margin-bottom: 30px; }
-        .grid {
-            display: grid;
-            grid-template-columns: repeat(4, 1fr);
-            gap: 20px;
-            margin-bottom: 20px;
-        }
-        .grid-full {
-            grid-column: 1 / -1;
-        }
-        .card {
-            background: rgba(255,255,255,0.05);
-            border-radius: 12px;
-            padding: 20px;
-            border: 1px solid rgba(255,255,255,0.1);
-        }
-        .card h2 {
-            font-size: 1.2em;
-            margin-bottom: 15px;
-            color: #a78bfa;
-        }
-        .stat-row {
-            display: flex;
-            justify-content: space-between;
-            padding: 8px 0;
-            border-bottom: 1px solid rgba(255,255,255,0.05);
-        }
-        .stat-row:last-child { border-bottom: none; }
-        .stat-label { color: #888; }
-        .stat-value { font-weight: 500; }
-        .health-healthy { color: #4ade80; }
-        .health-warning { color: #facc15; }
-        .health-critical { color: #f87171; }
-        .peer-list { max-height: 300px; overflow-y: auto; }
-        .peer-item {
-            padding: 10px;
-            margin: 5px 0;
-            background: rgba(255,255,255,0.03);
-            border-radius: 8px;
-        }
-        .peer-name { font-weight: 500; color: #60a5fa; }
-        .new-badge { background: #22c55e; color: #000; font-size: 9px; padding: 1px 4px; border-radius: 3px; margin-left: 4px; font-weight: 600; }
-        .peer-id { font-size: 0.8em; color: #666; font-family: monospace; }
-        .star-display { display: flex; align-items: center; gap: 10px; margin: 10px 0; }
-        .star {
-            width: 30px;
-            height: 30px;
-            border-radius: 50%;
-            box-shadow: 0 0 20px currentColor;
-        }
-        .star-blackhole {
-            width: 30px;
-            height: 30px;
-            border-radius: 50%;
-            background: radial-gradient(circle, #000 0%, #000 50%, #1a0a2e 70%, #3d1a5c 85%, transparent 100%);
-            box-shadow: 0 0 15px #8b5cf6, 0 0 30px #6366f1, 0 0 45px rgba(139, 92, 246, 0.3);
-            animation: blackhole-pulse 3s ease-in-out infinite;
-        }
-        @keyframes blackhole-pulse {
-            0%, 100% { box-shadow: 0 0 15px #8b5cf6, 0 0 30px #6366f1, 0 0 45px rgba(139, 92, 246, 0.3); }
-            50% { box-shadow: 0 0 20px #a78bfa, 0 0 40px #8b5cf6, 0 0 60px rgba(139, 92, 246, 0.4); }
-        }
-        .peer-meta { font-size: 0.85em; color: #888; }
-        .coords { font-family: monospace; }
-        .first-seen { color: #666; }
-        #galaxy-map {
-            width: 100%;
-            height: 600px;
-            background: radial-gradient(ellipse at center, #0a0a1a 0%, #000005 100%);
-            border-radius: 12px;
-            position: relative;
-            overflow: hidden;
-        }
-        #galaxy-map canvas {
-            border-radius: 12px;
-        }
-        .map-controls {
-            position: absolute;
-            top: 10px;
-            right: 10px;
-            z-index: 100;
-            display: flex;
-            gap: 8px;
-        }
-        .map-btn {
-            background: rgba(96, 165, 250, 0.2);
-            border: 1px solid rgba(96, 165, 250, 0.4);
-            color: #60a5fa;
-            padding: 8px 12px;
-            border-radius: 6px;
-            cursor: pointer;
-            font-size: 12px;
-            transition: all 0.2s;
-        }
-        .map-btn:hover {
-            background: rgba(96, 165, 250, 0.3);
-            border-color: rgba(96, 165, 250, 0.6);
-        }
-        .map-tooltip {
-            position: absolute;
-            background: rgba(0, 0, 0, 0.85);
-            border: 1px solid rgba(96, 165, 250, 0.4);
-            border-radius: 6px;
-            padding: 8px 12px;
-            color: #e0e0e0;
-            font-size: 12px;
-            pointer-events: none;
-            z-index: 200;
-            display: none;
-        }
-        .map-tooltip .tooltip-name {
-            color: #60a5fa;
-            font-weight: 500;
-            margin-bottom: 4px;
-        }
-        .map-tooltip .tooltip-coords {
-            color: #888;
-            font-family: monospace;
-            font-size: 11px;
-        }
-        .map-hint {
-            position: absolute;
-            bottom: 8px;
-            right: 12px;
-            font-size: 11px;
-            color: #666;
-            z-index: 100;
-        }
-        .version-badge {
-            display: inline-block;
-            padding: 4px 8px;
-            background: rgba(167, 139, 250, 0.2);
-            border-radius: 4px;
-            font-size: 0.9em;
-        }
-        .longevity-bar {
-            margin-top: 12px;
-            padding: 12px;
-            background: rgba(167, 139, 250, 0.1);
-            border-radius: 8px;
-        }
-        .longevity-header {
-            display: flex;
-            justify-content: space-between;
-            margin-bottom: 8px;
-            font-size: 0.85em;
-        }
-        .longevity-label { color: #888; }
-        .longevity-value { color: #a78bfa; font-weight: 500; }
-        .longevity-track {
-            height: 8px;
-            background: rgba(255,255,255,0.1);
-            border-radius: 4px;
-            overflow: hidden;
-        }
-        .longevity-fill {
-            height: 100%;
-            background: linear-gradient(90deg, #60a5fa, #a78bfa);
-            border-radius: 4px;
-            transition: width 0.3s ease;
-        }
-        .longevity-note {
-            margin-top: 6px;
-            font-size: 0.75em;
-            color: #666;
-        }
-        .peer-states {
-            display: grid;
-            grid-template-columns: repeat(2, 1fr);
-            gap: 8px;
-            margin: 12px 0;
-            padding: 12px;
-            background: rgba(255,255,255,0.03);
-            border-radius: 8px;
-        }
-        .peer-state {
-            display: flex;
-            align-items: center;
-            gap: 8px;
-        }
-        .state-dot {
-            width: 10px;
-            height: 10px;
-            border-radius: 50%;
-            flex-shrink: 0;
-        }
-        .state-active { background: #4ade80; box-shadow: 0 0 6px #4ade80; }
-        .state-pending { background: #60a5fa; box-shadow: 0 0 6px #60a5fa; }
-        .state-degraded { background: #facc15; box-shadow: 0 0 6px #facc15; }
-        .state-stale { background: #f87171; box-shadow: 0 0 6px #f87171; }
-        .state-label {
-            color: #888;
-            font-size: 0.85em;
-            flex-grow: 1;
-        }
-        .state-count {
-            font-weight: 500;
-            font-size: 0.95em;
-        }
-        .map-tooltip .tooltip-class {
-            color: #a78bfa;
-            font-size: 11px;
-            margin-bottom: 2px;
-        }
-        .map-tooltip .tooltip-distance {
-            color: #4ade80;
-            font-size: 11px;
-            margin-top: 4px;
+// handleCreditTransfersAPI returns transfers this system sent and received, newest first
+// Query params: direction (sent or received, default both), limit (max 100), offset
+func (w *WebInterface) handleCreditTransfersAPI(rw http.ResponseWriter, r *http.Request) {
+    params := r.URL.Query()
+
+    direction := params.Get("direction")
+    if direction != "" && direction != TransferSent && direction != TransferReceived {
+        http.Error(rw, "direction must be sent or received", http.StatusBadRequest)
+        return
+    }
+    limit := 20
+    if v := params.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 {
+            http.Error(rw, "Invalid limit", http.StatusBadRequest)
+            return
         }
-        @media (max-width: 1400px) {
-            .grid { grid-template-columns: repeat(2, 1fr); }
+        if n > 100 {
+            n = 100
         }
-        @media (max-width: 800px) {
-            .grid { grid-template-columns: 1fr; }
+        limit = n
+    }
+    offset := 0
+    if v := params.Get("offset"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            http.Error(rw, "Invalid offset", http.StatusBadRequest)
+            return
         }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h1>{{.System.Name}}</h1>
-        <p class="subtitle">
-            Stellar Lab Node
-            <span class="version-badge">v{{.ProtocolVersion}}</span>
-        </p>
-
-        <div class="grid">
-            <div class="card">
-                <h2>System Information</h2>
-                <div class="stat-row">
-                    <span class="stat-label">Status</span>
-                    <span id="stat-health" class="stat-value {{.NodeHealthClass}}">{{.NodeHealth}}</span>
-                </div>
-                <div class="stat-row">
-                    <span class="stat-label">System ID</span>
-                    <span class="stat-value" style="font-family: monospace; font-size: 0.8em; word-break: break-all;">{{.System.ID}}</span>
-                </div>
-                <div class="stat-row">
-                    <span class="stat-label">Coordinates</span>
-                    <span class="stat-value coords">({{printf "%.1f" .System.X}}, {{printf "%.1f" .System.Y}}, {{printf "%.1f" .System.Z}})</span>
-                </div>
-                <div class="star-display">
-                    {{if eq .System.Stars.Primary.Class "X"}}
-                    <div class="star-blackhole"></div>
-                    {{else}}
-                    <div class="star" style="background: {{.System.Stars.Primary.Color}}; color: {{.System.Stars.Primary.Color}};"></div>
-                    {{end}}
-                    {{if .System.Stars.Secondary}}
-                    <div class="star" style="background: {{.System.Stars.Secondary.Color}}; color: {{.System.Stars.Secondary.Color}}; width: 24px; height: 24px;"></div>
-                    {{end}}
-                    {{if .System.Stars.Tertiary}}
-                    <div class="star" style="background: {{.System.Stars.Tertiary.Color}}; color: {{.System.Stars.Tertiary.Color}}; width: 18px; height: 18px;"></div>
-                    {{end}}
-                    <span>{{.System.Stars.Primary.Description}}</span>
-                </div>
-            </div>
-
-            <div class="card">
-                <h2>Network Status</h2>
-                <div class="stat-row">
-                    <span class="stat-label">Known Systems</span>
-                    <span id="stat-galaxy" class="stat-value">{{.TotalSystems}} total</span>
-                </div>
-                <div class="peer-states" id="peer-states">
-                    <div class="peer-state">
-                        <span class="state-dot state-active"></span>
-                        <span class="state-label">Active</span>
-                        <span id="state-active" class="state-count">{{.PeerStates.Active}}</span>
-                    </div>
-                    <div class="peer-state">
-                        <span class="state-dot state-pending"></span>
-                        <span class="state-label">Pending</span>
-                        <span id="state-pending" class="state-count">{{.PeerStates.Pending}}</span>
-                    </div>
-                    <div class="peer-state">
-                        <span class="state-dot state-degraded"></span>
-                        <span class="state-label">Degraded</span>
-                        <span id="state-degraded" class="state-count">{{.PeerStates.Degraded}}</span>
-                    </div>
-                    <div class="peer-state">
-                        <span class="state-dot state-stale"></span>
-                        <span class="state-label">Stale</span>
-                        <span id="state-stale" class="state-count">{{.PeerStates.Stale}}</span>
-                    </div>
-                </div>
-                <div class="stat-row" style="margin-top: 12px;">
-                    <span class="stat-label">Peer Capacity</span>
-                    <span class="stat-value">{{.MaxPeers}} max ({{.PeerCapacityDesc}})</span>
-                </div>
-                <div class="stat-row">
-                    <span class="stat-label">Attestations</span>
-                    <span id="stat-attestations" class="stat-value">{{.AttestationCount}}</span>
-                </div>
-                <div class="stat-row">
-                    <span class="stat-label">Database</span>
-                    <span id="stat-dbsize" class="stat-value">{{.DatabaseSize}}</span>
-                </div>
-            </div>
-
-            <div class="card">
-                <h2>Stellar Credits</h2>
-                <div class="stat-row">
-                    <span class="stat-label">Balance</span>
-                    <span id="stat-balance" class="stat-value">{{.CreditBalance}} ✦</span>
-                </div>
-                <div class="stat-row">
-                    <span class="stat-label">Rank</span>
-                    <span id="stat-rank" class="stat-value" style="color: {{.CreditRankColor}};">{{.CreditRank}}</span>
-                </div>
-                <div id="stat-nextrank-row" class="stat-row" {{if not .NextRank}}style="display:none;"{{end}}>
-                    <span class="stat-label">Next Rank</span>
-                    <span id="stat-nextrank" class="stat-value">{{.NextRank}} ({{.CreditsToNextRank}} ✦ needed)</span>
-                </div>
-                <div class="longevity-bar">
-                    <div class="longevity-header">
-                        <span class="longevity-label">Longevity Bonus</span>
-                        <span id="stat-longbonus" class="longevity-value">+{{printf "%.1f" .LongevityBonusPct}}%</span>
-                    </div>
-                    <div class="longevity-track">
-                        <div id="stat-longbar" class="longevity-fill" style="width: {{printf "%.1f" .LongevityProgressPct}}%;"></div>
-                    </div>
-                    <div id="stat-longweeks" class="longevity-note">{{printf "%.1f" .LongevityWeeks}} / 52 weeks to max (+52%)</div>
-                </div>
-            </div>
-
-            <div class="card">
-                <h2 id="routing-title">Routing Table ({{.RoutingTableSize}} nodes)</h2>
-                <div id="peer-list" class="peer-list">
-                    {{range .Peers}}
-                    <div class="peer-item">
-                        <div class="peer-name">{{.System.Name}}{{if .IsNew}} <span class="new-badge">NEW</span>{{end}}</div>
-                        <div class="peer-id">{{.System.ID}}</div>
-                        <div class="peer-meta"><span class="coords">({{printf "%.1f" .System.X}}, {{printf "%.1f" .System.Y}}, {{printf "%.1f" .System.Z}})</span> · <span class="first-seen">First seen: {{.FirstSeenStr}}</span></div>
-                    </div>
-                    {{else}}
-                    <p style="color: #666; padding: 20px; text-align: center;">No peers in routing table</p>
-                    {{end}}
-                </div>
-            </div>
-
-            <div class="card grid-full">
-                <h2 id="galaxy-title">Galaxy Map ({{.TotalSystems}} systems)</h2>
-                <div id="galaxy-map"></div>
-            </div>
-        </div>
-
-        <div style="margin-top: 20px; padding: 15px; background: rgba(255,255,255,0.03); border-radius: 12px; border: 1px solid rgba(255,255,255,0.1); display: flex; justify-content: space-between; align-items: center;">
-            <span style="color: #666; font-size: 0.9em;">Export network topology data for analysis or debugging</span>
-            <button onclick="exportTopology()" style="background: rgba(96, 165, 250, 0.2); border: 1px solid rgba(96, 165, 250, 0.4); color: #60a5fa; padding: 8px 16px; border-radius: 6px; cursor: pointer; font-size: 0.9em;">Export JSON</button>
-        </div>
-    </div>
-
-    <script src="https://cdnjs.cloudflare.com/ajax/libs/three.js/r128/three.min.js"></script>
-    <script>
-        // OrbitControls inline (r128 compatible)
-        THREE.OrbitControls = function(object, domElement) {
-            this.object = object;
-            this.domElement = domElement;
-            this.enabled = true;
-            this.target = new THREE.Vector3();
-            this.minDistance = 0;
-            this.maxDistance = Infinity;
-            this.enableDamping = false;
-            this.dampingFactor = 0.05;
-            this.enableZoom = true;
-            this.zoomSpeed = 1.0;
-            this.enableRotate = true;
-            this.rotateSpeed = 1.0;
-            this.enablePan = true;
-            this.panSpeed = 1.0;
-            
-            const scope = this;
-            const STATE = { NONE: -1, ROTATE: 0, DOLLY: 1, PAN: 2 };
-            let state = STATE.NONE;
-            
-            const rotateStart = new THREE.Vector2();
-            const rotateEnd = new THREE.Vector2();
-            const rotateDelta = new THREE.Vector2();
-            const panStart = new THREE.Vector2();
-            const panEnd = new THREE.Vector2();
-            const panDelta = new THREE.Vector2();
-            const dollyStart = new THREE.Vector2();
-            const dollyEnd = new THREE.Vector2();
-            const dollyDelta = new THREE.Vector2();
-            
-            let spherical = new THREE.Spherical();
-            let sphericalDelta = new THREE.Spherical();
-            let scale = 1;
-            let panOffset = new THREE.Vector3();
-            
-            this.update = function() {
-                const offset = new THREE.Vector3();
-                const quat = new THREE.Quaternion().setFromUnitVectors(object.up, new THREE.Vector3(0, 1, 0));
-                const quatInverse = quat.clone().invert();
-                const lastPosition = new THREE.Vector3();
-                
-                const position = scope.object.position;
-                offset.copy(position).sub(scope.target);
-                offset.applyQuaternion(quat);
-                spherical.setFromVector3(offset);
-                spherical.theta += sphericalDelta.theta;
-                spherical.phi += sphericalDelta.phi;
-                spherical.phi = Math.max(0.01, Math.min(Math.PI - 0.01, spherical.phi));
-                spherical.radius *= scale;
-                spherical.radius = Math.max(scope.minDistance, Math.min(scope.maxDistance, spherical.radius));
-                scope.target.add(panOffset);
-                offset.setFromSpherical(spherical);
-                offset.applyQuaternion(quatInverse);
-                position.copy(scope.target).add(offset);
-                scope.object.lookAt(scope.target);
-                sphericalDelta.set(0, 0, 0);
-                scale = 1;
-                panOffset.set(0, 0, 0);
-                return false;
-            };
-            
-            function onMouseDown(event) {
-                if (!scope.enabled) return;
-                event.preventDefault();
-                markMapInteraction();
-                if (event.button === 0) {
-                    state = STATE.ROTATE;
-                    rotateStart.set(event.clientX, event.clientY);
-                } else if (event.button === 1) {
-                    state = STATE.DOLLY;
-                    dollyStart.set(event.clientX, event.clientY);
-                } else if (event.button === 2) {
-                    state = STATE.PAN;
-                    panStart.set(event.clientX, event.clientY);
-                }
-                document.addEventListener('mousemove', onMouseMove, false);
-                document.addEventListener('mouseup', onMouseUp, false);
-            }
-            
-            function onMouseMove(event) {
-                if (!scope.enabled) return;
-                event.preventDefault();
-                if (state === STATE.ROTATE) {
-                    rotateEnd.set(event.clientX, event.clientY);
-                    rotateDelta.subVectors(rotateEnd, rotateStart).multiplyScalar(scope.rotateSpeed);
-                    sphericalDelta.theta -= 2 * Math.PI * rotateDelta.x / domElement.clientHeight;
-                    sphericalDelta.phi -= 2 * Math.PI * rotateDelta.y / domElement.clientHeight;
-                    rotateStart.copy(rotateEnd);
-                } else if (state === STATE.DOLLY) {
-                    dollyEnd.set(event.clientX, event.clientY);
-                    dollyDelta.subVectors(dollyEnd, dollyStart);
-                    if (dollyDelta.y > 0) scale /= Math.pow(0.95, scope.zoomSpeed);
-                    else if (dollyDelta.y < 0) scale *= Math.pow(0.95, scope.zoomSpeed);
-                    dollyStart.copy(dollyEnd);
-                } else if (state === STATE.PAN) {
-                    panEnd.set(event.clientX, event.clientY);
-                    panDelta.subVectors(panEnd, panStart).multiplyScalar(scope.panSpeed);
-                    const offset = new THREE.Vector3();
-                    offset.setFromMatrixColumn(scope.object.matrix, 0);
-                    offset.multiplyScalar(-panDelta.x * 0.5);
-                    panOffset.add(offset);
-                    offset.setFromMatrixColumn(scope.object.matrix, 1);
-                    offset.multiplyScalar(panDelta.y * 0.5);
-                    panOffset.add(offset);
-                    panStart.copy(panEnd);
-                }
-                scope.update();
-            }
-            
-            function onMouseUp() {
-                state = STATE.NONE;
-                document.removeEventListener('mousemove', onMouseMove, false);
-                document.removeEventListener('mouseup', onMouseUp, false);
-            }
-            
-            function onWheel(event) {
-                if (!scope.enabled || !scope.enableZoom) return;
-                event.preventDefault();
-                markMapInteraction();
-                if (event.deltaY < 0) scale *= Math.pow(0.95, scope.zoomSpeed);
-                else if (event.deltaY > 0) scale /= Math.pow(0.95, scope.zoomSpeed);
-                scope.update();
+        offset = n
+    }
+
+    transfers, total, err := w.storage.GetTransferHistory(w.dht.GetLocalSystem().ID, direction, limit, offset)
+    if err != nil {
+        http.Error(rw, "Failed to query transfers", http.StatusInternalServerError)
+        return
+    }
+    rt := w.dht.GetRoutingTable()
+    for _, t := range transfers {
+        if id, err := uuid.Parse(t.PeerID); err == nil {
+            if sys := rt.GetCachedSystem(id); sys != nil {
+                t.PeerName = sys.Name
             }
-            
-            domElement.addEventListener('mousedown', onMouseDown, false);
-            domElement.addEventListener('wheel', onWheel, { passive: false });
-            domElement.addEventListener('contextmenu', e => e.preventDefault(), false);
-            this.update();
-        };
-
-        const knownSystems = [
-            {{range .KnownSystems}}
-            {id: "{{.System.ID}}", name: "{{.System.Name}}", x: {{.System.X}}, y: {{.System.Y}}, z: {{.System.Z}}, color: "{{.System.Stars.Primary.Color}}", starClass: "{{.System.Stars.Primary.Class}}", starDesc: "{{.System.Stars.Primary.Description}}", learnedAt: {{.LearnedAt}}},
-            {{end}}
-        ];
-
-        // Check if a system was learned within the last 24 hours
-        function isNewSystem(learnedAt) {
-            if (!learnedAt) return false;
-            const oneDayAgo = Math.floor(Date.now() / 1000) - (24 * 60 * 60);
-            return learnedAt > oneDayAgo;
-        }
-        const selfSystem = {
-            id: "{{.System.ID}}",
-            name: "{{.System.Name}}",
-            x: {{.System.X}},
-            y: {{.System.Y}},
-            z: {{.System.Z}},
-            color: "{{.System.Stars.Primary.Color}}",
-            starClass: "{{.System.Stars.Primary.Class}}",
-            starDesc: "{{.System.Stars.Primary.Description}}"
-        };
-        const livePeerIDs = new Set([
-            {{range .PeerIDs}}"{{.}}",{{end}}
-        ]);
-
-        let scene, camera, renderer, controls;
-        let starMeshes = [];
-        let connectionLines = [];
-        let cachedConnections = [];
-        let selfRing = null;
-        let ringPulseTime = 0;
-        let labelsContainer = null;
-        let labelElements = [];
-        let systemById = {};
-        let connectionCounts = {};
-
-        // Mutable data that gets refreshed
-        let currentKnownSystems = [...knownSystems];
-        let currentLivePeerIDs = new Set(livePeerIDs);
-
-        // Track user interaction to avoid disrupting browsing
-        let lastMapInteraction = 0;
-        const MAP_INTERACTION_COOLDOWN = 60000; // Don't refresh map for 60s after interaction
-
-        function markMapInteraction() {
-            lastMapInteraction = Date.now();
         }
+    }
 
-        function isUserBrowsingMap() {
-            return (Date.now() - lastMapInteraction) < MAP_INTERACTION_COOLDOWN;
-        }
+    response := map[string]interface{}{
+        "transfers": transfers,
+        "total":     total,
+        "limit":     limit,
+        "offset":    offset,
+    }
 
-        async function fetchConnections() {
-            try {
-                const resp = await fetch('/api/connections');
-                cachedConnections = await resp.json() || [];
-            } catch (e) {
-                console.error('Failed to fetch connections:', e);
-                cachedConnections = [];
-            }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(response)
+}
+
+// handleLivenessDebugAPI shows each routing table peer's liveness backoff state
+func (w *WebInterface) handleLivenessDebugAPI(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(w.dht.GetRoutingTable().GetLivenessSchedule())
+}
+
+// handleLookupAPI runs a find_node lookup for a system and reports every peer asked
+// GET /api/lookup/{id}
+func (w *WebInterface) handleLookupAPI(rw http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    id, err := uuid.Parse(strings.TrimPrefix(r.URL.Path, "/api/lookup/"))
+    if err != nil {
+        http.Error(rw, "Invalid system ID", http.StatusBadRequest)
+        return
+    }
+
+    report, err := w.dht.DebugLookup(id)
+    if errors.Is(err, ErrLookupBusy) {
+        http.Error(rw, err.Error(), http.StatusTooManyRequests)
+        return
+    }
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(report)
+}
+
+// handleDiagnosticsAPI explains the node's health: what happened while joining and what to try
+// GET /api/diagnostics
+func (w *WebInterface) handleDiagnosticsAPI(rw http.ResponseWriter, r *http.Request) {
+    report, err := w.dht.Diagnostics()
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(report)
+}
+
+// handleAdvisorAPI returns the capacity advisor's suggestions (see advisor.go)
+func (w *WebInterface) handleAdvisorAPI(rw http.ResponseWriter, r *http.Request) {
+    report, err := w.dht.GetAdvice()
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(report)
+}
+
+// handleTasksAPI shows the state of each background loop
+func (w *WebInterface) handleTasksAPI(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(w.dht.GetTasks())
+}
+
+// handleTaskRunAPI asks a background loop to run now
+// POST /api/tasks/{name}/run
+func (w *WebInterface) handleTaskRunAPI(rw http.ResponseWriter, r *http.Request) {
+    name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/tasks/"), "/run")
+    if !ok || name == "" || strings.Contains(name, "/") {
+        http.NotFound(rw, r)
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    if err := w.dht.RunTask(name); errors.Is(err, ErrUnknownTask) {
+        http.Error(rw, "Unknown task", http.StatusNotFound)
+        return
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    rw.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(rw).Encode(map[string]interface{}{"task": name, "queued": true})
+}
+
+// handleBlocklistAPI lists (GET), adds (POST) or lifts (DELETE ?system_id=) blocks
+func (w *WebInterface) handleBlocklistAPI(rw http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        rw.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(rw).Encode(w.dht.GetBlockedSystems())
+
+    case http.MethodPost:
+        r.Body = http.MaxBytesReader(rw, r.Body, 1<<16)
+
+        var req BlockRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(rw, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+            return
         }
 
-        function hexToRgb(hex) {
-            const result = /^#?([a-f\d]{2})([a-f\d]{2})([a-f\d]{2})$/i.exec(hex);
-            return result ? {
-                r: parseInt(result[1], 16) / 255,
-                g: parseInt(result[2], 16) / 255,
-                b: parseInt(result[3], 16) / 255
-            } : { r: 1, g: 1, b: 1 };
+        id, err := uuid.Parse(req.SystemID)
+        if err != nil {
+            http.Error(rw, "Invalid system_id", http.StatusBadRequest)
+            return
         }
 
-        function createStarSprite(color, size, isSelf, isCached, starClass) {
-            const canvas = document.createElement('canvas');
-            canvas.width = 64;
-            canvas.height = 64;
-            const ctx = canvas.getContext('2d');
-            
-            // Special rendering for black holes (Class X)
-            if (starClass === 'X') {
-                // Outer accretion disk glow
-                const outerGlow = ctx.createRadialGradient(32, 32, 20, 32, 32, 32);
-                outerGlow.addColorStop(0, 'rgba(139, 92, 246, 0)');
-                outerGlow.addColorStop(0.3, 'rgba(139, 92, 246, 0.4)');
-                outerGlow.addColorStop(0.6, 'rgba(99, 102, 241, 0.6)');
-                outerGlow.addColorStop(0.8, 'rgba(167, 139, 250, 0.3)');
-                outerGlow.addColorStop(1, 'rgba(0, 0, 0, 0)');
-                ctx.fillStyle = outerGlow;
-                ctx.fillRect(0, 0, 64, 64);
-                
-                // Inner ring (accretion disk edge)
-                ctx.beginPath();
-                ctx.arc(32, 32, 16, 0, Math.PI * 2);
-                ctx.strokeStyle = 'rgba(167, 139, 250, 0.8)';
-                ctx.lineWidth = 3;
-                ctx.stroke();
-                
-                // Dark center
-                const darkCenter = ctx.createRadialGradient(32, 32, 0, 32, 32, 14);
-                darkCenter.addColorStop(0, 'rgba(0, 0, 0, 1)');
-                darkCenter.addColorStop(0.7, 'rgba(10, 5, 20, 1)');
-                darkCenter.addColorStop(1, 'rgba(30, 15, 50, 0.8)');
-                ctx.fillStyle = darkCenter;
-                ctx.beginPath();
-                ctx.arc(32, 32, 14, 0, Math.PI * 2);
-                ctx.fill();
-                
-                const texture = new THREE.CanvasTexture(canvas);
-                const material = new THREE.SpriteMaterial({ 
-                    map: texture, 
-                    transparent: true,
-                    blending: THREE.AdditiveBlending
-                });
-                const sprite = new THREE.Sprite(material);
-                sprite.scale.set(size * 1.5, size * 1.5, 1); // Black holes render larger
-                return sprite;
+        var duration time.Duration
+        if req.Duration != "" {
+            duration, err = time.ParseDuration(req.Duration)
+            if err != nil || duration <= 0 {
+                http.Error(rw, "Invalid duration (use e.g. \"24h\", or omit for permanent)", http.StatusBadRequest)
+                return
             }
-            
-            const gradient = ctx.createRadialGradient(32, 32, 0, 32, 32, 32);
-            let rgb = hexToRgb(color);
-            
-            // For cached (non-live) systems, desaturate and add reddish tint
-            if (isCached && !isSelf) {
-                const avg = (rgb.r + rgb.g + rgb.b) / 3;
-                rgb.r = avg * 0.6 + 0.4; // Push toward red
-                rgb.g = avg * 0.4;
-                rgb.b = avg * 0.4;
-            }
-            
-            const colorStr = 'rgb(' + Math.floor(rgb.r*255) + ',' + Math.floor(rgb.g*255) + ',' + Math.floor(rgb.b*255) + ')';
-            
-            gradient.addColorStop(0, isCached && !isSelf ? 'rgba(255,200,200,0.8)' : 'rgba(255,255,255,1)');
-            gradient.addColorStop(0.1, colorStr);
-            gradient.addColorStop(0.4, colorStr.replace('rgb', 'rgba').replace(')', ',' + (isCached ? '0.3' : '0.6') + ')'));
-            gradient.addColorStop(1, 'rgba(0,0,0,0)');
-            
-            ctx.fillStyle = gradient;
-            ctx.fillRect(0, 0, 64, 64);
-            
-            const texture = new THREE.CanvasTexture(canvas);
-            const material = new THREE.SpriteMaterial({ 
-                map: texture, 
-                transparent: true,
-                blending: THREE.AdditiveBlending,
-                opacity: isCached && !isSelf ? 0.6 : 1.0
-            });
-            const sprite = new THREE.Sprite(material);
-            sprite.scale.set(size, size, 1);
-            return sprite;
         }
 
-        function calculateDistance(sys1, sys2) {
-            const dx = sys1.x - sys2.x;
-            const dy = sys1.y - sys2.y;
-            const dz = sys1.z - sys2.z;
-            return Math.sqrt(dx*dx + dy*dy + dz*dz);
+        blocked, err := w.dht.BlockSystem(id, req.Reason, duration)
+        if err != nil {
+            http.Error(rw, err.Error(), http.StatusBadRequest)
+            return
         }
 
-        function centerOnSelf() {
-            if (!controls || !camera) return;
-            
-            const targetPos = new THREE.Vector3(selfSystem.x, selfSystem.y, selfSystem.z);
-            controls.target.copy(targetPos);
-            
-            // Position camera at a nice viewing angle
-            const distance = 800;
-            camera.position.set(
-                targetPos.x + distance * 0.7,
-                targetPos.y + distance * 0.5,
-                targetPos.z + distance * 0.7
-            );
-            controls.update();
-        }
+        rw.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(rw).Encode(blocked)
 
-        function centerOnGenesis() {
-            if (!controls || !camera) return;
-            
-            // Genesis is always at 0,0,0
-            const targetPos = new THREE.Vector3(0, 0, 0);
-            controls.target.copy(targetPos);
-            
-            // Position camera at a nice viewing angle
-            const distance = 1500;
-            camera.position.set(
-                distance * 0.7,
-                distance * 0.5,
-                distance * 0.7
-            );
-            controls.update();
+    case http.MethodDelete:
+        id, err := uuid.Parse(r.URL.Query().Get("system_id"))
+        if err != nil {
+            http.Error(rw, "Invalid system_id", http.StatusBadRequest)
+            return
         }
 
-        function clearMapContent() {
-            // Remove existing stars
-            starMeshes.forEach(mesh => scene.remove(mesh));
-            starMeshes = [];
+        removed, err := w.dht.UnblockSystem(id)
+        if err != nil {
+            http.Error(rw, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        if !removed {
+            http.Error(rw, "System is not blocked", http.StatusNotFound)
+            return
+        }
+        rw.WriteHeader(http.StatusNoContent)
 
-            // Remove self ring
-            if (selfRing) {
-                scene.remove(selfRing);
-                selfRing = null;
-            }
+    default:
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
 
-            // Remove connection lines
-            connectionLines.forEach(line => scene.remove(line));
-            connectionLines = [];
+func (w *WebInterface) handleVersionAPI(rw http.ResponseWriter, r *http.Request) {
+    response := map[string]interface{}{
+        "version":  BuildVersion,
+        "protocol": CurrentProtocolVersion.String(),
+        "capabilities": LocalCapabilities.Names(),
+        "software": "stellar-lab",
+    }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(response)
+}
 
-            // Clear labels
-            labelElements.forEach(item => item.element.remove());
-            labelElements = [];
+// handleConnectionsAPI returns the peer connection topology
+// In public mode our own ID is blanked, as on the page, so the map still draws our links
+func (w *WebInterface) handleConnectionsAPI(rw http.ResponseWriter, r *http.Request) {
+    edges := w.dht.GetConnections()
+    if w.public {
+        selfID := w.dht.GetLocalSystem().ID.String()
+        for i := range edges {
+            if edges[i].FromID == selfID {
+                edges[i].FromID = ""
+            }
+            if edges[i].ToID == selfID {
+                edges[i].ToID = ""
+            }
         }
+    }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(edges)
+}
 
-        function rebuildMapContent() {
-            if (!scene || !labelsContainer) return;
-
-            clearMapContent();
-
-            const allSystems = [selfSystem, ...currentKnownSystems];
-            systemById = {};
-            allSystems.forEach(s => { systemById[s.id] = s; });
-
-            // Add stars
-            allSystems.forEach(sys => {
-                const isSelf = sys.id === selfSystem.id;
-                const isLive = currentLivePeerIDs.has(sys.id);
-                const isCached = !isSelf && !isLive;
-                const size = isSelf ? 40 : (isLive ? 28 : 22);
-                const star = createStarSprite(sys.color || '#ffffff', size, isSelf, isCached, sys.starClass);
-                star.position.set(sys.x, sys.y, sys.z);
-                star.userData = { system: sys, isSelf: isSelf, isLive: isLive, isCached: isCached };
-                scene.add(star);
-                starMeshes.push(star);
-
-                // Add ring pulse effect for self
-                if (isSelf) {
-                    const ringGeometry = new THREE.RingGeometry(18, 22, 32);
-                    const ringMaterial = new THREE.MeshBasicMaterial({
-                        color: 0x60a5fa,
-                        transparent: true,
-                        opacity: 0.6,
-                        side: THREE.DoubleSide
-                    });
-                    const ring = new THREE.Mesh(ringGeometry, ringMaterial);
-                    ring.position.set(sys.x, sys.y, sys.z);
-                    ring.userData = { startScale: 1, maxScale: 3.5 };
-                    scene.add(ring);
-                    selfRing = ring;
-                }
-
-                // Create HTML label
-                const label = document.createElement('div');
-                const isNew = !isSelf && isNewSystem(sys.learnedAt);
-                label.innerHTML = sys.name + (isNew ? ' <span style="background:#22c55e;color:#000;font-size:9px;padding:1px 4px;border-radius:3px;margin-left:4px;">NEW</span>' : '');
-                label.style.cssText = 'position:absolute;font-size:11px;white-space:nowrap;transform:translateX(-50%);';
-                if (isSelf) {
-                    label.style.color = '#60a5fa';
-                    label.style.fontWeight = '500';
-                } else if (isLive) {
-                    label.style.color = '#4ade80';
-                } else {
-                    label.style.color = '#666';
-                }
-                labelsContainer.appendChild(label);
-                labelElements.push({ element: label, position: star.position, isSelf: isSelf });
-            });
-
-            // Build reciprocity map
-            const edgeSet = new Set();
-            if (cachedConnections) {
-                cachedConnections.forEach(conn => {
-                    edgeSet.add(conn.from_id + ':' + conn.to_id);
-                });
-            }
+// handlePeerExportAPI returns our verified peers in the -export-peers format
+func (w *WebInterface) handlePeerExportAPI(rw http.ResponseWriter, r *http.Request) {
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(w.dht.ExportPeers())
+}
 
-            function isReciprocal(fromId, toId) {
-                return edgeSet.has(fromId + ':' + toId) && edgeSet.has(toId + ':' + fromId);
-            }
+// handlePeerImportAPI caches the systems in a peer export (the -export-peers format) and
+// starts verifying them
+func (w *WebInterface) handlePeerImportAPI(rw http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    r.Body = http.MaxBytesReader(rw, r.Body, MaxPeerImportBytes)
 
-            // Build connection count per system
-            connectionCounts = {};
-            if (cachedConnections) {
-                cachedConnections.forEach(conn => {
-                    connectionCounts[conn.from_id] = (connectionCounts[conn.from_id] || 0) + 1;
-                    connectionCounts[conn.to_id] = (connectionCounts[conn.to_id] || 0) + 1;
-                });
-            }
+    export, err := decodePeerExport(r.Body)
+    if err != nil {
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
 
-            // Add connection lines - ONLY show our direct peer connections by default
-            // Other connections are shown on hover
-            const processedEdges = new Set();
-            if (cachedConnections && cachedConnections.length > 0) {
-                cachedConnections.forEach(conn => {
-                    const from = systemById[conn.from_id];
-                    const to = systemById[conn.to_id];
-                    if (!from || !to) return;
-
-                    // Avoid drawing same edge twice
-                    const edgeKey = [conn.from_id, conn.to_id].sort().join(':');
-                    if (processedEdges.has(edgeKey)) return;
-                    processedEdges.add(edgeKey);
-
-                    // Only draw lines involving ourselves (direct peers)
-                    const involvesUs = conn.from_id === selfSystem.id || conn.to_id === selfSystem.id;
-
-                    const reciprocal = isReciprocal(conn.from_id, conn.to_id);
-                    const points = [
-                        new THREE.Vector3(from.x, from.y, from.z),
-                        new THREE.Vector3(to.x, to.y, to.z)
-                    ];
-                    const geometry = new THREE.BufferGeometry().setFromPoints(points);
-
-                    let line;
-                    if (reciprocal) {
-                        const material = new THREE.LineBasicMaterial({
-                            color: 0x64c8ff,
-                            transparent: true,
-                            opacity: involvesUs ? 0.5 : 0
-                        });
-                        line = new THREE.Line(geometry, material);
-                    } else {
-                        const material = new THREE.LineDashedMaterial({
-                            color: 0xffaa44,
-                            transparent: true,
-                            opacity: involvesUs ? 0.4 : 0,
-                            dashSize: 30,
-                            gapSize: 20
-                        });
-                        line = new THREE.Line(geometry, material);
-                        line.computeLineDistances();
-                    }
-                    line.userData = {
-                        fromId: conn.from_id,
-                        toId: conn.to_id,
-                        reciprocal: reciprocal,
-                        involvesUs: involvesUs,
-                        baseOpacity: involvesUs ? (reciprocal ? 0.5 : 0.4) : 0
-                    };
-                    scene.add(line);
-                    connectionLines.push(line);
-                });
-            }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(w.dht.ImportPeers(export))
+}
+
+// handleHistoryAPI replays recorded galaxy snapshots for the map time slider
+// Query params: from, to (unix, default the last 7 days), step (seconds, default 3600)
+func (w *WebInterface) handleHistoryAPI(rw http.ResponseWriter, r *http.Request) {
+    params := r.URL.Query()
+    parse := func(name string, def int64) (int64, bool) {
+        v := params.Get(name)
+        if v == "" {
+            return def, true
+        }
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n < 1 {
+            http.Error(rw, "Invalid "+name, http.StatusBadRequest)
+            return 0, false
         }
+        return n, true
+    }
 
-        async function initGalaxyMap() {
-            const container = document.getElementById('galaxy-map');
-            if (!container) return;
-            
-            const width = container.clientWidth;
-            const height = container.clientHeight;
-            if (width === 0 || height === 0) {
-                setTimeout(initGalaxyMap, 100);
-                return;
-            }
+    to, ok := parse("to", time.Now().Unix())
+    if !ok {
+        return
+    }
+    from, ok := parse("from", to-int64(DefaultHistoryRange.Seconds()))
+    if !ok {
+        return
+    }
+    step, ok := parse("step", int64(GalaxySnapshotInterval.Seconds()))
+    if !ok {
+        return
+    }
+    if from >= to {
+        http.Error(rw, "from must be before to", http.StatusBadRequest)
+        return
+    }
 
-            // Fetch connections
-            await fetchConnections();
-
-            // Scene
-            scene = new THREE.Scene();
-            
-            // Camera
-            camera = new THREE.PerspectiveCamera(60, width / height, 1, 50000);
-            
-            // Renderer
-            renderer = new THREE.WebGLRenderer({ antialias: true, alpha: true });
-            renderer.setSize(width, height);
-            renderer.setPixelRatio(Math.min(window.devicePixelRatio, 2));
-            container.appendChild(renderer.domElement);
-            
-            // Controls
-            controls = new THREE.OrbitControls(camera, renderer.domElement);
-            controls.enableDamping = true;
-            controls.dampingFactor = 0.05;
-            controls.minDistance = 100;
-            controls.maxDistance = 15000;
-            controls.panSpeed = 0.8;
-            controls.rotateSpeed = 0.6;
-            
-            // Add controls UI
-            const controlsDiv = document.createElement('div');
-            controlsDiv.className = 'map-controls';
-            controlsDiv.innerHTML = '<button class="map-btn" onclick="centerOnSelf()">⌂ Home</button><button class="map-btn" onclick="centerOnGenesis()">✦ Genesis</button>';
-            container.appendChild(controlsDiv);
-            
-            // Add legend
-            const legend = document.createElement('div');
-            legend.style.cssText = 'position:absolute;top:10px;left:10px;background:rgba(0,0,0,0.7);border:1px solid rgba(255,255,255,0.1);border-radius:6px;padding:8px 12px;font-size:11px;z-index:100;';
-            legend.innerHTML = 
-                '<div style="margin-bottom:6px;color:#888;font-weight:500;">Legend</div>' +
-                '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#60a5fa;">●</span> You</div>' +
-                '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#4ade80;">●</span> Live peers</div>' +
-                '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#996666;">●</span> Cached</div>' +
-                '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#64c8ff;">―</span> Your connections</div>' +
-                '<div style="display:flex;align-items:center;gap:6px;color:#666;font-size:10px;">Hover to see other connections</div>';
-            container.appendChild(legend);
-            
-            // Add tooltip
-            const tooltip = document.createElement('div');
-            tooltip.className = 'map-tooltip';
-            tooltip.id = 'map-tooltip';
-            container.appendChild(tooltip);
-            
-            // Add hint
-            const hint = document.createElement('div');
-            hint.className = 'map-hint';
-            hint.textContent = 'Left-drag: rotate • Right-drag: pan • Scroll: zoom';
-            container.appendChild(hint);
-
-            // Labels container
-            labelsContainer = document.createElement('div');
-            labelsContainer.style.cssText = 'position:absolute;top:0;left:0;width:100%;height:100%;pointer-events:none;overflow:hidden;';
-            container.appendChild(labelsContainer);
-
-            // Build initial map content (stars, connections, labels)
-            rebuildMapContent();
-
-            // Add subtle starfield background
-            const starfieldGeo = new THREE.BufferGeometry();
-            const starfieldCount = 2000;
-            const starfieldPositions = new Float32Array(starfieldCount * 3);
-            for (let i = 0; i < starfieldCount * 3; i += 3) {
-                starfieldPositions[i] = (Math.random() - 0.5) * 30000;
-                starfieldPositions[i+1] = (Math.random() - 0.5) * 30000;
-                starfieldPositions[i+2] = (Math.random() - 0.5) * 30000;
-            }
-            starfieldGeo.setAttribute('position', new THREE.BufferAttribute(starfieldPositions, 3));
-            const starfieldMat = new THREE.PointsMaterial({ color: 0x444466, size: 2, transparent: true, opacity: 0.5 });
-            const starfield = new THREE.Points(starfieldGeo, starfieldMat);
-            scene.add(starfield);
-
-            // Center on self initially
-            centerOnSelf();
-
-            // Raycaster for hover
-            const raycaster = new THREE.Raycaster();
-            raycaster.params.Sprite = { threshold: 20 };
-            const mouse = new THREE.Vector2();
-            let hoveredSystemId = null;
-            
-            function highlightConnections(systemId) {
-                connectionLines.forEach(line => {
-                    const involvesHovered = systemId && (line.userData.fromId === systemId || line.userData.toId === systemId);
-
-                    if (involvesHovered) {
-                        // Highlight connections involving hovered system
-                        line.material.opacity = line.userData.reciprocal ? 0.8 : 0.6;
-                        if (line.userData.reciprocal) {
-                            line.material.color.setHex(0x60a5fa);
-                        }
-                    } else {
-                        // Return to base state: only our direct connections visible
-                        line.material.opacity = line.userData.baseOpacity;
-                        if (line.userData.reciprocal) {
-                            line.material.color.setHex(0x64c8ff);
-                        }
-                    }
-                });
-            }
-            
-            renderer.domElement.addEventListener('mousemove', (event) => {
-                const rect = renderer.domElement.getBoundingClientRect();
-                mouse.x = ((event.clientX - rect.left) / rect.width) * 2 - 1;
-                mouse.y = -((event.clientY - rect.top) / rect.height) * 2 + 1;
-                
-                raycaster.setFromCamera(mouse, camera);
-                const intersects = raycaster.intersectObjects(starMeshes);
-                
-                const tooltip = document.getElementById('map-tooltip');
-                if (intersects.length > 0) {
-                    const userData = intersects[0].object.userData;
-                    const sys = userData.system;
-                    const isSelf = userData.isSelf;
-                    const isLive = userData.isLive;
-                    const distance = calculateDistance(selfSystem, sys);
-                    const connCount = connectionCounts[sys.id] || 0;
-                    
-                    let statusLabel = '';
-                    if (isSelf) statusLabel = ' <span style="color:#60a5fa">(You)</span>';
-                    else if (isLive) statusLabel = ' <span style="color:#4ade80">(Live)</span>';
-                    else statusLabel = ' <span style="color:#888">(Cached)</span>';
-                    
-                    tooltip.innerHTML = 
-                        '<div class="tooltip-name">' + sys.name + statusLabel + '</div>' +
-                        '<div class="tooltip-class">' + (sys.starDesc || sys.starClass + '-class star') + '</div>' +
-                        '<div class="tooltip-coords">(' + sys.x.toFixed(1) + ', ' + sys.y.toFixed(1) + ', ' + sys.z.toFixed(1) + ')</div>' +
-                        '<div class="tooltip-distance" style="color:#64c8ff;">' + connCount + ' connection' + (connCount !== 1 ? 's' : '') + '</div>' +
-                        (isSelf ? '' : '<div class="tooltip-distance">' + distance.toFixed(1) + ' units away</div>');
-                    tooltip.style.display = 'block';
-                    tooltip.style.left = (event.clientX - rect.left + 15) + 'px';
-                    tooltip.style.top = (event.clientY - rect.top + 15) + 'px';
-                    renderer.domElement.style.cursor = 'pointer';
-                    
-                    // Highlight connections
-                    if (hoveredSystemId !== sys.id) {
-                        hoveredSystemId = sys.id;
-                        highlightConnections(sys.id);
-                    }
-                } else {
-                    tooltip.style.display = 'none';
-                    renderer.domElement.style.cursor = 'grab';
-                    if (hoveredSystemId !== null) {
-                        hoveredSystemId = null;
-                        highlightConnections(null);
-                    }
-                }
-            });
-
-            // Animation loop
-            function animate() {
-                requestAnimationFrame(animate);
-                controls.update();
-                
-                // Animate ring pulse for self
-                if (selfRing) {
-                    ringPulseTime += 0.0032; // ~5 second cycle at 60fps
-                    const cycle = ringPulseTime % 1; // 0 to 1 cycle
-                    const scale = 1 + cycle * 2.5; // 1 to 3.5
-                    const opacity = 0.6 * (1 - cycle); // 0.6 to 0
-                    selfRing.scale.set(scale, scale, 1);
-                    selfRing.material.opacity = opacity;
-                    // Make ring face camera
-                    selfRing.lookAt(camera.position);
-                }
-                
-                // Update label positions
-                const widthHalf = width / 2;
-                const heightHalf = height / 2;
-                labelElements.forEach(item => {
-                    const pos = item.position.clone();
-                    pos.project(camera);
-                    
-                    // Check if in front of camera
-                    if (pos.z < 1) {
-                        item.element.style.display = 'block';
-                        item.element.style.left = (pos.x * widthHalf + widthHalf) + 'px';
-                        item.element.style.top = (-pos.y * heightHalf + heightHalf + 15) + 'px';
-                    } else {
-                        item.element.style.display = 'none';
-                    }
-                });
-                
-                renderer.render(scene, camera);
-            }
-            animate();
-
-            // Handle resize
-            window.addEventListener('resize', () => {
-                const w = container.clientWidth;
-                const h = container.clientHeight;
-                camera.aspect = w / h;
-                camera.updateProjectionMatrix();
-                renderer.setSize(w, h);
-            });
-        }
+    history, err := w.dht.GetGalaxyHistory(from, to, step)
+    if err != nil {
+        http.Error(rw, "Failed to get galaxy history", http.StatusInternalServerError)
+        return
+    }
 
-        document.addEventListener('DOMContentLoaded', initGalaxyMap);
-        
-        // AJAX refresh stats without reloading page
-        async function refreshStats() {
-            try {
-                // Fetch credits
-                const creditsResp = await fetch('/api/credits');
-                const credits = await creditsResp.json();
-                
-                document.getElementById('stat-balance').textContent = credits.balance + ' ✦';
-                document.getElementById('stat-rank').textContent = credits.rank;
-                document.getElementById('stat-rank').style.color = credits.rank_color;
-                
-                const nextRankRow = document.getElementById('stat-nextrank-row');
-                if (credits.credits_to_next > 0) {
-                    nextRankRow.style.display = '';
-                    document.getElementById('stat-nextrank').textContent = credits.next_rank + ' (' + credits.credits_to_next + ' ✦ needed)';
-                } else {
-                    nextRankRow.style.display = 'none';
-                }
-                
-                const longevityWeeks = credits.longevity_weeks || 0;
-                const longevityBonus = (credits.longevity_bonus || 0) * 100;
-                const longevityProgress = Math.min((longevityWeeks / 52) * 100, 100);
-                
-                document.getElementById('stat-longbonus').textContent = '+' + longevityBonus.toFixed(1) + '%';
-                document.getElementById('stat-longbar').style.width = longevityProgress.toFixed(1) + '%';
-                document.getElementById('stat-longweeks').textContent = longevityWeeks.toFixed(1) + ' / 52 weeks to max (+52%)';
-                
-                // Fetch stats
-                const statsResp = await fetch('/api/stats');
-                const stats = await statsResp.json();
-                
-                if (stats.attestation_count !== undefined) {
-                    document.getElementById('stat-attestations').textContent = stats.attestation_count;
-                }
-                if (stats.database_size) {
-                    document.getElementById('stat-dbsize').textContent = stats.database_size;
-                }
-
-                // Update peer state breakdown
-                if (stats.peer_states) {
-                    document.getElementById('state-active').textContent = stats.peer_states.active || 0;
-                    document.getElementById('state-pending').textContent = stats.peer_states.pending || 0;
-                    document.getElementById('state-degraded').textContent = stats.peer_states.degraded || 0;
-                    document.getElementById('state-stale').textContent = stats.peer_states.stale || 0;
-                }
-
-                // Fetch peers for routing table
-                const peersResp = await fetch('/api/peers');
-                const peers = await peersResp.json() || [];
-
-                const routingSize = peers.length;
-                document.getElementById('routing-title').textContent = 'Routing Table (' + routingSize + ' nodes)';
-                
-                // Update health based on routing table size
-                const healthEl = document.getElementById('stat-health');
-                if (routingSize >= 2) {
-                    healthEl.textContent = 'Healthy';
-                    healthEl.className = 'stat-value health-healthy';
-                } else if (routingSize === 1) {
-                    healthEl.textContent = 'Low Connectivity';
-                    healthEl.className = 'stat-value health-warning';
-                } else {
-                    healthEl.textContent = 'Isolated';
-                    healthEl.className = 'stat-value health-critical';
-                }
-                
-                // Update peer list (sorted alphabetically)
-                const peerListEl = document.getElementById('peer-list');
-                const oneDayAgo = Math.floor(Date.now() / 1000) - (24 * 60 * 60);
-                const formatDate = (ts) => {
-                    if (!ts) return 'Unknown';
-                    const d = new Date(ts * 1000);
-                    const mm = String(d.getMonth() + 1).padStart(2, '0');
-                    const dd = String(d.getDate()).padStart(2, '0');
-                    const yy = String(d.getFullYear()).slice(-2);
-                    return mm + '/' + dd + '/' + yy;
-                };
-                if (peers.length === 0) {
-                    peerListEl.innerHTML = '<p style="color: #666; padding: 20px; text-align: center;">No peers in routing table</p>';
-                } else {
-                    const sortedPeers = [...peers].sort((a, b) => a.name.localeCompare(b.name));
-                    peerListEl.innerHTML = sortedPeers.map(p => {
-                        const isNew = p.learned_at && p.learned_at > oneDayAgo;
-                        const newBadge = isNew ? ' <span class="new-badge">NEW</span>' : '';
-                        const firstSeen = formatDate(p.learned_at);
-                        return '<div class="peer-item">' +
-                            '<div class="peer-name">' + p.name + newBadge + '</div>' +
-                            '<div class="peer-id">' + p.id + '</div>' +
-                            '<div class="peer-meta"><span class="coords">(' + p.x.toFixed(1) + ', ' + p.y.toFixed(1) + ', ' + p.z.toFixed(1) + ')</span> · <span class="first-seen">First seen: ' + firstSeen + '</span></div>' +
-                            '</div>';
-                    }).join('');
-                }
-                
-                // Fetch known systems for counts AND map update
-                const systemsResp = await fetch('/api/known-systems');
-                const systems = await systemsResp.json() || [];
-
-                const totalSystems = systems.length + 1;
-                document.getElementById('stat-galaxy').textContent = totalSystems + ' total';
-                document.getElementById('galaxy-title').textContent = 'Galaxy Map (' + totalSystems + ' systems)';
-
-                // Only update map data if user isn't actively browsing
-                if (!isUserBrowsingMap()) {
-                    // Update live peer IDs set from peers response
-                    currentLivePeerIDs = new Set(peers.map(p => p.id));
-
-                    // Update known systems for map (convert to map format)
-                    currentKnownSystems = systems.map(s => ({
-                        id: s.id,
-                        name: s.name,
-                        x: s.x,
-                        y: s.y,
-                        z: s.z,
-                        color: s.stars?.primary?.color || '#ffffff',
-                        starClass: s.stars?.primary?.class || 'M',
-                        starDesc: s.stars?.primary?.description || '',
-                        learnedAt: s.learned_at || 0
-                    }));
-
-                    // Fetch fresh connections
-                    const connectionsResp = await fetch('/api/connections');
-                    cachedConnections = await connectionsResp.json() || [];
-
-                    // Rebuild the 3D map with updated data
-                    rebuildMapContent();
-                }
-
-            } catch (err) {
-                console.error('Failed to refresh stats:', err);
-            }
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(history)
+}
+
+// handleAttestationsAPI returns stored attestations, newest first
+// Query params: from_system, message_type, since (unix), limit (max 500), offset
+func (w *WebInterface) handleAttestationsAPI(rw http.ResponseWriter, r *http.Request) {
+    params := r.URL.Query()
+    query := AttestationQuery{
+        MessageType: params.Get("message_type"),
+        Limit:       50,
+    }
+
+    if from := params.Get("from_system"); from != "" {
+        id, err := uuid.Parse(from)
+        if err != nil {
+            http.Error(rw, "Invalid from_system", http.StatusBadRequest)
+            return
         }
-        
-        // Refresh stats every 30 seconds
-        setInterval(refreshStats, 30000);
-
-        async function exportTopology() {
-            const data = {
-                exported_at: new Date().toISOString(),
-                local_system: selfSystem,
-                known_systems: currentKnownSystems,
-                connections: cachedConnections,
-                live_peer_ids: Array.from(currentLivePeerIDs)
-            };
-            
-            const blob = new Blob([JSON.stringify(data, null, 2)], { type: 'application/json' });
-            const url = URL.createObjectURL(blob);
-            const a = document.createElement('a');
-            a.href = url;
-            a.download = 'stellar-topology-' + new Date().toISOString().split('T')[0] + '.json';
-            document.body.appendChild(a);
-            a.click();
-            document.body.removeChild(a);
-            URL.revokeObjectURL(url);
+        query.FromSystem = id.String()
+    }
+    if since := params.Get("since"); since != "" {
+        v, err := strconv.ParseInt(since, 10, 64)
+        if err != nil {
+            http.Error(rw, "Invalid since", http.StatusBadRequest)
+            return
         }
-    </script>
-</body>
-</html>`
\ No newline at end of file
+        query.Since = v
+    }
+    if limit := params.Get("limit"); limit != "" {
+        v, err := strconv.Atoi(limit)
+        if err != nil || v < 1 {
+            http.Error(rw, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        if v > 500 {
+            v = 500
+        }
+        query.Limit = v
+    }
+    if offset := params.Get("offset"); offset != "" {
+        v, err := strconv.Atoi(offset)
+        if err != nil || v < 0 {
+            http.Error(rw, "Invalid offset", http.StatusBadRequest)
+            return
+        }
+        query.Offset = v
+    }
+
+    // Include what's still buffered, so the list is never behind what we received
+    if err := w.dht.FlushAttestations(); err != nil {
+        http.Error(rw, "Failed to save buffered attestations", http.StatusInternalServerError)
+        return
+    }
+    records, total, err := w.storage.GetAttestationsPaged(query)
+    if err != nil {
+        http.Error(rw, "Failed to query attestations", http.StatusInternalServerError)
+        return
+    }
+
+    response := map[string]interface{}{
+        "attestations": records,
+        "total":        total,
+        "limit":        query.Limit,
+        "offset":       query.Offset,
+    }
+
+    rw.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(rw).Encode(response)
+}
+
+// formatBytes formats a byte count as a human-readable string
+func formatBytes(bytes int64) string {
+    const unit = 1024
+    if bytes < unit {
+        return fmt.Sprintf("%d B", bytes)
+    }
+    div, exp := int64(unit), 0
+    for n := bytes / unit; n >= unit; n /= unit {
+        div *= unit
+        exp++
+    }
+    return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,78 @@
+// Capacity advisor hints under Network Status: suggestions only, nothing happens unless clicked
+
+// Dismissed suggestion IDs, kept in localStorage so they stay dismissed across reloads
+function dismissedAdvice() {
+    try {
+        return new Set(JSON.parse(localStorage.getItem('dismissedAdvice') || '[]'));
+    } catch (err) {
+        return new Set();
+    }
+}
+
+function dismissAdvice(id) {
+    const dismissed = dismissedAdvice();
+    dismissed.add(id);
+    localStorage.setItem('dismissedAdvice', JSON.stringify([...dismissed]));
+    const hint = document.querySelector('.advice[data-id="' + CSS.escape(id) + '"]');
+    if (hint) hint.remove();
+    if (!document.querySelector('#advisor-hints .advice')) {
+        document.getElementById('advisor').style.display = 'none';
+    }
+}
+
+function renderAdvice(s) {
+    return '<div class="advice advice-' + s.kind + '" data-id="' + escapeHTML(s.id) + '">' +
+        '<div class="advice-message">' + escapeHTML(s.message) +
+        '<div class="advice-status" id="advice-status-' + escapeHTML(s.system_id) + '"></div></div>' +
+        (s.kind === 'connect' ? '<button onclick="connectAdvised(\'' + escapeHTML(s.system_id) + '\')" title="Ping it once; a reply makes it a peer">Connect</button>' : '') +
+        '<button onclick="dismissAdvice(\'' + escapeHTML(s.id) + '\')" title="Dismiss">×</button>' +
+        '</div>';
+}
+
+// The estimates are only as fresh as the peer lists behind them, so say how old those are
+function advisorNote(report) {
+    if (!report.newest_report) {
+        return 'No peer lists reported in the last ' + report.window_hours + ' hours to estimate from';
+    }
+    const hoursOld = Math.max(0, (report.generated_at - report.oldest_report) / 3600);
+    return 'Estimated for ' + report.systems_estimated + ' systems from peer lists up to ' +
+        hoursOld.toFixed(1) + ' hours old (window ' + report.window_hours + 'h)';
+}
+
+async function refreshAdvisor() {
+    let report;
+    try {
+        report = await fetch('/api/advisor').then(r => r.json());
+    } catch (err) {
+        console.error('Failed to load advisor:', err);
+        return;
+    }
+    const dismissed = dismissedAdvice();
+    const shown = report.suggestions.filter(s => !dismissed.has(s.id));
+    document.getElementById('advisor').style.display = shown.length ? '' : 'none';
+    document.getElementById('advisor-note').textContent = advisorNote(report);
+    document.getElementById('advisor-hints').innerHTML = shown.map(renderAdvice).join('');
+}
+
+// connectAdvised posts to the same endpoint as the map's "Attempt connection", reporting
+// only the outcome (the last line of the streamed progress)
+async function connectAdvised(systemId) {
+    const status = document.getElementById('advice-status-' + systemId);
+    status.textContent = 'Connecting...';
+    try {
+        const resp = await adminFetch('/api/peers/connect', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ system_id: systemId })
+        });
+        const text = (await resp.text()).trim();
+        if (!resp.ok) {
+            status.textContent = text;
+            return;
+        }
+        const last = JSON.parse(text.split('\n').pop());
+        status.textContent = last.stage === 'connected' ? 'Connected: now ' + last.state : 'Failed: ' + last.error;
+    } catch (err) {
+        status.textContent = err.message;
+    }
+}
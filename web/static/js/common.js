@@ -0,0 +1,60 @@
+// Helpers shared by the dashboard scripts
+
+// Names come from other nodes: anything put through innerHTML goes through here first
+function escapeHTML(s) {
+    return String(s).replace(/[&<>"']/g, c => ({'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'})[c]);
+}
+
+// The operator's own notes, tags and label colors by system ID (never in public mode)
+let peerAnnotations = {};
+
+async function refreshAnnotations() {
+    try {
+        const resp = await fetch('/api/peers/annotations');
+        const list = await resp.json() || [];
+        peerAnnotations = {};
+        list.forEach(a => { peerAnnotations[a.system_id] = a; });
+        renderPeerList(currentPeers);
+        mapDirty = true;
+    } catch (err) {
+        console.error('Failed to refresh annotations:', err);
+    }
+}
+
+function annotationChips(a) {
+    return a && a.tags.length ? a.tags.map(t => '<span class="tag-chip">' + escapeHTML(t) + '</span>').join('') : '';
+}
+
+// Check if a system was learned within the last 24 hours
+function isNewSystem(learnedAt) {
+    if (!learnedAt) return false;
+    const oneDayAgo = Math.floor(Date.now() / 1000) - (24 * 60 * 60);
+    return learnedAt > oneDayAgo;
+}
+
+// adminFetch sends a request that needs the admin token (kept in localStorage),
+// asking for the token when the server answers 401
+async function adminFetch(url, options = {}) {
+    for (let attempt = 0; attempt < 2; attempt++) {
+        const token = localStorage.getItem('adminToken') || '';
+        const resp = await fetch(url, { ...options, headers: { ...(options.headers || {}), 'Authorization': 'Bearer ' + token } });
+        if (resp.status !== 401) return resp;
+
+        const body = await resp.json().catch(() => ({}));
+        const entered = prompt((body.message || 'Admin token required') +
+            '\n\nEnter the admin token from the node\'s first-run log (or -admin-token):');
+        if (!entered) throw new Error(body.message || 'Admin token required');
+        localStorage.setItem('adminToken', entered.trim());
+    }
+    throw new Error('Invalid admin token');
+}
+
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let i = 0;
+    while (bytes >= 1024 && i < units.length - 1) {
+        bytes /= 1024;
+        i++;
+    }
+    return (i === 0 ? bytes : bytes.toFixed(1)) + ' ' + units[i];
+}
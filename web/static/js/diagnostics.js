@@ -0,0 +1,34 @@
+// Diagnostics panel under the health indicator: why the node is unhealthy and what to try
+
+const FINDING_ICONS = { ok: '✓', info: 'ℹ', warning: '⚠', problem: '✗' };
+
+function renderFinding(f) {
+    return '<div class="finding finding-' + f.severity + '">' +
+        '<div class="finding-title">' + FINDING_ICONS[f.severity] + ' ' + escapeHTML(f.title) + '</div>' +
+        (f.detail ? '<div class="finding-detail">' + escapeHTML(f.detail) + '</div>' : '') +
+        (f.advice ? '<div class="finding-advice">Try: ' + escapeHTML(f.advice) + '</div>' : '') +
+        '</div>';
+}
+
+function renderDiagnosticEvent(e) {
+    return '<div class="diagnostic-event' + (e.ok ? '' : ' failed') + '">' +
+        '<span class="transfer-time">' + new Date(e.at * 1000).toLocaleString() + '</span> ' +
+        (e.ok ? '✓ ' : '✗ ') + escapeHTML(e.stage.replace('_', ' ')) + ': ' + escapeHTML(e.message) + '</div>';
+}
+
+async function refreshDiagnostics() {
+    let report;
+    try {
+        report = await fetch('/api/diagnostics').then(r => r.json());
+    } catch (err) {
+        console.error('Failed to load diagnostics:', err);
+        return;
+    }
+    const problems = report.findings.filter(f => f.severity === 'problem' || f.severity === 'warning').length;
+    const summary = document.getElementById('diagnostics-summary');
+    summary.textContent = problems > 0 ? 'Diagnostics: ' + problems + ' thing' + (problems === 1 ? '' : 's') + ' to look at' : 'Diagnostics: nothing wrong found';
+    summary.className = problems > 0 ? 'health-warning' : '';
+    document.getElementById('diagnostics-findings').innerHTML = report.findings.map(renderFinding).join('');
+    document.getElementById('diagnostics-events').innerHTML = report.events.slice().reverse().map(renderDiagnosticEvent).join('') ||
+        '<div class="longevity-note">Nothing recorded yet</div>';
+}
@@ -0,0 +1,1314 @@
+// Galaxy map: Three.js scene, clustering, filters, search, lineage and history playback
+
+let scene, camera, renderer, controls;
+let starMeshes = [];
+let connectionLines = [];
+let connectionBundles = [];
+let cachedConnections = [];
+let selfRing = null;
+let ringPulseTime = 0;
+let labelsContainer = null;
+let labelElements = [];
+let systemById = {};
+let connectionCounts = {};
+
+// Mutable data that gets refreshed
+let currentKnownSystems = [];
+let currentLivePeerIDs = new Set(livePeerIDs);
+
+// Large galaxies come from /api/map as clusters that split up as the camera zooms in
+const MAX_MAP_LOD = 5;              // The server clamps to its own limit anyway
+const MAP_LOD_BASE_DISTANCE = 8000; // Camera distance of LOD 0; each halving adds a level
+const MAP_REFETCH_INTERVAL = 30000; // Clustered maps are refetched at most this often for changes
+let currentClusters = [];
+let mapClustered = false;
+let mapTotal = 0;
+let mapLOD = 0;
+let mapFetching = false;
+let mapStale = false;
+let lastMapFetch = 0;
+
+// Galaxy history playback: while a frame is shown the map draws it instead of live data
+let historyFrames = null;
+let historyState = null;
+let historyTimer = null;
+
+// Map filters: applied by the server (/api/map takes the /api/known-systems filter
+// parameters) and kept in the URL hash, so a filtered view can be shared as a link
+// like #class=M&within=7d. Hash keys map to query parameters
+const MAP_FILTER_PARAMS = {
+    class: 'star_class',
+    verified: 'verified_only',
+    within: 'learned_within',
+    name: 'name_prefix',
+    dist: 'max_distance',
+    near: 'max_distance_from' // x,y,z; ourselves when left out
+};
+const MAP_CLASSES = ['O', 'B', 'A', 'F', 'G', 'K', 'M', 'X'];
+let mapFilter = readMapFilterHash();
+let mapMatching = 0;
+
+// Search results get a pulsing ring like our own, for a few pulses
+const SEARCH_RING_COLOR = 0xfbbf24;
+const SEARCH_PULSES = 3;
+let searchRing = null;
+let searchPulseTime = 0;
+
+// Connections are straight lines in small galaxies. From EDGE_CURVE_MIN_EDGES on they bend
+// slightly to one side so they don't all cross the core in one hairball, and the visible
+// ones running between the same two regions are drawn as a single bundle, thicker the
+// more edges it holds, that splits back into them while either end is hovered
+const EDGE_CURVE_MIN_EDGES = 30;
+const EDGE_CURVE_BEND = 0.12;   // Control point offset, as a fraction of the edge's length
+const EDGE_CURVE_SEGMENTS = 16;
+const EDGE_BUNDLE_REGION = 500; // Edges are bundled by the grid cells of this size their ends are in
+
+// Lineage overlay: the /api/constellation tree of one system while it's on
+const LINEAGE_COLOR = 0xfbbf24;
+let lineage = null;
+let lineageLines = [];
+
+function mapView() {
+    return historyState || { systems: currentKnownSystems, clusters: currentClusters, connections: cachedConnections, liveIDs: currentLivePeerIDs };
+}
+
+function applyMap(map) {
+    mapClustered = map.clustered;
+    mapTotal = map.total;
+    mapMatching = map.matching;
+    mapLOD = map.lod;
+    currentKnownSystems = (map.systems || []).map(s => toMapSystem(s, s.learned_at));
+    currentClusters = map.clusters || [];
+    lastMapFetch = Date.now();
+    updateSystemCounts();
+}
+
+async function fetchMap(lod) {
+    mapFetching = true;
+    try {
+        const resp = await fetch('/api/map?lod=' + lod + mapFilterQuery());
+        applyMap(await resp.json());
+    } catch (e) {
+        console.error('Failed to fetch galaxy map:', e);
+    } finally {
+        mapFetching = false;
+    }
+}
+
+function readMapFilterHash() {
+    const params = new URLSearchParams(location.hash.slice(1));
+    const filter = {};
+    Object.keys(MAP_FILTER_PARAMS).forEach(key => {
+        if (params.get(key)) filter[key] = params.get(key);
+    });
+    return filter;
+}
+
+function writeMapFilterHash() {
+    const params = new URLSearchParams();
+    Object.keys(mapFilter).forEach(key => params.set(key, mapFilter[key]));
+    const hash = params.toString();
+    history.replaceState(null, '', hash ? '#' + hash : location.pathname + location.search);
+}
+
+function hasMapFilter() {
+    return Object.keys(mapFilter).some(key => key !== 'near');
+}
+
+// mapFilterQuery turns the filter into query parameters to append to /api/map?lod=N
+function mapFilterQuery() {
+    const filter = Object.assign({}, mapFilter);
+    if (!filter.dist) {
+        delete filter.near;
+    } else if (!filter.near) {
+        filter.near = [selfSystem.x, selfSystem.y, selfSystem.z].join(',');
+    }
+    return Object.keys(filter).map(key => '&' + MAP_FILTER_PARAMS[key] + '=' + encodeURIComponent(filter[key])).join('');
+}
+
+function setMapFilter(key, value) {
+    if (value === '' || value === false || value === null) {
+        delete mapFilter[key];
+    } else {
+        mapFilter[key] = String(value);
+    }
+    if (key === 'dist' && !mapFilter.dist) delete mapFilter.near;
+    writeMapFilterHash();
+    applyMapFilter();
+}
+
+function toggleMapFilterClass(cls) {
+    const classes = new Set((mapFilter.class || '').split(',').filter(c => c));
+    classes.has(cls) ? classes.delete(cls) : classes.add(cls);
+    setMapFilter('class', MAP_CLASSES.filter(c => classes.has(c)).join(','));
+}
+
+function clearMapFilter() {
+    mapFilter = {};
+    writeMapFilterHash();
+    applyMapFilter();
+}
+
+function applyMapFilter() {
+    renderMapFilterPanel();
+    fetchMap(mapLOD).then(rebuildMapContent);
+}
+
+function toggleMapFilterPanel() {
+    document.getElementById('map-filters').classList.toggle('open');
+}
+
+// renderMapFilterPanel shows the current filter in the panel's inputs
+function renderMapFilterPanel() {
+    const panel = document.getElementById('map-filters');
+    if (!panel) return;
+    const classes = (mapFilter.class || '').split(',');
+    panel.querySelectorAll('[data-class]').forEach(btn => {
+        btn.classList.toggle('active', classes.includes(btn.dataset.class));
+    });
+    document.getElementById('filter-verified').checked = mapFilter.verified === 'true';
+    const within = document.getElementById('filter-within');
+    if (mapFilter.within && !Array.from(within.options).some(o => o.value === mapFilter.within)) {
+        within.add(new Option(mapFilter.within, mapFilter.within));
+    }
+    within.value = mapFilter.within || '';
+    document.getElementById('filter-name').value = mapFilter.name || '';
+    document.getElementById('filter-dist').value = mapFilter.dist || '';
+    document.getElementById('filter-near').textContent = mapFilter.near ? '(' + mapFilter.near.split(',').map(v => Math.round(+v)).join(', ') + ')' : 'you';
+    document.getElementById('filter-btn').classList.toggle('active', hasMapFilter());
+}
+
+// Someone pasted a shared link into this tab
+window.addEventListener('hashchange', () => {
+    mapFilter = readMapFilterHash();
+    applyMapFilter();
+});
+
+// searchMap centers the map on the first system whose name or UUID starts with query
+// Systems not drawn on their own (clustered or filtered out) are looked up on the server
+async function searchMap(query) {
+    const input = document.getElementById('map-search');
+    const q = query.trim().toLowerCase();
+    if (!q || !controls) return;
+
+    let found = [selfSystem, ...currentKnownSystems].find(s => s.name.toLowerCase().startsWith(q) || s.id.startsWith(q));
+    for (const param of ['name_prefix', 'id_prefix']) {
+        if (found) break;
+        try {
+            const resp = await fetch('/api/known-systems?' + param + '=' + encodeURIComponent(q));
+            const matches = resp.ok ? await resp.json() : [];
+            if (matches && matches.length) found = toMapSystem(matches[0], matches[0].learned_at);
+        } catch (e) {
+            console.error('Failed to search systems:', e);
+        }
+    }
+
+    input.classList.toggle('not-found', !found);
+    if (!found) return;
+
+    const target = new THREE.Vector3(found.x, found.y, found.z);
+    controls.target.copy(target);
+    camera.position.set(target.x + 420, target.y + 300, target.z + 420);
+    controls.update();
+    markMapInteraction();
+
+    if (searchRing) scene.remove(searchRing);
+    searchRing = createPulseRing(found, SEARCH_RING_COLOR);
+    searchPulseTime = 0;
+    scene.add(searchRing);
+}
+
+// createPulseRing makes the expanding ring drawn around ourselves (and search results)
+function createPulseRing(sys, color) {
+    const ringGeometry = new THREE.RingGeometry(18, 22, 32);
+    const ringMaterial = new THREE.MeshBasicMaterial({
+        color: color,
+        transparent: true,
+        opacity: 0.6,
+        side: THREE.DoubleSide
+    });
+    const ring = new THREE.Mesh(ringGeometry, ringMaterial);
+    ring.position.set(sys.x, sys.y, sys.z);
+    ring.userData = { startScale: 1, maxScale: 3.5 };
+    return ring;
+}
+
+// pulseRing draws a ring at a point of its cycle (0 to 1), facing the camera
+function pulseRing(ring, cycle) {
+    const scale = 1 + cycle * 2.5; // 1 to 3.5
+    const opacity = 0.6 * (1 - cycle); // 0.6 to 0
+    ring.scale.set(scale, scale, 1);
+    ring.material.opacity = opacity;
+    ring.lookAt(camera.position);
+}
+
+function lodForDistance(distance) {
+    const lod = Math.round(Math.log2(MAP_LOD_BASE_DISTANCE / distance));
+    return Math.max(0, Math.min(MAX_MAP_LOD, lod));
+}
+
+// Track user interaction to avoid disrupting browsing
+let lastMapInteraction = 0;
+const MAP_INTERACTION_COOLDOWN = 60000; // Don't refresh map for 60s after interaction
+
+function markMapInteraction() {
+    lastMapInteraction = Date.now();
+}
+
+function isUserBrowsingMap() {
+    return (Date.now() - lastMapInteraction) < MAP_INTERACTION_COOLDOWN;
+}
+
+async function fetchConnections() {
+    try {
+        const resp = await fetch('/api/connections');
+        cachedConnections = await resp.json() || [];
+    } catch (e) {
+        console.error('Failed to fetch connections:', e);
+        cachedConnections = [];
+    }
+}
+
+function hexToRgb(hex) {
+    const result = /^#?([a-f\d]{2})([a-f\d]{2})([a-f\d]{2})$/i.exec(hex);
+    return result ? {
+        r: parseInt(result[1], 16) / 255,
+        g: parseInt(result[2], 16) / 255,
+        b: parseInt(result[3], 16) / 255
+    } : { r: 1, g: 1, b: 1 };
+}
+
+// Companion glows sit off-center and smaller, like the dots on the System Information card
+const companionOffsets = [{ x: 48, y: 20, r: 13 }, { x: 17, y: 47, r: 10 }];
+
+function createStarSprite(color, size, isSelf, isCached, starClass, companions) {
+    const canvas = document.createElement('canvas');
+    canvas.width = 64;
+    canvas.height = 64;
+    const ctx = canvas.getContext('2d');
+
+    // Special rendering for black holes (Class X)
+    if (starClass === 'X') {
+        // Outer accretion disk glow
+        const outerGlow = ctx.createRadialGradient(32, 32, 20, 32, 32, 32);
+        outerGlow.addColorStop(0, 'rgba(139, 92, 246, 0)');
+        outerGlow.addColorStop(0.3, 'rgba(139, 92, 246, 0.4)');
+        outerGlow.addColorStop(0.6, 'rgba(99, 102, 241, 0.6)');
+        outerGlow.addColorStop(0.8, 'rgba(167, 139, 250, 0.3)');
+        outerGlow.addColorStop(1, 'rgba(0, 0, 0, 0)');
+        ctx.fillStyle = outerGlow;
+        ctx.fillRect(0, 0, 64, 64);
+
+        // Inner ring (accretion disk edge)
+        ctx.beginPath();
+        ctx.arc(32, 32, 16, 0, Math.PI * 2);
+        ctx.strokeStyle = 'rgba(167, 139, 250, 0.8)';
+        ctx.lineWidth = 3;
+        ctx.stroke();
+
+        // Dark center
+        const darkCenter = ctx.createRadialGradient(32, 32, 0, 32, 32, 14);
+        darkCenter.addColorStop(0, 'rgba(0, 0, 0, 1)');
+        darkCenter.addColorStop(0.7, 'rgba(10, 5, 20, 1)');
+        darkCenter.addColorStop(1, 'rgba(30, 15, 50, 0.8)');
+        ctx.fillStyle = darkCenter;
+        ctx.beginPath();
+        ctx.arc(32, 32, 14, 0, Math.PI * 2);
+        ctx.fill();
+
+        const texture = new THREE.CanvasTexture(canvas);
+        const material = new THREE.SpriteMaterial({ 
+            map: texture, 
+            transparent: true,
+            blending: THREE.AdditiveBlending
+        });
+        const sprite = new THREE.Sprite(material);
+        sprite.scale.set(size * 1.5, size * 1.5, 1); // Black holes render larger
+        return sprite;
+    }
+
+    const gradient = ctx.createRadialGradient(32, 32, 0, 32, 32, 32);
+    let rgb = hexToRgb(color);
+
+    // For cached (non-live) systems, desaturate and add reddish tint
+    if (isCached && !isSelf) {
+        const avg = (rgb.r + rgb.g + rgb.b) / 3;
+        rgb.r = avg * 0.6 + 0.4; // Push toward red
+        rgb.g = avg * 0.4;
+        rgb.b = avg * 0.4;
+    }
+
+    const colorStr = 'rgb(' + Math.floor(rgb.r*255) + ',' + Math.floor(rgb.g*255) + ',' + Math.floor(rgb.b*255) + ')';
+
+    gradient.addColorStop(0, isCached && !isSelf ? 'rgba(255,200,200,0.8)' : 'rgba(255,255,255,1)');
+    gradient.addColorStop(0.1, colorStr);
+    gradient.addColorStop(0.4, colorStr.replace('rgb', 'rgba').replace(')', ',' + (isCached ? '0.3' : '0.6') + ')'));
+    gradient.addColorStop(1, 'rgba(0,0,0,0)');
+
+    ctx.fillStyle = gradient;
+    ctx.fillRect(0, 0, 64, 64);
+
+    (companions || []).slice(0, companionOffsets.length).forEach((c, i) => {
+        const o = companionOffsets[i];
+        const crgb = hexToRgb(c.color);
+        const cStr = Math.floor(crgb.r*255) + ',' + Math.floor(crgb.g*255) + ',' + Math.floor(crgb.b*255);
+        const glow = ctx.createRadialGradient(o.x, o.y, 0, o.x, o.y, o.r);
+        glow.addColorStop(0, 'rgba(255,255,255,' + (isCached ? '0.6' : '0.9') + ')');
+        glow.addColorStop(0.25, 'rgba(' + cStr + ',' + (isCached ? '0.5' : '0.9') + ')');
+        glow.addColorStop(1, 'rgba(' + cStr + ',0)');
+        ctx.fillStyle = glow;
+        ctx.beginPath();
+        ctx.arc(o.x, o.y, o.r, 0, Math.PI * 2);
+        ctx.fill();
+    });
+
+    const texture = new THREE.CanvasTexture(canvas);
+    const material = new THREE.SpriteMaterial({ 
+        map: texture, 
+        transparent: true,
+        blending: THREE.AdditiveBlending,
+        opacity: isCached && !isSelf ? 0.6 : 1.0
+    });
+    const sprite = new THREE.Sprite(material);
+    sprite.scale.set(size, size, 1);
+    return sprite;
+}
+
+function calculateDistance(sys1, sys2) {
+    const dx = sys1.x - sys2.x;
+    const dy = sys1.y - sys2.y;
+    const dz = sys1.z - sys2.z;
+    return Math.sqrt(dx*dx + dy*dy + dz*dz);
+}
+
+function centerOnSelf() {
+    if (!controls || !camera) return;
+
+    const targetPos = new THREE.Vector3(selfSystem.x, selfSystem.y, selfSystem.z);
+    controls.target.copy(targetPos);
+
+    // Position camera at a nice viewing angle
+    const distance = 800;
+    camera.position.set(
+        targetPos.x + distance * 0.7,
+        targetPos.y + distance * 0.5,
+        targetPos.z + distance * 0.7
+    );
+    controls.update();
+}
+
+function centerOnGenesis() {
+    if (!controls || !camera) return;
+
+    // Genesis is always at 0,0,0
+    const targetPos = new THREE.Vector3(0, 0, 0);
+    controls.target.copy(targetPos);
+
+    // Position camera at a nice viewing angle
+    const distance = 1500;
+    camera.position.set(
+        distance * 0.7,
+        distance * 0.5,
+        distance * 0.7
+    );
+    controls.update();
+}
+
+function clearMapContent() {
+    // Remove existing stars
+    starMeshes.forEach(mesh => scene.remove(mesh));
+    starMeshes = [];
+
+    // Remove self ring
+    if (selfRing) {
+        scene.remove(selfRing);
+        selfRing = null;
+    }
+
+    // Remove connection lines
+    connectionLines.forEach(line => scene.remove(line));
+    connectionLines = [];
+    connectionBundles.forEach(bundle => scene.remove(bundle));
+    connectionBundles = [];
+    lineageLines.forEach(line => scene.remove(line));
+    lineageLines = [];
+
+    // Clear labels
+    labelElements.forEach(item => item.element.remove());
+    labelElements = [];
+}
+
+function rebuildMapContent() {
+    if (!scene || !labelsContainer) return;
+
+    clearMapContent();
+
+    const view = mapView();
+    const allSystems = [selfSystem, ...view.systems];
+    systemById = {};
+    allSystems.forEach(s => { systemById[s.id] = s; });
+
+    // Add stars
+    allSystems.forEach(sys => {
+        const isSelf = sys.id === selfSystem.id;
+        const isLive = view.liveIDs.has(sys.id);
+        const isCached = !isSelf && !isLive;
+        const size = isSelf ? 40 : (isLive ? 28 : 22);
+        const star = createStarSprite(sys.color || '#ffffff', size, isSelf, isCached, sys.starClass, sys.companions);
+        star.position.set(sys.x, sys.y, sys.z);
+        star.userData = { system: sys, isSelf: isSelf, isLive: isLive, isCached: isCached };
+        scene.add(star);
+        starMeshes.push(star);
+
+        // Add ring pulse effect for self
+        if (isSelf) {
+            selfRing = createPulseRing(sys, 0x60a5fa);
+            scene.add(selfRing);
+        }
+
+        // Create HTML label
+        const label = document.createElement('div');
+        const isNew = !isSelf && isNewSystem(sys.learnedAt);
+        label.innerHTML = escapeHTML(sys.name) + (isNew ? ' <span style="background:#22c55e;color:#000;font-size:9px;padding:1px 4px;border-radius:3px;margin-left:4px;">NEW</span>' : '');
+        label.style.cssText = 'position:absolute;font-size:11px;white-space:nowrap;transform:translateX(-50%);';
+        if (isSelf) {
+            label.style.color = '#60a5fa';
+            label.style.fontWeight = '500';
+        } else if (isLive) {
+            label.style.color = '#4ade80';
+        } else {
+            label.style.color = '#666';
+        }
+        const note = peerAnnotations[sys.id];
+        if (note && note.color) label.style.color = note.color;
+        labelsContainer.appendChild(label);
+        labelElements.push({ element: label, position: star.position, isSelf: isSelf });
+    });
+
+    // Clusters: one sprite per group, growing with the number of systems in it
+    (view.clusters || []).forEach(cluster => {
+        const size = Math.min(90, 24 + Math.log2(cluster.count) * 10);
+        const sprite = createStarSprite(cluster.color || '#ffffff', size, false, false, cluster.star_class);
+        sprite.position.set(cluster.x, cluster.y, cluster.z);
+        sprite.userData = { cluster: cluster };
+        scene.add(sprite);
+        starMeshes.push(sprite);
+
+        const label = document.createElement('div');
+        label.textContent = cluster.count + ' systems';
+        label.style.cssText = 'position:absolute;font-size:10px;white-space:nowrap;transform:translateX(-50%);color:#888;';
+        labelsContainer.appendChild(label);
+        labelElements.push({ element: label, position: sprite.position, isSelf: false });
+    });
+
+    // Build connection count per system
+    connectionCounts = {};
+    if (view.connections) {
+        view.connections.forEach(conn => {
+            connectionCounts[conn.from_id] = (connectionCounts[conn.from_id] || 0) + 1;
+            connectionCounts[conn.to_id] = (connectionCounts[conn.to_id] || 0) + 1;
+        });
+    }
+
+    // Add connection lines - ONLY show our direct peer connections by default
+    // Other connections are shown on hover
+    // Each pair is drawn once, with the better evidence of its two directions
+    const pairs = new Map();
+    (view.connections || []).forEach(conn => {
+        const edgeKey = [conn.from_id, conn.to_id].sort().join(':');
+        const pair = pairs.get(edgeKey);
+        if (!pair) {
+            pairs.set(edgeKey, Object.assign({}, conn));
+            return;
+        }
+        pair.reciprocal = pair.reciprocal || conn.reciprocal;
+        pair.strength = Math.max(edgeStrength(pair), edgeStrength(conn));
+        pair.last_evidence = Math.max(pair.last_evidence || 0, conn.last_evidence || 0);
+    });
+    const curved = pairs.size >= EDGE_CURVE_MIN_EDGES;
+    Array.from(pairs.keys()).sort().forEach(edgeKey => {
+        const conn = pairs.get(edgeKey);
+        const from = systemById[conn.from_id];
+        const to = systemById[conn.to_id];
+        if (!from || !to) return;
+
+        // Only draw lines involving ourselves (direct peers)
+        const involvesUs = conn.from_id === selfSystem.id || conn.to_id === selfSystem.id;
+
+        const reciprocal = !!conn.reciprocal;
+        const strength = edgeStrength(conn);
+        const color = edgeColor(reciprocal ? 0x64c8ff : 0xffaa44, conn.last_evidence);
+        const points = curved ? edgeCurve(from, to).getPoints(EDGE_CURVE_SEGMENTS) : [
+            new THREE.Vector3(from.x, from.y, from.z),
+            new THREE.Vector3(to.x, to.y, to.z)
+        ];
+        const geometry = new THREE.BufferGeometry().setFromPoints(points);
+
+        let line;
+        if (reciprocal) {
+            const material = new THREE.LineBasicMaterial({
+                color: color,
+                transparent: true,
+                opacity: involvesUs ? 0.5 * strength : 0
+            });
+            line = new THREE.Line(geometry, material);
+        } else {
+            const material = new THREE.LineDashedMaterial({
+                color: color,
+                transparent: true,
+                opacity: involvesUs ? 0.4 * strength : 0,
+                dashSize: 30,
+                gapSize: 20
+            });
+            line = new THREE.Line(geometry, material);
+            line.computeLineDistances();
+        }
+        line.userData = {
+            fromId: conn.from_id,
+            toId: conn.to_id,
+            reciprocal: reciprocal,
+            involvesUs: involvesUs,
+            strength: strength,
+            lastEvidence: conn.last_evidence,
+            baseColor: color.getHex(),
+            baseOpacity: involvesUs ? (reciprocal ? 0.5 : 0.4) * strength : 0
+        };
+        scene.add(line);
+        connectionLines.push(line);
+    });
+    if (curved) bundleConnections();
+
+    drawLineage();
+}
+
+// edgeCurve is the curve an edge is drawn along: a quadratic bending off the straight
+// line, to the same side whichever way round the two ends are given
+function edgeCurve(from, to) {
+    if (from.id && to.id && from.id > to.id) [from, to] = [to, from];
+    const a = new THREE.Vector3(from.x, from.y, from.z);
+    const b = new THREE.Vector3(to.x, to.y, to.z);
+    const dir = b.clone().sub(a);
+    let side = new THREE.Vector3(0, 1, 0).cross(dir);
+    if (side.lengthSq() < 1e-6) side = new THREE.Vector3(1, 0, 0).cross(dir);
+    side.setLength(dir.length() * EDGE_CURVE_BEND);
+    const control = a.clone().add(b).multiplyScalar(0.5).add(side);
+    return new THREE.QuadraticBezierCurve3(a, control, b);
+}
+
+function edgeRegion(sys) {
+    return [sys.x, sys.y, sys.z].map(v => Math.floor(v / EDGE_BUNDLE_REGION)).join(',');
+}
+
+// bundleConnections replaces the visible edges between each two regions holding two or
+// more of them with one tube from the average of their ends to the average of the others
+function bundleConnections() {
+    const groups = new Map();
+    connectionLines.forEach(line => {
+        if (!line.userData.baseOpacity) return;
+        const ends = [systemById[line.userData.fromId], systemById[line.userData.toId]];
+        const regions = ends.map(edgeRegion);
+        if (regions[0] === regions[1]) return;
+        if (regions[0] > regions[1]) {
+            ends.reverse();
+            regions.reverse();
+        }
+        const key = regions.join('|');
+        if (!groups.has(key)) groups.set(key, []);
+        groups.get(key).push({ line: line, ends: ends });
+    });
+
+    Array.from(groups.keys()).sort().forEach(key => {
+        const group = groups.get(key);
+        if (group.length < 2) return;
+        const center = i => {
+            const p = { x: 0, y: 0, z: 0 };
+            group.forEach(m => {
+                p.x += m.ends[i].x / group.length;
+                p.y += m.ends[i].y / group.length;
+                p.z += m.ends[i].z / group.length;
+            });
+            return p;
+        };
+        const members = new Set();
+        let strength = 0;
+        let lastEvidence = 0;
+        group.forEach(m => {
+            members.add(m.line.userData.fromId);
+            members.add(m.line.userData.toId);
+            strength += m.line.userData.strength / group.length;
+            lastEvidence = Math.max(lastEvidence, m.line.userData.lastEvidence || 0);
+            // Shown again only while one of its ends is hovered
+            m.line.userData.baseOpacity = 0;
+            m.line.material.opacity = 0;
+        });
+        const reciprocal = group.every(m => m.line.userData.reciprocal);
+        const baseOpacity = 0.45 * strength;
+        const radius = 2 + 2 * Math.log2(group.length);
+        const bundle = new THREE.Mesh(
+            new THREE.TubeGeometry(edgeCurve(center(0), center(1)), EDGE_CURVE_SEGMENTS, radius, 6, false),
+            new THREE.MeshBasicMaterial({
+                color: edgeColor(reciprocal ? 0x64c8ff : 0xffaa44, lastEvidence),
+                transparent: true,
+                opacity: baseOpacity,
+                depthWrite: false
+            }));
+        bundle.userData = { members: members, count: group.length, baseOpacity: baseOpacity };
+        scene.add(bundle);
+        connectionBundles.push(bundle);
+    });
+}
+
+// edgeStrength maps a connection's server-side strength (0-1) to an opacity factor,
+// never fading a line out entirely; connections without one (history frames) count as full
+function edgeStrength(conn) {
+    if (typeof conn.strength !== 'number') return 1;
+    return 0.2 + 0.8 * Math.min(1, Math.max(0, conn.strength));
+}
+
+// edgeColor greys a connection's color as its newest evidence ages towards an hour old
+function edgeColor(hex, lastEvidence) {
+    const color = new THREE.Color(hex);
+    if (!lastEvidence) return color;
+    const age = Math.min(1, Math.max(0, (Date.now() / 1000 - lastEvidence) / 3600));
+    return color.lerp(new THREE.Color(0x6b7280), age * 0.8);
+}
+
+// drawLineage tints the systems in the shown lineage and links each to its sponsor
+// with a faint dotted line (connections are solid or long-dashed)
+function drawLineage() {
+    if (!lineage) return;
+    const members = new Set();
+    const walk = (node, parent) => {
+        members.add(node.id);
+        const from = parent && systemById[parent.id];
+        const to = systemById[node.id];
+        if (from && to) {
+            const geometry = new THREE.BufferGeometry().setFromPoints([
+                new THREE.Vector3(from.x, from.y, from.z),
+                new THREE.Vector3(to.x, to.y, to.z)
+            ]);
+            const line = new THREE.Line(geometry, new THREE.LineDashedMaterial({
+                color: LINEAGE_COLOR,
+                transparent: true,
+                opacity: 0.35,
+                dashSize: 6,
+                gapSize: 12
+            }));
+            line.computeLineDistances();
+            scene.add(line);
+            lineageLines.push(line);
+        }
+        node.children.forEach(child => walk(child, node));
+    };
+    walk(lineage.root, null);
+
+    starMeshes.forEach(star => {
+        if (star.userData.system && members.has(star.userData.system.id)) {
+            star.material.color.setHex(LINEAGE_COLOR);
+        }
+    });
+}
+
+async function showLineage(systemId) {
+    try {
+        const resp = await fetch('/api/constellation/' + systemId);
+        if (!resp.ok) throw new Error(await resp.text());
+        lineage = await resp.json();
+    } catch (e) {
+        console.error('Failed to fetch lineage:', e);
+        return;
+    }
+    document.getElementById('lineage-btn').classList.add('active');
+    rebuildMapContent();
+}
+
+function toggleLineage() {
+    if (lineage) {
+        lineage = null;
+        document.getElementById('lineage-btn').classList.remove('active');
+        rebuildMapContent();
+        return;
+    }
+    showLineage(selfSystem.id);
+}
+
+async function initGalaxyMap() {
+    const container = document.getElementById('galaxy-map');
+    if (!container) return;
+
+    const width = container.clientWidth;
+    const height = container.clientHeight;
+    if (width === 0 || height === 0) {
+        setTimeout(initGalaxyMap, 100);
+        return;
+    }
+
+    // Fetch connections and the galaxy itself
+    await fetchConnections();
+    await fetchMap(0);
+
+    // Scene
+    scene = new THREE.Scene();
+
+    // Camera
+    camera = new THREE.PerspectiveCamera(60, width / height, 1, 50000);
+
+    // Renderer
+    renderer = new THREE.WebGLRenderer({ antialias: true, alpha: true });
+    renderer.setSize(width, height);
+    renderer.setPixelRatio(Math.min(window.devicePixelRatio, 2));
+    container.appendChild(renderer.domElement);
+
+    // Controls
+    controls = new THREE.OrbitControls(camera, renderer.domElement);
+    controls.enableDamping = true;
+    controls.dampingFactor = 0.05;
+    controls.minDistance = 100;
+    controls.maxDistance = 15000;
+    controls.panSpeed = 0.8;
+    controls.rotateSpeed = 0.6;
+
+    // Add controls UI
+    const controlsDiv = document.createElement('div');
+    controlsDiv.className = 'map-controls';
+    controlsDiv.innerHTML = '<input type="text" class="map-search" id="map-search" placeholder="Find system by name or ID" onkeydown="if (event.key === \'Enter\') searchMap(this.value)" oninput="this.classList.remove(\'not-found\')">' +
+        '<button class="map-btn" id="filter-btn" onclick="toggleMapFilterPanel()">⚲ Filter</button>' +
+        '<button class="map-btn" onclick="centerOnSelf()">⌂ Home</button><button class="map-btn" onclick="centerOnGenesis()">✦ Genesis</button><button class="map-btn" onclick="openHistory()">⟲ History</button>' +
+        (publicMode ? '' : '<button class="map-btn" id="lineage-btn" onclick="toggleLineage()">⚘ Lineage</button>');
+    container.appendChild(controlsDiv);
+
+    // Add filter panel (opened with Filter)
+    const filters = document.createElement('div');
+    filters.className = 'map-filters';
+    filters.id = 'map-filters';
+    filters.innerHTML =
+        '<div>Star class</div>' +
+        '<div class="filter-classes">' + MAP_CLASSES.map(c => '<button class="map-btn" data-class="' + c + '" onclick="toggleMapFilterClass(\'' + c + '\')">' + c + '</button>').join('') + '</div>' +
+        '<label><input type="checkbox" id="filter-verified" onchange="setMapFilter(\'verified\', this.checked)"> Verified only</label>' +
+        '<label>Learned within <select id="filter-within" onchange="setMapFilter(\'within\', this.value)">' +
+            '<option value="">any time</option><option value="1h">1 hour</option><option value="24h">24 hours</option><option value="7d">7 days</option><option value="30d">30 days</option>' +
+        '</select></label>' +
+        '<label>Name starts with <input type="text" id="filter-name" size="12" onchange="setMapFilter(\'name\', this.value.trim())"></label>' +
+        '<label>Within <input type="number" id="filter-dist" min="1" step="100" onchange="setMapFilter(\'dist\', this.value > 0 ? this.value : \'\')"> units of <span id="filter-near">you</span></label>' +
+        '<button class="map-btn" onclick="clearMapFilter()">Clear filters</button>';
+    container.appendChild(filters);
+    renderMapFilterPanel();
+
+    // Add history time slider (hidden until History is clicked)
+    const timeline = document.createElement('div');
+    timeline.className = 'map-timeline';
+    timeline.id = 'map-timeline';
+    timeline.innerHTML =
+        '<button class="map-btn" id="timeline-play" onclick="toggleHistoryPlayback()">▶</button>' +
+        '<input type="range" id="timeline-slider" min="0" max="0" value="0" oninput="stopHistoryPlayback(); showHistoryFrame(+this.value)">' +
+        '<span class="timeline-label" id="timeline-label"></span>' +
+        '<button class="map-btn" onclick="closeHistory()">Live</button>';
+    container.appendChild(timeline);
+
+    // Add legend
+    const legend = document.createElement('div');
+    legend.style.cssText = 'position:absolute;top:10px;left:10px;background:rgba(0,0,0,0.7);border:1px solid rgba(255,255,255,0.1);border-radius:6px;padding:8px 12px;font-size:11px;z-index:100;';
+    legend.innerHTML = 
+        '<div style="margin-bottom:6px;color:#888;font-weight:500;">Legend</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#60a5fa;">●</span> You</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#4ade80;">●</span> Live peers</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#996666;">●</span> Cached</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#64c8ff;">―</span> Your connections</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#64c8ff;font-weight:bold;">━</span> Bundled (hover an end)</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;margin-bottom:4px;"><span style="color:#fbbf24;">┄</span> Sponsor lineage</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;color:#666;font-size:10px;">Hover to see other connections</div>' +
+        '<div style="display:flex;align-items:center;gap:6px;color:#666;font-size:10px;">With Lineage on, click a system for its own</div>' +
+        (publicMode ? '' : '<div style="display:flex;align-items:center;gap:6px;color:#666;font-size:10px;">Click a cached system to connect to it</div>');
+    container.appendChild(legend);
+
+    // Add connect panel (opened by clicking a cached system)
+    const systemPanel = document.createElement('div');
+    systemPanel.className = 'map-system-panel';
+    systemPanel.id = 'map-system-panel';
+    container.appendChild(systemPanel);
+
+    // Add tooltip
+    const tooltip = document.createElement('div');
+    tooltip.className = 'map-tooltip';
+    tooltip.id = 'map-tooltip';
+    container.appendChild(tooltip);
+
+    // Add hint
+    const hint = document.createElement('div');
+    hint.className = 'map-hint';
+    hint.textContent = 'Left-drag: rotate • Right-drag: pan • Scroll: zoom';
+    container.appendChild(hint);
+
+    // Labels container
+    labelsContainer = document.createElement('div');
+    labelsContainer.style.cssText = 'position:absolute;top:0;left:0;width:100%;height:100%;pointer-events:none;overflow:hidden;';
+    container.appendChild(labelsContainer);
+
+    // Build initial map content (stars, connections, labels)
+    rebuildMapContent();
+
+    // Add subtle starfield background
+    const starfieldGeo = new THREE.BufferGeometry();
+    const starfieldCount = 2000;
+    const starfieldPositions = new Float32Array(starfieldCount * 3);
+    for (let i = 0; i < starfieldCount * 3; i += 3) {
+        starfieldPositions[i] = (Math.random() - 0.5) * 30000;
+        starfieldPositions[i+1] = (Math.random() - 0.5) * 30000;
+        starfieldPositions[i+2] = (Math.random() - 0.5) * 30000;
+    }
+    starfieldGeo.setAttribute('position', new THREE.BufferAttribute(starfieldPositions, 3));
+    const starfieldMat = new THREE.PointsMaterial({ color: 0x444466, size: 2, transparent: true, opacity: 0.5 });
+    const starfield = new THREE.Points(starfieldGeo, starfieldMat);
+    scene.add(starfield);
+
+    // Center on self initially
+    centerOnSelf();
+
+    // Raycaster for hover
+    const raycaster = new THREE.Raycaster();
+    raycaster.params.Sprite = { threshold: 20 };
+    const mouse = new THREE.Vector2();
+    let hoveredSystemId = null;
+
+    // Planets are derived from the UUID server-side; fetched once per system on first hover
+    const planetCache = {};
+    function planetSummary(systemId) {
+        const planets = planetCache[systemId];
+        if (planets === undefined) {
+            planetCache[systemId] = null;
+            fetch('/api/system/' + systemId + '/planets')
+                .then(r => r.ok ? r.json() : [])
+                .then(p => { planetCache[systemId] = p; })
+                .catch(() => { delete planetCache[systemId]; });
+            return 'Surveying planets...';
+        }
+        if (planets === null) return 'Surveying planets...';
+        if (planets.length === 0) return 'No planets';
+        const counts = {};
+        planets.forEach(p => { counts[p.type] = (counts[p.type] || 0) + 1; });
+        return planets.length + ' planet' + (planets.length !== 1 ? 's' : '') + ': ' +
+            Object.keys(counts).map(t => counts[t] + ' ' + t).join(', ');
+    }
+
+    function highlightConnections(systemId) {
+        connectionLines.forEach(line => {
+            const involvesHovered = systemId && (line.userData.fromId === systemId || line.userData.toId === systemId);
+
+            if (involvesHovered) {
+                // Highlight connections involving hovered system
+                line.material.opacity = (line.userData.reciprocal ? 0.8 : 0.6) * line.userData.strength;
+                if (line.userData.reciprocal) {
+                    line.material.color.setHex(0x60a5fa);
+                }
+            } else {
+                // Return to base state: only our direct connections visible
+                line.material.opacity = line.userData.baseOpacity;
+                line.material.color.setHex(line.userData.baseColor);
+            }
+        });
+        connectionBundles.forEach(bundle => {
+            bundle.material.opacity = systemId && bundle.userData.members.has(systemId) ? 0 : bundle.userData.baseOpacity;
+        });
+    }
+
+    renderer.domElement.addEventListener('mousemove', (event) => {
+        const rect = renderer.domElement.getBoundingClientRect();
+        mouse.x = ((event.clientX - rect.left) / rect.width) * 2 - 1;
+        mouse.y = -((event.clientY - rect.top) / rect.height) * 2 + 1;
+
+        raycaster.setFromCamera(mouse, camera);
+        const intersects = raycaster.intersectObjects(starMeshes);
+
+        const tooltip = document.getElementById('map-tooltip');
+        if (intersects.length > 0 && intersects[0].object.userData.cluster) {
+            const cluster = intersects[0].object.userData.cluster;
+            tooltip.innerHTML =
+                '<div class="tooltip-name">' + cluster.count + ' systems</div>' +
+                '<div class="tooltip-class">Mostly ' + escapeHTML(cluster.star_class) + '-class stars</div>' +
+                '<div class="tooltip-coords">(' + cluster.x.toFixed(1) + ', ' + cluster.y.toFixed(1) + ', ' + cluster.z.toFixed(1) + ')</div>' +
+                '<div class="tooltip-distance">' + calculateDistance(selfSystem, cluster).toFixed(1) + ' units away</div>' +
+                '<div class="tooltip-distance">Zoom in to expand</div>';
+            tooltip.style.display = 'block';
+            tooltip.style.left = (event.clientX - rect.left + 15) + 'px';
+            tooltip.style.top = (event.clientY - rect.top + 15) + 'px';
+            renderer.domElement.style.cursor = 'zoom-in';
+            if (hoveredSystemId !== null) {
+                hoveredSystemId = null;
+                highlightConnections(null);
+            }
+        } else if (intersects.length > 0) {
+            const userData = intersects[0].object.userData;
+            const sys = userData.system;
+            const isSelf = userData.isSelf;
+            const isLive = userData.isLive;
+            const distance = calculateDistance(selfSystem, sys);
+            const connCount = connectionCounts[sys.id] || 0;
+
+            let statusLabel = '';
+            if (isSelf) statusLabel = ' <span style="color:#60a5fa">(You)</span>';
+            else if (isLive) statusLabel = ' <span style="color:#4ade80">(Live)</span>';
+            else statusLabel = ' <span style="color:#888">(Cached)</span>';
+
+            const note = peerAnnotations[sys.id];
+            const nameStyle = note && note.color ? ' style="color:' + note.color + '"' : '';
+            tooltip.innerHTML = 
+                '<div class="tooltip-name"' + nameStyle + '>' + escapeHTML(sys.name) + statusLabel + '</div>' +
+                (note && note.tags.length ? '<div>' + annotationChips(note) + '</div>' : '') +
+                (note && note.note ? '<div class="tooltip-note">' + escapeHTML(note.note) + '</div>' : '') +
+                (sys.profile && sys.profile.handle ? '<div class="tooltip-operator">Operated by @' + escapeHTML(sys.profile.handle) + '</div>' : '') +
+                '<div class="tooltip-class">' + escapeHTML(starLabel(sys)) + '</div>' +
+                '<div class="tooltip-coords">(' + sys.x.toFixed(1) + ', ' + sys.y.toFixed(1) + ', ' + sys.z.toFixed(1) + ')</div>' +
+                '<div class="tooltip-distance" style="color:#64c8ff;">' + connCount + ' connection' + (connCount !== 1 ? 's' : '') + '</div>' +
+                '<div class="tooltip-distance">' + planetSummary(sys.id) + '</div>' +
+                (isSelf ? '' : '<div class="tooltip-distance">' + distance.toFixed(1) + ' units away</div>');
+            tooltip.style.display = 'block';
+            tooltip.style.left = (event.clientX - rect.left + 15) + 'px';
+            tooltip.style.top = (event.clientY - rect.top + 15) + 'px';
+            renderer.domElement.style.cursor = 'pointer';
+
+            // Highlight connections
+            if (hoveredSystemId !== sys.id) {
+                hoveredSystemId = sys.id;
+                highlightConnections(sys.id);
+            }
+        } else {
+            tooltip.style.display = 'none';
+            renderer.domElement.style.cursor = 'grab';
+            if (hoveredSystemId !== null) {
+                hoveredSystemId = null;
+                highlightConnections(null);
+            }
+        }
+    });
+
+    // Clicking a system shows its lineage with the lineage overlay on, and otherwise opens
+    // the connect panel for a cached one (drags don't count)
+    let pointerDownAt = null;
+    renderer.domElement.addEventListener('pointerdown', (event) => {
+        pointerDownAt = { x: event.clientX, y: event.clientY };
+    });
+    renderer.domElement.addEventListener('click', (event) => {
+        if (!pointerDownAt) return;
+        if (Math.abs(event.clientX - pointerDownAt.x) + Math.abs(event.clientY - pointerDownAt.y) > 4) return;
+        const rect = renderer.domElement.getBoundingClientRect();
+        mouse.x = ((event.clientX - rect.left) / rect.width) * 2 - 1;
+        mouse.y = -((event.clientY - rect.top) / rect.height) * 2 + 1;
+        raycaster.setFromCamera(mouse, camera);
+        const hit = raycaster.intersectObjects(starMeshes).find(i => i.object.userData.system);
+        if (lineage) {
+            if (hit) showLineage(hit.object.userData.system.id);
+            return;
+        }
+        if (hit && hit.object.userData.isCached && !publicMode && !historyState) {
+            openSystemPanel(hit.object.userData.system);
+        } else {
+            closeSystemPanel();
+        }
+    });
+
+    // Animation loop
+    function animate() {
+        requestAnimationFrame(animate);
+        controls.update();
+
+        // Animate ring pulse for self
+        if (selfRing) {
+            ringPulseTime += 0.0032; // ~5 second cycle at 60fps
+            pulseRing(selfRing, ringPulseTime % 1);
+        }
+
+        // Search result rings pulse faster, and only a few times
+        if (searchRing) {
+            searchPulseTime += 0.01; // ~1.7 second cycle at 60fps
+            if (searchPulseTime >= SEARCH_PULSES) {
+                scene.remove(searchRing);
+                searchRing = null;
+            } else {
+                pulseRing(searchRing, searchPulseTime % 1);
+            }
+        }
+
+        // Update label positions
+        const widthHalf = width / 2;
+        const heightHalf = height / 2;
+        labelElements.forEach(item => {
+            const pos = item.position.clone();
+            pos.project(camera);
+
+            // Check if in front of camera
+            if (pos.z < 1) {
+                item.element.style.display = 'block';
+                item.element.style.left = (pos.x * widthHalf + widthHalf) + 'px';
+                item.element.style.top = (-pos.y * heightHalf + heightHalf + 15) + 'px';
+            } else {
+                item.element.style.display = 'none';
+            }
+        });
+
+        renderer.render(scene, camera);
+    }
+    animate();
+
+    // Handle resize
+    window.addEventListener('resize', () => {
+        const w = container.clientWidth;
+        const h = container.clientHeight;
+        camera.aspect = w / h;
+        camera.updateProjectionMatrix();
+        renderer.setSize(w, h);
+    });
+}
+
+document.addEventListener('DOMContentLoaded', initGalaxyMap);
+
+// === Galaxy history playback ===
+
+async function openHistory() {
+    const label = document.getElementById('timeline-label');
+    document.getElementById('map-timeline').style.display = 'flex';
+    label.textContent = 'Loading history...';
+
+    let frames = [];
+    try {
+        const resp = await fetch('/api/history');
+        frames = (await resp.json()).frames || [];
+    } catch (e) {
+        console.error('Failed to fetch galaxy history:', e);
+    }
+    if (frames.length === 0) {
+        label.textContent = 'No history recorded yet';
+        return;
+    }
+
+    historyFrames = frames;
+    const slider = document.getElementById('timeline-slider');
+    slider.max = frames.length - 1;
+    slider.value = 0;
+    showHistoryFrame(0);
+}
+
+// Replay frames up to index into the shape rebuildMapContent draws
+function historyStateAt(index) {
+    const systems = new Map();
+    const edges = new Set();
+    const routing = new Set();
+    for (let i = 0; i <= index; i++) {
+        const f = historyFrames[i];
+        if (f.keyframe) {
+            systems.clear();
+            edges.clear();
+            routing.clear();
+        }
+        (f.added_systems || []).forEach(s => systems.set(s.id, s));
+        (f.removed_systems || []).forEach(id => systems.delete(id));
+        (f.added_edges || []).forEach(e => edges.add(e[0] + ':' + e[1]));
+        (f.removed_edges || []).forEach(e => edges.delete(e[0] + ':' + e[1]));
+        (f.routing_added || []).forEach(id => routing.add(id));
+        (f.routing_removed || []).forEach(id => routing.delete(id));
+    }
+    return {
+        systems: [...systems.values()].filter(s => s.id !== selfSystem.id).map(s => ({
+            id: s.id,
+            name: s.name,
+            x: s.x,
+            y: s.y,
+            z: s.z,
+            color: s.color || '#ffffff',
+            starClass: s.class || 'M',
+            starDesc: '',
+            learnedAt: 0
+        })),
+        connections: [...edges].map(key => {
+            const [from_id, to_id] = key.split(':');
+            return { from_id, to_id, reciprocal: edges.has(to_id + ':' + from_id) };
+        }),
+        liveIDs: routing
+    };
+}
+
+function showHistoryFrame(index) {
+    if (!historyFrames) return;
+    const f = historyFrames[index];
+    historyState = historyStateAt(index);
+    document.getElementById('timeline-label').textContent =
+        new Date(f.time * 1000).toLocaleString() + ' · ' + f.system_count + ' systems';
+    rebuildMapContent();
+}
+
+function toggleHistoryPlayback() {
+    if (historyTimer) {
+        stopHistoryPlayback();
+        return;
+    }
+    if (!historyFrames) return;
+
+    const slider = document.getElementById('timeline-slider');
+    if (+slider.value >= historyFrames.length - 1) {
+        slider.value = 0;
+        showHistoryFrame(0);
+    }
+    document.getElementById('timeline-play').textContent = '❚❚';
+    historyTimer = setInterval(() => {
+        const next = +slider.value + 1;
+        if (next >= historyFrames.length) {
+            stopHistoryPlayback();
+            return;
+        }
+        slider.value = next;
+        showHistoryFrame(next);
+    }, 250);
+}
+
+function stopHistoryPlayback() {
+    clearInterval(historyTimer);
+    historyTimer = null;
+    document.getElementById('timeline-play').textContent = '▶';
+}
+
+// Back to live data
+function closeHistory() {
+    stopHistoryPlayback();
+    historyFrames = null;
+    historyState = null;
+    document.getElementById('map-timeline').style.display = 'none';
+    rebuildMapContent();
+}
+
+// Connect panel: a cached system's details and a button asking the node to ping it
+let systemPanelId = null;
+
+function openSystemPanel(sys) {
+    systemPanelId = sys.id;
+    const panel = document.getElementById('map-system-panel');
+    panel.innerHTML =
+        '<div class="tooltip-name">' + escapeHTML(sys.name) + ' <span style="color:#888">(Cached)</span></div>' +
+        '<div class="tooltip-class">' + escapeHTML(starLabel(sys)) + '</div>' +
+        '<div class="tooltip-coords">(' + sys.x.toFixed(1) + ', ' + sys.y.toFixed(1) + ', ' + sys.z.toFixed(1) + ')</div>' +
+        '<div class="tooltip-distance">' + calculateDistance(selfSystem, sys).toFixed(1) + ' units away</div>' +
+        '<div class="connect-status" id="connect-status"></div>' +
+        '<div class="panel-buttons">' +
+            '<button class="map-btn" id="connect-btn" onclick="attemptConnection(\'' + sys.id + '\')">Attempt connection</button>' +
+            '<a class="map-btn" href="/peer/' + sys.id + '">Details</a>' +
+            '<button class="map-btn" onclick="closeSystemPanel()">Close</button>' +
+        '</div>';
+    panel.classList.add('open');
+}
+
+function closeSystemPanel() {
+    systemPanelId = null;
+    const panel = document.getElementById('map-system-panel');
+    if (panel) panel.classList.remove('open');
+}
+
+// attemptConnection asks the node to ping a cached system, showing each stage as the
+// response streams in; a success reaches the map as a peer_added event
+async function attemptConnection(systemId) {
+    const button = document.getElementById('connect-btn');
+    button.disabled = true;
+    showConnectStatus(systemId, 'Connecting...', '');
+    try {
+        const resp = await adminFetch('/api/peers/connect', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ system_id: systemId })
+        });
+        if (!resp.ok) {
+            showConnectStatus(systemId, (await resp.text()).trim(), 'failed');
+            return;
+        }
+        const reader = resp.body.getReader();
+        const decoder = new TextDecoder();
+        let buffered = '';
+        for (;;) {
+            const { value, done } = await reader.read();
+            if (done) break;
+            buffered += decoder.decode(value, { stream: true });
+            let nl;
+            while ((nl = buffered.indexOf('\n')) >= 0) {
+                showConnectProgress(JSON.parse(buffered.slice(0, nl)));
+                buffered = buffered.slice(nl + 1);
+            }
+        }
+    } catch (err) {
+        showConnectStatus(systemId, err.message, 'failed');
+    } finally {
+        button.disabled = false;
+    }
+}
+
+function showConnectProgress(p) {
+    switch (p.stage) {
+        case 'pinging':
+            showConnectStatus(p.system_id, 'Pinging ' + p.peer_address + '...', '');
+            return;
+        case 'connected':
+            showConnectStatus(p.system_id, 'Connected: now ' + p.state + (p.in_routing_table ? ' and in the routing table' : ''), 'connected');
+            break;
+        default:
+            showConnectStatus(p.system_id, 'Failed: ' + p.error, 'failed');
+    }
+    // Without the live socket there's no peer_added event, so look for it now
+    if (!liveSocket) {
+        refreshStats();
+        mapStale = true;
+    }
+}
+
+function showConnectStatus(systemId, text, outcome) {
+    if (systemPanelId !== systemId) return; // The panel moved on to another system
+    const status = document.getElementById('connect-status');
+    status.textContent = text;
+    status.className = 'connect-status' + (outcome ? ' ' + outcome : '');
+}
+
+// Convert an API system object to the galaxy map format
+function toMapSystem(s, learnedAt) {
+    return {
+        id: s.id,
+        name: s.name,
+        x: s.x,
+        y: s.y,
+        z: s.z,
+        color: s.stars?.primary?.color || '#ffffff',
+        starClass: s.stars?.primary?.class || 'M',
+        starDesc: s.stars?.primary?.description || '',
+        companions: [s.stars?.secondary, s.stars?.tertiary].filter(c => c).map(c => ({
+            color: c.color || '#ffffff',
+            starClass: c.class
+        })),
+        learnedAt: learnedAt || 0
+    };
+}
+
+// Describe a system's stars for the map tooltip, e.g. "Yellow Star + M + K"
+function starLabel(sys) {
+    const primary = sys.starDesc || sys.starClass + '-class star';
+    const companions = (sys.companions || []).map(c => c.starClass);
+    return companions.length ? primary + ' + ' + companions.join(' + ') : primary;
+}
+
+async function exportTopology() {
+    // A clustered map only holds some systems individually, so export the full list instead
+    let knownSystems = currentKnownSystems;
+    if (mapClustered) {
+        const resp = await fetch('/api/known-systems');
+        knownSystems = (await resp.json() || []).map(s => toMapSystem(s, s.learned_at));
+    }
+    const data = {
+        exported_at: new Date().toISOString(),
+        local_system: selfSystem,
+        known_systems: knownSystems,
+        connections: cachedConnections,
+        live_peer_ids: Array.from(currentLivePeerIDs)
+    };
+
+    const blob = new Blob([JSON.stringify(data, null, 2)], { type: 'application/json' });
+    const url = URL.createObjectURL(blob);
+    const a = document.createElement('a');
+    a.href = url;
+    a.download = 'stellar-topology-' + new Date().toISOString().split('T')[0] + '.json';
+    document.body.appendChild(a);
+    a.click();
+    document.body.removeChild(a);
+    URL.revokeObjectURL(url);
+}
@@ -0,0 +1,186 @@
+// Messages modal and the unread badge in the header
+
+// === Direct messages ===
+const MESSAGE_MAX_BYTES = 2048;
+const MESSAGE_TIMEOUT = 60000; // The first attempt may look the recipient up and ping it first
+let messageRecipients = [];    // Known systems, for the picker
+let messageRecipient = null;   // The picked one
+
+function setUnreadMessages(n) {
+    const el = document.getElementById('messages-unread');
+    el.textContent = n;
+    el.style.display = n > 0 ? '' : 'none';
+}
+
+async function refreshUnreadMessages() {
+    try {
+        const page = await fetch('/api/messages?limit=1').then(r => r.json());
+        setUnreadMessages(page.unread);
+    } catch (err) {
+        console.error('Failed to load messages:', err);
+    }
+}
+
+function openMessagesModal() {
+    document.getElementById('messages-modal').classList.add('open');
+    showMessageBox('inbox');
+}
+
+function closeMessagesModal() {
+    document.getElementById('messages-modal').classList.remove('open');
+}
+
+function selectMessageTab(name) {
+    ['inbox', 'sent', 'compose'].forEach(tab =>
+        document.getElementById('messages-tab-' + tab).classList.toggle('selected', tab === name));
+    document.getElementById('message-list').style.display = name === 'compose' ? 'none' : '';
+    document.getElementById('message-compose').style.display = name === 'compose' ? '' : 'none';
+}
+
+function messageAgo(t) {
+    const s = Math.max(0, Math.floor(Date.now() / 1000) - t);
+    return s < 60 ? 'just now' : s < 3600 ? Math.floor(s / 60) + 'm ago' : s < 86400 ? Math.floor(s / 3600) + 'h ago' : Math.floor(s / 86400) + 'd ago';
+}
+
+function messageStatus(m) {
+    if (m.status === 'delivered') return '<span class="recipient-live">✓ delivered</span>';
+    if (m.status === 'pending') {
+        return '<span class="transfer-pending" title="' + escapeHTML(m.last_error || '') + '">retrying (attempt ' + m.attempts + ')</span>';
+    }
+    return '<span class="transfer-sent" title="' + escapeHTML(m.last_error || '') + '">✗ undelivered</span>';
+}
+
+function renderMessage(m) {
+    const name = escapeHTML(m.peer_name || m.peer_id.substring(0, 8));
+    const received = m.direction === 'received';
+    const reply = received ? ' · <a onclick="replyToMessage(\'' + m.peer_id + '\')">Reply</a>' : '';
+    return '<div class="message-item' + (received && !m.read ? ' unread' : '') + '">' +
+        '<div class="message-meta"><span>' + (received ? 'From' : 'To') + ' <a href="/peer/' + m.peer_id + '">' + name + '</a>' + reply + '</span>' +
+        '<span class="transfer-time">' + (received ? '' : messageStatus(m) + ' · ') + messageAgo(m.sent_at) + '</span></div>' +
+        '<div class="message-body">' + escapeHTML(m.body) + '</div></div>';
+}
+
+// Shows a box; opening the inbox marks what it shows read
+async function showMessageBox(box) {
+    selectMessageTab(box);
+    const list = document.getElementById('message-list');
+    list.innerHTML = '<div class="longevity-note">Loading...</div>';
+
+    let page;
+    try {
+        page = await fetch('/api/messages?box=' + box + '&limit=50').then(r => r.json());
+    } catch (err) {
+        list.innerHTML = '<div class="modal-error">Could not load messages: ' + escapeHTML(err.message) + '</div>';
+        return;
+    }
+    setUnreadMessages(page.unread);
+    list.innerHTML = page.messages.map(renderMessage).join('') ||
+        '<div class="longevity-note">' + (box === 'inbox' ? 'No messages yet' : 'Nothing sent yet') + '</div>';
+
+    const unread = box === 'inbox' ? page.messages.filter(m => !m.read).map(m => m.id) : [];
+    if (!unread.length) return;
+    try {
+        const resp = await adminFetch('/api/messages/read', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ ids: unread })
+        });
+        if (resp.ok) setUnreadMessages((await resp.json()).unread);
+    } catch (err) {
+        console.error('Failed to mark messages read:', err);
+    }
+}
+
+async function showMessageCompose(toID) {
+    selectMessageTab('compose');
+    messageRecipient = null;
+    document.getElementById('message-search').value = '';
+    document.getElementById('message-form-error').textContent = '';
+    document.getElementById('message-recipient-list').innerHTML = '<div class="longevity-note">Loading systems...</div>';
+    try {
+        const systems = await fetch('/api/known-systems').then(r => r.json());
+        messageRecipients = (systems || []).filter(s => s.id !== selfSystem.id && s.peer_address)
+            .sort((a, b) => a.name.localeCompare(b.name));
+    } catch (err) {
+        document.getElementById('message-form-error').textContent = 'Could not load known systems: ' + err.message;
+        return;
+    }
+    messageRecipient = toID ? messageRecipients.find(s => s.id === toID) || null : null;
+    if (messageRecipient) {
+        document.getElementById('message-search').value = messageRecipient.name;
+    }
+    renderMessageRecipients();
+    validateMessageForm();
+    document.getElementById('message-body').focus();
+}
+
+function replyToMessage(peerID) {
+    document.getElementById('message-body').value = '';
+    showMessageCompose(peerID);
+}
+
+// Live systems (in the routing table) first, then cached ones, each by name
+function renderMessageRecipients() {
+    const query = document.getElementById('message-search').value.trim().toLowerCase();
+    const matches = messageRecipients.filter(s => !query || s.name.toLowerCase().includes(query))
+        .sort((a, b) => currentLivePeerIDs.has(b.id) - currentLivePeerIDs.has(a.id))
+        .slice(0, 100);
+    const list = document.getElementById('message-recipient-list');
+    if (!matches.length) {
+        list.innerHTML = '<div class="longevity-note">' + (messageRecipients.length ? 'No systems match' : 'No known systems yet') + '</div>';
+        return;
+    }
+    list.innerHTML = matches.map(s => {
+        const live = currentLivePeerIDs.has(s.id);
+        const selected = messageRecipient && messageRecipient.id === s.id ? ' selected' : '';
+        return '<div class="recipient-item' + selected + '" onclick="selectMessageRecipient(\'' + s.id + '\')">' +
+            '<span class="peer-name">' + escapeHTML(s.name) + '</span>' +
+            (live ? '<span class="recipient-live">● live</span>' : '<span class="recipient-cached">○ cached</span>') + '</div>';
+    }).join('');
+}
+
+function selectMessageRecipient(id) {
+    messageRecipient = messageRecipients.find(s => s.id === id) || null;
+    renderMessageRecipients();
+    validateMessageForm();
+}
+
+// Mirrors the server's checks; the server checks again anyway
+function validateMessageForm() {
+    const body = document.getElementById('message-body').value;
+    let error = '';
+    if (!messageRecipient) {
+        error = body ? 'Pick a recipient' : '';
+    } else if (!body.trim()) {
+        error = ' ';
+    } else if (new TextEncoder().encode(body).length > MESSAGE_MAX_BYTES) {
+        error = 'Message must be ' + MESSAGE_MAX_BYTES + ' bytes or less';
+    }
+    document.getElementById('message-form-error').textContent = error.trim();
+    const ok = !!messageRecipient && !error;
+    document.getElementById('message-send').disabled = !ok;
+    return ok;
+}
+
+async function sendMessage() {
+    if (!validateMessageForm()) return;
+    const button = document.getElementById('message-send');
+    button.disabled = true;
+    button.textContent = 'Sending...';
+    try {
+        const resp = await adminFetch('/api/messages', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ to_system_id: messageRecipient.id, body: document.getElementById('message-body').value }),
+            signal: timeoutSignal(MESSAGE_TIMEOUT)
+        });
+        if (!resp.ok) throw new Error((await resp.text()).trim());
+        document.getElementById('message-body').value = '';
+        showMessageBox('sent');
+    } catch (err) {
+        document.getElementById('message-form-error').textContent = err.name === 'AbortError' ?
+            'no answer in time; check Sent before sending again' : err.message;
+    } finally {
+        button.textContent = 'Send';
+    }
+}
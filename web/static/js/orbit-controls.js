@@ -0,0 +1,130 @@
+// OrbitControls for Three.js r128: drag to rotate, right-drag to pan, wheel to zoom
+THREE.OrbitControls = function(object, domElement) {
+    this.object = object;
+    this.domElement = domElement;
+    this.enabled = true;
+    this.target = new THREE.Vector3();
+    this.minDistance = 0;
+    this.maxDistance = Infinity;
+    this.enableDamping = false;
+    this.dampingFactor = 0.05;
+    this.enableZoom = true;
+    this.zoomSpeed = 1.0;
+    this.enableRotate = true;
+    this.rotateSpeed = 1.0;
+    this.enablePan = true;
+    this.panSpeed = 1.0;
+
+    const scope = this;
+    const STATE = { NONE: -1, ROTATE: 0, DOLLY: 1, PAN: 2 };
+    let state = STATE.NONE;
+
+    const rotateStart = new THREE.Vector2();
+    const rotateEnd = new THREE.Vector2();
+    const rotateDelta = new THREE.Vector2();
+    const panStart = new THREE.Vector2();
+    const panEnd = new THREE.Vector2();
+    const panDelta = new THREE.Vector2();
+    const dollyStart = new THREE.Vector2();
+    const dollyEnd = new THREE.Vector2();
+    const dollyDelta = new THREE.Vector2();
+
+    let spherical = new THREE.Spherical();
+    let sphericalDelta = new THREE.Spherical();
+    let scale = 1;
+    let panOffset = new THREE.Vector3();
+
+    this.update = function() {
+        const offset = new THREE.Vector3();
+        const quat = new THREE.Quaternion().setFromUnitVectors(object.up, new THREE.Vector3(0, 1, 0));
+        const quatInverse = quat.clone().invert();
+        const lastPosition = new THREE.Vector3();
+
+        const position = scope.object.position;
+        offset.copy(position).sub(scope.target);
+        offset.applyQuaternion(quat);
+        spherical.setFromVector3(offset);
+        spherical.theta += sphericalDelta.theta;
+        spherical.phi += sphericalDelta.phi;
+        spherical.phi = Math.max(0.01, Math.min(Math.PI - 0.01, spherical.phi));
+        spherical.radius *= scale;
+        spherical.radius = Math.max(scope.minDistance, Math.min(scope.maxDistance, spherical.radius));
+        scope.target.add(panOffset);
+        offset.setFromSpherical(spherical);
+        offset.applyQuaternion(quatInverse);
+        position.copy(scope.target).add(offset);
+        scope.object.lookAt(scope.target);
+        sphericalDelta.set(0, 0, 0);
+        scale = 1;
+        panOffset.set(0, 0, 0);
+        return false;
+    };
+
+    function onMouseDown(event) {
+        if (!scope.enabled) return;
+        event.preventDefault();
+        markMapInteraction();
+        if (event.button === 0) {
+            state = STATE.ROTATE;
+            rotateStart.set(event.clientX, event.clientY);
+        } else if (event.button === 1) {
+            state = STATE.DOLLY;
+            dollyStart.set(event.clientX, event.clientY);
+        } else if (event.button === 2) {
+            state = STATE.PAN;
+            panStart.set(event.clientX, event.clientY);
+        }
+        document.addEventListener('mousemove', onMouseMove, false);
+        document.addEventListener('mouseup', onMouseUp, false);
+    }
+
+    function onMouseMove(event) {
+        if (!scope.enabled) return;
+        event.preventDefault();
+        if (state === STATE.ROTATE) {
+            rotateEnd.set(event.clientX, event.clientY);
+            rotateDelta.subVectors(rotateEnd, rotateStart).multiplyScalar(scope.rotateSpeed);
+            sphericalDelta.theta -= 2 * Math.PI * rotateDelta.x / domElement.clientHeight;
+            sphericalDelta.phi -= 2 * Math.PI * rotateDelta.y / domElement.clientHeight;
+            rotateStart.copy(rotateEnd);
+        } else if (state === STATE.DOLLY) {
+            dollyEnd.set(event.clientX, event.clientY);
+            dollyDelta.subVectors(dollyEnd, dollyStart);
+            if (dollyDelta.y > 0) scale /= Math.pow(0.95, scope.zoomSpeed);
+            else if (dollyDelta.y < 0) scale *= Math.pow(0.95, scope.zoomSpeed);
+            dollyStart.copy(dollyEnd);
+        } else if (state === STATE.PAN) {
+            panEnd.set(event.clientX, event.clientY);
+            panDelta.subVectors(panEnd, panStart).multiplyScalar(scope.panSpeed);
+            const offset = new THREE.Vector3();
+            offset.setFromMatrixColumn(scope.object.matrix, 0);
+            offset.multiplyScalar(-panDelta.x * 0.5);
+            panOffset.add(offset);
+            offset.setFromMatrixColumn(scope.object.matrix, 1);
+            offset.multiplyScalar(panDelta.y * 0.5);
+            panOffset.add(offset);
+            panStart.copy(panEnd);
+        }
+        scope.update();
+    }
+
+    function onMouseUp() {
+        state = STATE.NONE;
+        document.removeEventListener('mousemove', onMouseMove, false);
+        document.removeEventListener('mouseup', onMouseUp, false);
+    }
+
+    function onWheel(event) {
+        if (!scope.enabled || !scope.enableZoom) return;
+        event.preventDefault();
+        markMapInteraction();
+        if (event.deltaY < 0) scale *= Math.pow(0.95, scope.zoomSpeed);
+        else if (event.deltaY > 0) scale /= Math.pow(0.95, scope.zoomSpeed);
+        scope.update();
+    }
+
+    domElement.addEventListener('mousedown', onMouseDown, false);
+    domElement.addEventListener('wheel', onWheel, { passive: false });
+    domElement.addEventListener('contextmenu', e => e.preventDefault(), false);
+    this.update();
+};
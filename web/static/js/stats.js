@@ -0,0 +1,499 @@
+// Dashboard cards: periodic refresh, live updates over WebSocket and polling fallback
+
+// Render routing table list, title and connectivity health
+function renderPeerList(peers) {
+    const routingSize = peers.length;
+    document.getElementById('routing-title').textContent = 'Routing Table (' + routingSize + ' nodes)';
+
+    // Update health based on routing table size
+    const healthEl = document.getElementById('stat-health');
+    if (routingSize >= 2) {
+        healthEl.textContent = 'Healthy';
+        healthEl.className = 'stat-value health-healthy';
+    } else if (routingSize === 1) {
+        healthEl.textContent = 'Low Connectivity';
+        healthEl.className = 'stat-value health-warning';
+    } else {
+        healthEl.textContent = 'Isolated';
+        healthEl.className = 'stat-value health-critical';
+    }
+
+    // Update peer list (sorted alphabetically)
+    const peerListEl = document.getElementById('peer-list');
+    const oneDayAgo = Math.floor(Date.now() / 1000) - (24 * 60 * 60);
+    const formatDate = (ts) => {
+        if (!ts) return 'Unknown';
+        const d = new Date(ts * 1000);
+        const mm = String(d.getMonth() + 1).padStart(2, '0');
+        const dd = String(d.getDate()).padStart(2, '0');
+        const yy = String(d.getFullYear()).slice(-2);
+        return mm + '/' + dd + '/' + yy;
+    };
+    if (peers.length === 0) {
+        peerListEl.innerHTML = '<p style="color: #666; padding: 20px; text-align: center;">No peers in routing table</p>';
+    } else {
+        const sortedPeers = [...peers].sort((a, b) => a.name.localeCompare(b.name));
+        peerListEl.innerHTML = sortedPeers.map(p => {
+            const isNew = p.learned_at && p.learned_at > oneDayAgo;
+            const newBadge = isNew ? ' <span class="new-badge">NEW</span>' : '';
+            const lanBadge = p.lan ? ' <span class="lan-badge">LAN</span>' : '';
+            const localBadge = p.slot === 'local' ? ' <span class="local-badge" title="One of the systems nearest to this one in space, holding a local peer slot">LOCAL</span>' : '';
+            const quarantineBadge = p.quarantined ? ' <span class="quarantine-badge" title="Name or address failed sanitization; shown cleaned up and not passed on">SANITIZED</span>' : '';
+            const firstSeen = formatDate(p.learned_at);
+            const tag = publicMode ? 'div' : 'a';
+            const href = publicMode ? '' : ' href="/peer/' + p.id + '"';
+            const note = peerAnnotations[p.id];
+            const nameStyle = note && note.color ? ' style="color:' + note.color + '"' : '';
+            return '<' + tag + ' class="peer-item"' + href + '>' +
+                '<div class="peer-name"' + nameStyle + '>' + escapeHTML(p.name) + newBadge + lanBadge + localBadge + quarantineBadge + '</div>' +
+                '<div class="peer-id">' + p.id + '</div>' +
+                '<div class="peer-meta"><span class="coords">(' + p.x.toFixed(1) + ', ' + p.y.toFixed(1) + ', ' + p.z.toFixed(1) + ')</span> · <span class="first-seen">First seen: ' + firstSeen + '</span></div>' +
+                (note && note.note ? '<div class="peer-note" title="' + escapeHTML(note.note) + '">' + escapeHTML(note.note) + '</div>' : '') +
+                annotationChips(note) +
+                '</' + tag + '>';
+        }).join('');
+    }
+}
+
+async function refreshUptime() {
+    try {
+        const resp = await fetch('/api/uptime?days=14&bucket=day');
+        renderUptime(await resp.json());
+    } catch (err) {
+        console.error('Failed to refresh uptime:', err);
+    }
+}
+
+// Draw one bar per day, height and color by uptime
+function renderUptime(history) {
+    const strip = document.getElementById('uptime-strip');
+    const days = history.days || [];
+    strip.innerHTML = '';
+
+    let total = 0;
+    for (const day of days) {
+        const bar = document.createElement('div');
+        bar.className = 'uptime-day';
+        bar.style.height = Math.max(day.uptime_pct, 7) + '%';
+        if (day.uptime_pct >= 99) bar.style.background = '#4ade80';
+        else if (day.uptime_pct >= 90) bar.style.background = '#facc15';
+        else if (day.uptime_pct > 0) bar.style.background = '#f87171';
+        bar.title = day.date + ': ' + day.uptime_pct.toFixed(1) + '% uptime, ' + day.attestations + ' attestations';
+        strip.appendChild(bar);
+        total += day.uptime_pct;
+    }
+    document.getElementById('stat-uptime').textContent =
+        days.length ? (total / days.length).toFixed(1) + '%' : '-';
+}
+
+async function refreshEarnings() {
+    try {
+        const resp = await fetch('/api/credits/history?days=14');
+        renderEarnings(await resp.json());
+    } catch (err) {
+        console.error('Failed to refresh credit history:', err);
+    }
+}
+
+// Draw one bar per day, height relative to the best day, with the bonus breakdown on hover
+function renderEarnings(history) {
+    const strip = document.getElementById('earnings-strip');
+    const days = history.days || [];
+    strip.innerHTML = '';
+
+    const best = Math.max(0, ...days.map(d => d.credits_earned));
+    const pct = (v) => '+' + (v * 100).toFixed(1) + '%';
+    let total = 0;
+    for (const day of days) {
+        const bar = document.createElement('div');
+        bar.className = 'earnings-day' + (day.credits_earned > 0 ? ' earned' : '');
+        bar.style.height = (best > 0 ? Math.max(day.credits_earned / best * 100, 7) : 7) + '%';
+        const b = day.bonuses;
+        bar.title = day.date + ': ' + day.credits_earned.toFixed(2) + ' ✦ earned over ' + day.cycles + ' cycles' +
+            (day.cycles ? '\nbase ' + day.base_credits.toFixed(2) + ', bridge ' + pct(b.bridge) + ', longevity ' + pct(b.longevity) +
+                ', pioneer ' + pct(b.pioneer) + ', reciprocity ' + pct(b.reciprocity) : '');
+        strip.appendChild(bar);
+        total += day.credits_earned;
+    }
+    document.getElementById('stat-earnings').textContent = days.length ? total.toFixed(1) + ' ✦' : '-';
+}
+
+// Top 10 systems by shared credit rank, and where we stand
+async function refreshLeaderboard() {
+    try {
+        const resp = await fetch('/api/leaderboard?limit=10');
+        const board = await resp.json();
+        document.getElementById('leaderboard-title').textContent = 'Leaderboard (' + board.total + ' ranked)';
+        const listEl = document.getElementById('leaderboard-list');
+        if (board.systems.length === 0) {
+            listEl.innerHTML = '<p style="color: #666; padding: 20px; text-align: center;">No systems have shared their rank yet</p>';
+        } else {
+            listEl.innerHTML = board.systems.map(e => {
+                const status = e.status === 'verified'
+                    ? '<span class="rank-verified" title="A proof covered this rank">✓ verified</span>'
+                    : '<span class="rank-claimed" title="' + (e.verified_rank ? 'Its last proof only covered ' + e.verified_rank : 'Not yet proven') + '">claimed</span>';
+                const tag = publicMode || e.local ? 'div' : 'a';
+                const href = tag === 'a' ? ' href="/peer/' + e.id + '"' : '';
+                return '<' + tag + ' class="peer-item"' + href + '>' +
+                    '<div class="peer-name">#' + e.position + ' ' + escapeHTML(e.name) + (e.local ? ' <span class="new-badge">YOU</span>' : '') + '</div>' +
+                    '<div class="peer-meta"><span style="color: ' + e.rank_color + ';">' + e.rank + '</span> · ' + status +
+                    ' · ' + e.star_class + '-class' + (e.first_seen ? ' · First seen: ' + new Date(e.first_seen * 1000).toLocaleDateString() : '') + '</div>' +
+                    '</' + tag + '>';
+            }).join('');
+        }
+        document.getElementById('leaderboard-local-row').style.display = board.local ? '' : 'none';
+        if (board.local) {
+            document.getElementById('leaderboard-local').textContent = '#' + board.local.position + ' of ' + board.total + ' (' + board.local.rank + ')';
+        }
+    } catch (err) {
+        console.error('Failed to refresh leaderboard:', err);
+    }
+}
+
+async function refreshTasks() {
+    try {
+        const resp = await fetch('/api/tasks');
+        renderTasks(await resp.json());
+    } catch (err) {
+        console.error('Failed to refresh tasks:', err);
+    }
+}
+
+function renderTasks(tasks) {
+    const now = Math.floor(Date.now() / 1000);
+    const span = (s) => s < 60 ? s + 's' : s < 3600 ? Math.floor(s / 60) + 'm' : Math.floor(s / 3600) + 'h ' + Math.floor(s % 3600 / 60) + 'm';
+    document.getElementById('task-list').innerHTML = tasks.map(t => {
+        let last = t.last_start ? span(now - t.last_start) + ' ago' : 'Never';
+        if (t.running) last = '<span class="task-running">Running for ' + span(now - t.last_start) + '</span>';
+        const took = t.last_end && !t.running ? (t.last_duration_ms < 1000 ? t.last_duration_ms + 'ms' : (t.last_duration_ms / 1000).toFixed(1) + 's') : '-';
+        const next = t.next_run ? (t.next_run > now ? 'in ' + span(t.next_run - now) : 'due') : '-';
+        const error = t.last_error ? '<div class="task-error">' + escapeHTML(t.last_error) + '</div>' : '';
+        return '<tr><td><span class="task-name">' + t.name + '</span>' + error + '</td>' +
+            '<td>' + t.schedule + '</td><td>' + last + '</td><td>' + took + '</td>' +
+            '<td>' + (t.runs ? t.last_items : '-') + '</td><td>' + next + '</td>' +
+            '<td><button class="task-run" onclick="runTask(\'' + t.name + '\')">Run</button></td></tr>';
+    }).join('');
+}
+
+async function runTask(name) {
+    try {
+        await adminFetch('/api/tasks/' + name + '/run', { method: 'POST' });
+    } catch (err) {
+        console.error('Failed to run task:', err);
+        alert('Could not run ' + name + ': ' + err.message);
+    }
+    setTimeout(refreshTasks, 1000);
+}
+
+// AJAX refresh stats without reloading page
+async function refreshStats() {
+    try {
+        // Fetch credits (not available in public mode)
+        if (!publicMode) {
+            const creditsResp = await fetch('/api/credits');
+            const credits = await creditsResp.json();
+
+            document.getElementById('stat-balance').textContent = credits.balance + ' ✦';
+            document.getElementById('stat-rank').textContent = credits.rank;
+            document.getElementById('stat-rank').style.color = credits.rank_color;
+
+            const nextRankRow = document.getElementById('stat-nextrank-row');
+            if (credits.credits_to_next > 0) {
+                nextRankRow.style.display = '';
+                document.getElementById('stat-nextrank').textContent = credits.next_rank + ' (' + credits.credits_to_next + ' ✦ needed)';
+            } else {
+                nextRankRow.style.display = 'none';
+            }
+
+            const longevityWeeks = credits.longevity_weeks || 0;
+            const longevityBonus = (credits.longevity_bonus || 0) * 100;
+            const longevityProgress = Math.min((longevityWeeks / 52) * 100, 100);
+
+            document.getElementById('stat-longbonus').textContent = '+' + longevityBonus.toFixed(1) + '%';
+            document.getElementById('stat-longbar').style.width = longevityProgress.toFixed(1) + '%';
+            document.getElementById('stat-longweeks').textContent = longevityWeeks.toFixed(1) + ' / 52 weeks to max (+52%)';
+            refreshUptime();
+            refreshEarnings();
+            refreshTransfers();
+            refreshUnreadMessages();
+            refreshDiagnostics();
+            refreshAdvisor();
+            refreshTasks();
+            refreshAnnotations();
+        }
+        refreshLeaderboard();
+
+        // Fetch stats
+        const statsResp = await fetch('/api/stats');
+        const stats = await statsResp.json();
+
+        // Every field is always there (see StatsResponse); the database and bandwidth are zero in public mode
+        if (!publicMode) {
+            document.getElementById('stat-attestations').textContent = stats.attestation_count;
+            document.getElementById('stat-dbsize').textContent = stats.database_size || 'unknown';
+            renderBandwidth(stats.bandwidth);
+        }
+
+        // Peers refusing our own info point at a misconfigured node
+        const rejected = stats.rejected_by_peers;
+        document.getElementById('stat-rejected-row').style.display = rejected.peers > 0 ? '' : 'none';
+        document.getElementById('stat-rejected').textContent = rejected.peers > 0 ? 'By ' + rejected.peers + ' peers: ' + rejected.reason : '';
+
+        // Systems gossip calls alive that we can't reach: a split network, or its healing
+        renderPartition(stats.partition);
+
+        // Update peer state breakdown
+        document.getElementById('state-active').textContent = stats.peer_states.active;
+        document.getElementById('state-pending').textContent = stats.peer_states.pending;
+        document.getElementById('state-degraded').textContent = stats.peer_states.degraded;
+        document.getElementById('state-stale').textContent = stats.peer_states.stale;
+        document.getElementById('state-tls').textContent = stats.peer_states.tls + ' over TLS';
+
+        // Fetch peers for routing table
+        const peersResp = await fetch('/api/peers');
+        const peers = await peersResp.json() || [];
+        currentPeers = peers;
+        renderPeerList(peers);
+
+        // Fetch the map for counts AND map update
+        const mapResp = await fetch('/api/map?lod=' + mapLOD + mapFilterQuery());
+        const map = await mapResp.json();
+
+        const totalSystems = map.total + 1;
+        document.getElementById('stat-galaxy').textContent = totalSystems + ' total';
+        document.getElementById('galaxy-title').textContent = 'Galaxy Map (' + (hasMapFilter() ? map.matching + ' of ' : '') + totalSystems + ' systems)';
+
+        // Only update map data if user isn't actively browsing
+        if (!isUserBrowsingMap()) {
+            // Update live peer IDs set from peers response
+            currentLivePeerIDs = new Set(peers.map(p => p.id));
+
+            // Update known systems and clusters for map
+            applyMap(map);
+
+            // Fetch fresh connections
+            const connectionsResp = await fetch('/api/connections');
+            cachedConnections = await connectionsResp.json() || [];
+
+            // Rebuild the 3D map with updated data
+            rebuildMapContent();
+        }
+
+    } catch (err) {
+        console.error('Failed to refresh stats:', err);
+    }
+}
+
+// === Live updates over WebSocket ===
+// Events are applied incrementally; polling below only runs while the socket is down
+
+let currentPeers = [];
+let liveSocket = null;
+let mapDirty = false;
+
+function updateSystemCounts() {
+    const filtered = hasMapFilter();
+    const totalSystems = (mapClustered || filtered ? mapTotal : currentKnownSystems.length) + 1;
+    document.getElementById('stat-galaxy').textContent = totalSystems + ' total';
+    document.getElementById('galaxy-title').textContent = 'Galaxy Map (' + (filtered ? mapMatching + ' of ' : '') + totalSystems + ' systems)';
+}
+
+// A suspected partition as a warning, or for an hour after healing, how much came back
+function renderPartition(p) {
+    const row = document.getElementById('stat-partition-row');
+    const value = document.getElementById('stat-partition');
+    row.style.display = p.suspected || p.healed_recently ? '' : 'none';
+    document.getElementById('stat-partition-label').textContent = p.suspected ? '⚠ Partition' : 'Partition';
+    if (p.suspected) {
+        value.className = 'stat-value health-warning';
+        value.textContent = p.unreachable + ' systems unreachable, reported alive by ' + p.reporters + ' peers';
+    } else {
+        value.className = 'stat-value health-healthy';
+        value.textContent = 'Healed: ' + p.healed + ' systems reached again';
+    }
+}
+
+// Today's usage, against the budget if there is one, with the stage it put the node in
+function renderBandwidth(bw) {
+    const el = document.getElementById('stat-bandwidth');
+    const used = bw.bytes_sent + bw.bytes_received;
+    let text = formatBytes(used);
+    if (bw.budget_bytes) {
+        text += ' of ' + formatBytes(bw.budget_bytes);
+        if (bw.stage !== 'normal') {
+            text += ' (' + bw.stage + ')';
+        }
+    }
+    text += ', ' + formatBytes(bw.projected_bytes) + ' projected';
+    el.textContent = text;
+    el.style.color = bw.budget_bytes && bw.projected_bytes > bw.budget_bytes ? '#fbbf24' : '';
+    if (bw.budget_bytes && bw.stage !== 'normal') {
+        el.style.color = '#f87171';
+    }
+}
+
+function applyLiveStats(stats) {
+    if (stats.attestation_count !== undefined) {
+        document.getElementById('stat-attestations').textContent = stats.attestation_count;
+    }
+    if (stats.database_size) {
+        document.getElementById('stat-dbsize').textContent = stats.database_size;
+    }
+    if (stats.peer_states) {
+        document.getElementById('state-active').textContent = stats.peer_states.active || 0;
+        document.getElementById('state-pending').textContent = stats.peer_states.pending || 0;
+        document.getElementById('state-degraded').textContent = stats.peer_states.degraded || 0;
+        document.getElementById('state-stale').textContent = stats.peer_states.stale || 0;
+        document.getElementById('state-tls').textContent = (stats.peer_states.tls || 0) + ' over TLS';
+    }
+    if (stats.balance !== undefined) {
+        document.getElementById('stat-balance').textContent = stats.balance + ' ✦';
+    }
+    if (stats.rank) {
+        document.getElementById('stat-rank').textContent = stats.rank;
+        document.getElementById('stat-rank').style.color = stats.rank_color;
+    }
+}
+
+function applyLiveEvent(ev) {
+    switch (ev.type) {
+        case 'system_learned': {
+            if (mapClustered || hasMapFilter()) {
+                mapStale = true; // It may belong in a cluster or be filtered out: let the server decide
+                break;
+            }
+            const entry = toMapSystem(ev.system, ev.learned_at);
+            const idx = currentKnownSystems.findIndex(s => s.id === entry.id);
+            if (idx >= 0) {
+                currentKnownSystems[idx] = entry;
+            } else {
+                currentKnownSystems.push(entry);
+            }
+            updateSystemCounts();
+            mapDirty = true;
+            break;
+        }
+        case 'peer_added':
+            currentPeers = currentPeers.filter(p => p.id !== ev.system_id);
+            currentPeers.push(Object.assign({}, ev.system, { learned_at: ev.learned_at, lan: ev.lan, quarantined: ev.quarantined }));
+            currentLivePeerIDs.add(ev.system_id);
+            renderPeerList(currentPeers);
+            mapDirty = true;
+            mapStale = mapStale || mapClustered; // Live peers are never clustered
+            break;
+        case 'peer_removed':
+            currentPeers = currentPeers.filter(p => p.id !== ev.system_id);
+            currentLivePeerIDs.delete(ev.system_id);
+            if (ev.forgotten) {
+                currentKnownSystems = currentKnownSystems.filter(s => s.id !== ev.system_id);
+                mapStale = mapStale || mapClustered;
+                updateSystemCounts();
+            }
+            renderPeerList(currentPeers);
+            mapDirty = true;
+            break;
+        case 'connection_changed': {
+            // Replace this system's reported edges (our own direct edges stay)
+            const from = currentKnownSystems.find(s => s.id === ev.system_id);
+            cachedConnections = cachedConnections.filter(c => c.from_id !== ev.system_id || c.to_id === selfSystem.id);
+            (ev.data.peer_ids || []).forEach(id => {
+                const to = currentKnownSystems.find(s => s.id === id);
+                // Same rule as the server: reciprocal once the other side lists it too
+                const reverse = cachedConnections.find(c => c.from_id === id && c.to_id === ev.system_id);
+                if (reverse) reverse.reciprocal = true;
+                cachedConnections.push({
+                    from_id: ev.system_id,
+                    from_name: from ? from.name : '',
+                    to_id: id,
+                    to_name: to ? to.name : '',
+                    reciprocal: !!reverse,
+                    last_evidence: Math.floor(Date.now() / 1000),
+                    evidence_type: 'gossip',
+                    strength: reverse ? 1 : 0.6
+                });
+            });
+            mapDirty = true;
+            break;
+        }
+        case 'local_system_changed':
+            selfSystem.name = ev.system.name;
+            document.getElementById('system-name').textContent = ev.system.name;
+            document.title = ev.system.name + ' - Stellar Lab';
+            mapDirty = true;
+            break;
+        case 'stats':
+            applyLiveStats(ev.data);
+            break;
+        // peer_state_changed: counts arrive with the next stats delta
+    }
+}
+
+function connectLiveUpdates() {
+    const proto = location.protocol === 'https:' ? 'wss:' : 'ws:';
+    const ws = new WebSocket(proto + '//' + location.host + '/ws');
+    ws.onopen = () => {
+        liveSocket = ws;
+        refreshStats(); // Resync anything missed while disconnected
+    };
+    ws.onmessage = (msg) => {
+        try {
+            applyLiveEvent(JSON.parse(msg.data));
+        } catch (err) {
+            console.error('Bad live event:', err);
+        }
+    };
+    ws.onclose = () => {
+        liveSocket = null;
+        setTimeout(connectLiveUpdates, 15000);
+    };
+}
+
+// Rebuild the map at most once a second, and never while the user is browsing it
+setInterval(() => {
+    if (mapStale && !mapFetching && !isUserBrowsingMap() && Date.now() - lastMapFetch > MAP_REFETCH_INTERVAL) {
+        mapStale = false;
+        fetchMap(mapLOD).then(rebuildMapContent);
+        return;
+    }
+    if (mapDirty && !isUserBrowsingMap()) {
+        mapDirty = false;
+        rebuildMapContent();
+    }
+}, 1000);
+
+// Split or merge clusters as the camera zooms (zooming is browsing, so no cooldown here)
+setInterval(() => {
+    if (!mapClustered || mapFetching || historyState || !camera || !controls) return;
+    const lod = lodForDistance(camera.position.distanceTo(controls.target));
+    if (lod !== mapLOD) {
+        fetchMap(lod).then(rebuildMapContent);
+    }
+}, 500);
+
+// Fall back to polling every 30 seconds while the socket is down
+setInterval(() => {
+    if (!liveSocket) refreshStats();
+}, 30000);
+
+// Uptime and earnings only change slowly and aren't pushed over the socket
+if (!publicMode) setInterval(refreshUptime, 10 * 60 * 1000);
+if (!publicMode) setInterval(refreshEarnings, 10 * 60 * 1000);
+
+// Received transfers aren't pushed either
+if (!publicMode) setInterval(refreshTransfers, 60 * 1000);
+
+// Nor are new messages
+if (!publicMode) setInterval(refreshUnreadMessages, 60 * 1000);
+
+// Nor are diagnostics
+if (!publicMode) setInterval(refreshDiagnostics, 60 * 1000);
+
+// Nor is the capacity advisor, which only works its suggestions out every ten minutes
+if (!publicMode) setInterval(refreshAdvisor, 5 * 60 * 1000);
+
+// Task state isn't pushed over the socket either
+if (!publicMode) setInterval(refreshTasks, 15 * 1000);
+
+if ('WebSocket' in window) {
+    connectLiveUpdates();
+}
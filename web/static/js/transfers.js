@@ -0,0 +1,237 @@
+// Send Credits modal and Recent Transfers
+
+// === Credit transfers ===
+const TRANSFER_PAGE_SIZE = 5;
+const TRANSFER_TIMEOUT = 30000; // The server gives up on a lookup and delivery well before this
+let transferRecipients = [];    // Known systems, for the picker
+let transferRecipient = null;   // The picked one
+let transferBalance = 0;
+let transferOffset = 0;
+let pendingTransfer = null;     // Shown at the top of Recent Transfers while it's being delivered
+
+// timeoutSignal aborts a request still running after ms, so an unreachable peer ends in an error, not a spinner
+function timeoutSignal(ms) {
+    const controller = new AbortController();
+    setTimeout(() => controller.abort(), ms);
+    return controller.signal;
+}
+
+async function openTransferModal() {
+    transferRecipient = null;
+    document.getElementById('transfer-search').value = '';
+    document.getElementById('transfer-amount').value = '';
+    document.getElementById('transfer-memo').value = '';
+    document.getElementById('recipient-list').innerHTML = '<div class="longevity-note">Loading systems...</div>';
+    showTransferForm();
+    document.getElementById('transfer-modal').classList.add('open');
+    document.getElementById('transfer-search').focus();
+
+    try {
+        const [systems, credits] = await Promise.all([
+            fetch('/api/known-systems').then(r => r.json()),
+            fetch('/api/credits').then(r => r.json())
+        ]);
+        transferBalance = credits.balance;
+        transferRecipients = (systems || []).filter(s => s.id !== selfSystem.id && s.peer_address)
+            .sort((a, b) => a.name.localeCompare(b.name));
+    } catch (err) {
+        document.getElementById('transfer-form-error').textContent = 'Could not load known systems: ' + err.message;
+        return;
+    }
+    renderRecipients();
+    validateTransferForm();
+}
+
+function closeTransferModal() {
+    document.getElementById('transfer-modal').classList.remove('open');
+}
+
+function showTransferForm() {
+    document.getElementById('transfer-form').style.display = '';
+    document.getElementById('transfer-confirm').style.display = 'none';
+}
+
+// Live systems (in the routing table) first, then cached ones, each by name
+function renderRecipients() {
+    const query = document.getElementById('transfer-search').value.trim().toLowerCase();
+    const matches = transferRecipients.filter(s => !query || s.name.toLowerCase().includes(query))
+        .sort((a, b) => currentLivePeerIDs.has(b.id) - currentLivePeerIDs.has(a.id))
+        .slice(0, 100);
+    const list = document.getElementById('recipient-list');
+    if (!matches.length) {
+        list.innerHTML = '<div class="longevity-note">' + (transferRecipients.length ? 'No systems match' : 'No known systems yet') + '</div>';
+        return;
+    }
+    list.innerHTML = matches.map(s => {
+        const live = currentLivePeerIDs.has(s.id);
+        const selected = transferRecipient && transferRecipient.id === s.id ? ' selected' : '';
+        return '<div class="recipient-item' + selected + '" onclick="selectRecipient(\'' + s.id + '\')">' +
+            '<span><span class="peer-name">' + escapeHTML(s.name) + '</span> <span class="recipient-class">' +
+            escapeHTML(s.stars.primary.class) + '-class</span></span>' +
+            (live ? '<span class="recipient-live">● live</span>' : '<span class="recipient-cached">○ cached</span>') + '</div>';
+    }).join('');
+}
+
+function selectRecipient(id) {
+    transferRecipient = transferRecipients.find(s => s.id === id) || null;
+    renderRecipients();
+    validateTransferForm();
+}
+
+// Mirrors the server's checks; the server checks again anyway
+function validateTransferForm() {
+    const amountText = document.getElementById('transfer-amount').value;
+    const amount = Number(amountText);
+    const memo = document.getElementById('transfer-memo').value;
+    let error = '';
+    if (!transferRecipient) {
+        error = amountText ? 'Pick a recipient' : '';
+    } else if (!amountText) {
+        error = ' ';
+    } else if (!Number.isInteger(amount) || amount < 1) {
+        error = 'Enter a whole number of credits';
+    } else if (amount > transferBalance) {
+        error = 'Only ' + transferBalance + ' ✦ available';
+    } else if (new TextEncoder().encode(memo).length > 140) {
+        error = 'Memo must be 140 bytes or less';
+    }
+    document.getElementById('transfer-form-error').textContent = error.trim();
+    const ok = !!transferRecipient && !error;
+    document.getElementById('transfer-review').disabled = !ok;
+    return ok;
+}
+
+function transferErrorMessage(err, sending) {
+    if (err.name !== 'AbortError') return err.message;
+    return sending ? 'no answer in time; check Recent Transfers before sending again' : 'no answer in time; the recipient may be offline';
+}
+
+// Builds the transfer on the server without sending it, to show the proof it carries
+async function reviewTransfer() {
+    if (!validateTransferForm()) return;
+    const amount = Number(document.getElementById('transfer-amount').value);
+    const memo = document.getElementById('transfer-memo').value;
+    const button = document.getElementById('transfer-review');
+    button.disabled = true;
+    button.textContent = 'Checking...';
+    try {
+        const params = new URLSearchParams({ to: transferRecipient.id, amount: amount, memo: memo });
+        const resp = await adminFetch('/api/credits/transfer/preview?' + params, { signal: timeoutSignal(TRANSFER_TIMEOUT) });
+        if (!resp.ok) throw new Error((await resp.text()).trim());
+        const preview = await resp.json();
+
+        const row = (label, value) => '<div class="stat-row"><span class="stat-label">' + label + '</span><span class="stat-value">' + value + '</span></div>';
+        document.getElementById('transfer-summary').innerHTML =
+            row('To', escapeHTML(preview.to_name)) +
+            row('Amount', preview.amount + ' ✦') +
+            row('Balance after', (preview.balance - preview.amount) + ' ✦') +
+            (memo ? row('Memo', escapeHTML(memo)) : '') +
+            row('Proof', preview.proof_attestations + ' attestations, ' + formatBytes(preview.proof_bytes)) +
+            row('Recipient', preview.recipient_online ? '<span class="recipient-live">● online</span>' : '<span class="transfer-sent">○ offline</span>');
+        document.getElementById('transfer-confirm-error').textContent = preview.recipient_online ? '' :
+            preview.recipient_error + '. A transfer needs the recipient online to accept it.';
+        document.getElementById('transfer-send').disabled = !preview.recipient_online;
+        document.getElementById('transfer-form').style.display = 'none';
+        document.getElementById('transfer-confirm').style.display = '';
+    } catch (err) {
+        document.getElementById('transfer-form-error').textContent = transferErrorMessage(err, false);
+    } finally {
+        button.textContent = 'Review';
+        validateTransferForm();
+    }
+}
+
+async function sendTransfer() {
+    const recipient = transferRecipient;
+    const amount = Number(document.getElementById('transfer-amount').value);
+    const memo = document.getElementById('transfer-memo').value;
+    closeTransferModal();
+
+    pendingTransfer = { peer_id: recipient.id, peer_name: recipient.name, amount: amount, memo: memo };
+    setTransferStatus('pending', 'Sending ' + amount + ' ✦ to ' + recipient.name + '...');
+    renderTransfers();
+    try {
+        const resp = await adminFetch('/api/credits/transfer', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ to_system_id: recipient.id, amount: amount, memo: memo }),
+            signal: timeoutSignal(TRANSFER_TIMEOUT)
+        });
+        if (resp.status === 504) {
+            // Sent, but the answer was lost: it stays debited and the node resends it
+            setTransferStatus('pending', 'Transfer to ' + recipient.name + ' unconfirmed: ' + (await resp.text()).trim());
+            pendingTransfer = null;
+            transferOffset = 0;
+            refreshTransfers();
+            return;
+        }
+        if (!resp.ok) throw new Error((await resp.text()).trim());
+        const result = await resp.json();
+        setTransferStatus('confirmed', '✓ ' + recipient.name + ' accepted ' + amount + ' ✦');
+        if (result.balance !== undefined) {
+            document.getElementById('stat-balance').textContent = result.balance + ' ✦';
+        }
+    } catch (err) {
+        setTransferStatus('failed', 'Transfer to ' + recipient.name + ' failed: ' + transferErrorMessage(err, true) +
+            (err.name === 'AbortError' ? '' : '. Your balance is unchanged.'));
+    }
+    pendingTransfer = null;
+    transferOffset = 0;
+    refreshTransfers();
+}
+
+function setTransferStatus(state, text) {
+    const el = document.getElementById('transfer-status');
+    el.className = 'transfer-status ' + state;
+    el.textContent = text;
+}
+
+let transferPage = { transfers: [], total: 0 };
+
+async function refreshTransfers() {
+    try {
+        const resp = await fetch('/api/credits/transfers?limit=' + TRANSFER_PAGE_SIZE + '&offset=' + transferOffset);
+        transferPage = await resp.json();
+    } catch (err) {
+        console.error('Failed to load transfers:', err);
+        return;
+    }
+    renderTransfers();
+}
+
+function pageTransfers(step) {
+    transferOffset = Math.max(0, transferOffset + step * TRANSFER_PAGE_SIZE);
+    refreshTransfers();
+}
+
+function renderTransfers() {
+    const ago = (t) => {
+        const s = Math.max(0, Math.floor(Date.now() / 1000) - t);
+        return s < 60 ? 'just now' : s < 3600 ? Math.floor(s / 60) + 'm ago' : s < 86400 ? Math.floor(s / 3600) + 'h ago' : Math.floor(s / 86400) + 'd ago';
+    };
+    const item = (t, amountClass, sign, when) => {
+        const name = escapeHTML(t.peer_name || t.peer_id.substring(0, 8));
+        const dir = t.direction === 'received' ? 'from' : 'to';
+        return '<div class="transfer-item"><span><span class="' + amountClass + '">' + sign + t.amount + ' ✦</span> ' + dir +
+            ' <a href="/peer/' + t.peer_id + '">' + name + '</a>' +
+            (t.memo ? '<div class="peer-note">' + escapeHTML(t.memo) + '</div>' : '') + '</span>' +
+            '<span class="transfer-time">' + when + '</span></div>';
+    };
+
+    let html = pendingTransfer ? item(pendingTransfer, 'transfer-pending', '−', 'pending') : '';
+    html += transferPage.transfers.map(t => t.direction === 'received' ?
+        item(t, 'transfer-received', '+', ago(t.timestamp)) :
+        item(t, 'transfer-sent', '−', ago(t.timestamp))).join('');
+    document.getElementById('transfer-list').innerHTML = html || '<div class="longevity-note">No transfers yet</div>';
+
+    const total = transferPage.total;
+    const pager = document.getElementById('transfer-pager');
+    if (total <= TRANSFER_PAGE_SIZE) {
+        pager.innerHTML = '';
+        return;
+    }
+    const last = Math.min(transferOffset + TRANSFER_PAGE_SIZE, total);
+    pager.innerHTML = (transferOffset > 0 ? '<a onclick="pageTransfers(-1)">‹</a>' : '') +
+        (transferOffset + 1) + '-' + last + ' of ' + total +
+        (last < total ? '<a onclick="pageTransfers(1)">›</a>' : '');
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// LiveClientBuffer is how many events a socket can fall behind before it is dropped
+	LiveClientBuffer = 64
+
+	// LiveStatsInterval is how often stats deltas are computed for connected sockets
+	LiveStatsInterval = 5 * time.Second
+
+	// MaxLiveClients caps concurrent /ws connections
+	MaxLiveClients = 32
+)
+
+// liveClient is one connected browser tab
+type liveClient struct {
+	conn   *websocket.Conn
+	events chan Event
+}
+
+// LiveHub fans DHT events out to connected web UI sockets
+// Slow clients are disconnected rather than allowed to block the DHT;
+// the browser falls back to polling and reconnects.
+type LiveHub struct {
+	web *WebInterface
+
+	mu        sync.Mutex
+	clients   map[*liveClient]struct{}
+	lastStats map[string]interface{}
+
+	done chan struct{}
+}
+
+// NewLiveHub creates a hub for the given web interface
+func NewLiveHub(web *WebInterface) *LiveHub {
+	return &LiveHub{
+		web:     web,
+		clients: make(map[*liveClient]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Publish sends an event to every connected client without blocking
+func (h *LiveHub) Publish(e Event) {
+	// A public-mode UI doesn't get the operator profiles marked private
+	e.System = visibleProfile(e.System, h.web.public)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		select {
+		case c.events <- e:
+		default:
+			// Client can't keep up - drop it, it will reconnect and resync
+			delete(h.clients, c)
+			close(c.events)
+		}
+	}
+}
+
+// clientCount returns the number of connected sockets
+func (h *LiveHub) clientCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+// Handler returns the /ws endpoint
+func (h *LiveHub) Handler() websocket.Handler {
+	return func(conn *websocket.Conn) {
+		defer conn.Close()
+
+		client := &liveClient{conn: conn, events: make(chan Event, LiveClientBuffer)}
+
+		h.mu.Lock()
+		if len(h.clients) >= MaxLiveClients {
+			h.mu.Unlock()
+			return
+		}
+		h.clients[client] = struct{}{}
+		// New clients start from a full stats snapshot
+		h.lastStats = nil
+		h.mu.Unlock()
+
+		// Reader: we don't expect client messages, but need to notice disconnects
+		closed := make(chan struct{})
+		go func() {
+			var discard string
+			for websocket.Message.Receive(conn, &discard) == nil {
+			}
+			close(closed)
+		}()
+
+		for {
+			select {
+			case e, ok := <-client.events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				conn.SetWriteDeadline(time.Now().Add(RequestTimeout))
+				if err := websocket.Message.Send(conn, string(data)); err != nil {
+					h.remove(client)
+					return
+				}
+			case <-closed:
+				h.remove(client)
+				return
+			case <-h.done:
+				return
+			}
+		}
+	}
+}
+
+// remove unregisters a client if it is still registered
+func (h *LiveHub) remove(c *liveClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.events)
+	}
+}
+
+// statsLoop pushes changed stats fields while anyone is connected
+func (h *LiveHub) statsLoop() {
+	ticker := time.NewTicker(LiveStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			if h.clientCount() == 0 {
+				continue
+			}
+			if delta := h.statsDelta(); len(delta) > 0 {
+				h.Publish(Event{Type: EventStats, Data: delta, Timestamp: time.Now().Unix()})
+			}
+		}
+	}
+}
+
+// statsDelta returns the stats fields that changed since the last push
+func (h *LiveHub) statsDelta() map[string]interface{} {
+	current := h.web.liveStats()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delta := make(map[string]interface{})
+	for k, v := range current {
+		if prev, ok := h.lastStats[k]; !ok || !reflect.DeepEqual(prev, v) {
+			delta[k] = v
+		}
+	}
+	h.lastStats = current
+	return delta
+}
+
+// Close disconnects all clients and stops the stats loop
+// Hijacked websocket connections are not closed by http.Server.Shutdown
+func (h *LiveHub) Close() {
+	close(h.done)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		c.conn.Close()
+	}
+	log.Printf("Closed %d live update connections", len(h.clients))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// The widget is a small status card other sites can embed in an iframe. It's one
+// self-contained page (no Three.js or CDN scripts) that refreshes itself from
+// /api/widget-data, which gathers its fields in a single call
+
+const (
+	// MinWidgetRefresh and MaxWidgetRefresh bound ?refresh= (seconds; 0 turns it off)
+	MinWidgetRefresh = 10
+	MaxWidgetRefresh = 3600
+)
+
+// WidgetData is /api/widget-data: everything the widget shows
+// Rank is left out in public mode, like the rest of the credits
+type WidgetData struct {
+	Name         string `json:"name"`
+	StarClass    string `json:"star_class"`
+	Health       string `json:"health"`
+	Peers        int    `json:"peers"`
+	KnownSystems int    `json:"known_systems"`
+	Rank         string `json:"rank,omitempty"`
+}
+
+// widgetData gathers the widget's fields
+func (w *WebInterface) widgetData() WidgetData {
+	rt := w.dht.GetRoutingTable()
+	sys := w.dht.GetLocalSystem()
+	rtSize := rt.GetRoutingTableSize()
+
+	data := WidgetData{
+		Name:         sys.Name,
+		StarClass:    sys.Stars.Primary.Class,
+		Health:       NodeHealth(rtSize).String(),
+		Peers:        rtSize,
+		KnownSystems: rt.GetCacheSize(),
+	}
+	if !w.public {
+		if credits := creditStatus(w.storage, sys.ID); credits != nil {
+			data.Rank = credits.Rank
+		}
+	}
+	return data
+}
+
+// allowEmbedding lets pages on other origins fetch the widget and its data
+func allowEmbedding(rw http.ResponseWriter) {
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.Header().Set("Access-Control-Allow-Methods", "GET")
+}
+
+// handleWidgetDataAPI returns the widget's fields
+// GET /api/widget-data
+func (w *WebInterface) handleWidgetDataAPI(rw http.ResponseWriter, r *http.Request) {
+	allowEmbedding(rw)
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(w.widgetData())
+}
+
+// widgetPage is what the widget template renders
+type widgetPage struct {
+	WidgetData
+	StarColor   string
+	HealthClass string
+	Theme       string
+	Refresh     int // Seconds between refreshes (0: never)
+}
+
+// handleWidget serves the embeddable status widget
+// GET /widget?theme=dark|light&refresh=seconds
+func (w *WebInterface) handleWidget(rw http.ResponseWriter, r *http.Request) {
+	allowEmbedding(rw)
+
+	page := widgetPage{
+		WidgetData:  w.widgetData(),
+		StarColor:   w.dht.GetLocalSystem().Stars.Primary.Color,
+		HealthClass: NodeHealth(w.dht.GetRoutingTable().GetRoutingTableSize()).CSSClass(),
+		Theme:       "dark",
+	}
+	switch theme := r.URL.Query().Get("theme"); theme {
+	case "", "dark":
+	case "light":
+		page.Theme = theme
+	default:
+		http.Error(rw, "theme must be dark or light", http.StatusBadRequest)
+		return
+	}
+	if v := r.URL.Query().Get("refresh"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || (n != 0 && (n < MinWidgetRefresh || n > MaxWidgetRefresh)) {
+			http.Error(rw, fmt.Sprintf("refresh must be 0 or %d to %d seconds", MinWidgetRefresh, MaxWidgetRefresh), http.StatusBadRequest)
+			return
+		}
+		page.Refresh = n
+	}
+
+	var buf bytes.Buffer
+	if err := widgetTemplate.Execute(&buf, page); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(rw)
+}
+
+var widgetTemplate = template.Must(template.New("widget").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}} - Stellar Lab</title>
+<style>
+    :root { --bg: #0a0a1a; --fg: #e0e0e0; --muted: #888; --border: rgba(255,255,255,0.1); }
+    .light { --bg: #f8f8fc; --fg: #1a1a3a; --muted: #666; --border: rgba(0,0,0,0.12); }
+    html, body { margin: 0; background: var(--bg); color: var(--fg); font: 13px/1.4 -apple-system, "Segoe UI", Roboto, sans-serif; }
+    .widget { padding: 10px 12px; border: 1px solid var(--border); border-radius: 8px; }
+    .name { font-weight: 600; font-size: 15px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; }
+    .glyph { font-size: 16px; margin-right: 4px; }
+    .row { display: flex; justify-content: space-between; margin-top: 4px; }
+    .label { color: var(--muted); }
+    .health-healthy { color: #4ade80; }
+    .health-warning { color: #facc15; }
+    .health-critical { color: #f87171; }
+    .light .health-healthy { color: #16a34a; }
+    .light .health-warning { color: #ca8a04; }
+    .light .health-critical { color: #dc2626; }
+</style>
+</head>
+<body class="{{.Theme}}">
+<div class="widget">
+    <div class="name"><span class="glyph" style="color: {{.StarColor}}">{{if eq .StarClass "X"}}◉{{else}}★{{end}}</span><span id="name">{{.Name}}</span> <span class="label" id="class">{{.StarClass}}</span></div>
+    <div class="row"><span class="label">Health</span><span id="health" class="{{.HealthClass}}">{{.Health}}</span></div>
+    <div class="row"><span class="label">Peers</span><span id="peers">{{.Peers}}</span></div>
+    <div class="row"><span class="label">Known systems</span><span id="known">{{.KnownSystems}}</span></div>
+    {{if .Rank}}<div class="row"><span class="label">Rank</span><span id="rank">{{.Rank}}</span></div>{{end}}
+</div>
+{{if .Refresh}}<script>
+    var healthClasses = {'Healthy': 'health-healthy', 'Low Connectivity': 'health-warning', 'Isolated': 'health-critical'};
+    setInterval(function () {
+        fetch('/api/widget-data').then(function (r) { return r.json(); }).then(function (d) {
+            document.getElementById('name').textContent = d.name;
+            document.getElementById('class').textContent = d.star_class;
+            var health = document.getElementById('health');
+            health.textContent = d.health;
+            health.className = healthClasses[d.health] || '';
+            document.getElementById('peers').textContent = d.peers;
+            document.getElementById('known').textContent = d.known_systems;
+            var rank = document.getElementById('rank');
+            if (rank && d.rank) rank.textContent = d.rank;
+        }).catch(function () {});
+    }, {{.Refresh}} * 1000);
+</script>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// CompressionThreshold is the smallest DHT message body worth gzipping
+	CompressionThreshold = 1024
+
+	// DefaultMaxMessageBytes bounds a DHT message body, counted after decompression,
+	// unless -max-message-kb says otherwise. Peers that don't advertise their limit
+	// (max_message_bytes) are taken to have this one
+	DefaultMaxMessageBytes = 1 << 20
+
+	// MinMaxMessageBytes is the smallest limit -max-message-kb allows: a find_node
+	// answer with K systems must always fit
+	MinMaxMessageBytes = 64 << 10
+
+	// TopTrafficPeers is how many peers /api/stats lists by traffic
+	TopTrafficPeers = 10
+)
+
+// WireSystem is a System as relayed in closest_nodes and alternatives: the gossiped
+// fields only. The web address and timestamps matter to nobody but the owner, and
+// peers decoding it as a System (older ones included) just see them empty
+type WireSystem struct {
+	ID            uuid.UUID       `json:"id"`
+	Name          string          `json:"name"`
+	X             float64         `json:"x"`
+	Y             float64         `json:"y"`
+	Z             float64         `json:"z"`
+	Stars         MultiStarSystem `json:"stars"`
+	PeerAddress   string          `json:"peer_address"`
+	SponsorID     *uuid.UUID      `json:"sponsor_id,omitempty"`
+	InfoVersion   int64           `json:"info_version"`
+	InfoSignature string          `json:"info_signature,omitempty"`
+	PeerTLS       bool            `json:"peer_tls,omitempty"`
+	CoordsVersion int             `json:"coords_version,omitempty"`
+	StarsVersion  int             `json:"stars_version,omitempty"`
+
+	GenesisDemotion *GenesisDemotion `json:"genesis_demotion,omitempty"`
+	Profile         *OperatorProfile `json:"profile,omitempty"`
+}
+
+// wireSystems slims systems for relaying (nil stays nil, so omitempty still applies)
+func wireSystems(systems []*System) []*WireSystem {
+	if len(systems) == 0 {
+		return nil
+	}
+	wire := make([]*WireSystem, len(systems))
+	for i, s := range systems {
+		wire[i] = &WireSystem{
+			ID:            s.ID,
+			Name:          s.Name,
+			X:             s.X,
+			Y:             s.Y,
+			Z:             s.Z,
+			Stars:         s.Stars,
+			PeerAddress:   s.PeerAddress,
+			SponsorID:     s.SponsorID,
+			InfoVersion:   s.InfoVersion,
+			InfoSignature: s.InfoSignature,
+			PeerTLS:       s.PeerTLS,
+			CoordsVersion: s.CoordsVersion,
+			StarsVersion:  s.StarsVersion,
+
+			GenesisDemotion: s.GenesisDemotion,
+			Profile:         s.Profile,
+		}
+	}
+	return wire
+}
+
+// MarshalJSON sends relayed systems as WireSystems; the sender's own FromSystem stays whole
+func (m DHTMessage) MarshalJSON() ([]byte, error) {
+	type plain DHTMessage // Without this method
+	return json.Marshal(struct {
+		plain
+		ClosestNodes []*WireSystem `json:"closest_nodes,omitempty"`
+		Alternatives []*WireSystem `json:"alternatives,omitempty"`
+	}{plain(m), wireSystems(m.ClosestNodes), wireSystems(m.Alternatives)})
+}
+
+// ErrMessageTooLarge is a DHT message over the limit of the node it's for
+var ErrMessageTooLarge = errors.New("message too large")
+
+// encodeDHTBody marshals a message, gzipped if allowed and it's over CompressionThreshold
+// A message over limit, counted before compression as the receiver counts it, isn't sent
+func encodeDHTBody(msg *DHTMessage, allowGzip bool, limit int) (data []byte, gzipped bool, err error) {
+	data, err = json.Marshal(msg)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) > limit {
+		kind := msg.Type
+		if msg.IsResponse {
+			kind += " response"
+		}
+		return nil, false, fmt.Errorf("%w: %s is %d bytes, over the %d accepted", ErrMessageTooLarge, kind, len(data), limit)
+	}
+	if !allowGzip || len(data) < CompressionThreshold {
+		return data, false, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, false, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// readDHTBody reads a DHT message body, decompressing it if encoding is gzip
+// Fails past limit bytes of decompressed data, so a small gzip bomb can't
+// blow up into memory
+func readDHTBody(body io.Reader, encoding string, limit int) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("message exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+// acceptsGzip reports whether a request's sender takes gzipped responses
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]), "gzip") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDHTBody sends a response encoded by encodeDHTBody
+func writeDHTBody(w http.ResponseWriter, data []byte, gzipped bool) error {
+	w.Header().Set("Content-Type", "application/json")
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingResponseWriter counts the body bytes written through it, and keeps the status
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int // 0 until WriteHeader is called
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// PeerTraffic is how many DHT message body bytes crossed the wire (compressed size)
+type PeerTraffic struct {
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	Messages      int64 `json:"messages"` // Requests and responses
+	LastExchange  int64 `json:"last_exchange,omitempty"`
+}
+
+// PeerTrafficEntry is one peer's traffic in a TrafficSummary
+type PeerTrafficEntry struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	PeerTraffic
+}
+
+// TrafficSummary is the traffic part of /api/stats
+type TrafficSummary struct {
+	PeerTraffic
+	Since int64              `json:"since"`
+	Peers []PeerTrafficEntry `json:"peers,omitempty"` // Top TopTrafficPeers by bytes
+}
+
+// trafficStats accounts DHT bytes per peer since startup
+type trafficStats struct {
+	mu    sync.Mutex
+	since time.Time
+	total PeerTraffic
+	peers map[uuid.UUID]*PeerTraffic
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{since: time.Now(), peers: make(map[uuid.UUID]*PeerTraffic)}
+}
+
+// record adds one exchange with a peer (uuid.Nil counts toward the total only)
+func (t *trafficStats) record(peer uuid.UUID, sent, received int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now().Unix()
+	t.total.BytesSent += sent
+	t.total.BytesReceived += received
+	t.total.Messages++
+	t.total.LastExchange = now
+	if peer == uuid.Nil {
+		return
+	}
+	p := t.peers[peer]
+	if p == nil {
+		p = &PeerTraffic{}
+		t.peers[peer] = p
+	}
+	p.BytesSent += sent
+	p.BytesReceived += received
+	p.Messages++
+	p.LastExchange = now
+}
+
+// forget drops the peers keep doesn't want (their bytes stay in the total)
+func (t *trafficStats) forget(keep func(uuid.UUID) bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id := range t.peers {
+		if !keep(id) {
+			delete(t.peers, id)
+		}
+	}
+}
+
+// PeerTraffic returns the DHT traffic exchanged with a peer since startup
+func (dht *DHT) PeerTraffic(id uuid.UUID) (PeerTraffic, bool) {
+	dht.traffic.mu.Lock()
+	defer dht.traffic.mu.Unlock()
+	if p, ok := dht.traffic.peers[id]; ok {
+		return *p, true
+	}
+	return PeerTraffic{}, false
+}
+
+// TrafficSummary returns the DHT traffic since startup and the peers with the most of it
+func (dht *DHT) TrafficSummary() TrafficSummary {
+	dht.traffic.mu.Lock()
+	summary := TrafficSummary{PeerTraffic: dht.traffic.total, Since: dht.traffic.since.Unix()}
+	for id, p := range dht.traffic.peers {
+		summary.Peers = append(summary.Peers, PeerTrafficEntry{ID: id.String(), PeerTraffic: *p})
+	}
+	dht.traffic.mu.Unlock()
+
+	sort.Slice(summary.Peers, func(i, j int) bool {
+		a, b := summary.Peers[i], summary.Peers[j]
+		if a.BytesSent+a.BytesReceived != b.BytesSent+b.BytesReceived {
+			return a.BytesSent+a.BytesReceived > b.BytesSent+b.BytesReceived
+		}
+		return a.ID < b.ID
+	})
+	if len(summary.Peers) > TopTrafficPeers {
+		summary.Peers = summary.Peers[:TopTrafficPeers]
+	}
+	for i := range summary.Peers {
+		if id, err := uuid.Parse(summary.Peers[i].ID); err == nil {
+			if sys := dht.routingTable.GetCachedSystem(id); sys != nil {
+				summary.Peers[i].Name = sys.Name
+			}
+		}
+	}
+	return summary
+}